@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessWindow limits when a key can be used. Days are day names ("mon" or "monday", empty means
+// every day), Start and End are "15:04" times in Timezone (an IANA name, UTC if empty). A window
+// that ends before it starts runs past midnight, its days are the days it starts on
+type AccessWindow struct {
+	Days     []string `bson:"days" json:"days"`
+	Start    string   `bson:"start" json:"start"`
+	End      string   `bson:"end" json:"end"`
+	Timezone string   `bson:"timezone" json:"timezone"`
+}
+
+const accessWindowTimeFormat = "15:04"
+
+// accessWindowLocation is a loaded window timezone, or the error it failed to load with
+type accessWindowLocation struct {
+	location *time.Location
+	err      error
+}
+
+// Windows are checked on every request, their timezones are only loaded from the zoneinfo database once
+var accessWindowLocations = struct {
+	sync.RWMutex
+	locations map[string]accessWindowLocation
+}{locations: make(map[string]accessWindowLocation)}
+
+func loadAccessWindowLocation(name string) (*time.Location, error) {
+	accessWindowLocations.RLock()
+	loaded, found := accessWindowLocations.locations[name]
+	accessWindowLocations.RUnlock()
+	if found {
+		return loaded.location, loaded.err
+	}
+
+	loaded.location, loaded.err = time.LoadLocation(name)
+	accessWindowLocations.Lock()
+	accessWindowLocations.locations[name] = loaded
+	accessWindowLocations.Unlock()
+
+	return loaded.location, loaded.err
+}
+
+// minutesOfDay parses a window time, an empty start is the start of the day and an empty end is the end
+func minutesOfDay(value string, empty int) (int, error) {
+	if value == "" {
+		return empty, nil
+	}
+
+	asTime, err := time.Parse(accessWindowTimeFormat, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return asTime.Hour()*60 + asTime.Minute(), nil
+}
+
+func (w AccessWindow) hasDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	dayName := strings.ToLower(day.String())
+	for _, name := range w.Days {
+		name = strings.ToLower(name)
+		if name == dayName || name == dayName[:3] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsOpen checks if the window is open at a point in time, an invalid window is never open
+func (w AccessWindow) IsOpen(now time.Time) bool {
+	location, err := loadAccessWindowLocation(w.Timezone)
+	if err != nil {
+		log.Error("Invalid access window timezone: ", err)
+		return false
+	}
+
+	start, err := minutesOfDay(w.Start, 0)
+	if err != nil {
+		log.Error("Invalid access window start: ", err)
+		return false
+	}
+
+	end, err := minutesOfDay(w.End, 24*60)
+	if err != nil {
+		log.Error("Invalid access window end: ", err)
+		return false
+	}
+
+	local := now.In(location)
+	minute := local.Hour()*60 + local.Minute()
+
+	if start <= end {
+		return w.hasDay(local.Weekday()) && minute >= start && minute < end
+	}
+
+	// Overnight, open from start on one of the days until end the next morning
+	if minute >= start {
+		return w.hasDay(local.Weekday())
+	}
+
+	return minute < end && w.hasDay(local.AddDate(0, 0, -1).Weekday())
+}
+
+// IsWithinAccessWindows checks the access windows of a session, a session without windows can
+// always be used
+func (s *SessionState) IsWithinAccessWindows(now time.Time) bool {
+	if len(s.AccessWindows) == 0 {
+		return true
+	}
+
+	for _, window := range s.AccessWindows {
+		if window.IsOpen(now) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessWindowBusinessHours(t *testing.T) {
+	window := AccessWindow{Days: []string{"mon", "Tuesday", "wed", "thu", "fri"}, Start: "09:00", End: "17:30", Timezone: "America/New_York"}
+	newYork, _ := time.LoadLocation("America/New_York")
+
+	// Monday 2016-02-01
+	if !window.IsOpen(time.Date(2016, 2, 1, 9, 0, 0, 0, newYork)) {
+		t.Error("Window should be open at the start time")
+	}
+
+	if window.IsOpen(time.Date(2016, 2, 1, 17, 30, 0, 0, newYork)) {
+		t.Error("Window should be closed at the end time")
+	}
+
+	if window.IsOpen(time.Date(2016, 2, 6, 12, 0, 0, 0, newYork)) {
+		t.Error("Window should be closed on Saturday")
+	}
+
+	// 14:00 UTC is 09:00 in New York
+	if !window.IsOpen(time.Date(2016, 2, 2, 14, 0, 0, 0, time.UTC)) {
+		t.Error("Window should use its timezone")
+	}
+}
+
+func TestAccessWindowDayNames(t *testing.T) {
+	// Monday 2016-02-01
+	monday := time.Date(2016, 2, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, name := range []string{"mon", "Monday", "MON"} {
+		if !(AccessWindow{Days: []string{name}}).IsOpen(monday) {
+			t.Error("Day name should match Monday: ", name)
+		}
+	}
+
+	for _, name := range []string{"monkey", "mo", "tue", ""} {
+		if (AccessWindow{Days: []string{name}}).IsOpen(monday) {
+			t.Error("Day name should not match Monday: ", name)
+		}
+	}
+}
+
+func TestAccessWindowOvernight(t *testing.T) {
+	window := AccessWindow{Days: []string{"fri"}, Start: "22:00", End: "06:00"}
+
+	if !window.IsOpen(time.Date(2016, 2, 5, 23, 0, 0, 0, time.UTC)) {
+		t.Error("Window should be open on Friday night")
+	}
+
+	if !window.IsOpen(time.Date(2016, 2, 6, 5, 59, 0, 0, time.UTC)) {
+		t.Error("Window should still be open on Saturday morning")
+	}
+
+	if window.IsOpen(time.Date(2016, 2, 5, 5, 0, 0, 0, time.UTC)) {
+		t.Error("Window should be closed on Friday morning")
+	}
+}
+
+func TestSessionAccessWindows(t *testing.T) {
+	thisSession := SessionState{}
+	if !thisSession.IsWithinAccessWindows(time.Now()) {
+		t.Error("Sessions without access windows should always be usable")
+	}
+
+	thisSession.AccessWindows = []AccessWindow{{Timezone: "Not/AZone"}}
+	if thisSession.IsWithinAccessWindows(time.Now()) {
+		t.Error("Invalid access windows should never be open")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"sync"
+	"time"
+)
+
+const (
+	ADAPTIVE_RATE_LIMIT_DEFAULT_REDUCTION = 0.5
+	ADAPTIVE_RATE_LIMIT_DEFAULT_MIN       = 0.1
+	ADAPTIVE_RATE_LIMIT_DEFAULT_RECOVERY  = 0.1
+)
+
+// AdaptiveRateLimitConfig scales the anonymous rate limit and the per-API key rate limits of an API
+// with the health of its upstream. Every health check interval the ceiling is multiplied by
+// ReductionFactor (down to MinFactor of the configured rate) while the p99 upstream latency is over
+// MaxLatency (ms) or
+// the upstream error rate is over MaxErrorRate (%), once both are back under their thresholds the
+// ceiling is raised by RecoveryStep of the configured rate per interval
+type AdaptiveRateLimitConfig struct {
+	Enabled         bool    `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	MaxLatency      float64 `mapstructure:"max_latency" bson:"max_latency" json:"max_latency"`
+	MaxErrorRate    float64 `mapstructure:"max_error_rate" bson:"max_error_rate" json:"max_error_rate"`
+	ReductionFactor float64 `mapstructure:"reduction_factor" bson:"reduction_factor" json:"reduction_factor"`
+	MinFactor       float64 `mapstructure:"min_factor" bson:"min_factor" json:"min_factor"`
+	RecoveryStep    float64 `mapstructure:"recovery_step" bson:"recovery_step" json:"recovery_step"`
+}
+
+type AdaptiveRateLimitModuleConfig struct {
+	AdaptiveRateLimit AdaptiveRateLimitConfig `mapstructure:"adaptive_rate_limit" bson:"adaptive_rate_limit" json:"adaptive_rate_limit"`
+}
+
+func GetAdaptiveRateLimitConfig(spec *APISpec) AdaptiveRateLimitConfig {
+	var thisModuleConfig AdaptiveRateLimitModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode adaptive rate limit configuration: ", err)
+	}
+
+	thisConfig := thisModuleConfig.AdaptiveRateLimit
+	if thisConfig.ReductionFactor <= 0 || thisConfig.ReductionFactor >= 1 {
+		thisConfig.ReductionFactor = ADAPTIVE_RATE_LIMIT_DEFAULT_REDUCTION
+	}
+	if thisConfig.MinFactor <= 0 || thisConfig.MinFactor > 1 {
+		thisConfig.MinFactor = ADAPTIVE_RATE_LIMIT_DEFAULT_MIN
+	}
+	if thisConfig.RecoveryStep <= 0 {
+		thisConfig.RecoveryStep = ADAPTIVE_RATE_LIMIT_DEFAULT_RECOVERY
+	}
+
+	return thisConfig
+}
+
+// isUnhealthy checks the health values against the thresholds, an API without traffic is healthy
+func (c AdaptiveRateLimitConfig) isUnhealthy(values HealthCheckValues) bool {
+	if values.AvgRequestsPS == 0 {
+		return false
+	}
+	if c.MaxLatency > 0 && values.LatencyP99 > c.MaxLatency {
+		return true
+	}
+	if c.MaxErrorRate > 0 && values.UpstreamErrorRate > c.MaxErrorRate {
+		return true
+	}
+
+	return false
+}
+
+// nextFactor is the share of the configured rate allowed in the next interval
+func (c AdaptiveRateLimitConfig) nextFactor(factor float64, values HealthCheckValues) float64 {
+	if c.isUnhealthy(values) {
+		factor *= c.ReductionFactor
+		if factor < c.MinFactor {
+			factor = c.MinFactor
+		}
+		return factor
+	}
+
+	factor += c.RecoveryStep
+	if factor > 1 {
+		factor = 1
+	}
+
+	return factor
+}
+
+// Factors are kept by API ID so a reload doesn't reset a throttled API
+var adaptiveRateFactors = make(map[string]float64)
+var adaptiveRateFactorsLock sync.RWMutex
+
+// getAdaptiveRateFactor is the share of the configured rate limits an API is allowed
+func getAdaptiveRateFactor(APIID string) float64 {
+	adaptiveRateFactorsLock.RLock()
+	defer adaptiveRateFactorsLock.RUnlock()
+
+	factor, found := adaptiveRateFactors[APIID]
+	if !found {
+		return 1
+	}
+
+	return factor
+}
+
+// adaptedRate scales a configured rate by the adaptive factor of an API, at least one request is
+// always allowed
+func adaptedRate(rate float64, APIID string) float64 {
+	rate *= getAdaptiveRateFactor(APIID)
+	if rate < 1 {
+		rate = 1
+	}
+
+	return rate
+}
+
+func adaptRateLimit(spec *APISpec) {
+	thisConfig := GetAdaptiveRateLimitConfig(spec)
+	if !thisConfig.Enabled {
+		adaptiveRateFactorsLock.Lock()
+		delete(adaptiveRateFactors, spec.APIID)
+		adaptiveRateFactorsLock.Unlock()
+		return
+	}
+
+	values, err := spec.Health.GetApiHealthValues()
+	if err != nil {
+		log.Error("Couldn't read health values for adaptive rate limit: ", err)
+		return
+	}
+
+	factor := getAdaptiveRateFactor(spec.APIID)
+	newFactor := thisConfig.nextFactor(factor, values)
+	if newFactor == factor {
+		return
+	}
+
+	if newFactor < factor {
+		log.Warning("Upstream of API ", spec.APIID, " is unhealthy (p99 latency: ", values.LatencyP99, "ms, errors: ", values.UpstreamErrorRate, "%), rate limit lowered to ", newFactor*100, "%")
+	} else {
+		log.Info("Upstream of API ", spec.APIID, " is recovering, rate limit raised to ", newFactor*100, "%")
+	}
+
+	adaptiveRateFactorsLock.Lock()
+	adaptiveRateFactors[spec.APIID] = newFactor
+	adaptiveRateFactorsLock.Unlock()
+}
+
+// StartAdaptiveRateLimitLoop re-evaluates the adaptive rate limits of the loaded APIs every interval
+// seconds, it needs health checks to be enabled
+func StartAdaptiveRateLimitLoop(interval int) {
+	if interval < 1 {
+		interval = HEALTH_CHECK_DEFAULT_FLUSH_INTERVAL
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		for _, spec := range getApiSpecs() {
+			adaptRateLimit(spec)
+		}
+	}
+}
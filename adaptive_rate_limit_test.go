@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+type testHealthChecker struct {
+	values HealthCheckValues
+}
+
+func (h *testHealthChecker) Init(StorageHandler) {}
+func (h *testHealthChecker) GetApiHealthValues() (HealthCheckValues, error) {
+	return h.values, nil
+}
+func (h *testHealthChecker) StoreCounterVal(HealthPrefix, string)    {}
+func (h *testHealthChecker) StoreMiddlewareTimings(map[string]int64) {}
+
+func TestAdaptiveRateLimitFactor(t *testing.T) {
+	thisConfig := AdaptiveRateLimitConfig{Enabled: true, MaxLatency: 200, MaxErrorRate: 5, ReductionFactor: 0.5, MinFactor: 0.2, RecoveryStep: 0.25}
+
+	slow := HealthCheckValues{AvgRequestsPS: 10, AvgUpstreamLatency: 100, LatencyP99: 500}
+	failing := HealthCheckValues{AvgRequestsPS: 10, LatencyP99: 50, UpstreamErrorRate: 20}
+	healthy := HealthCheckValues{AvgRequestsPS: 10, LatencyP99: 50, UpstreamErrorRate: 1}
+
+	factor := thisConfig.nextFactor(1, slow)
+	if factor != 0.5 {
+		t.Error("Slow upstream should halve the rate: ", factor)
+	}
+	factor = thisConfig.nextFactor(thisConfig.nextFactor(factor, failing), failing)
+	if factor != 0.2 {
+		t.Error("Rate shouldn't drop below the minimum: ", factor)
+	}
+
+	for i := 0; i < 3; i++ {
+		factor = thisConfig.nextFactor(factor, healthy)
+	}
+	if factor != 0.95 {
+		t.Error("Rate should recover step by step: ", factor)
+	}
+	if factor = thisConfig.nextFactor(factor, healthy); factor != 1 {
+		t.Error("Rate shouldn't recover past the configured rate: ", factor)
+	}
+
+	if thisConfig.isUnhealthy(HealthCheckValues{LatencyP99: 500}) {
+		t.Error("An API without traffic should be healthy")
+	}
+}
+
+func TestAdaptRateLimit(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"adaptive_rate_limit": {"enabled": true, "max_error_rate": 10},`, 1))
+	spec.Health = &testHealthChecker{values: HealthCheckValues{AvgRequestsPS: 5, UpstreamErrorRate: 50}}
+
+	adaptRateLimit(&spec)
+	if factor := getAdaptiveRateFactor(spec.APIID); factor != ADAPTIVE_RATE_LIMIT_DEFAULT_REDUCTION {
+		t.Error("Rate limit should be lowered: ", factor)
+	}
+
+	if rate := adaptedRate(100, spec.APIID); rate != 50 {
+		t.Error("Per-API rate should be lowered as well: ", rate)
+	}
+	if rate := adaptedRate(1, spec.APIID); rate != 1 {
+		t.Error("At least one request should be allowed: ", rate)
+	}
+
+	// Turning the adaptive mode off restores the configured rate
+	spec.APIDefinition.RawData = map[string]interface{}{}
+	adaptRateLimit(&spec)
+	if factor := getAdaptiveRateFactor(spec.APIID); factor != 1 {
+		t.Error("Rate limit should be restored: ", factor)
+	}
+}
+
+func TestUpstreamErrorHealthCount(t *testing.T) {
+	aggregate := newHealthAggregate(10)
+	aggregate.record(RequestLog, "20", 100)
+	aggregate.record(UpstreamError, "1", 100)
+
+	if counts := aggregate.snapshot(100); counts.UpstreamErrors != 1 || counts.Blocked != 0 {
+		t.Error("Upstream error wasn't counted: ", counts)
+	}
+}
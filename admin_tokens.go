@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+// Admin token scopes, the shared secret always has full access
+const (
+	AdminScopeFull     = "full"
+	AdminScopeReadOnly = "read-only"
+	AdminScopeKeys     = "keys-only"
+	AdminScopeAPIs     = "apis-only"
+)
+
+// AdminToken is an additional credential for the admin API with a limited scope, so that CI
+// systems don't need the shared secret
+type AdminToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	Scope string `json:"scope"`
+}
+
+// adminScopePaths lists the admin paths each narrow scope can use (with any method), a path
+// covers itself and everything below it
+var adminScopePaths = map[string][]string{
+	AdminScopeKeys: []string{"/tyk/keys"},
+	AdminScopeAPIs: []string{"/tyk/apis", "/tyk/reload", "/tyk/chain", "/tyk/openapi"},
+}
+
+// adminReadOnlyPaths are the endpoints a read-only token can GET, key listings and anything that
+// runs a reload or a trace on GET are left out
+var adminReadOnlyPaths = []string{
+	"/tyk/apis",
+	"/tyk/health",
+	"/tyk/usage",
+	"/tyk/cluster/nodes",
+	"/tyk/oauth/clients",
+}
+
+// IsValidAdminScope checks the scope of an admin token
+func IsValidAdminScope(scope string) bool {
+	switch scope {
+	case AdminScopeFull, AdminScopeReadOnly, AdminScopeKeys, AdminScopeAPIs:
+		return true
+	}
+
+	return false
+}
+
+// adminScopeAllows checks if a scope covers an admin call
+func adminScopeAllows(scope string, r *http.Request) bool {
+	switch scope {
+	case AdminScopeFull:
+		return true
+	case AdminScopeReadOnly:
+		if r.Method != "GET" && r.Method != "HEAD" {
+			return false
+		}
+		return adminPathCovered(r.URL.Path, adminReadOnlyPaths)
+	}
+
+	return adminPathCovered(r.URL.Path, adminScopePaths[scope])
+}
+
+// adminPathCovered checks if a path is one of the given paths or below one of them, so that
+// "/tyk/keys" doesn't cover "/tyk/keysearch"
+func adminPathCovered(path string, paths []string) bool {
+	for _, allowed := range paths {
+		if path == allowed || strings.HasPrefix(path, allowed+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isReadOnlyAdminCall checks if an admin call was made with a read-only token, secrets are
+// redacted from their responses
+func isReadOnlyAdminCall(r *http.Request) bool {
+	scope, _ := context.Get(r, AdminScope).(string)
+	return scope == AdminScopeReadOnly
+}
+
+// findAdminToken looks up a scoped admin token
+func findAdminToken(token string) (AdminToken, bool) {
+	for _, adminToken := range config.AdminTokens {
+		if adminToken.Token != "" && subtle.ConstantTimeCompare([]byte(adminToken.Token), []byte(token)) == 1 {
+			return adminToken, true
+		}
+	}
+
+	return AdminToken{}, false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScopedAdminTokens(t *testing.T) {
+	oldTokens := config.AdminTokens
+	config.AdminTokens = []AdminToken{
+		{Name: "ci-keys", Token: "keys-token", Scope: AdminScopeKeys},
+		{Name: "dashboard", Token: "read-token", Scope: AdminScopeReadOnly},
+		{Name: "ci-deploy", Token: "apis-token", Scope: AdminScopeAPIs},
+	}
+	defer func() { config.AdminTokens = oldTokens }()
+
+	var actor string
+	handler := CheckIsAPIOwner(func(w http.ResponseWriter, r *http.Request) {
+		actor, _ = context.Get(r, AdminActor).(string)
+		w.WriteHeader(200)
+	})
+
+	tests := []struct {
+		token  string
+		method string
+		path   string
+		code   int
+	}{
+		{"keys-token", "POST", "/tyk/keys/create", 200},
+		{"keys-token", "GET", "/tyk/apis/", 403},
+		{"read-token", "GET", "/tyk/apis/", 200},
+		{"read-token", "DELETE", "/tyk/keys/1234", 403},
+		{"read-token", "GET", "/tyk/keys/", 403},
+		{"read-token", "GET", "/tyk/reload/", 403},
+		{"read-token", "GET", "/tyk/debug", 403},
+		{"read-token", "GET", "/tyk/oauth/clients/1", 200},
+		{"keys-token", "GET", "/tyk/keysearch", 403},
+		{"apis-token", "POST", "/tyk/reload/group", 200},
+		{"apis-token", "GET", "/tyk/apisecrets", 403},
+		{"unknown", "GET", "/tyk/apis/", 403},
+		{config.Secret, "DELETE", "/tyk/apis/1", 200},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		req.Header.Set("X-Tyk-Authorization", test.token)
+		handler(recorder, req)
+
+		if recorder.Code != test.code {
+			t.Error(test.token, " ", test.method, " ", test.path, " should return ", test.code, ", got: ", recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/keys/", nil)
+	req.Header.Set("X-Tyk-Authorization", "keys-token")
+	req.Header.Set("X-Tyk-Actor", "someone-else")
+	handler(recorder, req)
+	if actor != "ci-keys" {
+		t.Error("Scoped tokens should be audited by name, got: ", actor)
+	}
+
+	var readOnly bool
+	readHandler := CheckIsAPIOwner(func(w http.ResponseWriter, r *http.Request) {
+		readOnly = isReadOnlyAdminCall(r)
+	})
+	req, _ = http.NewRequest("GET", "/tyk/oauth/clients/1", nil)
+	req.Header.Set("X-Tyk-Authorization", "read-token")
+	readHandler(httptest.NewRecorder(), req)
+	if !readOnly {
+		t.Error("Read-only token calls should be flagged so that secrets are redacted")
+	}
+
+	req, _ = http.NewRequest("GET", "/tyk/oauth/clients/1", nil)
+	req.Header.Set("X-Tyk-Authorization", config.Secret)
+	readHandler(httptest.NewRecorder(), req)
+	if readOnly {
+		t.Error("Calls with the shared secret should not be flagged as read-only")
+	}
+
+	if IsValidAdminScope("superuser") {
+		t.Error("Unknown scopes should be rejected")
+	}
+}
+
+func TestReloadRequiresPost(t *testing.T) {
+	for _, handler := range []func(http.ResponseWriter, *http.Request){resetHandler, groupResetHandler} {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/tyk/reload/", nil)
+		handler(recorder, req)
+
+		if recorder.Code != 405 {
+			t.Error("Reloads should not be triggered by a GET, got: ", recorder.Code)
+		}
+	}
+}
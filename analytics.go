@@ -31,6 +31,19 @@ type AnalyticsRecord struct {
 	RequestTime   int64
 	Tags          []string
 	ExpireAt      time.Time `bson:"expireAt" json:"expireAt"`
+
+	// MiddlewareTimings is the time in microseconds spent in each middleware, it is only set if
+	// enable_middleware_timings is on
+	MiddlewareTimings map[string]int64 `bson:"middleware_timings,omitempty" json:"middleware_timings,omitempty"`
+
+	// StreamDuration is how long an SSE client stayed connected in milliseconds, RequestTime only
+	// covers the time to the response headers for these requests
+	StreamDuration int64 `bson:"stream_duration,omitempty" json:"stream_duration,omitempty"`
+
+	// RequestSize and ResponseSize are the body bytes read from and written to the client, unlike
+	// ContentLength they are also set for chunked requests
+	RequestSize  int64 `bson:"request_size" json:"request_size"`
+	ResponseSize int64 `bson:"response_size" json:"response_size"`
 }
 
 const (
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -49,7 +51,7 @@ func DoJSONWrite(w http.ResponseWriter, code int, responseMessage []byte) {
 }
 
 func GetSpecForApi(APIID string) *APISpec {
-	spec, ok := ApiSpecRegister[APIID]
+	spec, ok := getApiSpecs()[APIID]
 	if !ok {
 		return nil
 	}
@@ -59,7 +61,8 @@ func GetSpecForApi(APIID string) *APISpec {
 
 func GetSpecForOrg(APIID string) *APISpec {
 	var aKey string
-	for k, v := range ApiSpecRegister {
+	specs := getApiSpecs()
+	for k, v := range specs {
 		if v.OrgID == APIID {
 			return v
 		}
@@ -67,7 +70,7 @@ func GetSpecForOrg(APIID string) *APISpec {
 	}
 
 	// If we can't find a spec, it doesn;t matter, because we default to Redis anyway, grab whatever you can find
-	return ApiSpecRegister[aKey]
+	return specs[aKey]
 }
 
 func doAddOrUpdate(keyName string, newSession SessionState, dontReset bool) error {
@@ -100,7 +103,7 @@ func doAddOrUpdate(keyName string, newSession SessionState, dontReset bool) erro
 		// nothing defined, add key to ALL
 		if config.AllowMasterKeys {
 			log.Warning("No API Access Rights set, adding key to ALL.")
-			for _, spec := range ApiSpecRegister {
+			for _, spec := range getApiSpecs() {
 				if !dontReset {
 					spec.SessionManager.ResetQuota(keyName, newSession)
 					newSession.QuotaRenews = time.Now().Unix() + newSession.QuotaRenewalRate
@@ -117,6 +120,8 @@ func doAddOrUpdate(keyName string, newSession SessionState, dontReset bool) erro
 
 	}
 
+	trackNewKey(keyName)
+
 	log.WithFields(logrus.Fields{
 		"key": keyName,
 	}).Debug("New key added or updated.")
@@ -152,6 +157,31 @@ func handleAddOrUpdate(keyName string, r *http.Request) ([]byte, int) {
 			}
 
 		}
+
+		if !IsValidQuotaAlgorithm(newSession.QuotaAlgorithm) {
+			return createError("Unknown quota_algorithm: " + newSession.QuotaAlgorithm), 400
+		}
+
+		if newSession.State != "" && !IsValidKeyState(newSession.State) {
+			return createError("Unknown key state: " + newSession.State), 400
+		}
+
+		// Custom keys can be created with a POST, they must not collide with an existing key
+		if r.Method == "POST" {
+			claimed, claimErr := claimKey(keyName, newSession)
+			if claimErr != nil {
+				log.Error("Couldn't create key: ", claimErr)
+				return createError("Failed to create key - " + claimErr.Error()), 500
+			}
+
+			if !claimed {
+				log.WithFields(logrus.Fields{
+					"key": keyName,
+				}).Warning("Attempted to create a key that already exists.")
+				return createError("Key already exists, use PUT to update it"), 409
+			}
+		}
+
 		dont_reset := r.FormValue("suppress_reset")
 		var suppress_reset bool = false
 
@@ -207,6 +237,10 @@ func handleGetDetail(sessionKey string, APIID string) ([]byte, int) {
 	if !ok {
 		success = false
 	} else {
+		if KeyUsage != nil {
+			thisSession.LastUsed = KeyUsage.LastUsed(sessionKey)
+		}
+
 		responseMessage, err = json.Marshal(&thisSession)
 		if err != nil {
 			log.Error("Marshalling failed: ", err)
@@ -253,7 +287,7 @@ func handleGetAllKeys(filter string, APIID string) ([]byte, int) {
 
 	fixed_sessions := make([]string, 0)
 	for _, s := range sessions {
-		if !strings.Contains(s, QuotaKeyPrefix) {
+		if !strings.Contains(s, QuotaKeyPrefix) && !strings.Contains(s, ORG_CONFIG_KEY_PREFIX) {
 			if !strings.Contains(s, RateLimitKeyPrefix) {
 				fixed_sessions = append(fixed_sessions, s)
 			}
@@ -290,7 +324,7 @@ func handleDeleteKey(keyName string, APIID string) ([]byte, int) {
 
 	if APIID == "-1" {
 		// Go through ALL managed API's and delete the key
-		for _, spec := range ApiSpecRegister {
+		for _, spec := range getApiSpecs() {
 			spec.SessionManager.RemoveSession(keyName)
 		}
 
@@ -332,7 +366,7 @@ func handleDeleteHashedKey(keyName string, APIID string) ([]byte, int) {
 
 	if APIID == "-1" {
 		// Go through ALL managed API's and delete the key
-		for _, spec := range ApiSpecRegister {
+		for _, spec := range getApiSpecs() {
 			spec.SessionManager.RemoveSession(keyName)
 		}
 
@@ -355,6 +389,9 @@ func handleDeleteHashedKey(keyName string, APIID string) ([]byte, int) {
 	// TODO: This is pretty ugly
 	setKeyName := "apikey-" + keyName
 	sessStore.DeleteRawKey(setKeyName)
+	if KeyMetadataIndex != nil {
+		KeyMetadataIndex.removeMember(keyName)
+	}
 	code := 200
 
 	statusObj := APIModifyKeySuccess{keyName, "ok", "deleted"}
@@ -424,11 +461,12 @@ func HandleGetAPIList() ([]byte, int) {
 	var err error
 
 	var thisAPIIDList []tykcommon.APIDefinition
-	thisAPIIDList = make([]tykcommon.APIDefinition, len(ApiSpecRegister))
+	specs := getApiSpecs()
+	thisAPIIDList = make([]tykcommon.APIDefinition, len(specs))
 
 	c := 0
-	for _, apiSpec := range ApiSpecRegister {
-		thisAPIIDList[c] = apiSpec.APIDefinition
+	for _, apiSpec := range specs {
+		thisAPIIDList[c] = apiSpec.UnresolvedDefinition
 		thisAPIIDList[c].RawData = nil
 		c++
 	}
@@ -447,10 +485,10 @@ func HandleGetAPI(APIID string) ([]byte, int) {
 	var responseMessage []byte
 	var err error
 
-	for _, apiSpec := range ApiSpecRegister {
+	for _, apiSpec := range getApiSpecs() {
 		if apiSpec.APIDefinition.APIID == APIID {
 
-			responseMessage, err = json.Marshal(apiSpec.APIDefinition)
+			responseMessage, err = json.Marshal(apiSpec.UnresolvedDefinition)
 
 			if err != nil {
 				log.Error("Marshalling failed: ", err)
@@ -581,6 +619,11 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
+	if strings.HasSuffix(APIID, "/state") {
+		apiStateHandler(strings.TrimSuffix(APIID, "/state"), w, r)
+		return
+	}
+
 	log.Debug(r.Method)
 	if r.Method == "GET" {
 		if APIID != "" {
@@ -654,6 +697,25 @@ func keyHandler(w http.ResponseWriter, r *http.Request) {
 		responseMessage = createError("Method not supported")
 	}
 
+	// Cached copies of the key on other nodes are now stale
+	if code == 200 && r.Method == "DELETE" && keyName != "" {
+		namespace := ""
+		if thisSpec := GetSpecForApi(APIID); thisSpec != nil {
+			namespace = storageKeyNamespace(thisSpec.SessionManager.GetStore())
+		}
+		keyHash := keyName
+		if r.FormValue("hashed") == "" {
+			keyHash = publicHash(keyName)
+		}
+		broadcastTokenRevoked(namespace, keyHash, "")
+	} else if code == 200 && r.Method != "GET" {
+		if r.FormValue("hashed") != "" {
+			notifyKeySpaceChanged(keyName)
+		} else if keyName != "" {
+			notifyKeySpaceChanged(publicHash(keyName))
+		}
+	}
+
 	DoJSONWrite(w, code, responseMessage)
 }
 
@@ -681,7 +743,54 @@ func policyUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		responseMessage, code = handleUpdateHashedKey(keyName, APIID, policRecord.Policy)
+		if code == 200 {
+			notifyKeySpaceChanged(keyName)
+		}
+
+	} else {
+		// Return Not supported message (and code)
+		code = 405
+		responseMessage = createError("Method not supported")
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
+
+// KeyStateChangeObj is the request body for a key state transition
+type KeyStateChangeObj struct {
+	State string `json:"state"`
+}
+
+// APIKeyStateMessage reports the workflow state of a key
+type APIKeyStateMessage struct {
+	Key   string `json:"key"`
+	State string `json:"state"`
+}
+
+func keyStateHandler(w http.ResponseWriter, r *http.Request) {
+	keyName := r.URL.Path[len("/tyk/keys/state/"):]
+	APIID := r.FormValue("api_id")
+	var responseMessage []byte
+	var code int
+
+	if r.Method == "GET" {
+		responseMessage, code = handleGetKeyState(keyName, APIID)
+	} else if r.Method == "PUT" || r.Method == "POST" {
+		decoder := json.NewDecoder(r.Body)
+		var stateRecord KeyStateChangeObj
+		err := decoder.Decode(&stateRecord)
 
+		if err != nil {
+			decodeFail := APIStatusMessage{"error", "Couldn't decode instruction"}
+			responseMessage, _ = json.Marshal(&decodeFail)
+			DoJSONWrite(w, 400, responseMessage)
+			return
+		}
+
+		responseMessage, code = handleKeyStateChange(keyName, APIID, stateRecord.State)
+		if code == 200 {
+			notifyKeySpaceChanged(publicHash(keyName))
+		}
 	} else {
 		// Return Not supported message (and code)
 		code = 405
@@ -691,6 +800,259 @@ func policyUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	DoJSONWrite(w, code, responseMessage)
 }
 
+// keySuspensionHandler suspends (POST) and resumes (DELETE) a key without deleting it, it is a
+// shortcut for moving the key between the active and suspended states
+func keySuspensionHandler(w http.ResponseWriter, r *http.Request) {
+	keyName := r.URL.Path[len("/tyk/keys/suspend/"):]
+	APIID := r.FormValue("api_id")
+	var responseMessage []byte
+	var code int
+
+	switch r.Method {
+	case "POST":
+		responseMessage, code = handleKeyStateChange(keyName, APIID, KeyStateSuspended)
+	case "DELETE":
+		responseMessage, code = handleKeyStateChange(keyName, APIID, KeyStateActive)
+	case "GET":
+		responseMessage, code = handleGetKeyState(keyName, APIID)
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if code == 200 && r.Method != "GET" {
+		notifyKeySpaceChanged(publicHash(keyName))
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
+
+func handleGetKeyState(keyName string, APIID string) ([]byte, int) {
+	if keyName == "" {
+		return createError("No key specified"), 400
+	}
+
+	thiSpec := GetSpecForApi(APIID)
+	if thiSpec == nil {
+		return createError("API not found"), 400
+	}
+
+	thisSession, ok := thiSpec.SessionManager.GetSessionDetail(keyName)
+	if !ok {
+		return createError("Key not found"), 404
+	}
+
+	responseMessage, err := json.Marshal(&APIKeyStateMessage{keyName, thisSession.GetKeyState()})
+	if err != nil {
+		log.Error("Marshalling failed: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	return responseMessage, 200
+}
+
+func handleKeyStateChange(keyName string, APIID string, newState string) ([]byte, int) {
+	if keyName == "" {
+		return createError("No key specified"), 400
+	}
+
+	if !IsValidKeyState(newState) {
+		return createError("Unknown key state: " + newState), 400
+	}
+
+	thiSpec := GetSpecForApi(APIID)
+	if thiSpec == nil {
+		return createError("API not found"), 400
+	}
+
+	thisSession, ok := thiSpec.SessionManager.GetSessionDetail(keyName)
+	if !ok {
+		return createError("Key not found"), 404
+	}
+
+	oldState := thisSession.GetKeyState()
+	if !IsValidKeyStateTransition(oldState, newState) {
+		return createError("Key can't be moved from " + oldState + " to " + newState), 409
+	}
+
+	thisSession.State = newState
+	err := thiSpec.SessionManager.UpdateSession(keyName, thisSession, thiSpec.SessionLifetime)
+	if err != nil {
+		log.Error("Could not update key state: ", err)
+		return createError("Could not write key data"), 500
+	}
+
+	log.WithFields(logrus.Fields{
+		"key":  keyName,
+		"from": oldState,
+		"to":   newState,
+	}).Info("Key state changed.")
+
+	go thiSpec.FireEvent(EVENT_KeyStateChanged,
+		EVENT_KeyStateChangedMeta{
+			EventMetaDefault: EventMetaDefault{Message: "Key state changed."},
+			Key:              keyName,
+			OldState:         oldState,
+			NewState:         newState,
+		})
+
+	responseMessage, encErr := json.Marshal(&APIModifyKeySuccess{keyName, "ok", newState})
+	if encErr != nil {
+		log.Error("Could not create response message: ", encErr)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	return responseMessage, 200
+}
+
+// revokedKeyHandler manages the token revocation list, POST revokes a key (with an optional ttl
+// query parameter in seconds), DELETE removes it from the list and GET reports if it is revoked
+func revokedKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyName := r.URL.Path[len("/tyk/keys/revoked/"):]
+	var responseMessage []byte
+	var code int
+
+	if TokenRevocations == nil {
+		DoJSONWrite(w, 400, createError("Token revocation is not enabled"))
+		return
+	}
+
+	if keyName == "" {
+		DoJSONWrite(w, 400, createError("Key not specified"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		action := "active"
+		if TokenRevocations.IsRevoked(keyName) {
+			action = "revoked"
+		}
+		responseMessage, _ = json.Marshal(&APIModifyKeySuccess{keyName, "ok", action})
+		code = 200
+	case "POST":
+		var ttl int64
+		if ttlStr := r.FormValue("ttl"); ttlStr != "" {
+			var convErr error
+			ttl, convErr = strconv.ParseInt(ttlStr, 10, 64)
+			if convErr != nil {
+				DoJSONWrite(w, 400, createError("Invalid ttl"))
+				return
+			}
+		}
+
+		if err := TokenRevocations.Revoke(keyName, ttl); err != nil {
+			log.Error("Failed to revoke key: ", err)
+			DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+			return
+		}
+
+		broadcastTokenRevoked("", publicHash(keyName), tokenRevocationHash(keyName))
+
+		log.WithFields(logrus.Fields{
+			"key": keyName,
+		}).Info("Key revoked.")
+
+		responseMessage, _ = json.Marshal(&APIModifyKeySuccess{keyName, "ok", "revoked"})
+		code = 200
+	case "DELETE":
+		TokenRevocations.Unrevoke(keyName)
+		responseMessage, _ = json.Marshal(&APIModifyKeySuccess{keyName, "ok", "unrevoked"})
+		code = 200
+	default:
+		// Return Not supported message (and code)
+		code = 405
+		responseMessage = createError("Method not supported")
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
+
+// usageHandler returns the hourly usage rollups, from and to are hours in YYYYMMDDHH format (UTC) and
+// default to the last 24 hours, api_id and key filter the results and format=csv returns a CSV file.
+// group_by=org returns the totals of each organisation instead, filtered by org_id
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if Metering == nil {
+		DoJSONWrite(w, 400, createError("Usage metering is not enabled"))
+		return
+	}
+
+	if r.Method != "GET" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	to := time.Now().UTC()
+	if toStr := r.FormValue("to"); toStr != "" {
+		var parseErr error
+		to, parseErr = time.Parse(USAGE_HOUR_FORMAT, toStr)
+		if parseErr != nil {
+			DoJSONWrite(w, 400, createError("Invalid to hour, use YYYYMMDDHH"))
+			return
+		}
+	}
+
+	from := to.Add(-23 * time.Hour)
+	if fromStr := r.FormValue("from"); fromStr != "" {
+		var parseErr error
+		from, parseErr = time.Parse(USAGE_HOUR_FORMAT, fromStr)
+		if parseErr != nil {
+			DoJSONWrite(w, 400, createError("Invalid from hour, use YYYYMMDDHH"))
+			return
+		}
+	}
+
+	if to.Before(from) || to.Sub(from) > 31*24*time.Hour {
+		DoJSONWrite(w, 400, createError("Invalid range, at most 31 days can be requested"))
+		return
+	}
+
+	if r.FormValue("group_by") == "org" {
+		orgUsageHandler(w, r, Metering.GetOrgUsageRange(from, to, r.FormValue("org_id")))
+		return
+	}
+
+	usage := Metering.GetUsageRange(from, to, r.FormValue("api_id"), r.FormValue("key"))
+
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(200)
+		if err := WriteUsageCSV(csv.NewWriter(w), usage); err != nil {
+			log.Error("Failed to write usage CSV: ", err)
+		}
+		return
+	}
+
+	responseMessage, err := json.Marshal(usage)
+	if err != nil {
+		log.Error("Failed to encode usage: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
+
+func orgUsageHandler(w http.ResponseWriter, r *http.Request, usage []OrgUsageRecord) {
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(200)
+		if err := WriteOrgUsageCSV(csv.NewWriter(w), usage); err != nil {
+			log.Error("Failed to write usage CSV: ", err)
+		}
+		return
+	}
+
+	responseMessage, err := json.Marshal(usage)
+	if err != nil {
+		log.Error("Failed to encode usage: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
+
 func handleUpdateHashedKey(keyName string, APIID string, policyId string) ([]byte, int) {
 	var responseMessage []byte
 	var err error
@@ -715,7 +1077,7 @@ func handleUpdateHashedKey(keyName string, APIID string, policyId string) ([]byt
 	}
 
 	sess := SessionState{}
-	jsErr := json.Unmarshal([]byte(rawSessionData), &sess)
+	jsErr := decodeSession(rawSessionData, &sess)
 	if jsErr != nil {
 		notFound := APIStatusMessage{"error", "Unmarshalling failed"}
 		responseMessage, _ = json.Marshal(&notFound)
@@ -725,14 +1087,14 @@ func handleUpdateHashedKey(keyName string, APIID string, policyId string) ([]byt
 	// Set the policy
 	sess.ApplyPolicyID = policyId
 
-	sessAsJS, encErr := json.Marshal(sess)
+	sessAsJS, encErr := encodeSession(sess)
 	if encErr != nil {
 		notFound := APIStatusMessage{"error", "Marshalling failed"}
 		responseMessage, _ = json.Marshal(&notFound)
 		return responseMessage, 400
 	}
 
-	setErr := sessStore.SetRawKey(setKeyName, string(sessAsJS), 0)
+	setErr := sessStore.SetRawKey(setKeyName, sessAsJS, 0)
 	if setErr != nil {
 		notFound := APIStatusMessage{"error", "Could not write key data"}
 		responseMessage, _ = json.Marshal(&notFound)
@@ -785,6 +1147,10 @@ func orgHandler(w http.ResponseWriter, r *http.Request) {
 		responseMessage = createError("Method not supported")
 	}
 
+	if code == 200 && r.Method != "GET" {
+		notifyOrgChanged(keyName)
+	}
+
 	DoJSONWrite(w, code, responseMessage)
 }
 
@@ -923,7 +1289,7 @@ func handleGetAllOrgKeys(filter, ORGID string) ([]byte, int) {
 	sessions := thiSpec.OrgSessionManager.GetSessions(filter)
 	fixed_sessions := make([]string, 0)
 	for _, s := range sessions {
-		if !strings.Contains(s, QuotaKeyPrefix) {
+		if !strings.Contains(s, QuotaKeyPrefix) && !strings.Contains(s, ORG_CONFIG_KEY_PREFIX) {
 			if !strings.Contains(s, RateLimitKeyPrefix) {
 				fixed_sessions = append(fixed_sessions, s)
 			}
@@ -980,7 +1346,7 @@ func groupResetHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
-	if r.Method == "GET" {
+	if r.Method == "POST" {
 		log.Info("Group reload: sending to channel")
 		responseMessage, code = signalGroupReload()
 
@@ -997,7 +1363,7 @@ func resetHandler(w http.ResponseWriter, r *http.Request) {
 	var responseMessage []byte
 	var code int
 
-	if r.Method == "GET" {
+	if r.Method == "POST" {
 		responseMessage, code = handleURLReload()
 
 	} else {
@@ -1039,8 +1405,18 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 			log.Error("Couldn't decode body: ", err)
 
 		} else {
+			if !IsValidQuotaAlgorithm(newSession.QuotaAlgorithm) {
+				DoJSONWrite(w, 400, createError("Unknown quota_algorithm: "+newSession.QuotaAlgorithm))
+				return
+			}
+
+			newKey, genErr := generateUniqueKey(newSession)
+			if genErr != nil {
+				log.Error("Failed to generate key: ", genErr)
+				DoJSONWrite(w, 500, createError("Failed to create key - "+genErr.Error()))
+				return
+			}
 
-			newKey := keyGen.GenerateAuthKey(newSession.OrgID)
 			if newSession.HMACEnabled {
 				newSession.HmacSecret = keyGen.GenerateHMACSecret()
 			}
@@ -1074,7 +1450,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 				if config.AllowMasterKeys {
 					// nothing defined, add key to ALL
 					log.Warning("No API Access Rights set, adding key to ALL.")
-					for _, spec := range ApiSpecRegister {
+					for _, spec := range getApiSpecs() {
 						if !spec.DontSetQuotasOnCreate {
 							// Reset quote by default
 							spec.SessionManager.ResetQuota(newKey, newSession)
@@ -1126,6 +1502,7 @@ func createKeyHandler(w http.ResponseWriter, r *http.Request) {
 type NewClientRequest struct {
 	ClientRedirectURI string `json:"redirect_uri"`
 	APIID             string `json:"api_id"`
+	Public            bool   `json:"public"`
 }
 
 func createOauthClientStorageID(APIID string, clientID string) string {
@@ -1154,6 +1531,10 @@ func createOauthClient(w http.ResponseWriter, r *http.Request) {
 		cleanSting := strings.Replace(u5.String(), "-", "", -1)
 		u5Secret, err := uuid.NewV4()
 		secret := base64.StdEncoding.EncodeToString([]byte(u5Secret.String()))
+		if newOauthClient.Public {
+			// Public clients can't keep a secret, they have to use PKCE instead
+			secret = ""
+		}
 
 		newClient := osin.DefaultClient{
 			Id:          cleanSting,
@@ -1227,12 +1608,14 @@ func oAuthClientHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "GET" {
+		// Read-only admin tokens don't get to see client secrets
+		redactSecrets := isReadOnlyAdminCall(r)
 		if keyName != "" {
 			// Return single client detail
-			responseMessage, code = getOauthClientDetails(keyName, apiID)
+			responseMessage, code = getOauthClientDetails(keyName, apiID, redactSecrets)
 		} else {
 			// Return list of keys
-			responseMessage, code = getOauthClients(apiID)
+			responseMessage, code = getOauthClients(apiID, redactSecrets)
 		}
 
 	} else if r.Method == "DELETE" {
@@ -1249,7 +1632,7 @@ func oAuthClientHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Get client details
-func getOauthClientDetails(keyName string, APIID string) ([]byte, int) {
+func getOauthClientDetails(keyName string, APIID string, redactSecret bool) ([]byte, int) {
 	success := true
 	var responseMessage []byte
 	var err error
@@ -1276,6 +1659,9 @@ func getOauthClientDetails(keyName string, APIID string) ([]byte, int) {
 			ClientSecret:      thisClientData.GetSecret(),
 			ClientRedirectURI: thisClientData.GetRedirectUri(),
 		}
+		if redactSecret {
+			reportableClientData.ClientSecret = ""
+		}
 		responseMessage, err = json.Marshal(&reportableClientData)
 		if err != nil {
 			log.Error("Marshalling failed: ", err)
@@ -1344,7 +1730,7 @@ func handleDeleteOAuthClient(keyName string, APIID string) ([]byte, int) {
 }
 
 // List Clients
-func getOauthClients(APIID string) ([]byte, int) {
+func getOauthClients(APIID string, redactSecrets bool) ([]byte, int) {
 	success := true
 	var responseMessage []byte
 	var err error
@@ -1375,6 +1761,9 @@ func getOauthClients(APIID string) ([]byte, int) {
 				ClientSecret:      osinClient.GetSecret(),
 				ClientRedirectURI: osinClient.GetRedirectUri(),
 			}
+			if redactSecrets {
+				reportableClientData.ClientSecret = ""
+			}
 			clients = append(clients, reportableClientData)
 		}
 
@@ -1440,6 +1829,39 @@ func healthCheckhandler(w http.ResponseWriter, r *http.Request) {
 	DoJSONWrite(w, code, responseMessage)
 }
 
+func chainHandler(w http.ResponseWriter, r *http.Request) {
+	APIID := r.URL.Path[len("/tyk/chain/"):]
+	var responseMessage []byte
+	var code int = 200
+	var jsonErr error
+
+	if r.Method == "GET" {
+		if APIID != "" {
+			thisAPISpec := GetSpecForApi(APIID)
+			if thisAPISpec != nil {
+				responseMessage, jsonErr = json.Marshal(DescribeAPIChain(thisAPISpec))
+			} else {
+				code = 404
+				responseMessage = createError("API ID not found")
+			}
+		} else {
+			responseMessage, jsonErr = json.Marshal(DescribeAllAPIChains())
+		}
+
+		if jsonErr != nil {
+			log.Error("Failed to encode chain data: ", jsonErr)
+			code = 500
+			responseMessage = []byte(E_SYSTEM_ERROR)
+		}
+	} else {
+		// Return Not supported message (and code)
+		code = 405
+		responseMessage = createError("Method not supported")
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
+
 func UserRatesCheck() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		code := 200
@@ -1473,3 +1895,42 @@ func UserRatesCheck() func(http.ResponseWriter, *http.Request) {
 		return
 	}
 }
+
+// openAPIHandler returns the draft OpenAPI document learned from an API's traffic, DELETE resets it
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	APIID := r.URL.Path[len("/tyk/openapi/"):]
+	var responseMessage []byte
+	var code int = 200
+
+	if APIID == "" {
+		DoJSONWrite(w, 400, createError("API ID not specified"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		thisDocument, found := LearnedAPIs.GenerateDocument(APIID)
+		if !found {
+			code = 404
+			responseMessage = createError("No traffic has been learned for this API")
+			break
+		}
+
+		var jsonErr error
+		responseMessage, jsonErr = json.Marshal(thisDocument)
+		if jsonErr != nil {
+			log.Error("Failed to encode OpenAPI document: ", jsonErr)
+			code = 500
+			responseMessage = []byte(E_SYSTEM_ERROR)
+		}
+	case "DELETE":
+		LearnedAPIs.Reset(APIID)
+		responseMessage, _ = json.Marshal(&APIStatusMessage{"ok", "Learned traffic removed"})
+	default:
+		// Return Not supported message (and code)
+		code = 405
+		responseMessage = createError("Method not supported")
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
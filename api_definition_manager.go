@@ -117,6 +117,19 @@ type APISpec struct {
 	JSVM              *JSVM
 	ResponseChain     *[]TykResponseHandler
 	RoundRobin        *RoundRobin
+	MiddlewareChain   []ChainObject
+	OpenAPILearning   bool
+	LogMasking        *LogMasking
+	State             *APIState
+	ListenPathMatcher *ListenPathMatcher
+	Streaming         *StreamingSpec
+	SSE               *StreamingSpec
+	DRL               bool
+	Analytics         *RedisAnalyticsHandler
+	// The definition as it was loaded, with its secret references. It is what the API returns
+	UnresolvedDefinition tykcommon.APIDefinition
+	SecretsErr           error
+	StreamingErr         error
 }
 
 // APIDefinitionLoader will load an Api definition from a storage system. It has two methods LoadDefinitionsFromMongo()
@@ -139,8 +152,12 @@ func (a *APIDefinitionLoader) Connect() {
 // MakeSpec will generate a flattened URLSpec from and APIDefinitions' VersionInfo data. paths are
 // keyed to the Api version name, which is determined during routing to speed up lookups
 func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) APISpec {
+	resolvedAppConfig, secretsErr := resolveAPIDefinitionSecrets(thisAppConfig)
+
 	newAppSpec := APISpec{}
-	newAppSpec.APIDefinition = thisAppConfig
+	newAppSpec.APIDefinition = resolvedAppConfig
+	newAppSpec.UnresolvedDefinition = thisAppConfig
+	newAppSpec.SecretsErr = secretsErr
 
 	// We'll push the default HealthChecker:
 	newAppSpec.Health = &DefaultHealthChecker{
@@ -162,25 +179,40 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 	if newAppSpec.APIDefinition.SessionProvider.Name != "" {
 		switch newAppSpec.APIDefinition.SessionProvider.Name {
 		case DefaultSessionProvider:
-			newAppSpec.SessionManager = &DefaultSessionManager{}
+			newAppSpec.SessionManager = &DefaultSessionManager{CacheSessions: config.LocalSessionCache.Enabled, IndexMetadata: true}
 			newAppSpec.OrgSessionManager = &DefaultSessionManager{}
 		default:
-			newAppSpec.SessionManager = &DefaultSessionManager{}
+			newAppSpec.SessionManager = &DefaultSessionManager{CacheSessions: config.LocalSessionCache.Enabled, IndexMetadata: true}
 			newAppSpec.OrgSessionManager = &DefaultSessionManager{}
 		}
 	} else {
-		newAppSpec.SessionManager = &DefaultSessionManager{}
+		newAppSpec.SessionManager = &DefaultSessionManager{CacheSessions: config.LocalSessionCache.Enabled, IndexMetadata: true}
 		newAppSpec.OrgSessionManager = &DefaultSessionManager{}
 	}
 
 	// Create and init the virtual Machine
 	newAppSpec.JSVM = &JSVM{}
 	newAppSpec.JSVM.Init(config.TykJSPath)
+	newAppSpec.JSVM.Storage = NewJSVMStorage(newAppSpec.APIID)
+	newAppSpec.JSVM.LoadSpecData(&newAppSpec)
+	newAppSpec.OpenAPILearning = GetOpenAPILearningConfig(&newAppSpec).Enabled
+	newAppSpec.LogMasking = NewLogMasking(&newAppSpec)
+	newAppSpec.State = NewAPIState(&newAppSpec)
+
+	listenPathMatcher, listenPathErr := NewListenPathMatcher(newAppSpec.Proxy.ListenPath)
+	if listenPathErr != nil {
+		log.Error("Couldn't compile listen path of API ", newAppSpec.APIID, ": ", listenPathErr)
+	}
+	newAppSpec.ListenPathMatcher = listenPathMatcher
+	newAppSpec.Streaming = NewStreamingSpec(&newAppSpec)
+	newAppSpec.SSE = NewSSESpec(&newAppSpec)
+	newAppSpec.StreamingErr = checkStreamingConfig(&newAppSpec)
+	newAppSpec.DRL = GetDRLConfig(&newAppSpec).Enabled
 
 	// Set up Event Handlers
 	log.Debug("INITIALISING EVENT HANDLERS")
 	newAppSpec.EventPaths = make(map[tykcommon.TykEvent][]TykEventHandler)
-	for eventName, eventHandlerConfs := range thisAppConfig.EventHandlers.Events {
+	for eventName, eventHandlerConfs := range newAppSpec.APIDefinition.EventHandlers.Events {
 		log.Debug("FOUND EVENTS TO INIT")
 		for _, handlerConf := range eventHandlerConfs {
 			log.Debug("CREATING EVENT HANDLERS")
@@ -198,7 +230,7 @@ func (a *APIDefinitionLoader) MakeSpec(thisAppConfig tykcommon.APIDefinition) AP
 
 	newAppSpec.RxPaths = make(map[string][]URLSpec)
 	newAppSpec.WhiteListEnabled = make(map[string]bool)
-	for _, v := range thisAppConfig.VersionData.Versions {
+	for _, v := range newAppSpec.APIDefinition.VersionData.Versions {
 		var pathSpecs []URLSpec
 		var whiteListSpecs bool
 
@@ -848,7 +880,7 @@ func (a *APISpec) getVersionFromRequest(r *http.Request) string {
 
 	} else if a.APIDefinition.VersionDefinition.Location == "url" {
 		thisURL := r.URL.String()
-		thisURL = strings.Replace(thisURL, a.Proxy.ListenPath, "", 1)
+		thisURL = a.StripListenPath(thisURL)
 
 		// Assume first param is the version ID
 		firstParamEndsAt := strings.Index(thisURL, "/")
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"github.com/nu7hatch/gouuid"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,14 +17,24 @@ const (
 	KeyFailure        HealthPrefix = "KeyFailure"
 	RequestLog        HealthPrefix = "Request"
 	BlockedRequestLog HealthPrefix = "BlockedRequest"
+	UpstreamError     HealthPrefix = "UpstreamError"
+	RequestBytes      HealthPrefix = "RequestBytes"
+	ResponseBytes     HealthPrefix = "ResponseBytes"
+	ServerError       HealthPrefix = "ServerError"
 
 	HealthCheckRedisPrefix string = "apihealth"
 )
 
+const (
+	HEALTH_CHECK_DEFAULT_WINDOW         = 60
+	HEALTH_CHECK_DEFAULT_FLUSH_INTERVAL = 5
+)
+
 type HealthChecker interface {
 	Init(StorageHandler)
 	GetApiHealthValues() (HealthCheckValues, error)
 	StoreCounterVal(HealthPrefix, string)
+	StoreMiddlewareTimings(map[string]int64)
 }
 
 type HealthCheckValues struct {
@@ -30,11 +43,220 @@ type HealthCheckValues struct {
 	KeyFailuresPS       float64 `bson:"key_failures_per_second,omitempty" json:"key_failures_per_second"`
 	AvgUpstreamLatency  float64 `bson:"average_upstream_latency,omitempty" json:"average_upstream_latency"`
 	AvgRequestsPS       float64 `bson:"average_requests_per_second,omitempty" json:"average_requests_per_second"`
+	QuotaViolations     int64   `bson:"quota_violations,omitempty" json:"quota_violations"`
+	ThrottleRate        float64 `bson:"throttle_rate,omitempty" json:"throttle_rate"`
+	ErrorRate           float64 `bson:"error_rate,omitempty" json:"error_rate"`
+	UpstreamErrorRate   float64 `bson:"upstream_error_rate,omitempty" json:"upstream_error_rate"`
+	ServerErrorRate     float64 `bson:"server_error_rate,omitempty" json:"server_error_rate"`
+	TotalRequests       int64   `bson:"total_requests,omitempty" json:"total_requests"`
+	Window              int64   `bson:"window,omitempty" json:"window"`
+
+	// AvgMiddlewareLatency is the average time in milliseconds spent in each middleware
+	AvgMiddlewareLatency map[string]float64 `bson:"average_middleware_latency,omitempty" json:"average_middleware_latency,omitempty"`
+
+	// Body sizes in bytes, averages are per request (blocked ones included)
+	BytesInPS       float64 `bson:"bytes_in_per_second,omitempty" json:"bytes_in_per_second"`
+	BytesOutPS      float64 `bson:"bytes_out_per_second,omitempty" json:"bytes_out_per_second"`
+	AvgRequestSize  float64 `bson:"average_request_size,omitempty" json:"average_request_size"`
+	AvgResponseSize float64 `bson:"average_response_size,omitempty" json:"average_response_size"`
+
+	// Upstream latency percentiles in milliseconds
+	LatencyP50 float64 `bson:"latency_p50,omitempty" json:"latency_p50"`
+	LatencyP95 float64 `bson:"latency_p95,omitempty" json:"latency_p95"`
+	LatencyP99 float64 `bson:"latency_p99,omitempty" json:"latency_p99"`
 }
 
-type DefaultHealthChecker struct {
+// HealthCounts are the raw counters of an API over the rolling window, each node flushes its own
+// counts to Redis so the health values cover the whole cluster
+type HealthCounts struct {
+	Requests        int64 `json:"requests"`
+	Blocked         int64 `json:"blocked"`
+	Throttled       int64 `json:"throttled"`
+	QuotaViolations int64 `json:"quota_violations"`
+	KeyFailures     int64 `json:"key_failures"`
+	LatencyTotal    int64 `json:"latency_total"`
+	UpstreamErrors  int64 `json:"upstream_errors"`
+	ServerErrors    int64 `json:"server_errors"`
+	BytesIn         int64 `json:"bytes_in"`
+	BytesOut        int64 `json:"bytes_out"`
+
+	// LatencyBuckets is a histogram of the upstream latencies, see latencyBucket
+	LatencyBuckets map[string]int64 `json:"latency_buckets,omitempty"`
+
+	// Middleware times are totals in microseconds by middleware name
+	MiddlewareTime  map[string]int64 `json:"middleware_time,omitempty"`
+	MiddlewareCount map[string]int64 `json:"middleware_count,omitempty"`
+}
+
+func (c *HealthCounts) Add(other HealthCounts) {
+	c.Requests += other.Requests
+	c.Blocked += other.Blocked
+	c.Throttled += other.Throttled
+	c.QuotaViolations += other.QuotaViolations
+	c.KeyFailures += other.KeyFailures
+	c.LatencyTotal += other.LatencyTotal
+	c.UpstreamErrors += other.UpstreamErrors
+	c.ServerErrors += other.ServerErrors
+	c.BytesIn += other.BytesIn
+	c.BytesOut += other.BytesOut
+
+	for bucket, count := range other.LatencyBuckets {
+		c.addLatency(bucket, count)
+	}
+
+	for name, micros := range other.MiddlewareTime {
+		c.addMiddlewareTime(name, micros, other.MiddlewareCount[name])
+	}
+}
+
+func (c *HealthCounts) addLatency(bucket string, count int64) {
+	if c.LatencyBuckets == nil {
+		c.LatencyBuckets = make(map[string]int64)
+	}
+
+	c.LatencyBuckets[bucket] += count
+}
+
+func (c *HealthCounts) addMiddlewareTime(name string, micros int64, count int64) {
+	if c.MiddlewareTime == nil {
+		c.MiddlewareTime = make(map[string]int64)
+		c.MiddlewareCount = make(map[string]int64)
+	}
+
+	c.MiddlewareTime[name] += micros
+	c.MiddlewareCount[name] += count
+}
+
+type healthBucket struct {
+	second int64
+	counts HealthCounts
+}
+
+// healthAggregate keeps one bucket per second of the window, buckets are reused as the window rolls
+type healthAggregate struct {
+	sync.Mutex
 	storage StorageHandler
-	APIID   string
+	window  int64
+	buckets []healthBucket
+}
+
+func newHealthAggregate(window int64) *healthAggregate {
+	if window < 1 {
+		window = HEALTH_CHECK_DEFAULT_WINDOW
+	}
+
+	return &healthAggregate{window: window, buckets: make([]healthBucket, window)}
+}
+
+// bucketFor returns the bucket of the current second, the lock must be held
+func (a *healthAggregate) bucketFor(now int64) *healthBucket {
+	bucket := &a.buckets[now%a.window]
+	if bucket.second != now {
+		bucket.second = now
+		bucket.counts = HealthCounts{}
+	}
+
+	return bucket
+}
+
+func (a *healthAggregate) record(counterType HealthPrefix, value string, now int64) {
+	a.Lock()
+	defer a.Unlock()
+
+	bucket := a.bucketFor(now)
+
+	switch counterType {
+	case RequestLog:
+		bucket.counts.Requests++
+		latency, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Error("Couldn't convert tracked latency value to Int, vl is: ", value)
+			return
+		}
+		bucket.counts.LatencyTotal += latency
+		bucket.counts.addLatency(strconv.Itoa(latencyBucket(latency)), 1)
+	case BlockedRequestLog:
+		bucket.counts.Blocked++
+	case Throttle:
+		bucket.counts.Throttled++
+	case QuotaViolation:
+		bucket.counts.QuotaViolations++
+	case KeyFailure:
+		bucket.counts.KeyFailures++
+	case UpstreamError:
+		bucket.counts.UpstreamErrors++
+	case ServerError:
+		bucket.counts.ServerErrors++
+	case RequestBytes, ResponseBytes:
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Error("Couldn't convert tracked size value to Int, vl is: ", value)
+			return
+		}
+		if counterType == RequestBytes {
+			bucket.counts.BytesIn += size
+		} else {
+			bucket.counts.BytesOut += size
+		}
+	}
+}
+
+func (a *healthAggregate) recordMiddlewareTimings(timings map[string]int64, now int64) {
+	a.Lock()
+	defer a.Unlock()
+
+	bucket := a.bucketFor(now)
+	for name, micros := range timings {
+		bucket.counts.addMiddlewareTime(name, micros, 1)
+	}
+}
+
+func (a *healthAggregate) snapshot(now int64) HealthCounts {
+	a.Lock()
+	defer a.Unlock()
+
+	counts := HealthCounts{}
+	for _, bucket := range a.buckets {
+		if now-bucket.second < a.window {
+			counts.Add(bucket.counts)
+		}
+	}
+
+	return counts
+}
+
+// Aggregates are kept by API ID so the counters survive a reload
+var apiHealth = make(map[string]*healthAggregate)
+var apiHealthLock sync.Mutex
+
+func getHealthAggregate(APIID string) *healthAggregate {
+	apiHealthLock.Lock()
+	defer apiHealthLock.Unlock()
+
+	aggregate, found := apiHealth[APIID]
+	if !found {
+		aggregate = newHealthAggregate(config.HealthCheck.HealthCheckValueTimeout)
+		apiHealth[APIID] = aggregate
+	}
+
+	return aggregate
+}
+
+var localHealthNodeID, _ = uuid.NewV4()
+
+// healthCheckNodeID names this node's health entries, the node registry ID is used if there is one
+func healthCheckNodeID() string {
+	if Nodes != nil {
+		return Nodes.ID
+	}
+
+	return localHealthNodeID.String()
+}
+
+type DefaultHealthChecker struct {
+	storage   StorageHandler
+	APIID     string
+	aggregate *healthAggregate
 }
 
 func (h *DefaultHealthChecker) Init(storeType StorageHandler) {
@@ -44,49 +266,35 @@ func (h *DefaultHealthChecker) Init(storeType StorageHandler) {
 
 	h.storage = storeType
 	h.storage.Connect()
-}
-
-func (h *DefaultHealthChecker) CreateKeyName(subKey HealthPrefix) string {
-	var newKey string
-	now := time.Now().UnixNano()
 
-	// Key should be API-ID.SubKey.123456789
-	newKey = strings.Join([]string{h.APIID, string(subKey), strconv.FormatInt(now, 10)}, ".")
+	h.aggregate = getHealthAggregate(h.APIID)
+	h.aggregate.Lock()
+	h.aggregate.storage = storeType
+	h.aggregate.Unlock()
+}
 
-	return newKey
+func (h *DefaultHealthChecker) CreateKeyName(nodeID string) string {
+	// Key should be API-ID.Node-ID
+	return strings.Join([]string{h.APIID, nodeID}, ".")
 }
 
 // ReportHealthCheckValue is a shortcut we can use throughout the app to push a health check value
 func ReportHealthCheckValue(checker HealthChecker, counter HealthPrefix, value string) {
-	// TODO: Wrap this in a conditional so it can be deactivated
-	go checker.StoreCounterVal(counter, value)
+	checker.StoreCounterVal(counter, value)
 }
 
+// StoreCounterVal counts a value in memory, counts are written to Redis by the flush loop
 func (h *DefaultHealthChecker) StoreCounterVal(counterType HealthPrefix, value string) {
-	if config.HealthCheck.EnableHealthChecks {
-		searchStr := h.CreateKeyName(counterType)
-		log.Debug("Adding Healthcheck to: ", searchStr)
-		go h.storage.SetKey(searchStr, value, config.HealthCheck.HealthCheckValueTimeout)
+	if config.HealthCheck.EnableHealthChecks && h.aggregate != nil {
+		h.aggregate.record(counterType, value, time.Now().Unix())
 	}
 }
 
-func (h *DefaultHealthChecker) getAvgCount(prefix HealthPrefix) float64 {
-	searchStr := strings.Join([]string{h.APIID, string(prefix)}, ".")
-	log.Debug("Searching for: ", searchStr)
-	keys := h.storage.GetKeys(searchStr)
-	log.Debug("Found ", keys)
-	var count int64
-	count = int64(len(keys))
-	divisor := float64(config.HealthCheck.HealthCheckValueTimeout)
-	if divisor == 0 {
-		log.Warning("The Health Check sample timeout is set to 0, samples will never be deleted!!!")
-		divisor = 60.0
-	}
-	if count > 0 {
-		return roundValue(float64(count) / divisor)
+// StoreMiddlewareTimings counts the time each middleware took for a request
+func (h *DefaultHealthChecker) StoreMiddlewareTimings(timings map[string]int64) {
+	if config.HealthCheck.EnableHealthChecks && h.aggregate != nil && len(timings) > 0 {
+		h.aggregate.recordMiddlewareTimings(timings, time.Now().Unix())
 	}
-
-	return 0.00
 }
 
 func roundValue(untruncated float64) float64 {
@@ -95,32 +303,118 @@ func roundValue(untruncated float64) float64 {
 	return truncated
 }
 
+// GetApiHealthValues adds up the counts of this node and the counts other nodes have flushed
 func (h *DefaultHealthChecker) GetApiHealthValues() (HealthCheckValues, error) {
 	values := HealthCheckValues{}
+	if h.aggregate == nil {
+		return values, nil
+	}
 
-	// Get the counted / average values
-	values.ThrottledRequestsPS = h.getAvgCount(Throttle)
-	values.QuotaViolationsPS = h.getAvgCount(QuotaViolation)
-	values.KeyFailuresPS = h.getAvgCount(KeyFailure)
-	values.AvgRequestsPS = h.getAvgCount(RequestLog)
+	counts := h.aggregate.snapshot(time.Now().Unix())
 
-	// Get the micro latency graph, an average upstream latency
-	searchStr := strings.Join([]string{h.APIID, string(RequestLog)}, ".")
+	ownKey := h.CreateKeyName(healthCheckNodeID())
+	searchStr := h.APIID + "."
 	log.Debug("Searching KV for: ", searchStr)
-	kv := h.storage.GetKeysAndValuesWithFilter(searchStr)
-	log.Debug("Found: ", kv)
-	var runningTotal int
-	if len(kv) > 0 {
-		for _, v := range kv {
-			vInt, cErr := strconv.Atoi(v)
-			if cErr != nil {
-				log.Error("Couldn't convert tracked latency value to Int, vl is: ")
-			} else {
-				runningTotal += vInt
+	for keyName, v := range h.storage.GetKeysAndValuesWithFilter(searchStr) {
+		if keyName == ownKey || !strings.HasPrefix(keyName, searchStr) {
+			continue
+		}
+
+		nodeCounts := HealthCounts{}
+		if err := json.Unmarshal([]byte(v), &nodeCounts); err != nil {
+			log.Error("Couldn't decode health check counts: ", err)
+			continue
+		}
+		counts.Add(nodeCounts)
+	}
+
+	window := float64(h.aggregate.window)
+	values.Window = h.aggregate.window
+	values.ThrottledRequestsPS = roundValue(float64(counts.Throttled) / window)
+	values.QuotaViolationsPS = roundValue(float64(counts.QuotaViolations) / window)
+	values.KeyFailuresPS = roundValue(float64(counts.KeyFailures) / window)
+	values.AvgRequestsPS = roundValue(float64(counts.Requests) / window)
+	values.QuotaViolations = counts.QuotaViolations
+	values.BytesInPS = roundValue(float64(counts.BytesIn) / window)
+	values.BytesOutPS = roundValue(float64(counts.BytesOut) / window)
+
+	if counts.Requests > 0 {
+		values.AvgUpstreamLatency = roundValue(float64(counts.LatencyTotal) / float64(counts.Requests))
+
+		percentiles := latencyPercentiles(counts.LatencyBuckets, 50, 95, 99)
+		values.LatencyP50 = roundValue(percentiles[0])
+		values.LatencyP95 = roundValue(percentiles[1])
+		values.LatencyP99 = roundValue(percentiles[2])
+	}
+
+	if len(counts.MiddlewareTime) > 0 {
+		values.AvgMiddlewareLatency = make(map[string]float64)
+		for name, micros := range counts.MiddlewareTime {
+			if counts.MiddlewareCount[name] > 0 {
+				values.AvgMiddlewareLatency[name] = roundValue(float64(micros) / 1000 / float64(counts.MiddlewareCount[name]))
 			}
 		}
-		values.AvgUpstreamLatency = roundValue(float64(runningTotal / len(kv)))
+	}
+
+	// Rates are percentages of all requests, blocked ones included
+	total := counts.Requests + counts.Blocked
+	values.TotalRequests = total
+	if total > 0 {
+		values.ThrottleRate = roundValue(float64(counts.Throttled) * 100 / float64(total))
+		values.ErrorRate = roundValue(float64(counts.Blocked) * 100 / float64(total))
+		values.UpstreamErrorRate = roundValue(float64(counts.UpstreamErrors) * 100 / float64(total))
+		values.ServerErrorRate = roundValue(float64(counts.ServerErrors) * 100 / float64(total))
+		values.AvgRequestSize = roundValue(float64(counts.BytesIn) / float64(total))
+		values.AvgResponseSize = roundValue(float64(counts.BytesOut) / float64(total))
 	}
 
 	return values, nil
 }
+
+// flushHealthChecks writes this node's counts for every loaded API
+func flushHealthChecks() {
+	nodeID := healthCheckNodeID()
+
+	apiHealthLock.Lock()
+	aggregates := make(map[string]*healthAggregate, len(apiHealth))
+	for APIID, aggregate := range apiHealth {
+		if GetSpecForApi(APIID) != nil {
+			aggregates[APIID] = aggregate
+		}
+	}
+	apiHealthLock.Unlock()
+
+	now := time.Now().Unix()
+	for APIID, aggregate := range aggregates {
+		aggregate.Lock()
+		storage := aggregate.storage
+		aggregate.Unlock()
+
+		if storage == nil {
+			continue
+		}
+
+		asJSON, err := json.Marshal(aggregate.snapshot(now))
+		if err != nil {
+			log.Error("Couldn't encode health check counts: ", err)
+			continue
+		}
+
+		keyName := strings.Join([]string{APIID, nodeID}, ".")
+		if err := storage.SetKey(keyName, string(asJSON), aggregate.window); err != nil {
+			log.Error("Failed to flush health check counts: ", err)
+		}
+	}
+}
+
+// StartHealthCheckFlushLoop periodically writes the in-memory health counts to Redis
+func StartHealthCheckFlushLoop(interval int) {
+	if interval < 1 {
+		interval = HEALTH_CHECK_DEFAULT_FLUSH_INTERVAL
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		flushHealthChecks()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHealthAggregateRollingWindow(t *testing.T) {
+	aggregate := newHealthAggregate(10)
+
+	aggregate.record(RequestLog, "20", 100)
+	aggregate.record(RequestLog, "40", 105)
+	aggregate.record(Throttle, "1", 105)
+
+	counts := aggregate.snapshot(105)
+	if counts.Requests != 2 || counts.LatencyTotal != 60 || counts.Throttled != 1 {
+		t.Error("Counts are wrong: ", counts)
+	}
+
+	// The first request has left the window
+	counts = aggregate.snapshot(110)
+	if counts.Requests != 1 || counts.LatencyTotal != 40 {
+		t.Error("Expired bucket was counted: ", counts)
+	}
+
+	// Bucket is reused a full window later
+	aggregate.record(BlockedRequestLog, "1", 115)
+	counts = aggregate.snapshot(115)
+	if counts.Requests != 0 || counts.Blocked != 1 || counts.Throttled != 0 {
+		t.Error("Reused bucket was not reset: ", counts)
+	}
+}
+
+func TestHealthCheckValues(t *testing.T) {
+	enabled := config.HealthCheck.EnableHealthChecks
+	config.HealthCheck.EnableHealthChecks = true
+	defer func() { config.HealthCheck.EnableHealthChecks = enabled }()
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	checker := &DefaultHealthChecker{APIID: "health-test-api"}
+	checker.Init(store)
+	checker.aggregate = newHealthAggregate(10)
+
+	ReportHealthCheckValue(checker, RequestLog, "30")
+	ReportHealthCheckValue(checker, RequestLog, "10")
+	ReportHealthCheckValue(checker, BlockedRequestLog, "1")
+	ReportHealthCheckValue(checker, QuotaViolation, "1")
+
+	// Counts flushed by another node
+	store.SetKey("health-test-api.other-node", `{"requests": 5, "blocked": 1, "throttled": 1, "latency_total": 60}`, 0)
+
+	values, _ := checker.GetApiHealthValues()
+	if values.AvgUpstreamLatency != 14.28 {
+		t.Error("Average latency is wrong: ", values.AvgUpstreamLatency)
+	}
+
+	if values.ErrorRate != 22.22 || values.ThrottleRate != 11.11 {
+		t.Error("Rates are wrong: ", values.ErrorRate, values.ThrottleRate)
+	}
+
+	if values.QuotaViolations != 1 || values.AvgRequestsPS != 0.7 || values.Window != 10 {
+		t.Error("Health values are wrong: ", values)
+	}
+}
+
+func TestHealthMiddlewareLatency(t *testing.T) {
+	enabled := config.HealthCheck.EnableHealthChecks
+	config.HealthCheck.EnableHealthChecks = true
+	defer func() { config.HealthCheck.EnableHealthChecks = enabled }()
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	checker := &DefaultHealthChecker{APIID: "health-mw-api"}
+	checker.Init(store)
+	checker.aggregate = newHealthAggregate(10)
+
+	checker.StoreMiddlewareTimings(map[string]int64{"AuthKey": 1000, "TransformMiddleware": 500})
+	checker.StoreMiddlewareTimings(map[string]int64{"AuthKey": 3000})
+
+	// Timings flushed by another node
+	store.SetKey("health-mw-api.other-node", `{"middleware_time": {"AuthKey": 2000}, "middleware_count": {"AuthKey": 1}}`, 0)
+
+	values, _ := checker.GetApiHealthValues()
+	if values.AvgMiddlewareLatency["AuthKey"] != 2 || values.AvgMiddlewareLatency["TransformMiddleware"] != 0.5 {
+		t.Error("Middleware latency is wrong: ", values.AvgMiddlewareLatency)
+	}
+}
+
+func TestHealthTrafficSizes(t *testing.T) {
+	enabled := config.HealthCheck.EnableHealthChecks
+	config.HealthCheck.EnableHealthChecks = true
+	defer func() { config.HealthCheck.EnableHealthChecks = enabled }()
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	checker := &DefaultHealthChecker{APIID: "health-size-api"}
+	checker.Init(store)
+	checker.aggregate = newHealthAggregate(10)
+
+	ReportHealthCheckValue(checker, RequestLog, "10")
+	ReportHealthCheckValue(checker, RequestBytes, "100")
+	ReportHealthCheckValue(checker, ResponseBytes, "1000")
+	ReportHealthCheckValue(checker, BlockedRequestLog, "1")
+	ReportHealthCheckValue(checker, ResponseBytes, "50")
+
+	// Sizes flushed by another node
+	store.SetKey("health-size-api.other-node", `{"requests": 2, "bytes_in": 200, "bytes_out": 950}`, 0)
+
+	values, _ := checker.GetApiHealthValues()
+	if values.AvgRequestSize != 75 || values.AvgResponseSize != 500 {
+		t.Error("Average sizes are wrong: ", values.AvgRequestSize, values.AvgResponseSize)
+	}
+	if values.BytesInPS != 30 || values.BytesOutPS != 200 {
+		t.Error("Byte rates are wrong: ", values.BytesInPS, values.BytesOutPS)
+	}
+}
+
+func TestHealthLatencyPercentiles(t *testing.T) {
+	enabled := config.HealthCheck.EnableHealthChecks
+	config.HealthCheck.EnableHealthChecks = true
+	defer func() { config.HealthCheck.EnableHealthChecks = enabled }()
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	checker := &DefaultHealthChecker{APIID: "health-percentile-api"}
+	checker.Init(store)
+	checker.aggregate = newHealthAggregate(10)
+
+	for i := 0; i < 90; i++ {
+		ReportHealthCheckValue(checker, RequestLog, "20")
+	}
+
+	// The slow requests were served by another node
+	store.SetKey("health-percentile-api.other-node", `{"requests": 10, "latency_total": 10000, "latency_buckets": {"`+strconv.Itoa(latencyBucket(1000))+`": 10}}`, 0)
+
+	values, _ := checker.GetApiHealthValues()
+	if values.LatencyP50 != 20 {
+		t.Error("p50 is wrong: ", values.LatencyP50)
+	}
+	if values.LatencyP95 < 970 || values.LatencyP95 > 1030 || values.LatencyP99 != values.LatencyP95 {
+		t.Error("Slow requests should set p95 and p99: ", values.LatencyP95, values.LatencyP99)
+	}
+}
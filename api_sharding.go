@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/mitchellh/mapstructure"
+)
+
+// APITagsModuleConfig holds the tags of an API definition, segmented nodes (db_app_conf_options)
+// only load the APIs that share one of their tags. Mongo and RPC filter the definitions before
+// they reach the node, definitions from local sources are filtered when they are loaded
+type APITagsModuleConfig struct {
+	Tags []string `mapstructure:"tags" bson:"tags" json:"tags"`
+}
+
+func GetAPITags(spec *APISpec) []string {
+	var thisModuleConfig APITagsModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode API tags: ", err)
+	}
+
+	return thisModuleConfig.Tags
+}
+
+// nodeServesAPI checks if the API has one of the tags of this node, nodes that aren't segmented
+// serve all APIs
+func nodeServesAPI(spec *APISpec) bool {
+	if !config.DBAppConfOptions.NodeIsSegmented {
+		return true
+	}
+
+	for _, apiTag := range GetAPITags(spec) {
+		for _, nodeTag := range config.DBAppConfOptions.Tags {
+			if apiTag == nodeTag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// filterSegmentedSpecs drops the APIs this node doesn't serve
+func filterSegmentedSpecs(APISpecs []APISpec) []APISpec {
+	if !config.DBAppConfOptions.NodeIsSegmented {
+		return APISpecs
+	}
+
+	log.Info("Segmented node, loading: ", config.DBAppConfOptions.Tags)
+	servedSpecs := []APISpec{}
+	for i := range APISpecs {
+		if !nodeServesAPI(&APISpecs[i]) {
+			log.Debug("Skipping API ", APISpecs[i].APIID, ", it has none of the tags of this node")
+			continue
+		}
+		servedSpecs = append(servedSpecs, APISpecs[i])
+	}
+
+	return servedSpecs
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterSegmentedSpecs(t *testing.T) {
+	edgeSpec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"api_id": "maintenance1",`, `"api_id": "edge1", "tags": ["edge", "eu"],`, 1))
+	internalSpec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"api_id": "maintenance1",`, `"api_id": "internal1", "tags": ["internal"],`, 1))
+	untaggedSpec := createDefinitionFromString(maintenanceDefinition)
+	specs := []APISpec{edgeSpec, internalSpec, untaggedSpec}
+
+	oldOptions := config.DBAppConfOptions
+	defer func() { config.DBAppConfOptions = oldOptions }()
+
+	config.DBAppConfOptions.NodeIsSegmented = false
+	if len(filterSegmentedSpecs(specs)) != 3 {
+		t.Error("Nodes that aren't segmented should serve all APIs")
+	}
+
+	config.DBAppConfOptions.NodeIsSegmented = true
+	config.DBAppConfOptions.Tags = []string{"eu"}
+	servedSpecs := filterSegmentedSpecs(specs)
+	if len(servedSpecs) != 1 || servedSpecs[0].APIID != "edge1" {
+		t.Error("Only APIs with a tag of the node should be served: ", len(servedSpecs))
+	}
+
+	config.DBAppConfOptions.Tags = []string{}
+	if len(filterSegmentedSpecs(specs)) != 0 {
+		t.Error("Segmented nodes without tags shouldn't serve any APIs")
+	}
+}
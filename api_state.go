@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// State changes made with /tyk/apis/{id}/state are kept in Redis under this prefix so they apply to
+// all nodes and survive reloads, until they are cleared the definition's active flag is ignored
+const (
+	API_STATE_KEY_PREFIX          = "apistate."
+	API_MAINTENANCE_DEFAULT_ERROR = "This API is down for maintenance, please try again later."
+)
+
+// APIStateStore is nil until the gateway has connected to Redis
+var APIStateStore StorageHandler
+
+// APIStateModuleConfig takes an API out of service without deleting it, requests get a 503 with
+// maintenance_message (or a default message) rendered by the error template
+type APIStateModuleConfig struct {
+	Active             *bool  `mapstructure:"active" bson:"active" json:"active"`
+	MaintenanceMessage string `mapstructure:"maintenance_message" bson:"maintenance_message" json:"maintenance_message"`
+}
+
+// APIState is the maintenance switch of a loaded API, a nil APIState is always active
+type APIState struct {
+	inactive           int32
+	MaintenanceMessage string
+}
+
+// APIStateMessage is returned by /tyk/apis/{id}/state
+type APIStateMessage struct {
+	APIID  string `json:"api_id"`
+	Active bool   `json:"active"`
+}
+
+func GetAPIStateConfig(spec *APISpec) APIStateModuleConfig {
+	var thisModuleConfig APIStateModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode API state configuration: ", err)
+	}
+
+	return thisModuleConfig
+}
+
+// getAPIStateOverride returns the state set through the API, found is false if there is none
+func getAPIStateOverride(APIID string) (bool, bool) {
+	if APIStateStore == nil {
+		return false, false
+	}
+
+	value, err := APIStateStore.GetKey(APIID)
+	if err != nil {
+		return false, false
+	}
+
+	active, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, false
+	}
+
+	return active, true
+}
+
+// NewAPIState sets up the state of an API from its definition and any state set through the API
+func NewAPIState(spec *APISpec) *APIState {
+	thisModuleConfig := GetAPIStateConfig(spec)
+
+	thisState := &APIState{MaintenanceMessage: thisModuleConfig.MaintenanceMessage}
+	if thisState.MaintenanceMessage == "" {
+		thisState.MaintenanceMessage = API_MAINTENANCE_DEFAULT_ERROR
+	}
+
+	active := thisModuleConfig.Active == nil || *thisModuleConfig.Active
+	if override, found := getAPIStateOverride(spec.APIID); found {
+		active = override
+	}
+	thisState.SetActive(active)
+
+	return thisState
+}
+
+func (s *APIState) IsActive() bool {
+	return s == nil || atomic.LoadInt32(&s.inactive) == 0
+}
+
+func (s *APIState) SetActive(active bool) {
+	var inactive int32
+	if !active {
+		inactive = 1
+	}
+
+	atomic.StoreInt32(&s.inactive, inactive)
+}
+
+// MaintenanceHandler answers all requests of an API that is down for maintenance with a 503
+func MaintenanceHandler(tykMiddleware *TykMiddleware, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		thisState := tykMiddleware.Spec.State
+		if !thisState.IsActive() {
+			handler := ErrorHandler{tykMiddleware}
+			handler.HandleError(w, r, thisState.MaintenanceMessage, 503)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleAPIStateChanged re-reads the state of an API after it was changed on another node
+func handleAPIStateChanged(APIID string) {
+	spec := GetSpecForApi(APIID)
+	if spec == nil || spec.State == nil {
+		return
+	}
+
+	active, found := getAPIStateOverride(APIID)
+	if !found {
+		thisModuleConfig := GetAPIStateConfig(spec)
+		active = thisModuleConfig.Active == nil || *thisModuleConfig.Active
+	}
+	spec.State.SetActive(active)
+}
+
+// apiStateHandler serves /tyk/apis/{id}/state, PUT (or POST) {"active": false} takes the API down,
+// DELETE goes back to the active flag of the definition and GET reports the state
+func apiStateHandler(APIID string, w http.ResponseWriter, r *http.Request) {
+	spec := GetSpecForApi(APIID)
+	if spec == nil {
+		DoJSONWrite(w, 404, createError("API not found"))
+		return
+	}
+
+	if APIStateStore == nil {
+		DoJSONWrite(w, 500, createError("API state store is not available"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		var newState APIStateMessage
+		if err := json.NewDecoder(r.Body).Decode(&newState); err != nil {
+			DoJSONWrite(w, 400, createError("Request malformed"))
+			return
+		}
+
+		if err := APIStateStore.SetKey(APIID, strconv.FormatBool(newState.Active), 0); err != nil {
+			log.Error("Could not write API state: ", err)
+			DoJSONWrite(w, 500, createError("Could not write API state"))
+			return
+		}
+	case "DELETE":
+		APIStateStore.DeleteKey(APIID)
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if r.Method != "GET" {
+		handleAPIStateChanged(APIID)
+		MainNotifier.Notify(Notification{
+			Command: NoticeAPIStateChanged,
+			Payload: APIID,
+		})
+
+		log.WithFields(logrus.Fields{
+			"apiID":  APIID,
+			"active": spec.State.IsActive(),
+		}).Warning("API state changed.")
+	}
+
+	responseMessage, _ := json.Marshal(&APIStateMessage{APIID, spec.State.IsActive()})
+	DoJSONWrite(w, 200, responseMessage)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const maintenanceDefinition = `{
+	"name": "Maintenance API",
+	"api_id": "maintenance1",
+	"org_id": "default",
+	"use_keyless": true,
+	"active": false,
+	"maintenance_message": "Back at 10am",
+	"version_data": {
+		"not_versioned": true,
+		"versions": {"Default": {"name": "Default"}}
+	},
+	"proxy": {
+		"listen_path": "/maintenance/",
+		"target_url": "http://example.com",
+		"strip_listen_path": false
+	}
+}`
+
+func TestAPIStateFromDefinition(t *testing.T) {
+	spec := createDefinitionFromString(maintenanceDefinition)
+	if spec.State.IsActive() {
+		t.Error("API should be inactive")
+	}
+	if spec.State.MaintenanceMessage != "Back at 10am" {
+		t.Error("Maintenance message not set: ", spec.State.MaintenanceMessage)
+	}
+
+	activeSpec := createNonVersionedDefinition()
+	if !activeSpec.State.IsActive() {
+		t.Error("APIs without an active flag should be active")
+	}
+
+	var noState *APIState
+	if !noState.IsActive() {
+		t.Error("A nil state should be active")
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	spec := createDefinitionFromString(maintenanceDefinition)
+	redisStore := RedisStorageManager{KeyPrefix: "apikey-"}
+	healthStore := &RedisStorageManager{KeyPrefix: "apihealth."}
+	orgStore := &RedisStorageManager{KeyPrefix: "orgKey."}
+	spec.Init(&redisStore, &redisStore, healthStore, orgStore)
+
+	reached := false
+	handler := MaintenanceHandler(&TykMiddleware{&spec, nil}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	req, _ := http.NewRequest("GET", "/maintenance/", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != 503 || reached {
+		t.Error("Inactive APIs should return a 503: ", recorder.Code)
+	}
+
+	spec.State.SetActive(true)
+	req, _ = http.NewRequest("GET", "/maintenance/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !reached {
+		t.Error("Active APIs should be served")
+	}
+}
@@ -296,6 +296,31 @@ func TestKeyHandlerDeleteKey(t *testing.T) {
 	}
 }
 
+func TestKeySuspensionHandler(t *testing.T) {
+	MakeSampleAPI()
+	sampleKey := createSampleSession()
+	body, _ := json.Marshal(&sampleKey)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/tyk/keys/suspendme?api_id=1", strings.NewReader(string(body)))
+	keyHandler(recorder, req)
+
+	for _, step := range []struct {
+		method string
+		action string
+	}{{"POST", KeyStateSuspended}, {"DELETE", KeyStateActive}} {
+		recorder = httptest.NewRecorder()
+		req, _ = http.NewRequest(step.method, "/tyk/keys/suspend/suspendme?api_id=1", nil)
+		keySuspensionHandler(recorder, req)
+
+		newSuccess := Success{}
+		err := json.Unmarshal([]byte(recorder.Body.String()), &newSuccess)
+		if err != nil || recorder.Code != 200 || newSuccess.Action != step.action {
+			t.Error("Key should be ", step.action, ", got: ", recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
 func TestCreateKeyHandlerCreateNewKey(t *testing.T) {
 	createKey()
 
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditLogTypeFile  = "file"
+	AuditLogTypeRedis = "redis"
+
+	AUDIT_LOG_KEY_PREFIX       = "tyk-audit."
+	AUDIT_LOG_KEY_NAME         = "admin"
+	AUDIT_LOG_DEFAULT_FILE     = "/var/log/tyk/audit.log"
+	AUDIT_LOG_DEFAULT_MAX_SIZE = 100
+	AUDIT_LOG_DEFAULT_BACKUPS  = 5
+	AUDIT_LOG_DEFAULT_RECORDS  = 1000000
+	AUDIT_LOG_DEFAULT_ACTOR    = "admin"
+	AUDIT_LOG_MAX_BODY_SIZE    = 1 << 20
+)
+
+// AuditRecord is a single admin API call, key names in the path are replaced by their hash. Only
+// the first AUDIT_LOG_MAX_BODY_SIZE bytes of the body are hashed, BodyTruncated is set if there was more
+type AuditRecord struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Actor         string    `json:"actor"`
+	IP            string    `json:"ip"`
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	APIID         string    `json:"api_id,omitempty"`
+	Status        int       `json:"status"`
+	BodyHash      string    `json:"body_hash,omitempty"`
+	BodyTruncated bool      `json:"body_truncated,omitempty"`
+}
+
+// AuditSink is where audit records are appended
+type AuditSink interface {
+	Write(record AuditRecord) error
+}
+
+// AuditLog is only set if the audit log is enabled
+var AuditLog AuditSink
+
+// AuditFileSink appends JSON lines to a file, the file is rotated once it reaches MaxSize
+// megabytes and MaxBackups rotated files are kept (audit.log.1 is the newest)
+type AuditFileSink struct {
+	sync.Mutex
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	file       *os.File
+	size       int64
+}
+
+func NewAuditFileSink(path string, maxSizeMB int, maxBackups int) (*AuditFileSink, error) {
+	if path == "" {
+		path = AUDIT_LOG_DEFAULT_FILE
+	}
+	if maxSizeMB < 1 {
+		maxSizeMB = AUDIT_LOG_DEFAULT_MAX_SIZE
+	}
+	if maxBackups < 1 {
+		maxBackups = AUDIT_LOG_DEFAULT_BACKUPS
+	}
+
+	sink := &AuditFileSink{Path: path, MaxSize: int64(maxSizeMB) * 1024 * 1024, MaxBackups: maxBackups}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+
+	return sink, nil
+}
+
+func (a *AuditFileSink) open() error {
+	file, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditFileSink) rotate() error {
+	a.file.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", a.Path, a.MaxBackups))
+	for i := a.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.Path, i), fmt.Sprintf("%s.%d", a.Path, i+1))
+	}
+
+	if err := os.Rename(a.Path, a.Path+".1"); err != nil {
+		log.Error("Couldn't rotate audit log: ", err)
+	}
+
+	return a.open()
+}
+
+func (a *AuditFileSink) Write(record AuditRecord) error {
+	asJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	asJSON = append(asJSON, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.size+int64(len(asJSON)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(asJSON)
+	a.size += int64(n)
+	return err
+}
+
+// AuditListStore is a store that can keep a capped list
+type AuditListStore interface {
+	AppendToCappedList(keyName string, value string, maxLen int64) error
+}
+
+// AuditRedisSink appends records to a Redis list, only the last MaxRecords are kept
+type AuditRedisSink struct {
+	Store      AuditListStore
+	MaxRecords int64
+}
+
+func (a *AuditRedisSink) Write(record AuditRecord) error {
+	asJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	maxRecords := a.MaxRecords
+	if maxRecords < 1 {
+		maxRecords = AUDIT_LOG_DEFAULT_RECORDS
+	}
+
+	return a.Store.AppendToCappedList(AUDIT_LOG_KEY_NAME, string(asJSON), maxRecords)
+}
+
+// auditResponseWriter captures the status code of an admin API call
+type auditResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditKeyPaths are the admin paths that end with a key name
+var auditKeyPaths = []string{"/tyk/keys/policy/", "/tyk/keys/state/", "/tyk/keys/suspend/", "/tyk/keys/revoked/", "/tyk/keys/"}
+
+// auditPath replaces key names in a path with their hash so that live keys never end up in the audit log
+func auditPath(path string) string {
+	for _, prefix := range auditKeyPaths {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		keyName := path[len(prefix):]
+		if keyName == "" || keyName == "create" || keyName == "import" || strings.Contains(keyName, "/") {
+			return path
+		}
+
+		return prefix + "hash:" + doHash(keyName)
+	}
+
+	return path
+}
+
+// auditBodyHash hashes the start of the request body, the body is put back for the handler
+func auditBodyHash(r *http.Request) (string, bool) {
+	if r.Body == nil {
+		return "", false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, AUDIT_LOG_MAX_BODY_SIZE+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+	truncated := len(body) > AUDIT_LOG_MAX_BODY_SIZE
+	if truncated {
+		body = body[:AUDIT_LOG_MAX_BODY_SIZE]
+	}
+
+	if err != nil || len(body) == 0 {
+		return "", truncated
+	}
+
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), truncated
+}
+
+// AuditAdminCall wraps an admin handler so each call is written to the audit log, it runs once the
+// caller is authenticated and the actor is the name of their credential
+func AuditAdminCall(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if AuditLog == nil || (r.Method == "GET" && !config.AuditLog.IncludeReads) {
+			handler(w, r)
+			return
+		}
+
+		bodyHash, bodyTruncated := auditBodyHash(r)
+
+		auditWriter := &auditResponseWriter{ResponseWriter: w}
+		handler(auditWriter, r)
+
+		actor, _ := context.Get(r, AdminActor).(string)
+		if actor == "" {
+			actor = AUDIT_LOG_DEFAULT_ACTOR
+		}
+
+		thisRecord := AuditRecord{
+			Timestamp:     time.Now(),
+			Actor:         actor,
+			IP:            GetIPFromRequest(r),
+			Method:        r.Method,
+			Path:          auditPath(r.URL.Path),
+			APIID:         r.URL.Query().Get("api_id"),
+			Status:        auditWriter.code,
+			BodyHash:      bodyHash,
+			BodyTruncated: bodyTruncated,
+		}
+
+		if err := AuditLog.Write(thisRecord); err != nil {
+			log.Error("Failed to write audit log: ", err)
+		}
+	}
+}
+
+// SetupAuditLog creates the audit sink set in the configuration
+func SetupAuditLog() {
+	switch config.AuditLog.Type {
+	case AuditLogTypeRedis:
+		AuditStore := &RedisClusterStorageManager{KeyPrefix: AUDIT_LOG_KEY_PREFIX, HashKeys: false}
+		AuditStore.Connect()
+		AuditLog = &AuditRedisSink{Store: AuditStore, MaxRecords: config.AuditLog.MaxRecords}
+	case AuditLogTypeFile, "":
+		sink, err := NewAuditFileSink(config.AuditLog.FilePath, config.AuditLog.MaxSizeMB, config.AuditLog.MaxBackups)
+		if err != nil {
+			log.Fatal("Couldn't open audit log: ", err)
+		}
+		AuditLog = sink
+	default:
+		log.Fatal("Unknown audit log type: ", config.AuditLog.Type)
+	}
+
+	log.Info("Audit log enabled")
+}
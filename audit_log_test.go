@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type mockAuditSink struct {
+	records []AuditRecord
+}
+
+func (m *mockAuditSink) Write(record AuditRecord) error {
+	m.records = append(m.records, record)
+	return nil
+}
+
+func TestAuditAdminCall(t *testing.T) {
+	sink := &mockAuditSink{}
+	AuditLog = sink
+	defer func() { AuditLog = nil }()
+
+	handler := AuditAdminCall(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if string(body) != `{"rate": 10}` {
+				t.Error("Handler should still get the body")
+			}
+		}
+		w.WriteHeader(201)
+	})
+
+	req, _ := http.NewRequest("POST", "/tyk/keys/secretkey?api_id=1", strings.NewReader(`{"rate": 10}`))
+	context.Set(req, AdminActor, "deploy-bot")
+	defer context.Clear(req)
+	req.RemoteAddr = "10.0.0.1:1234"
+	handler(httptest.NewRecorder(), req)
+
+	if len(sink.records) != 1 {
+		t.Fatal("Expected one audit record, got: ", len(sink.records))
+	}
+
+	thisRecord := sink.records[0]
+	if thisRecord.Actor != "deploy-bot" || thisRecord.IP != "10.0.0.1" || thisRecord.Status != 201 || thisRecord.APIID != "1" {
+		t.Error("Audit record is wrong: ", thisRecord)
+	}
+
+	if strings.Contains(thisRecord.Path, "secretkey") || len(thisRecord.BodyHash) != 64 {
+		t.Error("Keys must be hashed in the audit log: ", thisRecord)
+	}
+
+	// Reads are not audited by default
+	req, _ = http.NewRequest("GET", "/tyk/apis/", nil)
+	handler(httptest.NewRecorder(), req)
+	if len(sink.records) != 1 {
+		t.Error("Reads should not be audited")
+	}
+
+	// Large bodies are only partly hashed, the handler still gets all of it
+	largeBody := strings.Repeat("a", AUDIT_LOG_MAX_BODY_SIZE+10)
+	largeHandler := AuditAdminCall(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) != len(largeBody) {
+			t.Error("Handler should get the whole body, got: ", len(body))
+		}
+	})
+	req, _ = http.NewRequest("POST", "/tyk/apis/", strings.NewReader(largeBody))
+	largeHandler(httptest.NewRecorder(), req)
+	if len(sink.records) != 2 || !sink.records[1].BodyTruncated {
+		t.Error("Large bodies should be flagged as truncated")
+	}
+}
+
+func TestAuditOnlyAuthenticatedCalls(t *testing.T) {
+	sink := &mockAuditSink{}
+	AuditLog = sink
+	defer func() { AuditLog = nil }()
+
+	oldTokens := config.AdminTokens
+	config.AdminTokens = []AdminToken{{Name: "ci-keys", Token: "keys-token", Scope: AdminScopeKeys}}
+	defer func() { config.AdminTokens = oldTokens }()
+
+	handler := CheckIsAPIOwner(func(w http.ResponseWriter, r *http.Request) {})
+	for _, token := range []string{"unknown", "keys-token"} {
+		req, _ := http.NewRequest("POST", "/tyk/apis/", nil)
+		req.Header.Set("X-Tyk-Authorization", token)
+		req.Header.Set("X-Tyk-Actor", "someone-else")
+		handler(httptest.NewRecorder(), req)
+	}
+
+	if len(sink.records) != 1 {
+		t.Fatal("Only calls with a valid credential should be audited, got: ", len(sink.records))
+	}
+	if sink.records[0].Actor != "ci-keys" || sink.records[0].Status != 403 {
+		t.Error("Calls outside a token's scope should be audited under its name: ", sink.records[0])
+	}
+}
+
+type mockAuditListStore struct {
+	maxLen int64
+	err    error
+}
+
+func (m *mockAuditListStore) AppendToCappedList(keyName string, value string, maxLen int64) error {
+	m.maxLen = maxLen
+	return m.err
+}
+
+func TestAuditRedisSink(t *testing.T) {
+	store := &mockAuditListStore{}
+	sink := &AuditRedisSink{Store: store}
+	if err := sink.Write(AuditRecord{Actor: "admin"}); err != nil || store.maxLen != AUDIT_LOG_DEFAULT_RECORDS {
+		t.Error("The list should be capped at the default size: ", store.maxLen)
+	}
+
+	store.err = errors.New("connection refused")
+	if err := sink.Write(AuditRecord{Actor: "admin"}); err == nil {
+		t.Error("Write errors should be returned")
+	}
+}
+
+func TestAuditFileSinkRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tyk-audit")
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "audit.log")
+	sink, err := NewAuditFileSink(logPath, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.MaxSize = 200
+
+	for i := 0; i < 10; i++ {
+		sink.Write(AuditRecord{Actor: "admin", Method: "POST", Path: "/tyk/reload/"})
+	}
+
+	for _, fileName := range []string{logPath, logPath + ".1", logPath + ".2"} {
+		if _, err := os.Stat(fileName); err != nil {
+			t.Error("Expected audit log file: ", fileName)
+		}
+	}
+
+	if _, err := os.Stat(logPath + ".3"); err == nil {
+		t.Error("Only two rotated files should be kept")
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"github.com/nu7hatch/gouuid"
 	"strings"
 	"time"
@@ -28,6 +27,7 @@ type SessionHandler interface {
 	GetSessions(filter string) []string
 	GetStore() StorageHandler
 	ResetQuota(string, SessionState)
+	KeyExists(keyName string) bool
 }
 
 type KeyGenerator interface {
@@ -41,8 +41,12 @@ type DefaultAuthorisationManager struct {
 	Store StorageHandler
 }
 
+// DefaultSessionManager implements SessionHandler, if CacheSessions is set sessions are read through
+// the local session cache
 type DefaultSessionManager struct {
-	Store StorageHandler
+	Store         StorageHandler
+	CacheSessions bool
+	IndexMetadata bool
 }
 
 func (b *DefaultAuthorisationManager) Init(store StorageHandler) {
@@ -59,7 +63,7 @@ func (b DefaultAuthorisationManager) IsKeyAuthorised(keyName string) (SessionSta
 		return newSession, false
 	}
 
-	if marshalErr := json.Unmarshal([]byte(jsonKeyVal), &newSession); marshalErr != nil {
+	if marshalErr := decodeSession(jsonKeyVal, &newSession); marshalErr != nil {
 		log.Error("Couldn't unmarshal session object")
 		log.Error(marshalErr)
 		return newSession, false
@@ -94,43 +98,158 @@ func (b *DefaultSessionManager) ResetQuota(keyName string, session SessionState)
 	rawKey := QuotaKeyPrefix + keyName
 	log.Debug("Setting: ", rawKey)
 	go b.Store.SetKey(rawKey, "0", session.QuotaRenewalRate)
+
+	// Calendar and sliding quotas keep their counters in per-window keys
+	go resetQuotaWindows(b.Store, QuotaKeyPrefix+publicHash(keyName), session)
+
+	// Per-API limit overrides have their own counters
+	for _, limitScope := range session.APILimitScopes() {
+		limitKey := QuotaKeyPrefix + publicHash(keyName+"-"+limitScope)
+		go b.Store.DeleteRawKey(limitKey)
+		go resetQuotaWindows(b.Store, limitKey, session)
+	}
 }
 
 // UpdateSession updates the session state in the storage engine
 func (b DefaultSessionManager) UpdateSession(keyName string, session SessionState, resetTTLTo int64) error {
-	v, _ := json.Marshal(session)
+	v, err := encodeSession(session)
+	if err != nil {
+		log.Error("Couldn't encode session object: ", err)
+		return err
+	}
+
+	if b.useCache() {
+		namespace, keyHash := b.cacheKey(keyName)
+		LocalSessionCache.Set(namespace, keyHash, v)
+	}
+
+	if index := b.metadataIndex(); index != nil {
+		if indexErr := index.Update(keyName, &session); indexErr != nil {
+			log.Error("Couldn't update key metadata index: ", indexErr)
+		}
+	}
 
 	// Keep the TTL
 	if config.UseAsyncSessionWrite {
-		go b.Store.SetKey(keyName, string(v), int64(resetTTLTo))
+		go b.Store.SetKey(keyName, v, int64(resetTTLTo))
 		return nil
 	}
-	err := b.Store.SetKey(keyName, string(v), int64(resetTTLTo))
+	err = b.Store.SetKey(keyName, v, int64(resetTTLTo))
 	return err
 
 }
 
+// ImportSessions writes sessions in one batch if the store supports it, existing keys are only
+// replaced if overwrite is set. It returns the keys that were skipped because they exist
+func (b DefaultSessionManager) ImportSessions(sessions map[string]SessionState, resetTTLTo int64, overwrite bool) ([]string, error) {
+	batchStore, ok := b.Store.(BatchKeyStorage)
+	if !ok {
+		return nil, ErrBatchKeysUnsupported
+	}
+
+	encoded := make(map[string]string, len(sessions))
+	for keyName, session := range sessions {
+		v, err := encodeSession(session)
+		if err != nil {
+			return nil, err
+		}
+		encoded[keyName] = v
+	}
+
+	skipped, err := batchStore.SetKeys(encoded, resetTTLTo, overwrite)
+	if err != nil {
+		return nil, err
+	}
+
+	wasSkipped := make(map[string]bool, len(skipped))
+	for _, keyName := range skipped {
+		wasSkipped[keyName] = true
+	}
+
+	for keyName, session := range sessions {
+		if wasSkipped[keyName] {
+			continue
+		}
+
+		if b.useCache() {
+			LocalSessionCache.Invalidate(b.cacheKey(keyName))
+		}
+		if index := b.metadataIndex(); index != nil {
+			if indexErr := index.Update(keyName, &session); indexErr != nil {
+				log.Error("Couldn't update key metadata index: ", indexErr)
+			}
+		}
+	}
+
+	return skipped, nil
+}
+
 func (b DefaultSessionManager) RemoveSession(keyName string) {
 	b.Store.DeleteKey(keyName)
+	if b.useCache() {
+		LocalSessionCache.Invalidate(b.cacheKey(keyName))
+	}
+	if index := b.metadataIndex(); index != nil {
+		index.Remove(keyName)
+	}
+}
+
+func (b DefaultSessionManager) useCache() bool {
+	return b.CacheSessions && LocalSessionCache != nil
+}
+
+// cacheKey is the namespace and hash a session is cached under
+func (b DefaultSessionManager) cacheKey(keyName string) (string, string) {
+	return storageKeyNamespace(b.Store), publicHash(keyName)
+}
+
+// metadataIndex is the key metadata index if the manager holds API keys and the index is enabled
+func (b DefaultSessionManager) metadataIndex() *KeyMetadataIndexer {
+	if !b.IndexMetadata {
+		return nil
+	}
+
+	return KeyMetadataIndex
 }
 
 // GetSessionDetail returns the session detail using the storage engine (either in memory or Redis)
 func (b DefaultSessionManager) GetSessionDetail(keyName string) (SessionState, bool) {
-	jsonKeyVal, err := b.Store.GetKey(keyName)
 	var thisSession SessionState
+	var namespace, keyHash string
+	if b.useCache() {
+		namespace, keyHash = b.cacheKey(keyName)
+		if jsonKeyVal, found := LocalSessionCache.Get(namespace, keyHash); found {
+			if marshalErr := decodeSession(jsonKeyVal, &thisSession); marshalErr == nil {
+				return thisSession, true
+			}
+			LocalSessionCache.Invalidate(namespace, keyHash)
+		}
+	}
+
+	jsonKeyVal, err := b.Store.GetKey(keyName)
 	if err != nil {
 		log.Debug("Key does not exist")
 		return thisSession, false
 	}
 
-	if marshalErr := json.Unmarshal([]byte(jsonKeyVal), &thisSession); marshalErr != nil {
+	if marshalErr := decodeSession(jsonKeyVal, &thisSession); marshalErr != nil {
 		log.Error("Couldn't unmarshal session object (may be cache miss): ", marshalErr)
 		return thisSession, false
 	}
 
+	if b.useCache() {
+		LocalSessionCache.Set(namespace, keyHash, jsonKeyVal)
+	}
+
 	return thisSession, true
 }
 
+// KeyExists checks if a session is stored for the key, used to detect collisions when creating keys
+func (b DefaultSessionManager) KeyExists(keyName string) bool {
+	_, err := b.Store.GetKey(keyName)
+	return err == nil
+}
+
 // GetSessions returns all sessions in the key store that match a filter key (a prefix)
 func (b DefaultSessionManager) GetSessions(filter string) []string {
 	return b.Store.GetKeys(filter)
@@ -141,11 +260,20 @@ type DefaultKeyGenerator struct {
 
 // GenerateAuthKey is a utility function for generating new auth keys. Returns the storage key name and the actual key
 func (b DefaultKeyGenerator) GenerateAuthKey(OrgID string) string {
-	u5, _ := uuid.NewV4()
-	cleanSting := strings.Replace(u5.String(), "-", "", -1)
-	newAuthKey := expandKey(OrgID, cleanSting)
+	thisConf := config.KeyGeneration
+	if !thisConf.IsCustom() {
+		u5, _ := uuid.NewV4()
+		cleanSting := strings.Replace(u5.String(), "-", "", -1)
+		return thisConf.formatKey(OrgID, cleanSting)
+	}
+
+	token, err := generateRandomToken(thisConf.Length, thisConf.getCharset())
+	if err != nil {
+		log.Error("Failed to generate key: ", err)
+		return ""
+	}
 
-	return newAuthKey
+	return thisConf.formatKey(OrgID, token)
 }
 
 // GenerateHMACSecret is a utility function for generating new auth keys. Returns the storage key name and the actual key
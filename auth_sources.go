@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	AuthSourceHeader = "header"
+	AuthSourceParam  = "param"
+	AuthSourceCookie = "cookie"
+)
+
+// AuthSourcesConfig extends the auth section of an API definition, headers are checked in order,
+// then the query / form parameter and finally the cookie
+type AuthSourcesConfig struct {
+	Headers       []string `mapstructure:"headers" bson:"headers" json:"headers"`
+	ParamName     string   `mapstructure:"param_name" bson:"param_name" json:"param_name"`
+	CookieName    string   `mapstructure:"cookie_name" bson:"cookie_name" json:"cookie_name"`
+	StripAuthData bool     `mapstructure:"-" bson:"-" json:"-"`
+}
+
+// AuthExtensionConfig holds settings added to the standard auth section of the API definition
+type AuthExtensionConfig struct {
+	StripAuthData bool `mapstructure:"strip_auth_data" bson:"strip_auth_data" json:"strip_auth_data"`
+}
+
+type AuthSourcesModuleConfig struct {
+	AuthSources AuthSourcesConfig   `mapstructure:"auth_sources" bson:"auth_sources" json:"auth_sources"`
+	Auth        AuthExtensionConfig `mapstructure:"auth" bson:"auth" json:"auth"`
+}
+
+// AuthTokenSource records where the token of a request was found
+type AuthTokenSource struct {
+	Type string
+	Name string
+}
+
+// GetAuthSourcesConfig merges the auth sources section with the standard auth settings, the
+// auth_header_name is used for any source that isn't explicitly named
+func GetAuthSourcesConfig(spec *APISpec) AuthSourcesConfig {
+	var thisModuleConfig AuthSourcesModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode auth sources configuration: ", err)
+	}
+
+	thisAuth := spec.APIDefinition.Auth
+	thisConf := mergeAuthSources(thisModuleConfig.AuthSources, thisAuth.AuthHeaderName, thisAuth.UseParam, thisAuth.UseCookie)
+	thisConf.StripAuthData = thisModuleConfig.Auth.StripAuthData
+
+	return thisConf
+}
+
+func mergeAuthSources(thisConf AuthSourcesConfig, authHeaderName string, useParam bool, useCookie bool) AuthSourcesConfig {
+	if len(thisConf.Headers) == 0 {
+		thisConf.Headers = []string{authHeaderName}
+	}
+
+	if thisConf.ParamName == "" && useParam {
+		thisConf.ParamName = authHeaderName
+	}
+
+	if thisConf.CookieName == "" && useCookie {
+		thisConf.CookieName = authHeaderName
+	}
+
+	return thisConf
+}
+
+// stripBearer removes the "Bearer " scheme from Authorization header values
+func stripBearer(value string) string {
+	if len(value) > 7 && strings.ToLower(value[:7]) == "bearer " {
+		return strings.TrimSpace(value[7:])
+	}
+
+	return value
+}
+
+// GetAuthToken finds the auth token in a request and reports where it came from
+func GetAuthToken(thisConf AuthSourcesConfig, r *http.Request) (string, AuthTokenSource) {
+	for _, hName := range thisConf.Headers {
+		if hName == "" {
+			continue
+		}
+
+		value := r.Header.Get(hName)
+		if value == "" {
+			continue
+		}
+
+		if http.CanonicalHeaderKey(hName) == "Authorization" {
+			value = stripBearer(value)
+		}
+
+		return value, AuthTokenSource{AuthSourceHeader, hName}
+	}
+
+	if thisConf.ParamName != "" {
+		// Copy the request so reading form data doesn't drain the body
+		tempRes := CopyRequest(r)
+		if value := tempRes.FormValue(thisConf.ParamName); value != "" {
+			return value, AuthTokenSource{AuthSourceParam, thisConf.ParamName}
+		}
+	}
+
+	if thisConf.CookieName != "" {
+		if authCookie, err := r.Cookie(thisConf.CookieName); err == nil && authCookie.Value != "" {
+			return authCookie.Value, AuthTokenSource{AuthSourceCookie, thisConf.CookieName}
+		}
+	}
+
+	return "", AuthTokenSource{}
+}
+
+// StripAuthToken removes the auth token from the request so it isn't forwarded to the upstream
+func StripAuthToken(r *http.Request, source AuthTokenSource) {
+	switch source.Type {
+	case AuthSourceHeader:
+		r.Header.Del(source.Name)
+	case AuthSourceParam:
+		values := r.URL.Query()
+		values.Del(source.Name)
+		r.URL.RawQuery = values.Encode()
+		stripFormParam(r, source.Name)
+	case AuthSourceCookie:
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, thisCookie := range cookies {
+			if thisCookie.Name != source.Name {
+				r.AddCookie(thisCookie)
+			}
+		}
+	}
+}
+
+// stripFormParam removes a field from a url encoded or multipart form body, other bodies are left as
+// they are
+func stripFormParam(r *http.Request, name string) {
+	if r.Body == nil {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data") {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		log.Error("Failed to read request body! ", err)
+		return
+	}
+
+	var stripped []byte
+	if mediaType == "multipart/form-data" {
+		stripped, err = stripMultipartField(body, params["boundary"], name)
+	} else {
+		var form url.Values
+		if form, err = url.ParseQuery(string(body)); err == nil {
+			form.Del(name)
+			stripped = []byte(form.Encode())
+		}
+	}
+
+	if err != nil {
+		log.Warning("Couldn't remove the auth token from the form body: ", err)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(stripped))
+	r.ContentLength = int64(len(stripped))
+	r.Header.Set("Content-Length", strconv.Itoa(len(stripped)))
+}
+
+// stripMultipartField copies a multipart body without the parts of a form field, the boundary is kept
+func stripMultipartField(body []byte, boundary string, name string) ([]byte, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == name && part.FileName() == "" {
+			continue
+		}
+
+		partWriter, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(partWriter, part); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
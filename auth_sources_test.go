@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAuthTokenHeaderPriority(t *testing.T) {
+	thisConf := mergeAuthSources(AuthSourcesConfig{Headers: []string{"X-Api-Key", "Authorization"}}, "authorization", false, false)
+
+	r, _ := http.NewRequest("GET", "/v1/widgets", nil)
+	r.Header.Set("Authorization", "Bearer abc123")
+
+	token, source := GetAuthToken(thisConf, r)
+	if token != "abc123" {
+		t.Error("Bearer scheme should be stripped, got: ", token)
+	}
+	if source.Type != AuthSourceHeader || source.Name != "Authorization" {
+		t.Error("Wrong source: ", source)
+	}
+
+	r.Header.Set("X-Api-Key", "def456")
+	if token, _ = GetAuthToken(thisConf, r); token != "def456" {
+		t.Error("First header should take priority, got: ", token)
+	}
+}
+
+func TestAuthTokenParamAndCookie(t *testing.T) {
+	thisConf := mergeAuthSources(AuthSourcesConfig{CookieName: "session"}, "authorization", true, false)
+
+	r, _ := http.NewRequest("GET", "/v1/widgets?authorization=abc123", nil)
+	token, source := GetAuthToken(thisConf, r)
+	if token != "abc123" || source.Type != AuthSourceParam {
+		t.Error("Token should be read from the param, got: ", token, source)
+	}
+
+	r, _ = http.NewRequest("GET", "/v1/widgets", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "ghi789"})
+	token, source = GetAuthToken(thisConf, r)
+	if token != "ghi789" || source.Type != AuthSourceCookie {
+		t.Error("Token should be read from the cookie, got: ", token, source)
+	}
+}
+
+func TestStripAuthToken(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/widgets?api_key=abc123&page=2", nil)
+	r.Header.Set("X-Api-Key", "abc123")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc123"})
+	r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+
+	StripAuthToken(r, AuthTokenSource{AuthSourceHeader, "X-Api-Key"})
+	if r.Header.Get("X-Api-Key") != "" {
+		t.Error("Header was not stripped")
+	}
+
+	StripAuthToken(r, AuthTokenSource{AuthSourceParam, "api_key"})
+	if r.URL.RawQuery != "page=2" {
+		t.Error("Param was not stripped: ", r.URL.RawQuery)
+	}
+
+	StripAuthToken(r, AuthTokenSource{AuthSourceCookie, "session"})
+	if _, err := r.Cookie("session"); err == nil {
+		t.Error("Cookie was not stripped")
+	}
+	if _, err := r.Cookie("theme"); err != nil {
+		t.Error("Other cookies should be kept")
+	}
+}
+
+func TestStripAuthTokenFormBody(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/v1/widgets", strings.NewReader("api_key=abc123&name=widget"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	StripAuthToken(r, AuthTokenSource{AuthSourceParam, "api_key"})
+	body, _ := ioutil.ReadAll(r.Body)
+	if string(body) != "name=widget" {
+		t.Error("Param was not stripped from the form body: ", string(body))
+	}
+	if r.ContentLength != int64(len(body)) {
+		t.Error("Content length was not updated: ", r.ContentLength)
+	}
+
+	var multipartBody bytes.Buffer
+	writer := multipart.NewWriter(&multipartBody)
+	writer.WriteField("api_key", "abc123")
+	writer.WriteField("name", "widget")
+	writer.Close()
+
+	r, _ = http.NewRequest("POST", "/v1/widgets", &multipartBody)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	StripAuthToken(r, AuthTokenSource{AuthSourceParam, "api_key"})
+	if r.FormValue("api_key") != "" {
+		t.Error("Param was not stripped from the multipart body")
+	}
+	if r.FormValue("name") != "widget" {
+		t.Error("Other fields should be kept, got: ", r.FormValue("name"))
+	}
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"strconv"
+	"net/url"
+	"path"
 	"strings"
+	"sync"
 )
 
 // RequestDefinition defines a batch request
@@ -32,54 +36,64 @@ type BatchReplyUnit struct {
 	Body        string      `json:"body"`
 }
 
-// BatchRequestHandler handles batch requests on /tyk/batch for any API Definition that has the feature enabled
-type BatchRequestHandler struct {
-	API *APISpec
-}
+var ErrBatchTargetNotAllowed = errors.New("Batch requests can only target the API or its upstream")
 
-// doAsyncRequest runs an async request and replies to a channel
-func (b BatchRequestHandler) doAsyncRequest(req *http.Request, relURL string, out chan BatchReplyUnit) {
-	client := &http.Client{}
-	resp, doReqErr := client.Do(req)
+// batchTransport sends sub-requests for APIs on this gateway through their middleware chain in-process,
+// so they get the full auth, quota and analytics treatment without looping back over the network.
+// Requests to the upstream of the API use the same transport settings as the proxy
+type batchTransport struct {
+	upstream http.RoundTripper
+}
 
-	if doReqErr != nil {
-		log.Error("Webhook request failed: ", doReqErr)
-		return
+func (t batchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isInternalURL(req.URL) {
+		return InternalTransport{}.RoundTrip(req)
 	}
 
-	defer resp.Body.Close()
-	content, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		log.Warning("Body read failure! ", readErr)
-		return
-	}
+	return t.upstream.RoundTrip(req)
+}
 
-	reply := BatchReplyUnit{
-		RelativeURL: relURL,
-		Code:        resp.StatusCode,
-		Headers:     resp.Header,
-		Body:        string(content),
-	}
+// BatchRequestHandler handles batch requests on /tyk/batch for any API Definition that has the feature enabled
+type BatchRequestHandler struct {
+	API *APISpec
+}
 
-	out <- reply
+// newBatchClient creates the client for the sub-requests of a batch, the caller closes its idle connections
+func (b BatchRequestHandler) newBatchClient() (*http.Client, *http.Transport) {
+	upstream := GetTransport(0, GetProxyTransportConfig(b.API)).(*http.Transport)
+	return &http.Client{Transport: batchTransport{upstream: upstream}}, upstream
+}
 
+// doAsyncRequest runs an async request and replies to a channel
+func (b BatchRequestHandler) doAsyncRequest(client *http.Client, req *http.Request, relURL string, out chan BatchReplyUnit) {
+	out <- b.doSyncRequest(client, req, relURL)
 }
 
-// doSyncRequest will make the same request but return a BatchReplyUnit
-func (b BatchRequestHandler) doSyncRequest(req *http.Request, relURL string) BatchReplyUnit {
-	client := &http.Client{}
+// doSyncRequest will make the same request but return a BatchReplyUnit, failed requests
+// are reported back as a 502 so that the caller always gets a reply for each request
+func (b BatchRequestHandler) doSyncRequest(client *http.Client, req *http.Request, relURL string) BatchReplyUnit {
 	resp, doReqErr := client.Do(req)
 
 	if doReqErr != nil {
-		log.Error("Webhook request failed: ", doReqErr)
-		return BatchReplyUnit{}
+		log.Error("Batch request failed: ", doReqErr)
+		return BatchReplyUnit{
+			RelativeURL: relURL,
+			Code:        502,
+			Headers:     http.Header{},
+			Body:        string(createError("Batch request failed")),
+		}
 	}
 
 	defer resp.Body.Close()
 	content, readErr := ioutil.ReadAll(resp.Body)
 	if readErr != nil {
 		log.Warning("Body read failure! ", readErr)
-		return BatchReplyUnit{}
+		return BatchReplyUnit{
+			RelativeURL: relURL,
+			Code:        502,
+			Headers:     resp.Header,
+			Body:        string(createError("Failed to read batch response")),
+		}
 	}
 
 	reply := BatchReplyUnit{
@@ -100,25 +114,74 @@ func (b BatchRequestHandler) DecodeBatchRequest(r *http.Request) (BatchRequestSt
 	return batchRequest, decodeErr
 }
 
+// apiURL is the internal URL of a path of the API, the request runs through the API's chain
+func (b BatchRequestHandler) apiURL(relURL *url.URL) *url.URL {
+	return &url.URL{
+		Scheme:   INTERNAL_API_SCHEME,
+		Host:     b.API.APIID,
+		Path:     "/" + strings.TrimLeft(relURL.Path, "/"),
+		RawQuery: relURL.RawQuery,
+	}
+}
+
+// isUpstreamURL checks that a URL is on the upstream of the API, under the path of its target
+func (b BatchRequestHandler) isUpstreamURL(target *url.URL) bool {
+	upstream, err := url.Parse(b.API.Proxy.TargetURL)
+	if err != nil || upstream.Host == "" {
+		return false
+	}
+
+	if !strings.EqualFold(target.Scheme, upstream.Scheme) || !strings.EqualFold(target.Host, upstream.Host) {
+		return false
+	}
+
+	basePath := "/" + strings.Trim(upstream.Path, "/")
+	targetPath := path.Clean("/" + target.Path)
+	return basePath == "/" || targetPath == basePath || strings.HasPrefix(targetPath, basePath+"/")
+}
+
+// batchTargetURL works out where a sub-request goes. Relative URLs are paths of the API, requests from
+// the JSVM can also target other APIs on the gateway (tyk://) or the upstream of the API
+func (b BatchRequestHandler) batchTargetURL(requestDef RequestDefinition, unsafe bool) (*url.URL, error) {
+	if b.API == nil {
+		return nil, ErrBatchTargetNotAllowed
+	}
+
+	target, err := url.Parse(requestDef.RelativeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme == "" && target.Host == "" {
+		return b.apiURL(target), nil
+	}
+
+	if unsafe && (isInternalURL(target) || b.isUpstreamURL(target)) {
+		return target, nil
+	}
+
+	return nil, ErrBatchTargetNotAllowed
+}
+
 func (b BatchRequestHandler) ConstructRequests(batchRequest BatchRequestStructure, unsafe bool) ([]*http.Request, error) {
 	requestSet := []*http.Request{}
 
 	for i, requestDef := range batchRequest.Requests {
-		// We re-build the URL to ensure that the requested URL is actually for the API in question
-		// URLs need to be built absolute so they go through the rate limiting and request limiting machinery
-		var absURL string
-		if !unsafe {
-			absUrlHeader := strings.Join([]string{"http://localhost", strconv.Itoa(config.ListenPort)}, ":")
-			absURL = strings.Join([]string{absUrlHeader, strings.Trim(b.API.Proxy.ListenPath, "/"), requestDef.RelativeURL}, "/")
-		} else {
-			absURL = requestDef.RelativeURL
+		// We re-build the URL to ensure that the requested URL is actually for the API in question, requests
+		// for the API are sent through its chain so they go through the rate limiting and request limiting machinery
+		target, targetErr := b.batchTargetURL(requestDef, unsafe)
+		if targetErr != nil {
+			log.Error("Batch request target is not allowed for request spec index: ", i, ": ", targetErr)
+			return nil, targetErr
 		}
 
-		thisRequest, createReqErr := http.NewRequest(requestDef.Method, absURL, bytes.NewBuffer([]byte(requestDef.Body)))
+		thisRequest, createReqErr := http.NewRequest(requestDef.Method, "/", bytes.NewBuffer([]byte(requestDef.Body)))
 		if createReqErr != nil {
 			log.Error("Failure generating batch request for request spec index: ", i)
 			return nil, createReqErr
 		}
+		thisRequest.URL = target
+		thisRequest.Host = target.Host
 
 		// Add headers
 		for k, v := range requestDef.Headers {
@@ -131,28 +194,51 @@ func (b BatchRequestHandler) ConstructRequests(batchRequest BatchRequestStructur
 	return requestSet, nil
 }
 
+// copyClientAddress gives the sub-requests the address of the client of the batch, so IP checks, rate
+// limits and analytics see the client. X-Forwarded-For is only passed on from a trusted proxy
+func copyClientAddress(requestSet []*http.Request, r *http.Request) {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	trusted := isTrustedProxy(remoteIP)
+
+	for _, thisRequest := range requestSet {
+		thisRequest.RemoteAddr = r.RemoteAddr
+		thisRequest.Header.Del("X-Forwarded-For")
+		if trusted {
+			for _, forwarded := range r.Header["X-Forwarded-For"] {
+				thisRequest.Header.Add("X-Forwarded-For", forwarded)
+			}
+		}
+	}
+}
+
 func (b BatchRequestHandler) MakeRequests(batchRequest BatchRequestStructure, requestSet []*http.Request) []BatchReplyUnit {
 	ReplySet := []BatchReplyUnit{}
 
+	client, upstream := b.newBatchClient()
+	defer upstream.CloseIdleConnections()
+
 	if len(batchRequest.Requests) != len(requestSet) {
 		log.Error("Something went wrong creating requests, they are of mismatched lengths!", len(batchRequest.Requests), len(requestSet))
 	}
 
 	if !batchRequest.SuppressParallelExecution {
-		replies := make(chan BatchReplyUnit)
+		// Replies are kept in the same order as the requests
+		ReplySet = make([]BatchReplyUnit, len(requestSet))
+		var wg sync.WaitGroup
 		for index, req := range requestSet {
-			go b.doAsyncRequest(req, batchRequest.Requests[index].RelativeURL, replies)
-		}
-
-		for i := 0; i < len(batchRequest.Requests); i++ {
-			val := BatchReplyUnit{}
-			val = <-replies
-
-			ReplySet = append(ReplySet, val)
+			wg.Add(1)
+			go func(i int, thisReq *http.Request) {
+				defer wg.Done()
+				ReplySet[i] = b.doSyncRequest(client, thisReq, batchRequest.Requests[i].RelativeURL)
+			}(index, req)
 		}
+		wg.Wait()
 	} else {
 		for index, req := range requestSet {
-			reply := b.doSyncRequest(req, batchRequest.Requests[index].RelativeURL)
+			reply := b.doSyncRequest(client, req, batchRequest.Requests[index].RelativeURL)
 			ReplySet = append(ReplySet, reply)
 		}
 	}
@@ -179,6 +265,7 @@ func (b BatchRequestHandler) HandleBatchRequest(w http.ResponseWriter, r *http.R
 			ReturnError(fmt.Sprintf("Batch request creation failed , request structure malformed"), w)
 			return
 		}
+		copyClientAddress(requestSet, r)
 
 		// Run requests and collate responses
 		ReplySet := b.MakeRequests(batchRequest, requestSet)
@@ -192,8 +279,10 @@ func (b BatchRequestHandler) HandleBatchRequest(w http.ResponseWriter, r *http.R
 
 		// Respond
 		DoJSONWrite(w, 200, replyMessage)
+		return
 	}
 
+	DoJSONWrite(w, 405, createError("Method not supported"))
 }
 
 // HandleBatchRequest is the actual http handler for a batch request on an API definition
@@ -152,12 +152,12 @@ func TestBatchSuccess(t *testing.T) {
 		t.Error("Request set length should be 3, is: ", len(requestSet))
 	}
 
-	if requestSet[0].URL.Host != "localhost:8080" {
-		t.Error("Request Host is wrong, is: ", requestSet[0].URL.Host)
+	if requestSet[0].URL.Scheme != INTERNAL_API_SCHEME || requestSet[0].URL.Host != "987999" {
+		t.Error("Request should be sent to the API chain, is: ", requestSet[0].URL)
 	}
 
-	if requestSet[0].URL.Path != "/v1/get/" {
-		t.Error("Request Path is wrong, is: ", requestSet[0].URL.Path)
+	if requestSet[0].URL.Path != "/get/" || requestSet[0].URL.Query().Get("param1") != "this" {
+		t.Error("Request Path is wrong, is: ", requestSet[0].URL)
 	}
 
 }
@@ -174,7 +174,8 @@ func TestMakeSyncRequest(t *testing.T) {
 	relURL := "/about-lonelycoder"
 	thisRequest, _ := http.NewRequest("GET", "http://lonelycode.com/about-lonelycoder", nil)
 
-	replyUnit := batchHandler.doSyncRequest(thisRequest, relURL)
+	client, _ := batchHandler.newBatchClient()
+	replyUnit := batchHandler.doSyncRequest(client, thisRequest, relURL)
 
 	if replyUnit.RelativeURL != relURL {
 		t.Error("Relativce URL in reply is wrong")
@@ -203,7 +204,8 @@ func TestMakeASyncRequest(t *testing.T) {
 	thisRequest, _ := http.NewRequest("GET", "http://lonelycode.com/about-lonelycoder", nil)
 
 	replies := make(chan BatchReplyUnit)
-	go batchHandler.doAsyncRequest(thisRequest, relURL, replies)
+	client, _ := batchHandler.newBatchClient()
+	go batchHandler.doAsyncRequest(client, thisRequest, relURL, replies)
 	replyUnit := BatchReplyUnit{}
 	replyUnit = <-replies
 
@@ -220,3 +222,78 @@ func TestMakeASyncRequest(t *testing.T) {
 	}
 
 }
+
+func TestBatchRequestTargets(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(BatchTestDef, `"target_url": "http://httpbin.org"`, `"target_url": "https://upstream.example.com/api"`, 1))
+	batchHandler := BatchRequestHandler{API: &spec}
+
+	targets := map[string]bool{
+		"get/?param1=this":                            false,
+		"https://upstream.example.com/api/orders":     true,
+		"tyk://other-api/orders":                      true,
+		"https://upstream.example.com/admin":          false,
+		"https://upstream.example.com/api/../admin":   false,
+		"http://upstream.example.com/api/orders":      false,
+		"https://169.254.169.254/latest/meta-data/":   false,
+		"https://upstream.example.com.evil.com/api/x": false,
+	}
+
+	for relURL, allowedFromJSVM := range targets {
+		batchRequest := BatchRequestStructure{Requests: []RequestDefinition{{Method: "GET", RelativeURL: relURL}}}
+		_, safeErr := batchHandler.ConstructRequests(batchRequest, false)
+		_, unsafeErr := batchHandler.ConstructRequests(batchRequest, true)
+
+		if relURL == "get/?param1=this" {
+			if safeErr != nil || unsafeErr != nil {
+				t.Error("Paths of the API should be allowed: ", relURL)
+			}
+			continue
+		}
+
+		if safeErr == nil {
+			t.Error("The batch endpoint should only allow paths of the API: ", relURL)
+		}
+		if allowedFromJSVM && unsafeErr != nil {
+			t.Error("JSVM batch requests should allow the upstream and other APIs: ", relURL)
+		}
+		if !allowedFromJSVM && unsafeErr == nil {
+			t.Error("JSVM batch request target should be rejected: ", relURL)
+		}
+	}
+
+	// A VM that doesn't belong to an API can't make batch requests
+	noAPIHandler := BatchRequestHandler{}
+	if _, err := noAPIHandler.ConstructRequests(BatchRequestStructure{Requests: []RequestDefinition{{Method: "GET", RelativeURL: "get/"}}}, true); err == nil {
+		t.Error("Batch requests without an API should be rejected")
+	}
+}
+
+func TestBatchRequestsKeepTheClientAddress(t *testing.T) {
+	oldProxies := config.TrustedProxies
+	config.TrustedProxies = []string{"10.0.0.1"}
+	config.loadTrustedProxies()
+	defer func() {
+		config.TrustedProxies = oldProxies
+		config.loadTrustedProxies()
+	}()
+
+	for _, test := range []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{"10.0.0.1:4000", "203.0.113.7"},
+		{"198.51.100.1:4000", "198.51.100.1"},
+	} {
+		batchReq, _ := http.NewRequest("POST", "/v1/tyk/batch/", nil)
+		batchReq.RemoteAddr = test.remoteAddr
+		batchReq.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+		subReq, _ := http.NewRequest("GET", "/get/", nil)
+		subReq.Header.Set("X-Forwarded-For", "192.0.2.1")
+		copyClientAddress([]*http.Request{subReq}, batchReq)
+
+		if ip := GetIPFromRequest(subReq); ip != test.expected {
+			t.Error("Expected the sub-request to come from ", test.expected, " got ", ip)
+		}
+	}
+}
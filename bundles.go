@@ -0,0 +1,496 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BUNDLE_MANIFEST_FILE     = "manifest.json"
+	BUNDLE_DOWNLOAD_TIMEOUT  = 30
+	BUNDLE_DEFAULT_DIRECTORY = "bundles"
+	BUNDLE_DEFAULT_MAX_SIZE  = 10 << 20
+)
+
+var bundleNameRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// BundleModuleConfig references the bundle of an API, a zip file name relative to the bundle base URL
+type BundleModuleConfig struct {
+	CustomMiddlewareBundle string `mapstructure:"custom_middleware_bundle" bson:"custom_middleware_bundle" json:"custom_middleware_bundle"`
+}
+
+// BundleMiddleware is the custom_middleware block of a bundle manifest, paths are relative to the bundle
+type BundleMiddleware struct {
+	Driver      string                     `json:"driver"`
+	Pre         []MiddlewareHookDefinition `json:"pre"`
+	AuthCheck   MiddlewareHookDefinition   `json:"auth_check"`
+	PostKeyAuth []MiddlewareHookDefinition `json:"post_key_auth"`
+	Post        []MiddlewareHookDefinition `json:"post"`
+	Response    []MiddlewareHookDefinition `json:"response"`
+}
+
+// BundleManifest is the manifest.json of a bundle. Checksum is the hex SHA-256 of the names, lengths
+// and contents of the files in FileList (in order), Signature is the base64 HMAC-SHA256 or RSA
+// (PKCS #1 v1.5, SHA-256) signature of the whole manifest without the signature, see bundleSignedData
+type BundleManifest struct {
+	FileList         []string         `json:"file_list"`
+	CustomMiddleware BundleMiddleware `json:"custom_middleware"`
+	Checksum         string           `json:"checksum"`
+	Signature        string           `json:"signature"`
+}
+
+// errBundleDownloading is returned while a bundle that isn't cached yet is downloaded, the APIs are
+// reloaded once it is ready
+var errBundleDownloading = errors.New("Bundle is being downloaded, the API will be loaded when it is ready")
+
+// The download and reload run in the background so loading APIs never waits for the bundle server
+var bundleDownloads = make(map[string]bool)
+var bundleDownloadsLock sync.Mutex
+
+// onBundleDownloaded runs when a download completes. It is set in init, as ReloadURLStructure leads
+// back to the download it would be an initialisation cycle
+var onBundleDownloaded func(name string)
+
+func init() {
+	onBundleDownloaded = func(name string) {
+		ReloadURLStructure()
+	}
+}
+
+// Bundle is a verified bundle, Files is keyed by the names in the manifest
+type Bundle struct {
+	Name     string
+	Manifest BundleManifest
+	Files    map[string][]byte
+	raw      []byte
+}
+
+func getBundleDirectory() string {
+	if config.Bundles.Path != "" {
+		return config.Bundles.Path
+	}
+
+	return filepath.Join(config.MiddlewarePath, BUNDLE_DEFAULT_DIRECTORY)
+}
+
+func getBundleMaxSize() int64 {
+	if config.Bundles.MaxSize > 0 {
+		return config.Bundles.MaxSize
+	}
+
+	return BUNDLE_DEFAULT_MAX_SIZE
+}
+
+// readLimited reads at most maxSize bytes, a reader with more is an error rather than cut short
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errors.New("Bundle is larger than the maximum size of " + strconv.FormatInt(maxSize, 10) + " bytes")
+	}
+
+	return data, nil
+}
+
+// isSafeBundlePath makes sure a file in a bundle can't be written outside of the bundle directory
+func isSafeBundlePath(name string) bool {
+	if name == "" || filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return false
+	}
+
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseBundle reads the manifest and the files it lists
+func parseBundle(name string, rawManifest []byte, readFile func(string) ([]byte, error)) (*Bundle, error) {
+	thisBundle := &Bundle{Name: name, Files: make(map[string][]byte), raw: rawManifest}
+	if err := json.Unmarshal(rawManifest, &thisBundle.Manifest); err != nil {
+		return nil, errors.New("Bundle manifest is malformed: " + err.Error())
+	}
+
+	for _, fileName := range thisBundle.Manifest.FileList {
+		if !isSafeBundlePath(fileName) {
+			return nil, errors.New("Bundle file has an invalid path: " + fileName)
+		}
+
+		contents, err := readFile(fileName)
+		if err != nil {
+			return nil, errors.New("Bundle file is missing: " + fileName)
+		}
+		thisBundle.Files[fileName] = contents
+	}
+
+	return thisBundle, nil
+}
+
+// readBundleZip reads a downloaded bundle, files that aren't in the manifest are ignored
+func readBundleZip(name string, data []byte) (*Bundle, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	zipFiles := make(map[string]*zip.File)
+	for _, f := range zipReader.File {
+		zipFiles[f.Name] = f
+	}
+
+	readFile := func(fileName string) ([]byte, error) {
+		f, found := zipFiles[fileName]
+		if !found {
+			return nil, os.ErrNotExist
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return readLimited(rc, getBundleMaxSize())
+	}
+
+	rawManifest, err := readFile(BUNDLE_MANIFEST_FILE)
+	if err != nil {
+		return nil, errors.New("Bundle has no manifest")
+	}
+
+	return parseBundle(name, rawManifest, readFile)
+}
+
+// readBundleDirectory reads a bundle from the local cache
+func readBundleDirectory(name string, bundleDir string) (*Bundle, error) {
+	rawManifest, err := ioutil.ReadFile(filepath.Join(bundleDir, BUNDLE_MANIFEST_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseBundle(name, rawManifest, func(fileName string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(bundleDir, fileName))
+	})
+}
+
+// bundleChecksum is the hex SHA-256 of the bundle files in manifest order, each file is hashed with
+// its name and length so contents can't be moved from one file to another
+func bundleChecksum(thisBundle *Bundle) string {
+	hasher := sha256.New()
+	for _, fileName := range thisBundle.Manifest.FileList {
+		contents := thisBundle.Files[fileName]
+		hasher.Write([]byte(fileName + "\x00" + strconv.Itoa(len(contents)) + "\x00"))
+		hasher.Write(contents)
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// bundleSignedData is what the signature of a bundle covers: the manifest without its signature
+// field, encoded as compact JSON with sorted keys. It includes the middleware hooks and the checksum
+func bundleSignedData(rawManifest []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(rawManifest))
+	decoder.UseNumber()
+
+	manifest := make(map[string]interface{})
+	if err := decoder.Decode(&manifest); err != nil {
+		return nil, errors.New("Bundle manifest is malformed: " + err.Error())
+	}
+	delete(manifest, "signature")
+
+	return json.Marshal(manifest)
+}
+
+func loadBundlePublicKey(keyPath string) (*rsa.PublicKey, error) {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, errors.New("Bundle public key is not PEM encoded")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Bundle public key is not an RSA key")
+	}
+
+	return rsaKey, nil
+}
+
+// verifyBundle checks the checksum and signature of a bundle, the public key takes precedence over
+// the secret if both are set
+func verifyBundle(thisBundle *Bundle) error {
+	if bundleChecksum(thisBundle) != thisBundle.Manifest.Checksum {
+		return errors.New("Bundle checksum does not match its files")
+	}
+
+	if config.Bundles.SkipVerification {
+		log.Warning("Bundle signature verification is disabled, loading unverified bundle: ", thisBundle.Name)
+		return nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(thisBundle.Manifest.Signature)
+	if err != nil || len(signature) == 0 {
+		return errors.New("Bundle signature is missing or malformed")
+	}
+
+	signedData, err := bundleSignedData(thisBundle.raw)
+	if err != nil {
+		return err
+	}
+
+	if config.Bundles.PublicKeyPath != "" {
+		publicKey, err := loadBundlePublicKey(config.Bundles.PublicKeyPath)
+		if err != nil {
+			return err
+		}
+
+		hashed := sha256.Sum256(signedData)
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hashed[:], signature); err != nil {
+			return errors.New("Bundle signature is invalid")
+		}
+		return nil
+	}
+
+	if config.Bundles.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(config.Bundles.Secret))
+		mac.Write(signedData)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("Bundle signature is invalid")
+		}
+		return nil
+	}
+
+	return errors.New("No public key or secret is set to verify bundles")
+}
+
+// saveBundle writes a verified bundle to the cache, it is written next to the target and moved
+// into place so a half written bundle is never loaded
+func saveBundle(thisBundle *Bundle, bundleDir string) error {
+	tmpDir := bundleDir + ".tmp"
+	os.RemoveAll(tmpDir)
+
+	files := map[string][]byte{BUNDLE_MANIFEST_FILE: thisBundle.raw}
+	for fileName, contents := range thisBundle.Files {
+		files[fileName] = contents
+	}
+
+	for fileName, contents := range files {
+		filePath := filepath.Join(tmpDir, fileName)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filePath, contents, 0644); err != nil {
+			return err
+		}
+	}
+
+	os.RemoveAll(bundleDir)
+	return os.Rename(tmpDir, bundleDir)
+}
+
+var bundleHTTPClient = &http.Client{Timeout: BUNDLE_DOWNLOAD_TIMEOUT * time.Second}
+
+func fetchBundle(name string) (*Bundle, error) {
+	if config.Bundles.BaseURL == "" {
+		return nil, errors.New("No bundle base URL is set")
+	}
+
+	if !strings.HasPrefix(strings.ToLower(config.Bundles.BaseURL), "https://") {
+		if !config.Bundles.SkipVerification {
+			return nil, errors.New("Bundles can only be downloaded over HTTPS")
+		}
+		log.Warning("Downloading unverified bundle over plain HTTP: ", name)
+	}
+
+	bundleURL := strings.TrimSuffix(config.Bundles.BaseURL, "/") + "/" + name
+	resp, err := bundleHTTPClient.Get(bundleURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Bundle server returned " + resp.Status)
+	}
+
+	data, err := readLimited(resp.Body, getBundleMaxSize())
+	if err != nil {
+		return nil, err
+	}
+
+	return readBundleZip(name, data)
+}
+
+// downloadBundle fetches a bundle, verifies it and adds it to the cache
+func downloadBundle(name string, bundleDir string) error {
+	log.Info("Downloading bundle: ", name)
+	thisBundle, err := fetchBundle(name)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyBundle(thisBundle); err != nil {
+		return err
+	}
+
+	return saveBundle(thisBundle, bundleDir)
+}
+
+// downloadBundleInBackground downloads a bundle unless it is already being downloaded, the APIs are
+// reloaded when it has been cached
+func downloadBundleInBackground(name string, bundleDir string) {
+	bundleDownloadsLock.Lock()
+	defer bundleDownloadsLock.Unlock()
+
+	if bundleDownloads[name] {
+		return
+	}
+	bundleDownloads[name] = true
+
+	go func() {
+		err := downloadBundle(name, bundleDir)
+
+		bundleDownloadsLock.Lock()
+		delete(bundleDownloads, name)
+		bundleDownloadsLock.Unlock()
+
+		if err != nil {
+			log.Error("Couldn't download bundle ", name, ": ", err)
+			return
+		}
+
+		log.Info("Bundle ", name, " downloaded, reloading APIs")
+		onBundleDownloaded(name)
+	}()
+}
+
+// getBundle returns a verified bundle from the cache. Cached bundles are verified again as the files
+// could have been changed on disk, a bundle that isn't cached is downloaded in the background
+func getBundle(name string) (*Bundle, string, error) {
+	bundleDir := filepath.Join(getBundleDirectory(), name)
+
+	if cachedBundle, err := readBundleDirectory(name, bundleDir); err == nil {
+		if err := verifyBundle(cachedBundle); err == nil {
+			return cachedBundle, bundleDir, nil
+		}
+		log.Warning("Cached bundle failed verification, downloading it again: ", name)
+	}
+
+	downloadBundleInBackground(name, bundleDir)
+	return nil, "", errBundleDownloading
+}
+
+// applyBundle replaces the custom middleware of an API with the middleware of its bundle
+func applyBundle(spec *APISpec, thisBundle *Bundle, bundleDir string) error {
+	thisMiddleware := thisBundle.Manifest.CustomMiddleware
+
+	resolve := func(mwDef *MiddlewareHookDefinition) error {
+		if _, found := thisBundle.Files[mwDef.Path]; !found {
+			return errors.New("Bundle middleware file is not in the manifest: " + mwDef.Path)
+		}
+		mwDef.Path = filepath.Join(bundleDir, mwDef.Path)
+		return nil
+	}
+
+	allDefs := []*MiddlewareHookDefinition{}
+	for _, mwList := range [][]MiddlewareHookDefinition{thisMiddleware.Pre, thisMiddleware.PostKeyAuth, thisMiddleware.Post, thisMiddleware.Response} {
+		for i := range mwList {
+			allDefs = append(allDefs, &mwList[i])
+		}
+	}
+	if thisMiddleware.AuthCheck.Name != "" {
+		allDefs = append(allDefs, &thisMiddleware.AuthCheck)
+	}
+
+	for _, mwDef := range allDefs {
+		if err := resolve(mwDef); err != nil {
+			return err
+		}
+	}
+
+	spec.APIDefinition.CustomMiddleware.Pre = []tykcommon.MiddlewareDefinition{}
+	for _, mwObj := range thisMiddleware.Pre {
+		spec.APIDefinition.CustomMiddleware.Pre = append(spec.APIDefinition.CustomMiddleware.Pre, mwObj.Definition())
+	}
+	spec.APIDefinition.CustomMiddleware.Post = []tykcommon.MiddlewareDefinition{}
+	for _, mwObj := range thisMiddleware.Post {
+		spec.APIDefinition.CustomMiddleware.Post = append(spec.APIDefinition.CustomMiddleware.Post, mwObj.Definition())
+	}
+
+	// The other hooks are read from the raw definition
+	asJson, err := json.Marshal(thisMiddleware)
+	if err != nil {
+		return err
+	}
+	rawMiddleware := make(map[string]interface{})
+	if err := json.Unmarshal(asJson, &rawMiddleware); err != nil {
+		return err
+	}
+	if spec.APIDefinition.RawData == nil {
+		spec.APIDefinition.RawData = make(map[string]interface{})
+	}
+	spec.APIDefinition.RawData["custom_middleware"] = rawMiddleware
+
+	return nil
+}
+
+// loadBundle fetches and applies the bundle of an API if it has one, an API with a bundle that
+// can't be loaded must not be loaded without its middleware
+func loadBundle(spec *APISpec) error {
+	var thisModuleConfig BundleModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		return err
+	}
+
+	name := thisModuleConfig.CustomMiddlewareBundle
+	if name == "" {
+		return nil
+	}
+
+	if !bundleNameRegex.MatchString(name) || name == "." || name == ".." {
+		return errors.New("Invalid bundle name: " + name)
+	}
+
+	thisBundle, bundleDir, err := getBundle(name)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Loading bundle ", name, " for API ", spec.APIID)
+	return applyBundle(spec, thisBundle, bundleDir)
+}
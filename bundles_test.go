@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const bundleTestSecret = "bundle-secret"
+
+func signTestManifest(t *testing.T, secret string, manifest BundleManifest) []byte {
+	manifest.Signature = ""
+	unsigned, _ := json.Marshal(manifest)
+	signedData, err := bundleSignedData(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(signedData)
+	manifest.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	rawManifest, _ := json.Marshal(manifest)
+	return rawManifest
+}
+
+func zipTestBundle(t *testing.T, rawManifest []byte, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for fileName, contents := range files {
+		f, err := zipWriter.Create(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(contents))
+	}
+	f, _ := zipWriter.Create(BUNDLE_MANIFEST_FILE)
+	f.Write(rawManifest)
+	zipWriter.Close()
+
+	return buf.Bytes()
+}
+
+func testBundleManifest(fileList []string, files map[string]string) BundleManifest {
+	checksumBundle := &Bundle{Manifest: BundleManifest{FileList: fileList}, Files: make(map[string][]byte)}
+	for fileName, contents := range files {
+		checksumBundle.Files[fileName] = []byte(contents)
+	}
+
+	return BundleManifest{
+		FileList: fileList,
+		CustomMiddleware: BundleMiddleware{
+			Pre:       []MiddlewareHookDefinition{{Name: "bundlePreMW", Path: "pre.js"}},
+			AuthCheck: MiddlewareHookDefinition{Name: "bundleAuthMW", Path: "auth.js"},
+		},
+		Checksum: bundleChecksum(checksumBundle),
+	}
+}
+
+func createTestBundle(t *testing.T, secret string, fileList []string, files map[string]string) []byte {
+	rawManifest := signTestManifest(t, secret, testBundleManifest(fileList, files))
+
+	return zipTestBundle(t, rawManifest, files)
+}
+
+func bundleDefinition(bundleName string) string {
+	return `{
+		"name": "Bundle API",
+		"api_id": "bundle1",
+		"org_id": "default",
+		"use_keyless": false,
+		"custom_middleware_bundle": "` + bundleName + `",
+		"version_data": {
+			"not_versioned": true,
+			"versions": {"Default": {"name": "Default"}}
+		},
+		"proxy": {
+			"listen_path": "/bundle/",
+			"target_url": "http://example.com",
+			"strip_listen_path": false
+		}
+	}`
+}
+
+func setupBundleServer(t *testing.T, bundles map[string][]byte) (*httptest.Server, string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bundle, found := bundles[filepath.Base(r.URL.Path)]
+		if !found {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(bundle)
+	}))
+
+	bundleDir, err := ioutil.TempDir("", "tyk-bundles")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Bundles.BaseURL = server.URL
+	config.Bundles.Path = bundleDir
+	config.Bundles.Secret = bundleTestSecret
+	bundleHTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	return server, bundleDir
+}
+
+// loadTestBundle loads a bundle that isn't cached yet, it waits for the download to finish
+func loadTestBundle(t *testing.T, spec *APISpec) error {
+	downloaded := make(chan string, 1)
+	onBundleDownloaded = func(name string) { downloaded <- name }
+	defer func() { onBundleDownloaded = func(name string) { ReloadURLStructure() } }()
+
+	if err := loadBundle(spec); err != errBundleDownloading {
+		t.Fatal("Bundles that aren't cached should be downloaded in the background, got: ", err)
+	}
+
+	select {
+	case <-downloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bundle wasn't downloaded")
+	}
+
+	return loadBundle(spec)
+}
+
+func TestLoadBundle(t *testing.T) {
+	oldBundles := config.Bundles
+	defer func() { config.Bundles = oldBundles }()
+
+	files := map[string]string{"pre.js": "var bundlePreMW = {};", "auth.js": "var bundleAuthMW = {};"}
+	server, bundleDir := setupBundleServer(t, map[string][]byte{
+		"bundle-1.zip": createTestBundle(t, bundleTestSecret, []string{"pre.js", "auth.js"}, files),
+	})
+	defer server.Close()
+	defer os.RemoveAll(bundleDir)
+
+	spec := createDefinitionFromString(bundleDefinition("bundle-1.zip"))
+	if err := loadTestBundle(t, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPath := filepath.Join(bundleDir, "bundle-1.zip", "pre.js")
+	if len(spec.CustomMiddleware.Pre) != 1 || spec.CustomMiddleware.Pre[0].Path != expectedPath {
+		t.Error("Bundle pre middleware not applied: ", spec.CustomMiddleware.Pre)
+	}
+	if contents, _ := ioutil.ReadFile(expectedPath); string(contents) != files["pre.js"] {
+		t.Error("Bundle was not cached")
+	}
+
+	thisHooks, _ := GetMiddlewareHooks(&spec)
+	if thisHooks.AuthCheck.Name != "bundleAuthMW" {
+		t.Error("Bundle auth check hook not applied: ", thisHooks.AuthCheck)
+	}
+
+	// The cached copy is used once the server is gone
+	server.Close()
+	spec = createDefinitionFromString(bundleDefinition("bundle-1.zip"))
+	if err := loadBundle(&spec); err != nil {
+		t.Error("Cached bundle should be loaded: ", err)
+	}
+}
+
+func TestLoadBundleRejectsBadBundles(t *testing.T) {
+	oldBundles := config.Bundles
+	defer func() { config.Bundles = oldBundles }()
+
+	files := map[string]string{"pre.js": "var bundlePreMW = {};", "auth.js": "var bundleAuthMW = {};"}
+	unlisted := map[string]string{"pre.js": "var bundlePreMW = {};", "auth.js": "var bundleAuthMW = {};"}
+	traversal := map[string]string{"../pre.js": "var bundlePreMW = {};"}
+
+	// The auth check hook is dropped from a signed manifest
+	tampered := testBundleManifest([]string{"pre.js", "auth.js"}, files)
+	var tamperedManifest map[string]interface{}
+	json.Unmarshal(signTestManifest(t, bundleTestSecret, tampered), &tamperedManifest)
+	delete(tamperedManifest["custom_middleware"].(map[string]interface{}), "auth_check")
+	rawTampered, _ := json.Marshal(tamperedManifest)
+
+	// Contents moved from one file to the next
+	shifted := map[string]string{"pre.js": "var bundlePreMW = {}", "auth.js": ";var bundleAuthMW = {};"}
+	rawShifted := signTestManifest(t, bundleTestSecret, testBundleManifest([]string{"pre.js", "auth.js"}, files))
+
+	server, bundleDir := setupBundleServer(t, map[string][]byte{
+		"wrong-key.zip": createTestBundle(t, "another-secret", []string{"pre.js", "auth.js"}, files),
+		"unlisted.zip":  createTestBundle(t, bundleTestSecret, []string{"pre.js"}, unlisted),
+		"traversal.zip": createTestBundle(t, bundleTestSecret, []string{"../pre.js"}, traversal),
+		"tampered.zip":  zipTestBundle(t, rawTampered, files),
+		"shifted.zip":   zipTestBundle(t, rawShifted, shifted),
+		"too-large.zip": createTestBundle(t, bundleTestSecret, []string{"pre.js", "auth.js"}, files),
+	})
+	defer server.Close()
+	defer os.RemoveAll(bundleDir)
+
+	for _, bundleName := range []string{"wrong-key.zip", "traversal.zip", "tampered.zip", "shifted.zip", "missing.zip"} {
+		if err := downloadBundle(bundleName, filepath.Join(bundleDir, bundleName)); err == nil {
+			t.Error("Bundle should be rejected: ", bundleName)
+		}
+	}
+
+	// Signed, but its middleware isn't in the file list
+	if err := downloadBundle("unlisted.zip", filepath.Join(bundleDir, "unlisted.zip")); err != nil {
+		t.Fatal(err)
+	}
+	spec := createDefinitionFromString(bundleDefinition("unlisted.zip"))
+	if err := loadBundle(&spec); err == nil {
+		t.Error("Bundle middleware that isn't in the file list should be rejected")
+	}
+
+	config.Bundles.MaxSize = 100
+	if err := downloadBundle("too-large.zip", filepath.Join(bundleDir, "too-large.zip")); err == nil {
+		t.Error("Bundles over the maximum size should be rejected")
+	}
+	config.Bundles.MaxSize = 0
+
+	config.Bundles.BaseURL = strings.Replace(server.URL, "https://", "http://", 1)
+	if err := downloadBundle("unlisted.zip", filepath.Join(bundleDir, "unlisted.zip")); err == nil {
+		t.Error("Bundles shouldn't be downloaded over plain HTTP")
+	}
+
+	spec = createDefinitionFromString(bundleDefinition("../bundle.zip"))
+	if err := loadBundle(&spec); err == nil || err == errBundleDownloading {
+		t.Error("Invalid bundle names should be rejected: ", err)
+	}
+}
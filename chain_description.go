@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// ChainObject describes a single step in the constructed middleware chain of an API
+type ChainObject struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Source string `json:"source,omitempty"`
+}
+
+// APIChainDescription is reported by the /tyk/chain/ endpoint, it reflects the chain as it was
+// actually constructed when the API was loaded, not what the definition says it should be
+type APIChainDescription struct {
+	APIID              string        `json:"api_id"`
+	Name               string        `json:"name"`
+	ListenPath         string        `json:"listen_path"`
+	Keyless            bool          `json:"keyless"`
+	Middleware         []ChainObject `json:"middleware"`
+	ResponseProcessors []string      `json:"response_processors"`
+	Endpoints          []string      `json:"endpoints"`
+}
+
+// ChainBuilder assembles an alice chain and keeps an ordered record of everything added to it
+type ChainBuilder struct {
+	TykMiddleware *TykMiddleware
+	Constructors  []alice.Constructor
+	Description   []ChainObject
+	Trace         *DebugTrace
+}
+
+// Add appends a raw constructor to the chain
+func (c *ChainBuilder) Add(thisObject ChainObject, constructor alice.Constructor) {
+	if c.Trace != nil {
+		constructor = c.Trace.Wrap(thisObject, constructor)
+	}
+	c.Constructors = append(c.Constructors, constructor)
+	c.Description = append(c.Description, thisObject)
+}
+
+// AddMiddleware creates the middleware and appends it to the chain
+func (c *ChainBuilder) AddMiddleware(mw TykMiddlewareImplementation) {
+	thisObject := DescribeMiddleware(mw)
+	if c.Trace != nil {
+		// A bad configuration is fatal when loading APIs, when tracing it is reported instead
+		mw.New()
+		if _, err := mw.GetConfig(); err != nil {
+			c.Trace.ConfigErrors = append(c.Trace.ConfigErrors, thisObject.Name+": "+err.Error())
+			return
+		}
+	}
+
+	c.Add(thisObject, CreateMiddleware(mw, c.TykMiddleware))
+}
+
+// AddDynamicMiddleware appends a JSVM middleware to the chain at one of the MW_HOOK_* points
+func (c *ChainBuilder) AddDynamicMiddleware(mwDef tykcommon.MiddlewareDefinition, hook string) {
+	thisObject := dynamicChainEntry(mwDef, hook).object
+	dMiddleware := &DynamicMiddleware{
+		TykMiddleware:       c.TykMiddleware,
+		MiddlewareClassName: mwDef.Name,
+		Pre:                 hook == MW_HOOK_PRE,
+		UseSession:          mwDef.RequireSession,
+		Hook:                hook,
+	}
+	c.Add(thisObject, CreateMiddleware(dMiddleware, c.TykMiddleware))
+}
+
+// Then finalises the chain with the handler h
+func (c *ChainBuilder) Then(h http.Handler) http.Handler {
+	return alice.New(c.Constructors...).Then(h)
+}
+
+// DescribeMiddleware generates a chain entry for a middleware object, JSVM middleware are described
+// by their class name and hook
+func DescribeMiddleware(mw TykMiddlewareImplementation) ChainObject {
+	if dynamicMw, ok := mw.(*DynamicMiddleware); ok {
+		return ChainObject{Name: dynamicMw.MiddlewareClassName, Type: dynamicMw.Hook}
+	}
+
+	thisType := reflect.TypeOf(mw)
+	if thisType.Kind() == reflect.Ptr {
+		thisType = thisType.Elem()
+	}
+
+	return ChainObject{Name: thisType.Name(), Type: "builtin"}
+}
+
+// DescribeAPIChain builds the chain description for a loaded API
+func DescribeAPIChain(spec *APISpec) APIChainDescription {
+	thisDescription := APIChainDescription{
+		APIID:              spec.APIID,
+		Name:               spec.Name,
+		ListenPath:         spec.Proxy.ListenPath,
+		Keyless:            spec.UseKeylessAccess,
+		Middleware:         spec.MiddlewareChain,
+		ResponseProcessors: []string{},
+		Endpoints:          []string{spec.Proxy.ListenPath},
+	}
+
+	for _, processorDetail := range spec.ResponseProcessors {
+		thisDescription.ResponseProcessors = append(thisDescription.ResponseProcessors, processorDetail.Name)
+	}
+
+	if thisHooks, supported := GetMiddlewareHooks(spec); supported {
+		for _, mwObj := range thisHooks.Response {
+			thisDescription.ResponseProcessors = append(thisDescription.ResponseProcessors, mwObj.Name)
+		}
+	}
+
+	if !spec.UseKeylessAccess {
+		thisDescription.Endpoints = append(thisDescription.Endpoints, rateLimitsPath(spec))
+	}
+
+	if spec.EnableBatchRequestSupport {
+		thisDescription.Endpoints = append(thisDescription.Endpoints, spec.Proxy.ListenPath+"tyk/batch/")
+	}
+
+	if spec.UseOauth2 {
+		thisDescription.Endpoints = append(thisDescription.Endpoints,
+			spec.Proxy.ListenPath+"tyk/oauth/authorize-client/",
+			spec.Proxy.ListenPath+"oauth/authorize/",
+			spec.Proxy.ListenPath+"oauth/token/")
+	}
+
+	return thisDescription
+}
+
+// DescribeAllAPIChains returns the chain descriptions of all loaded APIs, ordered by API ID
+func DescribeAllAPIChains() []APIChainDescription {
+	specs := getApiSpecs()
+	APIIDs := []string{}
+	for APIID, _ := range specs {
+		APIIDs = append(APIIDs, APIID)
+	}
+	sort.Strings(APIIDs)
+
+	descriptions := []APIChainDescription{}
+	for _, APIID := range APIIDs {
+		descriptions = append(descriptions, DescribeAPIChain(specs[APIID]))
+	}
+
+	return descriptions
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"testing"
+)
+
+func TestChainBuilderKeepsOrder(t *testing.T) {
+	spec := APISpec{}
+	tykMiddleware := &TykMiddleware{&spec, nil}
+	chainBuilder := &ChainBuilder{TykMiddleware: tykMiddleware}
+
+	passThrough := func(h http.Handler) http.Handler { return h }
+	chainBuilder.Add(ChainObject{Name: "CORS", Type: "builtin"}, passThrough)
+	chainBuilder.AddMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware})
+	chainBuilder.AddDynamicMiddleware(tykcommon.MiddlewareDefinition{Name: "testPostMW", Path: "middleware/post.js"}, MW_HOOK_POST)
+
+	if len(chainBuilder.Constructors) != 3 {
+		t.Fatal("Expected 3 constructors, got: ", len(chainBuilder.Constructors))
+	}
+
+	expected := []ChainObject{
+		ChainObject{Name: "CORS", Type: "builtin"},
+		ChainObject{Name: "IPWhiteListMiddleware", Type: "builtin"},
+		ChainObject{Name: "testPostMW", Type: "post", Source: "middleware/post.js"},
+	}
+
+	for i, thisObject := range expected {
+		if chainBuilder.Description[i] != thisObject {
+			t.Errorf("Chain entry %v does not match, expected: %v, got: %v", i, thisObject, chainBuilder.Description[i])
+		}
+	}
+}
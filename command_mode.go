@@ -18,6 +18,8 @@ var CommandModeOptions = map[string]bool{
 	"--as-mock":          true,
 	"--for-api":          true,
 	"--as-version":       true,
+	"bench":              true,
+	"--import-keys":      true,
 }
 
 // ./tyk --import-blueprint=blueprint.json --create-api --org-id=<id> --upstream-target="http://widgets.com/api/"`
@@ -31,6 +33,14 @@ func HandleCommandModeArgs(arguments map[string]interface{}) {
 		handleSwaggerMode(arguments)
 	}
 
+	if arguments["bench"] == true {
+		handleBenchMode(arguments)
+	}
+
+	if arguments["--import-keys"] != nil {
+		handleKeyImportMode(arguments)
+	}
+
 }
 
 func handleBluePrintMode(arguments map[string]interface{}) {
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BenchRequestTemplate is the request that gets replayed by "tyk bench"
+type BenchRequestTemplate struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// BenchResult is the outcome of a single replayed request, QuotaExceeded is set if a 403 was
+// caused by the key's quota rather than by access being denied
+type BenchResult struct {
+	Code          int
+	Latency       time.Duration
+	Remaining     string
+	QuotaExceeded bool
+	Err           error
+}
+
+// BenchReport summarises a bench run
+type BenchReport struct {
+	Requests     int
+	Concurrency  int
+	Duration     time.Duration
+	Errors       int
+	Codes        map[int]int
+	RateLimited  int
+	QuotaBlocked int
+	Forbidden    int
+	P50          time.Duration
+	P90          time.Duration
+	P95          time.Duration
+	P99          time.Duration
+	Max          time.Duration
+	Mean         time.Duration
+	MinRemaining string
+}
+
+// ./tyk bench --bench-target=http://localhost:8080/my-api/ --bench-template=req.json --concurrency=20 --requests=5000
+func handleBenchMode(arguments map[string]interface{}) {
+	target, _ := arguments["--bench-target"].(string)
+	if target == "" {
+		log.Error("A target URL is required for bench mode, please set one using the --bench-target flag")
+		return
+	}
+
+	thisTemplate := BenchRequestTemplate{Method: "GET"}
+	templateFile, _ := arguments["--bench-template"].(string)
+	if templateFile != "" {
+		templateData, err := ioutil.ReadFile(templateFile)
+		if err != nil {
+			log.Error("Couldn't load request template: ", err)
+			return
+		}
+
+		if decErr := json.Unmarshal(templateData, &thisTemplate); decErr != nil {
+			log.Error("Couldn't decode request template: ", decErr)
+			return
+		}
+	}
+
+	concurrency := getBenchIntArg(arguments, "--concurrency", 10)
+	requests := getBenchIntArg(arguments, "--requests", 1000)
+
+	log.Info(fmt.Sprintf("Sending %v requests to %v with a concurrency of %v", requests, target, concurrency))
+	thisReport := RunBench(target, thisTemplate, concurrency, requests)
+	printBenchReport(thisReport)
+}
+
+func getBenchIntArg(arguments map[string]interface{}, name string, defaultVal int) int {
+	val, _ := arguments[name].(string)
+	if val == "" {
+		return defaultVal
+	}
+
+	asInt, err := strconv.Atoi(val)
+	if err != nil || asInt < 1 {
+		log.Warning(fmt.Sprintf("Invalid value for %v, using %v", name, defaultVal))
+		return defaultVal
+	}
+
+	return asInt
+}
+
+// RunBench replays the request template against target and collects the results
+func RunBench(target string, thisTemplate BenchRequestTemplate, concurrency int, requests int) BenchReport {
+	client := &http.Client{Timeout: 60 * time.Second}
+	jobs := make(chan int, requests)
+	results := make(chan BenchResult, requests)
+
+	for i := 0; i < requests; i++ {
+		jobs <- i
+	}
+	close(jobs)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _ = range jobs {
+				results <- doBenchRequest(client, target, thisTemplate)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	allResults := []BenchResult{}
+	for thisResult := range results {
+		allResults = append(allResults, thisResult)
+	}
+
+	return GenerateBenchReport(allResults, concurrency, time.Since(start))
+}
+
+func doBenchRequest(client *http.Client, target string, thisTemplate BenchRequestTemplate) BenchResult {
+	var body io.Reader
+	if thisTemplate.Body != "" {
+		body = bytes.NewBufferString(thisTemplate.Body)
+	}
+
+	req, err := http.NewRequest(thisTemplate.Method, singleJoiningSlash(target, thisTemplate.Path), body)
+	if err != nil {
+		return BenchResult{Err: err}
+	}
+
+	for k, v := range thisTemplate.Headers {
+		req.Header.Set(k, v)
+	}
+
+	t1 := time.Now()
+	resp, respErr := client.Do(req)
+	if respErr != nil {
+		return BenchResult{Err: respErr, Latency: time.Since(t1)}
+	}
+
+	// A 403 is only a quota violation if the error says so, the start of the body is enough
+	quotaExceeded := false
+	if resp.StatusCode == 403 {
+		errBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		quotaExceeded = bytes.Contains(errBody, []byte("Quota exceeded"))
+	}
+
+	// Read the full body so the connection can be re-used
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return BenchResult{
+		Code:          resp.StatusCode,
+		Latency:       time.Since(t1),
+		Remaining:     resp.Header.Get("X-RateLimit-Remaining"),
+		QuotaExceeded: quotaExceeded,
+	}
+}
+
+// GenerateBenchReport calculates latency percentiles and limiter behaviour from a set of results
+func GenerateBenchReport(results []BenchResult, concurrency int, duration time.Duration) BenchReport {
+	thisReport := BenchReport{
+		Requests:    len(results),
+		Concurrency: concurrency,
+		Duration:    duration,
+		Codes:       make(map[int]int),
+	}
+
+	latencies := []time.Duration{}
+	var total time.Duration
+	minRemaining := -1
+
+	for _, thisResult := range results {
+		if thisResult.Err != nil {
+			thisReport.Errors++
+			continue
+		}
+
+		thisReport.Codes[thisResult.Code]++
+		latencies = append(latencies, thisResult.Latency)
+		total += thisResult.Latency
+
+		switch thisResult.Code {
+		case 429:
+			thisReport.RateLimited++
+		case 403:
+			if thisResult.QuotaExceeded {
+				thisReport.QuotaBlocked++
+			} else {
+				thisReport.Forbidden++
+			}
+		}
+
+		if thisResult.Remaining != "" {
+			remaining, err := strconv.Atoi(thisResult.Remaining)
+			if err == nil && (minRemaining == -1 || remaining < minRemaining) {
+				minRemaining = remaining
+			}
+		}
+	}
+
+	if minRemaining > -1 {
+		thisReport.MinRemaining = strconv.Itoa(minRemaining)
+	}
+
+	if len(latencies) == 0 {
+		return thisReport
+	}
+
+	sort.Sort(durationSlice(latencies))
+	thisReport.P50 = getPercentile(latencies, 50)
+	thisReport.P90 = getPercentile(latencies, 90)
+	thisReport.P95 = getPercentile(latencies, 95)
+	thisReport.P99 = getPercentile(latencies, 99)
+	thisReport.Max = latencies[len(latencies)-1]
+	thisReport.Mean = total / time.Duration(len(latencies))
+
+	return thisReport
+}
+
+type durationSlice []time.Duration
+
+func (d durationSlice) Len() int           { return len(d) }
+func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
+func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// getPercentile uses the nearest-rank method, sorted must be in ascending order
+func getPercentile(sorted []time.Duration, percentile int) time.Duration {
+	rank := (percentile*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+func printBenchReport(thisReport BenchReport) {
+	fmt.Printf("Requests:\t%v (%v errors)\n", thisReport.Requests, thisReport.Errors)
+	fmt.Printf("Concurrency:\t%v\n", thisReport.Concurrency)
+	fmt.Printf("Duration:\t%v\n", thisReport.Duration)
+	if thisReport.Duration > 0 {
+		fmt.Printf("Throughput:\t%.2f req/s\n", float64(thisReport.Requests)/thisReport.Duration.Seconds())
+	}
+
+	fmt.Println("\nLatency:")
+	fmt.Printf("\tmean\t%v\n", thisReport.Mean)
+	fmt.Printf("\tp50\t%v\n", thisReport.P50)
+	fmt.Printf("\tp90\t%v\n", thisReport.P90)
+	fmt.Printf("\tp95\t%v\n", thisReport.P95)
+	fmt.Printf("\tp99\t%v\n", thisReport.P99)
+	fmt.Printf("\tmax\t%v\n", thisReport.Max)
+
+	codes := []string{}
+	for code, count := range thisReport.Codes {
+		codes = append(codes, fmt.Sprintf("%v: %v", code, count))
+	}
+	sort.Strings(codes)
+
+	fmt.Println("\nStatus codes:")
+	fmt.Printf("\t%v\n", strings.Join(codes, ", "))
+
+	fmt.Println("\nLimiter:")
+	fmt.Printf("\trate limited (429)\t%v\n", thisReport.RateLimited)
+	fmt.Printf("\tquota exceeded (403)\t%v\n", thisReport.QuotaBlocked)
+	fmt.Printf("\tother 403\t%v\n", thisReport.Forbidden)
+	if thisReport.MinRemaining != "" {
+		fmt.Printf("\tlowest X-RateLimit-Remaining\t%v\n", thisReport.MinRemaining)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBenchQuotaExceeded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(403)
+		if r.URL.Path == "/quota" {
+			w.Write([]byte(`{"error": "Quota exceeded"}`))
+			return
+		}
+		w.Write([]byte(`{"error": "Access to this API has been disallowed"}`))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	results := []BenchResult{
+		doBenchRequest(client, server.URL, BenchRequestTemplate{Method: "GET", Path: "/quota"}),
+		doBenchRequest(client, server.URL, BenchRequestTemplate{Method: "GET", Path: "/denied"}),
+		{Code: 429},
+	}
+
+	thisReport := GenerateBenchReport(results, 1, time.Second)
+	if thisReport.QuotaBlocked != 1 {
+		t.Error("Expected one quota violation, got: ", thisReport.QuotaBlocked)
+	}
+	if thisReport.Forbidden != 1 {
+		t.Error("Access denied should not count as a quota violation, got: ", thisReport.Forbidden)
+	}
+	if thisReport.RateLimited != 1 {
+		t.Error("Expected one rate limited request, got: ", thisReport.RateLimited)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"sync"
+)
+
+const (
+	CONCURRENCY_KEY_PREFIX       = "concurrency-"
+	CONCURRENCY_DEFAULT_SLOT_TTL = 300
+)
+
+// ConcurrencyLimitConfig caps the number of requests an API handles at once, PerKey applies to each
+// key unless the key (or its policy) sets max_concurrent and PerAPI applies to all requests of the
+// API. Counts are kept per node unless Distributed is set, then they are shared through Redis
+type ConcurrencyLimitConfig struct {
+	PerKey      int64 `mapstructure:"per_key" bson:"per_key" json:"per_key"`
+	PerAPI      int64 `mapstructure:"per_api" bson:"per_api" json:"per_api"`
+	Distributed bool  `mapstructure:"distributed" bson:"distributed" json:"distributed"`
+	SlotTTL     int64 `mapstructure:"slot_ttl" bson:"slot_ttl" json:"slot_ttl"`
+}
+
+type ConcurrencyLimitModuleConfig struct {
+	ConcurrencyLimit ConcurrencyLimitConfig `mapstructure:"concurrency_limit" bson:"concurrency_limit" json:"concurrency_limit"`
+}
+
+// localConcurrencyCounter keeps the requests in flight on this node, it is shared by all APIs so
+// that the counts survive a reload
+type localConcurrencyCounter struct {
+	sync.Mutex
+	inFlight map[string]int64
+}
+
+var LocalConcurrency = &localConcurrencyCounter{inFlight: make(map[string]int64)}
+
+func (c *localConcurrencyCounter) AcquireSlot(keyName string, limit int64, ttl int64) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.inFlight[keyName] >= limit {
+		return false, nil
+	}
+	c.inFlight[keyName]++
+
+	return true, nil
+}
+
+func (c *localConcurrencyCounter) ReleaseSlot(keyName string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.inFlight[keyName]--
+	if c.inFlight[keyName] <= 0 {
+		delete(c.inFlight, keyName)
+	}
+
+	return nil
+}
+
+type heldSlot struct {
+	store   ConcurrencySlotStorage
+	keyName string
+}
+
+// concurrencySlots are the slots taken by a request, they are given back by
+// ConcurrencyReleaseHandler once the request is done
+type concurrencySlots struct {
+	sync.Mutex
+	held []heldSlot
+}
+
+func (s *concurrencySlots) acquire(store ConcurrencySlotStorage, keyName string, limit int64, ttl int64) (bool, error) {
+	acquired, err := store.AcquireSlot(keyName, limit, ttl)
+	if err != nil || !acquired {
+		return acquired, err
+	}
+
+	s.Lock()
+	s.held = append(s.held, heldSlot{store, keyName})
+	s.Unlock()
+
+	return true, nil
+}
+
+func (s *concurrencySlots) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, slot := range s.held {
+		slot.store.ReleaseSlot(slot.keyName)
+	}
+	s.held = nil
+}
+
+// ConcurrencyReleaseHandler wraps the chain of an API, the slots are kept outside of the context as
+// the context is cleared before the chain returns
+func ConcurrencyReleaseHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slots := &concurrencySlots{}
+		context.Set(r, ConcurrencySlots, slots)
+		defer slots.release()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// ConcurrencyLimit rejects requests once a key or the API has too many requests in flight, this
+// protects the upstream from a pile up of slow requests that a rate limit would let through
+type ConcurrencyLimit struct {
+	*TykMiddleware
+	store ConcurrencySlotStorage
+}
+
+func (c *ConcurrencyLimit) New() {
+	c.store = LocalConcurrency
+
+	thisConfig := GetConcurrencyLimitConfig(c.Spec)
+	if thisConfig.Distributed {
+		if config.Storage.EnableCluster {
+			log.Warning("Distributed concurrency limits need Lua scripting which isn't available with a Redis cluster, counting per node")
+			return
+		}
+
+		redisStore := &RedisClusterStorageManager{}
+		redisStore.Connect()
+		c.store = redisStore
+	}
+}
+
+func GetConcurrencyLimitConfig(spec *APISpec) ConcurrencyLimitConfig {
+	var thisModuleConfig ConcurrencyLimitModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode concurrency limit configuration: ", err)
+	}
+
+	thisConfig := thisModuleConfig.ConcurrencyLimit
+	if thisConfig.SlotTTL <= 0 {
+		thisConfig.SlotTTL = CONCURRENCY_DEFAULT_SLOT_TTL
+	}
+
+	return thisConfig
+}
+
+// GetConfig retrieves the configuration from the API config
+func (c *ConcurrencyLimit) GetConfig() (interface{}, error) {
+	return GetConcurrencyLimitConfig(c.Spec), nil
+}
+
+// keyLimit is the limit of the key making the request, a key can raise or lower the API default and
+// a negative value lifts it
+func (c *ConcurrencyLimit) keyLimit(r *http.Request, thisConfig ConcurrencyLimitConfig) int64 {
+	if thisSession, ok := context.Get(r, SessionData).(SessionState); ok && thisSession.MaxConcurrent != 0 {
+		return thisSession.MaxConcurrent
+	}
+
+	return thisConfig.PerKey
+}
+
+func (c *ConcurrencyLimit) rejectRequest(r *http.Request, authHeaderValue string, message string) (error, int) {
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": GetIPFromRequest(r),
+		"key":    c.Spec.LogMasking.MaskKey(authHeaderValue),
+	}).Info(message)
+
+	// Report in health check
+	ReportHealthCheckValue(c.Spec.Health, Throttle, "1")
+
+	return errors.New(message), 429
+}
+
+// ProcessRequest takes a slot for the API and one for the key, if the store fails the request is let through
+func (c *ConcurrencyLimit) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(ConcurrencyLimitConfig)
+
+	slots, ok := context.Get(r, ConcurrencySlots).(*concurrencySlots)
+	if !ok {
+		// Nothing would give the slots back
+		return nil, 200
+	}
+
+	authHeaderValue, _ := context.Get(r, AuthHeaderValue).(string)
+
+	if thisConfig.PerAPI > 0 {
+		acquired, err := slots.acquire(c.store, CONCURRENCY_KEY_PREFIX+"api-"+c.Spec.APIID, thisConfig.PerAPI, thisConfig.SlotTTL)
+		if err == nil && !acquired {
+			return c.rejectRequest(r, authHeaderValue, "API concurrency limit exceeded")
+		}
+	}
+
+	if keyLimit := c.keyLimit(r, thisConfig); keyLimit > 0 && authHeaderValue != "" {
+		acquired, err := slots.acquire(c.store, CONCURRENCY_KEY_PREFIX+"key-"+publicHash(authHeaderValue), keyLimit, thisConfig.SlotTTL)
+		if err == nil && !acquired {
+			return c.rejectRequest(r, authHeaderValue, "Key concurrency limit exceeded")
+		}
+	}
+
+	return nil, 200
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func createConcurrencyLimitRequest(key string, session SessionState) (*http.Request, *concurrencySlots) {
+	req, _ := http.NewRequest("GET", "/maintenance/widgets", nil)
+	slots := &concurrencySlots{}
+	context.Set(req, ConcurrencySlots, slots)
+	context.Set(req, AuthHeaderValue, key)
+	context.Set(req, SessionData, session)
+	return req, slots
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"concurrency_limit": {"per_key": 1, "per_api": 3},`, 1))
+	limiter := &ConcurrencyLimit{TykMiddleware: &TykMiddleware{&spec, nil}}
+	limiter.New()
+	thisConfig, _ := limiter.GetConfig()
+
+	first, firstSlots := createConcurrencyLimitRequest("key1", SessionState{})
+	defer context.Clear(first)
+	if err, _ := limiter.ProcessRequest(nil, first, thisConfig); err != nil {
+		t.Fatal("First request should be let through: ", err)
+	}
+
+	second, secondSlots := createConcurrencyLimitRequest("key1", SessionState{})
+	defer context.Clear(second)
+	if err, code := limiter.ProcessRequest(nil, second, thisConfig); err == nil || code != 429 {
+		t.Error("Key should be limited to one request in flight: ", code)
+	}
+	secondSlots.release()
+
+	// The key can raise its own limit, the API limit still applies
+	unlimited, unlimitedSlots := createConcurrencyLimitRequest("key2", SessionState{MaxConcurrent: -1})
+	defer context.Clear(unlimited)
+	for i := 0; i < 2; i++ {
+		if err, _ := limiter.ProcessRequest(nil, unlimited, thisConfig); err != nil {
+			t.Error("Key without a limit was limited: ", err)
+		}
+	}
+	if err, _ := limiter.ProcessRequest(nil, unlimited, thisConfig); err == nil || err.Error() != "API concurrency limit exceeded" {
+		t.Error("API limit should apply: ", err)
+	}
+	unlimitedSlots.release()
+
+	firstSlots.release()
+	if err, _ := limiter.ProcessRequest(nil, second, thisConfig); err != nil {
+		t.Error("Slot should be free once the first request is done: ", err)
+	}
+	secondSlots.release()
+}
+
+func TestConcurrencyReleaseHandler(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"concurrency_limit": {"per_key": 1},`, 1))
+	limiter := &ConcurrencyLimit{TykMiddleware: &TykMiddleware{&spec, nil}}
+	limiter.New()
+	thisConfig, _ := limiter.GetConfig()
+
+	keyName := CONCURRENCY_KEY_PREFIX + "key-" + publicHash("key3")
+	handler := ConcurrencyReleaseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		context.Set(r, AuthHeaderValue, "key3")
+		limiter.ProcessRequest(w, r, thisConfig)
+		if LocalConcurrency.inFlight[keyName] != 1 {
+			t.Error("Slot wasn't taken")
+		}
+		context.Clear(r)
+	}))
+
+	req, _ := http.NewRequest("GET", "/maintenance/widgets", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if _, found := LocalConcurrency.inFlight[keyName]; found {
+		t.Error("Slot should be released after the request")
+	}
+}
@@ -11,11 +11,12 @@ import (
 
 // Config is the configuration object used by tyk to set up various parameters.
 type Config struct {
-	ListenPort     int    `json:"listen_port"`
-	Secret         string `json:"secret"`
-	TemplatePath   string `json:"template_path"`
-	TykJSPath      string `json:"tyk_js_path"`
-	MiddlewarePath string `json:"middleware_path"`
+	ListenPort     int          `json:"listen_port"`
+	Secret         string       `json:"secret"`
+	AdminTokens    []AdminToken `json:"admin_tokens"`
+	TemplatePath   string       `json:"template_path"`
+	TykJSPath      string       `json:"tyk_js_path"`
+	MiddlewarePath string       `json:"middleware_path"`
 	Policies       struct {
 		PolicySource     string `json:"policy_source"`
 		PolicyRecordName string `json:"policy_record_name"`
@@ -37,21 +38,28 @@ type Config struct {
 		MaxIdle       int               `json:"optimisation_max_idle"`
 		MaxActive     int               `json:"optimisation_max_active"`
 		EnableCluster bool              `json:"enable_cluster"`
+		LRUSize       int               `json:"lru_size"`
 	} `json:"storage"`
+	Memcached struct {
+		Hosts   []string `json:"hosts"`
+		MaxIdle int      `json:"optimisation_max_idle"`
+	} `json:"memcached"`
 	EnableAnalytics bool `json:"enable_analytics"`
 	AnalyticsConfig struct {
-		Type               string   `json:"type"`
-		CSVDir             string   `json:"csv_dir"`
-		MongoURL           string   `json:"mongo_url"`
-		MongoDbName        string   `json:"mongo_db_name"`
-		MongoCollection    string   `json:"mongo_collection"`
-		PurgeDelay         int      `json:"purge_delay"`
-		IgnoredIPs         []string `json:"ignored_ips"`
-		ignoredIPsCompiled map[string]bool
+		Type                    string   `json:"type"`
+		CSVDir                  string   `json:"csv_dir"`
+		MongoURL                string   `json:"mongo_url"`
+		MongoDbName             string   `json:"mongo_db_name"`
+		MongoCollection         string   `json:"mongo_collection"`
+		PurgeDelay              int      `json:"purge_delay"`
+		IgnoredIPs              []string `json:"ignored_ips"`
+		EnableMiddlewareTimings bool     `json:"enable_middleware_timings"`
+		ignoredIPsCompiled      map[string]bool
 	} `json:"analytics_config"`
 	HealthCheck struct {
 		EnableHealthChecks      bool  `json:"enable_health_checks"`
 		HealthCheckValueTimeout int64 `json:"health_check_value_timeouts"`
+		FlushInterval           int   `json:"health_check_flush_interval"`
 	} `json:"health_check"`
 	UseAsyncSessionWrite            bool   `json:"optimisations_use_async_session_write"`
 	AllowMasterKeys                 bool   `json:"allow_master_keys"`
@@ -72,11 +80,19 @@ type Config struct {
 	}
 	OauthRefreshExpire int64 `json:"oauth_refresh_token_expire"`
 	SlaveOptions       struct {
-		UseRPC           bool   `json:"use_rpc"`
-		ConnectionString string `json:"connection_string"`
-		RPCKey           string `json:"rpc_key"`
-		APIKey           string `json:"api_key"`
-		EnableRPCCache   bool   `json:"enable_rpc_cache"`
+		UseRPC                 bool   `json:"use_rpc"`
+		ConnectionString       string `json:"connection_string"`
+		RPCKey                 string `json:"rpc_key"`
+		APIKey                 string `json:"api_key"`
+		EnableRPCCache         bool   `json:"enable_rpc_cache"`
+		RPCMaxRetries          int    `json:"rpc_max_retries"`
+		RPCBackoffMax          int    `json:"rpc_backoff_max"`
+		RPCCompression         string `json:"rpc_compression"`
+		RPCPoolSize            int    `json:"rpc_pool_size"`
+		KeySpaceSyncInterval   int    `json:"key_space_sync_interval"`
+		ReloadTimeout          int    `json:"rpc_reload_timeout"`
+		AnalyticsSpoolDir      string `json:"analytics_spool_dir"`
+		AnalyticsSpoolMaxFiles int    `json:"analytics_spool_max_files"`
 	} `json:"slave_options"`
 	DisableVirtualPathBlobs bool `json:"disable_virtual_path_blobs"`
 	HttpServerOptions       struct {
@@ -87,18 +103,89 @@ type Config struct {
 		Certificates     []CertData `json:"certificates"`
 		ServerName       string     `json:"server_name"`
 		MinVersion       uint16     `json:"min_version"`
+		ClientCAFile     string     `json:"client_ca_file"`
 		FlushInterval    int        `json:"flush_interval"`
 	} `json:"http_server_options"`
-	ServiceDiscovery struct {
+	Listener               ListenerConfig `json:"listener"`
+	TrustedProxies         []string       `json:"trusted_proxies"`
+	trustedProxiesCompiled []*net.IPNet
+	ServiceDiscovery       struct {
 		DefaultCacheTimeout int `json:"default_cache_timeout"`
 	} `json:"service_discovery"`
-	CloseConnections bool `json:"close_connections"`
-	AuthOverride     struct {
+	CloseConnections  bool                  `json:"close_connections"`
+	ProxyTransport    ProxyTransportConfig  `json:"proxy_transport"`
+	BannedHeaderRules []HeaderDenyRule      `json:"banned_header_rules"`
+	HeaderHardening   HeaderHardeningConfig `json:"header_hardening"`
+	SelfTelemetry     struct {
+		Enabled     bool  `json:"enabled"`
+		Interval    int   `json:"interval"`
+		ExpireAfter int64 `json:"expire_after"`
+	} `json:"self_telemetry"`
+	TokenRevocation struct {
+		Enabled         bool `json:"enabled"`
+		RefreshInterval int  `json:"refresh_interval"`
+		ExpectedTokens  int  `json:"expected_tokens"`
+	} `json:"token_revocation"`
+	UsageMetering struct {
+		Enabled        bool                  `json:"enabled"`
+		RetentionHours int64                 `json:"retention_hours"`
+		Exporters      []UsageExporterConfig `json:"exporters"`
+	} `json:"usage_metering"`
+	KeyGeneration KeyGenerationConfig `json:"key_generation"`
+	NodeRegistry  struct {
+		Disabled          bool `json:"disabled"`
+		HeartbeatInterval int  `json:"heartbeat_interval"`
+	} `json:"node_registry"`
+	KeyUsage struct {
+		Enabled        bool `json:"enabled"`
+		FlushInterval  int  `json:"flush_interval"`
+		ReapAfterDays  int  `json:"reap_after_days"`
+		ReaperInterval int  `json:"reaper_interval"`
+	} `json:"key_usage"`
+	AuditLog struct {
+		Enabled      bool   `json:"enabled"`
+		Type         string `json:"type"`
+		FilePath     string `json:"file_path"`
+		MaxSizeMB    int    `json:"max_size_mb"`
+		MaxBackups   int    `json:"max_backups"`
+		MaxRecords   int64  `json:"max_records"`
+		IncludeReads bool   `json:"include_reads"`
+	} `json:"audit_log"`
+	LocalSessionCache struct {
+		Enabled    bool  `json:"enabled"`
+		TTL        int64 `json:"cached_session_timeout"`
+		MaxEntries int   `json:"max_entries"`
+	} `json:"local_session_cache"`
+	Hooks struct {
+		OnStartup []HookConfig `json:"on_startup"`
+		OnReload  []HookConfig `json:"on_reload"`
+	} `json:"hooks"`
+	Secrets SecretsConfig `json:"secrets"`
+	Bundles struct {
+		BaseURL          string `json:"base_url"`
+		Path             string `json:"path"`
+		PublicKeyPath    string `json:"public_key_path"`
+		Secret           string `json:"secret"`
+		SkipVerification bool   `json:"skip_verification"`
+		MaxSize          int64  `json:"max_size"`
+	} `json:"bundles"`
+	GlobalMiddleware struct {
+		Pre  []MiddlewareHookDefinition `json:"pre"`
+		Post []MiddlewareHookDefinition `json:"post"`
+	} `json:"global_middleware"`
+	AuthOverride struct {
 		ForceAuthProvider    bool                          `json:"force_auth_provider"`
 		AuthProvider         tykcommon.AuthProviderMeta    `json:"auth_provider"`
 		ForceSessionProvider bool                          `json:"force_session_provider"`
 		SessionProvider      tykcommon.SessionProviderMeta `json:"session_provider"`
 	} `json:"auth_override"`
+	OrgKillSwitch    OrgKillSwitchConfig               `json:"org_kill_switch"`
+	GitSource        GitSourceConfig                   `json:"git_source"`
+	KubernetesSource KubernetesSourceConfig            `json:"kubernetes_source"`
+	LoadShedding     LoadSheddingConfig                `json:"load_shedding"`
+	OrgStorage       map[string]StorageIsolationConfig `json:"org_storage"`
+	SessionCodec     string                            `json:"session_codec"`
+	KeyMetadataIndex KeyMetadataIndexConfig            `json:"key_metadata_index"`
 }
 
 type CertData struct {
@@ -107,6 +194,18 @@ type CertData struct {
 	KeyFile  string `json:"key_file"`
 }
 
+// ProxyTransportConfig sets up the connection pool and timeouts used by the reverse proxy when talking
+// to upstream hosts, all timeouts are in seconds. It can be set globally and overridden per API.
+type ProxyTransportConfig struct {
+	MaxIdleConnsPerHost   int `mapstructure:"max_idle_conns_per_host" bson:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	IdleConnTimeout       int `mapstructure:"idle_conn_timeout" bson:"idle_conn_timeout" json:"idle_conn_timeout"`
+	DialTimeout           int `mapstructure:"dial_timeout" bson:"dial_timeout" json:"dial_timeout"`
+	ResponseHeaderTimeout int `mapstructure:"response_header_timeout" bson:"response_header_timeout" json:"response_header_timeout"`
+	TLSHandshakeTimeout   int `mapstructure:"tls_handshake_timeout" bson:"tls_handshake_timeout" json:"tls_handshake_timeout"`
+	MaxConnections        int `mapstructure:"max_upstream_connections" bson:"max_upstream_connections" json:"max_upstream_connections"`
+	MaxConnectionsWait    int `mapstructure:"max_upstream_connections_wait" bson:"max_upstream_connections_wait" json:"max_upstream_connections_wait"`
+}
+
 // WriteDefaultConf will create a default configuration file and set the storage type to "memory"
 func WriteDefaultConf(configStruct *Config) {
 	configStruct.ListenPort = 8080
@@ -129,6 +228,10 @@ func WriteDefaultConf(configStruct *Config) {
 	configStruct.AnalyticsConfig.Type = "csv"
 	configStruct.AnalyticsConfig.IgnoredIPs = make([]string, 0)
 	configStruct.UseAsyncSessionWrite = false
+	configStruct.ProxyTransport.MaxIdleConnsPerHost = 100
+	configStruct.ProxyTransport.IdleConnTimeout = 90
+	configStruct.ProxyTransport.DialTimeout = 30
+	configStruct.ProxyTransport.TLSHandshakeTimeout = 10
 	newConfig, err := json.MarshalIndent(configStruct, "", "    ")
 	if err != nil {
 		log.Error("Problem marshalling default configuration!")
@@ -158,6 +261,9 @@ func loadConfig(filePath string, configStruct *Config) {
 			log.Error("Couldn't unmarshal configuration")
 			log.Error(err)
 		}
+
+		applyEnvOverrides(configStruct)
+		resolveConfigSecrets(configStruct)
 	}
 }
 
@@ -168,6 +274,34 @@ func (c *Config) loadIgnoredIPs() {
 	}
 }
 
+// loadTrustedProxies parses the trusted proxies, each entry can be a CIDR or a single IP
+func (c *Config) loadTrustedProxies() {
+	c.trustedProxiesCompiled = parseCIDRList(c.TrustedProxies, "trusted proxy")
+}
+
+// parseCIDRList parses a list of CIDRs or single IPs, invalid entries are logged and skipped
+func parseCIDRList(entries []string, name string) []*net.IPNet {
+	compiled := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Error("Invalid ", name, ", ignoring: ", entry)
+			continue
+		}
+		compiled = append(compiled, ipNet)
+	}
+
+	return compiled
+}
+
 func (c *Config) TestShowIPs() {
 	log.Warning(c.AnalyticsConfig.ignoredIPsCompiled)
 }
@@ -177,14 +311,13 @@ func (c Config) StoreAnalytics(r *http.Request) bool {
 		return false
 	}
 
-	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
-
-	forwarded := r.Header.Get("X-FORWARDED-FOR")
-	if forwarded != "" {
-		ips := strings.Split(forwarded, ", ")
-		ip = ips[0]
+	// Requests run by /tyk/debug aren't real traffic
+	if isDebugTrace(r) {
+		return false
 	}
 
+	ip := GetIPFromRequest(r)
+
 	_, ignore := c.AnalyticsConfig.ignoredIPsCompiled[ip]
 
 	return !ignore
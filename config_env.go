@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Every field of the configuration can be set with an environment variable named after its JSON
+// path, e.g. TYK_GW_LISTEN_PORT or TYK_GW_STORAGE_PASSWORD. Lists of strings are comma separated,
+// other lists, maps and sections take JSON
+const CONFIG_ENV_PREFIX = "TYK_GW"
+
+// configFieldName is the name of a field in tyk.conf
+func configFieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+
+	return name
+}
+
+// setConfigFieldFromEnv parses an environment value into a field of the configuration
+func setConfigFieldFromEnv(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			values := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+			field.Set(reflect.ValueOf(values).Convert(field.Type()))
+			return nil
+		}
+		return json.Unmarshal([]byte(value), field.Addr().Interface())
+	case reflect.Map, reflect.Struct, reflect.Ptr:
+		return json.Unmarshal([]byte(value), field.Addr().Interface())
+	default:
+		return errors.New("Unsupported field type: " + field.Type().String())
+	}
+
+	return nil
+}
+
+// applyEnvToConfigValue sets the fields of a section that have an environment variable, sections
+// set as a whole take precedence over variables for their fields
+func applyEnvToConfigValue(v reflect.Value, prefix string) {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := t.Field(i)
+		name := configFieldName(fieldType)
+		if !field.CanSet() || name == "-" {
+			continue
+		}
+
+		envName := prefix + "_" + strings.ToUpper(name)
+		if value, found := os.LookupEnv(envName); found {
+			if err := setConfigFieldFromEnv(field, value); err != nil {
+				log.Error("Invalid value for ", envName, ", ignoring it: ", err)
+			} else {
+				log.Debug("Config field set from the environment: ", envName)
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.Struct {
+			applyEnvToConfigValue(field, envName)
+		}
+	}
+}
+
+// applyEnvOverrides sets the configuration fields that have a TYK_GW_ environment variable
+func applyEnvOverrides(configStruct *Config) {
+	applyEnvToConfigValue(reflect.ValueOf(configStruct).Elem(), CONFIG_ENV_PREFIX)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	envValues := map[string]string{
+		"TYK_GW_LISTEN_PORT":                  "9090",
+		"TYK_GW_STORAGE_HOST":                 "redis.internal",
+		"TYK_GW_STORAGE_ENABLE_CLUSTER":       "true",
+		"TYK_GW_STORAGE_HOSTS":                `{"redis-1": "6379"}`,
+		"TYK_GW_DB_APP_CONF_OPTIONS_TAGS":     "edge, eu-west",
+		"TYK_GW_MONITOR_GLOBAL_TRIGGER_LIMIT": "80.5",
+		"TYK_GW_HASH_KEYS":                    "not-a-bool",
+	}
+	for name, value := range envValues {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	thisConfig := Config{ListenPort: 8080, HashKeys: true}
+	thisConfig.Storage.Port = 6379
+	applyEnvOverrides(&thisConfig)
+
+	if thisConfig.ListenPort != 9090 {
+		t.Error("Listen port not set: ", thisConfig.ListenPort)
+	}
+	if thisConfig.Storage.Host != "redis.internal" || !thisConfig.Storage.EnableCluster {
+		t.Error("Nested fields not set: ", thisConfig.Storage.Host, thisConfig.Storage.EnableCluster)
+	}
+	if thisConfig.Storage.Port != 6379 {
+		t.Error("Fields without a variable should keep their value")
+	}
+	if thisConfig.Storage.Hosts["redis-1"] != "6379" {
+		t.Error("Maps should be read as JSON: ", thisConfig.Storage.Hosts)
+	}
+	if len(thisConfig.DBAppConfOptions.Tags) != 2 || thisConfig.DBAppConfOptions.Tags[1] != "eu-west" {
+		t.Error("String lists should be comma separated: ", thisConfig.DBAppConfOptions.Tags)
+	}
+	if thisConfig.Monitor.GlobalTriggerLimit != 80.5 {
+		t.Error("Fields of sections without a JSON name should be set: ", thisConfig.Monitor.GlobalTriggerLimit)
+	}
+	if !thisConfig.HashKeys {
+		t.Error("Invalid values should be ignored")
+	}
+}
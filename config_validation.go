@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configFieldTypes maps the lower cased names of the fields of a section to their types, names are
+// matched case insensitively like encoding/json does and embedded sections are flattened
+func configFieldTypes(t reflect.Type) map[string]reflect.Type {
+	fieldTypes := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := configFieldName(field)
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+
+		if field.Anonymous && field.Tag.Get("json") == "" && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedType := range configFieldTypes(field.Type) {
+				fieldTypes[embeddedName] = embeddedType
+			}
+			continue
+		}
+
+		fieldTypes[strings.ToLower(name)] = field.Type
+	}
+
+	return fieldTypes
+}
+
+// findUnknownConfigFields returns the paths of the entries of a raw section that don't match a
+// field of t, these are most likely typos and would otherwise be silently ignored
+func findUnknownConfigFields(raw map[string]interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	unknownFields := []string{}
+	fieldTypes := configFieldTypes(t)
+	for name, value := range raw {
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+
+		fieldType, found := fieldTypes[strings.ToLower(name)]
+		if !found {
+			unknownFields = append(unknownFields, fieldPath)
+			continue
+		}
+
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+
+		switch thisValue := value.(type) {
+		case map[string]interface{}:
+			unknownFields = append(unknownFields, findUnknownConfigFields(thisValue, fieldType, fieldPath)...)
+		case []interface{}:
+			if fieldType.Kind() != reflect.Slice && fieldType.Kind() != reflect.Array {
+				continue
+			}
+			for i, item := range thisValue {
+				if itemSection, ok := item.(map[string]interface{}); ok {
+					itemPath := fmt.Sprintf("%s[%d]", fieldPath, i)
+					unknownFields = append(unknownFields, findUnknownConfigFields(itemSection, fieldType.Elem(), itemPath)...)
+				}
+			}
+		}
+	}
+
+	sort.Strings(unknownFields)
+	return unknownFields
+}
+
+func isValidPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// validateConfig checks the settings that tyk can't run with, all the problems are returned so they
+// can be fixed in one go
+func validateConfig(configStruct *Config) []error {
+	configErrors := []error{}
+
+	if !isValidPort(configStruct.ListenPort) {
+		configErrors = append(configErrors, fmt.Errorf("listen_port must be between 1 and 65535, got %d", configStruct.ListenPort))
+	}
+
+	// The storage type only selects the key store, analytics, notifications, health checks and
+	// caching always use the Redis connection of the storage section
+	if !IsValidStorageType(configStruct.Storage.Type) {
+		configErrors = append(configErrors, errors.New("storage.type must be redis, memcached or lru"))
+	} else if StorageHandlerName(configStruct.Storage.Type) == MemcachedHandler && len(configStruct.Memcached.Hosts) == 0 {
+		configErrors = append(configErrors, errors.New("memcached.hosts must be set when storage.type is memcached"))
+	}
+
+	if len(configStruct.Storage.Hosts) == 0 {
+		if configStruct.Storage.Host == "" {
+			configErrors = append(configErrors, errors.New("storage.host must be set when storage.hosts is empty"))
+		}
+		if !isValidPort(configStruct.Storage.Port) {
+			configErrors = append(configErrors, fmt.Errorf("storage.port must be between 1 and 65535, got %d", configStruct.Storage.Port))
+		}
+	}
+
+	if configStruct.UseDBAppConfigs && configStruct.SlaveOptions.UseRPC {
+		configErrors = append(configErrors, errors.New("use_db_app_configs and slave_options.use_rpc can't both be enabled"))
+	}
+
+	if configStruct.SlaveOptions.UseRPC && configStruct.SlaveOptions.ConnectionString == "" {
+		configErrors = append(configErrors, errors.New("slave_options.connection_string must be set when slave_options.use_rpc is enabled"))
+	}
+
+	if configStruct.GitSource.Enabled {
+		if configStruct.GitSource.RepoURL == "" {
+			configErrors = append(configErrors, errors.New("git_source.repo_url must be set when git_source.enabled is on"))
+		}
+		if configStruct.UseDBAppConfigs || configStruct.SlaveOptions.UseRPC {
+			configErrors = append(configErrors, errors.New("git_source can't be used with use_db_app_configs or slave_options.use_rpc"))
+		}
+	}
+
+	if configStruct.KubernetesSource.Enabled {
+		if !IsValidKubernetesSourceKind(configStruct.KubernetesSource.Kind) {
+			configErrors = append(configErrors, errors.New("kubernetes_source.kind must be configmap or crd"))
+		}
+		if configStruct.UseDBAppConfigs || configStruct.SlaveOptions.UseRPC || configStruct.GitSource.Enabled {
+			configErrors = append(configErrors, errors.New("kubernetes_source can't be used with use_db_app_configs, slave_options.use_rpc or git_source"))
+		}
+	}
+
+	if !IsValidRPCCompression(configStruct.SlaveOptions.RPCCompression) {
+		configErrors = append(configErrors, errors.New("slave_options.rpc_compression must be none, gzip or snappy (or empty for the default)"))
+	}
+
+	for _, adminToken := range configStruct.AdminTokens {
+		if !IsValidAdminScope(adminToken.Scope) {
+			configErrors = append(configErrors, fmt.Errorf("admin token %s has an unknown scope %q, use full, read-only, keys-only or apis-only", adminToken.Name, adminToken.Scope))
+		}
+	}
+
+	if configStruct.LoadShedding.MaxInFlight < 0 || configStruct.LoadShedding.QueueDepth < 0 {
+		configErrors = append(configErrors, errors.New("load_shedding.max_in_flight and load_shedding.queue_depth can't be negative"))
+	}
+	if !IsValidShedPolicy(configStruct.LoadShedding.ShedPolicy) {
+		configErrors = append(configErrors, errors.New("load_shedding.shed_policy must be reject_new or drop_oldest"))
+	}
+
+	if !IsValidSessionCodec(configStruct.SessionCodec) {
+		configErrors = append(configErrors, errors.New("session_codec must be json or msgpack"))
+	} else if configStruct.SessionCodec == SessionCodecMsgpack && configStruct.SlaveOptions.UseRPC {
+		// Slaves write sessions to the master, which may serve nodes that can't read msgpack
+		configErrors = append(configErrors, errors.New("session_codec msgpack can't be used with slave_options.use_rpc"))
+	}
+
+	for orgID, isolation := range configStruct.OrgStorage {
+		if isolation.Database > 0 && configStruct.Storage.EnableCluster {
+			configErrors = append(configErrors, fmt.Errorf("org_storage.%s.database can't be used with storage.enable_cluster", orgID))
+		}
+	}
+
+	if configStruct.KeyMetadataIndex.Enabled && len(configStruct.KeyMetadataIndex.Fields) == 0 {
+		configErrors = append(configErrors, errors.New("key_metadata_index.fields must be set when key_metadata_index is enabled"))
+	}
+
+	if configStruct.HttpServerOptions.UseSSL {
+		if len(configStruct.HttpServerOptions.Certificates) == 0 {
+			configErrors = append(configErrors, errors.New("http_server_options.certificates must be set when http_server_options.use_ssl is enabled"))
+		}
+		for i, certData := range configStruct.HttpServerOptions.Certificates {
+			if certData.CertFile == "" || certData.KeyFile == "" {
+				configErrors = append(configErrors, fmt.Errorf("http_server_options.certificates[%d] needs a cert_file and a key_file", i))
+			}
+		}
+	}
+
+	return configErrors
+}
+
+// validateConfigFile validates the loaded configuration and the fields of the file it was read from,
+// the file is skipped if it can't be read as the defaults were used instead
+func validateConfigFile(filePath string, configStruct *Config) []error {
+	configErrors := []error{}
+
+	configuration, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		raw := make(map[string]interface{})
+		if err := json.Unmarshal(configuration, &raw); err != nil {
+			configErrors = append(configErrors, fmt.Errorf("%s is not valid JSON: %v", filePath, err))
+		} else {
+			for _, fieldPath := range findUnknownConfigFields(raw, reflect.TypeOf(configStruct), "") {
+				configErrors = append(configErrors, fmt.Errorf("unknown field %s", fieldPath))
+			}
+		}
+	}
+
+	return append(configErrors, validateConfig(configStruct)...)
+}
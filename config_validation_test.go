@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type configValidationTestSection struct {
+	Name    string `json:"name"`
+	Enabled bool
+	Hidden  string `json:"-"`
+}
+
+type configValidationTestStruct struct {
+	ListenPort int                           `json:"listen_port"`
+	Section    configValidationTestSection   `json:"section"`
+	Sections   []configValidationTestSection `json:"sections"`
+	Options    map[string]string             `json:"options"`
+}
+
+func TestFindUnknownConfigFields(t *testing.T) {
+	raw := map[string]interface{}{
+		"listen_port": 8080,
+		"listen_prot": 8080,
+		"section":     map[string]interface{}{"Name": "a", "enabled": true, "hidden": "x"},
+		"sections":    []interface{}{map[string]interface{}{"name": "b"}, map[string]interface{}{"nmae": "c"}},
+		"options":     map[string]interface{}{"anything": "goes"},
+	}
+
+	unknownFields := findUnknownConfigFields(raw, reflect.TypeOf(&configValidationTestStruct{}), "")
+	expected := []string{"listen_prot", "section.hidden", "sections[1].nmae"}
+	if !reflect.DeepEqual(unknownFields, expected) {
+		t.Error("Wrong unknown fields, expected ", expected, " got ", unknownFields)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	thisConfig := Config{ListenPort: 8080}
+	thisConfig.Storage.Type = "redis"
+	thisConfig.Storage.Host = "localhost"
+	thisConfig.Storage.Port = 6379
+	if configErrors := validateConfig(&thisConfig); len(configErrors) != 0 {
+		t.Error("Valid configuration should pass: ", configErrors)
+	}
+
+	thisConfig.ListenPort = 70000
+	thisConfig.Storage.Port = 0
+	thisConfig.UseDBAppConfigs = true
+	thisConfig.SlaveOptions.UseRPC = true
+	thisConfig.SlaveOptions.ConnectionString = "rpc.cloud.tyk.io:9091"
+
+	configErrors := validateConfig(&thisConfig)
+	if len(configErrors) != 3 {
+		t.Fatal("Expected 3 errors, got: ", configErrors)
+	}
+	if !strings.Contains(configErrors[2].Error(), "use_db_app_configs") {
+		t.Error("Mutually exclusive sources should be reported: ", configErrors[2])
+	}
+
+	// A cluster doesn't need a single host and port
+	thisConfig = Config{ListenPort: 8080}
+	thisConfig.Storage.Type = "redis"
+	thisConfig.Storage.Hosts = map[string]string{"redis-1": "6379"}
+	if configErrors := validateConfig(&thisConfig); len(configErrors) != 0 {
+		t.Error("Redis hosts should replace the host and port: ", configErrors)
+	}
+
+	// Memcached has its own section, Redis is still needed for everything else
+	thisConfig.Storage.Type = "memcached"
+	configErrors = validateConfig(&thisConfig)
+	if len(configErrors) != 1 || !strings.Contains(configErrors[0].Error(), "memcached.hosts") {
+		t.Error("Memcached hosts should be required: ", configErrors)
+	}
+	thisConfig.Memcached.Hosts = []string{"memcached-1:11211"}
+	thisConfig.Storage.Hosts = nil
+	if configErrors := validateConfig(&thisConfig); len(configErrors) != 2 {
+		t.Error("The Redis connection should be required with memcached: ", configErrors)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/context"
+	"github.com/nu7hatch/gouuid"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const TYK_CONTEXT_LABEL string = "$tyk_context."
+
+var tykContextRx = regexp.MustCompile(`\$tyk_context\.([A-Za-z0-9_\-]+)`)
+
+// generateContextVars snapshots the request details the first time they are needed, so that later
+// changes made by the chain (e.g. header injection) do not alter the values
+func generateContextVars(r *http.Request) map[string]interface{} {
+	contextVars := make(map[string]interface{})
+
+	u5, _ := uuid.NewV4()
+	contextVars["request_id"] = strings.Replace(u5.String(), "-", "", -1)
+
+	contextVars["remote_addr"] = GetIPFromRequest(r)
+
+	contextVars["method"] = r.Method
+	contextVars["host"] = r.Host
+	contextVars["path"] = r.URL.Path
+	contextVars["request_uri"] = r.URL.RequestURI()
+
+	pathParts := []string{}
+	for _, part := range strings.Split(r.URL.Path, "/") {
+		if part != "" {
+			pathParts = append(pathParts, part)
+		}
+	}
+	contextVars["path_parts"] = pathParts
+
+	// Header names are referenced with dashes replaced, e.g. headers_X_Request_Id
+	for hName, hVals := range r.Header {
+		if len(hVals) > 0 {
+			contextVars["headers_"+strings.Replace(hName, "-", "_", -1)] = hVals[0]
+		}
+	}
+
+	return contextVars
+}
+
+// GetContextVars returns the context variables of a request, listen path parameters and key meta
+// data are added on every call so they are available to anything that runs after they are set
+func GetContextVars(r *http.Request) map[string]interface{} {
+	contextVars, ok := context.Get(r, ContextData).(map[string]interface{})
+	if !ok {
+		contextVars = generateContextVars(r)
+		context.Set(r, ContextData, contextVars)
+	}
+
+	allVars := make(map[string]interface{}, len(contextVars))
+	for k, v := range contextVars {
+		allVars[k] = v
+	}
+
+	if listenPathParams, ok := context.Get(r, ListenPathParams).(map[string]string); ok {
+		for k, v := range listenPathParams {
+			allVars[LISTEN_PATH_PARAM_PREFIX+k] = v
+		}
+	}
+
+	if thisSessionState, ok := context.Get(r, SessionData).(SessionState); ok {
+		if metaData, ok := thisSessionState.MetaData.(map[string]interface{}); ok {
+			for k, v := range metaData {
+				allVars["key_meta_"+k] = v
+			}
+		}
+	}
+
+	return allVars
+}
+
+// eventContextVars returns the context variables sent with an event, credentials are removed as
+// event handlers (e.g. webhooks) send them outside the gateway
+func eventContextVars(r *http.Request, spec *APISpec) map[string]interface{} {
+	contextVars := GetContextVars(r)
+
+	credentialHeaders := []string{"Authorization", "Proxy-Authorization", "Cookie", spec.APIDefinition.Auth.AuthHeaderName}
+	for _, hName := range credentialHeaders {
+		if hName != "" {
+			delete(contextVars, "headers_"+strings.Replace(http.CanonicalHeaderKey(hName), "-", "_", -1))
+		}
+	}
+
+	return spec.LogMasking.MaskContextVars(contextVars)
+}
+
+// ReplaceTykContextVars substitutes $tyk_context.{name} references in a string, unknown variables
+// are replaced with an empty string
+func ReplaceTykContextVars(r *http.Request, in string) string {
+	return replaceTykContextVars(r, in, nil)
+}
+
+// ReplaceTykContextPathVars substitutes context variables in a URL path, the values are escaped so
+// they can't add path segments
+func ReplaceTykContextPathVars(r *http.Request, in string) string {
+	return replaceTykContextVars(r, in, escapePathVar)
+}
+
+// ReplaceTykContextQueryVars substitutes context variables in a raw query string, the values are
+// query escaped so they can't add parameters
+func ReplaceTykContextQueryVars(r *http.Request, in string) string {
+	return replaceTykContextVars(r, in, url.QueryEscape)
+}
+
+var pathVarEscaper = strings.NewReplacer("/", "%2F", "\\", "%5C")
+
+// escapePathVar escapes the characters of a value that would change the structure of a path
+func escapePathVar(value string) string {
+	switch value {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+
+	return pathVarEscaper.Replace(value)
+}
+
+func replaceTykContextVars(r *http.Request, in string, escape func(string) string) string {
+	if !strings.Contains(in, TYK_CONTEXT_LABEL) {
+		return in
+	}
+
+	contextVars := GetContextVars(r)
+	return tykContextRx.ReplaceAllStringFunc(in, func(match string) string {
+		varName := strings.Replace(match, TYK_CONTEXT_LABEL, "", 1)
+
+		var value string
+		switch thisVal := contextVars[varName].(type) {
+		case nil:
+			log.Debug("Context variable not found: ", varName)
+			return ""
+		case string:
+			value = thisVal
+		case []string:
+			value = strings.Join(thisVal, ",")
+		default:
+			value = fmt.Sprintf("%v", thisVal)
+		}
+
+		if escape != nil {
+			return escape(value)
+		}
+
+		return value
+	})
+}
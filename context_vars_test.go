@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"testing"
+)
+
+func TestReplaceTykContextVars(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/v1/widgets/42?page=2", nil)
+	defer context.Clear(r)
+
+	r.RemoteAddr = "10.0.0.1:51234"
+	r.Header.Set("X-Request-Source", "mobile")
+	context.Set(r, SessionData, SessionState{MetaData: map[string]interface{}{"user_id": "1234"}})
+
+	out := ReplaceTykContextVars(r, "/users/$tyk_context.key_meta_user_id/$tyk_context.path_parts?from=$tyk_context.remote_addr&src=$tyk_context.headers_X_Request_Source&x=$tyk_context.missing")
+	expected := "/users/1234/v1,widgets,42?from=10.0.0.1&src=mobile&x="
+	if out != expected {
+		t.Error("Context variables not replaced, expected: ", expected, " got: ", out)
+	}
+}
+
+func TestContextVarsStable(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/v1/widgets", nil)
+	defer context.Clear(r)
+
+	first := ReplaceTykContextVars(r, "$tyk_context.request_id")
+	if first == "" {
+		t.Fatal("Request ID should be generated")
+	}
+
+	r.URL.Path = "/rewritten"
+	if ReplaceTykContextVars(r, "$tyk_context.request_id") != first {
+		t.Error("Request ID should not change during a request")
+	}
+
+	if ReplaceTykContextVars(r, "$tyk_context.path") != "/v1/widgets" {
+		t.Error("Path should be the original request path")
+	}
+}
+
+func TestReplaceTykContextPathVars(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/v1/widgets", nil)
+	defer context.Clear(r)
+
+	r.Header.Set("X-Tenant", "../admin/users")
+	r.Header.Set("X-Page", "..")
+	r.Header.Set("X-Query", "1&admin=true")
+
+	if out := ReplaceTykContextPathVars(r, "/tenants/$tyk_context.headers_X_Tenant/$tyk_context.headers_X_Page"); out != "/tenants/..%2Fadmin%2Fusers/%2E%2E" {
+		t.Error("Path values should not add path segments, got: ", out)
+	}
+
+	if out := ReplaceTykContextQueryVars(r, "page=$tyk_context.headers_X_Query"); out != "page=1%26admin%3Dtrue" {
+		t.Error("Query values should not add parameters, got: ", out)
+	}
+}
+
+func TestEventContextVars(t *testing.T) {
+	r, _ := http.NewRequest("GET", "http://example.com/v1/widgets", nil)
+	defer context.Clear(r)
+
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("X-Api-Key", "secret")
+	r.Header.Set("X-Request-Source", "mobile")
+
+	spec := &APISpec{}
+	spec.APIDefinition.Auth.AuthHeaderName = "x-api-key"
+
+	contextVars := eventContextVars(r, spec)
+	if _, found := contextVars["headers_Authorization"]; found {
+		t.Error("Authorization should not be sent with events")
+	}
+
+	if _, found := contextVars["headers_X_Api_Key"]; found {
+		t.Error("Auth header should not be sent with events")
+	}
+
+	if contextVars["headers_X_Request_Source"] != "mobile" {
+		t.Error("Other headers should be kept")
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/context"
+	"github.com/justinas/alice"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DebugTraceRequest is the body of a /tyk/debug call, the sample request is run through the
+// chain of the API definition as if the API was loaded. The upstream isn't called, it returns
+// UpstreamResponse (a 200 with an empty body if it isn't set)
+type DebugTraceRequest struct {
+	APIDefinition    json.RawMessage `json:"api_definition"`
+	Request          DebugRequest    `json:"request"`
+	UpstreamResponse *DebugResponse  `json:"upstream_response"`
+}
+
+type DebugRequest struct {
+	Method     string            `json:"method"`
+	URL        string            `json:"url"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+}
+
+type DebugResponse struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// DebugTraceStep is a single middleware of the chain, Halted is set if it stopped the request
+type DebugTraceStep struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Source     string   `json:"source,omitempty"`
+	DurationMS float64  `json:"duration_ms"`
+	Halted     bool     `json:"halted"`
+	Mutations  []string `json:"mutations"`
+	finished   bool
+}
+
+// DebugTrace is the result of a /tyk/debug call, UpstreamRequest is empty if the request never got
+// to the upstream
+type DebugTrace struct {
+	Steps           []DebugTraceStep `json:"steps"`
+	ConfigErrors    []string         `json:"config_errors,omitempty"`
+	UpstreamRequest *DebugRequest    `json:"upstream_request"`
+	Response        DebugResponse    `json:"response"`
+}
+
+type requestSnapshot struct {
+	method  string
+	url     string
+	headers http.Header
+	body    string
+}
+
+// snapshotRequest copies the parts of a request that middleware can change, the body is put back
+func snapshotRequest(r *http.Request) requestSnapshot {
+	snapshot := requestSnapshot{
+		method:  r.Method,
+		url:     r.URL.String(),
+		headers: make(http.Header),
+	}
+	copyHeader(snapshot.headers, r.Header)
+
+	if r.Body != nil {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		snapshot.body = string(body)
+	}
+
+	return snapshot
+}
+
+// diffRequestSnapshots describes what a middleware changed
+func diffRequestSnapshots(before requestSnapshot, after requestSnapshot) []string {
+	mutations := []string{}
+
+	if before.method != after.method {
+		mutations = append(mutations, "method: "+before.method+" -> "+after.method)
+	}
+	if before.url != after.url {
+		mutations = append(mutations, "url: "+before.url+" -> "+after.url)
+	}
+
+	headerNames := []string{}
+	for name := range before.headers {
+		headerNames = append(headerNames, name)
+	}
+	for name := range after.headers {
+		if _, found := before.headers[name]; !found {
+			headerNames = append(headerNames, name)
+		}
+	}
+	sort.Strings(headerNames)
+
+	for _, name := range headerNames {
+		beforeValue, inBefore := before.headers[name]
+		afterValue, inAfter := after.headers[name]
+		switch {
+		case !inBefore:
+			mutations = append(mutations, "header added: "+name+": "+strings.Join(afterValue, ", "))
+		case !inAfter:
+			mutations = append(mutations, "header removed: "+name)
+		case strings.Join(beforeValue, ", ") != strings.Join(afterValue, ", "):
+			mutations = append(mutations, "header changed: "+name+": "+strings.Join(beforeValue, ", ")+" -> "+strings.Join(afterValue, ", "))
+		}
+	}
+
+	if before.body != after.body {
+		mutations = append(mutations, "body: "+after.body)
+	}
+
+	return mutations
+}
+
+// Wrap records the time a middleware took and what it changed, the middleware is finished once it
+// calls the next handler or returns without calling it
+func (t *DebugTrace) Wrap(thisObject ChainObject, constructor alice.Constructor) alice.Constructor {
+	return func(h http.Handler) http.Handler {
+		var stepIndex int
+		var before requestSnapshot
+		var start time.Time
+
+		finish := func(r *http.Request, halted bool) {
+			step := &t.Steps[stepIndex]
+			step.finished = true
+			step.Halted = halted
+			step.DurationMS = float64(time.Since(start).Nanoseconds()) * 0.000001
+			step.Mutations = diffRequestSnapshots(before, snapshotRequest(r))
+		}
+
+		inner := constructor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			finish(r, false)
+			h.ServeHTTP(w, r)
+		}))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stepIndex = len(t.Steps)
+			t.Steps = append(t.Steps, DebugTraceStep{Name: thisObject.Name, Type: thisObject.Type, Source: thisObject.Source})
+			before = snapshotRequest(r)
+			start = time.Now()
+
+			inner.ServeHTTP(w, r)
+			if !t.Steps[stepIndex].finished {
+				finish(r, true)
+			}
+		})
+	}
+}
+
+func flattenHeaders(headers http.Header) map[string]string {
+	flat := make(map[string]string)
+	for name, values := range headers {
+		flat[name] = strings.Join(values, ", ")
+	}
+	return flat
+}
+
+// debugTransport stands in for the upstream, it records the request the proxy would have sent
+type debugTransport struct {
+	trace    *DebugTrace
+	response DebugResponse
+}
+
+func (d debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	snapshot := snapshotRequest(req)
+	d.trace.UpstreamRequest = &DebugRequest{
+		Method:  snapshot.method,
+		URL:     snapshot.url,
+		Headers: flattenHeaders(snapshot.headers),
+		Body:    snapshot.body,
+	}
+
+	res := &http.Response{
+		StatusCode:    d.response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(d.response.Body)),
+		ContentLength: int64(len(d.response.Body)),
+		Request:       req,
+	}
+	res.Status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	for name, value := range d.response.Headers {
+		res.Header.Set(name, value)
+	}
+
+	return res, nil
+}
+
+// debugStore reads through to a live store and keeps every write in memory, so a trace sees the
+// live keys, quotas and cache without changing them
+type debugStore struct {
+	live    StorageHandler
+	overlay *InMemoryStorageManager
+	deleted map[string]bool
+}
+
+func newDebugStore(live StorageHandler) *debugStore {
+	return &debugStore{
+		live:    live,
+		overlay: &InMemoryStorageManager{Sessions: make(map[string]string)},
+		deleted: make(map[string]bool),
+	}
+}
+
+func (d *debugStore) GetKey(keyName string) (string, error) {
+	if value, err := d.overlay.GetKey(keyName); err == nil || d.deleted[keyName] {
+		return value, err
+	}
+	return d.live.GetKey(keyName)
+}
+
+func (d *debugStore) GetRawKey(keyName string) (string, error) {
+	if value, err := d.overlay.GetRawKey(keyName); err == nil || d.deleted[keyName] {
+		return value, err
+	}
+	return d.live.GetRawKey(keyName)
+}
+
+func (d *debugStore) SetKey(keyName string, value string, timeout int64) error {
+	delete(d.deleted, keyName)
+	return d.overlay.SetKey(keyName, value, timeout)
+}
+
+func (d *debugStore) SetRawKey(keyName string, value string, timeout int64) error {
+	delete(d.deleted, keyName)
+	return d.overlay.SetRawKey(keyName, value, timeout)
+}
+
+func (d *debugStore) GetExp(keyName string) (int64, error) {
+	return d.live.GetExp(keyName)
+}
+
+func (d *debugStore) GetKeys(filter string) []string {
+	return d.live.GetKeys(filter)
+}
+
+func (d *debugStore) DeleteKey(keyName string) bool {
+	d.overlay.DeleteKey(keyName)
+	d.deleted[keyName] = true
+	return true
+}
+
+func (d *debugStore) DeleteRawKey(keyName string) bool {
+	d.overlay.DeleteRawKey(keyName)
+	d.deleted[keyName] = true
+	return true
+}
+
+func (d *debugStore) Connect() bool {
+	return d.live.Connect()
+}
+
+func (d *debugStore) GetKeysAndValues() map[string]string {
+	return d.live.GetKeysAndValues()
+}
+
+func (d *debugStore) GetKeysAndValuesWithFilter(filter string) map[string]string {
+	return d.live.GetKeysAndValuesWithFilter(filter)
+}
+
+func (d *debugStore) DeleteKeys(keys []string) bool {
+	for _, keyName := range keys {
+		d.DeleteKey(keyName)
+	}
+	return true
+}
+
+func (d *debugStore) Decrement(keyName string) {}
+
+// IncrememntWithExpire counts on top of the live counter, so quotas are checked but not used up
+func (d *debugStore) IncrememntWithExpire(keyName string, expire int64) int64 {
+	if _, found := d.overlay.Sessions[keyName]; !found && !d.deleted[keyName] {
+		if value, err := d.live.GetRawKey(keyName); err == nil {
+			d.overlay.Sessions[keyName] = value
+		}
+	}
+	return d.overlay.IncrememntWithExpire(keyName, expire)
+}
+
+// SetRollingWindow doesn't record the request, rate limits never stop a trace
+func (d *debugStore) SetRollingWindow(keyName string, per int64, expire int64) int {
+	return 0
+}
+
+func isDebugTrace(r *http.Request) bool {
+	return context.Get(r, DebugTraceContext) != nil
+}
+
+// RunDebugTrace builds the chain of the API definition and runs the sample request through it. Keys,
+// quotas and the cache are read from the live stores but changes are kept in memory, rate limits
+// aren't applied, and the request isn't mirrored or recorded in analytics
+func RunDebugTrace(debugReq DebugTraceRequest, remoteAddr string) (*DebugTrace, error) {
+	if len(debugReq.APIDefinition) == 0 {
+		return nil, errors.New("api_definition is required")
+	}
+
+	loader := APIDefinitionLoader{}
+	thisDef, rawDef := loader.ParseDefinition(debugReq.APIDefinition)
+	if thisDef.Proxy.ListenPath == "" {
+		return nil, errors.New("API definition is not valid, it has no listen path")
+	}
+	thisDef.RawData = rawDef
+	spec := loader.MakeSpec(thisDef)
+	if spec.SecretsErr != nil {
+		return nil, spec.SecretsErr
+	}
+	if spec.StreamingErr != nil {
+		return nil, spec.StreamingErr
+	}
+
+	remote, err := url.Parse(spec.APIDefinition.Proxy.TargetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	keyStore := newDebugStore(NewKeyStorageHandler("apikey-", config.HashKeys))
+	orgKeyStore := newDebugStore(NewKeyStorageHandler("orgkey.", false))
+	healthStore := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	spec.Init(keyStore, keyStore, healthStore, orgKeyStore)
+	// The DRL is shared with the live APIs
+	spec.DRL = false
+
+	if err := loadBundle(&spec); err != nil {
+		return nil, err
+	}
+
+	mwPaths, mwPreFuncs, mwPostFuncs := loadCustomMiddleware(&spec)
+	spec.JSVM.LoadJSPaths(mwPaths)
+
+	if spec.UseOauth2 {
+		// The OAuth endpoints aren't needed, only the manager
+		spec.OAuthManager = addOAuthHandlers(&spec, http.NewServeMux(), false)
+	}
+
+	trace := &DebugTrace{Steps: []DebugTraceStep{}}
+	upstreamResponse := DebugResponse{StatusCode: 200}
+	if debugReq.UpstreamResponse != nil {
+		upstreamResponse = *debugReq.UpstreamResponse
+		if upstreamResponse.StatusCode == 0 {
+			upstreamResponse.StatusCode = 200
+		}
+	}
+
+	proxy := TykNewSingleHostReverseProxy(remote, &spec)
+	proxy.New(nil, &spec)
+	proxy.Transport = debugTransport{trace: trace, response: upstreamResponse}
+	spec.target = remote
+	creeateResponseMiddlewareChain(&spec)
+
+	tykMiddleware := &TykMiddleware{&spec, proxy}
+	CacheStore := newDebugStore(&RedisClusterStorageManager{KeyPrefix: "cache-" + spec.APIDefinition.APIID})
+	CacheStore.Connect()
+
+	var authChain []TykMiddlewareImplementation
+	if !spec.APIDefinition.UseKeylessAccess {
+		authChain = BuildAuthChain(&spec, tykMiddleware)
+	}
+
+	chainBuilder := &ChainBuilder{TykMiddleware: tykMiddleware, Trace: trace}
+	buildAPIChain(chainBuilder, &spec, tykMiddleware, CacheStore, authChain, mwPreFuncs, mwPostFuncs)
+	chain := chainBuilder.Then(DummyProxyHandler{SH: SuccessHandler{tykMiddleware}})
+
+	method := debugReq.Request.Method
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, debugReq.Request.URL, strings.NewReader(debugReq.Request.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range debugReq.Request.Headers {
+		req.Header.Set(name, value)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	req.RemoteAddr = remoteAddr
+	if debugReq.Request.RemoteAddr != "" {
+		req.RemoteAddr = debugReq.Request.RemoteAddr
+	}
+	context.Set(req, DebugTraceContext, true)
+
+	rw := &internalResponseWriter{header: make(http.Header)}
+	chain.ServeHTTP(rw, req)
+	if rw.code == 0 {
+		rw.code = 200
+	}
+
+	trace.Response = DebugResponse{
+		StatusCode: rw.code,
+		Headers:    flattenHeaders(rw.header),
+		Body:       rw.body.String(),
+	}
+
+	return trace, nil
+}
+
+// debugHandler is the /tyk/debug endpoint
+func debugHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	var debugReq DebugTraceRequest
+	if err := json.NewDecoder(r.Body).Decode(&debugReq); err != nil {
+		DoJSONWrite(w, 400, createError("Request malformed"))
+		return
+	}
+
+	trace, err := RunDebugTrace(debugReq, r.RemoteAddr)
+	if err != nil {
+		DoJSONWrite(w, 400, createError(err.Error()))
+		return
+	}
+
+	responseMessage, err := json.Marshal(trace)
+	if err != nil {
+		log.Error("Failed to encode debug trace: ", err)
+		DoJSONWrite(w, 500, []byte(E_SYSTEM_ERROR))
+		return
+	}
+
+	DoJSONWrite(w, 200, responseMessage)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugTraceRecordsMutations(t *testing.T) {
+	trace := &DebugTrace{Steps: []DebugTraceStep{}}
+
+	addHeader := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("X-Added", "yes")
+			r.Header.Del("X-Removed")
+			r.Method = "PUT"
+			h.ServeHTTP(w, r)
+		})
+	}
+	block := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(403)
+		})
+	}
+	never := func(h http.Handler) http.Handler {
+		return h
+	}
+
+	chain := alice.New(
+		trace.Wrap(ChainObject{Name: "AddHeader", Type: "builtin"}, addHeader),
+		trace.Wrap(ChainObject{Name: "Block", Type: "builtin"}, block),
+		trace.Wrap(ChainObject{Name: "Never", Type: "builtin"}, never),
+	).Then(http.NotFoundHandler())
+
+	req, _ := http.NewRequest("POST", "/v1/widgets", strings.NewReader("body"))
+	req.Header.Set("X-Removed", "no")
+	recorder := httptest.NewRecorder()
+	chain.ServeHTTP(recorder, req)
+
+	if len(trace.Steps) != 2 {
+		t.Fatal("Only the middleware that ran should be traced, got: ", trace.Steps)
+	}
+
+	first := trace.Steps[0]
+	if first.Name != "AddHeader" || first.Halted {
+		t.Error("First step should have passed the request on: ", first)
+	}
+	expected := []string{"method: POST -> PUT", "header added: X-Added: yes", "header removed: X-Removed"}
+	if strings.Join(first.Mutations, "|") != strings.Join(expected, "|") {
+		t.Error("Unexpected mutations: ", first.Mutations)
+	}
+
+	if !trace.Steps[1].Halted || len(trace.Steps[1].Mutations) != 0 {
+		t.Error("Second step should have halted without changes: ", trace.Steps[1])
+	}
+
+	// The body is still there for the rest of the chain
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != "body" {
+		t.Error("Tracing consumed the request body")
+	}
+}
+
+func TestDebugTransportRecordsUpstreamRequest(t *testing.T) {
+	trace := &DebugTrace{}
+	transport := debugTransport{trace: trace, response: DebugResponse{StatusCode: 201, Body: `{"ok": true}`}}
+
+	req, _ := http.NewRequest("POST", "http://upstream/widgets?id=1", strings.NewReader("payload"))
+	req.Header.Set("Authorization", "key")
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != 201 || res.Status != "201 Created" {
+		t.Error("Unexpected stub response: ", res.Status)
+	}
+	if trace.UpstreamRequest == nil || trace.UpstreamRequest.URL != "http://upstream/widgets?id=1" || trace.UpstreamRequest.Body != "payload" {
+		t.Error("Upstream request wasn't recorded: ", trace.UpstreamRequest)
+	}
+	if trace.UpstreamRequest.Headers["Authorization"] != "key" {
+		t.Error("Upstream headers weren't recorded")
+	}
+}
+
+func TestDebugStoreKeepsWritesInMemory(t *testing.T) {
+	live := &InMemoryStorageManager{Sessions: map[string]string{"key": "live", "quota-key": "5"}}
+	store := newDebugStore(live)
+
+	if value, _ := store.GetKey("key"); value != "live" {
+		t.Error("Reads should fall through to the live store, got: ", value)
+	}
+
+	store.SetKey("key", "changed", 0)
+	if value, _ := store.GetKey("key"); value != "changed" || live.Sessions["key"] != "live" {
+		t.Error("Writes should only be seen by the trace")
+	}
+
+	store.DeleteKey("key")
+	if _, err := store.GetKey("key"); err == nil || live.Sessions["key"] != "live" {
+		t.Error("Deleted keys should be gone for the trace only")
+	}
+
+	if count := store.IncrememntWithExpire("quota-key", 60); count != 6 || live.Sessions["quota-key"] != "5" {
+		t.Error("Counters should start from the live value without changing it, got: ", count)
+	}
+}
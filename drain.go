@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const NodeStateDraining = "draining"
+
+// NodeDrainState tracks whether the node is draining and how many proxied requests are in flight.
+// A draining node still serves requests, but its health endpoint fails so a load balancer takes it
+// out of rotation, and responses ask clients to close their connections
+type NodeDrainState struct {
+	sync.RWMutex
+	draining      bool
+	drainingSince int64
+	inFlight      int64
+}
+
+var NodeDrain = &NodeDrainState{}
+
+// NodeDrainStatus is returned by the drain and node health endpoints
+type NodeDrainStatus struct {
+	State         string `json:"state"`
+	DrainingSince int64  `json:"draining_since,omitempty"`
+	InFlight      int64  `json:"in_flight"`
+	Shed          int64  `json:"shed,omitempty"`
+}
+
+func (n *NodeDrainState) StartDraining() {
+	n.Lock()
+	if !n.draining {
+		n.draining = true
+		n.drainingSince = time.Now().Unix()
+		log.Warning("Node is draining")
+	}
+	n.Unlock()
+}
+
+func (n *NodeDrainState) StopDraining() {
+	n.Lock()
+	if n.draining {
+		n.draining = false
+		n.drainingSince = 0
+		log.Info("Node is no longer draining")
+	}
+	n.Unlock()
+}
+
+func (n *NodeDrainState) IsDraining() bool {
+	n.RLock()
+	defer n.RUnlock()
+
+	return n.draining
+}
+
+// State is the node state reported to the node registry
+func (n *NodeDrainState) State() string {
+	if n.IsDraining() {
+		return NodeStateDraining
+	}
+
+	return NodeStateActive
+}
+
+func (n *NodeDrainState) Status() NodeDrainStatus {
+	n.RLock()
+	drainingSince := n.drainingSince
+	n.RUnlock()
+
+	thisStatus := NodeDrainStatus{
+		State:         n.State(),
+		DrainingSince: drainingSince,
+		InFlight:      atomic.LoadInt64(&n.inFlight),
+	}
+	if NodeLoadShedder != nil {
+		thisStatus.Shed = NodeLoadShedder.Shed()
+	}
+
+	return thisStatus
+}
+
+// InFlightHandler wraps an API's chain so its requests are counted while they are being handled
+func InFlightHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&NodeDrain.inFlight, 1)
+		defer atomic.AddInt64(&NodeDrain.inFlight, -1)
+
+		if NodeDrain.IsDraining() {
+			w.Header().Set("Connection", "close")
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// drainHandler controls drain mode: POST /tyk/drain starts draining, DELETE stops it and GET returns
+// the state and the number of requests in flight, so a deploy can wait for it to reach 0
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		NodeDrain.StartDraining()
+	case "DELETE":
+		NodeDrain.StopDraining()
+	case "GET":
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if Nodes != nil && r.Method != "GET" {
+		go Nodes.Heartbeat()
+	}
+
+	responseMessage, _ := json.Marshal(NodeDrain.Status())
+	DoJSONWrite(w, 200, responseMessage)
+}
+
+// nodeHealthHandler is the load balancer health check, it is not authenticated and returns a 503
+// while the node is draining
+func nodeHealthHandler(w http.ResponseWriter, r *http.Request) {
+	code := 200
+	if NodeDrain.IsDraining() {
+		code = 503
+	}
+
+	responseMessage, _ := json.Marshal(NodeDrain.Status())
+	DoJSONWrite(w, code, responseMessage)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrainMode(t *testing.T) {
+	defer NodeDrain.StopDraining()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/node/health", nil)
+	nodeHealthHandler(recorder, req)
+	if recorder.Code != 200 {
+		t.Error("Active node should be healthy, got: ", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/tyk/drain", nil)
+	drainHandler(recorder, req)
+	if recorder.Code != 200 || !NodeDrain.IsDraining() {
+		t.Fatal("Node should be draining")
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/tyk/node/health", nil)
+	nodeHealthHandler(recorder, req)
+	if recorder.Code != 503 {
+		t.Error("Draining node should fail health checks, got: ", recorder.Code)
+	}
+
+	// Requests are still served while draining
+	var inFlight int64
+	handler := InFlightHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = NodeDrain.Status().InFlight
+		w.WriteHeader(200)
+	}))
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != 200 || recorder.Header().Get("Connection") != "close" {
+		t.Error("Draining node should serve the request and close the connection")
+	}
+
+	if inFlight != 1 || NodeDrain.Status().InFlight != 0 {
+		t.Error("In flight requests were not counted")
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/tyk/drain", nil)
+	drainHandler(recorder, req)
+	if NodeDrain.IsDraining() || NodeDrain.State() != NodeStateActive {
+		t.Error("Node should be active again")
+	}
+}
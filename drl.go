@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"math"
+	"sync"
+	"time"
+)
+
+// DRLConfig switches the key rate limits of an API to the distributed rate limiter (DRL). Each node
+// enforces its share of a key's rate in memory, the share is the rate divided by the number of active
+// nodes in the node registry, so the rate limit needs no Redis round trip. Limits are only as exact
+// as the load balancer's spread of a key's requests over the nodes, quotas are still counted in Redis
+type DRLConfig struct {
+	Enabled bool `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+}
+
+type DRLModuleConfig struct {
+	DRL DRLConfig `mapstructure:"drl" bson:"drl" json:"drl"`
+}
+
+func GetDRLConfig(spec *APISpec) DRLConfig {
+	var thisModuleConfig DRLModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode DRL configuration: ", err)
+	}
+
+	return thisModuleConfig.DRL
+}
+
+// drlBucket is a token bucket holding this node's share of a key's rate
+type drlBucket struct {
+	tokens   float64
+	capacity float64
+	fillRate float64
+	lastFill time.Time
+}
+
+// fill adds the tokens earned since the last fill
+func (b *drlBucket) fill(now time.Time) {
+	b.tokens += now.Sub(b.lastFill).Seconds() * b.fillRate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.lastFill = now
+}
+
+// DistributedRateLimiter keeps the token buckets of this node, it is shared by all APIs so that the
+// buckets survive a reload
+type DistributedRateLimiter struct {
+	sync.Mutex
+	nodeCount int
+	buckets   map[string]*drlBucket
+}
+
+var DRLManager = NewDistributedRateLimiter()
+
+func NewDistributedRateLimiter() *DistributedRateLimiter {
+	return &DistributedRateLimiter{
+		nodeCount: 1,
+		buckets:   make(map[string]*drlBucket),
+	}
+}
+
+// SetNodeCount sets the number of nodes the rates are shared between
+func (d *DistributedRateLimiter) SetNodeCount(nodeCount int) {
+	if nodeCount < 1 {
+		nodeCount = 1
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if nodeCount != d.nodeCount {
+		log.Info("DRL: ", nodeCount, " active nodes, rate limits are shared between them")
+		d.nodeCount = nodeCount
+	}
+}
+
+func (d *DistributedRateLimiter) NodeCount() int {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.nodeCount
+}
+
+// Allow takes a token from the bucket of a key, this node's share of rate requests per `per` seconds
+// is let through. A bucket holds at least one token so that small shares are not blocked for good
+func (d *DistributedRateLimiter) Allow(keyName string, rate float64, per float64) bool {
+	// Same as the rolling window, which is always empty without a period
+	if per <= 0 {
+		return rate >= 1
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	share := rate / float64(d.nodeCount)
+	now := time.Now()
+
+	bucket, found := d.buckets[keyName]
+	if !found {
+		bucket = &drlBucket{tokens: math.Max(share, 1), lastFill: now}
+		d.buckets[keyName] = bucket
+	}
+
+	// The rate of a key can change at any time
+	bucket.capacity = math.Max(share, 1)
+	bucket.fillRate = share / per
+	bucket.fill(now)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// Reap removes the buckets that have filled up again, they are recreated full on the next request
+func (d *DistributedRateLimiter) Reap() {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for keyName, bucket := range d.buckets {
+		bucket.fill(now)
+		if bucket.tokens >= bucket.capacity {
+			delete(d.buckets, keyName)
+		}
+	}
+}
+
+// activeNodeCount counts the nodes that take traffic, draining nodes are left to finish their
+// requests and don't get a share
+func activeNodeCount(nodes []NodeInfo) int {
+	count := 0
+	for _, thisNode := range nodes {
+		if thisNode.State == NodeStateActive {
+			count++
+		}
+	}
+
+	return count
+}
+
+// drlInUse is true if a loaded API uses the DRL
+func drlInUse() bool {
+	for _, spec := range getApiSpecs() {
+		if spec.DRL {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StartDRLLoop keeps the node count of the DRL in line with the node registry, the count is refreshed
+// with every heartbeat
+func StartDRLLoop() {
+	interval := NODE_DEFAULT_HEARTBEAT
+	if Nodes != nil {
+		interval = Nodes.Interval
+	}
+
+	warned := false
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		if drlInUse() {
+			if Nodes != nil {
+				DRLManager.SetNodeCount(activeNodeCount(Nodes.GetNodes()))
+			} else if !warned {
+				log.Warning("DRL is enabled but the node registry is disabled, each node enforces the full rate limit")
+				warned = true
+			}
+		}
+
+		DRLManager.Reap()
+	}
+}
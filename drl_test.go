@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDRLAllow(t *testing.T) {
+	d := NewDistributedRateLimiter()
+	d.SetNodeCount(2)
+
+	for i := 0; i < 5; i++ {
+		if !d.Allow("key", 10, 60) {
+			t.Fatal("Request should be within the node's share: ", i+1)
+		}
+	}
+	if d.Allow("key", 10, 60) {
+		t.Error("Node should only allow half of the rate")
+	}
+
+	// A share under one request still lets a request through
+	d.SetNodeCount(3)
+	if !d.Allow("small", 1, 60) || d.Allow("small", 1, 60) {
+		t.Error("Small share should allow exactly one request")
+	}
+
+	d.Reap()
+	if _, found := d.buckets["key"]; !found {
+		t.Error("Empty bucket shouldn't be reaped")
+	}
+	if !d.Allow("other", 10, 0) || len(d.buckets) != 2 {
+		t.Error("Rate without a period shouldn't need a bucket")
+	}
+}
+
+func TestDRLNodeCount(t *testing.T) {
+	nodes := []NodeInfo{{ID: "a", State: NodeStateActive}, {ID: "b", State: NodeStateDraining}, {ID: "c", State: NodeStateActive}}
+	if count := activeNodeCount(nodes); count != 2 {
+		t.Error("Draining nodes shouldn't get a share: ", count)
+	}
+
+	d := NewDistributedRateLimiter()
+	d.SetNodeCount(activeNodeCount([]NodeInfo{}))
+	if d.NodeCount() != 1 {
+		t.Error("Node should always count itself")
+	}
+}
+
+func TestForwardMessageDRL(t *testing.T) {
+	store := &atomicTestStore{InMemoryStorageManager: InMemoryStorageManager{Sessions: make(map[string]string)}}
+	limiter := SessionLimiter{UseDRL: true}
+
+	thisSession := createSampleSession()
+	thisSession.Rate = 2
+	thisSession.Per = 60
+	thisSession.QuotaMax = -1
+
+	for i := 0; i < 2; i++ {
+		if forward, _ := limiter.ForwardMessage(&thisSession, "drl-key", store); !forward {
+			t.Fatal("Request should be allowed: ", i+1)
+		}
+	}
+	if forward, reason := limiter.ForwardMessage(&thisSession, "drl-key", store); forward || reason != 1 {
+		t.Error("Rate limit should be exceeded, got reason: ", reason)
+	}
+
+	if store.calls != 0 {
+		t.Error("DRL shouldn't call the store: ", store.calls)
+	}
+}
+
+func TestDRLConfig(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"drl": {"enabled": true},`, 1))
+	if !spec.DRL {
+		t.Error("DRL should be enabled for the API")
+	}
+}
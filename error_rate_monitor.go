@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"sync"
+	"time"
+)
+
+const (
+	ERROR_RATE_MONITOR_PREFIX               = "error-rate-triggered."
+	ERROR_RATE_MONITOR_DEFAULT_MIN_REQUESTS = 10
+)
+
+// ErrorRateMonitorConfig fires EVENT_ErrorRateTriggered when the share of requests to an API that got
+// a 5xx response over the health check window reaches Threshold (%). Windows with fewer than
+// MinRequests requests are ignored so a couple of failures on a quiet API don't page anyone. The event
+// fires once when the threshold is crossed and again only after the rate has dropped below it
+type ErrorRateMonitorConfig struct {
+	Enabled     bool    `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	Threshold   float64 `mapstructure:"threshold" bson:"threshold" json:"threshold"`
+	MinRequests int64   `mapstructure:"min_requests" bson:"min_requests" json:"min_requests"`
+}
+
+type ErrorRateMonitorModuleConfig struct {
+	ErrorRateMonitor ErrorRateMonitorConfig `mapstructure:"error_rate_monitor" bson:"error_rate_monitor" json:"error_rate_monitor"`
+}
+
+func GetErrorRateMonitorConfig(spec *APISpec) ErrorRateMonitorConfig {
+	var thisModuleConfig ErrorRateMonitorModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode error rate monitor configuration: ", err)
+	}
+
+	thisConfig := thisModuleConfig.ErrorRateMonitor
+	if thisConfig.MinRequests < 1 {
+		thisConfig.MinRequests = ERROR_RATE_MONITOR_DEFAULT_MIN_REQUESTS
+	}
+
+	return thisConfig
+}
+
+// isBreached checks the 5xx rate of the health values against the threshold
+func (c ErrorRateMonitorConfig) isBreached(values HealthCheckValues) bool {
+	if c.Threshold <= 0 || values.TotalRequests < c.MinRequests {
+		return false
+	}
+
+	return values.ServerErrorRate >= c.Threshold
+}
+
+// ErrorRateClaims makes sure only one node fires the event for a breach, every node reads the same
+// cluster wide health values. Without it each node fires its own event
+var ErrorRateClaims BatchKeyStorage
+
+// Breaches are kept by API ID so a reload doesn't fire the event again
+var errorRateBreached = make(map[string]bool)
+var errorRateBreachedLock sync.Mutex
+
+// claimErrorRateEvent is true if this node should fire the event, the claim expires with the window
+func claimErrorRateEvent(APIID string, window int64) bool {
+	if ErrorRateClaims == nil {
+		return true
+	}
+
+	skipped, err := ErrorRateClaims.SetKeys(map[string]string{APIID: healthCheckNodeID()}, window, false)
+	if err != nil {
+		log.Error("Couldn't claim error rate event, firing anyway: ", err)
+		return true
+	}
+
+	return len(skipped) == 0
+}
+
+func checkErrorRate(spec *APISpec) {
+	thisConfig := GetErrorRateMonitorConfig(spec)
+	if !thisConfig.Enabled {
+		errorRateBreachedLock.Lock()
+		delete(errorRateBreached, spec.APIID)
+		errorRateBreachedLock.Unlock()
+		return
+	}
+
+	values, err := spec.Health.GetApiHealthValues()
+	if err != nil {
+		log.Error("Couldn't read health values for error rate monitor: ", err)
+		return
+	}
+
+	breached := thisConfig.isBreached(values)
+
+	errorRateBreachedLock.Lock()
+	wasBreached := errorRateBreached[spec.APIID]
+	errorRateBreached[spec.APIID] = breached
+	errorRateBreachedLock.Unlock()
+
+	if !breached {
+		if wasBreached {
+			log.Info("5xx error rate of API ", spec.APIID, " is back under the threshold: ", values.ServerErrorRate, "%")
+		}
+		return
+	}
+
+	if wasBreached {
+		return
+	}
+
+	log.Warning("5xx error rate of API ", spec.APIID, " is ", values.ServerErrorRate, "%, threshold: ", thisConfig.Threshold, "%")
+	if !claimErrorRateEvent(spec.APIID, values.Window) {
+		log.Debug("Error rate event was fired by another node")
+		return
+	}
+
+	spec.FireEvent(EVENT_ErrorRateTriggered,
+		EVENT_ErrorRateTriggeredMeta{
+			EventMetaDefault: EventMetaDefault{Message: fmt.Sprintf("5xx error rate of %v%% reached the threshold of %v%%", values.ServerErrorRate, thisConfig.Threshold)},
+			APIID:            spec.APIID,
+			ErrorRate:        values.ServerErrorRate,
+			Threshold:        thisConfig.Threshold,
+			Requests:         values.TotalRequests,
+			Window:           values.Window,
+		})
+}
+
+// StartErrorRateMonitorLoop checks the 5xx error rates of the loaded APIs every interval seconds, it
+// needs health checks to be enabled
+func StartErrorRateMonitorLoop(interval int) {
+	if interval < 1 {
+		interval = HEALTH_CHECK_DEFAULT_FLUSH_INTERVAL
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		for _, spec := range getApiSpecs() {
+			checkErrorRate(spec)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEventHandler struct {
+	events chan EventMessage
+}
+
+func (h testEventHandler) New(interface{}) (TykEventHandler, error) {
+	return h, nil
+}
+
+func (h testEventHandler) HandleEvent(em EventMessage) {
+	h.events <- em
+}
+
+// testClaimStore keeps the claims of another node
+type testClaimStore struct {
+	claims map[string]string
+}
+
+func (s *testClaimStore) SetKeys(keys map[string]string, timeout int64, overwrite bool) ([]string, error) {
+	skipped := []string{}
+	for keyName, value := range keys {
+		if _, found := s.claims[keyName]; found && !overwrite {
+			skipped = append(skipped, keyName)
+			continue
+		}
+		s.claims[keyName] = value
+	}
+	return skipped, nil
+}
+
+func newErrorRateTestSpec(values HealthCheckValues) (APISpec, chan EventMessage) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"error_rate_monitor": {"enabled": true, "threshold": 5, "min_requests": 20},`, 1))
+	spec.Health = &testHealthChecker{values: values}
+
+	events := make(chan EventMessage, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{
+		EVENT_ErrorRateTriggered: {testEventHandler{events}},
+	}
+
+	return spec, events
+}
+
+func expectErrorRateEvent(t *testing.T, events chan EventMessage, expected bool) {
+	select {
+	case em := <-events:
+		if !expected {
+			t.Error("Unexpected error rate event: ", em.EventMetaData)
+		}
+	case <-time.After(100 * time.Millisecond):
+		if expected {
+			t.Error("Error rate event wasn't fired")
+		}
+	}
+}
+
+func TestErrorRateMonitor(t *testing.T) {
+	spec, events := newErrorRateTestSpec(HealthCheckValues{TotalRequests: 100, ServerErrorRate: 10, Window: 60})
+	defer func() { delete(errorRateBreached, spec.APIID) }()
+	checker := spec.Health.(*testHealthChecker)
+
+	checkErrorRate(&spec)
+	expectErrorRateEvent(t, events, true)
+
+	// Still breached, the event only fires when the threshold is crossed
+	checkErrorRate(&spec)
+	expectErrorRateEvent(t, events, false)
+
+	checker.values.ServerErrorRate = 1
+	checkErrorRate(&spec)
+	checker.values.ServerErrorRate = 6
+	checkErrorRate(&spec)
+	expectErrorRateEvent(t, events, true)
+
+	// Quiet windows are ignored
+	delete(errorRateBreached, spec.APIID)
+	checker.values = HealthCheckValues{TotalRequests: 5, ServerErrorRate: 100, Window: 60}
+	checkErrorRate(&spec)
+	expectErrorRateEvent(t, events, false)
+}
+
+func TestErrorRateMonitorFiresOncePerCluster(t *testing.T) {
+	ErrorRateClaims = &testClaimStore{claims: map[string]string{}}
+	defer func() { ErrorRateClaims = nil }()
+
+	spec, events := newErrorRateTestSpec(HealthCheckValues{TotalRequests: 100, ServerErrorRate: 10, Window: 60})
+	defer func() { delete(errorRateBreached, spec.APIID) }()
+
+	checkErrorRate(&spec)
+	expectErrorRateEvent(t, events, true)
+
+	// Another node sees the same breach
+	delete(errorRateBreached, spec.APIID)
+	checkErrorRate(&spec)
+	expectErrorRateEvent(t, events, false)
+}
+
+func TestServerErrorHealthCount(t *testing.T) {
+	aggregate := newHealthAggregate(10)
+	aggregate.record(RequestLog, "20", 100)
+	aggregate.record(RequestLog, "20", 100)
+	aggregate.record(ServerError, "1", 100)
+	aggregate.record(BlockedRequestLog, "1", 100)
+	aggregate.record(ServerError, "1", 100)
+
+	if counts := aggregate.snapshot(100); counts.ServerErrors != 2 {
+		t.Error("5xx responses weren't counted: ", counts)
+	}
+}
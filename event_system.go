@@ -20,14 +20,24 @@ const (
 
 // Register new event types here, the string is the code used to hook at the Api Deifnititon JSON/BSON level
 const (
-	EVENT_QuotaExceeded     tykcommon.TykEvent = "QuotaExceeded"
-	EVENT_RateLimitExceeded tykcommon.TykEvent = "RatelimitExceeded"
-	EVENT_AuthFailure       tykcommon.TykEvent = "AuthFailure"
-	EVENT_KeyExpired        tykcommon.TykEvent = "KeyExpired"
-	EVENT_VersionFailure    tykcommon.TykEvent = "VersionFailure"
-	EVENT_OrgQuotaExceeded  tykcommon.TykEvent = "OrgQuotaExceeded"
-	EVENT_TriggerExceeded   tykcommon.TykEvent = "TriggerExceeded"
-	EVENT_BreakerTriggered  tykcommon.TykEvent = "BreakerTriggered"
+	EVENT_QuotaExceeded      tykcommon.TykEvent = "QuotaExceeded"
+	EVENT_RateLimitExceeded  tykcommon.TykEvent = "RatelimitExceeded"
+	EVENT_AuthFailure        tykcommon.TykEvent = "AuthFailure"
+	EVENT_KeyExpired         tykcommon.TykEvent = "KeyExpired"
+	EVENT_VersionFailure     tykcommon.TykEvent = "VersionFailure"
+	EVENT_OrgQuotaExceeded   tykcommon.TykEvent = "OrgQuotaExceeded"
+	EVENT_TriggerExceeded    tykcommon.TykEvent = "TriggerExceeded"
+	EVENT_BreakerTriggered   tykcommon.TykEvent = "BreakerTriggered"
+	EVENT_HardTimeout        tykcommon.TykEvent = "HardTimeout"
+	EVENT_KeyStateChanged    tykcommon.TykEvent = "KeyStateChanged"
+	EVENT_KeyRequested       tykcommon.TykEvent = "KeyRequested"
+	EVENT_KeyRequestApproved tykcommon.TykEvent = "KeyRequestApproved"
+	EVENT_KeyRequestRejected tykcommon.TykEvent = "KeyRequestRejected"
+	EVENT_KeyIPDenied        tykcommon.TykEvent = "KeyIPDenied"
+	EVENT_KeySuspended       tykcommon.TykEvent = "KeySuspended"
+	EVENT_KeyReaped          tykcommon.TykEvent = "KeyReaped"
+	EVENT_ListenPathConflict tykcommon.TykEvent = "ListenPathConflict"
+	EVENT_ErrorRateTriggered tykcommon.TykEvent = "ErrorRateTriggered"
 )
 
 // EventMetaDefault is a standard embedded struct to be used with custom event metadata types, gives an interface for
@@ -35,22 +45,25 @@ const (
 type EventMetaDefault struct {
 	Message            string
 	OriginatingRequest string
+	TykContext         map[string]interface{}
 }
 
 // EVENT_QuotaExceededMeta is the metadata structure for a quota exceeded event (EVENT_QuotaExceeded)
 type EVENT_QuotaExceededMeta struct {
 	EventMetaDefault
-	Path   string
-	Origin string
-	Key    string
+	Path        string
+	Origin      string
+	Key         string
+	MonitorOnly bool
 }
 
 // EVENT_RateLimitExceededMeta is the metadata structure for a rate limit exceeded event (EVENT_RateLimitExceeded)
 type EVENT_RateLimitExceededMeta struct {
 	EventMetaDefault
-	Path   string
-	Origin string
-	Key    string
+	Path        string
+	Origin      string
+	Key         string
+	MonitorOnly bool
 }
 
 // EVENT_AuthFailureMeta is the metadata structure for an auth failure (EVENT_AuthFailure)
@@ -69,6 +82,35 @@ type EVENT_CurcuitBreakerMeta struct {
 	CircuitEvent circuit.BreakerEvent
 }
 
+// EVENT_HardTimeoutMeta is the metadata structure for an upstream hard timeout (EVENT_HardTimeout)
+type EVENT_HardTimeoutMeta struct {
+	EventMetaDefault
+	Path    string
+	Origin  string
+	APIID   string
+	Timeout int
+}
+
+// EVENT_KeyStateChangedMeta is the metadata structure for a key workflow transition (EVENT_KeyStateChanged)
+type EVENT_KeyStateChangedMeta struct {
+	EventMetaDefault
+	Key      string
+	OldState string
+	NewState string
+}
+
+// EVENT_KeyRequestMeta is the metadata structure for the portal key request events (EVENT_KeyRequested,
+// EVENT_KeyRequestApproved and EVENT_KeyRequestRejected)
+type EVENT_KeyRequestMeta struct {
+	EventMetaDefault
+	RequestID string
+	PolicyID  string
+	Developer string
+	KeyHash   string
+	Status    string
+	Reason    string
+}
+
 // EVENT_KeyExpiredMeta is the metadata structure for an auth failure (EVENT_KeyExpired)
 type EVENT_KeyExpiredMeta struct {
 	EventMetaDefault
@@ -77,6 +119,40 @@ type EVENT_KeyExpiredMeta struct {
 	Key    string
 }
 
+// EVENT_KeySuspendedMeta is the metadata structure for a suspended key being used (EVENT_KeySuspended)
+type EVENT_KeySuspendedMeta struct {
+	EventMetaDefault
+	Path   string
+	Origin string
+	Key    string
+}
+
+// EVENT_KeyReapedMeta is the metadata structure for a key deleted by the stale key reaper (EVENT_KeyReaped)
+type EVENT_KeyReapedMeta struct {
+	EventMetaDefault
+	KeyHash  string
+	LastUsed int64
+}
+
+// EVENT_KeyIPDeniedMeta is the metadata structure for a key used from a disallowed IP (EVENT_KeyIPDenied)
+type EVENT_KeyIPDeniedMeta struct {
+	EventMetaDefault
+	Path   string
+	Origin string
+	Key    string
+}
+
+// EVENT_ErrorRateTriggeredMeta is the metadata structure for an API crossing its 5xx error rate threshold
+// (EVENT_ErrorRateTriggered), the rate is a percentage of the requests over the last Window seconds
+type EVENT_ErrorRateTriggeredMeta struct {
+	EventMetaDefault
+	APIID     string
+	ErrorRate float64
+	Threshold float64
+	Requests  int64
+	Window    int64
+}
+
 // EVENT_VersionFailureMeta is the metadata structure for an auth failure (EVENT_KeyExpired)
 type EVENT_VersionFailureMeta struct {
 	EventMetaDefault
@@ -219,5 +295,10 @@ func (l LogMessageEventHandler) HandleEvent(em EventMessage) {
 		formattedMsgString = fmt.Sprintf("%s:%s:%s: [STATUS] %v", formattedMsgString, msgConf.APIID, msgConf.Path, msgConf.CircuitEvent)
 	}
 
+	if em.EventType == EVENT_HardTimeout {
+		msgConf := em.EventMetaData.(EVENT_HardTimeoutMeta)
+		formattedMsgString = fmt.Sprintf("%s:%s:%s:%s: [TIMEOUT] %vs", formattedMsgString, msgConf.APIID, msgConf.Origin, msgConf.Path, msgConf.Timeout)
+	}
+
 	log.Warning(formattedMsgString)
 }
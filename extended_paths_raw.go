@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"regexp"
+)
+
+// RawExtendedPaths are the extended_paths entries that aren't part of the versioned API definition,
+// they are decoded from the raw definition
+type RawExtendedPaths struct {
+	MethodTransforms []MethodTransformMeta `mapstructure:"method_transforms"`
+	Mirror           []MirrorMeta          `mapstructure:"mirror"`
+}
+
+type RawExtendedPathsModuleConfig struct {
+	VersionData struct {
+		Versions map[string]struct {
+			ExtendedPaths RawExtendedPaths `mapstructure:"extended_paths"`
+		} `mapstructure:"versions"`
+	} `mapstructure:"version_data"`
+}
+
+// GetRawExtendedPaths returns the raw extended paths of each version of an API
+func GetRawExtendedPaths(spec *APISpec) (map[string]RawExtendedPaths, error) {
+	var thisModuleConfig RawExtendedPathsModuleConfig
+
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]RawExtendedPaths)
+	for versionName, version := range thisModuleConfig.VersionData.Versions {
+		versions[versionName] = version.ExtendedPaths
+	}
+
+	return versions, nil
+}
+
+var apiLangIDsRegex = regexp.MustCompile("{(.*?)}")
+
+// compileRawPath compiles a path the same way as the versioned extended paths
+func compileRawPath(path string) (*regexp.Regexp, error) {
+	return regexp.Compile(apiLangIDsRegex.ReplaceAllString(path, "(.*?)"))
+}
+
+// getRequestVersionKey returns the version of the request, it is empty if the version isn't valid
+func getRequestVersionKey(spec *APISpec, r *http.Request) string {
+	_, _, _, stat := spec.GetVersionData(r)
+	if stat != StatusOk {
+		return ""
+	}
+
+	versionKey, _ := context.Get(r, VersionKeyContext).(string)
+	return versionKey
+}
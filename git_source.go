@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// API definitions can be managed in a git repository, the repository is cloned into app_path and
+// definitions are loaded from git_source.path inside it. Nodes poll the branch and reload when its
+// HEAD moves, the repository is the source of truth so local changes to tracked files are discarded
+const (
+	GIT_SOURCE_DEFAULT_BRANCH        = "master"
+	GIT_SOURCE_DEFAULT_POLL_INTERVAL = 60
+)
+
+type GitSourceConfig struct {
+	Enabled      bool   `json:"enabled"`
+	RepoURL      string `json:"repo_url"`
+	Branch       string `json:"branch"`
+	Path         string `json:"path"`
+	PollInterval int    `json:"poll_interval"`
+}
+
+func (g GitSourceConfig) branch() string {
+	if g.Branch == "" {
+		return GIT_SOURCE_DEFAULT_BRANCH
+	}
+
+	return g.Branch
+}
+
+// runGit runs a git command in dir and returns its trimmed output, stderr is used as the error
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return "", errors.New("git " + args[0] + ": " + message)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// syncGitSource clones the repository into checkoutDir or brings it up to date with the remote
+// branch, it returns the commit that is checked out
+func syncGitSource(gitConfig GitSourceConfig, checkoutDir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(checkoutDir, ".git")); os.IsNotExist(err) {
+		// Cloning into a directory that holds other files would fail half way
+		if files, _ := ioutil.ReadDir(checkoutDir); len(files) > 0 {
+			return "", errors.New(checkoutDir + " is not empty and is not a git repository")
+		}
+
+		log.Info("Cloning API definitions from ", gitConfig.RepoURL)
+		if _, err := runGit(".", "clone", "--branch", gitConfig.branch(), "--single-branch", gitConfig.RepoURL, checkoutDir); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := runGit(checkoutDir, "fetch", "origin", gitConfig.branch()); err != nil {
+			return "", err
+		}
+		if _, err := runGit(checkoutDir, "reset", "--hard", "origin/"+gitConfig.branch()); err != nil {
+			return "", err
+		}
+	}
+
+	return runGit(checkoutDir, "rev-parse", "HEAD")
+}
+
+// getAppDefinitionsPath is the directory API definition files are loaded from
+func getAppDefinitionsPath() string {
+	if config.GitSource.Enabled {
+		return filepath.Join(config.AppPath, config.GitSource.Path)
+	}
+
+	return config.AppPath
+}
+
+// StartGitSource checks out the repository before the APIs are first loaded and then polls it, if
+// the first sync fails the definitions already on disk are used
+func StartGitSource() {
+	head, err := syncGitSource(config.GitSource, config.AppPath)
+	if err != nil {
+		log.Error("Couldn't sync API definitions from git: ", err)
+	} else {
+		log.Info("API definitions checked out at ", head)
+	}
+
+	go gitSourcePollLoop(head)
+}
+
+func gitSourcePollLoop(lastHead string) {
+	interval := config.GitSource.PollInterval
+	if interval < 1 {
+		interval = GIT_SOURCE_DEFAULT_POLL_INTERVAL
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		head, err := syncGitSource(config.GitSource, config.AppPath)
+		if err != nil {
+			log.Error("Couldn't sync API definitions from git: ", err)
+			continue
+		}
+
+		if head != lastHead {
+			log.Info("API definitions changed in git (", head, "), reloading")
+			lastHead = head
+			ReloadURLStructure()
+		}
+	}
+}
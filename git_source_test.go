@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func commitGitTestFile(t *testing.T, repoDir string, name string, content string) string {
+	if err := ioutil.WriteFile(filepath.Join(repoDir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", name},
+		{"-c", "user.name=tyk", "-c", "user.email=tyk@example.com", "commit", "-q", "-m", "Update " + name},
+	} {
+		if _, err := runGit(repoDir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head, _ := runGit(repoDir, "rev-parse", "HEAD")
+	return head
+}
+
+func TestSyncGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	tmpDir, _ := ioutil.TempDir("", "tyk-git-source")
+	defer os.RemoveAll(tmpDir)
+
+	originDir := filepath.Join(tmpDir, "origin")
+	os.Mkdir(originDir, 0755)
+	if _, err := runGit(originDir, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+	runGit(originDir, "checkout", "-q", "-b", "live")
+	firstHead := commitGitTestFile(t, originDir, "api1.json", "{}")
+
+	gitConfig := GitSourceConfig{Enabled: true, RepoURL: originDir, Branch: "live"}
+	checkoutDir := filepath.Join(tmpDir, "apps")
+
+	head, err := syncGitSource(gitConfig, checkoutDir)
+	if err != nil || head != firstHead {
+		t.Fatal("Clone failed: ", head, err)
+	}
+	if _, err := os.Stat(filepath.Join(checkoutDir, "api1.json")); err != nil {
+		t.Error("Definition was not checked out")
+	}
+
+	secondHead := commitGitTestFile(t, originDir, "api2.json", "{}")
+	head, err = syncGitSource(gitConfig, checkoutDir)
+	if err != nil || head != secondHead {
+		t.Error("Pull failed: ", head, err)
+	}
+
+	// Directories with other files are never cloned into
+	otherDir := filepath.Join(tmpDir, "other")
+	os.Mkdir(otherDir, 0755)
+	ioutil.WriteFile(filepath.Join(otherDir, "api.json"), []byte("{}"), 0644)
+	if _, err := syncGitSource(gitConfig, otherDir); err == nil {
+		t.Error("Cloning into a directory with files should fail")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
+)
+
+// GlobalMiddlewareModuleConfig lets an API opt out of the global_middleware set in tyk.conf
+type GlobalMiddlewareModuleConfig struct {
+	DisableGlobalMiddleware bool `mapstructure:"disable_global_middleware" bson:"disable_global_middleware" json:"disable_global_middleware"`
+}
+
+// getGlobalMiddleware returns the server-wide JSVM middleware for an API, global pre middleware
+// run before the API's own and global post middleware after them
+func getGlobalMiddleware(spec *APISpec) ([]tykcommon.MiddlewareDefinition, []tykcommon.MiddlewareDefinition) {
+	mwPreFuncs := []tykcommon.MiddlewareDefinition{}
+	mwPostFuncs := []tykcommon.MiddlewareDefinition{}
+
+	var thisModuleConfig GlobalMiddlewareModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode disable_global_middleware: ", err)
+	}
+
+	if thisModuleConfig.DisableGlobalMiddleware {
+		log.Debug("Global middleware disabled for API ", spec.APIID)
+		return mwPreFuncs, mwPostFuncs
+	}
+
+	for _, mwObj := range config.GlobalMiddleware.Pre {
+		mwPreFuncs = append(mwPreFuncs, mwObj.Definition())
+	}
+	for _, mwObj := range config.GlobalMiddleware.Post {
+		mwPostFuncs = append(mwPostFuncs, mwObj.Definition())
+	}
+
+	return mwPreFuncs, mwPostFuncs
+}
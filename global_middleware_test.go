@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+func globalMiddlewareDefinition(disabled string) string {
+	return `{
+		"name": "Global MW API",
+		"api_id": "globalmw1",
+		"org_id": "default",
+		"use_keyless": true,
+		"disable_global_middleware": ` + disabled + `,
+		"version_data": {
+			"not_versioned": true,
+			"versions": {"Default": {"name": "Default"}}
+		},
+		"proxy": {
+			"listen_path": "/globalmw/",
+			"target_url": "http://example.com",
+			"strip_listen_path": false
+		},
+		"custom_middleware": {
+			"pre": [{"name": "apiPreMW", "path": "middleware/api_pre.js"}],
+			"post": [{"name": "apiPostMW", "path": "middleware/api_post.js"}]
+		}
+	}`
+}
+
+func TestGlobalMiddleware(t *testing.T) {
+	oldGlobalMiddleware := config.GlobalMiddleware
+	defer func() { config.GlobalMiddleware = oldGlobalMiddleware }()
+
+	config.GlobalMiddleware.Pre = []MiddlewareHookDefinition{{Name: "globalPreMW", Path: "middleware/global_pre.js"}}
+	config.GlobalMiddleware.Post = []MiddlewareHookDefinition{{Name: "globalPostMW", Path: "middleware/global_post.js", RequireSession: true}}
+
+	spec := createDefinitionFromString(globalMiddlewareDefinition("false"))
+	mwPaths, mwPreFuncs, mwPostFuncs := loadCustomMiddleware(&spec)
+
+	if len(mwPreFuncs) != 2 || mwPreFuncs[0].Name != "globalPreMW" || mwPreFuncs[1].Name != "apiPreMW" {
+		t.Error("Global pre middleware should run before the API's: ", mwPreFuncs)
+	}
+	if len(mwPostFuncs) != 2 || mwPostFuncs[0].Name != "apiPostMW" || mwPostFuncs[1].Name != "globalPostMW" {
+		t.Error("Global post middleware should run after the API's: ", mwPostFuncs)
+	}
+	if !mwPostFuncs[1].RequireSession {
+		t.Error("Global middleware should keep require_session")
+	}
+	if len(mwPaths) != 4 {
+		t.Error("Global middleware files should be loaded into the API's VM: ", mwPaths)
+	}
+}
+
+func TestGlobalMiddlewareOptOut(t *testing.T) {
+	oldGlobalMiddleware := config.GlobalMiddleware
+	defer func() { config.GlobalMiddleware = oldGlobalMiddleware }()
+
+	config.GlobalMiddleware.Pre = []MiddlewareHookDefinition{{Name: "globalPreMW", Path: "middleware/global_pre.js"}}
+
+	spec := createDefinitionFromString(globalMiddlewareDefinition("true"))
+	_, mwPreFuncs, _ := loadCustomMiddleware(&spec)
+
+	if len(mwPreFuncs) != 1 || mwPreFuncs[0].Name != "apiPreMW" {
+		t.Error("API opted out of global middleware: ", mwPreFuncs)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"github.com/gorilla/context"
 	"net/http"
 	"runtime/pprof"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -22,7 +22,11 @@ type ErrorHandler struct {
 
 // HandleError is the actual error handler and will store the error details in analytics if analytics processing is enabled.
 func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err string, errCode int) {
+	// The analytics recorder modifies the path, so hold on to the original
+	instance := r.URL.Path
 
+	// The record is sent once the error body has been written, so that its size is known
+	var errorRecord *AnalyticsRecord
 	if config.StoreAnalytics(r) {
 
 		t := time.Now()
@@ -40,7 +44,7 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 		}
 
 		if e.TykMiddleware.Spec.APIDefinition.Proxy.StripListenPath {
-			r.URL.Path = strings.Replace(r.URL.Path, e.TykMiddleware.Spec.Proxy.ListenPath, "", 1)
+			r.URL.Path = e.TykMiddleware.Spec.StripListenPath(r.URL.Path)
 		}
 
 		// This is an odd bugfix, will need further testing
@@ -52,14 +56,16 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 
 		if thisSessionState != nil {
 			OauthClientID = thisSessionState.(SessionState).OauthClientID
-			tags = thisSessionState.(SessionState).Tags
+			tags = append(tags, thisSessionState.(SessionState).Tags...)
 		}
+		tags = append(tags, getTenantTags(r)...)
+		tags = append(tags, getLimitViolationTags(r)...)
 
 		thisRecord := AnalyticsRecord{
 			r.Method,
 			r.URL.Path,
 			r.ContentLength,
-			r.Header.Get("User-Agent"),
+			e.Spec.LogMasking.MaskHeader("User-Agent", r.Header.Get("User-Agent")),
 			t.Day(),
 			t.Month(),
 			t.Year(),
@@ -75,6 +81,10 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 			0,
 			tags,
 			time.Now(),
+			getMiddlewareTimings(r),
+			0,
+			requestSize(r, nil),
+			0,
 		}
 
 		expiresAfter := e.Spec.ExpireAnalyticsAfter
@@ -89,23 +99,44 @@ func (e ErrorHandler) HandleError(w http.ResponseWriter, r *http.Request, err st
 		}
 
 		thisRecord.SetExpiry(expiresAfter)
-		go analytics.RecordHit(thisRecord)
+		errorRecord = &thisRecord
 	}
 
 	// Report in health check
 	ReportHealthCheckValue(e.Spec.Health, BlockedRequestLog, "1")
+	if errCode >= 500 {
+		ReportHealthCheckValue(e.Spec.Health, ServerError, "1")
+	}
+	e.Spec.Health.StoreMiddlewareTimings(getMiddlewareTimings(r))
 
-	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("X-Generator", "tyk.io")
 	// Close connections
 	if config.CloseConnections {
 		w.Header().Add("Connection", "close")
 	}
 
+	sizeWriter := &meteringResponseWriter{ResponseWriter: w}
+	w = sizeWriter
+
 	log.Debug("Returning error header")
-	w.WriteHeader(errCode)
-	thisError := APIError{fmt.Sprintf("%s", err)}
-	templates.ExecuteTemplate(w, "error.json", &thisError)
+	problemConf := GetProblemDetailsConfig(e.Spec)
+	if problemConf.Enabled {
+		thisProblem := NewProblemDetails(problemConf, instance, err, errCode, getRetryAfter(r))
+		writeProblemDetails(w, thisProblem)
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(errCode)
+		thisError := APIError{fmt.Sprintf("%s", err)}
+		templates.ExecuteTemplate(w, "error.json", &thisError)
+	}
+
+	if errorRecord != nil {
+		errorRecord.ResponseSize = sizeWriter.bytesOut
+		go recordAnalytics(e.Spec, *errorRecord)
+	}
+	ReportHealthCheckValue(e.Spec.Health, RequestBytes, strconv.FormatInt(requestSize(r, nil), 10))
+	ReportHealthCheckValue(e.Spec.Health, ResponseBytes, strconv.FormatInt(sizeWriter.bytesOut, 10))
+
 	if doMemoryProfile {
 		pprof.WriteHeapProfile(profileFile)
 	}
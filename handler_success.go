@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"runtime/pprof"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -19,6 +18,22 @@ const (
 	AuthHeaderValue   = 1
 	VersionData       = 2
 	VersionKeyContext = 3
+	TenantData        = 4
+	ContextData       = 5
+	SOAPRequest       = 6
+	URLRewriteTarget  = 7
+	DebugTraceContext = 8
+	MiddlewareTimings = 9
+	ListenPathParams  = 10
+	StreamingRequest  = 11
+	SSEStreamStart    = 12
+	ConcurrencySlots  = 13
+	TrafficSizes      = 14
+	LimitViolations   = 15
+	AdminScope        = 16
+	AdminActor        = 17
+	VerifiedClaims    = 18
+	MiddlewareError   = 19
 )
 
 // TykMiddleware wraps up the ApiSpec and Proxy objects to be included in a
@@ -61,10 +76,15 @@ func (t TykMiddleware) ApplyPolicyIfExists(key string, thisSession *SessionState
 			thisSession.Per = policy.Per
 			thisSession.QuotaMax = policy.QuotaMax
 			thisSession.QuotaRenewalRate = policy.QuotaRenewalRate
+			thisSession.QuotaAlgorithm = policy.QuotaAlgorithm
 			thisSession.AccessRights = policy.AccessRights
 			thisSession.HMACEnabled = policy.HMACEnabled
 			thisSession.IsInactive = policy.IsInactive
 			thisSession.Tags = policy.Tags
+			thisSession.AccessWindows = policy.AccessWindows
+			thisSession.MaxConcurrent = policy.MaxConcurrent
+			thisSession.SpikeArrest = policy.SpikeArrest
+			thisSession.MonitorOnlyLimits = policy.MonitorOnlyLimits
 
 			// Update the session in the session manager in case it gets called again
 			t.Spec.SessionManager.UpdateSession(key, *thisSession, t.Spec.APIDefinition.SessionLifetime)
@@ -103,12 +123,33 @@ func (t TykMiddleware) CheckSessionAndIdentityForValidKey(key string) (SessionSt
 	return thisSession, found
 }
 
+// trafficSizes are the body sizes of a request and its response in bytes
+type trafficSizes struct {
+	RequestBytes  int64
+	ResponseBytes int64
+}
+
+// setTrafficSizes stores the sizes for RecordHit, it must be called before RecordHit runs
+func setTrafficSizes(r *http.Request, requestBytes int64, responseBytes int64) {
+	context.Set(r, TrafficSizes, trafficSizes{requestBytes, responseBytes})
+}
+
+// getTrafficSizes returns the stored sizes, only the declared request length is known if none were set
+func getTrafficSizes(r *http.Request) trafficSizes {
+	if sizes, ok := context.Get(r, TrafficSizes).(trafficSizes); ok {
+		return sizes
+	}
+
+	return trafficSizes{RequestBytes: requestSize(r, nil)}
+}
+
 // SuccessHandler represents the final ServeHTTP() request for a proxied API request
 type SuccessHandler struct {
 	*TykMiddleware
 }
 
 func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing int64) {
+	sizes := getTrafficSizes(r)
 
 	if config.StoreAnalytics(r) {
 
@@ -134,14 +175,22 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 
 		if thisSessionState != nil {
 			OauthClientID = thisSessionState.(SessionState).OauthClientID
-			tags = thisSessionState.(SessionState).Tags
+			tags = append(tags, thisSessionState.(SessionState).Tags...)
+		}
+		tags = append(tags, getTenantTags(r)...)
+		tags = append(tags, getLimitViolationTags(r)...)
+
+		var streamDuration int64
+		if streamStart, ok := context.Get(r, SSEStreamStart).(time.Time); ok {
+			tags = append(tags, SSE_ANALYTICS_TAG)
+			streamDuration = int64(t.Sub(streamStart) / time.Millisecond)
 		}
 
 		thisRecord := AnalyticsRecord{
 			r.Method,
 			r.URL.Path,
 			r.ContentLength,
-			r.Header.Get("User-Agent"),
+			s.Spec.LogMasking.MaskHeader("User-Agent", r.Header.Get("User-Agent")),
 			t.Day(),
 			t.Month(),
 			t.Year(),
@@ -157,6 +206,10 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 			timing,
 			tags,
 			time.Now(),
+			getMiddlewareTimings(r),
+			streamDuration,
+			sizes.RequestBytes,
+			sizes.ResponseBytes,
 		}
 
 		expiresAfter := s.Spec.ExpireAnalyticsAfter
@@ -172,11 +225,14 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 
 		thisRecord.SetExpiry(expiresAfter)
 
-		analytics.RecordHit(thisRecord)
+		recordAnalytics(s.Spec, thisRecord)
 	}
 
 	// Report in health check
 	ReportHealthCheckValue(s.Spec.Health, RequestLog, strconv.FormatInt(int64(timing), 10))
+	ReportHealthCheckValue(s.Spec.Health, RequestBytes, strconv.FormatInt(sizes.RequestBytes, 10))
+	ReportHealthCheckValue(s.Spec.Health, ResponseBytes, strconv.FormatInt(sizes.ResponseBytes, 10))
+	s.Spec.Health.StoreMiddlewareTimings(getMiddlewareTimings(r))
 
 	if doMemoryProfile {
 		pprof.WriteHeapProfile(profileFile)
@@ -185,13 +241,45 @@ func (s SuccessHandler) RecordHit(w http.ResponseWriter, r *http.Request, timing
 	context.Clear(r)
 }
 
+// RecordLastUsed marks the key of the request as used, it must be called before RecordHit clears the context
+func (s SuccessHandler) RecordLastUsed(r *http.Request) {
+	if KeyUsage == nil {
+		return
+	}
+
+	if authHeaderValue := context.Get(r, AuthHeaderValue); authHeaderValue != nil {
+		KeyUsage.Touch(authHeaderValue.(string))
+	}
+}
+
+// RecordUsage adds the request to the usage rollups, the key is read here as the context is cleared by RecordHit
+func (s SuccessHandler) RecordUsage(r *http.Request, bytesIn int64, bytesOut int64) {
+	keyName := ""
+	if authHeaderValue := context.Get(r, AuthHeaderValue); authHeaderValue != nil {
+		keyName = authHeaderValue.(string)
+	}
+
+	go Metering.Record(s.Spec.OrgID, s.Spec.APIID, keyName, bytesIn, bytesOut)
+}
+
 // ServeHTTP will store the request details in the analytics store if necessary and proxy the request to it's
 // final destination, this is invoked by the ProxyHandler or right at the start of a request chain if the URL
 // Spec states the path is Ignored
 func (s SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) *http.Response {
+	inPath := r.URL.Path
+	var learningWriter *learningResponseWriter
+	if s.Spec.OpenAPILearning {
+		learningWriter = &learningResponseWriter{ResponseWriter: w}
+		w = learningWriter
+	}
+	// Sizes are counted for analytics and health checks even if metering is off
+	meteringWriter := &meteringResponseWriter{ResponseWriter: w}
+	w = meteringWriter
+	requestBody := meterRequestBody(r)
+
 	// Make sure we get the correct target URL
 	if s.Spec.APIDefinition.Proxy.StripListenPath {
-		r.URL.Path = strings.Replace(r.URL.Path, s.Spec.Proxy.ListenPath, "", 1)
+		r.URL.Path = s.Spec.StripListenPath(r.URL.Path)
 		log.Debug("Upstream Path is: ", r.URL.Path)
 	}
 
@@ -199,7 +287,19 @@ func (s SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) *http.
 	s.Proxy.ServeHTTP(w, r)
 	t2 := time.Now()
 
-	millisec := float64(t2.UnixNano()-t1.UnixNano()) * 0.000001
+	if learningWriter != nil && learningWriter.code > 0 {
+		LearnedAPIs.Observe(s.Spec, r.Method, inPath, learningWriter.code)
+	}
+
+	bytesIn := requestSize(r, requestBody)
+	setTrafficSizes(r, bytesIn, meteringWriter.bytesOut)
+	if Metering != nil {
+		s.RecordUsage(r, bytesIn, meteringWriter.bytesOut)
+	}
+
+	s.RecordLastUsed(r)
+
+	millisec := upstreamLatency(r, t1, t2)
 	log.Debug("Upstream request took (ms): ", millisec)
 
 	go s.RecordHit(w, r, int64(millisec))
@@ -210,16 +310,34 @@ func (s SuccessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) *http.
 // final destination, this is invoked by the ProxyHandler or right at the start of a request chain if the URL
 // Spec states the path is Ignored Itwill also return a response object for the cache
 func (s SuccessHandler) ServeHTTPWithCache(w http.ResponseWriter, r *http.Request) *http.Response {
+	inPath := r.URL.Path
+	// Sizes are counted for analytics and health checks even if metering is off
+	meteringWriter := &meteringResponseWriter{ResponseWriter: w}
+	w = meteringWriter
+	requestBody := meterRequestBody(r)
+
 	// Make sure we get the correct target URL
 	if s.Spec.APIDefinition.Proxy.StripListenPath {
-		r.URL.Path = strings.Replace(r.URL.Path, s.Spec.Proxy.ListenPath, "", 1)
+		r.URL.Path = s.Spec.StripListenPath(r.URL.Path)
 	}
 
 	t1 := time.Now()
 	inRes := s.Proxy.ServeHTTPForCache(w, r)
 	t2 := time.Now()
 
-	millisec := float64(t2.UnixNano()-t1.UnixNano()) * 0.000001
+	if s.Spec.OpenAPILearning && inRes != nil {
+		LearnedAPIs.Observe(s.Spec, r.Method, inPath, inRes.StatusCode)
+	}
+
+	bytesIn := requestSize(r, requestBody)
+	setTrafficSizes(r, bytesIn, meteringWriter.bytesOut)
+	if Metering != nil {
+		s.RecordUsage(r, bytesIn, meteringWriter.bytesOut)
+	}
+
+	s.RecordLastUsed(r)
+
+	millisec := upstreamLatency(r, t1, t2)
 	log.Debug("Upstream request took (ms): ", millisec)
 
 	go s.RecordHit(w, r, int64(millisec))
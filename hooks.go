@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	HOOK_Startup = "startup"
+	HOOK_Reload  = "reload"
+
+	hookDefaultTimeout = 30
+)
+
+// HookConfig is a single startup or reload hook, either a named JS function (loaded from path)
+// or an external command, timeout is in seconds
+type HookConfig struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Timeout int      `json:"timeout"`
+}
+
+// HookContext is passed to JS hooks as their only argument, commands get the same values as
+// TYK_HOOK_* environment variables
+type HookContext struct {
+	Event    string
+	Hostname string
+	Version  string
+	APICount int
+}
+
+func newHookContext(event string) HookContext {
+	hostname, _ := os.Hostname()
+	return HookContext{
+		Event:    event,
+		Hostname: hostname,
+		Version:  VERSION,
+		APICount: len(getApiSpecs()),
+	}
+}
+
+// RunHooks runs each hook in order, a failing or timed out hook is logged and does not stop the others
+func RunHooks(event string, hooks []HookConfig) {
+	if len(hooks) == 0 {
+		return
+	}
+
+	thisContext := newHookContext(event)
+	log.Info(fmt.Sprintf("Running %v %v hook(s)", len(hooks), event))
+
+	for _, thisHook := range hooks {
+		var err error
+		if thisHook.Command != "" {
+			err = runCommandHook(thisHook, thisContext)
+		} else if thisHook.Name != "" {
+			err = runJSHook(thisHook, thisContext)
+		} else {
+			err = errors.New("hook has no name or command")
+		}
+
+		if err != nil {
+			log.Error("Hook failed (", event, "): ", err)
+		}
+	}
+}
+
+func getHookTimeout(thisHook HookConfig) time.Duration {
+	if thisHook.Timeout > 0 {
+		return time.Duration(thisHook.Timeout) * time.Second
+	}
+
+	return hookDefaultTimeout * time.Second
+}
+
+func runCommandHook(thisHook HookConfig, thisContext HookContext) error {
+	cmd := exec.Command(thisHook.Command, thisHook.Args...)
+	cmd.Env = append(os.Environ(),
+		"TYK_HOOK_EVENT="+thisContext.Event,
+		"TYK_HOOK_HOSTNAME="+thisContext.Hostname,
+		"TYK_HOOK_VERSION="+thisContext.Version,
+		fmt.Sprintf("TYK_HOOK_API_COUNT=%v", thisContext.APICount))
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(getHookTimeout(thisHook)):
+		cmd.Process.Kill()
+		return errors.New("command timed out: " + thisHook.Command)
+	}
+}
+
+func runJSHook(thisHook HookConfig, thisContext HookContext) error {
+	// Hooks get their own VM so a long running hook can be interrupted without affecting event handlers
+	hookVM := &JSVM{}
+	hookVM.Init(config.TykJSPath)
+	if thisHook.Path != "" {
+		hookVM.LoadJSPaths([]string{thisHook.Path})
+	}
+
+	contextAsJSON, encErr := json.Marshal(thisContext)
+	if encErr != nil {
+		return encErr
+	}
+
+	hookVM.VM.Interrupt = make(chan func(), 1)
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if caught := recover(); caught != nil {
+				done <- fmt.Errorf("JS hook interrupted: %v", caught)
+			}
+		}()
+
+		_, runErr := hookVM.VM.Run(thisHook.Name + `(` + string(contextAsJSON) + `);`)
+		done <- runErr
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(getHookTimeout(thisHook)):
+		hookVM.VM.Interrupt <- func() {
+			panic("timeout")
+		}
+		return errors.New("JS hook timed out: " + thisHook.Name)
+	}
+}
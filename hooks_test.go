@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandHook(t *testing.T) {
+	thisContext := newHookContext(HOOK_Startup)
+
+	if err := runCommandHook(HookConfig{Command: "true"}, thisContext); err != nil {
+		t.Error("Command hook should have succeeded: ", err)
+	}
+
+	if err := runCommandHook(HookConfig{Command: "false"}, thisContext); err == nil {
+		t.Error("Failing command should return an error")
+	}
+
+	if err := runCommandHook(HookConfig{Command: "/does/not/exist"}, thisContext); err == nil {
+		t.Error("Missing command should return an error")
+	}
+}
+
+func TestCommandHookTimeout(t *testing.T) {
+	start := time.Now()
+	err := runCommandHook(HookConfig{Command: "sleep", Args: []string{"10"}, Timeout: 1}, newHookContext(HOOK_Reload))
+	if err == nil {
+		t.Error("Hook should have timed out")
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("Hook was not killed after its timeout")
+	}
+}
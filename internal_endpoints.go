@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gorilla/context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Targets with the tyk scheme are other APIs on this gateway, e.g. tyk://<api_id>/path or
+// tyk://<api name>/path, the path is relative to the listen path of the target API
+const (
+	INTERNAL_API_SCHEME   = "tyk"
+	INTERNAL_HOPS_HEADER  = "X-Tyk-Internal-Hops"
+	INTERNAL_API_MAX_HOPS = 10
+)
+
+var (
+	ErrInternalAPINotFound = errors.New("Internal API not found")
+	ErrInternalAPILoop     = errors.New("Too many internal API hops, is there a loop?")
+)
+
+type internalAPI struct {
+	listenPath string
+	handler    http.Handler
+}
+
+var internalAPIs = make(map[string]internalAPI)
+var internalAPIsLock sync.RWMutex
+
+// setInternalAPIs replaces the internal API handlers, it is called once all the APIs are loaded
+func setInternalAPIs(apis map[string]internalAPI) {
+	internalAPIsLock.Lock()
+	internalAPIs = apis
+	internalAPIsLock.Unlock()
+}
+
+// addInternalAPI registers an API under its ID and its name, IDs take precedence over names
+func addInternalAPI(apis map[string]internalAPI, spec *APISpec, handler http.Handler) {
+	thisAPI := internalAPI{listenPath: spec.Proxy.ListenPath, handler: handler}
+	apis[spec.APIDefinition.APIID] = thisAPI
+
+	nameKey := strings.ToLower(spec.APIDefinition.Name)
+	if _, exists := apis[nameKey]; !exists {
+		apis[nameKey] = thisAPI
+	}
+}
+
+func getInternalAPI(host string) (internalAPI, bool) {
+	internalAPIsLock.RLock()
+	defer internalAPIsLock.RUnlock()
+
+	if thisAPI, found := internalAPIs[host]; found {
+		return thisAPI, true
+	}
+
+	thisAPI, found := internalAPIs[strings.ToLower(host)]
+	return thisAPI, found
+}
+
+// isInternalURL checks if a target or rewritten path points to another API on this gateway
+func isInternalURL(target *url.URL) bool {
+	return target != nil && target.Scheme == INTERNAL_API_SCHEME
+}
+
+// getInternalHops returns the number of internal calls a request has been through, clients can
+// only send the header to make the limit stricter
+func getInternalHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(INTERNAL_HOPS_HEADER))
+	if err != nil || hops < 0 {
+		return 0
+	}
+
+	return hops
+}
+
+// internalResponseWriter buffers the response of the target API so it can be handled like an
+// upstream response
+type internalResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *internalResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *internalResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *internalResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = 200
+	}
+	return w.body.Write(b)
+}
+
+// InternalTransport sends requests to the middleware chain of the target API in-process instead of
+// over the network, the target API applies its own auth, quotas and analytics
+type InternalTransport struct{}
+
+func (t InternalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, found := getInternalAPI(req.URL.Host)
+	if !found {
+		return nil, ErrInternalAPINotFound
+	}
+
+	hops := getInternalHops(req) + 1
+	if hops > INTERNAL_API_MAX_HOPS {
+		return nil, ErrInternalAPILoop
+	}
+
+	internalReq := new(http.Request)
+	*internalReq = *req
+	internalReq.URL = new(url.URL)
+	*internalReq.URL = *req.URL
+	internalReq.URL.Scheme = ""
+	internalReq.URL.Host = ""
+	internalReq.URL.Path = singleJoiningSlash(target.listenPath, req.URL.Path)
+	internalReq.RequestURI = internalReq.URL.RequestURI()
+	internalReq.Header = make(http.Header)
+	copyHeader(internalReq.Header, req.Header)
+	internalReq.Header.Set(INTERNAL_HOPS_HEADER, strconv.Itoa(hops))
+	defer context.Clear(internalReq)
+
+	log.Debug("Sending request to internal API: ", req.URL.Host, internalReq.URL.Path)
+
+	rw := &internalResponseWriter{header: make(http.Header)}
+	target.handler.ServeHTTP(rw, internalReq)
+	if rw.code == 0 {
+		rw.code = 200
+	}
+
+	return &http.Response{
+		Status:        strconv.Itoa(rw.code) + " " + http.StatusText(rw.code),
+		StatusCode:    rw.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rw.header,
+		Body:          ioutil.NopCloser(&rw.body),
+		ContentLength: int64(rw.body.Len()),
+		Request:       req,
+	}, nil
+}
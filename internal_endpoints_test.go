@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestInternalTransport(t *testing.T) {
+	spec := &APISpec{}
+	spec.APIDefinition.APIID = "internal1"
+	spec.APIDefinition.Name = "Users"
+	spec.Proxy.ListenPath = "/users/"
+
+	var gotPath, gotHops string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotHops = r.Header.Get(INTERNAL_HOPS_HEADER)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		w.Write([]byte(`{"id": 1}`))
+	})
+
+	apis := make(map[string]internalAPI)
+	addInternalAPI(apis, spec, handler)
+	setInternalAPIs(apis)
+	defer setInternalAPIs(make(map[string]internalAPI))
+
+	for _, target := range []string{"tyk://internal1/1/profile", "tyk://users/1/profile"} {
+		req, _ := http.NewRequest("GET", target, nil)
+		res, err := InternalTransport{}.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 201 || string(body) != `{"id": 1}` {
+			t.Error("Unexpected internal response: ", res.StatusCode, string(body))
+		}
+		if res.Header.Get("Content-Type") != "application/json" {
+			t.Error("Internal response headers were not kept")
+		}
+		if gotPath != "/users/1/profile" {
+			t.Error("Internal request should be relative to the listen path, got: ", gotPath)
+		}
+		if gotHops != "1" {
+			t.Error("Hops should be 1, got: ", gotHops)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "tyk://missing/", nil)
+	if _, err := (InternalTransport{}).RoundTrip(req); err != ErrInternalAPINotFound {
+		t.Error("Unknown internal APIs should fail, got: ", err)
+	}
+
+	req, _ = http.NewRequest("GET", "tyk://internal1/", nil)
+	req.Header.Set(INTERNAL_HOPS_HEADER, "10")
+	if _, err := (InternalTransport{}).RoundTrip(req); err != ErrInternalAPILoop {
+		t.Error("Requests over the hop limit should fail, got: ", err)
+	}
+}
@@ -11,13 +11,13 @@ var TykJS = {
         }
 };
 
-TykJS.TykMiddleware.MiddlewareComponentMeta.prototype.ProcessRequest = function(request, session) {
+TykJS.TykMiddleware.MiddlewareComponentMeta.prototype.ProcessRequest = function(request, session, spec) {
     log("Process Request Not Implemented");
     return request;
 };
 
-TykJS.TykMiddleware.MiddlewareComponentMeta.prototype.DoProcessRequest = function(request, session) {
-    var processed_request = this.ProcessRequest(request, session);
+TykJS.TykMiddleware.MiddlewareComponentMeta.prototype.DoProcessRequest = function(request, session, spec) {
+    var processed_request = this.ProcessRequest(request, session, spec);
 
     if (!processed_request) {
         log("Middleware didn't return request object!");
@@ -47,6 +47,44 @@ TykJS.TykMiddleware.NewMiddleware.prototype.ReturnData = function(request, sessi
     return {Request: request, SessionMeta: session}
 };
 
+// Auth check middleware return the key and its session, a request without them is rejected
+TykJS.TykMiddleware.NewMiddleware.prototype.ReturnAuthData = function(request, session, key) {
+    return {Request: request, Session: session, AuthKey: key}
+};
+
+// Stops the request with an error response
+TykJS.TykMiddleware.NewMiddleware.prototype.ReturnError = function(request, code, message) {
+    return {Request: request, ReturnOverrides: {ResponseCode: code, ResponseError: message}}
+};
+
+// Response middleware
+TykJS.TykMiddleware.MiddlewareComponentMeta.prototype.ProcessResponse = function(response, session, spec) {
+    log("Process Response Not Implemented");
+    return {Response: response};
+};
+
+TykJS.TykMiddleware.MiddlewareComponentMeta.prototype.DoProcessResponse = function(response, session, spec) {
+    var processed_response = this.ProcessResponse(response, session, spec);
+
+    if (!processed_response) {
+        log("Middleware didn't return response object!");
+        return;
+    }
+
+    // Reset the headers object
+    processed_response.Response.Headers = {}
+
+    return JSON.stringify(processed_response)
+};
+
+TykJS.TykMiddleware.NewMiddleware.prototype.NewProcessResponse = function(callback) {
+    this.ProcessResponse = callback;
+};
+
+TykJS.TykMiddleware.NewMiddleware.prototype.ReturnResponse = function(response) {
+    return {Response: response}
+};
+
 // ---- End middleware implementation for global context ----
 
 // -- Start Event Handler implementation ----
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// Named character sets for generated keys
+var keyCharsets = map[string]string{
+	"hex":          "0123456789abcdef",
+	"numeric":      "0123456789",
+	"alphanumeric": "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"urlsafe":      "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_",
+}
+
+// Generated keys are retried this many times if they collide with an existing key
+const KEY_GENERATION_ATTEMPTS = 5
+
+// KeyGenerationConfig sets the format of generated keys, the defaults keep the original format:
+// the org ID followed by 32 hex characters
+type KeyGenerationConfig struct {
+	Length           int    `json:"length"`
+	Charset          string `json:"charset"`
+	CustomCharset    string `json:"custom_charset"`
+	Prefix           string `json:"prefix"`
+	Separator        string `json:"separator"`
+	DisableOrgPrefix bool   `json:"disable_org_prefix"`
+}
+
+// IsCustom is true if the token part of a key needs to be generated from the charset rather than a UUID
+func (k KeyGenerationConfig) IsCustom() bool {
+	return k.Length > 0 || k.Charset != "" || k.CustomCharset != ""
+}
+
+func (k KeyGenerationConfig) getCharset() string {
+	if k.CustomCharset != "" {
+		return k.CustomCharset
+	}
+
+	if charset, ok := keyCharsets[k.Charset]; ok {
+		return charset
+	}
+
+	return keyCharsets["hex"]
+}
+
+// generateRandomToken uses crypto/rand, each character is picked uniformly from the charset. The
+// charset is read as runes so a custom charset can hold multi-byte characters
+func generateRandomToken(length int, charset string) (string, error) {
+	if length < 1 {
+		length = 32
+	}
+
+	chars := []rune(charset)
+	if len(chars) < 2 {
+		return "", errors.New("Key charset needs at least two characters")
+	}
+
+	max := big.NewInt(int64(len(chars)))
+	token := make([]rune, length)
+	for i := range token {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		token[i] = chars[n.Int64()]
+	}
+
+	return string(token), nil
+}
+
+// formatKey adds the configured prefix and org ID to a token
+func (k KeyGenerationConfig) formatKey(OrgID string, token string) string {
+	if k.DisableOrgPrefix || OrgID == "" {
+		return k.Prefix + token
+	}
+
+	return k.Prefix + expandKey(OrgID+k.Separator, token)
+}
+
+// sessionSpecs returns the APIs a session has access to, a session without access rights is for all APIs
+func sessionSpecs(thisSession SessionState) []*APISpec {
+	specs := []*APISpec{}
+	if len(thisSession.AccessRights) > 0 {
+		for APIID := range thisSession.AccessRights {
+			if thisAPISpec := GetSpecForApi(APIID); thisAPISpec != nil {
+				specs = append(specs, thisAPISpec)
+			}
+		}
+		return specs
+	}
+
+	for _, thisAPISpec := range getApiSpecs() {
+		specs = append(specs, thisAPISpec)
+	}
+
+	return specs
+}
+
+// claimKey creates a key in the session store of every API the session has access to, only if it
+// doesn't exist there yet (SET NX) so two requests can't create the same key. Stores that can't
+// write keys that way are checked for the key instead. If the key exists it is removed from the
+// stores it was created in and false is returned
+func claimKey(keyName string, thisSession SessionState) (bool, error) {
+	claimed := []*APISpec{}
+	release := func() {
+		for _, thisAPISpec := range claimed {
+			thisAPISpec.SessionManager.RemoveSession(keyName)
+		}
+	}
+
+	// APIs that share a store only need to claim the key once
+	namespaces := make(map[string]bool)
+	for _, thisAPISpec := range sessionSpecs(thisSession) {
+		namespace := storageKeyNamespace(thisAPISpec.SessionManager.GetStore())
+		if namespaces[namespace] {
+			continue
+		}
+		namespaces[namespace] = true
+
+		if importer, ok := thisAPISpec.SessionManager.(SessionImporter); ok {
+			skipped, err := importer.ImportSessions(map[string]SessionState{keyName: thisSession}, thisAPISpec.SessionLifetime, false)
+			if err == nil && len(skipped) == 0 {
+				claimed = append(claimed, thisAPISpec)
+				continue
+			}
+
+			if err == nil {
+				release()
+				return false, nil
+			}
+
+			if err != ErrBatchKeysUnsupported {
+				release()
+				return false, err
+			}
+		}
+
+		if thisAPISpec.SessionManager.KeyExists(keyName) {
+			release()
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// generateUniqueKey generates keys until one can be claimed, see claimKey
+func generateUniqueKey(thisSession SessionState) (string, error) {
+	for i := 0; i < KEY_GENERATION_ATTEMPTS; i++ {
+		newKey := keyGen.GenerateAuthKey(thisSession.OrgID)
+		if newKey == "" {
+			return "", errors.New("Key generation failed")
+		}
+
+		claimed, err := claimKey(newKey, thisSession)
+		if err != nil {
+			return "", err
+		}
+
+		if claimed {
+			return newKey, nil
+		}
+		log.Warning("Generated key collided with an existing key, retrying")
+	}
+
+	return "", errors.New("Could not generate a unique key, consider increasing the key length")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateRandomToken(t *testing.T) {
+	token, err := generateRandomToken(48, keyCharsets["numeric"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(token) != 48 {
+		t.Error("Token length is wrong: ", len(token))
+	}
+
+	if strings.Trim(token, keyCharsets["numeric"]) != "" {
+		t.Error("Token has characters outside the charset: ", token)
+	}
+
+	if _, err := generateRandomToken(10, "a"); err == nil {
+		t.Error("Single character charset should be rejected")
+	}
+
+	token, err = generateRandomToken(16, "äöü")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len([]rune(token)) != 16 || strings.Trim(token, "äöü") != "" {
+		t.Error("Multi-byte charset should be picked by character: ", token)
+	}
+}
+
+func TestClaimKey(t *testing.T) {
+	store := batchKeyStore{&InMemoryStorageManager{Sessions: make(map[string]string)}, "apikey-"}
+	spec := &APISpec{SessionManager: &DefaultSessionManager{}}
+	spec.APIID = "api-1"
+	spec.SessionManager.Init(store)
+
+	oldSpecs := getApiSpecs()
+	setApiSpecs(map[string]*APISpec{spec.APIID: spec})
+	defer setApiSpecs(oldSpecs)
+
+	thisSession := SessionState{AccessRights: map[string]AccessDefinition{"api-1": {}}}
+	if claimed, err := claimKey("abc123", thisSession); err != nil || !claimed {
+		t.Fatal("New key should be claimed: ", err)
+	}
+
+	if _, found := store.Sessions["abc123"]; !found {
+		t.Error("Claimed key should be stored")
+	}
+
+	if claimed, _ := claimKey("abc123", thisSession); claimed {
+		t.Error("Existing key should not be claimed again")
+	}
+}
+
+func TestKeyGenerationFormat(t *testing.T) {
+	thisConf := KeyGenerationConfig{Prefix: "tyk_", Separator: "."}
+	if key := thisConf.formatKey("org1", "abc"); key != "tyk_org1.abc" {
+		t.Error("Key format is wrong: ", key)
+	}
+
+	thisConf.DisableOrgPrefix = true
+	if key := thisConf.formatKey("org1", "abc"); key != "tyk_abc" {
+		t.Error("Org prefix should be disabled: ", key)
+	}
+
+	if (KeyGenerationConfig{}).IsCustom() {
+		t.Error("Default config should keep the UUID based keys")
+	}
+
+	if (KeyGenerationConfig{Charset: "unknown"}).getCharset() != keyCharsets["hex"] {
+		t.Error("Unknown charsets should fall back to hex")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys are written to Redis in transactions of at most this many keys
+const KEY_IMPORT_BATCH_SIZE = 1000
+
+// KeyImportRecord is an externally generated token and its session
+type KeyImportRecord struct {
+	Key     string       `json:"key"`
+	Session SessionState `json:"session"`
+}
+
+// KeyImportResult reports the outcome of an import, existing keys are skipped unless overwrite is set
+type KeyImportResult struct {
+	Status   string   `json:"status"`
+	Imported int      `json:"imported"`
+	Skipped  []string `json:"skipped"`
+	Errors   []string `json:"errors"`
+}
+
+// ParseKeyImportJSON reads a JSON list of key import records
+func ParseKeyImportJSON(r io.Reader) ([]KeyImportRecord, error) {
+	records := []KeyImportRecord{}
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// ParseKeyImportCSV reads a CSV file with a header row, the key column is required, the session column
+// can hold a JSON session and the policy_id, org_id and expires columns override its values
+func ParseKeyImportCSV(r io.Reader) ([]KeyImportRecord, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, header := range headers {
+		columns[strings.ToLower(strings.TrimSpace(header))] = i
+	}
+
+	if _, ok := columns["key"]; !ok {
+		return nil, errors.New("CSV import needs a key column")
+	}
+
+	getColumn := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	records := []KeyImportRecord{}
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		thisRecord := KeyImportRecord{Key: getColumn(row, "key")}
+		if sessionJSON := getColumn(row, "session"); sessionJSON != "" {
+			if err := json.Unmarshal([]byte(sessionJSON), &thisRecord.Session); err != nil {
+				return nil, errors.New("Invalid session on line " + strconv.Itoa(line) + ": " + err.Error())
+			}
+		}
+
+		if policyID := getColumn(row, "policy_id"); policyID != "" {
+			thisRecord.Session.ApplyPolicyID = policyID
+		}
+		if orgID := getColumn(row, "org_id"); orgID != "" {
+			thisRecord.Session.OrgID = orgID
+		}
+		if expires := getColumn(row, "expires"); expires != "" {
+			thisRecord.Session.Expires, err = strconv.ParseInt(expires, 10, 64)
+			if err != nil {
+				return nil, errors.New("Invalid expires on line " + strconv.Itoa(line))
+			}
+		}
+
+		records = append(records, thisRecord)
+	}
+
+	return records, nil
+}
+
+// SessionImporter is implemented by session managers that can write sessions in batches, existing
+// keys are only replaced if overwrite is set. The keys that were skipped because they exist are returned
+type SessionImporter interface {
+	ImportSessions(sessions map[string]SessionState, resetTTLTo int64, overwrite bool) ([]string, error)
+}
+
+// validateKeyImport drops records without a key or an expiry, or that are duplicated in the import
+func validateKeyImport(records []KeyImportRecord) (map[string]SessionState, []string) {
+	sessions := make(map[string]SessionState)
+	importErrors := []string{}
+	now := time.Now().Unix()
+
+	for i, thisRecord := range records {
+		if thisRecord.Key == "" {
+			importErrors = append(importErrors, "Record "+strconv.Itoa(i+1)+" has no key")
+			continue
+		}
+
+		if _, exists := sessions[thisRecord.Key]; exists {
+			importErrors = append(importErrors, "Duplicate key in import: "+thisRecord.Key)
+			continue
+		}
+
+		// Imported tokens were issued elsewhere, they must not become keys that never expire
+		if thisRecord.Session.Expires <= 0 {
+			importErrors = append(importErrors, "Key has no expiry: "+thisRecord.Key)
+			continue
+		}
+
+		if thisRecord.Session.Expires <= now {
+			importErrors = append(importErrors, "Key has expired: "+thisRecord.Key)
+			continue
+		}
+
+		if thisRecord.Session.State != "" && !IsValidKeyState(thisRecord.Session.State) {
+			importErrors = append(importErrors, "Key has an unknown state: "+thisRecord.Key)
+			continue
+		}
+
+		sessions[thisRecord.Key] = thisRecord.Session
+	}
+
+	return sessions, importErrors
+}
+
+// keyImportTarget is a session store keys are imported into, APIs that share a store share a target
+type keyImportTarget struct {
+	importer   SessionImporter
+	resetTTLTo int64
+	sessions   map[string]SessionState
+}
+
+// keyImportTargets groups the sessions by the session store of the APIs they give access to, like
+// keys created with the REST API, a key without access rights is added to all APIs if master keys
+// are allowed
+func keyImportTargets(specs map[string]*APISpec, sessions map[string]SessionState) (map[string]*keyImportTarget, []string) {
+	targets := make(map[string]*keyImportTarget)
+	importErrors := []string{}
+
+	for keyName, thisSession := range sessions {
+		keySpecs := []*APISpec{}
+		if len(thisSession.AccessRights) > 0 {
+			for apiID := range thisSession.AccessRights {
+				if spec, found := specs[apiID]; found {
+					keySpecs = append(keySpecs, spec)
+				}
+			}
+			if len(keySpecs) != len(thisSession.AccessRights) {
+				importErrors = append(importErrors, "Key gives access to an API that doesn't exist: "+keyName)
+				continue
+			}
+		} else if config.AllowMasterKeys {
+			for _, spec := range specs {
+				keySpecs = append(keySpecs, spec)
+			}
+		} else {
+			importErrors = append(importErrors, "Key has no access rights and master keys are not allowed: "+keyName)
+			continue
+		}
+
+		for _, spec := range keySpecs {
+			importer, ok := spec.SessionManager.(SessionImporter)
+			if !ok {
+				importErrors = append(importErrors, "The session store of API "+spec.APIID+" doesn't support imports, key not added to it: "+keyName)
+				continue
+			}
+
+			namespace := storageKeyNamespace(spec.SessionManager.GetStore())
+			thisTarget, found := targets[namespace]
+			if !found {
+				thisTarget = &keyImportTarget{importer: importer, resetTTLTo: spec.SessionLifetime, sessions: make(map[string]SessionState)}
+				targets[namespace] = thisTarget
+			}
+
+			// APIs sharing a store keep the key for the longest session lifetime, 0 keeps it forever
+			if thisTarget.resetTTLTo != 0 && (spec.SessionLifetime == 0 || spec.SessionLifetime > thisTarget.resetTTLTo) {
+				thisTarget.resetTTLTo = spec.SessionLifetime
+			}
+			thisTarget.sessions[keyName] = thisSession
+		}
+	}
+
+	return targets, importErrors
+}
+
+// ImportKeys loads the keys into the session stores of the APIs they give access to, in batches
+func ImportKeys(specs map[string]*APISpec, records []KeyImportRecord, overwrite bool) KeyImportResult {
+	sessions, importErrors := validateKeyImport(records)
+	targets, targetErrors := keyImportTargets(specs, sessions)
+	thisResult := KeyImportResult{Status: "ok", Skipped: []string{}, Errors: append(importErrors, targetErrors...)}
+
+	// A key is reported once, however many stores it is written to
+	imported := make(map[string]bool)
+	skipped := make(map[string]bool)
+	for _, thisTarget := range targets {
+		batch := make(map[string]SessionState)
+		flush := func() {
+			batchSkipped, err := thisTarget.importer.ImportSessions(batch, thisTarget.resetTTLTo, overwrite)
+			if err != nil {
+				log.Error("Key import batch failed: ", err)
+				thisResult.Errors = append(thisResult.Errors, "Batch failed: "+err.Error())
+				batch = make(map[string]SessionState)
+				return
+			}
+
+			for _, keyName := range batchSkipped {
+				skipped[keyName] = true
+				delete(batch, keyName)
+			}
+			for keyName := range batch {
+				imported[keyName] = true
+			}
+			batch = make(map[string]SessionState)
+		}
+
+		for keyName, thisSession := range thisTarget.sessions {
+			batch[keyName] = thisSession
+			if len(batch) >= KEY_IMPORT_BATCH_SIZE {
+				flush()
+			}
+		}
+		if len(batch) > 0 {
+			flush()
+		}
+	}
+
+	thisResult.Imported = len(imported)
+	for keyName := range skipped {
+		thisResult.Skipped = append(thisResult.Skipped, keyName)
+	}
+	sort.Strings(thisResult.Skipped)
+
+	if len(thisResult.Errors) > 0 {
+		thisResult.Status = "error"
+	}
+
+	log.Info("Imported ", thisResult.Imported, " keys, skipped ", len(thisResult.Skipped), " existing keys")
+	return thisResult
+}
+
+// loadKeyImportSpecs loads the API definitions for an import from the command line, their session
+// stores are set up the same way as when the gateway loads them
+func loadKeyImportSpecs() map[string]*APISpec {
+	keyStore := NewKeyStorageHandler("apikey-", config.HashKeys)
+	specs := make(map[string]*APISpec)
+
+	for _, spec := range getAPISpecs() {
+		thisSpec := spec
+		thisSpec.SessionManager.Init(specSessionStore(&thisSpec, specKeyStore(&thisSpec, keyStore)))
+		specs[thisSpec.APIID] = &thisSpec
+	}
+
+	return specs
+}
+
+// keyImportHandler accepts a JSON list (or a CSV file if the content type is text/csv) of keys to import,
+// set overwrite=1 to replace keys that already exist
+func keyImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	var records []KeyImportRecord
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		records, err = ParseKeyImportCSV(r.Body)
+	} else {
+		records, err = ParseKeyImportJSON(r.Body)
+	}
+
+	if err != nil {
+		DoJSONWrite(w, 400, createError("Couldn't decode import: "+err.Error()))
+		return
+	}
+
+	overwrite := r.FormValue("overwrite") == "1"
+	thisResult := ImportKeys(getApiSpecs(), records, overwrite)
+	if overwrite && thisResult.Imported > 0 {
+		notifyKeySpaceChanged("")
+	}
+	responseMessage, _ := json.Marshal(&thisResult)
+
+	code := 200
+	if thisResult.Status != "ok" {
+		code = 400
+	}
+	DoJSONWrite(w, code, responseMessage)
+}
+
+// handleKeyImportMode imports keys from the command line:
+// ./tyk --import-keys=keys.csv --conf=/etc/tyk/tyk.conf [--overwrite]
+func handleKeyImportMode(arguments map[string]interface{}) {
+	inputFile, _ := arguments["--import-keys"].(string)
+	confFile, _ := arguments["--conf"].(string)
+	if confFile == "" {
+		confFile = "/etc/tyk/tyk.conf"
+	}
+	loadConfig(confFile, &config)
+
+	importFile, err := os.Open(inputFile)
+	if err != nil {
+		log.Error("Couldn't open import file: ", err)
+		return
+	}
+	defer importFile.Close()
+
+	var records []KeyImportRecord
+	if strings.HasSuffix(strings.ToLower(inputFile), ".csv") {
+		records, err = ParseKeyImportCSV(importFile)
+	} else {
+		records, err = ParseKeyImportJSON(importFile)
+	}
+
+	if err != nil {
+		log.Error("Couldn't decode import file: ", err)
+		return
+	}
+
+	overwrite, _ := arguments["--overwrite"].(bool)
+	thisResult := ImportKeys(loadKeyImportSpecs(), records, overwrite)
+	for _, importErr := range thisResult.Errors {
+		log.Error(importErr)
+	}
+}
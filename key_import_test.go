@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseKeyImportCSV(t *testing.T) {
+	importCSV := `key,policy_id,expires,session
+abc123,gold,1893456000,
+def456,,,"{""rate"": 10, ""per"": 60, ""org_id"": ""org-1""}"
+`
+	records, err := ParseKeyImportCSV(strings.NewReader(importCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatal("Expected 2 records, got: ", len(records))
+	}
+
+	if records[0].Key != "abc123" || records[0].Session.ApplyPolicyID != "gold" || records[0].Session.Expires != 1893456000 {
+		t.Error("Policy record was not parsed: ", records[0])
+	}
+
+	if records[1].Session.Rate != 10 || records[1].Session.OrgID != "org-1" {
+		t.Error("Session column was not parsed: ", records[1].Session)
+	}
+
+	if _, err := ParseKeyImportCSV(strings.NewReader("token,policy_id\nabc,gold\n")); err == nil {
+		t.Error("CSV without a key column should fail")
+	}
+}
+
+func TestValidateKeyImport(t *testing.T) {
+	records, err := ParseKeyImportJSON(strings.NewReader(`[
+		{"key": "abc123", "session": {"rate": 10, "per": 60, "expires": 1893456000}},
+		{"key": "", "session": {"expires": 1893456000}},
+		{"key": "abc123", "session": {"rate": 20, "per": 60, "expires": 1893456000}},
+		{"key": "def456", "session": {"rate": 10, "per": 60}},
+		{"key": "ghi789", "session": {"rate": 10, "per": 60, "expires": 1262304000}},
+		{"key": "jkl012", "session": {"rate": 10, "per": 60, "expires": 1893456000, "state": "frozen"}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, importErrors := validateKeyImport(records)
+	if len(sessions) != 1 || len(importErrors) != 5 {
+		t.Error("Expected 1 valid key and 5 errors, got: ", len(sessions), importErrors)
+	}
+
+	if sessions["abc123"].Rate != 10 {
+		t.Error("First record for a key should be kept: ", sessions["abc123"])
+	}
+}
+
+// batchKeyStore is an in memory store that can write keys in batches
+type batchKeyStore struct {
+	*InMemoryStorageManager
+	prefix string
+}
+
+func (s batchKeyStore) KeyNamespace() string {
+	return s.prefix
+}
+
+func (s batchKeyStore) SetKeys(keys map[string]string, timeout int64, overwrite bool) ([]string, error) {
+	skipped := []string{}
+	for keyName, value := range keys {
+		if _, exists := s.Sessions[keyName]; exists && !overwrite {
+			skipped = append(skipped, keyName)
+			continue
+		}
+		s.Sessions[keyName] = value
+	}
+
+	return skipped, nil
+}
+
+func TestImportKeys(t *testing.T) {
+	sharedStore := batchKeyStore{&InMemoryStorageManager{Sessions: make(map[string]string)}, "apikey-"}
+	isolatedStore := batchKeyStore{&InMemoryStorageManager{Sessions: make(map[string]string)}, "tenant-a/apikey-"}
+
+	specs := make(map[string]*APISpec)
+	for apiID, store := range map[string]batchKeyStore{"api-1": sharedStore, "api-2": sharedStore, "api-3": isolatedStore} {
+		spec := &APISpec{SessionManager: &DefaultSessionManager{}}
+		spec.APIID = apiID
+		spec.SessionManager.Init(store)
+		specs[apiID] = spec
+	}
+
+	sharedStore.Sessions["existing"] = "{}"
+	records, err := ParseKeyImportJSON(strings.NewReader(`[
+		{"key": "abc123", "session": {"expires": 1893456000, "access_rights": {"api-1": {}, "api-2": {}, "api-3": {}}}},
+		{"key": "existing", "session": {"expires": 1893456000, "access_rights": {"api-1": {}}}},
+		{"key": "def456", "session": {"expires": 1893456000, "access_rights": {"api-9": {}}}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thisResult := ImportKeys(specs, records, false)
+	if thisResult.Imported != 1 || len(thisResult.Skipped) != 1 || thisResult.Skipped[0] != "existing" {
+		t.Error("Expected 1 imported and 1 skipped key, got: ", thisResult)
+	}
+
+	if len(thisResult.Errors) != 1 {
+		t.Error("Key for an unknown API should fail, got: ", thisResult.Errors)
+	}
+
+	if _, found := sharedStore.Sessions["abc123"]; !found {
+		t.Error("Key should be written to the shared session store")
+	}
+
+	if _, found := isolatedStore.Sessions["abc123"]; !found {
+		t.Error("Key should be written to the session store of the isolated API")
+	}
+
+	if sharedStore.Sessions["existing"] != "{}" {
+		t.Error("Existing key should not be overwritten")
+	}
+}
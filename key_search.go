@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const KEY_METADATA_INDEX_PREFIX string = "key-meta-index."
+
+// KeyMetadataIndexConfig lists the metadata fields keys can be searched by with /tyk/keys/search. Only
+// top level fields with a string, number or boolean value are indexed, keys are indexed when they are
+// written so keys created before the index was enabled are found once they are updated
+type KeyMetadataIndexConfig struct {
+	Enabled bool     `json:"enabled"`
+	Fields  []string `json:"fields"`
+}
+
+// keyIndexStore holds the index sets and, for every key, the entries it is indexed under
+type keyIndexStore interface {
+	StorageHandler
+	SetStorage
+}
+
+// KeyMetadataIndexer keeps a set of key names for every indexed metadata field and value. Keys are
+// listed the way the key store names them, hashed if hash_keys is enabled
+type KeyMetadataIndexer struct {
+	Store  keyIndexStore
+	Fields map[string]bool
+}
+
+// KeyMetadataIndex is set up in setupGlobals if key_metadata_index is enabled
+var KeyMetadataIndex *KeyMetadataIndexer
+
+func NewKeyMetadataIndexer(store keyIndexStore, fields []string) *KeyMetadataIndexer {
+	thisIndex := &KeyMetadataIndexer{Store: store, Fields: make(map[string]bool)}
+	for _, field := range fields {
+		thisIndex.Fields[field] = true
+	}
+
+	return thisIndex
+}
+
+// entries are the sorted field=value pairs of the metadata that are indexed
+func (i *KeyMetadataIndexer) entries(metaData interface{}) []string {
+	entries := []string{}
+	fields, ok := metaData.(map[string]interface{})
+	if !ok {
+		return entries
+	}
+
+	for field, value := range fields {
+		if !i.Fields[field] {
+			continue
+		}
+
+		switch value.(type) {
+		case string, bool, float64, int, int64, uint64:
+			entries = append(entries, field+"="+fmt.Sprint(value))
+		}
+	}
+	sort.Strings(entries)
+
+	return entries
+}
+
+func (i *KeyMetadataIndexer) setName(entry string) string {
+	return "meta." + entry
+}
+
+func (i *KeyMetadataIndexer) recordName(member string) string {
+	return "key." + member
+}
+
+// Update indexes a key under its current metadata and takes it out of the sets of values it no longer
+// has. Sessions read from the store whose metadata hasn't changed (e.g. after a rate limit update) are
+// skipped so the index costs nothing on the request path
+func (i *KeyMetadataIndexer) Update(keyName string, session *SessionState) error {
+	entries := i.entries(session.MetaData)
+	signature := strings.Join(entries, "\n")
+	if session.storedMetadataIndex != nil && *session.storedMetadataIndex == signature {
+		return nil
+	}
+
+	member := publicHash(keyName)
+	previous, _ := i.Store.GetKey(i.recordName(member))
+
+	current := make(map[string]bool)
+	for _, entry := range entries {
+		current[entry] = true
+		if err := i.Store.AddSetMember(i.setName(entry), member); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range strings.Split(previous, "\n") {
+		if entry != "" && !current[entry] {
+			i.Store.RemoveSetMember(i.setName(entry), member)
+		}
+	}
+
+	if len(entries) == 0 {
+		i.Store.DeleteKey(i.recordName(member))
+	} else if signature != previous {
+		if err := i.Store.SetKey(i.recordName(member), signature, 0); err != nil {
+			return err
+		}
+	}
+
+	session.storedMetadataIndex = &signature
+	return nil
+}
+
+// Remove takes a deleted key out of the index
+func (i *KeyMetadataIndexer) Remove(keyName string) {
+	i.removeMember(publicHash(keyName))
+}
+
+// removeMember takes a key out of the index by the name it is listed under, used when deleting by hash
+func (i *KeyMetadataIndexer) removeMember(member string) {
+	previous, err := i.Store.GetKey(i.recordName(member))
+	if err != nil {
+		return
+	}
+
+	for _, entry := range strings.Split(previous, "\n") {
+		if entry != "" {
+			i.Store.RemoveSetMember(i.setName(entry), member)
+		}
+	}
+	i.Store.DeleteKey(i.recordName(member))
+}
+
+// Search returns the keys that match all the filters, every filtered field must be indexed
+func (i *KeyMetadataIndexer) Search(filters map[string]string) ([]string, error) {
+	var found map[string]bool
+	for field, value := range filters {
+		if !i.Fields[field] {
+			return nil, fmt.Errorf("metadata field %s is not indexed", field)
+		}
+
+		members, err := i.Store.GetSetMembers(i.setName(field + "=" + value))
+		if err != nil {
+			return nil, err
+		}
+
+		matched := make(map[string]bool)
+		for _, member := range members {
+			if found == nil || found[member] {
+				matched[member] = true
+			}
+		}
+		found = matched
+	}
+
+	keys := []string{}
+	for member, _ := range found {
+		keys = append(keys, member)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// markMetadataStored remembers the indexed metadata of a session read from the store, so writing it
+// back unchanged doesn't touch the index
+func (s *SessionState) markMetadataStored() {
+	if KeyMetadataIndex == nil {
+		return
+	}
+
+	signature := strings.Join(KeyMetadataIndex.entries(s.MetaData), "\n")
+	s.storedMetadataIndex = &signature
+}
+
+// keySearchHandler finds keys by metadata, e.g. /tyk/keys/search?meta.plan=gold&meta.customer=acme
+func keySearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if KeyMetadataIndex == nil {
+		DoJSONWrite(w, 400, createError("Key metadata index is not enabled"))
+		return
+	}
+
+	filters := make(map[string]string)
+	for name, values := range r.URL.Query() {
+		if strings.HasPrefix(name, "meta.") && len(values) > 0 {
+			filters[strings.TrimPrefix(name, "meta.")] = values[0]
+		}
+	}
+
+	if len(filters) == 0 {
+		DoJSONWrite(w, 400, createError("Search needs at least one meta. filter"))
+		return
+	}
+
+	keys, err := KeyMetadataIndex.Search(filters)
+	if err != nil {
+		log.Error("Key search failed: ", err)
+		DoJSONWrite(w, 400, createError("Key search failed - "+err.Error()))
+		return
+	}
+
+	responseMessage, _ := json.Marshal(&APIAllKeys{keys})
+	DoJSONWrite(w, 200, responseMessage)
+}
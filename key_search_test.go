@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// setTestStore adds sets to the in-memory store
+type setTestStore struct {
+	InMemoryStorageManager
+	sets map[string]map[string]bool
+}
+
+func (s *setTestStore) AddSetMember(keyName string, member string) error {
+	if s.sets[keyName] == nil {
+		s.sets[keyName] = make(map[string]bool)
+	}
+	s.sets[keyName][member] = true
+	return nil
+}
+
+func (s *setTestStore) RemoveSetMember(keyName string, member string) error {
+	delete(s.sets[keyName], member)
+	return nil
+}
+
+func (s *setTestStore) GetSetMembers(keyName string) ([]string, error) {
+	members := []string{}
+	for member, _ := range s.sets[keyName] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func newTestKeyMetadataIndex() *setTestStore {
+	store := &setTestStore{InMemoryStorageManager: InMemoryStorageManager{Sessions: make(map[string]string)}, sets: make(map[string]map[string]bool)}
+	KeyMetadataIndex = NewKeyMetadataIndexer(store, []string{"plan", "customer"})
+	return store
+}
+
+func TestKeyMetadataIndexUpdate(t *testing.T) {
+	store := newTestKeyMetadataIndex()
+	defer func() { KeyMetadataIndex = nil }()
+
+	manager := DefaultSessionManager{Store: &InMemoryStorageManager{Sessions: make(map[string]string)}, IndexMetadata: true}
+
+	thisSession := createSampleSession()
+	thisSession.MetaData = map[string]interface{}{"plan": "gold", "customer": "acme", "notes": "not indexed"}
+	manager.UpdateSession("key-1", thisSession, 0)
+	thisSession.MetaData = map[string]interface{}{"plan": "silver", "customer": "acme"}
+	manager.UpdateSession("key-2", thisSession, 0)
+
+	keys, err := KeyMetadataIndex.Search(map[string]string{"customer": "acme"})
+	if err != nil || len(keys) != 2 {
+		t.Fatal("Both keys should belong to the customer: ", keys, err)
+	}
+
+	keys, _ = KeyMetadataIndex.Search(map[string]string{"customer": "acme", "plan": "gold"})
+	if len(keys) != 1 || keys[0] != "key-1" {
+		t.Error("Filters should be combined: ", keys)
+	}
+
+	if _, err := KeyMetadataIndex.Search(map[string]string{"notes": "not indexed"}); err == nil {
+		t.Error("Searching a field that isn't indexed should fail")
+	}
+
+	// Changing the plan moves the key
+	stored, _ := manager.GetSessionDetail("key-1")
+	stored.MetaData = map[string]interface{}{"plan": "silver", "customer": "acme"}
+	manager.UpdateSession("key-1", stored, 0)
+	if keys, _ := KeyMetadataIndex.Search(map[string]string{"plan": "gold"}); len(keys) != 0 {
+		t.Error("Key should have left its old plan: ", keys)
+	}
+
+	manager.RemoveSession("key-2")
+	keys, _ = KeyMetadataIndex.Search(map[string]string{"plan": "silver"})
+	if len(keys) != 1 || keys[0] != "key-1" {
+		t.Error("Deleted key should be removed from the index: ", keys)
+	}
+	if _, err := store.GetKey("key.key-2"); err == nil {
+		t.Error("Index record of the deleted key should be removed")
+	}
+}
+
+func TestKeyMetadataIndexSkipsUnchangedSessions(t *testing.T) {
+	store := newTestKeyMetadataIndex()
+	defer func() { KeyMetadataIndex = nil }()
+
+	manager := DefaultSessionManager{Store: &InMemoryStorageManager{Sessions: make(map[string]string)}, IndexMetadata: true}
+
+	thisSession := createSampleSession()
+	thisSession.MetaData = map[string]interface{}{"plan": "gold"}
+	manager.UpdateSession("key-1", thisSession, 0)
+
+	// Drop the index behind the manager's back, a rate limit update of the stored session mustn't touch it
+	delete(store.sets, "meta.plan=gold")
+	stored, _ := manager.GetSessionDetail("key-1")
+	stored.Allowance = 5
+	manager.UpdateSession("key-1", stored, 0)
+	if len(store.sets["meta.plan=gold"]) != 0 {
+		t.Error("Unchanged metadata shouldn't be reindexed")
+	}
+
+	orgManager := DefaultSessionManager{Store: &InMemoryStorageManager{Sessions: make(map[string]string)}}
+	orgManager.UpdateSession("org-1", thisSession, 0)
+	if keys, _ := KeyMetadataIndex.Search(map[string]string{"plan": "gold"}); len(keys) != 0 {
+		t.Error("Only API keys should be indexed: ", keys)
+	}
+}
+
+func TestKeySearchHandler(t *testing.T) {
+	newTestKeyMetadataIndex()
+	defer func() { KeyMetadataIndex = nil }()
+
+	thisSession := createSampleSession()
+	thisSession.MetaData = map[string]interface{}{"plan": "gold"}
+	KeyMetadataIndex.Update("key-1", &thisSession)
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/keys/search?meta.plan=gold", nil)
+	keySearchHandler(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatal("Search failed: ", recorder.Code, recorder.Body.String())
+	}
+
+	var found APIAllKeys
+	json.Unmarshal(recorder.Body.Bytes(), &found)
+	if len(found.APIKeys) != 1 || found.APIKeys[0] != "key-1" {
+		t.Error("Key wasn't found: ", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/tyk/keys/search", nil)
+	keySearchHandler(recorder, req)
+	if recorder.Code != 400 {
+		t.Error("Search without filters should be rejected, got: ", recorder.Code)
+	}
+}
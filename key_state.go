@@ -0,0 +1,62 @@
+package main
+
+// Key workflow states, a key with no state set is treated as active so existing keys keep working
+const (
+	KeyStatePending   string = "pending"
+	KeyStateActive    string = "active"
+	KeyStateSuspended string = "suspended"
+	KeyStateRevoked   string = "revoked"
+)
+
+// keyStateTransitions lists the states a key can be moved to from each state, revoked is final
+var keyStateTransitions = map[string][]string{
+	KeyStatePending:   []string{KeyStateActive, KeyStateRevoked},
+	KeyStateActive:    []string{KeyStateSuspended, KeyStateRevoked},
+	KeyStateSuspended: []string{KeyStateActive, KeyStateRevoked},
+	KeyStateRevoked:   []string{},
+}
+
+// GetKeyState returns the workflow state of the session
+func (s *SessionState) GetKeyState() string {
+	if s.State == "" {
+		return KeyStateActive
+	}
+
+	return s.State
+}
+
+// IsValidKeyState checks that the state is one we know about
+func IsValidKeyState(state string) bool {
+	_, found := keyStateTransitions[state]
+	return found
+}
+
+// IsValidKeyStateTransition checks if a key can be moved from one state to another
+func IsValidKeyStateTransition(from string, to string) bool {
+	allowed, found := keyStateTransitions[from]
+	if !found {
+		return false
+	}
+
+	for _, state := range allowed {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeyStateErrorMessage is the message returned to clients using a key that isn't active
+func KeyStateErrorMessage(state string) string {
+	switch state {
+	case KeyStatePending:
+		return "Key is pending activation"
+	case KeyStateSuspended:
+		return "Key has been suspended"
+	case KeyStateRevoked:
+		return "Key has been revoked"
+	}
+
+	return "Key is not active"
+}
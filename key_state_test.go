@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestKeyStateTransitions(t *testing.T) {
+	tests := []struct {
+		from     string
+		to       string
+		expected bool
+	}{
+		{KeyStatePending, KeyStateActive, true},
+		{KeyStatePending, KeyStateSuspended, false},
+		{KeyStateActive, KeyStateSuspended, true},
+		{KeyStateActive, KeyStatePending, false},
+		{KeyStateSuspended, KeyStateActive, true},
+		{KeyStateSuspended, KeyStateRevoked, true},
+		{KeyStateRevoked, KeyStateActive, false},
+		{"frozen", KeyStateActive, false},
+		{KeyStateActive, "frozen", false},
+	}
+
+	for _, test := range tests {
+		if IsValidKeyStateTransition(test.from, test.to) != test.expected {
+			t.Error("Moving a key from ", test.from, " to ", test.to, " should be allowed: ", test.expected)
+		}
+	}
+}
+
+func TestKeyStateDefaultsToActive(t *testing.T) {
+	thisSession := SessionState{}
+	if thisSession.GetKeyState() != KeyStateActive {
+		t.Error("Keys without a state should be active, got: ", thisSession.GetKeyState())
+	}
+
+	thisSession.State = KeyStateSuspended
+	if thisSession.GetKeyState() != KeyStateSuspended {
+		t.Error("Key state not returned, got: ", thisSession.GetKeyState())
+	}
+}
+
+func TestKeyStateChangeValidation(t *testing.T) {
+	if _, code := handleKeyStateChange("", "1", KeyStateSuspended); code != 400 {
+		t.Error("A state change without a key should be rejected, got: ", code)
+	}
+
+	if _, code := handleKeyStateChange("abc123", "1", "frozen"); code != 400 {
+		t.Error("An unknown state should be rejected, got: ", code)
+	}
+
+	if _, code := handleGetKeyState("", "1"); code != 400 {
+		t.Error("Getting the state without a key should be rejected, got: ", code)
+	}
+}
+
+func TestAddKeyWithUnknownState(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/tyk/keys/abc123", strings.NewReader(`{"rate": 10, "per": 60, "state": "frozen"}`))
+	responseMessage, code := handleAddOrUpdate("abc123", req)
+	if code != 400 {
+		t.Error("Keys with an unknown state should be rejected, got: ", code, " ", string(responseMessage))
+	}
+}
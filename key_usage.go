@@ -0,0 +1,257 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	KEY_LAST_USED_PREFIX             = "key-last-used."
+	KEY_USAGE_DEFAULT_FLUSH_INTERVAL = 10
+	KEY_REAPER_DEFAULT_INTERVAL      = 3600
+	KEY_USAGE_DEFAULT_RETENTION_DAYS = 90
+	KEY_REAPER_SCAN_BATCH_SIZE       = 1000
+)
+
+// BatchKeyStorage is implemented by stores that can write several keys in one round trip
+type BatchKeyStorage interface {
+	SetKeys(keys map[string]string, timeout int64, overwrite bool) ([]string, error)
+}
+
+// KeyUsageTracker records when each key was last used. Uses are kept in memory and written in
+// batches by the flush loop, so tracking doesn't add a Redis write to every request. Entries expire
+// TTL seconds after the last use, so the entries of deleted keys don't build up
+type KeyUsageTracker struct {
+	sync.Mutex
+	Store   StorageHandler
+	TTL     int64
+	pending map[string]int64
+}
+
+// KeyUsage is only set if key usage tracking is enabled
+var KeyUsage *KeyUsageTracker
+
+func NewKeyUsageTracker(store StorageHandler, ttl int64) *KeyUsageTracker {
+	return &KeyUsageTracker{Store: store, TTL: ttl, pending: make(map[string]int64)}
+}
+
+// keyUsageTTL keeps the entries long enough for the reaper to find idle keys, or for
+// KEY_USAGE_DEFAULT_RETENTION_DAYS if the reaper is off
+func keyUsageTTL(reapAfterDays int, reaperInterval int) int64 {
+	if reapAfterDays <= 0 {
+		return KEY_USAGE_DEFAULT_RETENTION_DAYS * 24 * 3600
+	}
+
+	if reaperInterval < 1 {
+		reaperInterval = KEY_REAPER_DEFAULT_INTERVAL
+	}
+
+	return int64(reapAfterDays)*24*3600 + 2*int64(reaperInterval)
+}
+
+// Touch marks a key as used now
+func (k *KeyUsageTracker) Touch(keyName string) {
+	if keyName == "" {
+		return
+	}
+
+	k.Lock()
+	k.pending[keyName] = time.Now().Unix()
+	k.Unlock()
+}
+
+// LastUsed returns when a key was last used, 0 if it has never been seen
+func (k *KeyUsageTracker) LastUsed(keyName string) int64 {
+	k.Lock()
+	lastUsed, found := k.pending[keyName]
+	k.Unlock()
+	if found {
+		return lastUsed
+	}
+
+	value, err := k.Store.GetKey(keyName)
+	if err != nil {
+		return 0
+	}
+
+	lastUsed, _ = strconv.ParseInt(value, 10, 64)
+	return lastUsed
+}
+
+// Flush writes the pending uses to the store
+func (k *KeyUsageTracker) Flush() {
+	k.Lock()
+	pending := k.pending
+	k.pending = make(map[string]int64)
+	k.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	values := make(map[string]string, len(pending))
+	for keyName, lastUsed := range pending {
+		values[keyName] = strconv.FormatInt(lastUsed, 10)
+	}
+
+	if batchStore, ok := k.Store.(BatchKeyStorage); ok {
+		if _, err := batchStore.SetKeys(values, k.TTL, true); err != nil {
+			log.Error("Failed to write key usage: ", err)
+		}
+		return
+	}
+
+	for keyName, value := range values {
+		if err := k.Store.SetKey(keyName, value, k.TTL); err != nil {
+			log.Error("Failed to write key usage: ", err)
+		}
+	}
+}
+
+// StartFlushLoop periodically writes key uses to the store
+func (k *KeyUsageTracker) StartFlushLoop(interval int) {
+	if interval < 1 {
+		interval = KEY_USAGE_DEFAULT_FLUSH_INTERVAL
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		k.Flush()
+	}
+}
+
+// trackNewKey starts the idle time of a new key, keys that are updated keep their last use
+func trackNewKey(keyName string) {
+	if KeyUsage != nil && KeyUsage.LastUsed(keyName) == 0 {
+		KeyUsage.Touch(keyName)
+	}
+}
+
+// apiSessionStores returns the session stores of the loaded APIs, APIs that share a store are only
+// listed once
+func apiSessionStores() []StorageHandler {
+	stores := []StorageHandler{}
+	namespaces := make(map[string]bool)
+	for _, spec := range getApiSpecs() {
+		store := spec.SessionManager.GetStore()
+		namespace := storageKeyNamespace(store)
+		if !namespaces[namespace] {
+			namespaces[namespace] = true
+			stores = append(stores, store)
+		}
+	}
+
+	return stores
+}
+
+// scanKeyUsage calls fn with the stored entries in batches, stores that can't walk their keys are
+// read in one go
+func (k *KeyUsageTracker) scanKeyUsage(fn func(map[string]string)) error {
+	if scanStore, ok := k.Store.(ScanKeyStorage); ok {
+		return scanStore.ScanKeysAndValues(KEY_REAPER_SCAN_BATCH_SIZE, fn)
+	}
+
+	fn(k.Store.GetKeysAndValues())
+	return nil
+}
+
+// ReapStaleKeys deletes the keys that haven't been used for maxIdleDays from the session stores and
+// fires a KeyReaped event on each API the key had access to. Entries are stored by the key's public
+// hash (see publicHash) so keys are removed by it. It returns the number of keys that were deleted
+func (k *KeyUsageTracker) ReapStaleKeys(sessionStores []StorageHandler, maxIdleDays int) int {
+	k.Flush()
+
+	cutOff := time.Now().Add(-time.Duration(maxIdleDays) * 24 * time.Hour).Unix()
+	reaped := 0
+	err := k.scanKeyUsage(func(entries map[string]string) {
+		for storedKey, value := range entries {
+			lastUsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || lastUsed > cutOff {
+				continue
+			}
+
+			if k.reapKey(sessionStores, storedKey, lastUsed) {
+				reaped++
+			}
+		}
+	})
+	if err != nil {
+		log.Error("Key reaper couldn't read key usage: ", err)
+	}
+
+	return reaped
+}
+
+// reapKey deletes an idle key from every session store it is in
+func (k *KeyUsageTracker) reapKey(sessionStores []StorageHandler, storedKey string, lastUsed int64) bool {
+	k.Store.DeleteRawKey(KEY_LAST_USED_PREFIX + storedKey)
+
+	// Events and logs never carry the raw key, even if keys aren't hashed in the store
+	keyHash := storedKey
+	if !config.HashKeys {
+		keyHash = doHash(storedKey)
+	}
+
+	var sessionJSON string
+	found := false
+	for _, sessionStore := range sessionStores {
+		sessionKey := storedKey
+		if hashedStore, ok := sessionStore.(HashedKeyStorage); ok {
+			sessionKey = hashedStore.HashedKeyName(storedKey)
+		}
+
+		thisSessionJSON, err := sessionStore.GetRawKey(sessionKey)
+		if err != nil {
+			// Already deleted
+			continue
+		}
+
+		sessionStore.DeleteRawKey(sessionKey)
+		sessionJSON = thisSessionJSON
+		found = true
+	}
+
+	if !found {
+		return false
+	}
+
+	if KeyMetadataIndex != nil {
+		KeyMetadataIndex.removeMember(storedKey)
+	}
+	notifyKeySpaceChanged(storedKey)
+
+	log.Info("Reaped key unused since ", time.Unix(lastUsed, 0), ": ", keyHash)
+
+	thisSession := SessionState{}
+	if err := decodeSession(sessionJSON, &thisSession); err != nil {
+		return true
+	}
+
+	for APIID, _ := range thisSession.AccessRights {
+		if thisSpec := GetSpecForApi(APIID); thisSpec != nil {
+			go thisSpec.FireEvent(EVENT_KeyReaped,
+				EVENT_KeyReapedMeta{
+					EventMetaDefault: EventMetaDefault{Message: "Key was deleted as it hasn't been used."},
+					KeyHash:          keyHash,
+					LastUsed:         lastUsed,
+				})
+		}
+	}
+
+	return true
+}
+
+// StartReaperLoop periodically reaps stale keys from the session stores of the loaded APIs
+func (k *KeyUsageTracker) StartReaperLoop(maxIdleDays int, interval int) {
+	if interval < 1 {
+		interval = KEY_REAPER_DEFAULT_INTERVAL
+	}
+
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		if reaped := k.ReapStaleKeys(apiSessionStores(), maxIdleDays); reaped > 0 {
+			log.Info("Key reaper deleted ", reaped, " stale key(s)")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyUsageTracker(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	tracker := NewKeyUsageTracker(store, 3600)
+
+	if tracker.LastUsed("key") != 0 {
+		t.Error("Unused key should have no last use")
+	}
+
+	tracker.Touch("key")
+	if _, found := store.Sessions["key"]; found {
+		t.Error("Uses should only be written when flushed")
+	}
+
+	tracker.Flush()
+	lastUsed := tracker.LastUsed("key")
+	if lastUsed == 0 || store.Sessions["key"] != strconv.FormatInt(lastUsed, 10) {
+		t.Error("Last use was not flushed: ", store.Sessions)
+	}
+}
+
+func TestReapStaleKeys(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	sessionStore := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	tracker := NewKeyUsageTracker(store, 3600)
+
+	store.Sessions["stale"] = strconv.FormatInt(time.Now().AddDate(0, 0, -40).Unix(), 10)
+	store.Sessions["fresh"] = strconv.FormatInt(time.Now().AddDate(0, 0, -5).Unix(), 10)
+	sessionStore.Sessions["stale"] = `{"rate": 10}`
+	sessionStore.Sessions["fresh"] = `{"rate": 10}`
+
+	if reaped := tracker.ReapStaleKeys([]StorageHandler{sessionStore}, 30); reaped != 1 {
+		t.Error("Expected one key to be reaped, got: ", reaped)
+	}
+
+	if _, found := sessionStore.Sessions["stale"]; found {
+		t.Error("Stale key was not deleted")
+	}
+
+	if _, found := sessionStore.Sessions["fresh"]; !found {
+		t.Error("Fresh key should not be deleted")
+	}
+}
+
+func TestKeyUsageTTL(t *testing.T) {
+	if ttl := keyUsageTTL(0, 0); ttl != KEY_USAGE_DEFAULT_RETENTION_DAYS*24*3600 {
+		t.Error("Entries should be kept for the default retention without the reaper, got: ", ttl)
+	}
+
+	// Entries must outlive the idle time until the reaper has run
+	if ttl := keyUsageTTL(30, 3600); ttl != 30*24*3600+7200 {
+		t.Error("Entries should be kept until the reaper has seen them, got: ", ttl)
+	}
+}
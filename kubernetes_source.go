@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// API definitions can be read from Kubernetes, either from ConfigMaps (every entry of the data
+// section is a definition) or from TykAPIDefinition custom resources (the spec is the definition).
+// The gateway watches the namespace and reloads when a definition is added, changed or removed
+const (
+	KUBERNETES_SOURCE_CONFIGMAP = "configmap"
+	KUBERNETES_SOURCE_CRD       = "crd"
+
+	KUBERNETES_DEFAULT_LABEL_SELECTOR = "tyk.io/api-definition=true"
+	KUBERNETES_CRD_GROUP              = "tyk.io"
+	KUBERNETES_CRD_VERSION            = "v1alpha1"
+	KUBERNETES_CRD_PLURAL             = "tykapidefinitions"
+
+	KUBERNETES_SERVICE_ACCOUNT_DIR = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	KUBERNETES_WATCH_RETRY         = 5
+)
+
+type KubernetesSourceConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Kind          string `json:"kind"`
+	Namespace     string `json:"namespace"`
+	LabelSelector string `json:"label_selector"`
+	APIServer     string `json:"api_server"`
+	TokenFile     string `json:"token_file"`
+	CAFile        string `json:"ca_file"`
+}
+
+// kubernetesObjectList is the part of a ConfigMapList or a TykAPIDefinitionList that is used
+type kubernetesObjectList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesObject `json:"items"`
+}
+
+type kubernetesObject struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]string `json:"data"`
+	Spec json.RawMessage   `json:"spec"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+func IsValidKubernetesSourceKind(kind string) bool {
+	return kind == "" || kind == KUBERNETES_SOURCE_CONFIGMAP || kind == KUBERNETES_SOURCE_CRD
+}
+
+// apiServer is the address of the Kubernetes API, when tyk runs in a pod it is found from the
+// environment of the service account
+func (k KubernetesSourceConfig) apiServer() string {
+	if k.APIServer != "" {
+		return strings.TrimRight(k.APIServer, "/")
+	}
+
+	return "https://" + os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT")
+}
+
+func (k KubernetesSourceConfig) namespace() string {
+	if k.Namespace != "" {
+		return k.Namespace
+	}
+
+	namespace, err := ioutil.ReadFile(KUBERNETES_SERVICE_ACCOUNT_DIR + "namespace")
+	if err != nil {
+		return "default"
+	}
+
+	return strings.TrimSpace(string(namespace))
+}
+
+func (k KubernetesSourceConfig) listPath() string {
+	if k.Kind == KUBERNETES_SOURCE_CRD {
+		return "/apis/" + KUBERNETES_CRD_GROUP + "/" + KUBERNETES_CRD_VERSION + "/namespaces/" + k.namespace() + "/" + KUBERNETES_CRD_PLURAL
+	}
+
+	return "/api/v1/namespaces/" + k.namespace() + "/configmaps"
+}
+
+func (k KubernetesSourceConfig) query(watch bool, resourceVersion string) string {
+	values := url.Values{}
+	if k.Kind != KUBERNETES_SOURCE_CRD {
+		labelSelector := k.LabelSelector
+		if labelSelector == "" {
+			labelSelector = KUBERNETES_DEFAULT_LABEL_SELECTOR
+		}
+		values.Set("labelSelector", labelSelector)
+	} else if k.LabelSelector != "" {
+		values.Set("labelSelector", k.LabelSelector)
+	}
+
+	if watch {
+		values.Set("watch", "true")
+		values.Set("resourceVersion", resourceVersion)
+	}
+
+	return values.Encode()
+}
+
+// kubernetesRequest sets up a request to the API server with the service account token
+func kubernetesRequest(k KubernetesSourceConfig, watch bool, resourceVersion string) (*http.Client, *http.Request, error) {
+	req, err := http.NewRequest("GET", k.apiServer()+k.listPath()+"?"+k.query(watch, resourceVersion), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokenFile := k.TokenFile
+	if tokenFile == "" {
+		tokenFile = KUBERNETES_SERVICE_ACCOUNT_DIR + "token"
+	}
+	if token, err := ioutil.ReadFile(tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	tlsConfig := &tls.Config{}
+	caFile := k.CAFile
+	if caFile == "" {
+		caFile = KUBERNETES_SERVICE_ACCOUNT_DIR + "ca.crt"
+	}
+	if caCert, err := ioutil.ReadFile(caFile); err == nil {
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(caCert)
+		tlsConfig.RootCAs = certPool
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	if !watch {
+		client.Timeout = 30 * time.Second
+	}
+
+	return client, req, nil
+}
+
+// getKubernetesDefinitions lists the definitions in the namespace and returns them with the
+// resource version to watch from
+func getKubernetesDefinitions(k KubernetesSourceConfig) ([][]byte, string, error) {
+	client, req, err := kubernetesRequest(k, false, "")
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", errors.New("Kubernetes API returned " + resp.Status + ": " + string(body))
+	}
+
+	var objectList kubernetesObjectList
+	if err := json.Unmarshal(body, &objectList); err != nil {
+		return nil, "", err
+	}
+
+	definitions := [][]byte{}
+	for _, thisObject := range objectList.Items {
+		if k.Kind == KUBERNETES_SOURCE_CRD {
+			if len(thisObject.Spec) > 0 {
+				definitions = append(definitions, thisObject.Spec)
+			}
+			continue
+		}
+
+		for entryName, entry := range thisObject.Data {
+			log.Debug("Found API definition ", thisObject.Metadata.Name, "/", entryName)
+			definitions = append(definitions, []byte(entry))
+		}
+	}
+
+	return definitions, objectList.Metadata.ResourceVersion, nil
+}
+
+// lastKubernetesDefinitions are the definitions of the last successful list, they are used if
+// the API server can't be reached during a reload
+var lastKubernetesDefinitions [][]byte
+
+// LoadDefinitionsFromKubernetes reads API definitions from the ConfigMaps or custom resources in a
+// namespace
+func (a *APIDefinitionLoader) LoadDefinitionsFromKubernetes(k KubernetesSourceConfig) []APISpec {
+	var APISpecs = []APISpec{}
+
+	definitions, _, err := getKubernetesDefinitions(k)
+	if err != nil {
+		log.Error("Couldn't load API definitions from Kubernetes: ", err)
+		if lastKubernetesDefinitions == nil {
+			return APISpecs
+		}
+		log.Warning("Using the last known Kubernetes API definitions")
+		definitions = lastKubernetesDefinitions
+	}
+	lastKubernetesDefinitions = definitions
+
+	for _, thisDefinition := range definitions {
+		thisAppConfig, thisRawConfig := a.ParseDefinition(thisDefinition)
+		if thisAppConfig.APIID == "" {
+			log.Error("Skipping Kubernetes API definition without an api_id")
+			continue
+		}
+
+		thisAppConfig.RawData = thisRawConfig // Lets keep a copy for plugable modules
+		newAppSpec := a.MakeSpec(thisAppConfig)
+		APISpecs = append(APISpecs, newAppSpec)
+	}
+
+	return APISpecs
+}
+
+// watchKubernetesDefinitions blocks until the watch ends, onChange is called for every definition
+// that is added, changed or removed. It returns the last resource version that was seen so the
+// watch can be resumed, or an empty version if the namespace has to be listed again
+func watchKubernetesDefinitions(k KubernetesSourceConfig, resourceVersion string, onChange func()) (string, error) {
+	client, req, err := kubernetesRequest(k, true, resourceVersion)
+	if err != nil {
+		return resourceVersion, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", errors.New("Kubernetes API returned " + resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var thisEvent kubernetesWatchEvent
+		if err := decoder.Decode(&thisEvent); err != nil {
+			if err == io.EOF {
+				// The API server closes watches after a while
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+
+		switch thisEvent.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var thisObject kubernetesObject
+			if err := json.Unmarshal(thisEvent.Object, &thisObject); err == nil {
+				resourceVersion = thisObject.Metadata.ResourceVersion
+			}
+
+			log.Info("Kubernetes API definitions changed (", thisObject.Metadata.Name, " ", strings.ToLower(thisEvent.Type), "), reloading")
+			onChange()
+		case "ERROR":
+			// Usually the resource version is too old, changes may have been missed
+			return "", errors.New("watch failed: " + string(thisEvent.Object))
+		}
+	}
+}
+
+// StartKubernetesSource watches the namespace for changes to API definitions, if the watch can't
+// be resumed the namespace is listed again and the APIs are reloaded in case changes were missed
+func StartKubernetesSource() {
+	go func() {
+		resourceVersion := ""
+		firstList := true
+		for {
+			if resourceVersion == "" {
+				_, listVersion, err := getKubernetesDefinitions(config.KubernetesSource)
+				if err != nil {
+					log.Error("Couldn't list Kubernetes API definitions: ", err)
+					time.Sleep(KUBERNETES_WATCH_RETRY * time.Second)
+					continue
+				}
+
+				if !firstList {
+					ReloadURLStructure()
+				}
+				firstList = false
+				resourceVersion = listVersion
+			}
+
+			var err error
+			resourceVersion, err = watchKubernetesDefinitions(config.KubernetesSource, resourceVersion, ReloadURLStructure)
+			if err != nil {
+				log.Warning("Kubernetes watch ended: ", err)
+				time.Sleep(KUBERNETES_WATCH_RETRY * time.Second)
+			}
+		}
+	}()
+}
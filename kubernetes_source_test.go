@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoadDefinitionsFromKubernetesConfigMaps(t *testing.T) {
+	configMapList := map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "42"},
+		"items": []interface{}{
+			map[string]interface{}{
+				"metadata": map[string]interface{}{"name": "apis"},
+				"data":     map[string]interface{}{"maintenance.json": maintenanceDefinition},
+			},
+		},
+	}
+
+	var labelSelector string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/gateway/configmaps" {
+			w.WriteHeader(404)
+			return
+		}
+		labelSelector = r.URL.Query().Get("labelSelector")
+		json.NewEncoder(w).Encode(configMapList)
+	}))
+	defer server.Close()
+
+	k := KubernetesSourceConfig{Enabled: true, Namespace: "gateway", APIServer: server.URL}
+	definitions, resourceVersion, err := getKubernetesDefinitions(k)
+	if err != nil || len(definitions) != 1 || resourceVersion != "42" {
+		t.Fatal("ConfigMaps weren't listed: ", len(definitions), resourceVersion, err)
+	}
+	if labelSelector != KUBERNETES_DEFAULT_LABEL_SELECTOR {
+		t.Error("Default label selector not used: ", labelSelector)
+	}
+
+	thisAPILoader := APIDefinitionLoader{}
+	specs := thisAPILoader.LoadDefinitionsFromKubernetes(k)
+	if len(specs) != 1 || specs[0].APIID != "maintenance1" {
+		t.Fatal("API definition wasn't loaded: ", specs)
+	}
+
+	// The last known definitions are kept if the API server goes away
+	server.Close()
+	specs = thisAPILoader.LoadDefinitionsFromKubernetes(k)
+	if len(specs) != 1 {
+		t.Error("Last known definitions should be used: ", specs)
+	}
+}
+
+func TestLoadDefinitionsFromKubernetesCRD(t *testing.T) {
+	crdList := `{"metadata": {"resourceVersion": "7"}, "items": [{"metadata": {"name": "maintenance"}, "spec": ` + maintenanceDefinition + `}]}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/tyk.io/v1alpha1/namespaces/gateway/tykapidefinitions" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(crdList))
+	}))
+	defer server.Close()
+
+	k := KubernetesSourceConfig{Enabled: true, Kind: KUBERNETES_SOURCE_CRD, Namespace: "gateway", APIServer: server.URL}
+	definitions, _, err := getKubernetesDefinitions(k)
+	if err != nil || len(definitions) != 1 {
+		t.Fatal("Custom resources weren't listed: ", len(definitions), err)
+	}
+
+	thisAppConfig, _ := (&APIDefinitionLoader{}).ParseDefinition(definitions[0])
+	if thisAppConfig.APIID != "maintenance1" {
+		t.Error("Spec should be the API definition: ", thisAppConfig.APIID)
+	}
+}
+
+func TestWatchKubernetesDefinitions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" || r.URL.Query().Get("resourceVersion") != "42" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"type": "MODIFIED", "object": {"metadata": {"name": "apis", "resourceVersion": "43"}}}` + "\n"))
+		w.Write([]byte(`{"type": "DELETED", "object": {"metadata": {"name": "apis", "resourceVersion": "44"}}}` + "\n"))
+	}))
+	defer server.Close()
+
+	k := KubernetesSourceConfig{Enabled: true, Namespace: "gateway", APIServer: server.URL}
+	changes := 0
+	resourceVersion, err := watchKubernetesDefinitions(k, "42", func() { changes++ })
+	if err != nil || changes != 2 || resourceVersion != "44" {
+		t.Error("Watch events weren't handled: ", changes, resourceVersion, err)
+	}
+
+	resourceVersion, err = watchKubernetesDefinitions(k, "1", func() { changes++ })
+	if err == nil || resourceVersion != "" {
+		t.Error("Failed watches should list again: ", resourceVersion, err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Latency histograms use the layout of an HDR histogram with 5 bits of precision: latencies under
+// 64ms have a bucket each, above that every power of two is split into 32 buckets so values are
+// kept within ~3%. Buckets are keyed by their index as a string so the counts flushed by each node
+// stay small JSON objects that are merged by adding them up
+const (
+	latencySubBuckets     = 32
+	latencyExactBuckets   = 2 * latencySubBuckets
+	latencySubBucketsBits = 5
+)
+
+// latencyBucket returns the index of the bucket a latency in milliseconds is counted in
+func latencyBucket(latency int64) int {
+	if latency < 0 {
+		latency = 0
+	}
+	if latency < latencyExactBuckets {
+		return int(latency)
+	}
+
+	bits := uint(0)
+	for v := latency; v > 0; v >>= 1 {
+		bits++
+	}
+
+	shift := bits - latencySubBucketsBits - 1
+	subBucket := int(latency >> shift)
+	return latencyExactBuckets + int(shift-1)*latencySubBuckets + subBucket - latencySubBuckets
+}
+
+// latencyBucketValue is the latency a bucket stands for, the middle of its range
+func latencyBucketValue(bucket int) float64 {
+	if bucket < latencyExactBuckets {
+		return float64(bucket)
+	}
+
+	shift := uint((bucket-latencyExactBuckets)/latencySubBuckets + 1)
+	subBucket := int64((bucket-latencyExactBuckets)%latencySubBuckets + latencySubBuckets)
+	lowest := subBucket << shift
+	highest := ((subBucket + 1) << shift) - 1
+
+	return float64(lowest+highest) / 2
+}
+
+// latencyPercentiles returns the latency below which each of the percentiles of the counted requests
+// fall, percentiles are between 0 and 100
+func latencyPercentiles(buckets map[string]int64, percentiles ...float64) []float64 {
+	values := make([]float64, len(percentiles))
+
+	var total int64
+	indexes := []int{}
+	counts := make(map[int]int64, len(buckets))
+	for bucketID, count := range buckets {
+		bucket, err := strconv.Atoi(bucketID)
+		if err != nil || count <= 0 {
+			continue
+		}
+		indexes = append(indexes, bucket)
+		counts[bucket] = count
+		total += count
+	}
+
+	if total == 0 {
+		return values
+	}
+	sort.Ints(indexes)
+
+	for i, percentile := range percentiles {
+		rank := int64(math.Ceil(percentile / 100 * float64(total)))
+		if rank < 1 {
+			rank = 1
+		}
+
+		var seen int64
+		for _, bucket := range indexes {
+			seen += counts[bucket]
+			if seen >= rank {
+				values[i] = latencyBucketValue(bucket)
+				break
+			}
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestLatencyBucketPrecision(t *testing.T) {
+	lastBucket := -1
+	for _, latency := range []int64{0, 1, 63, 64, 65, 127, 128, 1000, 4095, 4096, 60000, 3600000} {
+		bucket := latencyBucket(latency)
+		if bucket < lastBucket {
+			t.Fatal("Buckets should grow with the latency: ", latency, bucket)
+		}
+		lastBucket = bucket
+
+		value := latencyBucketValue(bucket)
+		if math.Abs(value-float64(latency)) > float64(latency)*0.032 {
+			t.Error("Bucket value is too far from the latency: ", latency, value)
+		}
+	}
+
+	if latencyBucket(10) == latencyBucket(11) {
+		t.Error("Short latencies should be counted exactly")
+	}
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	buckets := make(map[string]int64)
+	for latency := int64(1); latency <= 100; latency++ {
+		buckets[strconv.Itoa(latencyBucket(latency))]++
+	}
+	// A slow tail
+	buckets[strconv.Itoa(latencyBucket(5000))] += 2
+
+	percentiles := latencyPercentiles(buckets, 50, 95, 99, 100)
+	if percentiles[0] < 50 || percentiles[0] > 53 {
+		t.Error("p50 is wrong: ", percentiles[0])
+	}
+	if percentiles[1] < 96 || percentiles[1] > 99 {
+		t.Error("p95 is wrong: ", percentiles[1])
+	}
+	if percentiles[2] < 4900 || percentiles[3] < 4900 {
+		t.Error("p99 should be in the slow tail: ", percentiles[2], percentiles[3])
+	}
+
+	if empty := latencyPercentiles(nil, 50); empty[0] != 0 {
+		t.Error("No requests should have no latency")
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+)
+
+// Analytics tags of requests that broke a limit in monitor only mode
+const (
+	LIMIT_MONITOR_RATE_TAG  = "monitored-rate-limit-exceeded"
+	LIMIT_MONITOR_QUOTA_TAG = "monitored-quota-exceeded"
+)
+
+// LimitEnforcementConfig lets new rate limits and quotas be tried against real traffic: with MonitorOnly
+// set, requests over a limit still fire the exceeded events and are tagged in analytics, but they are
+// let through. A policy or key can be put in monitor only mode with monitor_only_limits instead
+type LimitEnforcementConfig struct {
+	MonitorOnly bool `mapstructure:"monitor_only" bson:"monitor_only" json:"monitor_only"`
+}
+
+// limitsMonitorOnly is true if violations of the session's limits shouldn't block the request
+func limitsMonitorOnly(thisConfig LimitEnforcementConfig, thisSessionState *SessionState) bool {
+	return thisConfig.MonitorOnly || thisSessionState.MonitorOnlyLimits
+}
+
+// addLimitViolationTag records a violation that was let through so RecordHit can tag the request
+func addLimitViolationTag(r *http.Request, tag string) {
+	tags, _ := context.Get(r, LimitViolations).([]string)
+	context.Set(r, LimitViolations, append(tags, tag))
+}
+
+// getLimitViolationTags returns the analytics tags of the violations let through for a request
+func getLimitViolationTags(r *http.Request) []string {
+	tags, _ := context.Get(r, LimitViolations).([]string)
+	return tags
+}
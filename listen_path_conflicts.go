@@ -0,0 +1,183 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"sort"
+	"strings"
+)
+
+// APIRoutingModuleConfig binds an API to a domain, requests for that host are matched against the
+// API before any API without a domain
+type APIRoutingModuleConfig struct {
+	Domain string `mapstructure:"domain" bson:"domain" json:"domain"`
+}
+
+// ListenPathConflict describes two APIs that both match some requests. Duplicate conflicts are
+// APIs with the same domain and listen path, only the winner is loaded. Otherwise both APIs are
+// loaded and the winner gets the overlapping requests
+type ListenPathConflict struct {
+	Duplicate     bool
+	WinnerIndex   int
+	ShadowedIndex int
+}
+
+// EVENT_ListenPathConflictMeta is the metadata structure for a listen path conflict (EVENT_ListenPathConflict)
+type EVENT_ListenPathConflictMeta struct {
+	EventMetaDefault
+	APIID              string
+	Pattern            string
+	ConflictingAPIID   string
+	ConflictingPattern string
+	Skipped            bool
+}
+
+// specsByAPIID sorts the indexes of APIs by their API ID
+type specsByAPIID struct {
+	specs []APISpec
+	order []int
+}
+
+func (s specsByAPIID) Len() int {
+	return len(s.order)
+}
+
+func (s specsByAPIID) Swap(i, j int) {
+	s.order[i], s.order[j] = s.order[j], s.order[i]
+}
+
+func (s specsByAPIID) Less(i, j int) bool {
+	return s.specs[s.order[i]].APIID < s.specs[s.order[j]].APIID
+}
+
+func GetAPIDomain(spec *APISpec) string {
+	var thisModuleConfig APIRoutingModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode API routing configuration: ", err)
+	}
+
+	return strings.ToLower(thisModuleConfig.Domain)
+}
+
+// routePattern is the pattern the API is registered with on the muxer
+func routePattern(spec *APISpec) string {
+	return GetAPIDomain(spec) + spec.Proxy.ListenPath
+}
+
+// pathCovers checks if the muxer would route requests for path to the listen path pattern, only
+// patterns that end in a slash match the paths below them
+func pathCovers(pattern string, path string) bool {
+	if pattern == path {
+		return true
+	}
+
+	return strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern)
+}
+
+// findListenPathConflicts checks every pair of APIs for requests they would both match. The
+// precedence is deterministic: an API bound to the request's domain beats one without a domain,
+// then the longest listen path wins, exact duplicates are settled by the lowest API ID
+func findListenPathConflicts(APISpecs []APISpec) []ListenPathConflict {
+	conflicts := []ListenPathConflict{}
+
+	// Sorting by API ID makes the duplicate winner independent of the load order
+	order := specsByAPIID{specs: APISpecs, order: make([]int, len(APISpecs))}
+	for i := range order.order {
+		order.order[i] = i
+	}
+	sort.Stable(order)
+
+	domains := make([]string, len(APISpecs))
+	for i := range APISpecs {
+		domains[i] = GetAPIDomain(&APISpecs[i])
+	}
+
+	for a := 0; a < len(order.order); a++ {
+		for b := a + 1; b < len(order.order); b++ {
+			first, second := order.order[a], order.order[b]
+			// Parameter names don't change the requests a listen path matches
+			firstPath := normaliseListenPathParams(APISpecs[first].Proxy.ListenPath)
+			secondPath := normaliseListenPathParams(APISpecs[second].Proxy.ListenPath)
+			firstDomain, secondDomain := domains[first], domains[second]
+
+			if firstDomain != "" && secondDomain != "" && firstDomain != secondDomain {
+				continue
+			}
+
+			if firstDomain == secondDomain && firstPath == secondPath {
+				conflicts = append(conflicts, ListenPathConflict{Duplicate: true, WinnerIndex: first, ShadowedIndex: second})
+				continue
+			}
+
+			if !pathCovers(firstPath, secondPath) && !pathCovers(secondPath, firstPath) {
+				continue
+			}
+
+			thisConflict := ListenPathConflict{WinnerIndex: first, ShadowedIndex: second}
+			switch {
+			case firstDomain != secondDomain:
+				if secondDomain != "" {
+					thisConflict = ListenPathConflict{WinnerIndex: second, ShadowedIndex: first}
+				}
+			case len(secondPath) > len(firstPath):
+				thisConflict = ListenPathConflict{WinnerIndex: second, ShadowedIndex: first}
+			}
+			conflicts = append(conflicts, thisConflict)
+		}
+	}
+
+	return conflicts
+}
+
+// checkListenPaths reports the conflicts between the APIs that are being loaded and returns the
+// indexes of the APIs that can't be loaded as their listen path is taken
+func checkListenPaths(APISpecs []APISpec) map[int]bool {
+	skipped := make(map[int]bool)
+	conflicts := findListenPathConflicts(APISpecs)
+
+	// Only the API with the lowest ID is loaded out of a set of duplicates
+	for _, thisConflict := range conflicts {
+		if thisConflict.Duplicate {
+			skipped[thisConflict.ShadowedIndex] = true
+		}
+	}
+
+	for _, thisConflict := range conflicts {
+		winner := &APISpecs[thisConflict.WinnerIndex]
+		shadowed := &APISpecs[thisConflict.ShadowedIndex]
+
+		// Conflicts with APIs that aren't loaded are reported through their duplicate
+		if skipped[thisConflict.WinnerIndex] || (!thisConflict.Duplicate && skipped[thisConflict.ShadowedIndex]) {
+			continue
+		}
+
+		logger := log.WithFields(logrus.Fields{
+			"apiID":              shadowed.APIID,
+			"pattern":            routePattern(shadowed),
+			"conflictingApiID":   winner.APIID,
+			"conflictingPattern": routePattern(winner),
+		})
+
+		var message string
+		if thisConflict.Duplicate {
+			message = "Listen path is already used by another API, this API will not be loaded."
+			logger.Error(message)
+		} else {
+			message = "Listen path overlaps with another API, the other API serves the overlapping requests."
+			logger.Warning(message)
+		}
+
+		go shadowed.FireEvent(EVENT_ListenPathConflict,
+			EVENT_ListenPathConflictMeta{
+				EventMetaDefault:   EventMetaDefault{Message: message},
+				APIID:              shadowed.APIID,
+				Pattern:            routePattern(shadowed),
+				ConflictingAPIID:   winner.APIID,
+				ConflictingPattern: routePattern(winner),
+				Skipped:            thisConflict.Duplicate,
+			})
+	}
+
+	return skipped
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func createConflictTestSpec(APIID string, listenPath string, domain string) APISpec {
+	defStr := strings.Replace(maintenanceDefinition, `"api_id": "maintenance1",`, `"api_id": "`+APIID+`", "domain": "`+domain+`",`, 1)
+	defStr = strings.Replace(defStr, `"listen_path": "/maintenance/",`, `"listen_path": "`+listenPath+`",`, 1)
+	return createDefinitionFromString(defStr)
+}
+
+func TestDuplicateListenPaths(t *testing.T) {
+	specs := []APISpec{
+		createConflictTestSpec("c", "/widgets/", ""),
+		createConflictTestSpec("a", "/widgets/", ""),
+		createConflictTestSpec("b", "/widgets/", ""),
+		createConflictTestSpec("d", "/widgets/", "api.example.com"),
+	}
+
+	skipped := checkListenPaths(specs)
+	if len(skipped) != 2 || !skipped[0] || !skipped[2] {
+		t.Error("Only the API with the lowest ID should be loaded: ", skipped)
+	}
+}
+
+func TestOverlappingListenPaths(t *testing.T) {
+	specs := []APISpec{
+		createConflictTestSpec("short", "/widgets/", ""),
+		createConflictTestSpec("long", "/widgets/blue/", ""),
+		createConflictTestSpec("exact", "/widgets", ""),
+		createConflictTestSpec("domain", "/", "api.example.com"),
+		createConflictTestSpec("other", "/widgets/", "other.example.com"),
+	}
+
+	conflicts := findListenPathConflicts(specs)
+	winners := make(map[string]string)
+	for _, thisConflict := range conflicts {
+		if thisConflict.Duplicate {
+			t.Error("Overlapping listen paths aren't duplicates")
+		}
+		winners[specs[thisConflict.ShadowedIndex].APIID+">"+specs[thisConflict.WinnerIndex].APIID] = ""
+	}
+
+	// Domains are matched first, so other.example.com/widgets/blue/ is served by "other"
+	for _, expected := range []string{"short>long", "short>domain", "long>domain", "exact>domain", "short>other", "long>other"} {
+		if _, found := winners[expected]; !found {
+			t.Error("Missing conflict ", expected, ": ", winners)
+		}
+	}
+	if len(conflicts) != 6 {
+		t.Error("APIs on different domains and exact paths don't overlap: ", winners)
+	}
+
+	if len(checkListenPaths(specs)) != 0 {
+		t.Error("Overlapping APIs should all be loaded")
+	}
+}
+
+func TestDuplicateListenPathsWithParameters(t *testing.T) {
+	specs := []APISpec{
+		createConflictTestSpec("b", "/customers/{customer}/orders/", ""),
+		createConflictTestSpec("a", "/customers/{id}/orders/", ""),
+		createConflictTestSpec("c", "/customers/*/orders/", ""),
+		createConflictTestSpec("d", "/customers/{id:[0-9]+}/orders/", ""),
+	}
+
+	skipped := checkListenPaths(specs)
+	if len(skipped) != 2 || !skipped[0] || !skipped[2] {
+		t.Error("Listen paths that only differ in parameter names should be duplicates: ", skipped)
+	}
+}
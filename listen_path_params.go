@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Listen paths can contain parameters, e.g. /customers/{id}/orders, a parameter matches a single
+// path segment unless it has its own regex ({id:[0-9]+}) and * matches any single segment. The
+// captured values are available as path_param_{name} context variables
+const LISTEN_PATH_PARAM_PREFIX = "path_param_"
+
+var listenPathParamRx = regexp.MustCompile(`\{([a-zA-Z0-9_]+)(?::([^}]+))?\}|\*`)
+
+// ListenPathMatcher matches requests against a listen path with parameters
+type ListenPathMatcher struct {
+	rx        *regexp.Regexp
+	varNames  []string
+	MuxPrefix string
+}
+
+func IsParameterisedListenPath(listenPath string) bool {
+	return listenPathParamRx.MatchString(listenPath)
+}
+
+// normaliseListenPathParams drops the parameter names from a listen path, listen paths that only
+// differ in the names of their parameters match the same requests
+func normaliseListenPathParams(listenPath string) string {
+	return listenPathParamRx.ReplaceAllString(listenPath, "{:${2}}")
+}
+
+// NewListenPathMatcher compiles a listen path with parameters, it returns nil for fixed listen
+// paths as they are matched by prefix
+func NewListenPathMatcher(listenPath string) (*ListenPathMatcher, error) {
+	if !IsParameterisedListenPath(listenPath) {
+		return nil, nil
+	}
+
+	thisMatcher := &ListenPathMatcher{}
+
+	// The muxer only knows about the fixed part of the path
+	firstParam := listenPathParamRx.FindStringIndex(listenPath)[0]
+	thisMatcher.MuxPrefix = listenPath[:strings.LastIndex(listenPath[:firstParam], "/")+1]
+
+	rxString := ""
+	lastEnd := 0
+	for _, loc := range listenPathParamRx.FindAllStringSubmatchIndex(listenPath, -1) {
+		rxString += regexp.QuoteMeta(listenPath[lastEnd:loc[0]])
+		lastEnd = loc[1]
+
+		if loc[2] == -1 {
+			rxString += `[^/]+`
+			continue
+		}
+
+		thisMatcher.varNames = append(thisMatcher.varNames, listenPath[loc[2]:loc[3]])
+		if loc[4] == -1 {
+			rxString += `([^/]+)`
+		} else {
+			rxString += "(" + listenPath[loc[4]:loc[5]] + ")"
+		}
+	}
+	rxString += regexp.QuoteMeta(listenPath[lastEnd:])
+
+	// Parameters end at a segment boundary so /orders doesn't match /ordersummary
+	boundary := `(?:/|$)`
+	if strings.HasSuffix(listenPath, "/") {
+		boundary = ""
+	}
+
+	var err error
+	thisMatcher.rx, err = regexp.Compile("^(" + rxString + ")" + boundary)
+	if err != nil {
+		return nil, err
+	}
+
+	// Custom regexes may not have groups of their own, the values would be out of order
+	if thisMatcher.rx.NumSubexp() != len(thisMatcher.varNames)+1 {
+		return nil, errors.New("regexes in listen path parameters can't have groups, use (?:...) instead")
+	}
+
+	return thisMatcher, nil
+}
+
+// Match returns the part of the path that matched the listen path and the captured parameters
+func (l *ListenPathMatcher) Match(path string) (string, map[string]string, bool) {
+	matches := l.rx.FindStringSubmatch(path)
+	if matches == nil {
+		return "", nil, false
+	}
+
+	params := make(map[string]string, len(l.varNames))
+	for i, name := range l.varNames {
+		params[name] = matches[i+2]
+	}
+
+	return matches[1], params, true
+}
+
+// StripListenPath removes the listen path from the start of a request path
+func (a *APISpec) StripListenPath(path string) string {
+	if a.ListenPathMatcher != nil {
+		if matched, _, found := a.ListenPathMatcher.Match(path); found {
+			return strings.TrimPrefix(path, matched)
+		}
+		return path
+	}
+
+	return strings.Replace(path, a.Proxy.ListenPath, "", 1)
+}
+
+type listenPathRoute struct {
+	matcher *ListenPathMatcher
+	handler http.Handler
+}
+
+// ListenPathRouter serves a muxer prefix that is shared by listen paths with parameters, the
+// most specific listen path is tried first and requests that match none go to the fallback
+type ListenPathRouter struct {
+	routes   []listenPathRoute
+	fallback http.Handler
+}
+
+func (l *ListenPathRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, thisRoute := range l.routes {
+		if _, params, found := thisRoute.matcher.Match(r.URL.Path); found {
+			context.Set(r, ListenPathParams, params)
+			thisRoute.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if l.fallback != nil {
+		l.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+type routesByLength []listenPathRoute
+
+func (r routesByLength) Len() int {
+	return len(r)
+}
+
+func (r routesByLength) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+func (r routesByLength) Less(i, j int) bool {
+	return len(r[i].matcher.rx.String()) > len(r[j].matcher.rx.String())
+}
+
+// listenPathRoutes collects the handlers of a reload so that listen paths with parameters that
+// share a muxer prefix (and any fixed listen path on that prefix) can be registered together
+type listenPathRoutes struct {
+	fixed  map[string]http.Handler
+	params map[string][]listenPathRoute
+	order  []string
+}
+
+func newListenPathRoutes() *listenPathRoutes {
+	return &listenPathRoutes{
+		fixed:  make(map[string]http.Handler),
+		params: make(map[string][]listenPathRoute),
+	}
+}
+
+// Add queues a handler for a domain and listen path, the listen path may have parameters
+func (l *listenPathRoutes) Add(domain string, listenPath string, h http.Handler) {
+	thisMatcher, err := NewListenPathMatcher(listenPath)
+	if err != nil {
+		log.Error("Couldn't compile listen path ", listenPath, ": ", err)
+		return
+	}
+
+	if thisMatcher == nil {
+		pattern := domain + listenPath
+		if _, found := l.fixed[pattern]; !found {
+			l.order = append(l.order, pattern)
+		}
+		l.fixed[pattern] = h
+		return
+	}
+
+	pattern := domain + thisMatcher.MuxPrefix
+	if _, found := l.params[pattern]; !found {
+		l.order = append(l.order, pattern)
+	}
+	l.params[pattern] = append(l.params[pattern], listenPathRoute{thisMatcher, h})
+}
+
+// Register adds the queued handlers to the muxer, each pattern is only registered once
+func (l *listenPathRoutes) Register(Muxer *http.ServeMux) {
+	registered := make(map[string]bool)
+	for _, pattern := range l.order {
+		if registered[pattern] {
+			continue
+		}
+		registered[pattern] = true
+
+		routes, hasParams := l.params[pattern]
+		if !hasParams {
+			Muxer.Handle(pattern, l.fixed[pattern])
+			continue
+		}
+
+		sort.Stable(routesByLength(routes))
+		Muxer.Handle(pattern, &ListenPathRouter{routes: routes, fallback: l.fixed[pattern]})
+	}
+}
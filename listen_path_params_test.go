@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListenPathMatcher(t *testing.T) {
+	thisMatcher, err := NewListenPathMatcher("/customers/{id}/orders")
+	if err != nil || thisMatcher == nil {
+		t.Fatal("Listen path wasn't compiled: ", err)
+	}
+	if thisMatcher.MuxPrefix != "/customers/" {
+		t.Error("Wrong muxer prefix: ", thisMatcher.MuxPrefix)
+	}
+
+	matched, params, found := thisMatcher.Match("/customers/42/orders/7")
+	if !found || matched != "/customers/42/orders" || params["id"] != "42" {
+		t.Error("Listen path should match: ", matched, params)
+	}
+
+	for _, path := range []string{"/customers/42/ordersummary", "/customers/42", "/customers//orders"} {
+		if _, _, found := thisMatcher.Match(path); found {
+			t.Error("Listen path shouldn't match ", path)
+		}
+	}
+
+	thisMatcher, _ = NewListenPathMatcher("/{tenant}/*/users/{id:[0-9]+}/")
+	if _, params, found := thisMatcher.Match("/acme/v1/users/12/profile"); !found || params["tenant"] != "acme" || params["id"] != "12" {
+		t.Error("Wildcards and regexes should match: ", params)
+	}
+	if _, _, found := thisMatcher.Match("/acme/v1/users/bob/"); found {
+		t.Error("Parameter regex should be applied")
+	}
+
+	if thisMatcher, _ := NewListenPathMatcher("/widgets/"); thisMatcher != nil {
+		t.Error("Fixed listen paths don't need a matcher")
+	}
+	if _, err := NewListenPathMatcher("/users/{id:(a|b)}"); err == nil {
+		t.Error("Groups in parameter regexes should be rejected")
+	}
+}
+
+func TestStripParameterisedListenPath(t *testing.T) {
+	spec := createConflictTestSpec("orders", "/customers/{id}/orders", "")
+	if stripped := spec.StripListenPath("/customers/42/orders/7"); stripped != "/7" {
+		t.Error("Listen path wasn't stripped: ", stripped)
+	}
+
+	spec = createConflictTestSpec("widgets", "/widgets/", "")
+	if stripped := spec.StripListenPath("/widgets/blue"); stripped != "blue" {
+		t.Error("Fixed listen path wasn't stripped: ", stripped)
+	}
+}
+
+func TestListenPathRoutes(t *testing.T) {
+	served := ""
+	handlerFor := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served = name + ":" + ReplaceTykContextVars(r, "$tyk_context.path_param_id")
+		})
+	}
+
+	routes := newListenPathRoutes()
+	routes.Add("", "/customers/", handlerFor("customers"))
+	routes.Add("", "/customers/{id}/", handlerFor("customer"))
+	routes.Add("", "/customers/{id}/orders/", handlerFor("orders"))
+	muxer := http.NewServeMux()
+	routes.Register(muxer)
+
+	for path, expected := range map[string]string{
+		"/customers/42/orders/7": "orders:42",
+		"/customers/42/":         "customer:42",
+		"/customers/":            "customers:",
+	} {
+		served = ""
+		req, _ := http.NewRequest("GET", path, nil)
+		muxer.ServeHTTP(httptest.NewRecorder(), req)
+		if served != expected {
+			t.Error("Wrong API for ", path, ": ", served)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SD_LISTEN_FDS_START is the first file descriptor passed by systemd socket activation
+const SD_LISTEN_FDS_START = 3
+
+// ListenerConfig sets where the gateway listens. The control API is served by the same listener,
+// so it follows these settings too
+type ListenerConfig struct {
+	UnixSocket           string   `json:"unix_socket"`
+	SocketMode           string   `json:"socket_mode"`
+	SystemdActivation    bool     `json:"systemd_activation"`
+	ProxyProtocol        bool     `json:"proxy_protocol"`
+	ProxyProtocolTimeout int      `json:"proxy_protocol_timeout"`
+	ProxyProtocolSources []string `json:"proxy_protocol_trusted_sources"`
+}
+
+// systemdListeners returns the sockets passed by systemd, LISTEN_PID must be this process. The
+// variables are unset so they aren't inherited by a child process after a reload
+func systemdListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("No sockets were passed to this process by systemd")
+	}
+
+	numFDs, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFDs < 1 {
+		return nil, errors.New("No sockets were passed to this process by systemd")
+	}
+
+	listeners := make([]net.Listener, numFDs)
+	for i := 0; i < numFDs; i++ {
+		fd := SD_LISTEN_FDS_START + i
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners[i] = l
+	}
+
+	return listeners, nil
+}
+
+// listenUnixSocket listens on a unix domain socket, a stale socket file left by a previous run is
+// removed first
+func listenUnixSocket(path string, mode string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a socket")
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is handed over to the new process on a reload, so closing it must not remove it
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if mode != "" {
+		fileMode, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			l.Close()
+			return nil, errors.New("Invalid socket mode: " + mode)
+		}
+		if err := os.Chmod(path, os.FileMode(fileMode)); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// getListener creates the main listener: a systemd activated socket, a unix domain socket or the
+// TCP port, in that order. It reads PROXY protocol headers if they are enabled
+func getListener(targetPort string) (net.Listener, error) {
+	l, err := getBaseListener(targetPort)
+	if err != nil || !config.Listener.ProxyProtocol {
+		return l, err
+	}
+
+	log.Info("--> PROXY protocol enabled")
+	return &proxyProtocolListener{
+		Listener:       l,
+		Timeout:        time.Duration(config.Listener.ProxyProtocolTimeout) * time.Second,
+		TrustedSources: parseCIDRList(config.Listener.ProxyProtocolSources, "PROXY protocol source"),
+	}, nil
+}
+
+func getBaseListener(targetPort string) (net.Listener, error) {
+	if config.Listener.SystemdActivation {
+		listeners, err := systemdListeners()
+		if err == nil {
+			if len(listeners) > 1 {
+				log.Warning("systemd passed ", len(listeners), " sockets, only the first one is used")
+				for _, l := range listeners[1:] {
+					l.Close()
+				}
+			}
+			log.Info("--> Using systemd activated socket: ", listeners[0].Addr())
+			return listeners[0], nil
+		}
+		log.Warning(err, ", falling back to the configured listener")
+	}
+
+	if config.Listener.UnixSocket != "" {
+		log.Info("--> Listening on unix socket: ", config.Listener.UnixSocket)
+		return listenUnixSocket(config.Listener.UnixSocket, config.Listener.SocketMode)
+	}
+
+	return net.Listen("tcp", targetPort)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tyk-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "tyk.sock")
+	l, err := listenUnixSocket(socketPath, "0660")
+	if err != nil {
+		t.Fatal("Couldn't listen on socket: ", err)
+	}
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Error("Socket mode should be 0660, got: ", info.Mode().Perm())
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal("Couldn't connect to socket: ", err)
+	}
+	conn.Close()
+	l.Close()
+
+	// The socket file is left behind on close, a new listener must replace it
+	l, err = listenUnixSocket(socketPath, "")
+	if err != nil {
+		t.Fatal("Stale socket should be replaced: ", err)
+	}
+	l.Close()
+
+	filePath := filepath.Join(dir, "not-a-socket")
+	ioutil.WriteFile(filePath, []byte("data"), 0600)
+	if _, err := listenUnixSocket(filePath, ""); err == nil {
+		t.Error("Regular files should never be replaced by the socket")
+	}
+
+	if _, err := listenUnixSocket(filepath.Join(dir, "bad-mode.sock"), "rw"); err == nil {
+		t.Error("Invalid socket modes should fail")
+	}
+}
+
+func TestSystemdListenersForOtherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	if _, err := systemdListeners(); err == nil {
+		t.Error("Sockets passed to another process should be ignored")
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS should be unset")
+	}
+}
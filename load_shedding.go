@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SHED_POLICY_REJECT_NEW  = "reject_new"
+	SHED_POLICY_DROP_OLDEST = "drop_oldest"
+
+	LOAD_SHEDDING_DEFAULT_QUEUE_TIMEOUT = 500
+)
+
+// LoadSheddingConfig caps the number of proxied requests a node handles at once. Up to QueueDepth
+// requests wait (for at most QueueTimeout ms) for a free slot, anything beyond that is shed with a
+// 503. With the reject_new policy a full queue rejects the new request, with drop_oldest the
+// request that has waited longest is shed instead
+type LoadSheddingConfig struct {
+	MaxInFlight  int    `json:"max_in_flight"`
+	QueueDepth   int    `json:"queue_depth"`
+	QueueTimeout int    `json:"queue_timeout"`
+	ShedPolicy   string `json:"shed_policy"`
+}
+
+// IsValidShedPolicy checks the shed policy set in tyk.conf, empty means reject_new
+func IsValidShedPolicy(policy string) bool {
+	switch policy {
+	case "", SHED_POLICY_REJECT_NEW, SHED_POLICY_DROP_OLDEST:
+		return true
+	}
+
+	return false
+}
+
+// LoadShedder hands out the in-flight slots of the node, when a slot is freed it goes straight to
+// the oldest waiting request
+type LoadShedder struct {
+	sync.Mutex
+	maxInFlight  int
+	queueDepth   int
+	queueTimeout time.Duration
+	dropOldest   bool
+	inFlight     int
+	waiting      []chan bool
+	shed         int64
+}
+
+var NodeLoadShedder *LoadShedder
+
+func NewLoadShedder(thisConfig LoadSheddingConfig) *LoadShedder {
+	queueTimeout := thisConfig.QueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = LOAD_SHEDDING_DEFAULT_QUEUE_TIMEOUT
+	}
+
+	return &LoadShedder{
+		maxInFlight:  thisConfig.MaxInFlight,
+		queueDepth:   thisConfig.QueueDepth,
+		queueTimeout: time.Duration(queueTimeout) * time.Millisecond,
+		dropOldest:   thisConfig.ShedPolicy == SHED_POLICY_DROP_OLDEST,
+	}
+}
+
+// Acquire takes a slot, waiting in the queue if there is room, false means the request is shed
+func (l *LoadShedder) Acquire() bool {
+	l.Lock()
+	if l.inFlight < l.maxInFlight && len(l.waiting) == 0 {
+		l.inFlight++
+		l.Unlock()
+		return true
+	}
+
+	if len(l.waiting) >= l.queueDepth {
+		if !l.dropOldest || l.queueDepth == 0 {
+			l.Unlock()
+			atomic.AddInt64(&l.shed, 1)
+			return false
+		}
+
+		oldest := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		oldest <- false
+	}
+
+	waiter := make(chan bool, 1)
+	l.waiting = append(l.waiting, waiter)
+	l.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var admitted bool
+	select {
+	case admitted = <-waiter:
+	case <-timer.C:
+		l.Lock()
+		for i, queued := range l.waiting {
+			if queued == waiter {
+				l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+				l.Unlock()
+				atomic.AddInt64(&l.shed, 1)
+				return false
+			}
+		}
+		l.Unlock()
+
+		// A slot or a rejection was handed over while timing out
+		admitted = <-waiter
+	}
+
+	if !admitted {
+		atomic.AddInt64(&l.shed, 1)
+	}
+
+	return admitted
+}
+
+// Release gives a slot back, or passes it on to the oldest waiting request
+func (l *LoadShedder) Release() {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.waiting) > 0 {
+		next := l.waiting[0]
+		l.waiting = l.waiting[1:]
+		next <- true
+		return
+	}
+
+	l.inFlight--
+}
+
+// Shed is the number of requests shed since the node started
+func (l *LoadShedder) Shed() int64 {
+	return atomic.LoadInt64(&l.shed)
+}
+
+// LoadSheddingHandler wraps an API's chain so that its requests need a slot from the node's load
+// shedder, shed requests never reach the middleware
+func LoadSheddingHandler(tykMiddleware *TykMiddleware, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if NodeLoadShedder == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if !NodeLoadShedder.Acquire() {
+			log.Debug("Node is overloaded, shedding request for: ", r.URL.Path)
+			handler := ErrorHandler{tykMiddleware}
+			handler.HandleError(w, r, "Gateway is overloaded, try again later.", 503)
+			return
+		}
+		defer NodeLoadShedder.Release()
+
+		h.ServeHTTP(w, r)
+	})
+}
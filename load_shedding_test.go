@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// queueAcquire waits in the shedder's queue from another goroutine
+func queueAcquire(t *testing.T, l *LoadShedder) chan bool {
+	l.Lock()
+	queued := len(l.waiting)
+	l.Unlock()
+
+	result := make(chan bool, 1)
+	go func() {
+		result <- l.Acquire()
+	}()
+
+	for i := 0; i < 100; i++ {
+		l.Lock()
+		waiting := len(l.waiting)
+		l.Unlock()
+		if waiting > queued {
+			return result
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("Request wasn't queued")
+	return nil
+}
+
+func TestLoadShedderRejectNew(t *testing.T) {
+	l := NewLoadShedder(LoadSheddingConfig{MaxInFlight: 1, QueueDepth: 1, QueueTimeout: 1000})
+	if !l.Acquire() {
+		t.Fatal("First request should get a slot")
+	}
+
+	queued := queueAcquire(t, l)
+	if l.Acquire() {
+		t.Error("Request should be shed when the queue is full")
+	}
+
+	l.Release()
+	if !<-queued {
+		t.Error("Freed slot should go to the waiting request")
+	}
+	l.Release()
+
+	if l.inFlight != 0 || l.Shed() != 1 {
+		t.Error("Wrong shedder state: ", l.inFlight, l.Shed())
+	}
+}
+
+func TestLoadShedderDropOldest(t *testing.T) {
+	l := NewLoadShedder(LoadSheddingConfig{MaxInFlight: 1, QueueDepth: 1, QueueTimeout: 1000, ShedPolicy: SHED_POLICY_DROP_OLDEST})
+	l.Acquire()
+
+	oldest := queueAcquire(t, l)
+	newest := make(chan bool, 1)
+	go func() {
+		newest <- l.Acquire()
+	}()
+	if <-oldest {
+		t.Error("Oldest waiting request should be shed")
+	}
+
+	l.Release()
+	if !<-newest {
+		t.Error("Newest request should get the freed slot")
+	}
+}
+
+func TestLoadShedderQueueTimeout(t *testing.T) {
+	l := NewLoadShedder(LoadSheddingConfig{MaxInFlight: 1, QueueDepth: 5, QueueTimeout: 10})
+	l.Acquire()
+
+	if l.Acquire() {
+		t.Error("Request should be shed after waiting for the queue timeout")
+	}
+	if len(l.waiting) != 0 {
+		t.Error("Timed out request should leave the queue")
+	}
+}
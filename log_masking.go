@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const MASKED_VALUE = "****"
+
+// LogMaskingConfig lists the headers and query parameters of an API whose values must not end up
+// in logs, analytics or event payloads
+type LogMaskingConfig struct {
+	SensitiveHeaders []string `mapstructure:"sensitive_headers" bson:"sensitive_headers" json:"sensitive_headers"`
+	SensitiveParams  []string `mapstructure:"sensitive_params" bson:"sensitive_params" json:"sensitive_params"`
+}
+
+// LogMasking masks the sensitive values of an API, a nil LogMasking masks nothing
+type LogMasking struct {
+	headers  map[string]bool
+	params   map[string]bool
+	maskKeys bool
+}
+
+// NewLogMasking builds the masking rules of an API, keys are masked too if the header or parameter
+// they are read from is sensitive
+func NewLogMasking(spec *APISpec) *LogMasking {
+	var thisModuleConfig LogMaskingConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode log masking configuration: ", err)
+		return nil
+	}
+
+	if len(thisModuleConfig.SensitiveHeaders) == 0 && len(thisModuleConfig.SensitiveParams) == 0 {
+		return nil
+	}
+
+	thisMasking := &LogMasking{headers: make(map[string]bool), params: make(map[string]bool)}
+	for _, name := range thisModuleConfig.SensitiveHeaders {
+		thisMasking.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range thisModuleConfig.SensitiveParams {
+		thisMasking.params[name] = true
+	}
+
+	// Basic auth and OAuth always use the Authorization header
+	authSources := GetAuthSourcesConfig(spec)
+	thisMasking.maskKeys = thisMasking.headers["Authorization"] || thisMasking.params[authSources.ParamName]
+	for _, name := range authSources.Headers {
+		if thisMasking.headers[http.CanonicalHeaderKey(name)] {
+			thisMasking.maskKeys = true
+		}
+	}
+
+	return thisMasking
+}
+
+// MaskHeader returns the value to log for a header
+func (m *LogMasking) MaskHeader(name string, value string) string {
+	if m == nil || value == "" || !m.headers[http.CanonicalHeaderKey(name)] {
+		return value
+	}
+
+	return MASKED_VALUE
+}
+
+// MaskKey returns the value to log for a key, the last 4 characters are kept so keys can still be
+// told apart
+func (m *LogMasking) MaskKey(key string) string {
+	if m == nil || !m.maskKeys || key == "" {
+		return key
+	}
+
+	if len(key) <= 8 {
+		return MASKED_VALUE
+	}
+
+	return MASKED_VALUE + key[len(key)-4:]
+}
+
+// MaskQuery returns a raw query with the values of sensitive parameters masked, the order and
+// encoding of the other parameters is kept
+func (m *LogMasking) MaskQuery(rawQuery string) string {
+	if m == nil || len(m.params) == 0 || rawQuery == "" {
+		return rawQuery
+	}
+
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		nameValue := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(nameValue[0])
+		if err != nil {
+			name = nameValue[0]
+		}
+		if m.params[name] && len(nameValue) == 2 {
+			pairs[i] = nameValue[0] + "=" + MASKED_VALUE
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// MaskRequest returns a copy of the request to log, the body is shared with the original request
+func (m *LogMasking) MaskRequest(r *http.Request) *http.Request {
+	if m == nil {
+		return r
+	}
+
+	maskedReq := new(http.Request)
+	*maskedReq = *r
+	maskedReq.URL = new(url.URL)
+	*maskedReq.URL = *r.URL
+	maskedReq.URL.RawQuery = m.MaskQuery(r.URL.RawQuery)
+
+	maskedReq.Header = make(http.Header)
+	for name, values := range r.Header {
+		for _, value := range values {
+			maskedReq.Header.Add(name, m.MaskHeader(name, value))
+		}
+	}
+
+	return maskedReq
+}
+
+// MaskContextVars masks the header and request URI context variables
+func (m *LogMasking) MaskContextVars(contextVars map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return contextVars
+	}
+
+	for name := range m.headers {
+		varName := "headers_" + strings.Replace(name, "-", "_", -1)
+		if _, found := contextVars[varName]; found {
+			contextVars[varName] = MASKED_VALUE
+		}
+	}
+
+	if requestURI, ok := contextVars["request_uri"].(string); ok {
+		if parts := strings.SplitN(requestURI, "?", 2); len(parts) == 2 {
+			contextVars["request_uri"] = parts[0] + "?" + m.MaskQuery(parts[1])
+		}
+	}
+
+	return contextVars
+}
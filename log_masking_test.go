@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const logMaskingDefinition = `{
+	"name": "Masked API",
+	"api_id": "masked1",
+	"org_id": "default",
+	"use_keyless": false,
+	"auth": {"auth_header_name": "authorization"},
+	"sensitive_headers": ["authorization", "X-Card-Number"],
+	"sensitive_params": ["card"],
+	"version_data": {
+		"not_versioned": true,
+		"versions": {"Default": {"name": "Default"}}
+	},
+	"proxy": {
+		"listen_path": "/masked/",
+		"target_url": "http://example.com",
+		"strip_listen_path": false
+	}
+}`
+
+func TestLogMaskingRequest(t *testing.T) {
+	spec := createDefinitionFromString(logMaskingDefinition)
+	if spec.LogMasking == nil {
+		t.Fatal("Log masking should be set up")
+	}
+
+	req, _ := http.NewRequest("GET", "/masked/pay?card=4111111111111111&amount=10", nil)
+	req.Header.Set("Authorization", "abc123")
+	req.Header.Set("X-Card-Number", "4111111111111111")
+	req.Header.Set("Content-Type", "application/json")
+
+	maskedReq := spec.LogMasking.MaskRequest(req)
+	if maskedReq.Header.Get("Authorization") != MASKED_VALUE || maskedReq.Header.Get("X-Card-Number") != MASKED_VALUE {
+		t.Error("Sensitive headers should be masked: ", maskedReq.Header)
+	}
+	if maskedReq.Header.Get("Content-Type") != "application/json" {
+		t.Error("Other headers should be kept")
+	}
+	if strings.Contains(maskedReq.URL.RawQuery, "4111") || !strings.Contains(maskedReq.URL.RawQuery, "amount=10") {
+		t.Error("Sensitive params should be masked: ", maskedReq.URL.RawQuery)
+	}
+
+	// The request that is proxied is untouched
+	if req.Header.Get("Authorization") != "abc123" || !strings.Contains(req.URL.RawQuery, "4111") {
+		t.Error("The original request should not be changed")
+	}
+
+	contextVars := spec.LogMasking.MaskContextVars(generateContextVars(req))
+	if contextVars["headers_X_Card_Number"] != MASKED_VALUE {
+		t.Error("Header context vars should be masked: ", contextVars["headers_X_Card_Number"])
+	}
+	if strings.Contains(contextVars["request_uri"].(string), "4111") {
+		t.Error("The request URI context var should be masked: ", contextVars["request_uri"])
+	}
+}
+
+func TestLogMaskingKeys(t *testing.T) {
+	spec := createDefinitionFromString(logMaskingDefinition)
+
+	if masked := spec.LogMasking.MaskKey("default1234567890abcd"); masked != MASKED_VALUE+"abcd" {
+		t.Error("Keys from a sensitive header should be masked: ", masked)
+	}
+	if spec.LogMasking.MaskHeader("User-Agent", "curl") != "curl" {
+		t.Error("Other headers should not be masked")
+	}
+
+	// APIs without masking log everything as before
+	var noMasking *LogMasking
+	if noMasking.MaskKey("abc123") != "abc123" || noMasking.MaskHeader("Authorization", "abc123") != "abc123" {
+		t.Error("Nothing should be masked without sensitive headers or params")
+	}
+}
@@ -10,10 +10,8 @@ import (
 	osin "github.com/lonelycode/osin"
 	"github.com/lonelycode/tykcommon"
 	"github.com/rcrowley/goagain"
-	"github.com/rs/cors"
 	"html/template"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,6 +19,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,7 +37,10 @@ var DefaultQuotaStore = DefaultSessionManager{}
 var MonitoringHandler TykEventHandler
 var RPCListener = RPCStorageHandler{}
 
+// ApiSpecRegister holds the loaded APIs by ID, it is replaced as a whole when the APIs are loaded
+// and never changed in place, read it with getApiSpecs
 var ApiSpecRegister = make(map[string]*APISpec)
+var apiSpecRegisterLock sync.RWMutex
 var keyGen = DefaultKeyGenerator{}
 
 // Generic system error
@@ -53,12 +55,28 @@ func displayConfig() {
 	log.Info("--> Listening on port: ", config.ListenPort)
 }
 
+// newAnalyticsPurger creates the purger of an analytics store for the analytics type set in tyk.conf
+func newAnalyticsPurger(store *RedisClusterStorageManager) Purger {
+	if config.AnalyticsConfig.Type == "csv" {
+		log.Debug("Using CSV cache purge")
+		return &CSVPurger{store}
+
+	} else if config.AnalyticsConfig.Type == "mongo" {
+		log.Debug("Using MongoDB cache purge")
+		return &MongoPurger{store, nil}
+	} else if config.AnalyticsConfig.Type == "rpc" {
+		log.Debug("Using RPC cache purge")
+		thisPurger := RPCPurger{Store: store, Address: config.SlaveOptions.ConnectionString, SpoolDir: config.SlaveOptions.AnalyticsSpoolDir}
+		thisPurger.Connect()
+		return &thisPurger
+	}
+
+	return nil
+}
+
 // Create all globals and init connection handlers
 func setupGlobals() {
-
-	if (config.EnableAnalytics == true) && (config.Storage.Type != "redis") {
-		log.Panic("Analytics requires Redis Storage backend, please enable Redis in the tyk.conf file.")
-	}
+	config.loadTrustedProxies()
 
 	if config.EnableAnalytics {
 		config.loadIgnoredIPs()
@@ -67,20 +85,7 @@ func setupGlobals() {
 
 		analytics = RedisAnalyticsHandler{
 			Store: &AnalyticsStore,
-		}
-
-		if config.AnalyticsConfig.Type == "csv" {
-			log.Debug("Using CSV cache purge")
-			analytics.Clean = &CSVPurger{&AnalyticsStore}
-
-		} else if config.AnalyticsConfig.Type == "mongo" {
-			log.Debug("Using MongoDB cache purge")
-			analytics.Clean = &MongoPurger{&AnalyticsStore, nil}
-		} else if config.AnalyticsConfig.Type == "rpc" {
-			log.Debug("Using RPC cache purge")
-			thisPurger := RPCPurger{Store: &AnalyticsStore, Address: config.SlaveOptions.ConnectionString}
-			thisPurger.Connect()
-			analytics.Clean = &thisPurger
+			Clean: newAnalyticsPurger(&AnalyticsStore),
 		}
 
 		analytics.Store.Connect()
@@ -90,6 +95,12 @@ func setupGlobals() {
 		} else {
 			log.Warn("Cache purge turned off, you are responsible for Redis storage maintenance.")
 		}
+
+		if config.SelfTelemetry.Enabled && config.SlaveOptions.UseRPC {
+			log.Warning("Self telemetry is not available in hybrid (RPC) mode, analytics records lose their tags")
+		} else if config.SelfTelemetry.Enabled {
+			go StartTelemetryLoop(config.SelfTelemetry.Interval)
+		}
 	}
 
 	//genericOsinStorage = MakeNewOsinServer()
@@ -100,6 +111,81 @@ func setupGlobals() {
 	// Set up global JSVM
 	GlobalEventsJSVM.Init(config.TykJSPath)
 
+	if config.TokenRevocation.Enabled {
+		RevocationStore := &RedisClusterStorageManager{KeyPrefix: REVOCATION_KEY_PREFIX, HashKeys: false}
+		RevocationStore.Connect()
+		TokenRevocations = NewTokenRevocationList(RevocationStore, config.TokenRevocation.ExpectedTokens)
+		go TokenRevocations.StartRefreshLoop(config.TokenRevocation.RefreshInterval)
+	}
+
+	APIStateStore = GetGlobalStorageHandler(API_STATE_KEY_PREFIX, false)
+	APIStateStore.Connect()
+
+	if config.UsageMetering.Enabled {
+		retentionHours := config.UsageMetering.RetentionHours
+		if retentionHours < 1 {
+			retentionHours = 24 * 90
+		}
+
+		MeteringStore := &RedisClusterStorageManager{KeyPrefix: USAGE_KEY_PREFIX, HashKeys: false}
+		MeteringStore.Connect()
+		Metering = &UsageMeter{Store: MeteringStore, Retention: retentionHours * 3600}
+		go StartUsageExportLoop(config.UsageMetering.Exporters)
+	}
+
+	PortalRequestStore.Connect()
+
+	if config.KeyMetadataIndex.Enabled && !config.SlaveOptions.UseRPC {
+		KeyMetadataIndexStore := &RedisClusterStorageManager{KeyPrefix: KEY_METADATA_INDEX_PREFIX, HashKeys: false}
+		KeyMetadataIndexStore.Connect()
+		KeyMetadataIndex = NewKeyMetadataIndexer(KeyMetadataIndexStore, config.KeyMetadataIndex.Fields)
+	}
+
+	if !config.NodeRegistry.Disabled && !config.SlaveOptions.UseRPC {
+		NodeRegistryStore := &RedisClusterStorageManager{KeyPrefix: NODE_REGISTRY_KEY_PREFIX, HashKeys: false}
+		NodeRegistryStore.Connect()
+		Nodes = NewNodeRegistry(NodeRegistryStore, config.NodeRegistry.HeartbeatInterval)
+		go Nodes.StartHeartbeatLoop()
+	}
+
+	go StartDRLLoop()
+
+	if config.HealthCheck.EnableHealthChecks {
+		go StartHealthCheckFlushLoop(config.HealthCheck.FlushInterval)
+		go StartAdaptiveRateLimitLoop(config.HealthCheck.FlushInterval)
+
+		ErrorRateClaimStore := &RedisClusterStorageManager{KeyPrefix: ERROR_RATE_MONITOR_PREFIX, HashKeys: false}
+		ErrorRateClaimStore.Connect()
+		ErrorRateClaims = ErrorRateClaimStore
+		go StartErrorRateMonitorLoop(config.HealthCheck.FlushInterval)
+	}
+
+	if config.AuditLog.Enabled {
+		SetupAuditLog()
+	}
+
+	if config.KeyUsage.Enabled {
+		KeyUsageStore := &RedisClusterStorageManager{KeyPrefix: KEY_LAST_USED_PREFIX, HashKeys: config.HashKeys}
+		KeyUsageStore.Connect()
+		KeyUsage = NewKeyUsageTracker(KeyUsageStore, keyUsageTTL(config.KeyUsage.ReapAfterDays, config.KeyUsage.ReaperInterval))
+		go KeyUsage.StartFlushLoop(config.KeyUsage.FlushInterval)
+
+		if config.KeyUsage.ReapAfterDays > 0 && !config.SlaveOptions.UseRPC {
+			log.Info("Keys unused for ", config.KeyUsage.ReapAfterDays, " days will be deleted")
+			go KeyUsage.StartReaperLoop(config.KeyUsage.ReapAfterDays, config.KeyUsage.ReaperInterval)
+		}
+	}
+
+	if config.LoadShedding.MaxInFlight > 0 {
+		log.Info("Load shedding enabled, max requests in flight: ", config.LoadShedding.MaxInFlight)
+		NodeLoadShedder = NewLoadShedder(config.LoadShedding)
+	}
+
+	if config.LocalSessionCache.Enabled {
+		log.Info("Local session cache enabled")
+		LocalSessionCache = NewSessionCache(config.LocalSessionCache.TTL, config.LocalSessionCache.MaxEntries)
+	}
+
 	// Get the notifier ready
 	log.Debug("Notifier will not work in hybrid mode")
 	MainNotifierStore := RedisClusterStorageManager{}
@@ -126,8 +212,11 @@ func getAPISpecs() []APISpec {
 	} else if config.SlaveOptions.UseRPC {
 		log.Debug("Using RPC Configuration")
 		APISpecs = thisAPILoader.LoadDefinitionsFromRPC(config.SlaveOptions.RPCKey)
+	} else if config.KubernetesSource.Enabled {
+		log.Debug("Using App Configuration from Kubernetes")
+		APISpecs = filterSegmentedSpecs(thisAPILoader.LoadDefinitionsFromKubernetes(config.KubernetesSource))
 	} else {
-		APISpecs = thisAPILoader.LoadDefinitions(config.AppPath)
+		APISpecs = filterSegmentedSpecs(thisAPILoader.LoadDefinitions(getAppDefinitionsPath()))
 	}
 
 	log.Printf("Detected %v APIs", len(APISpecs))
@@ -163,6 +252,8 @@ func getPolicies() {
 	} else {
 		Policies = LoadPoliciesFromFile(config.Policies.PolicyRecordName)
 	}
+
+	Policies = validatePolicyQuotaAlgorithms(Policies)
 }
 
 // Set up default Tyk control API endpoints - these are global, so need to be added first
@@ -173,9 +264,22 @@ func loadAPIEndpoints(Muxer *http.ServeMux) {
 
 	if !IsRPCMode() {
 		Muxer.HandleFunc("/tyk/org/keys/", CheckIsAPIOwner(orgHandler))
+		Muxer.HandleFunc("/tyk/org/config/", CheckIsAPIOwner(orgConfigHandler))
+		Muxer.HandleFunc("/tyk/org/state/", CheckIsAPIOwner(orgStateHandler))
 		Muxer.HandleFunc("/tyk/keys/policy/", CheckIsAPIOwner(policyUpdateHandler))
+		Muxer.HandleFunc("/tyk/keys/state/", CheckIsAPIOwner(keyStateHandler))
+		Muxer.HandleFunc("/tyk/keys/suspend/", CheckIsAPIOwner(keySuspensionHandler))
+		Muxer.HandleFunc("/tyk/keys/revoked/", CheckIsAPIOwner(revokedKeyHandler))
+		Muxer.HandleFunc("/tyk/usage/", CheckIsAPIOwner(usageHandler))
+		Muxer.HandleFunc("/tyk/portal/requests", CheckIsAPIOwner(portalRequestHandler))
+		Muxer.HandleFunc("/tyk/portal/requests/", CheckIsAPIOwner(portalRequestHandler))
 		Muxer.HandleFunc("/tyk/keys/create", CheckIsAPIOwner(createKeyHandler))
+		Muxer.HandleFunc("/tyk/keys/import", CheckIsAPIOwner(keyImportHandler))
+		Muxer.HandleFunc("/tyk/keys/search", CheckIsAPIOwner(keySearchHandler))
+		Muxer.HandleFunc("/tyk/cluster/nodes", CheckIsAPIOwner(clusterNodesHandler))
+		Muxer.HandleFunc("/tyk/cluster/nodes/", CheckIsAPIOwner(clusterNodesHandler))
 		Muxer.HandleFunc("/tyk/apis/", CheckIsAPIOwner(apiHandler))
+		Muxer.HandleFunc("/tyk/health", CheckIsAPIOwner(healthCheckhandler))
 		Muxer.HandleFunc("/tyk/health/", CheckIsAPIOwner(healthCheckhandler))
 		Muxer.HandleFunc("/tyk/oauth/clients/create", CheckIsAPIOwner(createOauthClient))
 	} else {
@@ -184,6 +288,13 @@ func loadAPIEndpoints(Muxer *http.ServeMux) {
 
 	Muxer.HandleFunc("/tyk/keys/", CheckIsAPIOwner(keyHandler))
 	Muxer.HandleFunc("/tyk/oauth/clients/", CheckIsAPIOwner(oAuthClientHandler))
+	Muxer.HandleFunc("/tyk/chain/", CheckIsAPIOwner(chainHandler))
+	Muxer.HandleFunc("/tyk/openapi/", CheckIsAPIOwner(openAPIHandler))
+	Muxer.HandleFunc("/tyk/drain", CheckIsAPIOwner(drainHandler))
+	Muxer.HandleFunc("/tyk/debug", CheckIsAPIOwner(debugHandler))
+
+	// Load balancer health check, not authenticated
+	Muxer.HandleFunc("/tyk/node/health", nodeHealthHandler)
 }
 
 // Create API-specific OAuth handlers and respective auth servers
@@ -217,7 +328,8 @@ func addOAuthHandlers(spec *APISpec, Muxer *http.ServeMux, test bool) *OAuthMana
 	osinServer := TykOsinNewServer(serverConfig, osinStorage)
 	osinServer.AccessTokenGen = &AccessTokenGenTyk{}
 
-	oauthManager := OAuthManager{spec, osinServer}
+	thisFlow := GetOAuthFlowConfig(spec)
+	oauthManager := OAuthManager{API: spec, OsinServer: osinServer, Flow: thisFlow, ConsentHook: newOAuthConsentHook(thisFlow)}
 	oauthHandlers := OAuthHandlers{oauthManager}
 
 	Muxer.HandleFunc(apiAuthorizePath, CheckIsAPIOwner(oauthHandlers.HandleGenerateAuthCodeData))
@@ -232,6 +344,8 @@ func addBatchEndpoint(spec *APISpec, Muxer *http.ServeMux) {
 	apiBatchPath := spec.Proxy.ListenPath + "tyk/batch/"
 	thisBatchHandler := BatchRequestHandler{API: spec}
 	Muxer.HandleFunc(apiBatchPath, thisBatchHandler.HandleBatchRequest)
+	// The mux would otherwise redirect, and a redirected POST loses its body
+	Muxer.HandleFunc(strings.TrimSuffix(apiBatchPath, "/"), thisBatchHandler.HandleBatchRequest)
 }
 
 func loadCustomMiddleware(referenceSpec *APISpec) ([]string, []tykcommon.MiddlewareDefinition, []tykcommon.MiddlewareDefinition) {
@@ -239,6 +353,14 @@ func loadCustomMiddleware(referenceSpec *APISpec) ([]string, []tykcommon.Middlew
 	mwPreFuncs := []tykcommon.MiddlewareDefinition{}
 	mwPostFuncs := []tykcommon.MiddlewareDefinition{}
 
+	// Global pre middleware come first
+	globalPreFuncs, globalPostFuncs := getGlobalMiddleware(referenceSpec)
+	for _, mwObj := range globalPreFuncs {
+		mwPaths = append(mwPaths, mwObj.Path)
+		mwPreFuncs = append(mwPreFuncs, mwObj)
+		log.Debug("Loading global PRE-PROCESSOR middleware: ", mwObj.Name)
+	}
+
 	// Load form the configuration
 	for _, mwObj := range referenceSpec.APIDefinition.CustomMiddleware.Pre {
 		mwPaths = append(mwPaths, mwObj.Path)
@@ -271,7 +393,7 @@ func loadCustomMiddleware(referenceSpec *APISpec) ([]string, []tykcommon.Middlew
 			thisMWDef.RequireSession = requiresSession
 
 			mwPaths = append(mwPaths, filePath)
-			mwPreFuncs = append(mwPostFuncs, thisMWDef)
+			mwPreFuncs = append(mwPreFuncs, thisMWDef)
 		}
 	}
 
@@ -293,7 +415,31 @@ func loadCustomMiddleware(referenceSpec *APISpec) ([]string, []tykcommon.Middlew
 			thisMWDef.RequireSession = requiresSession
 
 			mwPaths = append(mwPaths, filePath)
-			mwPreFuncs = append(mwPreFuncs, thisMWDef)
+			mwPostFuncs = append(mwPostFuncs, thisMWDef)
+		}
+	}
+
+	// Global post middleware come last
+	for _, mwObj := range globalPostFuncs {
+		mwPaths = append(mwPaths, mwObj.Path)
+		mwPostFuncs = append(mwPostFuncs, mwObj)
+		log.Debug("Loading global POST-PROCESSOR middleware: ", mwObj.Name)
+	}
+
+	// The other hook points are only set in the definition, their middleware is built where it runs
+	thisHooks, supported := GetMiddlewareHooks(referenceSpec)
+	if supported {
+		if thisHooks.AuthCheck.Name != "" {
+			mwPaths = append(mwPaths, thisHooks.AuthCheck.Path)
+			log.Debug("Loading custom AUTH-CHECK middleware: ", thisHooks.AuthCheck.Name)
+		}
+		for _, mwObj := range thisHooks.PostKeyAuth {
+			mwPaths = append(mwPaths, mwObj.Path)
+			log.Debug("Loading custom POST-KEY-AUTH middleware: ", mwObj.Name)
+		}
+		for _, mwObj := range thisHooks.Response {
+			mwPaths = append(mwPaths, mwObj.Path)
+			log.Debug("Loading custom RESPONSE middleware: ", mwObj.Name)
 		}
 	}
 
@@ -315,26 +461,33 @@ func creeateResponseMiddlewareChain(referenceSpec *APISpec) {
 		log.Debug("Loading Response processor: ", processorDetail.Name)
 		responseChain[i] = thisProcessor
 	}
-	referenceSpec.ResponseChain = &responseChain
-}
 
-func handleCORS(chain *[]alice.Constructor, spec *APISpec) {
-
-	if spec.CORS.Enable {
-		log.Debug("CORS ENABLED")
-		c := cors.New(cors.Options{
-			AllowedOrigins:     spec.CORS.AllowedOrigins,
-			AllowedMethods:     spec.CORS.AllowedMethods,
-			AllowedHeaders:     spec.CORS.AllowedHeaders,
-			ExposedHeaders:     spec.CORS.ExposedHeaders,
-			AllowCredentials:   spec.CORS.AllowCredentials,
-			MaxAge:             spec.CORS.MaxAge,
-			OptionsPassthrough: spec.CORS.OptionsPassthrough,
-			Debug:              spec.CORS.Debug,
-		})
+	if HasSOAPPaths(referenceSpec) {
+		log.Debug("Loading SOAP response processor")
+		soapProcessor, _ := SOAPResponseHandler{}.New(nil, referenceSpec)
+		// Unwrap first so the other processors see JSON
+		responseChain = append([]TykResponseHandler{soapProcessor}, responseChain...)
+	}
 
-		*chain = append(*chain, c.Handler)
+	if thisHooks, supported := GetMiddlewareHooks(referenceSpec); supported {
+		for _, mwObj := range thisHooks.Response {
+			hookProcessor, err := JSVMResponseHook{}.New(mwObj.Name, referenceSpec)
+			if err != nil {
+				log.Error("Failed to load JSVM response middleware: ", err)
+				continue
+			}
+			log.Debug("Loading JSVM response middleware: ", mwObj.Name)
+			responseChain = append(responseChain, hookProcessor)
+		}
 	}
+
+	if GetResponseCompressionConfig(referenceSpec).Enabled {
+		log.Debug("Loading response compression processor")
+		compressionProcessor, _ := ResponseCompressionHandler{}.New(nil, referenceSpec)
+		// Last so the other processors see the plain body
+		responseChain = append(responseChain, compressionProcessor)
+	}
+	referenceSpec.ResponseChain = &responseChain
 }
 
 func IsRPCMode() bool {
@@ -346,43 +499,185 @@ func IsRPCMode() bool {
 	return false
 }
 
+// buildAPIChain adds the middleware of an API to the chain in order, keyless APIs skip the auth
+// and session checks
+func buildAPIChain(chainBuilder *ChainBuilder, spec *APISpec, tykMiddleware *TykMiddleware, cacheStore StorageHandler, authChain []TykMiddlewareImplementation, mwPreFuncs []tykcommon.MiddlewareDefinition, mwPostFuncs []tykcommon.MiddlewareDefinition) {
+	handleSecurityHeaders(chainBuilder, spec)
+	handleCORS(chainBuilder, spec)
+
+	var baseChainArray = []TykMiddlewareImplementation{
+		&HeaderDenyMiddleware{TykMiddleware: tykMiddleware},
+		&TenantDomainMiddleware{TykMiddleware: tykMiddleware},
+		&IPWhiteListMiddleware{TykMiddleware: tykMiddleware},
+		&AnonymousRateLimit{TykMiddleware: tykMiddleware},
+		&OrganizationMonitor{TykMiddleware: tykMiddleware},
+		&VersionCheck{TykMiddleware: tykMiddleware},
+	}
+
+	entries := []chainEntry{}
+	for _, obj := range mwPreFuncs {
+		entries = append(entries, dynamicChainEntry(obj, MW_HOOK_PRE))
+	}
+
+	for _, baseMw := range baseChainArray {
+		entries = append(entries, builtinChainEntry(baseMw))
+	}
+
+	if !spec.APIDefinition.UseKeylessAccess {
+		for _, authMw := range authChain {
+			entries = append(entries, builtinChainEntry(authMw))
+		}
+
+		if thisHooks, supported := GetMiddlewareHooks(spec); supported {
+			for _, obj := range thisHooks.PostKeyAuth {
+				entries = append(entries, dynamicChainEntry(obj.Definition(), MW_HOOK_POST_KEY_AUTH))
+			}
+		}
+
+		for _, sessionMw := range []TykMiddlewareImplementation{
+			&KeyExpired{tykMiddleware},
+			&KeyIPRestriction{tykMiddleware},
+			&AccessRightsCheck{tykMiddleware},
+			&RateLimitAndQuotaCheck{tykMiddleware},
+		} {
+			entries = append(entries, builtinChainEntry(sessionMw))
+		}
+	}
+
+	for _, baseMw := range []TykMiddlewareImplementation{
+		&ConcurrencyLimit{TykMiddleware: tykMiddleware},
+		&ValidateJSON{TykMiddleware: tykMiddleware},
+		&TransformMiddleware{tykMiddleware},
+		&SOAPTransform{TykMiddleware: tykMiddleware},
+		&TransformHeaders{TykMiddleware: tykMiddleware},
+		&RedisCacheMiddleware{TykMiddleware: tykMiddleware, CacheStore: cacheStore},
+		&VirtualEndpoint{TykMiddleware: tykMiddleware},
+		&URLRewriteMiddleware{TykMiddleware: tykMiddleware},
+		&MethodTransform{TykMiddleware: tykMiddleware},
+		&TrafficMirror{TykMiddleware: tykMiddleware},
+	} {
+		entries = append(entries, builtinChainEntry(baseMw))
+	}
+
+	for _, obj := range mwPostFuncs {
+		entries = append(entries, dynamicChainEntry(obj, MW_HOOK_POST))
+	}
+
+	for _, entry := range orderChainEntries(spec, entries, authChain) {
+		if entry.builtin != nil {
+			chainBuilder.AddMiddleware(entry.builtin)
+		} else {
+			chainBuilder.AddDynamicMiddleware(entry.dynamic, entry.object.Type)
+		}
+	}
+}
+
+// rateLimitsPath is where a key can read its own rate limits and quotas, the route covers every path
+// under it
+func rateLimitsPath(spec *APISpec) string {
+	return spec.Proxy.ListenPath + "tyk/rate-limits/"
+}
+
+// getApiSpecs returns the loaded APIs, the map must not be changed
+func getApiSpecs() map[string]*APISpec {
+	apiSpecRegisterLock.RLock()
+	defer apiSpecRegisterLock.RUnlock()
+	return ApiSpecRegister
+}
+
+// setApiSpecs replaces the loaded APIs
+func setApiSpecs(specs map[string]*APISpec) {
+	apiSpecRegisterLock.Lock()
+	ApiSpecRegister = specs
+	apiSpecRegisterLock.Unlock()
+}
+
+// specKeyStore is the key store of an API, isolated APIs keep their keys in their own namespace
+func specKeyStore(spec *APISpec, keyStore StorageHandler) StorageHandler {
+	isolation := GetStorageIsolationConfig(spec)
+	if isolation.IsIsolated() {
+		return isolation.keyStore("apikey-", config.HashKeys)
+	}
+
+	return keyStore
+}
+
+// specSessionStore is the store an API keeps its sessions in
+func specSessionStore(spec *APISpec, apiKeyStore StorageHandler) StorageHandler {
+	SessionStorageEngineToUse := spec.SessionProvider.StorageEngine
+	// if config.SlaveOptions.OverrideDefinitionStorageSettings {
+	// 	SessionStorageEngineToUse = RPCStorageEngine
+	// }
+
+	switch SessionStorageEngineToUse {
+	case DefaultStorageEngine:
+		return apiKeyStore
+
+	case RPCStorageEngine:
+		return &RPCStorageHandler{KeyPrefix: "apikey-", HashKeys: config.HashKeys, UserKey: config.SlaveOptions.APIKey, Address: config.SlaveOptions.ConnectionString}
+	}
+
+	return apiKeyStore
+}
+
 // Create the individual API (app) specs based on live configurations and assign middleware
 func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 	// load the APi defs
 	log.Debug("Loading API configurations.")
 
 	// Only create this once, add other types here as needed, seems wasteful but we can let the GC handle it
-	redisStore := RedisClusterStorageManager{KeyPrefix: "apikey-", HashKeys: config.HashKeys}
-	redisOrgStore := RedisClusterStorageManager{KeyPrefix: "orgkey."}
-
-	listenPaths := make(map[string]bool)
+	keyStore := NewKeyStorageHandler("apikey-", config.HashKeys)
+	orgKeyStore := NewKeyStorageHandler("orgkey.", false)
+
+	skippedAPIs := checkListenPaths(APISpecs)
+	// The register is swapped once every API is loaded, requests read it while this runs
+	newApiSpecRegister := make(map[string]*APISpec)
+	for APIID, spec := range getApiSpecs() {
+		newApiSpecRegister[APIID] = spec
+	}
+	newInternalAPIs := make(map[string]internalAPI)
+	routes := newListenPathRoutes()
 
 	// Create a new handler for each API spec
 	for apiIndex, _ := range APISpecs {
-		var skip bool
 		// We need a reference to this as we change it on the go and re-use it in a global index
 		referenceSpec := APISpecs[apiIndex]
 		log.Info("--> Loading API: ", referenceSpec.APIDefinition.Name)
 
-		_, listenPathExists := listenPaths[referenceSpec.Proxy.ListenPath]
-		if listenPathExists {
-			log.Error("Duplicate listen path found, skipping. API ID: ", referenceSpec.APIID)
-			skip = true
-		}
+		skip := skippedAPIs[apiIndex]
 
 		remote, err := url.Parse(referenceSpec.APIDefinition.Proxy.TargetURL)
 		if err != nil {
 			log.Error("Culdn't parse target URL: ", err)
 		}
 
+		if !skip && referenceSpec.SecretsErr != nil {
+			log.Error("Couldn't resolve the secrets of API ", referenceSpec.APIID, ", skipping: ", referenceSpec.SecretsErr)
+			skip = true
+		}
+
+		if !skip && referenceSpec.StreamingErr != nil {
+			log.Error("Couldn't honour the streaming configuration of API ", referenceSpec.APIID, ", skipping: ", referenceSpec.StreamingErr)
+			skip = true
+		}
+
+		if !skip {
+			if bundleErr := loadBundle(&referenceSpec); bundleErr != nil {
+				log.Error("Couldn't load the bundle of API ", referenceSpec.APIID, ", skipping: ", bundleErr)
+				skip = true
+			}
+		}
+
 		if !skip {
 
-			listenPaths[referenceSpec.Proxy.ListenPath] = true
 			// Initialise the auth and session managers (use Redis for now)
 			var authStore StorageHandler
 			var sessionStore StorageHandler
 			var orgStore StorageHandler
 
+			apiKeyStore := specKeyStore(&referenceSpec, keyStore)
+			isolation := GetStorageIsolationConfig(&referenceSpec)
+
 			authStorageEngineToUse := referenceSpec.AuthProvider.StorageEngine
 			// if config.SlaveOptions.OverrideDefinitionStorageSettings {
 			// 	authStorageEngineToUse = RPCStorageEngine
@@ -390,13 +685,13 @@ func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 
 			switch authStorageEngineToUse {
 			case DefaultStorageEngine:
-				authStore = &redisStore
-				orgStore = &redisOrgStore
+				authStore = apiKeyStore
+				orgStore = orgKeyStore
 			case LDAPStorageEngine:
 				thisStorageEngine := LDAPStorageHandler{}
 				thisStorageEngine.LoadConfFromMeta(referenceSpec.AuthProvider.Meta)
 				authStore = &thisStorageEngine
-				orgStore = &redisOrgStore
+				orgStore = orgKeyStore
 			case RPCStorageEngine:
 				thisStorageEngine := &RPCStorageHandler{KeyPrefix: "apikey-", HashKeys: config.HashKeys, UserKey: config.SlaveOptions.APIKey, Address: config.SlaveOptions.ConnectionString}
 				authStore = thisStorageEngine
@@ -405,29 +700,20 @@ func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 				config.EnforceOrgQuotas = true
 
 			default:
-				authStore = &redisStore
-				orgStore = &redisOrgStore
+				authStore = apiKeyStore
+				orgStore = orgKeyStore
 			}
 
-			SessionStorageEngineToUse := referenceSpec.SessionProvider.StorageEngine
-			// if config.SlaveOptions.OverrideDefinitionStorageSettings {
-			// 	SessionStorageEngineToUse = RPCStorageEngine
-			// }
-
-			switch SessionStorageEngineToUse {
-			case DefaultStorageEngine:
-				sessionStore = &redisStore
-
-			case RPCStorageEngine:
-				sessionStore = &RPCStorageHandler{KeyPrefix: "apikey-", HashKeys: config.HashKeys, UserKey: config.SlaveOptions.APIKey, Address: config.SlaveOptions.ConnectionString}
-			default:
-				sessionStore = &redisStore
-			}
+			sessionStore = specSessionStore(&referenceSpec, apiKeyStore)
 
 			// Health checkers are initialised per spec so that each API handler has it's own connection and redis sotorage pool
-			healthStore := &RedisClusterStorageManager{KeyPrefix: "apihealth."}
+			healthStore := isolation.redisStore("apihealth.", false)
 			referenceSpec.Init(authStore, sessionStore, healthStore, orgStore)
 
+			if config.EnableAnalytics && isolation.IsIsolated() {
+				referenceSpec.Analytics = getIsolatedAnalytics(isolation)
+			}
+
 			//Set up all the JSVM middleware
 			mwPaths := []string{}
 			mwPreFuncs := []tykcommon.MiddlewareDefinition{}
@@ -459,117 +745,88 @@ func loadApps(APISpecs []APISpec, Muxer *http.ServeMux) {
 			tykMiddleware := &TykMiddleware{&referenceSpec, proxy}
 
 			keyPrefix := "cache-" + referenceSpec.APIDefinition.APIID
-			CacheStore := &RedisClusterStorageManager{KeyPrefix: keyPrefix}
+			CacheStore := isolation.redisStore(keyPrefix, false)
 			CacheStore.Connect()
 
 			if referenceSpec.APIDefinition.UseKeylessAccess {
 
-				// Add pre-process MW
-				var chainArray = []alice.Constructor{}
-				handleCORS(&chainArray, &referenceSpec)
-
-				var baseChainArray = []alice.Constructor{
-					CreateMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&TransformMiddleware{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&TransformHeaders{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&RedisCacheMiddleware{TykMiddleware: tykMiddleware, CacheStore: CacheStore}, tykMiddleware),
-					CreateMiddleware(&VirtualEndpoint{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&URLRewriteMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
-				}
-
-				for _, obj := range mwPreFuncs {
-					chainArray = append(chainArray, CreateDynamicMiddleware(obj.Name, true, obj.RequireSession, tykMiddleware))
-				}
-
-				for _, baseMw := range baseChainArray {
-					chainArray = append(chainArray, baseMw)
-				}
-
-				for _, obj := range mwPostFuncs {
-					chainArray = append(chainArray, CreateDynamicMiddleware(obj.Name, false, obj.RequireSession, tykMiddleware))
-				}
+				chainBuilder := &ChainBuilder{TykMiddleware: tykMiddleware}
+				buildAPIChain(chainBuilder, &referenceSpec, tykMiddleware, CacheStore, nil, mwPreFuncs, mwPostFuncs)
 
 				// for KeyLessAccess we can't support rate limiting, versioning or access rules
-				chain := alice.New(chainArray...).Then(DummyProxyHandler{SH: SuccessHandler{tykMiddleware}})
-				Muxer.Handle(referenceSpec.Proxy.ListenPath, chain)
-
-			} else {
-
-				// Select the keying method to use for setting session states
-				var keyCheck func(http.Handler) http.Handler
-
-				if referenceSpec.APIDefinition.UseOauth2 {
-					// Oauth2
-					keyCheck = CreateMiddleware(&Oauth2KeyExists{tykMiddleware}, tykMiddleware)
-				} else if referenceSpec.APIDefinition.UseBasicAuth {
-					// Basic Auth
-					keyCheck = CreateMiddleware(&BasicAuthKeyIsValid{tykMiddleware}, tykMiddleware)
-				} else if referenceSpec.EnableSignatureChecking {
-					// HMAC Auth
-					keyCheck = CreateMiddleware(&HMACMiddleware{tykMiddleware}, tykMiddleware)
-				} else {
-					// Auth key
-					keyCheck = CreateMiddleware(&AuthKey{tykMiddleware}, tykMiddleware)
-				}
-
-				var chainArray = []alice.Constructor{}
-
-				handleCORS(&chainArray, &referenceSpec)
-				var baseChainArray = []alice.Constructor{
-					CreateMiddleware(&IPWhiteListMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
-					keyCheck,
-					CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&RateLimitAndQuotaCheck{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&GranularAccessMiddleware{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&TransformMiddleware{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&TransformHeaders{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&RedisCacheMiddleware{TykMiddleware: tykMiddleware, CacheStore: CacheStore}, tykMiddleware),
-					CreateMiddleware(&VirtualEndpoint{TykMiddleware: tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&URLRewriteMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
+				chain := chainBuilder.Then(DummyProxyHandler{SH: SuccessHandler{tykMiddleware}})
+				referenceSpec.MiddlewareChain = chainBuilder.Description
+				if config.SelfTelemetry.Enabled {
+					chain = TelemetryCountHandler(referenceSpec.APIID, chain)
 				}
+				chain = StreamingHandler(&referenceSpec, chain)
+				chain = ConcurrencyReleaseHandler(chain)
+				chain = InFlightHandler(chain)
+				chain = LoadSheddingHandler(tykMiddleware, chain)
+				chain = MaintenanceHandler(tykMiddleware, chain)
+				routes.Add(GetAPIDomain(&referenceSpec), referenceSpec.Proxy.ListenPath, chain)
+				addInternalAPI(newInternalAPIs, &referenceSpec, chain)
 
-				// Add pre-process MW
-				for _, obj := range mwPreFuncs {
-					chainArray = append(chainArray, CreateDynamicMiddleware(obj.Name, true, obj.RequireSession, tykMiddleware))
-				}
+			} else {
 
-				for _, baseMw := range baseChainArray {
-					chainArray = append(chainArray, baseMw)
-				}
+				// Select the keying method(s) to use for setting session states
+				authChain := BuildAuthChain(&referenceSpec, tykMiddleware)
 
-				for _, obj := range mwPostFuncs {
-					chainArray = append(chainArray, CreateDynamicMiddleware(obj.Name, false, obj.RequireSession, tykMiddleware))
-				}
+				chainBuilder := &ChainBuilder{TykMiddleware: tykMiddleware}
+				buildAPIChain(chainBuilder, &referenceSpec, tykMiddleware, CacheStore, authChain, mwPreFuncs, mwPostFuncs)
 
 				// Use CreateMiddleware(&ModifiedMiddleware{tykMiddleware}, tykMiddleware)  to run custom middleware
-				chain := alice.New(chainArray...).Then(DummyProxyHandler{SH: SuccessHandler{tykMiddleware}})
+				chain := chainBuilder.Then(DummyProxyHandler{SH: SuccessHandler{tykMiddleware}})
+				referenceSpec.MiddlewareChain = chainBuilder.Description
 
 				userCheckHandler := http.HandlerFunc(UserRatesCheck())
-				simpleChain := alice.New(
+				simpleChainArray := []alice.Constructor{}
+				if securityHeadersHandler := SecurityHeadersHandler(&referenceSpec); securityHeadersHandler != nil {
+					simpleChainArray = append(simpleChainArray, securityHeadersHandler)
+				}
+				if corsHandler := CORSHandler(&referenceSpec); corsHandler != nil {
+					simpleChainArray = append(simpleChainArray, corsHandler)
+				}
+				simpleChainArray = append(simpleChainArray,
+					CreateMiddleware(&HeaderDenyMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&TenantDomainMiddleware{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&IPWhiteListMiddleware{tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&OrganizationMonitor{TykMiddleware: tykMiddleware}, tykMiddleware),
 					CreateMiddleware(&VersionCheck{TykMiddleware: tykMiddleware}, tykMiddleware),
-					keyCheck,
+				)
+				for _, authMw := range authChain {
+					simpleChainArray = append(simpleChainArray, CreateMiddleware(authMw, tykMiddleware))
+				}
+				simpleChainArray = append(simpleChainArray,
 					CreateMiddleware(&KeyExpired{tykMiddleware}, tykMiddleware),
-					CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware)).Then(userCheckHandler)
+					CreateMiddleware(&KeyIPRestriction{tykMiddleware}, tykMiddleware),
+					CreateMiddleware(&AccessRightsCheck{tykMiddleware}, tykMiddleware))
+				simpleChain := alice.New(simpleChainArray...).Then(userCheckHandler)
 
-				rateLimitPath := fmt.Sprintf("%s%s", referenceSpec.Proxy.ListenPath, "tyk/rate-limits/")
+				rateLimitPath := rateLimitsPath(&referenceSpec)
 				log.Debug("Rate limits available at: ", rateLimitPath)
-				Muxer.Handle(rateLimitPath, simpleChain)
-				Muxer.Handle(referenceSpec.Proxy.ListenPath, chain)
+				routes.Add(GetAPIDomain(&referenceSpec), rateLimitPath, simpleChain)
+				if config.SelfTelemetry.Enabled {
+					chain = TelemetryCountHandler(referenceSpec.APIID, chain)
+				}
+				chain = StreamingHandler(&referenceSpec, chain)
+				chain = ConcurrencyReleaseHandler(chain)
+				chain = InFlightHandler(chain)
+				chain = LoadSheddingHandler(tykMiddleware, chain)
+				chain = MaintenanceHandler(tykMiddleware, chain)
+				routes.Add(GetAPIDomain(&referenceSpec), referenceSpec.Proxy.ListenPath, chain)
+				addInternalAPI(newInternalAPIs, &referenceSpec, chain)
 			}
 
-			ApiSpecRegister[referenceSpec.APIDefinition.APIID] = &referenceSpec
+			newApiSpecRegister[referenceSpec.APIDefinition.APIID] = &referenceSpec
 
 		}
 
 	}
 
+	setApiSpecs(newApiSpecRegister)
+	routes.Register(Muxer)
+	setInternalAPIs(newInternalAPIs)
 }
 
 func RPCReloadLoop(RPCKey string) {
@@ -600,6 +857,12 @@ func ReloadURLStructure() {
 
 	http.DefaultServeMux = newMuxes
 	log.Info("API reload complete")
+
+	if Nodes != nil {
+		Nodes.MarkReloaded()
+	}
+
+	RunHooks(HOOK_Reload, config.Hooks.OnReload)
 }
 
 func init() {
@@ -608,6 +871,7 @@ func init() {
 
 	Usage:
 		tyk [options]
+		tyk bench [options]
 
 	Options:
 		-h --help                    Show this screen
@@ -623,6 +887,12 @@ func init() {
 		--as-mock                    Creates the API as a mock based on example fields
 		--for-api=<path>             Adds blueprint to existing API Defintition as version
 		--as-version=<version>       The version number to use when inserting
+		--bench-target=<url>         The local API URL to send requests to (bench mode)
+		--bench-template=<file>      A JSON request template to replay (bench mode)
+		--concurrency=<n>            Number of concurrent clients, defaults to 10 (bench mode)
+		--requests=<n>               Total number of requests to send, defaults to 1000 (bench mode)
+		--import-keys=<file>         Import keys from a JSON or CSV file into the session store
+		--overwrite                  Replace keys that already exist when importing keys
 	`
 
 	arguments, err := docopt.Parse(usage, nil, true, VERSION, false, false)
@@ -658,8 +928,11 @@ func init() {
 
 	loadConfig(filename, &config)
 
-	if config.Storage.Type != "redis" {
-		log.Fatal("Redis connection details not set, please ensure that the storage type is set to Redis and that the connection parameters are correct.")
+	if configErrors := validateConfigFile(filename, &config); len(configErrors) > 0 {
+		for _, configError := range configErrors {
+			log.Error("Invalid configuration: ", configError)
+		}
+		log.Fatal(fmt.Sprintf("Found %d problem(s) in the configuration, please fix them and restart.", len(configErrors)))
 	}
 
 	setupGlobals()
@@ -752,6 +1025,14 @@ func main() {
 
 	loadAPIEndpoints(http.DefaultServeMux)
 
+	if config.GitSource.Enabled {
+		StartGitSource()
+	}
+
+	if config.KubernetesSource.Enabled {
+		StartKubernetesSource()
+	}
+
 	// Start listening for reload messages
 	if !config.SuppressRedisSignalReload {
 		go StartPubSubLoop()
@@ -774,7 +1055,7 @@ func main() {
 	l, err := goagain.Listener()
 	if nil != err {
 
-		// Listen on a TCP or a UNIX domain socket (TCP here).
+		// Listen on a TCP or a UNIX domain socket, or use a socket passed by systemd
 		log.Info("Setting up Server")
 		if config.HttpServerOptions.UseSSL {
 			log.Warning("--> Using SSL (https)")
@@ -792,32 +1073,46 @@ func main() {
 			config := tls.Config{
 				Certificates:      certs,
 				NameToCertificate: certNameMap,
+				GetCertificate:    GetCertificateForHost(certNameMap, certs),
 				ServerName:        config.HttpServerOptions.ServerName,
 				MinVersion:        config.HttpServerOptions.MinVersion,
+				ClientCAs:         loadClientCAs(config.HttpServerOptions.ClientCAFile),
+			}
+			if config.ClientCAs != nil {
+				// Certificates are optional at the TLS level, APIs using mtls require them
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			l, err = getListener(targetPort)
+			if err == nil {
+				l = tls.NewListener(l, &config)
 			}
-			l, err = tls.Listen("tcp", targetPort, &config)
 		} else {
 			log.Warning("--> Standard listener (http)")
-			l, err = net.Listen("tcp", targetPort)
+			l, err = getListener(targetPort)
+		}
+
+		if err != nil {
+			log.Fatal("Couldn't start listener: ", err)
 		}
 
 		// Accept connections in a new goroutine.
 		specs := getAPISpecs()
 		loadApps(specs, http.DefaultServeMux)
 		getPolicies()
+		RunHooks(HOOK_Startup, config.Hooks.OnStartup)
 
 		// Use a custom server so we can control keepalives
 		if config.HttpServerOptions.OverrideDefaults {
 			log.Info("Custom gateway started")
 			log.Warning("HTTP Server Overrides detected, this could destabilise long-running http-requests")
+			// The write timeout is applied per request so that it can be lifted for SSE
 			s := &http.Server{
-				Addr:         ":" + targetPort,
-				ReadTimeout:  time.Duration(ReadTimeout) * time.Second,
-				WriteTimeout: time.Duration(WriteTimeout) * time.Second,
-				Handler:      http.DefaultServeMux,
+				Addr:        ":" + targetPort,
+				ReadTimeout: time.Duration(ReadTimeout) * time.Second,
+				Handler:     WriteTimeoutHandler(time.Duration(WriteTimeout)*time.Second, http.DefaultServeMux),
 			}
 
-			go s.Serve(l)
+			go s.Serve(newTrackedListener(l))
 			displayConfig()
 		} else {
 			log.Printf("Gateway started (%v)", VERSION)
@@ -832,18 +1127,19 @@ func main() {
 		specs := getAPISpecs()
 		loadApps(specs, http.DefaultServeMux)
 		getPolicies()
+		RunHooks(HOOK_Startup, config.Hooks.OnStartup)
 
 		if config.HttpServerOptions.OverrideDefaults {
 			log.Warning("HTTP Server Overrides detected, this could destabilise long-running http-requests")
+			// The write timeout is applied per request so that it can be lifted for SSE
 			s := &http.Server{
-				Addr:         ":" + targetPort,
-				ReadTimeout:  time.Duration(ReadTimeout) * time.Second,
-				WriteTimeout: time.Duration(WriteTimeout) * time.Second,
-				Handler:      http.DefaultServeMux,
+				Addr:        ":" + targetPort,
+				ReadTimeout: time.Duration(ReadTimeout) * time.Second,
+				Handler:     WriteTimeoutHandler(time.Duration(WriteTimeout)*time.Second, http.DefaultServeMux),
 			}
 
 			log.Info("Custom gateway started")
-			go s.Serve(l)
+			go s.Serve(newTrackedListener(l))
 			displayConfig()
 		} else {
 			log.Printf("Gateway started (%v)", VERSION)
@@ -1,8 +1,10 @@
 package main
 
-import "net/http"
-
-import ()
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"time"
+)
 
 type TykMiddlewareImplementation interface {
 	New()
@@ -16,6 +18,10 @@ func CreateDynamicMiddleware(MiddlewareName string, IsPre, UseSession bool, tykM
 		MiddlewareClassName: MiddlewareName,
 		Pre:                 IsPre,
 		UseSession:          UseSession,
+		Hook:                MW_HOOK_POST,
+	}
+	if IsPre {
+		dMiddleware.Hook = MW_HOOK_PRE
 	}
 
 	return CreateMiddleware(dMiddleware, tykMwSuper)
@@ -35,11 +41,23 @@ func CreateMiddleware(mw TykMiddlewareImplementation, tykMwSuper *TykMiddleware)
 		//handler.HandleError(w, r, confErr.Error(), 403)
 	}
 
+	thisName := middlewareName(mw)
+	skipWhenStreaming := skipsWhenStreaming(mw)
+
 	aliceHandler := func(h http.Handler) http.Handler {
 		thisHandler := func(w http.ResponseWriter, r *http.Request) {
+			if skipWhenStreaming && isStreamingRequest(r) {
+				h.ServeHTTP(w, r)
+				return
+			}
 
+			t1 := time.Now()
 			reqErr, errCode := mw.ProcessRequest(w, r, thisMwConfiguration)
+			if GetOrgConfig(tykMwSuper.Spec).MiddlewareTimingsEnabled() {
+				recordMiddlewareTiming(r, thisName, time.Since(t1))
+			}
 			if reqErr != nil {
+				context.Set(r, MiddlewareError, reqErr)
 				handler := ErrorHandler{tykMwSuper}
 				handler.HandleError(w, r, reqErr.Error(), errCode)
 				return
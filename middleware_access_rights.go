@@ -6,6 +6,9 @@ import (
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 // AccessRightsCheck is a middleware that will check if the key bing used to access the API has
@@ -27,7 +30,7 @@ func (a *AccessRightsCheck) GetConfig() (interface{}, error) {
 func (a *AccessRightsCheck) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
 	accessingVersion := a.Spec.getVersionFromRequest(r)
 	thisSessionState := context.Get(r, SessionData).(SessionState)
-	authHeaderValue := context.Get(r, AuthHeaderValue)
+	authHeaderValue, _ := context.Get(r, AuthHeaderValue).(string)
 
 	// If there's nothing in our profile, we let them through to the next phase
 	if len(thisSessionState.AccessRights) > 0 {
@@ -36,8 +39,8 @@ func (a *AccessRightsCheck) ProcessRequest(w http.ResponseWriter, r *http.Reques
 		if !apiExists {
 			log.WithFields(logrus.Fields{
 				"path":      r.URL.Path,
-				"origin":    r.RemoteAddr,
-				"key":       authHeaderValue,
+				"origin":    GetIPFromRequest(r),
+				"key":       a.Spec.LogMasking.MaskKey(authHeaderValue),
 				"api_found": false,
 			}).Info("Attempted access to unauthorised API.")
 
@@ -62,15 +65,80 @@ func (a *AccessRightsCheck) ProcessRequest(w http.ResponseWriter, r *http.Reques
 			// Not found? Bounce
 			log.WithFields(logrus.Fields{
 				"path":          r.URL.Path,
-				"origin":        r.RemoteAddr,
-				"key":           authHeaderValue,
+				"origin":        GetIPFromRequest(r),
+				"key":           a.Spec.LogMasking.MaskKey(authHeaderValue),
 				"api_found":     true,
 				"version_found": false,
 			}).Info("Attempted access to unauthorised API version.")
 
 			return errors.New("Access to this API has been disallowed"), 403
 		}
+
+		// A key can be limited to some paths and methods of the API, its rate limits can still be read
+		if !strings.HasPrefix(r.URL.Path, rateLimitsPath(a.Spec)) && !isURLAllowed(versionList.AllowedURLs, r) {
+			log.WithFields(logrus.Fields{
+				"path":      r.URL.Path,
+				"method":    r.Method,
+				"origin":    GetIPFromRequest(r),
+				"key":       a.Spec.LogMasking.MaskKey(authHeaderValue),
+				"api_found": true,
+			}).Info("Attempted access to unauthorised endpoint (Granular).")
+
+			return errors.New("Access to this resource has been disallowed"), 403
+		}
 	}
 
 	return nil, 200
 }
+
+// Compiled allowed_urls patterns, these are shared by many keys so they are only compiled once
+var allowedURLPatterns = make(map[string]*regexp.Regexp)
+var allowedURLPatternsLock sync.RWMutex
+
+func getAllowedURLPattern(pattern string) (*regexp.Regexp, error) {
+	allowedURLPatternsLock.RLock()
+	asRegex, found := allowedURLPatterns[pattern]
+	allowedURLPatternsLock.RUnlock()
+	if found {
+		return asRegex, nil
+	}
+
+	asRegex, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedURLPatternsLock.Lock()
+	allowedURLPatterns[pattern] = asRegex
+	allowedURLPatternsLock.Unlock()
+
+	return asRegex, nil
+}
+
+// isURLAllowed checks a request against the allowed_urls of a key, an empty list allows everything.
+// Entries with an invalid pattern never match
+func isURLAllowed(allowedURLs []AccessSpec, r *http.Request) bool {
+	if len(allowedURLs) == 0 {
+		return true
+	}
+
+	for _, accessSpec := range allowedURLs {
+		asRegex, err := getAllowedURLPattern(accessSpec.URL)
+		if err != nil {
+			log.Error("Regex error: ", err)
+			continue
+		}
+
+		if !asRegex.MatchString(r.URL.Path) {
+			continue
+		}
+
+		for _, method := range accessSpec.Methods {
+			if strings.EqualFold(method, r.Method) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
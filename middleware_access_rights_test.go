@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsURLAllowed(t *testing.T) {
+	readOnly := []AccessSpec{
+		{URL: "^/widgets", Methods: []string{"GET", "head"}},
+		{URL: "(invalid", Methods: []string{"POST"}},
+	}
+
+	get, _ := http.NewRequest("GET", "http://tyk/widgets/1", nil)
+	head, _ := http.NewRequest("HEAD", "http://tyk/widgets/1", nil)
+	post, _ := http.NewRequest("POST", "http://tyk/widgets/1", nil)
+	other, _ := http.NewRequest("GET", "http://tyk/gadgets/1", nil)
+
+	if !isURLAllowed(readOnly, get) || !isURLAllowed(readOnly, head) {
+		t.Error("Read access should be allowed")
+	}
+
+	if isURLAllowed(readOnly, post) {
+		t.Error("Write access should be denied, invalid patterns must not match")
+	}
+
+	if isURLAllowed(readOnly, other) {
+		t.Error("Unlisted paths should be denied")
+	}
+
+	if !isURLAllowed([]AccessSpec{}, post) {
+		t.Error("Keys without allowed URLs should have full access")
+	}
+}
+
+func TestAllowedURLsDontApplyToRateLimits(t *testing.T) {
+	spec := createDefinitionFromString(nonExpiringDef)
+	check := &AccessRightsCheck{&TykMiddleware{&spec, nil}}
+
+	thisSession := createNonThrottledSession()
+	thisSession.AccessRights = map[string]AccessDefinition{
+		"1": {
+			APIID:       "1",
+			Versions:    []string{"v1"},
+			AllowedURLs: []AccessSpec{{URL: "^/v1/widgets", Methods: []string{"GET"}}},
+		},
+	}
+
+	for _, test := range []struct {
+		path string
+		code int
+	}{
+		{"/v1/widgets", 200},
+		{"/v1/gadgets", 403},
+		{rateLimitsPath(&spec), 200},
+	} {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.Header.Set("version", "v1")
+		context.Set(req, SessionData, thisSession)
+		context.Set(req, AuthHeaderValue, "1234")
+
+		if _, errCode := check.ProcessRequest(httptest.NewRecorder(), req, nil); errCode != test.code {
+			t.Error("Expected ", test.code, " for ", test.path, " got ", errCode)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+)
+
+const AnonRateLimitKeyPrefix string = "anon-rate-limit-"
+
+// AnonymousRateLimitConfig limits requests by client IP (scope "ip", the default) or across all
+// clients of the API (scope "global"), Rate requests are allowed Per seconds
+type AnonymousRateLimitConfig struct {
+	Rate  float64 `mapstructure:"rate" bson:"rate" json:"rate"`
+	Per   float64 `mapstructure:"per" bson:"per" json:"per"`
+	Scope string  `mapstructure:"scope" bson:"scope" json:"scope"`
+}
+
+type AnonymousRateLimitModuleConfig struct {
+	AnonymousRateLimit AnonymousRateLimitConfig `mapstructure:"anonymous_rate_limit" bson:"anonymous_rate_limit" json:"anonymous_rate_limit"`
+}
+
+// AnonymousRateLimit is a rate limiter that does not need a key, it protects keyless APIs and
+// acts as a backstop for keyed APIs as it runs before authentication
+type AnonymousRateLimit struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (a *AnonymousRateLimit) New() {
+	if GetAdaptiveRateLimitConfig(a.Spec).Enabled && !config.HealthCheck.EnableHealthChecks {
+		log.Warning("Adaptive rate limit of API ", a.Spec.APIID, " needs health checks to be enabled, the configured rate will be used")
+	}
+}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (a *AnonymousRateLimit) GetConfig() (interface{}, error) {
+	var thisModuleConfig AnonymousRateLimitModuleConfig
+
+	err := mapstructure.Decode(a.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return thisModuleConfig.AnonymousRateLimit, nil
+}
+
+// getAnonRateLimitKey generates the rolling window key for a request
+func getAnonRateLimitKey(APIID string, scope string, r *http.Request) string {
+	if scope == "global" {
+		return AnonRateLimitKeyPrefix + APIID + "-global"
+	}
+
+	return AnonRateLimitKeyPrefix + APIID + "-" + GetIPFromRequest(r)
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (a *AnonymousRateLimit) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(AnonymousRateLimitConfig)
+
+	// Disabled, pass through
+	if thisConfig.Rate <= 0 || thisConfig.Per <= 0 {
+		return nil, 200
+	}
+
+	// An unhealthy upstream lowers the ceiling, see AdaptiveRateLimitConfig
+	rate := adaptedRate(thisConfig.Rate, a.Spec.APIID)
+
+	rateLimiterKey := getAnonRateLimitKey(a.Spec.APIID, thisConfig.Scope, r)
+	ratePerPeriodNow := a.Spec.SessionManager.GetStore().SetRollingWindow(rateLimiterKey, int64(thisConfig.Per), int64(thisConfig.Per))
+
+	// Subtract by 1 because of the delayed add in the window
+	if ratePerPeriodNow > (int(rate) - 1) {
+		origin := GetIPFromRequest(r)
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": origin,
+			"scope":  thisConfig.Scope,
+		}).Info("Anonymous rate limit exceeded.")
+
+		go a.TykMiddleware.FireEvent(EVENT_RateLimitExceeded,
+			EVENT_RateLimitExceededMeta{
+				EventMetaDefault: EventMetaDefault{Message: "Anonymous Rate Limit Exceeded", OriginatingRequest: EncodeRequestToEvent(a.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, a.Spec)},
+				Path:             r.URL.Path,
+				Origin:           origin,
+				Key:              origin,
+			})
+
+		// Report in health check
+		ReportHealthCheckValue(a.Spec.Health, Throttle, "1")
+
+		return errors.New("Rate limit exceeded"), 429
+	}
+
+	return nil, 200
+}
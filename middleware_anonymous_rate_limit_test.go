@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAnonRateLimitKey(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/widgets", nil)
+	r.RemoteAddr = "10.0.0.1:51234"
+
+	if key := getAnonRateLimitKey("api-1", "", r); key != "anon-rate-limit-api-1-10.0.0.1" {
+		t.Error("IP scoped key is wrong: ", key)
+	}
+
+	if key := getAnonRateLimitKey("api-1", "global", r); key != "anon-rate-limit-api-1-global" {
+		t.Error("Global key is wrong: ", key)
+	}
+
+	r.RemoteAddr = "[::1]:51234"
+	if ip := GetIPFromRequest(r); ip != "::1" {
+		t.Error("IPv6 address not extracted: ", ip)
+	}
+}
@@ -3,16 +3,20 @@ package main
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/gorilla/context"
 )
 
 // CheckIsAPIOwner will ensure that the accessor of the tyk API has the correct security credentials - this is a
 // shared secret between the client and the owner and is set in the tyk.conf file. This should never be made public!
+// Calls with a valid credential are audited, including the ones outside the scope of an admin token
 func CheckIsAPIOwner(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		tykAuthKey := r.Header.Get("X-Tyk-Authorization")
-		if tykAuthKey != config.Secret {
-			// Error
-			log.Warning("Attempted administrative access with invalid or missing key!")
+	auditedHandler := AuditAdminCall(func(w http.ResponseWriter, r *http.Request) {
+		// Scoped admin tokens can only use part of the API
+		scope, _ := context.Get(r, AdminScope).(string)
+		if !adminScopeAllows(scope, r) {
+			actor, _ := context.Get(r, AdminActor).(string)
+			log.Warning("Admin token ", actor, " attempted access outside its scope: ", r.Method, " ", r.URL.Path)
 
 			responseMessage := createError("Forbidden")
 			w.WriteHeader(403)
@@ -22,6 +26,34 @@ func CheckIsAPIOwner(handler func(http.ResponseWriter, *http.Request)) func(http
 		}
 
 		handler(w, r)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer context.Clear(r)
+
+		tykAuthKey := r.Header.Get("X-Tyk-Authorization")
+		actor := AUDIT_LOG_DEFAULT_ACTOR
+		scope := AdminScopeFull
+		if tykAuthKey != config.Secret {
+			// The name of a scoped admin token is the audit actor
+			adminToken, found := findAdminToken(tykAuthKey)
+			if !found {
+				// Error
+				log.Warning("Attempted administrative access with invalid or missing key!")
+
+				responseMessage := createError("Forbidden")
+				w.WriteHeader(403)
+				fmt.Fprintf(w, string(responseMessage))
+
+				return
+			}
+
+			actor = adminToken.Name
+			scope = adminToken.Scope
+		}
 
+		context.Set(r, AdminActor, actor)
+		context.Set(r, AdminScope, scope)
+		auditedHandler(w, r)
 	}
 }
@@ -21,7 +21,7 @@ func (k AuthKey) New() {}
 
 // GetConfig retrieves the configuration from the API config
 func (k *AuthKey) GetConfig() (interface{}, error) {
-	return k.TykMiddleware.Spec.APIDefinition.Auth, nil
+	return GetAuthSourcesConfig(k.TykMiddleware.Spec), nil
 }
 
 func (k *AuthKey) copyResponse(dst io.Writer, src io.Reader) {
@@ -32,6 +32,10 @@ func CopyRequest(r *http.Request) *http.Request {
 	tempRes := new(http.Request)
 	*tempRes = *r
 
+	if r.Body == nil {
+		return tempRes
+	}
+
 	defer r.Body.Close()
 
 	// Buffer body data - don't like thi but we would otherwise drain the request body
@@ -49,43 +53,40 @@ func CopyRequest(r *http.Request) *http.Request {
 }
 
 func (k *AuthKey) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
-	thisConfig := k.TykMiddleware.Spec.APIDefinition.Auth
-
-	authHeaderValue := r.Header.Get(thisConfig.AuthHeaderName)
-	if thisConfig.UseParam {
-		tempRes := CopyRequest(r)
-
-		// Set hte header name
-		authHeaderValue = tempRes.FormValue(thisConfig.AuthHeaderName)
-	}
-
-	if thisConfig.UseCookie {
-		tempRes := CopyRequest(r)
-		authCookie, notFoundErr := tempRes.Cookie(thisConfig.AuthHeaderName)
-		if notFoundErr != nil {
-			authHeaderValue = ""
-		} else {
-			authHeaderValue = authCookie.Value
-		}
-	}
+	thisConfig := configuration.(AuthSourcesConfig)
+	authHeaderValue, tokenSource := GetAuthToken(thisConfig, r)
 
 	if authHeaderValue == "" {
 		// No header value, fail
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 		}).Info("Attempted access with malformed header, no auth header found.")
 
 		return errors.New("Authorization field missing"), 400
 	}
 
+	// Revoked tokens are rejected before the session is looked up
+	if IsTokenRevoked(authHeaderValue) {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
+		}).Info("Attempted access with revoked key.")
+
+		AuthFailed(k.TykMiddleware, r, authHeaderValue)
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Key has been revoked"), 403
+	}
+
 	// Check if API key valid
 	thisSessionState, keyExists := k.TykMiddleware.CheckSessionAndIdentityForValidKey(authHeaderValue)
 	if !keyExists {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
-			"key":    authHeaderValue,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
 		}).Info("Attempted access with non-existent key.")
 
 		// Fire Authfailed Event
@@ -101,15 +102,19 @@ func (k *AuthKey) ProcessRequest(w http.ResponseWriter, r *http.Request, configu
 	context.Set(r, SessionData, thisSessionState)
 	context.Set(r, AuthHeaderValue, authHeaderValue)
 
+	if thisConfig.StripAuthData {
+		StripAuthToken(r, tokenSource)
+	}
+
 	return nil, 200
 }
 
 func AuthFailed(m *TykMiddleware, r *http.Request, authHeaderValue string) {
 	go m.FireEvent(EVENT_AuthFailure,
 		EVENT_AuthFailureMeta{
-			EventMetaDefault: EventMetaDefault{Message: "Auth Failure", OriginatingRequest: EncodeRequestToEvent(r)},
+			EventMetaDefault: EventMetaDefault{Message: "Auth Failure", OriginatingRequest: EncodeRequestToEvent(m.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, m.Spec)},
 			Path:             r.URL.Path,
-			Origin:           r.RemoteAddr,
-			Key:              authHeaderValue,
+			Origin:           GetIPFromRequest(r),
+			Key:              m.Spec.LogMasking.MaskKey(authHeaderValue),
 		})
 }
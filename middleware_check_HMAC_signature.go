@@ -28,7 +28,7 @@ type HMACMiddleware struct {
 func (hm *HMACMiddleware) authorizationError(w http.ResponseWriter, r *http.Request) (error, int) {
 	log.WithFields(logrus.Fields{
 		"path":   r.URL.Path,
-		"origin": r.RemoteAddr,
+		"origin": GetIPFromRequest(r),
 	}).Info("Authorization field missing or malformed")
 
 	return errors.New("Authorization field missing, malformed or invalid"), 400
@@ -62,7 +62,7 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	if isOutOftime == false {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 		}).Info("Date is out of allowed range.")
 
 		handler := ErrorHandler{hm.TykMiddleware}
@@ -143,7 +143,7 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	if thisSessionState.HmacSecret == "" || thisSessionState.HMACEnabled == false {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 		}).Info("API Requires HMAC signature, session missing HMACSecret or HMAC not enabled for key")
 
 		return errors.New("This key is invalid"), 400
@@ -165,7 +165,7 @@ func (hm *HMACMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	if ourSignature != compareTo {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 		}).Info("Request signature is invalid")
 
 		// Fire Authfailed Event
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"github.com/rs/cors"
+)
+
+// CORSHandler answers preflight requests and adds the CORS headers for an API, so upstreams don't
+// each have to implement it. It is nil if CORS is disabled
+func CORSHandler(spec *APISpec) alice.Constructor {
+	if !spec.CORS.Enable {
+		return nil
+	}
+
+	if spec.CORS.AllowCredentials {
+		for _, origin := range spec.CORS.AllowedOrigins {
+			if origin == "*" {
+				log.Warning("API ", spec.APIID, " allows credentialed requests from any origin")
+				break
+			}
+		}
+	}
+
+	c := cors.New(cors.Options{
+		AllowedOrigins:     spec.CORS.AllowedOrigins,
+		AllowedMethods:     spec.CORS.AllowedMethods,
+		AllowedHeaders:     spec.CORS.AllowedHeaders,
+		ExposedHeaders:     spec.CORS.ExposedHeaders,
+		AllowCredentials:   spec.CORS.AllowCredentials,
+		MaxAge:             spec.CORS.MaxAge,
+		OptionsPassthrough: spec.CORS.OptionsPassthrough,
+		Debug:              spec.CORS.Debug,
+	})
+
+	return c.Handler
+}
+
+func handleCORS(chain *ChainBuilder, spec *APISpec) {
+	if corsHandler := CORSHandler(spec); corsHandler != nil {
+		log.Debug("CORS ENABLED")
+		chain.Add(ChainObject{Name: "CORS", Type: "builtin"}, corsHandler)
+	}
+}
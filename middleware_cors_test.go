@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var corsDefinition string = `
+
+	{
+		"name": "CORS API",
+		"api_id": "cors1",
+		"org_id": "default",
+		"definition": {
+			"location": "header",
+			"key": "version"
+		},
+		"auth": {
+			"auth_header_name": "authorization"
+		},
+		"CORS": {
+			"enable": true,
+			"allowed_origins": ["http://app.example.com"],
+			"allowed_methods": ["GET", "POST"],
+			"allowed_headers": ["Authorization"],
+			"max_age": 300
+		},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {
+				"Default": {
+					"name": "Default"
+				}
+			}
+		},
+		"proxy": {
+			"listen_path": "/v1",
+			"target_url": "http://lonelycode.com",
+			"strip_listen_path": false
+		}
+	}
+
+`
+
+func TestCORSHandler(t *testing.T) {
+	spec := createDefinitionFromString(corsDefinition)
+	corsHandler := CORSHandler(&spec)
+	if corsHandler == nil {
+		t.Fatal("CORS should be enabled")
+	}
+
+	upstreamCalled := false
+	handler := corsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+	}))
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/v1/resource", nil)
+	req.Header.Set("Origin", "http://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	handler.ServeHTTP(recorder, req)
+
+	if upstreamCalled {
+		t.Error("Preflight requests shouldn't be passed upstream")
+	}
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "http://app.example.com" {
+		t.Error("Preflight should allow the origin, got: ", recorder.Header())
+	}
+	if recorder.Header().Get("Access-Control-Max-Age") != "300" {
+		t.Error("Preflight should set the max age, got: ", recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/v1/resource", nil)
+	req.Header.Set("Origin", "http://evil.example.com")
+	handler.ServeHTTP(recorder, req)
+
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error("Other origins shouldn't be allowed")
+	}
+
+	spec.CORS.Enable = false
+	if CORSHandler(&spec) != nil {
+		t.Error("No handler should be created when CORS is disabled")
+	}
+}
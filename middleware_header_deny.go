@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"regexp"
+)
+
+// HeaderDenyRule rejects a request if the value of Header matches the Match regex, a missing header
+// is treated as an empty value so "^$" can be used to reject clients that don't send it
+type HeaderDenyRule struct {
+	Header string `mapstructure:"header" bson:"header" json:"header"`
+	Match  string `mapstructure:"match" bson:"match" json:"match"`
+}
+
+type compiledHeaderDenyRule struct {
+	header string
+	rx     *regexp.Regexp
+}
+
+type HeaderDenyMiddlewareConfig struct {
+	BannedHeaderRules []HeaderDenyRule `mapstructure:"banned_header_rules" bson:"banned_header_rules" json:"banned_header_rules"`
+}
+
+// HeaderDenyMiddleware is a cheap check that runs first in the chain to reject known-bad clients
+// (scrapers, malformed user agents or content types) before any of the heavier middleware
+type HeaderDenyMiddleware struct {
+	*TykMiddleware
+}
+
+// CompileHeaderDenyRules compiles the rules once at load time, invalid rules are logged and skipped
+func CompileHeaderDenyRules(rules []HeaderDenyRule) []compiledHeaderDenyRule {
+	compiled := []compiledHeaderDenyRule{}
+	for _, rule := range rules {
+		if rule.Header == "" {
+			log.Warning("Banned header rule has no header name, skipping")
+			continue
+		}
+
+		rx, err := regexp.Compile(rule.Match)
+		if err != nil {
+			log.Error("Banned header rule for ", rule.Header, " failed to compile, skipping: ", err)
+			continue
+		}
+
+		compiled = append(compiled, compiledHeaderDenyRule{http.CanonicalHeaderKey(rule.Header), rx})
+	}
+
+	return compiled
+}
+
+// New lets you do any initialisations for the object can be done here
+func (h *HeaderDenyMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config and compiles the global and API rules
+func (h *HeaderDenyMiddleware) GetConfig() (interface{}, error) {
+	var thisModuleConfig HeaderDenyMiddlewareConfig
+
+	err := mapstructure.Decode(h.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	// Global rules first, then the API specific ones
+	allRules := append([]HeaderDenyRule{}, config.BannedHeaderRules...)
+	allRules = append(allRules, thisModuleConfig.BannedHeaderRules...)
+
+	return CompileHeaderDenyRules(allRules), nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (h *HeaderDenyMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	if IsHeaderDenied(configuration.([]compiledHeaderDenyRule), r.Header) {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+		}).Info("Request rejected by banned header rule.")
+		return errors.New("Request rejected"), 403
+	}
+
+	return nil, 200
+}
+
+// IsHeaderDenied checks the headers against the compiled rules
+func IsHeaderDenied(rules []compiledHeaderDenyRule, headers http.Header) bool {
+	for _, rule := range rules {
+		values, found := headers[rule.header]
+		if !found || len(values) == 0 {
+			values = []string{""}
+		}
+
+		for _, value := range values {
+			if rule.rx.MatchString(value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderDenyRules(t *testing.T) {
+	oldRules := config.BannedHeaderRules
+	config.BannedHeaderRules = []HeaderDenyRule{{Header: "user-agent", Match: "(?i)badbot"}}
+	defer func() { config.BannedHeaderRules = oldRules }()
+
+	spec := createNonVersionedDefinition()
+	spec.APIDefinition.RawData["banned_header_rules"] = []interface{}{
+		map[string]interface{}{"header": "X-Client-Version", "match": "^$"},
+		map[string]interface{}{"header": "Content-Type", "match": "["},
+	}
+
+	headerDeny := &HeaderDenyMiddleware{TykMiddleware: &TykMiddleware{&spec, nil}}
+	headerDeny.New()
+	thisConfig, err := headerDeny.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules := thisConfig.([]compiledHeaderDenyRule); len(rules) != 2 {
+		t.Error("Expected the global and the valid API rule, got: ", len(rules))
+	}
+
+	tests := []struct {
+		userAgent     string
+		clientVersion string
+		expected      int
+	}{
+		{"curl/7.47.0", "1.0", 200},
+		{"Mozilla/5.0 (compatible; BadBot/2.1)", "1.0", 403},
+		{"curl/7.47.0", "", 403},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/v1/widgets", nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		if test.clientVersion != "" {
+			req.Header.Set("X-Client-Version", test.clientVersion)
+		}
+
+		_, code := headerDeny.ProcessRequest(httptest.NewRecorder(), req, thisConfig)
+		if code != test.expected {
+			t.Error("User agent ", test.userAgent, " with client version ", test.clientVersion, " should get ", test.expected, ", got: ", code)
+		}
+	}
+}
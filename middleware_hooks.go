@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The points in the chain custom middleware can be hooked into, pre and post are the existing
+// custom_middleware lists, the others are read from the same block of the raw definition
+const (
+	MW_HOOK_PRE           = "pre"
+	MW_HOOK_AUTH_CHECK    = "auth_check"
+	MW_HOOK_POST_KEY_AUTH = "post_key_auth"
+	MW_HOOK_POST          = "post"
+	MW_HOOK_RESPONSE      = "response"
+)
+
+// Only JSVM middleware can be loaded by this gateway, other drivers are rejected when the API loads
+const MW_DRIVER_OTTO = "otto"
+
+type MiddlewareHookDefinition struct {
+	Name           string `mapstructure:"name" bson:"name" json:"name"`
+	Path           string `mapstructure:"path" bson:"path" json:"path"`
+	RequireSession bool   `mapstructure:"require_session" bson:"require_session" json:"require_session"`
+}
+
+// MiddlewareHooks are the extra hook points of custom_middleware. AuthCheck replaces the auth
+// methods of a keyed API, PostKeyAuth runs with the session right after auth, Response processes
+// the upstream response
+type MiddlewareHooks struct {
+	Driver      string                     `mapstructure:"driver" bson:"driver" json:"driver"`
+	AuthCheck   MiddlewareHookDefinition   `mapstructure:"auth_check" bson:"auth_check" json:"auth_check"`
+	PostKeyAuth []MiddlewareHookDefinition `mapstructure:"post_key_auth" bson:"post_key_auth" json:"post_key_auth"`
+	Response    []MiddlewareHookDefinition `mapstructure:"response" bson:"response" json:"response"`
+}
+
+type MiddlewareHooksModuleConfig struct {
+	CustomMiddleware MiddlewareHooks `mapstructure:"custom_middleware" bson:"custom_middleware" json:"custom_middleware"`
+}
+
+// Definition converts the hook to the definition used by the pre and post lists
+func (h MiddlewareHookDefinition) Definition() tykcommon.MiddlewareDefinition {
+	thisMWDef := tykcommon.MiddlewareDefinition{}
+	thisMWDef.Name = h.Name
+	thisMWDef.Path = h.Path
+	thisMWDef.RequireSession = h.RequireSession
+
+	return thisMWDef
+}
+
+// GetMiddlewareHooks reads the hooks of an API, the second value is false if the driver isn't
+// supported, in which case none of the hooks can be loaded
+func GetMiddlewareHooks(spec *APISpec) (MiddlewareHooks, bool) {
+	var thisModuleConfig MiddlewareHooksModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode custom middleware hooks: ", err)
+		return MiddlewareHooks{}, true
+	}
+
+	thisHooks := thisModuleConfig.CustomMiddleware
+	if thisHooks.Driver != "" && thisHooks.Driver != MW_DRIVER_OTTO {
+		log.Error("Unsupported custom middleware driver for API ", spec.APIID, ": ", thisHooks.Driver)
+		return thisHooks, false
+	}
+
+	// The session is the point of running after auth
+	for i := range thisHooks.PostKeyAuth {
+		thisHooks.PostKeyAuth[i].RequireSession = true
+	}
+
+	return thisHooks, true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func hooksDefinition(driver string) string {
+	return `{
+		"name": "Hooks API",
+		"api_id": "hooks1",
+		"org_id": "default",
+		"use_keyless": false,
+		"auth": {"auth_header_name": "authorization"},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {"Default": {"name": "Default"}}
+		},
+		"proxy": {
+			"listen_path": "/hooks/",
+			"target_url": "http://example.com",
+			"strip_listen_path": false
+		},
+		"custom_middleware": {
+			"driver": "` + driver + `",
+			"pre": [],
+			"post": [],
+			"auth_check": {"name": "authMW", "path": "middleware/auth.js"},
+			"post_key_auth": [{"name": "postKeyAuthMW", "path": "middleware/post_key_auth.js"}],
+			"response": [{"name": "responseMW", "path": "middleware/response.js"}]
+		}
+	}`
+}
+
+func TestGetMiddlewareHooks(t *testing.T) {
+	spec := createDefinitionFromString(hooksDefinition(""))
+
+	thisHooks, supported := GetMiddlewareHooks(&spec)
+	if !supported {
+		t.Fatal("JSVM hooks should be supported")
+	}
+	if thisHooks.AuthCheck.Name != "authMW" || thisHooks.AuthCheck.Path != "middleware/auth.js" {
+		t.Error("Auth check hook not loaded: ", thisHooks.AuthCheck)
+	}
+	if len(thisHooks.PostKeyAuth) != 1 || !thisHooks.PostKeyAuth[0].RequireSession {
+		t.Error("Post key auth hooks should always get the session: ", thisHooks.PostKeyAuth)
+	}
+	if len(thisHooks.Response) != 1 || thisHooks.Response[0].Name != "responseMW" {
+		t.Error("Response hook not loaded: ", thisHooks.Response)
+	}
+}
+
+func TestAuthCheckHookReplacesAuthChain(t *testing.T) {
+	spec := createDefinitionFromString(hooksDefinition(MW_DRIVER_OTTO))
+	tykMiddleware := &TykMiddleware{&spec, nil}
+
+	authChain := BuildAuthChain(&spec, tykMiddleware)
+	if len(authChain) != 1 {
+		t.Fatal("Expected a single auth middleware, got: ", len(authChain))
+	}
+	if thisObject := DescribeMiddleware(authChain[0]); thisObject.Name != "authMW" || thisObject.Type != MW_HOOK_AUTH_CHECK {
+		t.Error("Auth check middleware not in the auth chain: ", thisObject)
+	}
+
+	chainBuilder := &ChainBuilder{TykMiddleware: tykMiddleware}
+	buildAPIChain(chainBuilder, &spec, tykMiddleware, nil, authChain, nil, nil)
+
+	names := []string{}
+	for _, thisObject := range chainBuilder.Description {
+		names = append(names, thisObject.Name)
+	}
+	if !strings.Contains(strings.Join(names, ","), "authMW,postKeyAuthMW,KeyExpired") {
+		t.Error("Post key auth middleware should run right after auth: ", names)
+	}
+}
+
+func TestAuthCheckHookFailsClosed(t *testing.T) {
+	spec := createDefinitionFromString(hooksDefinition("grpc"))
+	tykMiddleware := &TykMiddleware{&spec, nil}
+
+	if _, supported := GetMiddlewareHooks(&spec); supported {
+		t.Error("Unsupported driver should be rejected")
+	}
+
+	authChain := BuildAuthChain(&spec, tykMiddleware)
+	if len(authChain) != 1 || DescribeMiddleware(authChain[0]).Name != "DenyAllMiddleware" {
+		t.Error("Auth check with an unsupported driver should deny all requests")
+	}
+}
+
+func TestAuthCheckHookRejectsOnVMFailure(t *testing.T) {
+	spec := createDefinitionFromString(hooksDefinition(MW_DRIVER_OTTO))
+	tykMiddleware := &TykMiddleware{&spec, nil}
+
+	// The class was never loaded in the VM, so running it fails
+	for _, test := range []struct {
+		hook string
+		code int
+	}{
+		{MW_HOOK_AUTH_CHECK, 403},
+		{MW_HOOK_PRE, 200},
+	} {
+		mw := &DynamicMiddleware{TykMiddleware: tykMiddleware, MiddlewareClassName: "missingMW", Pre: test.hook == MW_HOOK_PRE, Hook: test.hook}
+		req, _ := http.NewRequest("GET", "/hooks/widgets", strings.NewReader(""))
+		if _, code := mw.ProcessRequest(httptest.NewRecorder(), req, nil); code != test.code {
+			t.Error(test.hook, " middleware that fails to run should return ", test.code, ", got: ", code)
+		}
+	}
+}
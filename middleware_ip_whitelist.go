@@ -4,7 +4,6 @@ import (
 	"errors"
 	"net"
 	"net/http"
-	"strings"
 )
 
 // IPWhiteListMiddleware lets you define a list of IPs to allow upstream
@@ -28,18 +27,11 @@ func (i *IPWhiteListMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Re
 		return nil, 200
 	}
 
-	var remoteIP net.IP
+	remoteIP := net.ParseIP(GetIPFromRequest(r))
 
 	// Enabled, check incoming IP address
 	for _, ip := range i.TykMiddleware.Spec.AllowedIPs {
 		allowedIP := net.ParseIP(ip)
-		splitIP := strings.Split(r.RemoteAddr, ":")
-		remoteIPString := splitIP[0]
-		if len(splitIP) > 2 {
-			// Might be an IPv6 address, don't mess with it
-			remoteIPString = r.RemoteAddr
-		}
-		remoteIP = net.ParseIP(remoteIPString)
 
 		// We parse the IP to manage IPv4 and IPv6 easily
 		if allowedIP.String() == remoteIP.String() {
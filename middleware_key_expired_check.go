@@ -6,6 +6,7 @@ import (
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"time"
 )
 
 // KeyExpired middleware will check if the requesting key is expired or not. It makes use of the authManager to do so.
@@ -35,17 +36,17 @@ func (k *KeyExpired) ProcessRequest(w http.ResponseWriter, r *http.Request, conf
 		authHeaderValue := context.Get(r, AuthHeaderValue).(string)
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
-			"key":    authHeaderValue,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
 		}).Info("Attempted access from inactive key.")
 
 		// Fire a key expired event
 		go k.TykMiddleware.FireEvent(EVENT_KeyExpired,
 			EVENT_KeyExpiredMeta{
-				EventMetaDefault: EventMetaDefault{Message: "Attempted access from inactive key.", OriginatingRequest: EncodeRequestToEvent(r)},
+				EventMetaDefault: EventMetaDefault{Message: "Attempted access from inactive key.", OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
 				Path:             r.URL.Path,
-				Origin:           r.RemoteAddr,
-				Key:              authHeaderValue,
+				Origin:           GetIPFromRequest(r),
+				Key:              k.Spec.LogMasking.MaskKey(authHeaderValue),
 			})
 
 		// Report in health check
@@ -54,14 +55,55 @@ func (k *KeyExpired) ProcessRequest(w http.ResponseWriter, r *http.Request, conf
 		return errors.New("Key is inactive, please renew"), 403
 	}
 
+	keyState := thisSessionState.GetKeyState()
+	if keyState != KeyStateActive {
+		authHeaderValue := context.Get(r, AuthHeaderValue).(string)
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
+			"state":  keyState,
+		}).Info("Attempted access from key that is not active.")
+
+		if keyState == KeyStateSuspended {
+			// Fire a key suspended event
+			go k.TykMiddleware.FireEvent(EVENT_KeySuspended,
+				EVENT_KeySuspendedMeta{
+					EventMetaDefault: EventMetaDefault{Message: "Attempted access from suspended key.", OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
+					Path:             r.URL.Path,
+					Origin:           GetIPFromRequest(r),
+					Key:              k.Spec.LogMasking.MaskKey(authHeaderValue),
+				})
+		}
+
+		// Report in health check
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New(KeyStateErrorMessage(keyState)), 403
+	}
+
+	if !thisSessionState.IsWithinAccessWindows(time.Now()) {
+		authHeaderValue := context.Get(r, AuthHeaderValue).(string)
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
+		}).Info("Attempted access from key outside its access windows.")
+
+		// Report in health check
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Key can't be used at this time"), 403
+	}
+
 	keyExpired := k.Spec.AuthManager.IsKeyExpired(&thisSessionState)
 
 	if keyExpired {
 		authHeaderValue := context.Get(r, AuthHeaderValue).(string)
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
-			"key":    authHeaderValue,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
 		}).Info("Attempted access from expired key.")
 
 		// Fire a key expired event
@@ -69,8 +111,8 @@ func (k *KeyExpired) ProcessRequest(w http.ResponseWriter, r *http.Request, conf
 			EVENT_KeyExpiredMeta{
 				EventMetaDefault: EventMetaDefault{Message: "Attempted access from expired key."},
 				Path:             r.URL.Path,
-				Origin:           r.RemoteAddr,
-				Key:              authHeaderValue,
+				Origin:           GetIPFromRequest(r),
+				Key:              k.Spec.LogMasking.MaskKey(authHeaderValue),
 			})
 
 		// Report in health check
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"net"
+	"net/http"
+)
+
+// KeyIPRestriction checks that a key is only used from the addresses in its allowed_ips, keys
+// without allowed_ips can be used from anywhere
+type KeyIPRestriction struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (k *KeyIPRestriction) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (k *KeyIPRestriction) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *KeyIPRestriction) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisSessionState := context.Get(r, SessionData).(SessionState)
+	if len(thisSessionState.AllowedIPs) == 0 {
+		return nil, 200
+	}
+
+	origin := GetIPFromRequest(r)
+	if isIPAllowed(thisSessionState.AllowedIPs, origin) {
+		return nil, 200
+	}
+
+	authHeaderValue := context.Get(r, AuthHeaderValue).(string)
+	log.WithFields(logrus.Fields{
+		"path":   r.URL.Path,
+		"origin": origin,
+		"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
+	}).Info("Attempted access to key from a disallowed IP.")
+
+	// Fire a key IP denied event
+	go k.TykMiddleware.FireEvent(EVENT_KeyIPDenied,
+		EVENT_KeyIPDeniedMeta{
+			EventMetaDefault: EventMetaDefault{Message: "Attempted access to key from a disallowed IP.", OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
+			Path:             r.URL.Path,
+			Origin:           origin,
+			Key:              k.Spec.LogMasking.MaskKey(authHeaderValue),
+		})
+
+	// Report in health check
+	ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+	return errors.New("Key is not allowed to be used from this IP address"), 403
+}
+
+// isIPAllowed checks an address against a list of IPs and CIDR ranges, invalid entries never match
+func isIPAllowed(allowedIPs []string, ip string) bool {
+	remoteIP := net.ParseIP(ip)
+	if remoteIP == nil {
+		return false
+	}
+
+	for _, allowed := range allowedIPs {
+		if _, allowedNet, err := net.ParseCIDR(allowed); err == nil {
+			if allowedNet.Contains(remoteIP) {
+				return true
+			}
+			continue
+		}
+
+		allowedIP := net.ParseIP(allowed)
+		if allowedIP == nil {
+			log.Error("Invalid entry in key allowed_ips: ", allowed)
+			continue
+		}
+
+		if allowedIP.Equal(remoteIP) {
+			return true
+		}
+	}
+
+	return false
+}
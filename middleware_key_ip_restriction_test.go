@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsIPAllowed(t *testing.T) {
+	allowedIPs := []string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32", "not-an-ip"}
+
+	for _, ip := range []string{"10.1.2.3", "192.168.1.10", "2001:db8::1"} {
+		if !isIPAllowed(allowedIPs, ip) {
+			t.Error("IP should be allowed: ", ip)
+		}
+	}
+
+	for _, ip := range []string{"192.168.1.11", "11.0.0.1", "2001:db9::1", "", "not-an-ip"} {
+		if isIPAllowed(allowedIPs, ip) {
+			t.Error("IP should be denied: ", ip)
+		}
+	}
+}
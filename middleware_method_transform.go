@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// MethodTransformMeta is a method_transforms entry in a version's extended_paths, matching requests
+// are sent to the upstream with ToMethod
+type MethodTransformMeta struct {
+	Path     string `mapstructure:"path" bson:"path" json:"path"`
+	Method   string `mapstructure:"method" bson:"method" json:"method"`
+	ToMethod string `mapstructure:"to_method" bson:"to_method" json:"to_method"`
+}
+
+// methodTransformTargets are the methods a request can be sent upstream with
+var methodTransformTargets = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+type compiledMethodTransform struct {
+	path     *regexp.Regexp
+	method   string
+	toMethod string
+}
+
+// MethodTransform rewrites the method of a request before it is proxied, it runs at the end of the
+// chain so every other extended path still matches on the method the client used
+type MethodTransform struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (m *MethodTransform) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (m *MethodTransform) GetConfig() (interface{}, error) {
+	versions, err := GetRawExtendedPaths(m.TykMiddleware.Spec)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	compiled := make(map[string][]compiledMethodTransform)
+	for versionName, extendedPaths := range versions {
+		for _, entry := range extendedPaths.MethodTransforms {
+			pathRegex, err := compileRawPath(entry.Path)
+			if err != nil {
+				log.Error("Invalid method transform path ", entry.Path, ", skipping: ", err)
+				continue
+			}
+
+			toMethod := strings.ToUpper(entry.ToMethod)
+			if !methodTransformTargets[toMethod] {
+				log.Error("Invalid to_method \"", entry.ToMethod, "\" for method transform of ", entry.Path, ", skipping")
+				continue
+			}
+
+			compiled[versionName] = append(compiled[versionName], compiledMethodTransform{
+				path:     pathRegex,
+				method:   entry.Method,
+				toMethod: toMethod,
+			})
+		}
+	}
+
+	return compiled, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (m *MethodTransform) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	transforms := configuration.(map[string][]compiledMethodTransform)
+	if len(transforms) == 0 {
+		return nil, 200
+	}
+
+	for _, transform := range transforms[getRequestVersionKey(m.Spec, r)] {
+		if strings.EqualFold(transform.method, r.Method) && transform.path.MatchString(r.URL.Path) {
+			log.Debug("Changing request method from ", r.Method, " to ", transform.toMethod)
+			r.Method = transform.toMethod
+			break
+		}
+	}
+
+	return nil, 200
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var methodTransformDefinition string = `
+
+	{
+		"name": "Method Transform API",
+		"api_id": "methodtransform1",
+		"org_id": "default",
+		"definition": {
+			"location": "header",
+			"key": "version"
+		},
+		"auth": {
+			"auth_header_name": "authorization"
+		},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {
+				"Default": {
+					"name": "Default",
+					"extended_paths": {
+						"method_transforms": [
+							{
+								"path": "/v1/widgets/{id}",
+								"method": "POST",
+								"to_method": "put"
+							},
+							{
+								"path": "/v1/gadgets/{id}",
+								"method": "POST",
+								"to_method": "PUT\r\nX-Injected: 1"
+							},
+							{
+								"path": "/v1/gizmos/{id}",
+								"method": "POST",
+								"to_method": ""
+							}
+						]
+					}
+				}
+			}
+		},
+		"proxy": {
+			"listen_path": "/v1",
+			"target_url": "http://lonelycode.com",
+			"strip_listen_path": false
+		}
+	}
+
+`
+
+func TestMethodTransform(t *testing.T) {
+	spec := createDefinitionFromString(methodTransformDefinition)
+	methodTransform := &MethodTransform{TykMiddleware: &TykMiddleware{&spec, nil}}
+	methodTransform.New()
+	thisConfig, err := methodTransform.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if transforms := thisConfig.(map[string][]compiledMethodTransform)["Default"]; len(transforms) != 1 {
+		t.Error("Transforms with an invalid to_method should be skipped, got: ", len(transforms))
+	}
+
+	tests := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{"POST", "/v1/widgets/1", "PUT"},
+		{"GET", "/v1/widgets/1", "GET"},
+		{"POST", "/v1/gadgets/1", "POST"},
+		{"POST", "/v1/gizmos/1", "POST"},
+		{"POST", "/v1/other/1", "POST"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		methodTransform.ProcessRequest(httptest.NewRecorder(), req, thisConfig)
+		if req.Method != test.expected {
+			t.Error(test.method, " ", test.path, " should be sent as ", test.expected, ", got: ", req.Method)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	MIRROR_DEFAULT_TIMEOUT       = 10
+	MIRROR_DEFAULT_MAX_IN_FLIGHT = 100
+	MIRROR_HEADER                = "X-Tyk-Mirror"
+)
+
+// MirrorConfig sends an async copy of the requests of an API to TargetURL, SampleRate is the share
+// of requests that are mirrored between 0 and 1, everything is mirrored if it isn't set
+type MirrorConfig struct {
+	TargetURL   string  `mapstructure:"target_url" bson:"target_url" json:"target_url"`
+	SampleRate  float64 `mapstructure:"sample_rate" bson:"sample_rate" json:"sample_rate"`
+	Timeout     int     `mapstructure:"timeout" bson:"timeout" json:"timeout"`
+	MaxInFlight int     `mapstructure:"max_in_flight" bson:"max_in_flight" json:"max_in_flight"`
+}
+
+type MirrorModuleConfig struct {
+	Mirror MirrorConfig `mapstructure:"mirror" bson:"mirror" json:"mirror"`
+}
+
+// MirrorMeta is a mirror entry in a version's extended_paths, it overrides the API mirror for
+// matching requests
+type MirrorMeta struct {
+	Path       string  `mapstructure:"path" bson:"path" json:"path"`
+	Method     string  `mapstructure:"method" bson:"method" json:"method"`
+	TargetURL  string  `mapstructure:"target_url" bson:"target_url" json:"target_url"`
+	SampleRate float64 `mapstructure:"sample_rate" bson:"sample_rate" json:"sample_rate"`
+}
+
+type mirrorTarget struct {
+	target     *url.URL
+	sampleRate float64
+}
+
+type compiledMirrorPath struct {
+	path   *regexp.Regexp
+	method string
+	mirror *mirrorTarget
+}
+
+type trafficMirrorConfig struct {
+	api    *mirrorTarget
+	paths  map[string][]compiledMirrorPath
+	client *http.Client
+	slots  chan bool
+}
+
+func newMirrorTarget(targetURL string, sampleRate float64) (*mirrorTarget, error) {
+	target, err := url.Parse(targetURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+
+	return &mirrorTarget{target: target, sampleRate: sampleRate}, nil
+}
+
+// TrafficMirror sends a copy of each request to a mirror upstream without waiting for it, the
+// mirror response is discarded so it never affects the client
+type TrafficMirror struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (m *TrafficMirror) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (m *TrafficMirror) GetConfig() (interface{}, error) {
+	var thisModuleConfig MirrorModuleConfig
+	err := mapstructure.Decode(m.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	versions, err := GetRawExtendedPaths(m.TykMiddleware.Spec)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	thisConfig := trafficMirrorConfig{paths: make(map[string][]compiledMirrorPath)}
+
+	if thisModuleConfig.Mirror.TargetURL != "" {
+		thisConfig.api, err = newMirrorTarget(thisModuleConfig.Mirror.TargetURL, thisModuleConfig.Mirror.SampleRate)
+		if err != nil {
+			log.Error("Invalid mirror target URL, mirroring disabled: ", err)
+		}
+	}
+
+	for versionName, extendedPaths := range versions {
+		for _, entry := range extendedPaths.Mirror {
+			pathRegex, err := compileRawPath(entry.Path)
+			if err != nil {
+				log.Error("Invalid mirror path ", entry.Path, ", skipping: ", err)
+				continue
+			}
+
+			mirror, err := newMirrorTarget(entry.TargetURL, entry.SampleRate)
+			if err != nil || entry.TargetURL == "" {
+				log.Error("Invalid mirror target URL for ", entry.Path, ", skipping")
+				continue
+			}
+
+			thisConfig.paths[versionName] = append(thisConfig.paths[versionName], compiledMirrorPath{
+				path:   pathRegex,
+				method: entry.Method,
+				mirror: mirror,
+			})
+		}
+	}
+
+	timeout := thisModuleConfig.Mirror.Timeout
+	if timeout <= 0 {
+		timeout = MIRROR_DEFAULT_TIMEOUT
+	}
+	maxInFlight := thisModuleConfig.Mirror.MaxInFlight
+	if maxInFlight <= 0 {
+		maxInFlight = MIRROR_DEFAULT_MAX_IN_FLIGHT
+	}
+
+	thisConfig.client = &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	thisConfig.slots = make(chan bool, maxInFlight)
+
+	return thisConfig, nil
+}
+
+// getMirror returns the mirror for a request, endpoint mirrors take precedence over the API mirror
+func (m *TrafficMirror) getMirror(r *http.Request, thisConfig trafficMirrorConfig) *mirrorTarget {
+	if len(thisConfig.paths) > 0 {
+		for _, mirrorPath := range thisConfig.paths[getRequestVersionKey(m.Spec, r)] {
+			if strings.EqualFold(mirrorPath.method, r.Method) && mirrorPath.path.MatchString(r.URL.Path) {
+				return mirrorPath.mirror
+			}
+		}
+	}
+
+	return thisConfig.api
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (m *TrafficMirror) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(trafficMirrorConfig)
+
+	// Traces from /tyk/debug never leave the gateway
+	if isDebugTrace(r) {
+		return nil, 200
+	}
+
+	mirror := m.getMirror(r, thisConfig)
+	if mirror == nil || rand.Float64() >= mirror.sampleRate {
+		return nil, 200
+	}
+
+	// Skip the mirror rather than queue it if too many mirrored requests are pending
+	select {
+	case thisConfig.slots <- true:
+	default:
+		log.Debug("Too many mirrored requests in flight, skipping mirror")
+		return nil, 200
+	}
+
+	mirrorReq, err := m.copyRequest(r, mirror.target)
+	if err != nil {
+		<-thisConfig.slots
+		log.Warning("Failed to copy request for mirror: ", err)
+		return nil, 200
+	}
+
+	go func() {
+		defer func() { <-thisConfig.slots }()
+
+		res, err := thisConfig.client.Do(mirrorReq)
+		if err != nil {
+			log.Debug("Mirror request failed: ", err)
+			return
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	return nil, 200
+}
+
+// copyRequest builds the mirrored request, the body is buffered so both upstreams get all of it
+func (m *TrafficMirror) copyRequest(r *http.Request, target *url.URL) (*http.Request, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	path := r.URL.Path
+	if m.Spec.APIDefinition.Proxy.StripListenPath {
+		path = m.Spec.StripListenPath(path)
+	}
+
+	mirrorURL := *target
+	mirrorURL.Path = singleJoiningSlash(target.Path, path)
+	if target.RawQuery == "" || r.URL.RawQuery == "" {
+		mirrorURL.RawQuery = target.RawQuery + r.URL.RawQuery
+	} else {
+		mirrorURL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	}
+
+	mirrorReq, err := http.NewRequest(r.Method, mirrorURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	copyHeader(mirrorReq.Header, r.Header)
+	for _, h := range hopHeaders {
+		mirrorReq.Header.Del(h)
+	}
+	mirrorReq.Header.Set(MIRROR_HEADER, "true")
+	mirrorReq.Header.Set("X-Forwarded-For", GetIPFromRequest(r))
+
+	return mirrorReq, nil
+}
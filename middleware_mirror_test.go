@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var mirrorDefinition string = `
+
+	{
+		"name": "Mirror API",
+		"api_id": "mirror1",
+		"org_id": "default",
+		"definition": {
+			"location": "header",
+			"key": "version"
+		},
+		"auth": {
+			"auth_header_name": "authorization"
+		},
+		"mirror": {
+			"target_url": "%s/v2"
+		},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {
+				"Default": {
+					"name": "Default"
+				}
+			}
+		},
+		"proxy": {
+			"listen_path": "/mirrored/",
+			"target_url": "http://lonelycode.com",
+			"strip_listen_path": true
+		}
+	}
+
+`
+
+type mirroredRequest struct {
+	method string
+	path   string
+	body   string
+	header string
+}
+
+func TestTrafficMirror(t *testing.T) {
+	mirrored := make(chan mirroredRequest, 1)
+	mirrorServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.URL.RequestURI(), string(body), r.Header.Get(MIRROR_HEADER)}
+	}))
+	defer mirrorServer.Close()
+
+	spec := createDefinitionFromString(fmt.Sprintf(mirrorDefinition, mirrorServer.URL))
+	mirror := &TrafficMirror{TykMiddleware: &TykMiddleware{&spec, nil}}
+	mirror.New()
+	thisConfig, err := mirror.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/mirrored/widgets?colour=red", strings.NewReader(`{"name": "widget"}`))
+	mirror.ProcessRequest(httptest.NewRecorder(), req, thisConfig)
+
+	// The proxied request must still have its body
+	body, _ := ioutil.ReadAll(req.Body)
+	if string(body) != `{"name": "widget"}` {
+		t.Error("Request body was consumed by the mirror: ", string(body))
+	}
+
+	select {
+	case got := <-mirrored:
+		if got.method != "POST" || got.path != "/v2/widgets?colour=red" {
+			t.Error("Unexpected mirrored request: ", got.method, " ", got.path)
+		}
+		if got.body != `{"name": "widget"}` {
+			t.Error("Mirrored body doesn't match: ", got.body)
+		}
+		if got.header != "true" {
+			t.Error("Mirrored requests should be marked with ", MIRROR_HEADER)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Request was not mirrored")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"github.com/gorilla/context"
 	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
 	"net/http"
 	"strings"
 )
@@ -14,18 +16,58 @@ type TransformHeaders struct {
 
 const TYK_META_LABEL string = "$tyk_meta."
 
-type TransformHeadersConfig struct{}
+// TransformHeadersConfig maps upstream header names to session meta data keys, these headers are set on
+// every request to the API, e.g. {"X-User-Id": "user_id"}
+type TransformHeadersConfig struct {
+	GlobalHeadersFromMetadata map[string]string `mapstructure:"global_headers_from_metadata" bson:"global_headers_from_metadata" json:"global_headers_from_metadata"`
+}
 
 // New lets you do any initialisations for the object can be done here
 func (t *TransformHeaders) New() {}
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (t *TransformHeaders) GetConfig() (interface{}, error) {
-	return nil, nil
+	var thisModuleConfig TransformHeadersConfig
+
+	err := mapstructure.Decode(t.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return thisModuleConfig, nil
+}
+
+// injectMetadataHeaders sets the mapped session meta data values as headers, any values sent by the client
+// are removed first so that upstreams can trust them
+func injectMetadataHeaders(r *http.Request, headerMap map[string]string) {
+	if len(headerMap) == 0 {
+		return
+	}
+
+	var metaData map[string]interface{}
+	if thisSessionState, ok := context.Get(r, SessionData).(SessionState); ok {
+		metaData, _ = thisSessionState.MetaData.(map[string]interface{})
+	}
+
+	for hName, metaKey := range headerMap {
+		r.Header.Del(hName)
+
+		metaVal, found := metaData[metaKey]
+		if !found || metaVal == nil {
+			log.Debug("Session Meta Data not found for key in map: ", metaKey)
+			continue
+		}
+
+		r.Header.Set(hName, fmt.Sprintf("%v", metaVal))
+	}
 }
 
 // ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
 func (t *TransformHeaders) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	if thisConfig, ok := configuration.(TransformHeadersConfig); ok {
+		injectMetadataHeaders(r, thisConfig.GlobalHeadersFromMetadata)
+	}
 
 	// Uee the request status validator to see if it's in our cache list
 	var stat RequestStatus
@@ -71,6 +113,8 @@ func (t *TransformHeaders) ProcessRequest(w http.ResponseWriter, r *http.Request
 					}
 				}
 
+			} else if strings.Contains(nVal, TYK_CONTEXT_LABEL) {
+				r.Header.Add(nKey, ReplaceTykContextVars(r, nVal))
 			} else {
 				r.Header.Add(nKey, nVal)
 			}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"testing"
+)
+
+func TestInjectMetadataHeaders(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/widgets", nil)
+	defer context.Clear(r)
+
+	r.Header.Set("X-User-Id", "spoofed")
+	r.Header.Set("X-Account", "spoofed")
+
+	thisSession := SessionState{MetaData: map[string]interface{}{"user_id": "1234", "tier": float64(2)}}
+	context.Set(r, SessionData, thisSession)
+
+	injectMetadataHeaders(r, map[string]string{"X-User-Id": "user_id", "X-Tier": "tier", "X-Account": "account"})
+
+	if r.Header.Get("X-User-Id") != "1234" {
+		t.Error("User ID header not injected, got: ", r.Header.Get("X-User-Id"))
+	}
+
+	if r.Header.Get("X-Tier") != "2" {
+		t.Error("Non-string meta data not injected, got: ", r.Header.Get("X-Tier"))
+	}
+
+	if r.Header.Get("X-Account") != "" {
+		t.Error("Client supplied header should have been removed")
+	}
+}
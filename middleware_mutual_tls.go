@@ -0,0 +1,90 @@
+package main
+
+import "net/http"
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"io/ioutil"
+)
+
+// MutualTLSMiddleware authenticates a request by its client certificate, the certificate must have
+// been verified against http_server_options.client_ca_file. The session of a certificate is stored
+// under its SHA-256 fingerprint (lower case hex)
+type MutualTLSMiddleware struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (k *MutualTLSMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (k *MutualTLSMiddleware) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// loadClientCAs reads the CAs client certificates are verified against, there are none if the file isn't set
+func loadClientCAs(caFile string) *x509.CertPool {
+	if caFile == "" {
+		return nil
+	}
+
+	caData, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Fatal("Couldn't read client CA file: ", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		log.Fatal("No certificates found in client CA file: ", caFile)
+	}
+
+	return pool
+}
+
+// certificateFingerprint is the key name of a client certificate
+func certificateFingerprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", sha256.Sum256(cert.Raw))
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *MutualTLSMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	// Chains are only set once the TLS server has verified the certificate against the client CAs
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || len(r.TLS.VerifiedChains) == 0 {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+		}).Info("Attempted access without a verified client certificate.")
+
+		return errors.New("Client certificate required"), 401
+	}
+
+	keyName := certificateFingerprint(r.TLS.PeerCertificates[0])
+	thisSessionState, keyExists := k.TykMiddleware.CheckSessionAndIdentityForValidKey(keyName)
+	if !keyExists {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"key":    keyName,
+		}).Info("Attempted access with an unknown client certificate.")
+
+		// Fire Authfailed Event
+		AuthFailed(k.TykMiddleware, r, keyName)
+
+		// Report in health check
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Certificate not authorised"), 403
+	}
+
+	// Set session state on context, we will need it later
+	context.Set(r, SessionData, thisSessionState)
+	context.Set(r, AuthHeaderValue, keyName)
+
+	// Request is valid, carry on
+	return nil, 200
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/gorilla/context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestClientCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	certData, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestMutualTLSMiddleware(t *testing.T) {
+	spec := createDefinitionFromString(maintenanceDefinition)
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	spec.SessionManager = &DefaultSessionManager{Store: store}
+	spec.AuthManager = &DefaultAuthorisationManager{Store: store}
+	spec.Health = &DefaultHealthChecker{}
+	thisMiddleware := &MutualTLSMiddleware{&TykMiddleware{&spec, nil}}
+
+	cert := newTestClientCertificate(t)
+	runRequest := func(state *tls.ConnectionState) (string, int) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.TLS = state
+		defer context.Clear(req)
+
+		_, code := thisMiddleware.ProcessRequest(httptest.NewRecorder(), req, nil)
+		keyName, _ := context.Get(req, AuthHeaderValue).(string)
+		return keyName, code
+	}
+
+	if _, code := runRequest(nil); code != 401 {
+		t.Error("Requests without TLS should be rejected, got: ", code)
+	}
+
+	// A certificate the server didn't verify has no chains
+	if _, code := runRequest(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); code != 401 {
+		t.Error("Unverified certificates should be rejected, got: ", code)
+	}
+
+	verified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if _, code := runRequest(verified); code != 403 {
+		t.Error("Certificates without a session should be rejected, got: ", code)
+	}
+
+	spec.SessionManager.UpdateSession(certificateFingerprint(cert), SessionState{Rate: 10, Per: 1}, 0)
+	keyName, code := runRequest(verified)
+	if code != 200 {
+		t.Error("Certificate with a session should be accepted, got: ", code)
+	}
+	if keyName != certificateFingerprint(cert) {
+		t.Error("The certificate fingerprint should be the key, got: ", keyName)
+	}
+}
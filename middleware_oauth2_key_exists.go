@@ -20,7 +20,7 @@ func (k *Oauth2KeyExists) New() {}
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (k *Oauth2KeyExists) GetConfig() (interface{}, error) {
-	return nil, nil
+	return GetAuthSourcesConfig(k.TykMiddleware.Spec), nil
 }
 
 // ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
@@ -32,7 +32,7 @@ func (k *Oauth2KeyExists) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	if len(parts) < 2 {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 		}).Info("Attempted access with malformed header, no auth header found.")
 
 		return errors.New("Authorization field missing"), 400
@@ -41,20 +41,33 @@ func (k *Oauth2KeyExists) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	if strings.ToLower(parts[0]) != "bearer" {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 		}).Info("Bearer token malformed")
 
 		return errors.New("Bearer token malformed"), 400
 	}
 
 	accessToken := parts[1]
+	if IsTokenRevoked(accessToken) {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(accessToken),
+		}).Info("Attempted access with revoked key.")
+
+		AuthFailed(k.TykMiddleware, r, accessToken)
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Key has been revoked"), 403
+	}
+
 	thisSessionState, keyExists := k.TykMiddleware.CheckSessionAndIdentityForValidKey(accessToken)
 
 	if !keyExists {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
-			"key":    accessToken,
+			"origin": GetIPFromRequest(r),
+			"key":    k.Spec.LogMasking.MaskKey(accessToken),
 		}).Info("Attempted access with non-existent key.")
 
 		// Fire Authfailed Event
@@ -69,6 +82,10 @@ func (k *Oauth2KeyExists) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	context.Set(r, SessionData, thisSessionState)
 	context.Set(r, AuthHeaderValue, accessToken)
 
+	if configuration.(AuthSourcesConfig).StripAuthData {
+		r.Header.Del("Authorization")
+	}
+
 	// Request is valid, carry on
 	return nil, 200
 }
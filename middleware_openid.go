@@ -0,0 +1,642 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	openIDDefaultIdentityClaim = "sub"
+	openIDDefaultJWKSCacheTTL  = 3600
+	// openIDMinRefresh stops tokens with unknown key IDs from making us fetch the JWKS on every request
+	openIDMinRefresh = 30 * time.Second
+	openIDClockSkew  = 60
+	// After a failed fetch the issuer isn't asked again for openIDMinRefresh, doubled for every
+	// further failure up to openIDMaxBackoff
+	openIDMaxBackoff = 10 * time.Minute
+)
+
+// OpenIDPolicyMapping grants the policy to tokens issued to ClientID (any client if empty) whose claims
+// have all the listed values, a claim that is a list matches if it contains the value
+type OpenIDPolicyMapping struct {
+	ClientID string            `mapstructure:"client_id" bson:"client_id" json:"client_id"`
+	Claims   map[string]string `mapstructure:"claims" bson:"claims" json:"claims"`
+	PolicyID string            `mapstructure:"policy_id" bson:"policy_id" json:"policy_id"`
+}
+
+// OpenIDProvider is an issuer whose ID tokens are accepted, ClientIDs are the audiences accepted. The
+// discovery document is read from the issuer unless DiscoveryURL (or JWKSURI, to skip discovery) is set
+type OpenIDProvider struct {
+	Issuer       string                `mapstructure:"issuer" bson:"issuer" json:"issuer"`
+	DiscoveryURL string                `mapstructure:"discovery_url" bson:"discovery_url" json:"discovery_url"`
+	JWKSURI      string                `mapstructure:"jwks_uri" bson:"jwks_uri" json:"jwks_uri"`
+	ClientIDs    []string              `mapstructure:"client_ids" bson:"client_ids" json:"client_ids"`
+	Policies     []OpenIDPolicyMapping `mapstructure:"policies" bson:"policies" json:"policies"`
+}
+
+// OpenIDConfig enables OpenID Connect auth for an API, JWKSCacheTTL is in seconds
+type OpenIDConfig struct {
+	Providers     []OpenIDProvider `mapstructure:"providers" bson:"providers" json:"providers"`
+	IdentityClaim string           `mapstructure:"identity_claim" bson:"identity_claim" json:"identity_claim"`
+	JWKSCacheTTL  int64            `mapstructure:"jwks_cache_ttl" bson:"jwks_cache_ttl" json:"jwks_cache_ttl"`
+}
+
+type OpenIDModuleConfig struct {
+	OpenIDConnect OpenIDConfig `mapstructure:"openid_connect" bson:"openid_connect" json:"openid_connect"`
+}
+
+func GetOpenIDConfig(spec *APISpec) OpenIDConfig {
+	var thisModuleConfig OpenIDModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode OpenID Connect configuration: ", err)
+	}
+
+	thisConfig := thisModuleConfig.OpenIDConnect
+	if thisConfig.IdentityClaim == "" {
+		thisConfig.IdentityClaim = openIDDefaultIdentityClaim
+	}
+	if thisConfig.JWKSCacheTTL <= 0 {
+		thisConfig.JWKSCacheTTL = openIDDefaultJWKSCacheTTL
+	}
+
+	return thisConfig
+}
+
+// IsEnabled is true if any issuer is configured
+func (c OpenIDConfig) IsEnabled() bool {
+	return len(c.Providers) > 0
+}
+
+func (c OpenIDConfig) provider(issuer string) (OpenIDProvider, bool) {
+	for _, thisProvider := range c.Providers {
+		if thisProvider.Issuer == issuer {
+			return thisProvider, true
+		}
+	}
+
+	return OpenIDProvider{}, false
+}
+
+// OpenIDToken is a verified ID token
+type OpenIDToken struct {
+	Issuer   string
+	ClientID string
+	Claims   map[string]interface{}
+}
+
+// claimMatches compares a claim with a configured value, lists match if they contain the value
+func claimMatches(claim interface{}, value string) bool {
+	switch thisClaim := claim.(type) {
+	case []interface{}:
+		for _, item := range thisClaim {
+			if fmt.Sprint(item) == value {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	}
+
+	return fmt.Sprint(claim) == value
+}
+
+// policyFor returns the policy of the first mapping the token matches
+func (p OpenIDProvider) policyFor(thisToken OpenIDToken) (string, bool) {
+	for _, mapping := range p.Policies {
+		if mapping.ClientID != "" && mapping.ClientID != thisToken.ClientID {
+			continue
+		}
+
+		matched := true
+		for claim, value := range mapping.Claims {
+			if !claimMatches(thisToken.Claims[claim], value) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return mapping.PolicyID, true
+		}
+	}
+
+	return "", false
+}
+
+func decodeJWTSegment(segment string) ([]byte, error) {
+	if m := len(segment) % 4; m != 0 {
+		segment += strings.Repeat("=", 4-m)
+	}
+
+	return base64.URLEncoding.DecodeString(segment)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifyJWTSignature checks an RSA or ECDSA signature, symmetric and unsigned tokens are never accepted
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return fmt.Errorf("signing algorithm %s is not supported", alg)
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(signed))
+	hashed := hasher.Sum(nil)
+
+	switch thisKey := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.New("key type does not match the signing algorithm")
+		}
+		return rsa.VerifyPKCS1v15(thisKey, hash, hashed, signature)
+	case *ecdsa.PublicKey:
+		size := (thisKey.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return errors.New("key type does not match the signing algorithm")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(thisKey, hashed, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return errors.New("unsupported key type")
+}
+
+// jsonWebKey is a key of a JWKS document, only the fields of RSA and EC signing keys are read
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, nErr := decodeJWTSegment(k.N)
+		e, eErr := decodeJWTSegment(k.E)
+		if nErr != nil || eErr != nil {
+			return nil, errors.New("malformed RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("curve %s is not supported", k.Crv)
+		}
+		x, xErr := decodeJWTSegment(k.X)
+		y, yErr := decodeJWTSegment(k.Y)
+		if xErr != nil || yErr != nil {
+			return nil, errors.New("malformed EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("key type %s is not supported", k.Kty)
+}
+
+// openIDKeySet is the cached JWKS of an issuer
+type openIDKeySet struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// openIDKeyFetch is a JWKS fetch in progress, requests that need the same issuer wait for it
+type openIDKeyFetch struct {
+	done chan struct{}
+	set  *openIDKeySet
+	err  error
+}
+
+// openIDFetchFailures is the backoff state of an issuer whose keys couldn't be fetched
+type openIDFetchFailures struct {
+	count int
+	retry time.Time
+}
+
+// OpenIDKeyCache keeps the signing keys of each issuer, keys are fetched again once the TTL has passed
+// or when a token is signed with a key that isn't known yet (the issuer rotated its keys). Only one
+// fetch per issuer runs at a time and it runs without holding the lock, an issuer that failed is
+// backed off so requests don't all wait on an issuer that is down
+type OpenIDKeyCache struct {
+	sync.Mutex
+	sets     map[string]*openIDKeySet
+	fetches  map[string]*openIDKeyFetch
+	failures map[string]*openIDFetchFailures
+	client   *http.Client
+}
+
+func NewOpenIDKeyCache(client *http.Client) *OpenIDKeyCache {
+	return &OpenIDKeyCache{
+		sets:     make(map[string]*openIDKeySet),
+		fetches:  make(map[string]*openIDKeyFetch),
+		failures: make(map[string]*openIDFetchFailures),
+		client:   client,
+	}
+}
+
+var openIDKeys = NewOpenIDKeyCache(&http.Client{Timeout: 10 * time.Second})
+
+func (c *OpenIDKeyCache) getJSON(url string, into interface{}) error {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(into)
+}
+
+// jwksURI reads the JWKS location from the provider's discovery document
+func (c *OpenIDKeyCache) jwksURI(thisProvider OpenIDProvider) (string, error) {
+	if thisProvider.JWKSURI != "" {
+		return thisProvider.JWKSURI, nil
+	}
+
+	discoveryURL := thisProvider.DiscoveryURL
+	if discoveryURL == "" {
+		discoveryURL = strings.TrimSuffix(thisProvider.Issuer, "/") + "/.well-known/openid-configuration"
+	}
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := c.getJSON(discoveryURL, &discovery); err != nil {
+		return "", err
+	}
+
+	if discovery.Issuer != thisProvider.Issuer {
+		return "", errors.New("discovery document is for another issuer: " + discovery.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return "", errors.New("discovery document has no jwks_uri")
+	}
+
+	return discovery.JWKSURI, nil
+}
+
+func (c *OpenIDKeyCache) fetch(thisProvider OpenIDProvider) (*openIDKeySet, error) {
+	uri, err := c.jwksURI(thisProvider)
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := c.getJSON(uri, &document); err != nil {
+		return nil, err
+	}
+
+	thisSet := &openIDKeySet{keys: make(map[string]crypto.PublicKey), fetched: time.Now()}
+	for _, thisKey := range document.Keys {
+		if thisKey.Use != "" && thisKey.Use != "sig" {
+			continue
+		}
+
+		publicKey, keyErr := thisKey.publicKey()
+		if keyErr != nil {
+			log.Warning("Skipping key ", thisKey.Kid, " of ", thisProvider.Issuer, ": ", keyErr)
+			continue
+		}
+		thisSet.keys[thisKey.Kid] = publicKey
+	}
+
+	return thisSet, nil
+}
+
+// Key returns the signing key of an issuer, a token without a key ID can only use a JWKS with one key
+func (c *OpenIDKeyCache) Key(thisProvider OpenIDProvider, kid string, ttl int64) (crypto.PublicKey, error) {
+	issuer := thisProvider.Issuer
+
+	c.Lock()
+	thisSet, cached := c.sets[issuer]
+	age := time.Duration(0)
+	if cached {
+		age = time.Since(thisSet.fetched)
+	}
+
+	_, known := thisSet.lookup(kid)
+	expired := age > time.Duration(ttl)*time.Second
+	refresh := !cached || expired || (!known && age > openIDMinRefresh)
+
+	thisFetch, running := c.fetches[issuer]
+	if refresh && !running {
+		if failures, failed := c.failures[issuer]; failed && time.Now().Before(failures.retry) {
+			refresh = false
+		}
+	}
+
+	if refresh {
+		if !running {
+			thisFetch = &openIDKeyFetch{done: make(chan struct{})}
+			c.fetches[issuer] = thisFetch
+			c.Unlock()
+
+			thisFetch.set, thisFetch.err = c.fetch(thisProvider)
+			c.finishFetch(issuer, thisFetch)
+		} else {
+			c.Unlock()
+			<-thisFetch.done
+		}
+
+		if thisFetch.err == nil {
+			thisSet = thisFetch.set
+		}
+	} else {
+		c.Unlock()
+	}
+
+	if thisSet == nil {
+		if refresh && thisFetch.err != nil {
+			return nil, thisFetch.err
+		}
+		return nil, errors.New("signing keys of " + issuer + " are unavailable")
+	}
+
+	publicKey, found := thisSet.lookup(kid)
+	if !found {
+		return nil, errors.New("signing key not found: " + kid)
+	}
+
+	return publicKey, nil
+}
+
+// finishFetch stores the result of a fetch and wakes the requests waiting for it, failures push the
+// next attempt back
+func (c *OpenIDKeyCache) finishFetch(issuer string, thisFetch *openIDKeyFetch) {
+	c.Lock()
+	delete(c.fetches, issuer)
+	if thisFetch.err == nil {
+		c.sets[issuer] = thisFetch.set
+		delete(c.failures, issuer)
+	} else {
+		failures, failed := c.failures[issuer]
+		if !failed {
+			failures = &openIDFetchFailures{}
+			c.failures[issuer] = failures
+		}
+		failures.count++
+
+		backoff := openIDMinRefresh
+		for i := 1; i < failures.count && backoff < openIDMaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > openIDMaxBackoff {
+			backoff = openIDMaxBackoff
+		}
+		failures.retry = time.Now().Add(backoff)
+
+		log.Error("Failed to fetch signing keys of ", issuer, ", retrying in ", backoff, ": ", thisFetch.err)
+	}
+	c.Unlock()
+
+	close(thisFetch.done)
+}
+
+func (s *openIDKeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	if kid == "" && len(s.keys) == 1 {
+		for _, publicKey := range s.keys {
+			return publicKey, true
+		}
+	}
+
+	publicKey, found := s.keys[kid]
+	return publicKey, found
+}
+
+// audiences reads the aud claim, which can be a single value or a list
+func audiences(claims map[string]interface{}) []string {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		values := []string{}
+		for _, item := range aud {
+			if value, ok := item.(string); ok {
+				values = append(values, value)
+			}
+		}
+		return values
+	}
+
+	return []string{}
+}
+
+// claimTime reads a NumericDate claim
+func claimTime(claims map[string]interface{}, name string) (int64, bool) {
+	value, ok := claims[name].(float64)
+	return int64(value), ok
+}
+
+// ValidateIDToken checks the signature, issuer, audience and lifetime of an ID token
+func (c OpenIDConfig) ValidateIDToken(rawToken string) (OpenIDToken, OpenIDProvider, error) {
+	var thisToken OpenIDToken
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return thisToken, OpenIDProvider{}, errors.New("token is not a JWT")
+	}
+
+	var header jwtHeader
+	headerJSON, headerErr := decodeJWTSegment(parts[0])
+	claimsJSON, claimsErr := decodeJWTSegment(parts[1])
+	signature, signatureErr := decodeJWTSegment(parts[2])
+	if headerErr != nil || claimsErr != nil || signatureErr != nil {
+		return thisToken, OpenIDProvider{}, errors.New("token is not correctly encoded")
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return thisToken, OpenIDProvider{}, errors.New("token header is malformed")
+	}
+	if err := json.Unmarshal(claimsJSON, &thisToken.Claims); err != nil {
+		return thisToken, OpenIDProvider{}, errors.New("token claims are malformed")
+	}
+
+	thisToken.Issuer, _ = thisToken.Claims["iss"].(string)
+	thisProvider, found := c.provider(thisToken.Issuer)
+	if !found {
+		return thisToken, thisProvider, errors.New("issuer is not trusted: " + thisToken.Issuer)
+	}
+
+	publicKey, keyErr := openIDKeys.Key(thisProvider, header.Kid, c.JWKSCacheTTL)
+	if keyErr != nil {
+		return thisToken, thisProvider, keyErr
+	}
+	if err := verifyJWTSignature(header.Alg, publicKey, parts[0]+"."+parts[1], signature); err != nil {
+		return thisToken, thisProvider, err
+	}
+
+	now := time.Now().Unix()
+	if exp, ok := claimTime(thisToken.Claims, "exp"); !ok || now > exp+openIDClockSkew {
+		return thisToken, thisProvider, errors.New("token has expired")
+	}
+	if nbf, ok := claimTime(thisToken.Claims, "nbf"); ok && now < nbf-openIDClockSkew {
+		return thisToken, thisProvider, errors.New("token is not valid yet")
+	}
+
+	// The client is the authorized party if there is one, otherwise an audience we accept
+	azp, _ := thisToken.Claims["azp"].(string)
+	for _, aud := range audiences(thisToken.Claims) {
+		for _, clientID := range thisProvider.ClientIDs {
+			if aud == clientID && (azp == "" || azp == clientID) {
+				thisToken.ClientID = clientID
+			}
+		}
+	}
+	if thisToken.ClientID == "" {
+		return thisToken, thisProvider, errors.New("token was not issued to an accepted client")
+	}
+
+	return thisToken, thisProvider, nil
+}
+
+// OpenIDMiddleware authenticates requests with an OpenID Connect ID token sent as a bearer token, each
+// identity gets a session of its own (per issuer and client) with the policy it maps to
+type OpenIDMiddleware struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (k *OpenIDMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (k *OpenIDMiddleware) GetConfig() (interface{}, error) {
+	return GetOpenIDConfig(k.TykMiddleware.Spec), nil
+}
+
+// openIDSessionKey is the key of the session of an identity, it can't collide with keys issued by Tyk
+// or with the key of another identity
+func (k *OpenIDMiddleware) openIDSessionKey(thisToken OpenIDToken, identity string) string {
+	return k.Spec.OrgID + "oidc-" + fmt.Sprintf("%x", sha256.Sum256([]byte(thisToken.Issuer+"|"+thisToken.ClientID+"|"+identity)))
+}
+
+// newOpenIDSession creates the session of an identity seen for the first time, the policy fills in
+// its limits and access rights
+func newOpenIDSession(policy Policy, thisToken OpenIDToken, identity string) SessionState {
+	thisSession := SessionState{
+		OrgID:         policy.OrgID,
+		ApplyPolicyID: policy.ID,
+		QuotaRenews:   time.Now().Unix() + policy.QuotaRenewalRate,
+		MetaData: map[string]interface{}{
+			"oidc_issuer":    thisToken.Issuer,
+			"oidc_client_id": thisToken.ClientID,
+			"oidc_identity":  identity,
+		},
+	}
+	thisSession.QuotaRemaining = policy.QuotaMax
+
+	return thisSession
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (k *OpenIDMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	thisConfig := configuration.(OpenIDConfig)
+
+	authHeaderValue := r.Header.Get("Authorization")
+	rawToken := strings.TrimSpace(strings.TrimPrefix(authHeaderValue, "Bearer "))
+	if rawToken == "" || rawToken == authHeaderValue {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+		}).Info("Attempted access with malformed header, no bearer token found.")
+
+		return errors.New("Authorization field missing"), 400
+	}
+
+	thisToken, thisProvider, err := thisConfig.ValidateIDToken(rawToken)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"issuer": thisToken.Issuer,
+		}).Info("Attempted access with invalid ID token: ", err)
+
+		AuthFailed(k.TykMiddleware, r, rawToken)
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Key not authorised"), 403
+	}
+
+	identity := fmt.Sprint(thisToken.Claims[thisConfig.IdentityClaim])
+	policyID, mapped := thisProvider.policyFor(thisToken)
+	policy, policyFound := Policies[policyID]
+	if _, hasIdentity := thisToken.Claims[thisConfig.IdentityClaim]; !hasIdentity || !mapped || !policyFound {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"issuer": thisToken.Issuer,
+			"client": thisToken.ClientID,
+		}).Info("ID token does not map to a policy.")
+
+		AuthFailed(k.TykMiddleware, r, rawToken)
+		ReportHealthCheckValue(k.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Key not authorised"), 403
+	}
+
+	keyName := k.openIDSessionKey(thisToken, identity)
+	thisSessionState, found := k.Spec.SessionManager.GetSessionDetail(keyName)
+	if !found || thisSessionState.ApplyPolicyID != policyID {
+		// A new identity, or its claims now map to another policy
+		thisSessionState = newOpenIDSession(policy, thisToken, identity)
+	}
+
+	// The policy is applied (and the session stored) on every request so changes to it take effect
+	k.ApplyPolicyIfExists(keyName, &thisSessionState)
+
+	// Set session state on context, we will need it later
+	context.Set(r, SessionData, thisSessionState)
+	context.Set(r, AuthHeaderValue, keyName)
+	context.Set(r, VerifiedClaims, thisToken.Claims)
+
+	return nil, 200
+}
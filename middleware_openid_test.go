@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/context"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeJWTSegment(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+// newTestOpenIDIssuer serves a discovery document and a JWKS with one RSA key
+func newTestOpenIDIssuer(t *testing.T) (*httptest.Server, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": server.URL, "jwks_uri": server.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"use": "sig",
+				"n":   encodeJWTSegment(key.N.Bytes()),
+				"e":   encodeJWTSegment(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+
+	return server, key
+}
+
+func signTestIDToken(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key-1"})
+	payload, _ := json.Marshal(claims)
+	signed := encodeJWTSegment(header) + "." + encodeJWTSegment(payload)
+
+	hashed := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+
+	return signed + "." + encodeJWTSegment(signature)
+}
+
+func testIDTokenClaims(issuer string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    issuer,
+		"sub":    "user-1",
+		"aud":    "client-a",
+		"exp":    time.Now().Unix() + 300,
+		"groups": []string{"staff", "admins"},
+	}
+}
+
+func TestOpenIDValidateIDToken(t *testing.T) {
+	server, key := newTestOpenIDIssuer(t)
+	defer server.Close()
+
+	thisConfig := OpenIDConfig{Providers: []OpenIDProvider{{Issuer: server.URL, ClientIDs: []string{"client-a"}}}, JWKSCacheTTL: 60}
+
+	thisToken, _, err := thisConfig.ValidateIDToken(signTestIDToken(key, testIDTokenClaims(server.URL)))
+	if err != nil {
+		t.Fatal("Valid token was rejected: ", err)
+	}
+	if thisToken.ClientID != "client-a" || thisToken.Claims["sub"] != "user-1" {
+		t.Error("Token wasn't decoded: ", thisToken)
+	}
+
+	claims := testIDTokenClaims(server.URL)
+	claims["aud"] = "client-b"
+	if _, _, err := thisConfig.ValidateIDToken(signTestIDToken(key, claims)); err == nil {
+		t.Error("Token for another client should be rejected")
+	}
+
+	claims = testIDTokenClaims(server.URL)
+	claims["exp"] = time.Now().Unix() - 600
+	if _, _, err := thisConfig.ValidateIDToken(signTestIDToken(key, claims)); err == nil {
+		t.Error("Expired token should be rejected")
+	}
+
+	claims = testIDTokenClaims("https://untrusted.example.com")
+	if _, _, err := thisConfig.ValidateIDToken(signTestIDToken(key, claims)); err == nil {
+		t.Error("Token from an untrusted issuer should be rejected")
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, _, err := thisConfig.ValidateIDToken(signTestIDToken(otherKey, testIDTokenClaims(server.URL))); err == nil {
+		t.Error("Token with a forged signature should be rejected")
+	}
+
+	parts := strings.Split(signTestIDToken(key, testIDTokenClaims(server.URL)), ".")
+	unsigned := encodeJWTSegment([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	if _, _, err := thisConfig.ValidateIDToken(unsigned); err == nil {
+		t.Error("Unsigned token should be rejected")
+	}
+}
+
+func TestOpenIDMiddlewarePolicyMapping(t *testing.T) {
+	server, key := newTestOpenIDIssuer(t)
+	defer server.Close()
+
+	originalPolicies := Policies
+	Policies = map[string]Policy{
+		"admins": {ID: "admins", OrgID: "default", Rate: 1000, Per: 1, QuotaMax: -1},
+		"staff":  {ID: "staff", OrgID: "default", Rate: 10, Per: 1, QuotaMax: 100},
+	}
+	defer func() { Policies = originalPolicies }()
+
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"openid_connect": {
+		"providers": [{
+			"issuer": "`+server.URL+`",
+			"client_ids": ["client-a"],
+			"policies": [
+				{"client_id": "client-a", "claims": {"groups": "admins", "sub": "user-1"}, "policy_id": "admins"},
+				{"claims": {"groups": "staff"}, "policy_id": "staff"}
+			]
+		}]
+	},`, 1))
+	spec.SessionManager = &DefaultSessionManager{Store: &InMemoryStorageManager{Sessions: make(map[string]string)}}
+	spec.Health = &DefaultHealthChecker{}
+
+	if getDefaultAuthMethod(&spec) != AuthMethodOIDC {
+		t.Error("APIs with OpenID Connect providers should use the OIDC middleware")
+	}
+
+	thisMiddleware := &OpenIDMiddleware{&TykMiddleware{&spec, nil}}
+	thisConfig, _ := thisMiddleware.GetConfig()
+
+	runRequest := func(claims map[string]interface{}) (SessionState, int) {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestIDToken(key, claims))
+		defer context.Clear(req)
+
+		_, code := thisMiddleware.ProcessRequest(recorder, req, thisConfig)
+		thisSession, _ := context.Get(req, SessionData).(SessionState)
+		return thisSession, code
+	}
+
+	thisSession, code := runRequest(testIDTokenClaims(server.URL))
+	if code != 200 || thisSession.ApplyPolicyID != "admins" || thisSession.Rate != 1000 {
+		t.Error("Admin should get the admins policy: ", code, thisSession.ApplyPolicyID)
+	}
+
+	claims := testIDTokenClaims(server.URL)
+	claims["sub"] = "user-2"
+	thisSession, code = runRequest(claims)
+	if code != 200 || thisSession.ApplyPolicyID != "staff" || thisSession.QuotaRemaining != 100 {
+		t.Error("Claims should fall through to the staff policy: ", code, thisSession.ApplyPolicyID)
+	}
+
+	claims["groups"] = []string{"contractors"}
+	if _, code := runRequest(claims); code != 403 {
+		t.Error("Identities that don't map to a policy should be rejected, got: ", code)
+	}
+}
+
+func TestOpenIDSessionKey(t *testing.T) {
+	spec := createDefinitionFromString(maintenanceDefinition)
+	thisMiddleware := &OpenIDMiddleware{&TykMiddleware{&spec, nil}}
+	thisToken := OpenIDToken{Issuer: "https://issuer.example.com", ClientID: "client-a"}
+
+	sessionKey := thisMiddleware.openIDSessionKey(thisToken, "user-1")
+	if !strings.HasPrefix(sessionKey, spec.OrgID+"oidc-") || len(sessionKey) != len(spec.OrgID)+len("oidc-")+64 {
+		t.Error("Session key should be the org ID followed by a SHA-256 digest, got: ", sessionKey)
+	}
+
+	if thisMiddleware.openIDSessionKey(thisToken, "user-2") == sessionKey {
+		t.Error("Identities should get their own sessions")
+	}
+
+	thisToken.ClientID = "client-b"
+	if thisMiddleware.openIDSessionKey(thisToken, "user-1") == sessionKey {
+		t.Error("Each client should get its own session for an identity")
+	}
+}
+
+func TestOpenIDKeyCacheSingleFetchAndBackoff(t *testing.T) {
+	server, _ := newTestOpenIDIssuer(t)
+	defer server.Close()
+
+	var fetches int32
+	failing := int32(1)
+	slowIssuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		http.Redirect(w, r, server.URL+r.URL.Path, 302)
+	}))
+	defer slowIssuer.Close()
+
+	keyCache := NewOpenIDKeyCache(&http.Client{Timeout: time.Second})
+	thisProvider := OpenIDProvider{Issuer: server.URL, JWKSURI: slowIssuer.URL + "/keys"}
+
+	getKeys := func() int {
+		var wg sync.WaitGroup
+		var found int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := keyCache.Key(thisProvider, "key-1", 60); err == nil {
+					atomic.AddInt32(&found, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		return int(found)
+	}
+
+	if found := getKeys(); found != 0 || atomic.LoadInt32(&fetches) != 1 {
+		t.Error("Concurrent requests should share one failed fetch: ", found, atomic.LoadInt32(&fetches))
+	}
+
+	// The issuer is backed off after the failure
+	atomic.StoreInt32(&failing, 0)
+	if found := getKeys(); found != 0 || atomic.LoadInt32(&fetches) != 1 {
+		t.Error("Failed issuer should be backed off: ", found, atomic.LoadInt32(&fetches))
+	}
+
+	keyCache.Lock()
+	keyCache.failures[server.URL].retry = time.Now()
+	keyCache.Unlock()
+	if found := getKeys(); found != 10 || atomic.LoadInt32(&fetches) != 2 {
+		t.Error("Keys should be fetched once after the backoff: ", found, atomic.LoadInt32(&fetches))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"github.com/lonelycode/tykcommon"
+	"github.com/mitchellh/mapstructure"
+)
+
+// MiddlewareOrderModuleConfig reorders the chain of an API. The listed middleware (builtin names as
+// reported by /tyk/chain/ or JSVM middleware names) are moved, in the listed order, to the place of
+// the one that comes first in the default chain, everything else keeps its place
+type MiddlewareOrderModuleConfig struct {
+	MiddlewareOrder []string `mapstructure:"middleware_order" bson:"middleware_order" json:"middleware_order"`
+}
+
+// Middleware that need the session of the key, they can't run before auth
+var sessionMiddleware = map[string]bool{
+	"KeyExpired":             true,
+	"KeyIPRestriction":       true,
+	"AccessRightsCheck":      true,
+	"RateLimitAndQuotaCheck": true,
+	"ConcurrencyLimit":       true,
+}
+
+// Middleware that can answer a request on their own, before auth and the session checks they would
+// serve requests that should be rejected
+var respondingMiddleware = map[string]bool{
+	"RedisCacheMiddleware": true,
+	"VirtualEndpoint":      true,
+}
+
+// Middleware that reject requests by the session of the key
+var sessionCheckMiddleware = map[string]bool{
+	"KeyExpired":             true,
+	"KeyIPRestriction":       true,
+	"AccessRightsCheck":      true,
+	"RateLimitAndQuotaCheck": true,
+}
+
+// chainEntry is a builtin or JSVM middleware waiting to be added to the chain
+type chainEntry struct {
+	object  ChainObject
+	builtin TykMiddlewareImplementation
+	dynamic tykcommon.MiddlewareDefinition
+}
+
+func builtinChainEntry(mw TykMiddlewareImplementation) chainEntry {
+	return chainEntry{object: DescribeMiddleware(mw), builtin: mw}
+}
+
+func dynamicChainEntry(mwDef tykcommon.MiddlewareDefinition, hook string) chainEntry {
+	thisObject := ChainObject{Name: mwDef.Name, Type: hook, Source: mwDef.Path}
+	return chainEntry{object: thisObject, dynamic: mwDef}
+}
+
+func (e chainEntry) needsSession() bool {
+	if e.builtin == nil {
+		return e.dynamic.RequireSession
+	}
+
+	return sessionMiddleware[e.object.Name]
+}
+
+// reorderChain moves the middleware in order to the position of the earliest one
+func reorderChain(entries []chainEntry, order []string) ([]chainEntry, error) {
+	positions := make(map[string]int)
+	counts := make(map[string]int)
+	for i, entry := range entries {
+		positions[entry.object.Name] = i
+		counts[entry.object.Name]++
+	}
+
+	listed := make(map[string]bool)
+	insertAt := len(entries)
+	for _, name := range order {
+		position, found := positions[name]
+		if !found {
+			return nil, errors.New("Unknown middleware: " + name)
+		}
+		if listed[name] {
+			return nil, errors.New("Middleware listed more than once: " + name)
+		}
+		if counts[name] > 1 {
+			return nil, errors.New("Middleware is in the chain more than once and can't be moved: " + name)
+		}
+		listed[name] = true
+
+		if position < insertAt {
+			insertAt = position
+		}
+	}
+
+	reordered := []chainEntry{}
+	for i, entry := range entries {
+		if i == insertAt {
+			for _, name := range order {
+				reordered = append(reordered, entries[positions[name]])
+			}
+		}
+		if !listed[entry.object.Name] {
+			reordered = append(reordered, entry)
+		}
+	}
+
+	return reordered, nil
+}
+
+// validateChainOrder rejects chains where middleware would run without the session they need, or
+// could answer requests before they are authenticated
+func validateChainOrder(entries []chainEntry, authChain []TykMiddlewareImplementation) error {
+	authNames := make(map[string]bool)
+	for _, authMw := range authChain {
+		authNames[DescribeMiddleware(authMw).Name] = true
+	}
+
+	lastAuth := -1
+	for i, entry := range entries {
+		if entry.builtin != nil && authNames[entry.object.Name] {
+			lastAuth = i
+		}
+	}
+	if lastAuth == -1 {
+		return nil
+	}
+
+	lastCheck := lastAuth
+	for i, entry := range entries {
+		if entry.builtin != nil && sessionCheckMiddleware[entry.object.Name] && i > lastCheck {
+			lastCheck = i
+		}
+	}
+
+	for i, entry := range entries[:lastCheck] {
+		if i < lastAuth && entry.needsSession() {
+			return errors.New(entry.object.Name + " needs a session and must come after auth")
+		}
+		if entry.builtin != nil && respondingMiddleware[entry.object.Name] {
+			return errors.New(entry.object.Name + " can respond to requests and must come after auth and the session checks")
+		}
+	}
+
+	return nil
+}
+
+// orderChainEntries applies the middleware_order of an API, an invalid order is logged and the
+// default order is used
+func orderChainEntries(spec *APISpec, entries []chainEntry, authChain []TykMiddlewareImplementation) []chainEntry {
+	var thisModuleConfig MiddlewareOrderModuleConfig
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig); err != nil {
+		log.Error("Failed to decode middleware_order: ", err)
+		return entries
+	}
+
+	if len(thisModuleConfig.MiddlewareOrder) == 0 {
+		return entries
+	}
+
+	reordered, err := reorderChain(entries, thisModuleConfig.MiddlewareOrder)
+	if err == nil {
+		err = validateChainOrder(reordered, authChain)
+	}
+	if err != nil {
+		log.Error("Invalid middleware_order for API ", spec.APIID, ", using the default order: ", err)
+		return entries
+	}
+
+	return reordered
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"strings"
+	"testing"
+)
+
+func testChainEntries() ([]chainEntry, []TykMiddlewareImplementation) {
+	authChain := []TykMiddlewareImplementation{&AuthKey{}}
+	entries := []chainEntry{
+		dynamicChainEntry(tykcommon.MiddlewareDefinition{Name: "preMW"}, MW_HOOK_PRE),
+		builtinChainEntry(&VersionCheck{}),
+		builtinChainEntry(authChain[0]),
+		builtinChainEntry(&KeyExpired{}),
+		builtinChainEntry(&TransformMiddleware{}),
+		builtinChainEntry(&RedisCacheMiddleware{}),
+		dynamicChainEntry(tykcommon.MiddlewareDefinition{Name: "postMW", RequireSession: true}, MW_HOOK_POST),
+	}
+
+	return entries, authChain
+}
+
+func chainNames(entries []chainEntry) string {
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.object.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestReorderChain(t *testing.T) {
+	entries, authChain := testChainEntries()
+
+	reordered, err := reorderChain(entries, []string{"TransformMiddleware", "AuthKey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "preMW,VersionCheck,TransformMiddleware,AuthKey,KeyExpired,RedisCacheMiddleware,postMW"
+	if chainNames(reordered) != expected {
+		t.Error("Unexpected order: ", chainNames(reordered))
+	}
+	if err := validateChainOrder(reordered, authChain); err != nil {
+		t.Error("Transform before auth should be allowed: ", err)
+	}
+
+	// JSVM middleware can be moved too
+	reordered, _ = reorderChain(entries, []string{"VersionCheck", "preMW"})
+	if !strings.HasPrefix(chainNames(reordered), "VersionCheck,preMW,AuthKey") {
+		t.Error("Unexpected order: ", chainNames(reordered))
+	}
+}
+
+func TestReorderChainRejectsInvalidOrders(t *testing.T) {
+	entries, authChain := testChainEntries()
+
+	if _, err := reorderChain(entries, []string{"Unknown"}); err == nil {
+		t.Error("Unknown middleware should be rejected")
+	}
+	if _, err := reorderChain(entries, []string{"AuthKey", "AuthKey"}); err == nil {
+		t.Error("Duplicate middleware should be rejected")
+	}
+
+	for _, order := range [][]string{
+		{"KeyExpired", "AuthKey"},
+		{"RedisCacheMiddleware", "AuthKey"},
+		{"RedisCacheMiddleware", "KeyExpired"},
+		{"postMW", "AuthKey"},
+	} {
+		reordered, err := reorderChain(entries, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateChainOrder(reordered, authChain); err == nil {
+			t.Error("Order should be rejected: ", order)
+		}
+	}
+}
@@ -15,13 +15,11 @@ var orgActiveMap = make(map[string]bool)
 type OrganizationMonitor struct {
 	*TykMiddleware
 	sessionlimiter SessionLimiter
-	mon            Monitor
 }
 
 // New lets you do any initialisations for the object can be done here
 func (k *OrganizationMonitor) New() {
 	k.sessionlimiter = SessionLimiter{}
-	k.mon = Monitor{}
 }
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
@@ -30,6 +28,18 @@ func (k *OrganizationMonitor) GetConfig() (interface{}, error) {
 }
 
 func (k *OrganizationMonitor) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	// The kill switch is checked first and from a local cache so a disabled org costs nothing
+	if IsOrgDisabled(k.Spec) {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+			"org":    k.Spec.OrgID,
+		}).Warning("Organisation access is disabled.")
+
+		message, code := OrgDisabledError()
+		return errors.New(message), code
+	}
+
 	if config.ExperimentalProcessOrgOffThread {
 		return k.ProcessRequestOffThread(w, r, configuration)
 	} else {
@@ -40,7 +50,8 @@ func (k *OrganizationMonitor) ProcessRequest(w http.ResponseWriter, r *http.Requ
 // ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
 func (k *OrganizationMonitor) ProcessRequestLive(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
 
-	if !config.EnforceOrgQuotas {
+	thisOrgConfig := GetOrgConfig(k.Spec)
+	if !thisOrgConfig.OrgQuotasEnforced() {
 		// We aren;t enforcing quotas, so skip this altogether
 		return nil, 200
 	}
@@ -56,11 +67,12 @@ func (k *OrganizationMonitor) ProcessRequestLive(w http.ResponseWriter, r *http.
 	if thisSessionState.IsInactive {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 			"key":    k.Spec.OrgID,
 		}).Warning("Organisation access is disabled.")
 
-		return errors.New("This organisation access has been disabled, please contact your API administrator."), 403
+		message, code := OrgDisabledError()
+		return errors.New(message), code
 	}
 
 	// We found a session, apply the quota limiter
@@ -72,16 +84,16 @@ func (k *OrganizationMonitor) ProcessRequestLive(w http.ResponseWriter, r *http.
 		if reason == 2 {
 			log.WithFields(logrus.Fields{
 				"path":   r.URL.Path,
-				"origin": r.RemoteAddr,
+				"origin": GetIPFromRequest(r),
 				"key":    k.Spec.OrgID,
 			}).Warning("Organisation quota has been exceeded.")
 
 			// Fire a quota exceeded event
 			go k.TykMiddleware.FireEvent(EVENT_OrgQuotaExceeded,
 				EVENT_QuotaExceededMeta{
-					EventMetaDefault: EventMetaDefault{Message: "Organisation quota has been exceeded", OriginatingRequest: EncodeRequestToEvent(r)},
+					EventMetaDefault: EventMetaDefault{Message: "Organisation quota has been exceeded", OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
 					Path:             r.URL.Path,
-					Origin:           r.RemoteAddr,
+					Origin:           GetIPFromRequest(r),
 					Key:              k.Spec.OrgID,
 				})
 
@@ -89,9 +101,10 @@ func (k *OrganizationMonitor) ProcessRequestLive(w http.ResponseWriter, r *http.
 		}
 	}
 
-	if config.Monitor.MonitorOrgKeys {
+	if thisOrgConfig.MonitorOrgKeys() {
 		// Run the trigger monitor
-		k.mon.Check(&thisSessionState, "")
+		mon := Monitor{OrgConfig: thisOrgConfig}
+		mon.Check(&thisSessionState, "")
 	}
 	// Request is valid, carry on
 	return nil, 200
@@ -112,7 +125,7 @@ func (k *OrganizationMonitor) SetOrgSentinel(orgChan chan bool, orgId string) {
 
 func (k *OrganizationMonitor) ProcessRequestOffThread(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
 
-	if !config.EnforceOrgQuotas {
+	if !GetOrgConfig(k.Spec).OrgQuotasEnforced() {
 		// We aren't enforcing quotas, so skip this altogether
 		return nil, 200
 	}
@@ -142,6 +155,7 @@ func (k *OrganizationMonitor) ProcessRequestOffThread(w http.ResponseWriter, r *
 
 func (k *OrganizationMonitor) AllowAccessNext(orgChan chan bool, r *http.Request) {
 
+	thisOrgConfig := GetOrgConfig(k.Spec)
 	thisSessionState, found := k.GetOrgSession(k.Spec.OrgID)
 
 	if !found {
@@ -154,7 +168,7 @@ func (k *OrganizationMonitor) AllowAccessNext(orgChan chan bool, r *http.Request
 	if thisSessionState.IsInactive {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 			"key":    k.Spec.OrgID,
 		}).Warning("Organisation access is disabled.")
 
@@ -171,33 +185,35 @@ func (k *OrganizationMonitor) AllowAccessNext(orgChan chan bool, r *http.Request
 	if isQuotaExceeded {
 		log.WithFields(logrus.Fields{
 			"path":   r.URL.Path,
-			"origin": r.RemoteAddr,
+			"origin": GetIPFromRequest(r),
 			"key":    k.Spec.OrgID,
 		}).Warning("Organisation quota has been exceeded.")
 
 		// Fire a quota exceeded event
 		go k.TykMiddleware.FireEvent(EVENT_OrgQuotaExceeded,
 			EVENT_QuotaExceededMeta{
-				EventMetaDefault: EventMetaDefault{Message: "Organisation quota has been exceeded", OriginatingRequest: EncodeRequestToEvent(r)},
+				EventMetaDefault: EventMetaDefault{Message: "Organisation quota has been exceeded", OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
 				Path:             r.URL.Path,
-				Origin:           r.RemoteAddr,
+				Origin:           GetIPFromRequest(r),
 				Key:              k.Spec.OrgID,
 			})
 
 		//return errors.New("This organisation quota has been exceeded, please contact your API administrator"), 403
 		orgChan <- false
 
-		if config.Monitor.MonitorOrgKeys {
+		if thisOrgConfig.MonitorOrgKeys() {
 			// Run the trigger monitor
-			k.mon.Check(&thisSessionState, "")
+			mon := Monitor{OrgConfig: thisOrgConfig}
+			mon.Check(&thisSessionState, "")
 		}
 
 		return
 	}
 
-	if config.Monitor.MonitorOrgKeys {
+	if thisOrgConfig.MonitorOrgKeys() {
 		// Run the trigger monitor
-		k.mon.Check(&thisSessionState, "")
+		mon := Monitor{OrgConfig: thisOrgConfig}
+		mon.Check(&thisSessionState, "")
 	}
 
 	orgChan <- true
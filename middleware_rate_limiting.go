@@ -6,6 +6,13 @@ import (
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The errors a key is rejected with, the error handler uses them to tell the client when to retry
+var (
+	ErrRateLimitExceeded = errors.New("Rate limit exceeded")
+	ErrQuotaExceeded     = errors.New("Quota exceeded")
 )
 
 // RateLimitAndQuotaCheck will check the incomming request and key whether it is within it's quota and
@@ -14,22 +21,87 @@ type RateLimitAndQuotaCheck struct {
 	*TykMiddleware
 }
 
+// RateLimitAndQuotaModuleConfig holds the sections of the API definition the middleware reads
+type RateLimitAndQuotaModuleConfig struct {
+	RateLimitDimension RateLimitDimensionConfig `mapstructure:"rate_limit_dimension" bson:"rate_limit_dimension" json:"rate_limit_dimension"`
+	LimitEnforcement   LimitEnforcementConfig   `mapstructure:"limit_enforcement" bson:"limit_enforcement" json:"limit_enforcement"`
+}
+
 // New lets you do any initialisations for the object can be done here
 func (k *RateLimitAndQuotaCheck) New() {}
 
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (k *RateLimitAndQuotaCheck) GetConfig() (interface{}, error) {
-	return nil, nil
+	var thisModuleConfig RateLimitAndQuotaModuleConfig
+
+	err := mapstructure.Decode(k.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return thisModuleConfig, nil
 }
 
 // ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
 func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
-	sessionLimiter := SessionLimiter{}
 	thisSessionState := context.Get(r, SessionData).(SessionState)
 	authHeaderValue := context.Get(r, AuthHeaderValue).(string)
 
+	thisConfig, _ := configuration.(RateLimitAndQuotaModuleConfig)
+	thisOrgConfig := GetOrgConfig(k.Spec)
+	sessionLimiter := SessionLimiter{
+		Dimension:        thisConfig.RateLimitDimension.GetDimension(r, authHeaderValue, &thisSessionState),
+		DisableRateLimit: thisOrgConfig.RateLimitDisabled(),
+		DisableQuota:     thisOrgConfig.QuotaDisabled(),
+		UseDRL:           k.Spec.DRL,
+	}
+
 	storeRef := k.Spec.SessionManager.GetStore()
-	forwardMessage, reason := sessionLimiter.ForwardMessage(&thisSessionState, authHeaderValue, storeRef)
+	accessingVersion := k.Spec.getVersionFromRequest(r)
+	thisLimit, limitScope, hasLimit := thisSessionState.GetAPILimit(k.Spec.APIID, accessingVersion)
+	checkLimits := func(limiter SessionLimiter) (bool, int) {
+		if hasLimit {
+			// An unhealthy upstream lowers the rate, see AdaptiveRateLimitConfig, the configured
+			// rate is kept in the session
+			appliedLimit := thisLimit
+			if appliedLimit.Rate > 0 {
+				appliedLimit.Rate = adaptedRate(appliedLimit.Rate, k.Spec.APIID)
+			}
+			forwardMessage, reason := limiter.ForwardMessageWithLimit(&thisSessionState, &appliedLimit, authHeaderValue, authHeaderValue+"-"+limitScope, storeRef)
+			appliedLimit.Rate = thisLimit.Rate
+			thisLimit = appliedLimit
+			thisSessionState.SetAPILimit(k.Spec.APIID, accessingVersion, thisLimit)
+			return forwardMessage, reason
+		}
+
+		configuredRate := thisSessionState.Rate
+		if configuredRate > 0 {
+			thisSessionState.Rate = adaptedRate(configuredRate, k.Spec.APIID)
+		}
+		forwardMessage, reason := limiter.ForwardMessage(&thisSessionState, authHeaderValue, storeRef)
+		thisSessionState.Rate = configuredRate
+		return forwardMessage, reason
+	}
+
+	// In monitor only mode violations are reported but the request carries on, the rate limit and
+	// the quota are checked separately so that both are counted and every violation is reported
+	monitorOnly := limitsMonitorOnly(thisConfig.LimitEnforcement, &thisSessionState)
+	reasons := []int{}
+	if monitorOnly {
+		rateLimiter := sessionLimiter
+		rateLimiter.DisableQuota = true
+		quotaLimiter := sessionLimiter
+		quotaLimiter.DisableRateLimit = true
+
+		for _, limiter := range []SessionLimiter{rateLimiter, quotaLimiter} {
+			if forwardMessage, reason := checkLimits(limiter); !forwardMessage {
+				reasons = append(reasons, reason)
+			}
+		}
+	} else if forwardMessage, reason := checkLimits(sessionLimiter); !forwardMessage {
+		reasons = append(reasons, reason)
+	}
 
 	// Ensure quota and rate data for this session are recorded
 	if !config.UseAsyncSessionWrite {
@@ -42,57 +114,75 @@ func (k *RateLimitAndQuotaCheck) ProcessRequest(w http.ResponseWriter, r *http.R
 
 	log.Debug("SessionState: ", thisSessionState)
 
-	if !forwardMessage {
+	// Violations let through in monitor only mode are not counted in the health check as nothing
+	// was throttled
+	logSuffix := ""
+	if monitorOnly {
+		logSuffix = " (monitor only)"
+	}
+
+	for _, reason := range reasons {
 		// TODO Use an Enum!
 		if reason == 1 {
 			log.WithFields(logrus.Fields{
-				"path":   r.URL.Path,
-				"origin": r.RemoteAddr,
-				"key":    authHeaderValue,
-			}).Info("Key rate limit exceeded.")
+				"path":      r.URL.Path,
+				"origin":    GetIPFromRequest(r),
+				"key":       k.Spec.LogMasking.MaskKey(authHeaderValue),
+				"dimension": sessionLimiter.Dimension,
+			}).Info("Key rate limit exceeded." + logSuffix)
 
 			// Fire a rate limit exceeded event
 			go k.TykMiddleware.FireEvent(EVENT_RateLimitExceeded,
 				EVENT_RateLimitExceededMeta{
-					EventMetaDefault: EventMetaDefault{Message: "Key Rate Limit Exceeded", OriginatingRequest: EncodeRequestToEvent(r)},
+					EventMetaDefault: EventMetaDefault{Message: "Key Rate Limit Exceeded" + logSuffix, OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
 					Path:             r.URL.Path,
-					Origin:           r.RemoteAddr,
-					Key:              authHeaderValue,
+					Origin:           GetIPFromRequest(r),
+					Key:              k.Spec.LogMasking.MaskKey(authHeaderValue),
+					MonitorOnly:      monitorOnly,
 				})
 
-			// Report in health check
-			ReportHealthCheckValue(k.Spec.Health, Throttle, "1")
+			if !monitorOnly {
+				// Report in health check
+				ReportHealthCheckValue(k.Spec.Health, Throttle, "1")
 
-			return errors.New("Rate limit exceeded"), 429
+				return ErrRateLimitExceeded, 429
+			}
+			addLimitViolationTag(r, LIMIT_MONITOR_RATE_TAG)
 
 		} else if reason == 2 {
 			log.WithFields(logrus.Fields{
 				"path":   r.URL.Path,
-				"origin": r.RemoteAddr,
-				"key":    authHeaderValue,
-			}).Info("Key quota limit exceeded.")
+				"origin": GetIPFromRequest(r),
+				"key":    k.Spec.LogMasking.MaskKey(authHeaderValue),
+			}).Info("Key quota limit exceeded." + logSuffix)
 
 			// Fire a quota exceeded event
 			go k.TykMiddleware.FireEvent(EVENT_QuotaExceeded,
 				EVENT_QuotaExceededMeta{
-					EventMetaDefault: EventMetaDefault{Message: "Key Quota Limit Exceeded", OriginatingRequest: EncodeRequestToEvent(r)},
+					EventMetaDefault: EventMetaDefault{Message: "Key Quota Limit Exceeded" + logSuffix, OriginatingRequest: EncodeRequestToEvent(k.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, k.Spec)},
 					Path:             r.URL.Path,
-					Origin:           r.RemoteAddr,
-					Key:              authHeaderValue,
+					Origin:           GetIPFromRequest(r),
+					Key:              k.Spec.LogMasking.MaskKey(authHeaderValue),
+					MonitorOnly:      monitorOnly,
 				})
 
-			// Report in health check
-			ReportHealthCheckValue(k.Spec.Health, QuotaViolation, "1")
+			if !monitorOnly {
+				// Report in health check
+				ReportHealthCheckValue(k.Spec.Health, QuotaViolation, "1")
+
+				return ErrQuotaExceeded, 403
+			}
+			addLimitViolationTag(r, LIMIT_MONITOR_QUOTA_TAG)
 
-			return errors.New("Quota exceeded"), 403
+		} else {
+			// Other reason? Still not allowed
+			return errors.New("Access denied"), 403
 		}
-		// Other reason? Still not allowed
-		return errors.New("Access denied"), 403
 	}
 
 	// Run the trigger monitor
-	if config.Monitor.MonitorUserKeys {
-		mon := Monitor{}
+	if thisOrgConfig.MonitorUserKeys() {
+		mon := Monitor{OrgConfig: thisOrgConfig}
 		mon.Check(&thisSessionState, authHeaderValue)
 	}
 
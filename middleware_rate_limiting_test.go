@@ -0,0 +1,165 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"github.com/lonelycode/tykcommon"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLimitMonitorTestSpec(apiMonitorOnly bool) (APISpec, chan EventMessage) {
+	definition := maintenanceDefinition
+	if apiMonitorOnly {
+		definition = strings.Replace(maintenanceDefinition, `"active": false,`, `"limit_enforcement": {"monitor_only": true},`, 1)
+	}
+
+	spec := createDefinitionFromString(definition)
+	spec.SessionManager = &DefaultSessionManager{Store: &InMemoryStorageManager{Sessions: make(map[string]string)}}
+	spec.Health = &DefaultHealthChecker{}
+
+	events := make(chan EventMessage, 10)
+	spec.EventPaths = map[tykcommon.TykEvent][]TykEventHandler{
+		EVENT_QuotaExceeded: {testEventHandler{events}},
+	}
+
+	return spec, events
+}
+
+func runQuotaCheck(spec *APISpec, thisSession SessionState) (int, []string) {
+	thisMiddleware := &RateLimitAndQuotaCheck{&TykMiddleware{spec, nil}}
+	thisConfig, _ := thisMiddleware.GetConfig()
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	defer context.Clear(req)
+	context.Set(req, SessionData, thisSession)
+	context.Set(req, AuthHeaderValue, "monitored-key")
+
+	_, code := thisMiddleware.ProcessRequest(recorder, req, thisConfig)
+	return code, getLimitViolationTags(req)
+}
+
+func newLimitMonitorSession(monitorOnly bool) SessionState {
+	thisSession := createNonThrottledSession()
+	thisSession.QuotaMax = 1
+	thisSession.QuotaRemaining = 1
+	thisSession.QuotaRenewalRate = 300
+	thisSession.MonitorOnlyLimits = monitorOnly
+	return thisSession
+}
+
+func expectMonitoredQuotaEvent(t *testing.T, events chan EventMessage, monitorOnly bool) {
+	select {
+	case em := <-events:
+		if em.EventMetaData.(EVENT_QuotaExceededMeta).MonitorOnly != monitorOnly {
+			t.Error("Event should be marked as monitor only: ", monitorOnly)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Quota exceeded event wasn't fired")
+	}
+}
+
+func TestLimitsEnforced(t *testing.T) {
+	spec, events := newLimitMonitorTestSpec(false)
+
+	if code, _ := runQuotaCheck(&spec, newLimitMonitorSession(false)); code != 200 {
+		t.Fatal("First request should be within the quota, got: ", code)
+	}
+
+	code, tags := runQuotaCheck(&spec, newLimitMonitorSession(false))
+	if code != 403 || len(tags) != 0 {
+		t.Error("Request over the quota should be blocked: ", code, tags)
+	}
+	expectMonitoredQuotaEvent(t, events, false)
+}
+
+func TestLimitsMonitorOnly(t *testing.T) {
+	// Set on the API
+	spec, events := newLimitMonitorTestSpec(true)
+	runQuotaCheck(&spec, newLimitMonitorSession(false))
+
+	code, tags := runQuotaCheck(&spec, newLimitMonitorSession(false))
+	if code != 200 {
+		t.Error("Request over the quota should be let through in monitor only mode, got: ", code)
+	}
+	if len(tags) != 1 || tags[0] != LIMIT_MONITOR_QUOTA_TAG {
+		t.Error("Violation should be tagged for analytics: ", tags)
+	}
+	expectMonitoredQuotaEvent(t, events, true)
+
+	// Set by the policy of the key
+	spec, events = newLimitMonitorTestSpec(false)
+	runQuotaCheck(&spec, newLimitMonitorSession(true))
+
+	if code, _ := runQuotaCheck(&spec, newLimitMonitorSession(true)); code != 200 {
+		t.Error("Keys with monitor only limits should be let through, got: ", code)
+	}
+	expectMonitoredQuotaEvent(t, events, true)
+}
+
+// rollingWindowStore counts the requests in each rate limit window, the in-memory store never limits
+type rollingWindowStore struct {
+	*InMemoryStorageManager
+	windows map[string]int
+}
+
+func (s *rollingWindowStore) SetRollingWindow(keyName string, per int64, expire int64) int {
+	count := s.windows[keyName]
+	s.windows[keyName]++
+	return count
+}
+
+func TestLimitsMonitorOnlyReportsEveryViolation(t *testing.T) {
+	spec, events := newLimitMonitorTestSpec(true)
+	spec.SessionManager = &DefaultSessionManager{Store: &rollingWindowStore{
+		InMemoryStorageManager: &InMemoryStorageManager{Sessions: make(map[string]string)},
+		windows:                make(map[string]int),
+	}}
+
+	thisSession := newLimitMonitorSession(false)
+	thisSession.Rate = 1
+	thisSession.Per = 60
+	runQuotaCheck(&spec, thisSession)
+
+	code, tags := runQuotaCheck(&spec, thisSession)
+	if code != 200 {
+		t.Error("Request over both limits should be let through in monitor only mode, got: ", code)
+	}
+	if strings.Join(tags, ",") != LIMIT_MONITOR_RATE_TAG+","+LIMIT_MONITOR_QUOTA_TAG {
+		t.Error("Both violations should be tagged: ", tags)
+	}
+	expectMonitoredQuotaEvent(t, events, true)
+}
+
+func TestAdaptiveRateLimitLowersTheKeyRate(t *testing.T) {
+	spec, _ := newLimitMonitorTestSpec(false)
+	store := &rollingWindowStore{
+		InMemoryStorageManager: &InMemoryStorageManager{Sessions: make(map[string]string)},
+		windows:                make(map[string]int),
+	}
+	spec.SessionManager = &DefaultSessionManager{Store: store}
+
+	adaptiveRateFactorsLock.Lock()
+	adaptiveRateFactors[spec.APIID] = 0.5
+	adaptiveRateFactorsLock.Unlock()
+	defer func() {
+		adaptiveRateFactorsLock.Lock()
+		delete(adaptiveRateFactors, spec.APIID)
+		adaptiveRateFactorsLock.Unlock()
+	}()
+
+	thisSession := createNonThrottledSession()
+	thisSession.Rate = 2
+	thisSession.Per = 60
+	thisSession.QuotaMax = -1
+
+	if code, _ := runQuotaCheck(&spec, thisSession); code != 200 {
+		t.Fatal("First request should be within the lowered rate, got: ", code)
+	}
+	if code, _ := runQuotaCheck(&spec, thisSession); code != 429 {
+		t.Error("Second request should be over the lowered rate, got: ", code)
+	}
+}
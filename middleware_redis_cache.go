@@ -5,17 +5,20 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
-	"errors"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	UPSTREAM_CACHE_HEADER_NAME     = "x-tyk-cache-action-set"
 	UPSTREAM_CACHE_TTL_HEADER_NAME = "x-tyk-cache-action-set-ttl"
+	CACHE_EXPIRES_HEADER_NAME      = "x-tyk-cache-expires"
 )
 
 // RedisCacheMiddleware is a caching middleware that will pull data from Redis instead of the upstream proxy
@@ -26,6 +29,14 @@ type RedisCacheMiddleware struct {
 }
 
 type RedisCacheMiddlewareConfig struct {
+	ConditionalCache ConditionalCacheConfig `mapstructure:"conditional_cache" bson:"conditional_cache" json:"conditional_cache"`
+}
+
+// ConditionalCacheConfig enables ETag / Last-Modified handling in the cache, expired entries are kept
+// for RevalidationWindow seconds so they can be revalidated against the upstream with a conditional request
+type ConditionalCacheConfig struct {
+	Enabled            bool  `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	RevalidationWindow int64 `mapstructure:"revalidation_window" bson:"revalidation_window" json:"revalidation_window"`
 }
 
 // New lets you do any initialisations for the object can be done here
@@ -36,12 +47,23 @@ func (m *RedisCacheMiddleware) New() {
 // GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
 func (m *RedisCacheMiddleware) GetConfig() (interface{}, error) {
 	var thisModuleConfig RedisCacheMiddlewareConfig
+
+	err := mapstructure.Decode(m.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
 	return thisModuleConfig, nil
 }
 
 func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string) string {
 	h := md5.New()
 	toEncode := strings.Join([]string{req.Method, req.URL.String()}, "-")
+	// Clients that accept different encodings can get different responses
+	if acceptEncoding := req.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+		toEncode += "-" + acceptEncoding
+	}
 	log.Debug("Cache encoding: ", toEncode)
 	io.WriteString(h, toEncode)
 	reqChecksum := hex.EncodeToString(h.Sum(nil))
@@ -51,21 +73,9 @@ func (m RedisCacheMiddleware) CreateCheckSum(req *http.Request, keyName string)
 	return cacheKey
 }
 
-func GetIP(ip string) (string, error) {
-	IPWithoutPort := strings.Split(ip, ":")
-
-	if len(IPWithoutPort) > 1 {
-		ip = IPWithoutPort[0]
-	} else {
-		log.Warning("Strange IP found: ", ip)
-		return "", errors.New("IP Address malformed")
-	}
-
-	return ip, nil
-}
-
 // ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
 func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	var thisConfig = configuration.(RedisCacheMiddlewareConfig)
 
 	// Allow global cache disabe
 	if !m.Spec.APIDefinition.CacheOptions.EnableCache {
@@ -92,16 +102,11 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 		// Cached route matched, let go
 		if stat == StatusCached {
 			var authHeaderValue string
-			var ipErr error
 			authVal := context.Get(r, AuthHeaderValue)
 
 			// No authentication data? use the IP.
 			if authVal == nil {
-				authHeaderValue, ipErr = GetIP(r.RemoteAddr)
-				if ipErr != nil {
-					log.Error(ipErr)
-					return nil, 200
-				}
+				authHeaderValue = GetIPFromRequest(r)
 			} else {
 				authHeaderValue = authVal.(string)
 			}
@@ -122,40 +127,12 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 				} else {
 					// This passes through and will write the value to the writer, but spit out a copy for the cache
 					log.Debug("Not virtual, passing")
+					// The response is cached for every client, so the upstream must send all of it
+					stripConditionalHeaders(r.Header)
 					reqVal = m.sh.ServeHTTPWithCache(w, r)
 				}
 
-				cacheThisRequest := true
-				cacheTTL := m.Spec.APIDefinition.CacheOptions.CacheTimeout
-				// Are we using upstream cache control?
-				if m.Spec.APIDefinition.CacheOptions.EnableUpstreamCacheControl {
-					log.Debug("Upstream control enabled")
-					// Do we cache?
-					if reqVal.Header.Get(UPSTREAM_CACHE_HEADER_NAME) == "" {
-						log.Warning("Upstream cache action not found, not caching")
-						cacheThisRequest = false
-					}
-					// Do we override TTL?
-					ttl := reqVal.Header.Get(UPSTREAM_CACHE_TTL_HEADER_NAME)
-					if ttl != "" {
-						log.Debug("TTL Set upstream")
-						cacheAsInt, valErr := strconv.Atoi(ttl)
-						if valErr != nil {
-							log.Error("Failed to decode TTL cache value: ", valErr)
-							cacheTTL = m.Spec.APIDefinition.CacheOptions.CacheTimeout
-						}
-						cacheTTL = int64(cacheAsInt)
-					}
-				}
-
-				if cacheThisRequest {
-					log.Debug("Caching request to redis")
-					var wireFormatReq bytes.Buffer
-					reqVal.Write(&wireFormatReq)
-					log.Debug("Cache TTL is:", cacheTTL)
-					go m.CacheStore.SetKey(thisKey, wireFormatReq.String(), cacheTTL)
-
-				}
+				m.CacheResponse(thisKey, reqVal, thisConfig)
 				return nil, 666
 
 			}
@@ -170,10 +147,42 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 			}
 
 			defer newRes.Body.Close()
+
+			if thisConfig.ConditionalCache.Enabled && cacheEntryExpired(newRes) {
+				if isVirtual {
+					// Nothing to revalidate against, just regenerate it
+					thisVP := VirtualEndpoint{TykMiddleware: m.TykMiddleware}
+					thisVP.New()
+					m.CacheResponse(thisKey, thisVP.ServeHTTPForCache(w, r), thisConfig)
+					return nil, 666
+				}
+
+				// Stale entry, check if the upstream still considers it valid
+				if !m.revalidate(w, r, thisKey, newRes, thisConfig) {
+					// The upstream sent a fresh response that has already been written out
+					return nil, 666
+				}
+			}
+			newRes.Header.Del(CACHE_EXPIRES_HEADER_NAME)
+
 			for _, h := range hopHeaders {
 				newRes.Header.Del(h)
 			}
 
+			if thisConfig.ConditionalCache.Enabled && IsNotModified(r, newRes) {
+				// The client copy is still valid, no need to send the body
+				for _, h := range []string{"ETag", "Last-Modified", "Cache-Control", "Expires", "Vary"} {
+					if val := newRes.Header.Get(h); val != "" {
+						w.Header().Set(h, val)
+					}
+				}
+				w.Header().Add("x-tyk-cached-response", "1")
+				w.WriteHeader(http.StatusNotModified)
+
+				go m.sh.RecordHit(w, r, 0)
+				return nil, 666
+			}
+
 			copyHeader(w.Header(), newRes.Header)
 			sessObj := context.Get(r, SessionData)
 			var thisSessionState SessionState
@@ -187,9 +196,11 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 			}
 			w.Header().Add("x-tyk-cached-response", "1")
 			w.WriteHeader(newRes.StatusCode)
-			m.Proxy.copyResponse(w, newRes.Body)
+			sizeWriter := &meteringResponseWriter{ResponseWriter: w}
+			m.Proxy.copyResponse(sizeWriter, newRes.Body)
 
 			// Record analytics
+			setTrafficSizes(r, requestSize(r, nil), sizeWriter.bytesOut)
 			go m.sh.RecordHit(w, r, 0)
 
 			// Stop any further execution
@@ -199,3 +210,227 @@ func (m *RedisCacheMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 
 	return nil, 200
 }
+
+// CacheResponse writes an upstream response to the cache store, if conditional caching is enabled
+// an ETag is generated for responses that don't have one and the entry is kept past its TTL so it
+// can be revalidated
+func (m *RedisCacheMiddleware) CacheResponse(thisKey string, reqVal *http.Response, thisConfig RedisCacheMiddlewareConfig) {
+	if reqVal == nil {
+		log.Debug("No response to cache")
+		return
+	}
+
+	if reqVal.StatusCode != http.StatusOK {
+		log.Debug("Not caching response with status: ", reqVal.StatusCode)
+		return
+	}
+
+	cacheThisRequest := true
+	cacheTTL := m.Spec.APIDefinition.CacheOptions.CacheTimeout
+	// Are we using upstream cache control?
+	if m.Spec.APIDefinition.CacheOptions.EnableUpstreamCacheControl {
+		log.Debug("Upstream control enabled")
+		// Do we cache?
+		if reqVal.Header.Get(UPSTREAM_CACHE_HEADER_NAME) == "" {
+			log.Warning("Upstream cache action not found, not caching")
+			cacheThisRequest = false
+		}
+		// Do we override TTL?
+		ttl := reqVal.Header.Get(UPSTREAM_CACHE_TTL_HEADER_NAME)
+		if ttl != "" {
+			log.Debug("TTL Set upstream")
+			cacheAsInt, valErr := strconv.Atoi(ttl)
+			if valErr != nil {
+				log.Error("Failed to decode TTL cache value: ", valErr)
+				cacheTTL = m.Spec.APIDefinition.CacheOptions.CacheTimeout
+			} else {
+				cacheTTL = int64(cacheAsInt)
+			}
+		}
+	}
+
+	if !cacheThisRequest {
+		return
+	}
+
+	storeTTL := cacheTTL
+	if thisConfig.ConditionalCache.Enabled {
+		if reqVal.Header.Get("ETag") == "" && reqVal.Body != nil {
+			bodyBytes, _ := ioutil.ReadAll(reqVal.Body)
+			reqVal.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+			reqVal.Header.Set("ETag", GenerateETag(bodyBytes))
+		}
+
+		reqVal.Header.Set(CACHE_EXPIRES_HEADER_NAME, strconv.Itoa(int(time.Now().Unix()+cacheTTL)))
+		storeTTL = cacheTTL + thisConfig.ConditionalCache.RevalidationWindow
+	}
+
+	log.Debug("Caching request to redis")
+	var wireFormatReq bytes.Buffer
+	reqVal.Write(&wireFormatReq)
+	log.Debug("Cache TTL is:", cacheTTL)
+	go m.CacheStore.SetKey(thisKey, wireFormatReq.String(), storeTTL)
+}
+
+// Headers that let the upstream answer with less than the full response
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+func stripConditionalHeaders(header http.Header) {
+	for _, h := range conditionalHeaders {
+		header.Del(h)
+	}
+}
+
+// revalidate sends a conditional request to the upstream for a stale cache entry, it returns true if the
+// entry is still valid (and has been refreshed) so it can be served, false if the upstream sent a new response
+func (m *RedisCacheMiddleware) revalidate(w http.ResponseWriter, r *http.Request, thisKey string, cachedRes *http.Response, thisConfig RedisCacheMiddlewareConfig) bool {
+	log.Debug("Cache entry expired, revalidating with upstream")
+
+	// The conditional request is made with a copy so the client's request, and its own
+	// conditional headers, are left as they are for the rest of the chain
+	outreq := new(http.Request)
+	*outreq = *r
+	outURL := *r.URL
+	outreq.URL = &outURL
+	outreq.Header = make(http.Header)
+	copyHeader(outreq.Header, r.Header)
+	for k, v := range context.GetAll(r) {
+		context.Set(outreq, k, v)
+	}
+	defer context.Clear(outreq)
+
+	stripConditionalHeaders(outreq.Header)
+	if etag := cachedRes.Header.Get("ETag"); etag != "" {
+		outreq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cachedRes.Header.Get("Last-Modified"); lastModified != "" {
+		outreq.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	// Make sure we get the correct target URL
+	if m.Spec.APIDefinition.Proxy.StripListenPath {
+		outreq.URL.Path = m.Spec.StripListenPath(outreq.URL.Path)
+	}
+
+	revalidationWriter := &RevalidationResponseWriter{ResponseWriter: w, header: make(http.Header)}
+	t1 := time.Now()
+	reqVal := m.Proxy.ServeHTTPForCache(revalidationWriter, outreq)
+	millisec := upstreamLatency(outreq, t1, time.Now())
+
+	// Keep what the proxy recorded (traffic sizes, timings) for the analytics of the request
+	for k, v := range context.GetAll(outreq) {
+		context.Set(r, k, v)
+	}
+
+	if !revalidationWriter.NotModified {
+		go m.sh.RecordHit(w, r, int64(millisec))
+		m.CacheResponse(thisKey, reqVal, thisConfig)
+		return false
+	}
+
+	// Still valid, push the expiry forward
+	log.Debug("Upstream confirmed cache entry is still valid")
+	bodyBytes, _ := ioutil.ReadAll(cachedRes.Body)
+	cachedRes.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	refreshed := *cachedRes
+	refreshed.Header = make(http.Header)
+	copyHeader(refreshed.Header, cachedRes.Header)
+	refreshed.Header.Del(CACHE_EXPIRES_HEADER_NAME)
+	refreshed.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+	m.CacheResponse(thisKey, &refreshed, thisConfig)
+
+	return true
+}
+
+func cacheEntryExpired(res *http.Response) bool {
+	expires := res.Header.Get(CACHE_EXPIRES_HEADER_NAME)
+	if expires == "" {
+		return false
+	}
+
+	expiresAt, err := strconv.Atoi(expires)
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Unix() > int64(expiresAt)
+}
+
+// GenerateETag creates a strong ETag from the response body
+func GenerateETag(body []byte) string {
+	h := md5.New()
+	h.Write(body)
+	return "\"" + hex.EncodeToString(h.Sum(nil)) + "\""
+}
+
+// IsNotModified checks the conditional headers of a request against a cached response
+func IsNotModified(r *http.Request, res *http.Response) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(res.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		lastModified := res.Header.Get("Last-Modified")
+		if lastModified == "" {
+			return false
+		}
+
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		modified, mErr := http.ParseTime(lastModified)
+		if mErr != nil {
+			return false
+		}
+
+		return !modified.After(since)
+	}
+
+	return false
+}
+
+// RevalidationResponseWriter swallows a 304 from the upstream so that the cached copy can be served instead,
+// any other response is passed through to the client as normal
+type RevalidationResponseWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	NotModified bool
+}
+
+func (rw *RevalidationResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *RevalidationResponseWriter) WriteHeader(code int) {
+	if code == http.StatusNotModified {
+		rw.NotModified = true
+		return
+	}
+
+	copyHeader(rw.ResponseWriter.Header(), rw.header)
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *RevalidationResponseWriter) Write(b []byte) (int, error) {
+	if rw.NotModified {
+		return len(b), nil
+	}
+
+	return rw.ResponseWriter.Write(b)
+}
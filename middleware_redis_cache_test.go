@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsNotModifiedWithETag(t *testing.T) {
+	res := &http.Response{Header: make(http.Header)}
+	res.Header.Set("ETag", GenerateETag([]byte("hello world")))
+
+	req, _ := http.NewRequest("GET", "http://example.com/cached", nil)
+	req.Header.Set("If-None-Match", "\"abc\", "+res.Header.Get("ETag"))
+	if !IsNotModified(req, res) {
+		t.Error("Matching ETag should not be modified")
+	}
+
+	req.Header.Set("If-None-Match", GenerateETag([]byte("something else")))
+	if IsNotModified(req, res) {
+		t.Error("Different ETag should be modified")
+	}
+
+	postReq, _ := http.NewRequest("POST", "http://example.com/cached", nil)
+	postReq.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	if IsNotModified(postReq, res) {
+		t.Error("Conditional POST requests should never be served a 304")
+	}
+}
+
+func TestIsNotModifiedWithLastModified(t *testing.T) {
+	res := &http.Response{Header: make(http.Header)}
+	res.Header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+
+	req, _ := http.NewRequest("GET", "http://example.com/cached", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	if !IsNotModified(req, res) {
+		t.Error("Unchanged resource should not be modified")
+	}
+
+	req.Header.Set("If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT")
+	if IsNotModified(req, res) {
+		t.Error("Resource changed since the request date should be modified")
+	}
+}
+
+func TestCacheKeyVariesOnAcceptEncoding(t *testing.T) {
+	spec := createNonVersionedDefinition()
+	m := RedisCacheMiddleware{TykMiddleware: &TykMiddleware{Spec: &spec}}
+
+	plainReq, _ := http.NewRequest("GET", "http://example.com/cached", nil)
+	gzipReq, _ := http.NewRequest("GET", "http://example.com/cached", nil)
+	gzipReq.Header.Set("Accept-Encoding", "gzip")
+
+	if m.CreateCheckSum(plainReq, "") == m.CreateCheckSum(gzipReq, "") {
+		t.Error("Requests with different encodings should be cached separately")
+	}
+}
+
+func TestRevalidateUsesACopyOfTheRequest(t *testing.T) {
+	var upstreamPath, upstreamETag string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		upstreamETag = r.Header.Get("If-None-Match")
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer upstream.Close()
+
+	spec := createDefinitionFromString(BatchTestDef)
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	spec.Init(store, store, store, store)
+	upstreamURL, _ := url.Parse(upstream.URL)
+	m := &RedisCacheMiddleware{
+		TykMiddleware: &TykMiddleware{Spec: &spec, Proxy: TykNewSingleHostReverseProxy(upstreamURL, &spec)},
+		CacheStore:    store,
+	}
+	m.New()
+
+	cachedETag := GenerateETag([]byte("cached"))
+	cachedRes := &http.Response{StatusCode: 200, Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewReader([]byte("cached")))}
+	cachedRes.Header.Set("ETag", cachedETag)
+
+	req, _ := http.NewRequest("GET", "/v1/get", nil)
+	req.Header.Set("If-None-Match", "\"client-etag\"")
+	if !m.revalidate(httptest.NewRecorder(), req, "cache-key", cachedRes, RedisCacheMiddlewareConfig{}) {
+		t.Fatal("A 304 from the upstream should keep the cache entry")
+	}
+
+	if upstreamPath != "/get" {
+		t.Error("Upstream should get the stripped path, got: ", upstreamPath)
+	}
+	if upstreamETag != cachedETag {
+		t.Error("Upstream should be sent the validator of the cache entry, got: ", upstreamETag)
+	}
+
+	if req.URL.Path != "/v1/get" {
+		t.Error("Client request path was changed: ", req.URL.Path)
+	}
+	if req.Header.Get("If-None-Match") != "\"client-etag\"" {
+		t.Error("Client conditional headers were changed: ", req.Header.Get("If-None-Match"))
+	}
+}
+
+func TestStripConditionalHeaders(t *testing.T) {
+	header := make(http.Header)
+	header.Set("If-None-Match", "\"client-etag\"")
+	header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	header.Set("If-Range", "\"client-etag\"")
+	header.Set("Accept", "application/json")
+
+	stripConditionalHeaders(header)
+
+	for _, h := range conditionalHeaders {
+		if header.Get(h) != "" {
+			t.Error("Conditional header should be removed: ", h)
+		}
+	}
+	if header.Get("Accept") != "application/json" {
+		t.Error("Other headers should be kept")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/justinas/alice"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"strconv"
+)
+
+const (
+	SECURITY_HEADERS_DEFAULT_CONTENT_TYPE_OPTIONS = "nosniff"
+	SECURITY_HEADERS_DEFAULT_FRAME_OPTIONS        = "SAMEORIGIN"
+)
+
+// SecurityHeadersConfig sets the security headers added to every response of an API, including
+// the errors generated by the gateway. HSTS is only sent if HSTSMaxAge is set and the CSP only if
+// there is a policy. Headers set by the upstream are kept unless Override is set
+type SecurityHeadersConfig struct {
+	Enabled               bool   `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	HSTSMaxAge            int    `mapstructure:"hsts_max_age" bson:"hsts_max_age" json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool   `mapstructure:"hsts_include_subdomains" bson:"hsts_include_subdomains" json:"hsts_include_subdomains"`
+	HSTSPreload           bool   `mapstructure:"hsts_preload" bson:"hsts_preload" json:"hsts_preload"`
+	ContentTypeOptions    string `mapstructure:"content_type_options" bson:"content_type_options" json:"content_type_options"`
+	FrameOptions          string `mapstructure:"frame_options" bson:"frame_options" json:"frame_options"`
+	ContentSecurityPolicy string `mapstructure:"content_security_policy" bson:"content_security_policy" json:"content_security_policy"`
+	Override              bool   `mapstructure:"override" bson:"override" json:"override"`
+}
+
+type SecurityHeadersModuleConfig struct {
+	SecurityHeaders SecurityHeadersConfig `mapstructure:"security_headers" bson:"security_headers" json:"security_headers"`
+}
+
+// Headers returns the headers to add to each response
+func (c SecurityHeadersConfig) Headers() http.Header {
+	headers := http.Header{}
+
+	if c.HSTSMaxAge > 0 {
+		hsts := "max-age=" + strconv.Itoa(c.HSTSMaxAge)
+		if c.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if c.HSTSPreload {
+			hsts += "; preload"
+		}
+		headers.Set("Strict-Transport-Security", hsts)
+	}
+
+	contentTypeOptions := c.ContentTypeOptions
+	if contentTypeOptions == "" {
+		contentTypeOptions = SECURITY_HEADERS_DEFAULT_CONTENT_TYPE_OPTIONS
+	}
+	headers.Set("X-Content-Type-Options", contentTypeOptions)
+
+	frameOptions := c.FrameOptions
+	if frameOptions == "" {
+		frameOptions = SECURITY_HEADERS_DEFAULT_FRAME_OPTIONS
+	}
+	headers.Set("X-Frame-Options", frameOptions)
+
+	if c.ContentSecurityPolicy != "" {
+		headers.Set("Content-Security-Policy", c.ContentSecurityPolicy)
+	}
+
+	return headers
+}
+
+// securityHeadersWriter adds the headers just before the response is written, so that they can be
+// compared with the ones copied from the upstream response
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	override    bool
+	wroteHeader bool
+}
+
+func (w *securityHeadersWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for name, values := range w.headers {
+			if w.override || w.Header().Get(name) == "" {
+				w.Header()[name] = values
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *securityHeadersWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working when security headers are on
+func (w *securityHeadersWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// SecurityHeadersHandler wraps the chain of an API so its responses get the security headers, it
+// is nil if they aren't enabled for the API
+func SecurityHeadersHandler(spec *APISpec) alice.Constructor {
+	var thisModuleConfig SecurityHeadersModuleConfig
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig); err != nil {
+		log.Error(err)
+		return nil
+	}
+
+	if !thisModuleConfig.SecurityHeaders.Enabled {
+		return nil
+	}
+
+	headers := thisModuleConfig.SecurityHeaders.Headers()
+	override := thisModuleConfig.SecurityHeaders.Override
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(&securityHeadersWriter{ResponseWriter: w, headers: headers, override: override}, r)
+		})
+	}
+}
+
+func handleSecurityHeaders(chain *ChainBuilder, spec *APISpec) {
+	if securityHeadersHandler := SecurityHeadersHandler(spec); securityHeadersHandler != nil {
+		chain.Add(ChainObject{Name: "SecurityHeaders", Type: "builtin"}, securityHeadersHandler)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	securityHeaders := SecurityHeadersConfig{
+		Enabled:               true,
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubdomains: true,
+		ContentSecurityPolicy: "default-src 'self'",
+	}
+	headers := securityHeaders.Headers()
+
+	expected := map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Content-Security-Policy":   "default-src 'self'",
+	}
+	for name, value := range expected {
+		if headers.Get(name) != value {
+			t.Error(name, " should be ", value, ", got: ", headers.Get(name))
+		}
+	}
+
+	if (SecurityHeadersConfig{Enabled: true}).Headers().Get("Strict-Transport-Security") != "" {
+		t.Error("HSTS shouldn't be sent without a max age")
+	}
+}
+
+func TestSecurityHeadersWriter(t *testing.T) {
+	headers := SecurityHeadersConfig{Enabled: true, FrameOptions: "DENY"}.Headers()
+
+	recorder := httptest.NewRecorder()
+	w := &securityHeadersWriter{ResponseWriter: recorder, headers: headers}
+	w.Header().Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+	w.WriteHeader(403)
+
+	if recorder.Header().Get("X-Frame-Options") != "ALLOW-FROM https://example.com" {
+		t.Error("Upstream headers should be kept, got: ", recorder.Header().Get("X-Frame-Options"))
+	}
+	if recorder.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Missing headers should be added to error responses too")
+	}
+
+	recorder = httptest.NewRecorder()
+	w = &securityHeadersWriter{ResponseWriter: recorder, headers: headers, override: true}
+	w.Header().Set("X-Frame-Options", "ALLOW-FROM https://example.com")
+	w.Write([]byte("body"))
+
+	if recorder.Header().Get("X-Frame-Options") != "DENY" {
+		t.Error("Override should replace upstream headers, got: ", recorder.Header().Get("X-Frame-Options"))
+	}
+	if recorder.Code != http.StatusOK {
+		t.Error("Write without WriteHeader should send a 200, got: ", recorder.Code)
+	}
+}
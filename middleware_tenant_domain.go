@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TenantDomainConfig binds an API to a (wildcard) domain, e.g. "{tenant}.api.example.com"
+type TenantDomainConfig struct {
+	Pattern      string `mapstructure:"pattern" bson:"pattern" json:"pattern"`
+	TenantHeader string `mapstructure:"tenant_header" bson:"tenant_header" json:"tenant_header"`
+}
+
+type TenantDomainMiddlewareConfig struct {
+	TenantDomain TenantDomainConfig `mapstructure:"tenant_domain" bson:"tenant_domain" json:"tenant_domain"`
+}
+
+// TenantDomainMiddleware checks that the request was made to the domain the API is bound to and extracts
+// any tenant identifiers from the host name into the request context
+type TenantDomainMiddleware struct {
+	*TykMiddleware
+}
+
+// tenantDomainMatcher is the compiled configuration the middleware runs with, domainRx is nil if the API
+// is not bound to a domain
+type tenantDomainMatcher struct {
+	domainRx     *regexp.Regexp
+	varNames     []string
+	tenantHeader string
+}
+
+var tenantDomainVarRx = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// CompileTenantDomain turns a domain pattern into a regex, each {name} matches a single host label
+func CompileTenantDomain(pattern string) (*regexp.Regexp, []string, error) {
+	varNames := []string{}
+	for _, match := range tenantDomainVarRx.FindAllStringSubmatch(pattern, -1) {
+		varNames = append(varNames, match[1])
+	}
+
+	rxString := regexp.QuoteMeta(strings.ToLower(pattern))
+	// QuoteMeta escapes the braces, so match the escaped form
+	rxString = regexp.MustCompile(`\\\{[a-zA-Z0-9_]+\\\}`).ReplaceAllString(rxString, `([a-z0-9-]+)`)
+
+	domainRx, err := regexp.Compile("^" + rxString + "$")
+	return domainRx, varNames, err
+}
+
+// MatchTenantDomain checks a host against the compiled domain and returns the extracted variables
+func MatchTenantDomain(domainRx *regexp.Regexp, varNames []string, host string) (map[string]string, bool) {
+	if thisHost, _, err := net.SplitHostPort(host); err == nil {
+		host = thisHost
+	}
+
+	matches := domainRx.FindStringSubmatch(strings.ToLower(host))
+	if matches == nil {
+		return nil, false
+	}
+
+	tenantData := make(map[string]string)
+	for i, name := range varNames {
+		tenantData[name] = matches[i+1]
+	}
+
+	return tenantData, true
+}
+
+// New lets you do any initialisations for the object can be done here
+func (t *TenantDomainMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config and compiles the domain pattern
+func (t *TenantDomainMiddleware) GetConfig() (interface{}, error) {
+	var thisModuleConfig TenantDomainMiddlewareConfig
+
+	err := mapstructure.Decode(t.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	thisMatcher := tenantDomainMatcher{tenantHeader: thisModuleConfig.TenantDomain.TenantHeader}
+	if thisModuleConfig.TenantDomain.Pattern != "" {
+		thisMatcher.domainRx, thisMatcher.varNames, err = CompileTenantDomain(thisModuleConfig.TenantDomain.Pattern)
+		if err != nil {
+			log.Error("Failed to compile tenant domain: ", err)
+			return nil, err
+		}
+	}
+
+	return thisMatcher, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (t *TenantDomainMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	var thisMatcher = configuration.(tenantDomainMatcher)
+
+	// Not bound to a domain, pass through
+	if thisMatcher.domainRx == nil {
+		return nil, 200
+	}
+
+	tenantData, found := MatchTenantDomain(thisMatcher.domainRx, thisMatcher.varNames, r.Host)
+	if !found {
+		log.Debug("Request host does not match API domain: ", r.Host)
+		return errors.New("Not found"), 404
+	}
+
+	context.Set(r, TenantData, tenantData)
+
+	if thisMatcher.tenantHeader != "" {
+		if tenantID, ok := tenantData["tenant"]; ok {
+			r.Header.Set(thisMatcher.tenantHeader, tenantID)
+		}
+	}
+
+	return nil, 200
+}
+
+// getTenantTags returns the tenant values extracted from the host as analytics tags, sorted by variable name
+func getTenantTags(r *http.Request) []string {
+	tags := []string{}
+	tenantData, ok := context.Get(r, TenantData).(map[string]string)
+	if !ok {
+		return tags
+	}
+
+	varNames := []string{}
+	for k := range tenantData {
+		varNames = append(varNames, k)
+	}
+	sort.Strings(varNames)
+
+	for _, k := range varNames {
+		tags = append(tags, k+"-"+tenantData[k])
+	}
+
+	return tags
+}
+
+// GetCertificateForHost resolves certificates by exact name first, then by wildcard and finally by the base
+// domain, so a single certificate entry for "api.example.com" or "*.api.example.com" covers all tenants
+func GetCertificateForHost(certNameMap map[string]*tls.Certificate, defaultCerts []tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(hello.ServerName)
+		if cert, ok := certNameMap[name]; ok {
+			return cert, nil
+		}
+
+		labels := strings.Split(name, ".")
+		for i := 1; i < len(labels)-1; i++ {
+			baseDomain := strings.Join(labels[i:], ".")
+			if cert, ok := certNameMap["*."+baseDomain]; ok {
+				return cert, nil
+			}
+			if cert, ok := certNameMap[baseDomain]; ok {
+				return cert, nil
+			}
+		}
+
+		if len(defaultCerts) > 0 {
+			return &defaultCerts[0], nil
+		}
+
+		return nil, errors.New("No certificate found for " + name)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTenantDomainMatch(t *testing.T) {
+	domainRx, varNames, err := CompileTenantDomain("{tenant}.{region}.api.example.com")
+	if err != nil {
+		t.Fatal("Pattern failed to compile: ", err)
+	}
+
+	tenantData, found := MatchTenantDomain(domainRx, varNames, "Acme.eu.api.example.com:8080")
+	if !found {
+		t.Fatal("Host should have matched")
+	}
+
+	if tenantData["tenant"] != "acme" {
+		t.Error("Tenant not extracted, got: ", tenantData["tenant"])
+	}
+
+	if tenantData["region"] != "eu" {
+		t.Error("Region not extracted, got: ", tenantData["region"])
+	}
+}
+
+func TestTenantDomainNoMatch(t *testing.T) {
+	domainRx, varNames, _ := CompileTenantDomain("{tenant}.api.example.com")
+
+	for _, host := range []string{"api.example.com", "a.b.api.example.com", "acme.api.example.org", "acme.apixexample.com"} {
+		if _, found := MatchTenantDomain(domainRx, varNames, host); found {
+			t.Error("Host should not have matched: ", host)
+		}
+	}
+}
+
+func TestTenantTagsAreSorted(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://acme.eu.prod.api.example.com/", nil)
+	context.Set(req, TenantData, map[string]string{"tenant": "acme", "region": "eu", "env": "prod"})
+	defer context.Clear(req)
+
+	expected := []string{"env-prod", "region-eu", "tenant-acme"}
+	for i := 0; i < 10; i++ {
+		if tags := getTenantTags(req); !reflect.DeepEqual(tags, expected) {
+			t.Fatal("Tenant tags should be in a stable order, got: ", tags)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"time"
+)
+
+// middlewareName is the name a middleware's time is recorded under, JSVM middleware use their
+// class name
+func middlewareName(mw TykMiddlewareImplementation) string {
+	return DescribeMiddleware(mw).Name
+}
+
+// recordMiddlewareTiming adds the time a middleware took to the request, in microseconds
+func recordMiddlewareTiming(r *http.Request, name string, elapsed time.Duration) {
+	timings, _ := context.Get(r, MiddlewareTimings).(map[string]int64)
+	if timings == nil {
+		timings = make(map[string]int64)
+		context.Set(r, MiddlewareTimings, timings)
+	}
+
+	timings[name] += elapsed.Nanoseconds() / 1000
+}
+
+// getMiddlewareTimings returns the middleware times of a request, it is nil if timings are disabled
+func getMiddlewareTimings(r *http.Request) map[string]int64 {
+	timings, _ := context.Get(r, MiddlewareTimings).(map[string]int64)
+	return timings
+}
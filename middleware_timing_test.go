@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareTimingsAreRecorded(t *testing.T) {
+	enabled := config.AnalyticsConfig.EnableMiddlewareTimings
+	config.AnalyticsConfig.EnableMiddlewareTimings = true
+	defer func() { config.AnalyticsConfig.EnableMiddlewareTimings = enabled }()
+
+	spec := createDefinitionFromString(methodTransformDefinition)
+	tykMiddleware := &TykMiddleware{&spec, nil}
+	handler := CreateMiddleware(&MethodTransform{TykMiddleware: tykMiddleware}, tykMiddleware)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req, _ := http.NewRequest("GET", "/v1/widgets/1", nil)
+	defer context.Clear(req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	timings := getMiddlewareTimings(req)
+	if _, found := timings["MethodTransform"]; !found {
+		t.Error("Middleware time was not recorded: ", timings)
+	}
+}
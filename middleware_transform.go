@@ -57,13 +57,20 @@ func (t *TransformMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Requ
 		}
 
 		if thisMeta.TemplateMeta.TemplateData.EnableSession {
-			ses := context.Get(r, SessionData).(SessionState)
-			switch bodyData.(type) {
-			case map[string]interface{}:
-				bodyData.(map[string]interface{})["_tyk_meta"] = ses.MetaData
+			// Keyless APIs have no session
+			if ses, ok := context.Get(r, SessionData).(SessionState); ok {
+				switch bodyData.(type) {
+				case map[string]interface{}:
+					bodyData.(map[string]interface{})["_tyk_meta"] = ses.MetaData
+				}
 			}
 		}
 
+		switch bodyData.(type) {
+		case map[string]interface{}:
+			bodyData.(map[string]interface{})["_tyk_context"] = GetContextVars(r)
+		}
+
 		// Apply to template
 		var bodyBuffer bytes.Buffer
 		err = thisMeta.Template.Execute(&bodyBuffer, bodyData)
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"github.com/gorilla/context"
 	"github.com/lonelycode/tykcommon"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -89,6 +91,21 @@ func (m *URLRewriteMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Req
 		if pErr != nil {
 			return pErr, 500
 		}
+
+		// Rewrites to tyk://<api>/path are sent to another API by the proxy, this is checked before
+		// context variables are substituted so request values can't change where the request goes
+		if strings.HasPrefix(p, INTERNAL_API_SCHEME+"://") {
+			rewriteTarget, err := url.Parse(p)
+			if err != nil {
+				return err, 500
+			}
+			rewriteTarget.Path = ReplaceTykContextPathVars(r, rewriteTarget.Path)
+			rewriteTarget.RawQuery = ReplaceTykContextQueryVars(r, rewriteTarget.RawQuery)
+			context.Set(r, URLRewriteTarget, rewriteTarget)
+			p = rewriteTarget.Path
+		} else {
+			p = ReplaceTykContextPathVars(r, p)
+		}
 		r.URL.Path = p
 	}
 	return nil, 200
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"github.com/xeipuuv/gojsonschema"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const VALIDATE_JSON_DEFAULT_ERROR_CODE = 422
+
+// ValidateJSONMeta is a validate_json entry in a version's extended_paths, the request body of
+// matching requests must conform to Schema
+type ValidateJSONMeta struct {
+	Path              string                 `mapstructure:"path" bson:"path" json:"path"`
+	Method            string                 `mapstructure:"method" bson:"method" json:"method"`
+	Schema            map[string]interface{} `mapstructure:"schema" bson:"schema" json:"schema"`
+	ErrorResponseCode int                    `mapstructure:"error_response_code" bson:"error_response_code" json:"error_response_code"`
+}
+
+// ValidateJSONModuleConfig reads the validate_json entries of each version, they aren't part of
+// the versioned extended paths so they are decoded from the raw definition
+type ValidateJSONModuleConfig struct {
+	VersionData struct {
+		Versions map[string]struct {
+			ExtendedPaths struct {
+				ValidateJSON []ValidateJSONMeta `mapstructure:"validate_json"`
+			} `mapstructure:"extended_paths"`
+		} `mapstructure:"versions"`
+	} `mapstructure:"version_data"`
+}
+
+type compiledValidateJSON struct {
+	path      *regexp.Regexp
+	method    string
+	schema    *gojsonschema.Schema
+	errorCode int
+}
+
+// JSONValidationError is returned to the client when a request body doesn't match the schema
+type JSONValidationError struct {
+	Error      string                    `json:"error"`
+	Violations []JSONValidationViolation `json:"violations"`
+}
+
+type JSONValidationViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidateJSON rejects request bodies that don't conform to the JSON schema of their endpoint
+type ValidateJSON struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (v *ValidateJSON) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (v *ValidateJSON) GetConfig() (interface{}, error) {
+	var thisModuleConfig ValidateJSONModuleConfig
+
+	err := mapstructure.Decode(v.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return CompileValidateJSONPaths(thisModuleConfig), nil
+}
+
+// CompileValidateJSONPaths compiles the path regexes and schemas of each version once at load time,
+// invalid schemas are logged and skipped
+func CompileValidateJSONPaths(thisModuleConfig ValidateJSONModuleConfig) map[string][]compiledValidateJSON {
+	apiLangIDsRegex := regexp.MustCompile("{(.*?)}")
+
+	compiled := make(map[string][]compiledValidateJSON)
+	for versionName, version := range thisModuleConfig.VersionData.Versions {
+		for _, entry := range version.ExtendedPaths.ValidateJSON {
+			pathRegex, err := regexp.Compile(apiLangIDsRegex.ReplaceAllString(entry.Path, "(.*?)"))
+			if err != nil {
+				log.Error("Invalid validate_json path ", entry.Path, ", skipping: ", err)
+				continue
+			}
+
+			schema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(entry.Schema))
+			if err != nil {
+				log.Error("Invalid JSON schema for ", entry.Path, ", skipping: ", err)
+				continue
+			}
+
+			errorCode := entry.ErrorResponseCode
+			if errorCode == 0 {
+				errorCode = VALIDATE_JSON_DEFAULT_ERROR_CODE
+			}
+
+			compiled[versionName] = append(compiled[versionName], compiledValidateJSON{
+				path:      pathRegex,
+				method:    entry.Method,
+				schema:    schema,
+				errorCode: errorCode,
+			})
+		}
+	}
+
+	return compiled
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (v *ValidateJSON) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	validations := configuration.(map[string][]compiledValidateJSON)
+	if len(validations) == 0 {
+		return nil, 200
+	}
+
+	_, _, _, stat := v.Spec.GetVersionData(r)
+	if stat != StatusOk {
+		return nil, 200
+	}
+
+	versionKey, _ := context.Get(r, VersionKeyContext).(string)
+	for _, validation := range validations[versionKey] {
+		if !strings.EqualFold(validation.method, r.Method) || !validation.path.MatchString(r.URL.Path) {
+			continue
+		}
+
+		var body []byte
+		if r.Body != nil {
+			body, _ = ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		violations := validateJSONBody(validation.schema, body)
+		if len(violations) == 0 {
+			return nil, 200
+		}
+
+		log.Debug("Request body failed validation: ", r.URL.Path)
+		ReportHealthCheckValue(v.Spec.Health, BlockedRequestLog, "1")
+
+		responseMessage, _ := json.Marshal(JSONValidationError{
+			Error:      "Request body failed validation",
+			Violations: violations,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(validation.errorCode)
+		w.Write(responseMessage)
+		return nil, 666
+	}
+
+	return nil, 200
+}
+
+// validateJSONBody returns the schema violations of a body, a body that isn't JSON is one violation
+func validateJSONBody(schema *gojsonschema.Schema, body []byte) []JSONValidationViolation {
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return []JSONValidationViolation{{Field: "(root)", Message: "Request body is not valid JSON"}}
+	}
+
+	violations := []JSONValidationViolation{}
+	for _, resultError := range result.Errors() {
+		violations = append(violations, JSONValidationViolation{
+			Field:   resultError.Field(),
+			Message: resultError.Description(),
+		})
+	}
+
+	return violations
+}
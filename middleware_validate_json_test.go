@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var validateJSONDefinition string = `
+
+	{
+		"name": "Validated API",
+		"api_id": "validate1",
+		"org_id": "default",
+		"definition": {
+			"location": "header",
+			"key": "version"
+		},
+		"auth": {
+			"auth_header_name": "authorization"
+		},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {
+				"Default": {
+					"name": "Default",
+					"extended_paths": {
+						"validate_json": [
+							{
+								"path": "/v1/widgets",
+								"method": "POST",
+								"schema": {
+									"type": "object",
+									"properties": {
+										"name": {"type": "string"},
+										"size": {"type": "integer", "minimum": 1}
+									},
+									"required": ["name"]
+								}
+							}
+						]
+					}
+				}
+			}
+		},
+		"proxy": {
+			"listen_path": "/v1",
+			"target_url": "http://lonelycode.com",
+			"strip_listen_path": false
+		}
+	}
+
+`
+
+func TestValidateJSON(t *testing.T) {
+	spec := createDefinitionFromString(validateJSONDefinition)
+	validateJSON := &ValidateJSON{TykMiddleware: &TykMiddleware{&spec, nil}}
+	validateJSON.New()
+	thisConfig, err := validateJSON.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		body   string
+		code   int
+	}{
+		{"POST", `{"name": "widget", "size": 2}`, 200},
+		{"POST", `{"size": 0}`, 666},
+		{"POST", `not json`, 666},
+		{"GET", ``, 200},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest(test.method, "/v1/widgets", strings.NewReader(test.body))
+		err, code := validateJSON.ProcessRequest(recorder, req, thisConfig)
+		if err != nil || code != test.code {
+			t.Error(test.method, " ", test.body, " should return ", test.code, ", got: ", code, " ", err)
+			continue
+		}
+
+		if code != 666 {
+			continue
+		}
+
+		if recorder.Code != 422 {
+			t.Error("Invalid bodies should be rejected with a 422, got: ", recorder.Code)
+		}
+
+		var validationError JSONValidationError
+		json.Unmarshal(recorder.Body.Bytes(), &validationError)
+		if len(validationError.Violations) == 0 {
+			t.Error("The violations should be listed, got: ", recorder.Body.String())
+		}
+	}
+}
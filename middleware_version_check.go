@@ -44,9 +44,9 @@ func (v *VersionCheck) ProcessRequest(w http.ResponseWriter, r *http.Request, co
 		// Fire a versioning failure event
 		go v.TykMiddleware.FireEvent(EVENT_VersionFailure,
 			EVENT_VersionFailureMeta{
-				EventMetaDefault: EventMetaDefault{Message: "Attempted access to disallowed version / path.", OriginatingRequest: EncodeRequestToEvent(r)},
+				EventMetaDefault: EventMetaDefault{Message: "Attempted access to disallowed version / path.", OriginatingRequest: EncodeRequestToEvent(v.Spec.LogMasking.MaskRequest(r)), TykContext: eventContextVars(r, v.Spec)},
 				Path:             r.URL.Path,
-				Origin:           r.RemoteAddr,
+				Origin:           GetIPFromRequest(r),
 				Key:              "",
 				Reason:           string(stat),
 			})
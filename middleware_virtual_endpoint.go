@@ -162,8 +162,12 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 
 	// Encode the session object (if not a pre-process)
 	if thisMeta.UseSession {
-		thisSessionState = context.Get(r, SessionData).(SessionState)
-		authHeaderValue = context.Get(r, AuthHeaderValue).(string)
+		if sessVal := context.Get(r, SessionData); sessVal != nil {
+			thisSessionState = sessVal.(SessionState)
+		}
+		if authVal := context.Get(r, AuthHeaderValue); authVal != nil {
+			authHeaderValue = authVal.(string)
+		}
 	}
 
 	sessionAsJsonObj, sessEncErr := json.Marshal(thisSessionState)
@@ -174,21 +178,30 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Run the middleware
-	returnRaw, _ := d.Spec.JSVM.VM.Run(thisMeta.ResponseFunctionName + `(` + string(asJsonRequestObj) + `, ` + string(sessionAsJsonObj) + `, ` + string(asJsonConfigData) + `);`)
-	returnDataStr, _ := returnRaw.ToString()
-
-	// Decode the return object
 	newResponseData := VMResponseObject{}
-	decErr := json.Unmarshal([]byte(returnDataStr), &newResponseData)
+	returnRaw, runErr := d.Spec.JSVM.VM.Run(thisMeta.ResponseFunctionName + `(` + string(asJsonRequestObj) + `, ` + string(sessionAsJsonObj) + `, ` + string(asJsonConfigData) + `);`)
+	if runErr != nil {
+		// Never fall through to the upstream, the endpoint is virtual
+		log.Error("Virtual endpoint function failed: ", runErr)
+		newResponseData.Response = virtualErrorResponse("Virtual endpoint failed")
+	} else {
+		returnDataStr, _ := returnRaw.ToString()
+
+		// Decode the return object
+		decErr := json.Unmarshal([]byte(returnDataStr), &newResponseData)
+		if decErr != nil {
+			log.Error("Failed to decode virtual endpoint response data on return from VM: ", decErr)
+			log.Error("--> Returned: ", returnDataStr)
+			newResponseData = VMResponseObject{Response: virtualErrorResponse("Virtual endpoint returned an invalid response")}
+		}
+	}
 
-	if decErr != nil {
-		log.Error("Failed to decode virtual endpoint response data on return from VM: ", decErr)
-		log.Error("--> Returned: ", returnDataStr)
-		return nil
+	if newResponseData.Response.Code == 0 {
+		newResponseData.Response.Code = 200
 	}
 
 	// Save the sesison data (if modified)
-	if thisMeta.UseSession {
+	if thisMeta.UseSession && authHeaderValue != "" && newResponseData.SessionMeta != nil {
 		thisSessionState.MetaData = newResponseData.SessionMeta
 		d.Spec.SessionManager.UpdateSession(authHeaderValue, thisSessionState, 0)
 	}
@@ -244,6 +257,7 @@ func (d *VirtualEndpoint) ServeHTTPForCache(w http.ResponseWriter, r *http.Reque
 	d.HandleResponse(w, newResponse, &thisSessionState)
 
 	// Record analytics
+	setTrafficSizes(r, requestSize(r, nil), int64(bodyBuffer2.Len()))
 	go d.sh.RecordHit(w, r, 0)
 
 	return copiedRes
@@ -262,6 +276,15 @@ func (d *VirtualEndpoint) ProcessRequest(w http.ResponseWriter, r *http.Request,
 	return nil, 666
 }
 
+// virtualErrorResponse generates the response sent when the JS function fails
+func virtualErrorResponse(msg string) ResponseObject {
+	return ResponseObject{
+		Body:    string(createError(msg)),
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Code:    500,
+	}
+}
+
 func (d *VirtualEndpoint) HandleResponse(rw http.ResponseWriter, res *http.Response, ses *SessionState) error {
 
 	defer res.Body.Close()
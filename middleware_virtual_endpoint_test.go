@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const virtualEndpointTestJS = `
+function virtualThrows(request, session, config) {
+	throw "Something went wrong";
+}
+
+function virtualInvalid(request, session, config) {
+	return "not a response object";
+}
+
+function virtualDefaults(request, session, config) {
+	return JSON.stringify({Response: {Body: "virtual response"}});
+}
+`
+
+var virtualEndpointDefinition string = `
+
+	{
+		"name": "Virtual Endpoint API",
+		"api_id": "virtualendpoint1",
+		"org_id": "default",
+		"use_keyless": true,
+		"definition": {
+			"location": "header",
+			"key": "version"
+		},
+		"auth": {
+			"auth_header_name": "authorization"
+		},
+		"version_data": {
+			"not_versioned": true,
+			"versions": {
+				"Default": {
+					"name": "Default",
+					"use_extended_paths": true,
+					"extended_paths": {
+						"virtual": [
+							{
+								"response_function_name": "virtualThrows",
+								"function_source_type": "blob",
+								"function_source_uri": "VIRTUAL_JS",
+								"path": "/v1/throws",
+								"method": "GET",
+								"use_session": true
+							},
+							{
+								"response_function_name": "virtualInvalid",
+								"function_source_type": "blob",
+								"function_source_uri": "VIRTUAL_JS",
+								"path": "/v1/invalid",
+								"method": "GET",
+								"use_session": true
+							},
+							{
+								"response_function_name": "virtualDefaults",
+								"function_source_type": "blob",
+								"function_source_uri": "VIRTUAL_JS",
+								"path": "/v1/defaults",
+								"method": "GET",
+								"use_session": true
+							}
+						]
+					}
+				}
+			}
+		},
+		"proxy": {
+			"listen_path": "/v1",
+			"target_url": "http://lonelycode.com",
+			"strip_listen_path": false
+		}
+	}
+
+`
+
+func TestVirtualEndpointFailsClosed(t *testing.T) {
+	defStr := strings.Replace(virtualEndpointDefinition, "VIRTUAL_JS", base64.StdEncoding.EncodeToString([]byte(virtualEndpointTestJS)), -1)
+	spec := createDefinitionFromString(defStr)
+	virtualEndpoint := &VirtualEndpoint{TykMiddleware: &TykMiddleware{&spec, nil}}
+	virtualEndpoint.New()
+
+	tests := []struct {
+		path     string
+		expected int
+		body     string
+	}{
+		{"/v1/throws", 500, "Virtual endpoint failed"},
+		{"/v1/invalid", 500, "Virtual endpoint returned an invalid response"},
+		{"/v1/defaults", 200, "virtual response"},
+	}
+
+	for _, test := range tests {
+		// Keyless, so there is no session or key in the request context
+		req, _ := http.NewRequest("GET", test.path, nil)
+		recorder := httptest.NewRecorder()
+
+		err, code := virtualEndpoint.ProcessRequest(recorder, req, nil)
+		if err != nil || code != 666 {
+			t.Error(test.path, " should be answered by the virtual endpoint, got: ", code, " ", err)
+		}
+
+		if recorder.Code != test.expected {
+			t.Error(test.path, " should return ", test.expected, ", got: ", recorder.Code)
+		}
+		if !strings.Contains(recorder.Body.String(), test.body) {
+			t.Error(test.path, " returned the wrong body: ", recorder.Body.String())
+		}
+	}
+}
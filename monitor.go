@@ -2,10 +2,13 @@ package main
 
 import "time"
 
-type Monitor struct{}
+// Monitor fires the trigger events of a session, OrgConfig overrides the global settings when set
+type Monitor struct {
+	OrgConfig *OrgConfig
+}
 
 func (m Monitor) IsMonitorEnabled() bool {
-	if config.Monitor.EnableTriggerMonitors {
+	if m.OrgConfig.TriggerMonitorsEnabled() {
 		return true
 	}
 
@@ -42,16 +45,17 @@ func (m Monitor) Check(sessionData *SessionState, key string) {
 
 	log.Debug("Perc is: ", usagePerc)
 
-	if config.Monitor.GlobalTriggerLimit > 0.0 {
-		if usagePerc >= config.Monitor.GlobalTriggerLimit {
-			m.Fire(sessionData, key, config.Monitor.GlobalTriggerLimit)
+	globalTriggerLimit := m.OrgConfig.GlobalTriggerLimit()
+	if globalTriggerLimit > 0.0 {
+		if usagePerc >= globalTriggerLimit {
+			m.Fire(sessionData, key, globalTriggerLimit)
 		}
 	}
 
 	for _, triggerLimit := range sessionData.Monitor.TriggerLimits {
 		if usagePerc >= triggerLimit {
 
-			if triggerLimit != config.Monitor.GlobalTriggerLimit {
+			if triggerLimit != globalTriggerLimit {
 				m.Fire(sessionData, key, triggerLimit)
 				break
 			}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"strings"
+)
+
+const (
+	AuthMethodToken = "auth_token"
+	AuthMethodOAuth = "oauth"
+	AuthMethodBasic = "basic"
+	AuthMethodHMAC  = "hmac"
+	AuthMethodOIDC  = "oidc"
+	AuthMethodMTLS  = "mtls"
+)
+
+// MultiAuthConfig requires every listed auth method to pass, the session of the base identity
+// provider is the one that rate limits and quotas are applied to
+type MultiAuthConfig struct {
+	Methods              []string `mapstructure:"methods" bson:"methods" json:"methods"`
+	BaseIdentityProvider string   `mapstructure:"base_identity_provider" bson:"base_identity_provider" json:"base_identity_provider"`
+}
+
+type MultiAuthModuleConfig struct {
+	MultiAuth MultiAuthConfig `mapstructure:"multi_auth" bson:"multi_auth" json:"multi_auth"`
+}
+
+// GetMultiAuthConfig reads the multi auth section of the API definition
+func GetMultiAuthConfig(spec *APISpec) MultiAuthConfig {
+	var thisModuleConfig MultiAuthModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode multi auth configuration: ", err)
+	}
+
+	return thisModuleConfig.MultiAuth
+}
+
+// getDefaultAuthMethod selects the single auth method of an API from the standard flags
+func getDefaultAuthMethod(spec *APISpec) string {
+	if spec.APIDefinition.UseOauth2 {
+		return AuthMethodOAuth
+	} else if spec.APIDefinition.UseBasicAuth {
+		return AuthMethodBasic
+	} else if spec.EnableSignatureChecking {
+		return AuthMethodHMAC
+	} else if GetOpenIDConfig(spec).IsEnabled() {
+		return AuthMethodOIDC
+	}
+
+	return AuthMethodToken
+}
+
+func getAuthMiddleware(method string, tykMiddleware *TykMiddleware) (TykMiddlewareImplementation, bool) {
+	switch strings.ToLower(method) {
+	case AuthMethodToken:
+		return &AuthKey{tykMiddleware}, true
+	case AuthMethodOAuth:
+		return &Oauth2KeyExists{tykMiddleware}, true
+	case AuthMethodBasic:
+		return &BasicAuthKeyIsValid{tykMiddleware}, true
+	case AuthMethodHMAC:
+		return &HMACMiddleware{tykMiddleware}, true
+	case AuthMethodOIDC:
+		return &OpenIDMiddleware{tykMiddleware}, true
+	case AuthMethodMTLS:
+		return &MutualTLSMiddleware{tykMiddleware}, true
+	}
+
+	return nil, false
+}
+
+// Validate checks that the base identity provider is one of the methods, otherwise its session
+// would never be set and another method's limits would apply instead
+func (c MultiAuthConfig) Validate() error {
+	if c.BaseIdentityProvider == "" {
+		return nil
+	}
+
+	for _, method := range c.Methods {
+		if strings.ToLower(method) == strings.ToLower(c.BaseIdentityProvider) {
+			return nil
+		}
+	}
+
+	return errors.New("base identity provider " + c.BaseIdentityProvider + " is not one of the auth methods")
+}
+
+// OrderAuthMethods removes duplicates and moves the base identity provider to the end, each auth
+// middleware sets the session on the request context so the last one to run is the one that applies
+func OrderAuthMethods(thisConfig MultiAuthConfig) []string {
+	base := strings.ToLower(thisConfig.BaseIdentityProvider)
+	seen := make(map[string]bool)
+	methods := []string{}
+	hasBase := false
+
+	for _, method := range thisConfig.Methods {
+		method = strings.ToLower(method)
+		if seen[method] {
+			continue
+		}
+		seen[method] = true
+
+		if method == base {
+			hasBase = true
+			continue
+		}
+		methods = append(methods, method)
+	}
+
+	if hasBase {
+		methods = append(methods, base)
+	}
+
+	return methods
+}
+
+// BuildAuthChain returns the auth middleware for an API, a single method unless multi auth is configured
+func BuildAuthChain(spec *APISpec, tykMiddleware *TykMiddleware) []TykMiddlewareImplementation {
+	// An auth_check hook takes over auth completely
+	if thisHooks, supported := GetMiddlewareHooks(spec); thisHooks.AuthCheck.Name != "" {
+		if !supported {
+			return []TykMiddlewareImplementation{&DenyAllMiddleware{tykMiddleware}}
+		}
+
+		return []TykMiddlewareImplementation{&DynamicMiddleware{
+			TykMiddleware:       tykMiddleware,
+			MiddlewareClassName: thisHooks.AuthCheck.Name,
+			Hook:                MW_HOOK_AUTH_CHECK,
+		}}
+	}
+
+	thisConfig := GetMultiAuthConfig(spec)
+	if err := thisConfig.Validate(); err != nil {
+		// Fail closed, like an unknown method
+		log.Error("Invalid multi auth configuration for API ", spec.APIID, ": ", err)
+		return []TykMiddlewareImplementation{&DenyAllMiddleware{tykMiddleware}}
+	}
+
+	methods := OrderAuthMethods(thisConfig)
+
+	if len(methods) == 0 {
+		methods = []string{getDefaultAuthMethod(spec)}
+	} else if thisConfig.BaseIdentityProvider == "" {
+		log.Warning("No base identity provider set for multi auth API ", spec.APIID, ", using the last method: ", methods[len(methods)-1])
+	}
+
+	authChain := []TykMiddlewareImplementation{}
+	for i, method := range methods {
+		authMw, found := getAuthMiddleware(method, tykMiddleware)
+		if !found {
+			// Fail closed, an API that can't enforce all of its auth methods must not be open
+			log.Error("Unknown auth method for API ", spec.APIID, ": ", method)
+			authChain = append(authChain, &DenyAllMiddleware{tykMiddleware})
+			continue
+		}
+		authChain = append(authChain, authMw)
+
+		// The session of every method but the last is replaced by the next one, so it is checked here
+		if i < len(methods)-1 {
+			authChain = append(authChain, &MultiAuthSessionCheck{tykMiddleware})
+		}
+	}
+
+	return authChain
+}
+
+// DenyAllMiddleware rejects every request, it stands in for auth methods that could not be set up
+type DenyAllMiddleware struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (d *DenyAllMiddleware) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (d *DenyAllMiddleware) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (d *DenyAllMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	return errors.New("Authentication is not configured correctly for this API"), 500
+}
+
+// MultiAuthSessionCheck checks the session set by an auth method that isn't the base identity
+// provider, a key that is inactive, expired, used from an address it isn't allowed or not granted
+// this API can't be used to pass one of the methods
+type MultiAuthSessionCheck struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (m *MultiAuthSessionCheck) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (m *MultiAuthSessionCheck) GetConfig() (interface{}, error) {
+	return nil, nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (m *MultiAuthSessionCheck) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	for _, sessionMw := range []TykMiddlewareImplementation{
+		&KeyExpired{m.TykMiddleware},
+		&KeyIPRestriction{m.TykMiddleware},
+		&AccessRightsCheck{m.TykMiddleware},
+	} {
+		if err, errCode := sessionMw.ProcessRequest(w, r, nil); err != nil {
+			return err, errCode
+		}
+	}
+
+	return nil, 200
+}
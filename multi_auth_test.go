@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOrderAuthMethods(t *testing.T) {
+	methods := OrderAuthMethods(MultiAuthConfig{
+		Methods:              []string{"basic", "auth_token", "HMAC", "basic"},
+		BaseIdentityProvider: "basic",
+	})
+
+	expected := []string{"auth_token", "hmac", "basic"}
+	if len(methods) != len(expected) {
+		t.Fatal("Expected ", expected, " got ", methods)
+	}
+
+	for i, method := range expected {
+		if methods[i] != method {
+			t.Error("Expected ", expected, " got ", methods)
+			break
+		}
+	}
+}
+
+func TestOrderAuthMethodsNoBase(t *testing.T) {
+	methods := OrderAuthMethods(MultiAuthConfig{Methods: []string{"hmac", "auth_token"}})
+	if len(methods) != 2 || methods[1] != "auth_token" {
+		t.Error("Order should be kept when there is no base provider, got: ", methods)
+	}
+}
+
+func TestMultiAuthBaseProviderMustBeAMethod(t *testing.T) {
+	if err := (MultiAuthConfig{Methods: []string{"mtls", "auth_token"}, BaseIdentityProvider: "Auth_Token"}).Validate(); err != nil {
+		t.Error("Base provider listed in the methods should be valid: ", err)
+	}
+
+	if err := (MultiAuthConfig{Methods: []string{"mtls", "auth_token"}, BaseIdentityProvider: "basic"}).Validate(); err == nil {
+		t.Error("Base provider that isn't one of the methods should be rejected")
+	}
+}
+
+func TestMultiAuthChecksEverySession(t *testing.T) {
+	spec := createDefinitionFromString(nonExpiringDef)
+	spec.APIDefinition.RawData = map[string]interface{}{
+		"multi_auth": map[string]interface{}{
+			"methods":                []interface{}{"auth_token", "basic", "hmac"},
+			"base_identity_provider": "basic",
+		},
+	}
+	tykMiddleware := &TykMiddleware{&spec, nil}
+
+	names := []string{}
+	for _, authMw := range BuildAuthChain(&spec, tykMiddleware) {
+		names = append(names, DescribeMiddleware(authMw).Name)
+	}
+
+	expected := "AuthKey,MultiAuthSessionCheck,HMACMiddleware,MultiAuthSessionCheck,BasicAuthKeyIsValid"
+	if strings.Join(names, ",") != expected {
+		t.Error("Expected ", expected, " got ", names)
+	}
+}
+
+func TestMultiAuthSessionCheckRejectsOtherAPIs(t *testing.T) {
+	spec := createDefinitionFromString(nonExpiringDef)
+	check := &MultiAuthSessionCheck{&TykMiddleware{&spec, nil}}
+
+	thisSession := createNonThrottledSession()
+	thisSession.AccessRights = map[string]AccessDefinition{"other-api": {APIID: "other-api"}}
+
+	req, _ := http.NewRequest("GET", "/v1/test", nil)
+	context.Set(req, SessionData, thisSession)
+	context.Set(req, AuthHeaderValue, "1234")
+
+	if err, errCode := check.ProcessRequest(httptest.NewRecorder(), req, nil); err == nil || errCode != 403 {
+		t.Error("A session without access to the API should be rejected, got: ", errCode)
+	}
+
+	thisSession.IsInactive = true
+	thisSession.AccessRights = nil
+	context.Set(req, SessionData, thisSession)
+	if err, errCode := check.ProcessRequest(httptest.NewRecorder(), req, nil); err == nil || errCode != 403 {
+		t.Error("An inactive session should be rejected, got: ", errCode)
+	}
+}
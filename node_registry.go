@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/nu7hatch/gouuid"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NODE_REGISTRY_KEY_PREFIX  = "tyk-node."
+	NODE_DEFAULT_HEARTBEAT    = 10
+	NodeStateActive           = "active"
+	nodeHeartbeatsBeforeStale = 3
+)
+
+// NodeInfo is what a gateway publishes about itself with each heartbeat
+type NodeInfo struct {
+	ID         string `json:"id"`
+	Hostname   string `json:"hostname"`
+	Version    string `json:"version"`
+	APICount   int    `json:"api_count"`
+	StartedAt  int64  `json:"started_at"`
+	Uptime     int64  `json:"uptime"`
+	LastSeen   int64  `json:"last_seen"`
+	LastReload int64  `json:"last_reload"`
+	State      string `json:"state"`
+}
+
+// NodeRegistry registers this node in Redis, the entry expires if the node misses three heartbeats
+// so the registry only lists live nodes
+type NodeRegistry struct {
+	sync.Mutex
+	Store      StorageHandler
+	ID         string
+	Interval   int
+	startedAt  time.Time
+	lastReload int64
+}
+
+// Nodes is only set if the node registry is enabled
+var Nodes *NodeRegistry
+
+func NewNodeRegistry(store StorageHandler, interval int) *NodeRegistry {
+	if interval < 1 {
+		interval = NODE_DEFAULT_HEARTBEAT
+	}
+
+	nodeID, _ := uuid.NewV4()
+	now := time.Now()
+	return &NodeRegistry{
+		Store:      store,
+		ID:         nodeID.String(),
+		Interval:   interval,
+		startedAt:  now,
+		lastReload: now.Unix(),
+	}
+}
+
+// Info describes this node
+func (n *NodeRegistry) Info() NodeInfo {
+	n.Lock()
+	lastReload := n.lastReload
+	n.Unlock()
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	return NodeInfo{
+		ID:         n.ID,
+		Hostname:   hostname,
+		Version:    VERSION,
+		APICount:   len(getApiSpecs()),
+		StartedAt:  n.startedAt.Unix(),
+		Uptime:     int64(now.Sub(n.startedAt).Seconds()),
+		LastSeen:   now.Unix(),
+		LastReload: lastReload,
+		State:      NodeDrain.State(),
+	}
+}
+
+// Heartbeat writes the node's entry to the registry
+func (n *NodeRegistry) Heartbeat() error {
+	asJSON, err := json.Marshal(n.Info())
+	if err != nil {
+		return err
+	}
+
+	return n.Store.SetKey(n.ID, string(asJSON), int64(n.Interval*nodeHeartbeatsBeforeStale))
+}
+
+// MarkReloaded records a reload and publishes it straight away, so a coordinated reload can be
+// confirmed from the registry
+func (n *NodeRegistry) MarkReloaded() {
+	n.Lock()
+	n.lastReload = time.Now().Unix()
+	n.Unlock()
+
+	if err := n.Heartbeat(); err != nil {
+		log.Error("Failed to update node registry: ", err)
+	}
+}
+
+// StartHeartbeatLoop registers the node and keeps its entry alive
+func (n *NodeRegistry) StartHeartbeatLoop() {
+	log.Info("Registering node: ", n.ID)
+	for {
+		if err := n.Heartbeat(); err != nil {
+			log.Error("Node heartbeat failed: ", err)
+		}
+		time.Sleep(time.Duration(n.Interval) * time.Second)
+	}
+}
+
+// GetNodes lists the live nodes of the cluster ordered by ID
+func (n *NodeRegistry) GetNodes() []NodeInfo {
+	nodes := []NodeInfo{}
+	for _, asJSON := range n.Store.GetKeysAndValues() {
+		thisNode := NodeInfo{}
+		if err := json.Unmarshal([]byte(asJSON), &thisNode); err != nil {
+			log.Error("Couldn't decode node registry entry: ", err)
+			continue
+		}
+		nodes = append(nodes, thisNode)
+	}
+
+	sort.Sort(nodesByID(nodes))
+	return nodes
+}
+
+// GetNode finds a live node by ID
+func (n *NodeRegistry) GetNode(nodeID string) (NodeInfo, bool) {
+	thisNode := NodeInfo{}
+	asJSON, err := n.Store.GetKey(nodeID)
+	if err != nil {
+		return thisNode, false
+	}
+
+	if err := json.Unmarshal([]byte(asJSON), &thisNode); err != nil {
+		return thisNode, false
+	}
+
+	return thisNode, true
+}
+
+type nodesByID []NodeInfo
+
+func (n nodesByID) Len() int           { return len(n) }
+func (n nodesByID) Less(i, j int) bool { return n[i].ID < n[j].ID }
+func (n nodesByID) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+// isNotificationForThisNode checks if a node reload or drain notification targets this node
+func isNotificationForThisNode(nodeID string) bool {
+	return Nodes != nil && nodeID == Nodes.ID
+}
+
+// clusterNodesHandler exposes the node registry:
+// GET /tyk/cluster/nodes lists the live nodes, GET /tyk/cluster/nodes/{id} returns one and
+// POST /tyk/cluster/nodes/{id}/reload reloads a single node, POST /tyk/cluster/nodes/{id}/drain drains it
+func clusterNodesHandler(w http.ResponseWriter, r *http.Request) {
+	if Nodes == nil {
+		DoJSONWrite(w, 404, createError("Node registry is disabled"))
+		return
+	}
+
+	requestPath := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tyk/cluster/nodes"), "/")
+	parts := strings.Split(requestPath, "/")
+
+	switch {
+	case requestPath == "" && r.Method == "GET":
+		responseMessage, _ := json.Marshal(Nodes.GetNodes())
+		DoJSONWrite(w, 200, responseMessage)
+
+	case len(parts) == 1 && r.Method == "GET":
+		thisNode, found := Nodes.GetNode(parts[0])
+		if !found {
+			DoJSONWrite(w, 404, createError("Node not found"))
+			return
+		}
+		responseMessage, _ := json.Marshal(thisNode)
+		DoJSONWrite(w, 200, responseMessage)
+
+	case len(parts) == 2 && parts[1] == "reload" && r.Method == "POST":
+		if _, found := Nodes.GetNode(parts[0]); !found {
+			DoJSONWrite(w, 404, createError("Node not found"))
+			return
+		}
+
+		MainNotifier.Notify(Notification{
+			Command: NoticeNodeReload,
+			Payload: parts[0],
+		})
+
+		responseMessage, _ := json.Marshal(&APIStatusMessage{"ok", "Reload signalled to node " + parts[0]})
+		DoJSONWrite(w, 200, responseMessage)
+
+	case len(parts) == 2 && parts[1] == "drain" && r.Method == "POST":
+		if _, found := Nodes.GetNode(parts[0]); !found {
+			DoJSONWrite(w, 404, createError("Node not found"))
+			return
+		}
+
+		MainNotifier.Notify(Notification{
+			Command: NoticeNodeDrain,
+			Payload: parts[0],
+		})
+
+		responseMessage, _ := json.Marshal(&APIStatusMessage{"ok", "Drain signalled to node " + parts[0]})
+		DoJSONWrite(w, 200, responseMessage)
+
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+	}
+}
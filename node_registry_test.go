@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNodeRegistry(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	thisRegistry := NewNodeRegistry(store, 0)
+	if thisRegistry.Interval != NODE_DEFAULT_HEARTBEAT {
+		t.Error("Default heartbeat interval was not set")
+	}
+
+	otherNode := NewNodeRegistry(store, 5)
+	thisRegistry.Heartbeat()
+	otherNode.Heartbeat()
+
+	nodes := thisRegistry.GetNodes()
+	if len(nodes) != 2 {
+		t.Fatal("Expected two nodes, got: ", len(nodes))
+	}
+
+	if nodes[0].ID > nodes[1].ID {
+		t.Error("Nodes should be ordered by ID")
+	}
+
+	thisNode, found := thisRegistry.GetNode(thisRegistry.ID)
+	if !found || thisNode.Version != VERSION || thisNode.State != NodeStateActive {
+		t.Error("Node entry is wrong: ", thisNode)
+	}
+
+	NodeDrain.StartDraining()
+	thisRegistry.Heartbeat()
+	NodeDrain.StopDraining()
+	thisNode, _ = thisRegistry.GetNode(thisRegistry.ID)
+	if thisNode.State != NodeStateDraining {
+		t.Error("Draining node should be reported as draining, got: ", thisNode.State)
+	}
+
+	Nodes = thisRegistry
+	defer func() { Nodes = nil }()
+
+	if !isNotificationForThisNode(thisRegistry.ID) || isNotificationForThisNode(otherNode.ID) {
+		t.Error("Node reload should only target the named node")
+	}
+
+	recorder := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/tyk/cluster/nodes/missing", nil)
+	clusterNodesHandler(recorder, req)
+	if recorder.Code != 404 {
+		t.Error("Unknown node should return 404, got: ", recorder.Code)
+	}
+}
@@ -7,11 +7,17 @@ import (
 type NotificationCommand string
 
 const (
-	NoticeApiUpdated    NotificationCommand = "ApiUpdated"
-	NoticeApiRemoved    NotificationCommand = "ApiRemoved"
-	NoticeApiAdded      NotificationCommand = "ApiAdded"
-	NoticeGroupReload   NotificationCommand = "GroupReload"
-	NoticePolicyChanged NotificationCommand = "PolicyChanged"
+	NoticeApiUpdated      NotificationCommand = "ApiUpdated"
+	NoticeApiRemoved      NotificationCommand = "ApiRemoved"
+	NoticeApiAdded        NotificationCommand = "ApiAdded"
+	NoticeGroupReload     NotificationCommand = "GroupReload"
+	NoticePolicyChanged   NotificationCommand = "PolicyChanged"
+	NoticeKeySpaceChanged NotificationCommand = "KeySpaceChanged"
+	NoticeNodeReload      NotificationCommand = "NodeReload"
+	NoticeNodeDrain       NotificationCommand = "NodeDrain"
+	NoticeOrgChanged      NotificationCommand = "OrgChanged"
+	NoticeAPIStateChanged NotificationCommand = "APIStateChanged"
+	NoticeTokenRevoked    NotificationCommand = "TokenRevoked"
 )
 
 // Notification is a type that encodes a message published to a pub sub channel
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	osin "github.com/lonelycode/osin"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PKCEMethodPlain = "plain"
+	PKCEMethodS256  = "S256"
+
+	OAuthRedirectMatchExact = "exact"
+)
+
+// OAuthFlowConfig sets how strictly the authorization code flow of an API is checked, clients created
+// with "public": true have no secret and always have to use PKCE. RedirectMatch "exact" only accepts the
+// redirect_uri the client was registered with (by default it only has to start with it). ConsentHook is
+// a JS function (loaded from ConsentHookPath) that replaces the redirect to auth_login_redirect
+type OAuthFlowConfig struct {
+	RequirePKCE     bool   `mapstructure:"require_pkce" bson:"require_pkce" json:"require_pkce"`
+	AllowPlainPKCE  bool   `mapstructure:"allow_plain_pkce" bson:"allow_plain_pkce" json:"allow_plain_pkce"`
+	RedirectMatch   string `mapstructure:"redirect_match" bson:"redirect_match" json:"redirect_match"`
+	ConsentHook     string `mapstructure:"consent_hook" bson:"consent_hook" json:"consent_hook"`
+	ConsentHookPath string `mapstructure:"consent_hook_path" bson:"consent_hook_path" json:"consent_hook_path"`
+}
+
+type OAuthFlowModuleConfig struct {
+	OAuthFlow OAuthFlowConfig `mapstructure:"oauth_flow" bson:"oauth_flow" json:"oauth_flow"`
+}
+
+func GetOAuthFlowConfig(spec *APISpec) OAuthFlowConfig {
+	var thisModuleConfig OAuthFlowModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode OAuth flow configuration: ", err)
+	}
+
+	return thisModuleConfig.OAuthFlow
+}
+
+// PKCEChallenge is the code_challenge sent with an authorize request, kept until the code is exchanged
+type PKCEChallenge struct {
+	Challenge string `json:"code_challenge"`
+	Method    string `json:"code_challenge_method"`
+}
+
+// isPKCEValue checks the length and characters of a code_challenge or code_verifier (RFC 7636)
+func isPKCEValue(value string) bool {
+	if len(value) < 43 || len(value) > 128 {
+		return false
+	}
+
+	for _, c := range value {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateCodeChallenge checks the code_challenge of an authorize request, the method defaults to plain
+func validateCodeChallenge(challenge string, method string, allowPlain bool) (PKCEChallenge, error) {
+	if method == "" {
+		method = PKCEMethodPlain
+	}
+
+	if method != PKCEMethodS256 && (method != PKCEMethodPlain || !allowPlain) {
+		return PKCEChallenge{}, fmt.Errorf("code_challenge_method %s is not supported", method)
+	}
+
+	if !isPKCEValue(challenge) {
+		return PKCEChallenge{}, errors.New("code_challenge is malformed")
+	}
+
+	return PKCEChallenge{Challenge: challenge, Method: method}, nil
+}
+
+// Verify checks the code_verifier sent when the code is exchanged for a token
+func (c PKCEChallenge) Verify(verifier string) bool {
+	if !isPKCEValue(verifier) {
+		return false
+	}
+
+	expected := verifier
+	if c.Method == PKCEMethodS256 {
+		hashed := sha256.Sum256([]byte(verifier))
+		expected = strings.TrimRight(base64.URLEncoding.EncodeToString(hashed[:]), "=")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(c.Challenge)) == 1
+}
+
+// isPublicClient is true for clients without a secret, they can't keep one (e.g. mobile apps)
+func (o *OAuthManager) isPublicClient(clientID string) bool {
+	client, err := o.OsinServer.Storage.GetClient(clientID)
+	if err != nil {
+		return false
+	}
+
+	return client.GetSecret() == ""
+}
+
+// checkAuthoriseRequest applies the redirect and PKCE rules before osin handles an authorize request
+func (o *OAuthManager) checkAuthoriseRequest(r *http.Request) (*PKCEChallenge, error) {
+	clientID := r.FormValue("client_id")
+	client, err := o.OsinServer.Storage.GetClient(clientID)
+	if err != nil {
+		// osin reports unknown clients
+		return nil, nil
+	}
+
+	redirectURI := r.FormValue("redirect_uri")
+	if o.Flow.RedirectMatch == OAuthRedirectMatchExact && redirectURI != "" && redirectURI != client.GetRedirectUri() {
+		return nil, errors.New("redirect_uri does not match the registered redirect URI")
+	}
+
+	if r.FormValue("response_type") != string(osin.CODE) {
+		return nil, nil
+	}
+
+	challenge := r.FormValue("code_challenge")
+	if challenge == "" {
+		if o.Flow.RequirePKCE || client.GetSecret() == "" {
+			return nil, errors.New("code_challenge is required")
+		}
+		return nil, nil
+	}
+
+	thisChallenge, err := validateCodeChallenge(challenge, r.FormValue("code_challenge_method"), o.Flow.AllowPlainPKCE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &thisChallenge, nil
+}
+
+// checkCodeVerifier verifies the code_verifier of a token request against the challenge stored with the code
+func (o *OAuthManager) checkCodeVerifier(r *http.Request) error {
+	if r.FormValue("grant_type") != string(osin.AUTHORIZATION_CODE) {
+		return nil
+	}
+
+	thisChallenge, err := o.OsinServer.Storage.GetCodeChallenge(r.FormValue("code"))
+	if err != nil {
+		clientID := r.FormValue("client_id")
+		if auth, authErr := osin.CheckBasicAuth(r); authErr == nil && auth != nil {
+			clientID = auth.Username
+		}
+
+		if o.Flow.RequirePKCE || o.isPublicClient(clientID) {
+			return errors.New("code_verifier can't be checked, the code has no code_challenge")
+		}
+		return nil
+	}
+
+	if !thisChallenge.Verify(r.FormValue("code_verifier")) {
+		return errors.New("code_verifier does not match the code_challenge")
+	}
+
+	return nil
+}
+
+// OAuthConsentResult is returned by the consent hook. RedirectTo sends the user to a login page
+// instead, the page completes the flow with /tyk/oauth/authorize-client/ as usual
+type OAuthConsentResult struct {
+	Authorized bool            `json:"authorized"`
+	KeyRules   json.RawMessage `json:"key_rules"`
+	RedirectTo string          `json:"redirect_to"`
+}
+
+// OAuthConsentRequest is passed to the consent hook as its only argument
+type OAuthConsentRequest struct {
+	ClientID     string              `json:"client_id"`
+	RedirectURI  string              `json:"redirect_uri"`
+	ResponseType string              `json:"response_type"`
+	Scope        string              `json:"scope"`
+	State        string              `json:"state"`
+	Headers      map[string][]string `json:"headers"`
+	Params       map[string][]string `json:"params"`
+}
+
+// oauthConsentHook runs the consent hook of an API in a VM of its own, calls are serialised as the VM
+// isn't safe for concurrent use
+type oauthConsentHook struct {
+	Name string
+	vm   *JSVM
+	lock sync.Mutex
+}
+
+func newOAuthConsentHook(thisFlow OAuthFlowConfig) *oauthConsentHook {
+	if thisFlow.ConsentHook == "" {
+		return nil
+	}
+
+	hookVM := &JSVM{}
+	hookVM.Init(config.TykJSPath)
+	if thisFlow.ConsentHookPath != "" {
+		hookVM.LoadJSPaths([]string{thisFlow.ConsentHookPath})
+	}
+	hookVM.VM.Interrupt = make(chan func(), 1)
+
+	return &oauthConsentHook{Name: thisFlow.ConsentHook, vm: hookVM}
+}
+
+func (h *oauthConsentHook) Run(r *http.Request) (*OAuthConsentResult, error) {
+	r.ParseForm()
+	thisRequest := OAuthConsentRequest{
+		ClientID:     r.FormValue("client_id"),
+		RedirectURI:  r.FormValue("redirect_uri"),
+		ResponseType: r.FormValue("response_type"),
+		Scope:        r.FormValue("scope"),
+		State:        r.FormValue("state"),
+		Headers:      r.Header,
+		Params:       r.Form,
+	}
+
+	requestAsJSON, encErr := json.Marshal(thisRequest)
+	if encErr != nil {
+		return nil, encErr
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	done := make(chan error, 1)
+	var returnDataStr string
+	go func() {
+		defer func() {
+			if caught := recover(); caught != nil {
+				done <- fmt.Errorf("consent hook interrupted: %v", caught)
+			}
+		}()
+
+		returnRaw, runErr := h.vm.VM.Run(`JSON.stringify(` + h.Name + `(` + string(requestAsJSON) + `));`)
+		if runErr == nil {
+			returnDataStr, _ = returnRaw.ToString()
+		}
+		done <- runErr
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-time.After(hookDefaultTimeout * time.Second):
+		h.vm.VM.Interrupt <- func() {
+			panic("timeout")
+		}
+		<-done
+		return nil, errors.New("consent hook timed out: " + h.Name)
+	}
+
+	thisResult := &OAuthConsentResult{}
+	if err := json.Unmarshal([]byte(returnDataStr), thisResult); err != nil {
+		return nil, err
+	}
+
+	if thisResult.Authorized && thisResult.RedirectTo == "" && len(thisResult.KeyRules) == 0 {
+		return nil, errors.New("consent hook authorized the request without key_rules")
+	}
+
+	return thisResult, nil
+}
+
+// HandleConsent completes an authorize request with the decision of the consent hook, the user is
+// sent back to the client (with the code or an access_denied error) or to the login page it returned
+func (o *OAuthHandlers) HandleConsent(w http.ResponseWriter, r *http.Request) {
+	thisResult, err := o.Manager.ConsentHook.Run(r)
+	if err != nil {
+		log.Error("[OAuth] Consent hook failed: ", err)
+		w.WriteHeader(500)
+		fmt.Fprintf(w, string(createError("Consent hook failed")))
+		return
+	}
+
+	if thisResult.RedirectTo != "" {
+		w.Header().Add("Location", thisResult.RedirectTo)
+		w.WriteHeader(302)
+		return
+	}
+
+	resp := o.Manager.authorise(r, true, thisResult.Authorized, string(thisResult.KeyRules))
+	redirect, rediErr := resp.GetRedirectUrl()
+	if rediErr != nil {
+		log.Error("[OAuth] Couldn't redirect after consent: ", resp.StatusText)
+		w.WriteHeader(resp.ErrorStatusCode)
+		fmt.Fprintf(w, string(createError(resp.StatusText)))
+		return
+	}
+
+	w.Header().Add("Location", redirect)
+	w.WriteHeader(302)
+}
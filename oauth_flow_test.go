@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	osin "github.com/lonelycode/osin"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// From RFC 7636 appendix B
+const (
+	T_CODE_VERIFIER  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	T_CODE_CHALLENGE = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestPKCEChallengeVerify(t *testing.T) {
+	thisChallenge, err := validateCodeChallenge(T_CODE_CHALLENGE, PKCEMethodS256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !thisChallenge.Verify(T_CODE_VERIFIER) {
+		t.Error("S256 verifier should match")
+	}
+	if thisChallenge.Verify(T_CODE_CHALLENGE) {
+		t.Error("The challenge itself isn't a valid verifier for S256")
+	}
+
+	if _, err := validateCodeChallenge(T_CODE_VERIFIER, "", false); err == nil {
+		t.Error("Plain challenges should only be accepted if allowed")
+	}
+	plain, err := validateCodeChallenge(T_CODE_VERIFIER, "", true)
+	if err != nil || !plain.Verify(T_CODE_VERIFIER) {
+		t.Error("Plain verifier should match: ", err)
+	}
+
+	if _, err := validateCodeChallenge("too-short", PKCEMethodS256, false); err == nil {
+		t.Error("Malformed challenge should be rejected")
+	}
+}
+
+func newTestOAuthManager(thisFlow OAuthFlowConfig) *OAuthManager {
+	return newTestOAuthManagerWithStore(thisFlow, &InMemoryStorageManager{Sessions: make(map[string]string)})
+}
+
+func newTestOAuthManagerWithStore(thisFlow OAuthFlowConfig, store StorageHandler) *OAuthManager {
+	serverConfig := osin.NewServerConfig()
+	serverConfig.AllowedAuthorizeTypes = osin.AllowedAuthorizeType{osin.CODE}
+	serverConfig.AllowedAccessTypes = osin.AllowedAccessType{osin.AUTHORIZATION_CODE}
+
+	sessionManager := &DefaultSessionManager{Store: &InMemoryStorageManager{Sessions: make(map[string]string)}}
+	osinStorage := RedisOsinStorageInterface{store, sessionManager}
+	osinStorage.SetClient(T_CLIENT_ID, &osin.DefaultClient{Id: T_CLIENT_ID, Secret: "aabbccdd", RedirectUri: T_REDIRECT_URI}, false)
+	osinStorage.SetClient("public", &osin.DefaultClient{Id: "public", RedirectUri: T_REDIRECT_URI}, false)
+
+	osinServer := TykOsinNewServer(serverConfig, osinStorage)
+	return &OAuthManager{OsinServer: osinServer, Flow: thisFlow}
+}
+
+func newTestOAuthRequest(uri string, param url.Values) *http.Request {
+	req, _ := http.NewRequest("POST", uri, bytes.NewBufferString(param.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestOAuthPKCEFlow(t *testing.T) {
+	thisManager := newTestOAuthManager(OAuthFlowConfig{})
+
+	param := make(url.Values)
+	param.Set("response_type", "code")
+	param.Set("redirect_uri", T_REDIRECT_URI)
+	param.Set("client_id", "public")
+
+	resp := thisManager.HandleAuthorisation(newTestOAuthRequest("/oauth/authorize/", param), true, keyRules)
+	if !resp.IsError {
+		t.Fatal("Public clients should have to send a code challenge")
+	}
+
+	param.Set("code_challenge", T_CODE_CHALLENGE)
+	param.Set("code_challenge_method", PKCEMethodS256)
+	resp = thisManager.HandleAuthorisation(newTestOAuthRequest("/oauth/authorize/", param), true, keyRules)
+	code, _ := resp.Output["code"].(string)
+	if resp.IsError || code == "" {
+		t.Fatal("Authorisation with a code challenge failed: ", resp.StatusText)
+	}
+
+	tokenParam := make(url.Values)
+	tokenParam.Set("grant_type", "authorization_code")
+	tokenParam.Set("redirect_uri", T_REDIRECT_URI)
+	tokenParam.Set("client_id", "public")
+	tokenParam.Set("code", code)
+	tokenParam.Set("code_verifier", "wrong-verifier-wrong-verifier-wrong-verifier")
+
+	req := newTestOAuthRequest("/oauth/token/", tokenParam)
+	req.Header.Set("Authorization", "Basic cHVibGljOg==")
+	if resp := thisManager.HandleAccess(req); !resp.IsError {
+		t.Error("Token request with the wrong code_verifier should fail")
+	}
+
+	tokenParam.Set("code_verifier", T_CODE_VERIFIER)
+	req = newTestOAuthRequest("/oauth/token/", tokenParam)
+	req.Header.Set("Authorization", "Basic cHVibGljOg==")
+	resp = thisManager.HandleAccess(req)
+	if resp.IsError || resp.Output["access_token"] == nil {
+		t.Error("Token request with the code_verifier failed: ", resp.StatusText)
+	}
+
+	if _, err := thisManager.OsinServer.Storage.GetCodeChallenge(code); err == nil {
+		t.Error("Code challenge should be removed with the code")
+	}
+}
+
+// failingPKCEStore can't store code challenges
+type failingPKCEStore struct {
+	*InMemoryStorageManager
+}
+
+func (s failingPKCEStore) SetKey(keyName string, value string, timeout int64) error {
+	if strings.HasPrefix(keyName, PKCE_PREFIX) {
+		return errors.New("store unavailable")
+	}
+
+	return s.InMemoryStorageManager.SetKey(keyName, value, timeout)
+}
+
+func TestOAuthPKCEChallengeNotStored(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	thisManager := newTestOAuthManagerWithStore(OAuthFlowConfig{}, failingPKCEStore{store})
+
+	param := make(url.Values)
+	param.Set("response_type", "code")
+	param.Set("redirect_uri", T_REDIRECT_URI)
+	param.Set("client_id", "public")
+	param.Set("code_challenge", T_CODE_CHALLENGE)
+	param.Set("code_challenge_method", PKCEMethodS256)
+
+	resp := thisManager.HandleAuthorisation(newTestOAuthRequest("/oauth/authorize/", param), true, keyRules)
+	if !resp.IsError || resp.Output["code"] != nil {
+		t.Error("Authorisation should fail if the code challenge can't be stored")
+	}
+
+	for keyName, _ := range store.Sessions {
+		if strings.HasPrefix(keyName, AUTH_PREFIX) {
+			t.Error("Code without its challenge should be removed: ", keyName)
+		}
+	}
+}
+
+func TestOAuthRedirectMatch(t *testing.T) {
+	param := make(url.Values)
+	param.Set("response_type", "code")
+	param.Set("redirect_uri", T_REDIRECT_URI+"/callback")
+	param.Set("client_id", T_CLIENT_ID)
+
+	thisManager := newTestOAuthManager(OAuthFlowConfig{})
+	if _, err := thisManager.checkAuthoriseRequest(newTestOAuthRequest("/oauth/authorize/", param)); err != nil {
+		t.Error("Redirect URIs are matched by prefix by default: ", err)
+	}
+
+	thisManager = newTestOAuthManager(OAuthFlowConfig{RedirectMatch: OAuthRedirectMatchExact, RequirePKCE: true})
+	if _, err := thisManager.checkAuthoriseRequest(newTestOAuthRequest("/oauth/authorize/", param)); err == nil {
+		t.Error("Redirect URI should have to match exactly")
+	}
+
+	param.Set("redirect_uri", T_REDIRECT_URI)
+	if _, err := thisManager.checkAuthoriseRequest(newTestOAuthRequest("/oauth/authorize/", param)); err == nil {
+		t.Error("PKCE should be required for confidential clients too")
+	}
+}
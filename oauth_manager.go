@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	osin "github.com/lonelycode/osin"
 	"github.com/nu7hatch/gouuid"
@@ -146,6 +147,11 @@ func (o *OAuthHandlers) HandleAuthorizePassthrough(w http.ResponseWriter, r *htt
 			return
 		}
 
+		if o.Manager.ConsentHook != nil {
+			o.HandleConsent(w, r)
+			return
+		}
+
 		w.Header().Add("Location", o.Manager.API.Oauth2Meta.AuthorizeLoginRedirect)
 		w.WriteHeader(307)
 
@@ -221,21 +227,44 @@ func (o *OAuthHandlers) HandleAccessRequest(w http.ResponseWriter, r *http.Reque
 
 // OAuthManager handles and wraps osin OAuth2 functions to handle authorise and access requests
 type OAuthManager struct {
-	API        *APISpec
-	OsinServer *TykOsinServer
+	API         *APISpec
+	OsinServer  *TykOsinServer
+	Flow        OAuthFlowConfig
+	ConsentHook *oauthConsentHook
 }
 
 // HandleAuthorisation creates the authorisation data for the request
 func (o *OAuthManager) HandleAuthorisation(r *http.Request, complete bool, sessionState string) *osin.Response {
+	// Since this is called by the Reource provider (proxied API), we assume it has been approved
+	return o.authorise(r, complete, true, sessionState)
+}
+
+func (o *OAuthManager) authorise(r *http.Request, complete bool, authorized bool, sessionState string) *osin.Response {
 	resp := o.OsinServer.NewResponse()
 
+	thisChallenge, checkErr := o.checkAuthoriseRequest(r)
+	if checkErr != nil {
+		resp.SetError(osin.E_INVALID_REQUEST, checkErr.Error())
+		return resp
+	}
+
 	if ar := o.OsinServer.HandleAuthorizeRequest(resp, r); ar != nil {
-		// Since this is called by the Reource provider (proxied API), we assume it has been approved
-		ar.Authorized = true
+		ar.Authorized = authorized
 
 		if complete {
 			ar.UserData = sessionState
 			o.OsinServer.FinishAuthorizeRequest(resp, r, ar)
+
+			// The challenge lives as long as the code it was sent with, a code without its challenge
+			// can't be used so it is removed again
+			if code, ok := resp.Output["code"].(string); ok && thisChallenge != nil && !resp.IsError {
+				if setErr := o.OsinServer.Storage.SetCodeChallenge(code, *thisChallenge, int64(o.OsinServer.Config.AuthorizationExpiration)); setErr != nil {
+					log.Error("Couldn't store code challenge: ", setErr)
+					o.OsinServer.Storage.RemoveAuthorize(code)
+					resp.SetError(osin.E_SERVER_ERROR, "")
+					resp.InternalError = setErr
+				}
+			}
 		}
 	}
 	if resp.IsError && resp.InternalError != nil {
@@ -248,6 +277,11 @@ func (o *OAuthManager) HandleAuthorisation(r *http.Request, complete bool, sessi
 // HandleAccess wraps an access request with osin's primitives
 func (o *OAuthManager) HandleAccess(r *http.Request) *osin.Response {
 	resp := o.OsinServer.NewResponse()
+	if verifyErr := o.checkCodeVerifier(r); verifyErr != nil {
+		resp.SetError(osin.E_INVALID_GRANT, verifyErr.Error())
+		return resp
+	}
+
 	if ar := o.OsinServer.HandleAccessRequest(resp, r); ar != nil {
 
 		if ar.Type == osin.PASSWORD {
@@ -292,6 +326,7 @@ const (
 	CLIENT_PREFIX  string = "oauth-clientid."
 	ACCESS_PREFIX  string = "oauth-access."
 	REFRESH_PREFIX string = "oauth-refresh."
+	PKCE_PREFIX    string = "oauth-pkce."
 )
 
 type ExtendedOsinStorageInterface interface {
@@ -348,6 +383,12 @@ type ExtendedOsinStorageInterface interface {
 	// RemoveRefresh revokes or deletes refresh AccessData.
 	RemoveRefresh(token string) error
 
+	// SetCodeChallenge keeps the PKCE challenge of an authorization code, it is removed with the code
+	SetCodeChallenge(code string, challenge PKCEChallenge, expiresIn int64) error
+
+	// GetCodeChallenge retrieves the PKCE challenge of an authorization code
+	GetCodeChallenge(code string) (*PKCEChallenge, error)
+
 	// GetUser retrieves a Basic Access user token type from the key store
 	GetUser(string) (*SessionState, error)
 }
@@ -536,9 +577,38 @@ func (r RedisOsinStorageInterface) LoadAuthorize(code string) (*osin.AuthorizeDa
 func (r RedisOsinStorageInterface) RemoveAuthorize(code string) error {
 	key := AUTH_PREFIX + code
 	r.store.DeleteKey(key)
+	r.store.DeleteKey(PKCE_PREFIX + code)
 	return nil
 }
 
+// SetCodeChallenge saves the PKCE challenge of an auth code to redis
+func (r RedisOsinStorageInterface) SetCodeChallenge(code string, challenge PKCEChallenge, expiresIn int64) error {
+	challengeJSON, marshalErr := json.Marshal(&challenge)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	key := PKCE_PREFIX + code
+	log.Debug("Saving code challenge: ", key)
+	return r.store.SetKey(key, string(challengeJSON), expiresIn)
+}
+
+// GetCodeChallenge loads the PKCE challenge of an auth code from redis
+func (r RedisOsinStorageInterface) GetCodeChallenge(code string) (*PKCEChallenge, error) {
+	challengeJSON, storeErr := r.store.GetKey(PKCE_PREFIX + code)
+	if storeErr != nil {
+		return nil, storeErr
+	}
+
+	thisChallenge := PKCEChallenge{}
+	if marshalErr := json.Unmarshal([]byte(challengeJSON), &thisChallenge); marshalErr != nil {
+		log.Error("Couldn't unmarshal code challenge: ", marshalErr)
+		return nil, marshalErr
+	}
+
+	return &thisChallenge, nil
+}
+
 // SaveAccess will save a token and it's access data to redis
 func (r RedisOsinStorageInterface) SaveAccess(accessData *osin.AccessData) error {
 	authDataJSON, marshalErr := json.Marshal(accessData)
@@ -622,6 +692,7 @@ func (r RedisOsinStorageInterface) RemoveAccess(token string) error {
 
 	// remove the access token from central storage too
 	r.sessionManager.RemoveSession(token)
+	broadcastTokenRevoked(storageKeyNamespace(r.sessionManager.GetStore()), publicHash(token), "")
 
 	return nil
 }
@@ -677,6 +748,9 @@ func (a *AccessTokenGenTyk) GenerateAccessToken(data *osin.AccessData, generater
 	}
 
 	accesstoken = keyGen.GenerateAuthKey(newSession.OrgID)
+	if accesstoken == "" {
+		return "", "", errors.New("Access token generation failed")
+	}
 
 	if generaterefresh {
 		u6, _ := uuid.NewV4()
@@ -699,7 +773,7 @@ func (r RedisOsinStorageInterface) GetUser(username string) (*SessionState, erro
 	// new interface means having to make this nested... ick.
 	thisSession := SessionState{}
 
-	if marshalErr := json.Unmarshal([]byte(accessJSON), &thisSession); marshalErr != nil {
+	if marshalErr := decodeSession(accessJSON, &thisSession); marshalErr != nil {
 		log.Error("Couldn't unmarshal OAuth auth data object (LoadRefresh): ", marshalErr)
 		log.Error("Decoding:", accessJSON)
 		return nil, marshalErr
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Learning stops adding new paths to an API after this many, so a crawler can't exhaust memory
+const OPENAPI_LEARNING_MAX_PATHS = 1000
+
+// OpenAPILearningConfig enables learning mode for an API
+type OpenAPILearningConfig struct {
+	Enabled bool `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+}
+
+type OpenAPILearningModuleConfig struct {
+	OpenAPILearning OpenAPILearningConfig `mapstructure:"openapi_learning" bson:"openapi_learning" json:"openapi_learning"`
+}
+
+// GetOpenAPILearningConfig reads the learning mode settings from the API definition
+func GetOpenAPILearningConfig(spec *APISpec) OpenAPILearningConfig {
+	var thisModuleConfig OpenAPILearningModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode OpenAPI learning configuration: ", err)
+	}
+
+	return thisModuleConfig.OpenAPILearning
+}
+
+// LearnedAPI holds the observed path -> method -> status codes of an API
+type LearnedAPI struct {
+	Name       string
+	ListenPath string
+	Paths      map[string]map[string]map[int]bool
+}
+
+// OpenAPILearner collects observed traffic for all APIs in learning mode, it is kept across reloads
+type OpenAPILearner struct {
+	sync.RWMutex
+	apis map[string]*LearnedAPI
+}
+
+var LearnedAPIs = &OpenAPILearner{apis: make(map[string]*LearnedAPI)}
+
+var (
+	learnNumericRx = regexp.MustCompile(`^[0-9]+$`)
+	learnUUIDRx    = regexp.MustCompile(`^[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}$`)
+	learnHexIDRx   = regexp.MustCompile(`^[0-9a-fA-F]{24,}$`)
+	learnParamRx   = regexp.MustCompile(`\{([a-z0-9]+)\}`)
+)
+
+// TemplatePath replaces path segments that look like identifiers with parameters
+func TemplatePath(path string) (string, []string) {
+	params := []string{}
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if learnNumericRx.MatchString(segment) || learnUUIDRx.MatchString(segment) || learnHexIDRx.MatchString(segment) {
+			paramName := "id"
+			if len(params) > 0 {
+				paramName = "id" + strconv.Itoa(len(params)+1)
+			}
+			params = append(params, paramName)
+			segments[i] = "{" + paramName + "}"
+		}
+	}
+
+	templated := strings.Join(segments, "/")
+	if !strings.HasPrefix(templated, "/") {
+		templated = "/" + templated
+	}
+
+	return templated, params
+}
+
+// Observe records a request and the status code that was returned for it
+func (o *OpenAPILearner) Observe(spec *APISpec, method string, path string, code int) {
+	path = strings.TrimPrefix(path, spec.Proxy.ListenPath)
+	templated, _ := TemplatePath(path)
+	method = strings.ToLower(method)
+
+	o.Lock()
+	defer o.Unlock()
+
+	thisAPI, ok := o.apis[spec.APIID]
+	if !ok {
+		thisAPI = &LearnedAPI{Paths: make(map[string]map[string]map[int]bool)}
+		o.apis[spec.APIID] = thisAPI
+	}
+	thisAPI.Name = spec.Name
+	thisAPI.ListenPath = spec.Proxy.ListenPath
+
+	methods, ok := thisAPI.Paths[templated]
+	if !ok {
+		if len(thisAPI.Paths) >= OPENAPI_LEARNING_MAX_PATHS {
+			log.Debug("OpenAPI learning path limit reached for API: ", spec.APIID)
+			return
+		}
+		methods = make(map[string]map[int]bool)
+		thisAPI.Paths[templated] = methods
+	}
+
+	if methods[method] == nil {
+		methods[method] = make(map[int]bool)
+	}
+	methods[method][code] = true
+}
+
+// Reset removes all observations for an API
+func (o *OpenAPILearner) Reset(APIID string) {
+	o.Lock()
+	delete(o.apis, APIID)
+	o.Unlock()
+}
+
+// GenerateDocument builds a draft OpenAPI 3 document from the observations of an API
+func (o *OpenAPILearner) GenerateDocument(APIID string) (map[string]interface{}, bool) {
+	o.RLock()
+	defer o.RUnlock()
+
+	thisAPI, ok := o.apis[APIID]
+	if !ok {
+		return nil, false
+	}
+
+	paths := make(map[string]interface{})
+	for path, methods := range thisAPI.Paths {
+		params := learnParamRx.FindAllStringSubmatch(path, -1)
+		pathItem := make(map[string]interface{})
+
+		for method, codes := range methods {
+			codeList := []int{}
+			for code, _ := range codes {
+				codeList = append(codeList, code)
+			}
+			sort.Ints(codeList)
+
+			responses := make(map[string]interface{})
+			for _, code := range codeList {
+				responses[strconv.Itoa(code)] = map[string]string{"description": http.StatusText(code)}
+			}
+
+			operation := map[string]interface{}{"responses": responses}
+			if len(params) > 0 {
+				parameters := []map[string]interface{}{}
+				for _, param := range params {
+					parameters = append(parameters, map[string]interface{}{
+						"name":     param[1],
+						"in":       "path",
+						"required": true,
+						"schema":   map[string]string{"type": "string"},
+					})
+				}
+				operation["parameters"] = parameters
+			}
+
+			pathItem[method] = operation
+		}
+
+		paths[path] = pathItem
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]string{
+			"title":       thisAPI.Name,
+			"version":     "draft",
+			"description": fmt.Sprintf("Generated by Tyk from observed traffic (%v paths)", len(thisAPI.Paths)),
+		},
+		"servers": []map[string]string{{"url": thisAPI.ListenPath}},
+		"paths":   paths,
+	}, true
+}
+
+// learningResponseWriter records the status code written by the proxy
+type learningResponseWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (l *learningResponseWriter) WriteHeader(code int) {
+	l.code = code
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *learningResponseWriter) Write(b []byte) (int, error) {
+	if l.code == 0 {
+		l.code = 200
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+// Flush keeps streaming responses working when learning mode is on
+func (l *learningResponseWriter) Flush() {
+	if f, ok := l.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
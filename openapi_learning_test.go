@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/lonelycode/tykcommon"
+	"testing"
+)
+
+func TestTemplatePath(t *testing.T) {
+	templated, params := TemplatePath("users/42/orders/5f1b2c3d4e5f6a7b8c9d0e1f")
+	if templated != "/users/{id}/orders/{id2}" {
+		t.Error("Path not templated correctly: ", templated)
+	}
+
+	if len(params) != 2 {
+		t.Error("Expected 2 params, got: ", params)
+	}
+}
+
+func TestOpenAPILearning(t *testing.T) {
+	thisSpec := &APISpec{APIDefinition: tykcommon.APIDefinition{APIID: "learn-test", Name: "Learn Test"}}
+	thisSpec.Proxy.ListenPath = "/learn/"
+
+	thisLearner := &OpenAPILearner{apis: make(map[string]*LearnedAPI)}
+	thisLearner.Observe(thisSpec, "GET", "/learn/users/1", 200)
+	thisLearner.Observe(thisSpec, "GET", "/learn/users/2", 404)
+	thisLearner.Observe(thisSpec, "POST", "/learn/users", 201)
+
+	thisDocument, found := thisLearner.GenerateDocument("learn-test")
+	if !found {
+		t.Fatal("Document should have been generated")
+	}
+
+	paths := thisDocument["paths"].(map[string]interface{})
+	if len(paths) != 2 {
+		t.Fatal("Expected 2 paths, got: ", paths)
+	}
+
+	userPath := paths["/users/{id}"].(map[string]interface{})
+	getOp := userPath["get"].(map[string]interface{})
+	responses := getOp["responses"].(map[string]interface{})
+	if _, ok := responses["200"]; !ok {
+		t.Error("200 response not recorded")
+	}
+	if _, ok := responses["404"]; !ok {
+		t.Error("404 response not recorded")
+	}
+
+	if _, ok := getOp["parameters"]; !ok {
+		t.Error("Path parameter not documented")
+	}
+
+	thisLearner.Reset("learn-test")
+	if _, found := thisLearner.GenerateDocument("learn-test"); found {
+		t.Error("Observations should have been removed")
+	}
+}
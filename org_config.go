@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Org configuration records are kept in the org store under this prefix, nodes cache them (and the
+// fact that an org has none) for ORG_CONFIG_CACHE_TTL seconds
+const (
+	ORG_CONFIG_KEY_PREFIX = "org-config-"
+	ORG_CONFIG_CACHE_TTL  = 10
+)
+
+// OrgConfig overrides parts of tyk.conf for the APIs of one organisation so tenants can have
+// different SLAs, settings that aren't set in the record use the global values
+type OrgConfig struct {
+	OrgID   string `json:"org_id"`
+	Monitor struct {
+		EnableTriggerMonitors *bool    `json:"enable_trigger_monitors"`
+		GlobalTriggerLimit    *float64 `json:"global_trigger_limit"`
+		MonitorUserKeys       *bool    `json:"monitor_user_keys"`
+		MonitorOrgKeys        *bool    `json:"monitor_org_keys"`
+	} `json:"monitor"`
+	Analytics struct {
+		EnableMiddlewareTimings *bool `json:"enable_middleware_timings"`
+	} `json:"analytics"`
+	RateLimit struct {
+		EnforceOrgQuotas *bool `json:"enforce_org_quotas"`
+		DisableRateLimit bool  `json:"disable_rate_limit"`
+		DisableQuota     bool  `json:"disable_quota"`
+	} `json:"rate_limit"`
+}
+
+type orgConfigCacheEntry struct {
+	orgConfig *OrgConfig
+	expires   int64
+}
+
+var orgConfigCache = make(map[string]orgConfigCacheEntry)
+var orgConfigCacheLock sync.RWMutex
+
+// TriggerMonitorsEnabled replaces monitor.enable_trigger_monitors, all the OrgConfig getters can be
+// used on a nil config
+func (o *OrgConfig) TriggerMonitorsEnabled() bool {
+	if o == nil || o.Monitor.EnableTriggerMonitors == nil {
+		return config.Monitor.EnableTriggerMonitors
+	}
+
+	return *o.Monitor.EnableTriggerMonitors
+}
+
+// GlobalTriggerLimit replaces monitor.global_trigger_limit
+func (o *OrgConfig) GlobalTriggerLimit() float64 {
+	if o == nil || o.Monitor.GlobalTriggerLimit == nil {
+		return config.Monitor.GlobalTriggerLimit
+	}
+
+	return *o.Monitor.GlobalTriggerLimit
+}
+
+// MonitorUserKeys replaces monitor.monitor_user_keys
+func (o *OrgConfig) MonitorUserKeys() bool {
+	if o == nil || o.Monitor.MonitorUserKeys == nil {
+		return config.Monitor.MonitorUserKeys
+	}
+
+	return *o.Monitor.MonitorUserKeys
+}
+
+// MonitorOrgKeys replaces monitor.monitor_org_keys
+func (o *OrgConfig) MonitorOrgKeys() bool {
+	if o == nil || o.Monitor.MonitorOrgKeys == nil {
+		return config.Monitor.MonitorOrgKeys
+	}
+
+	return *o.Monitor.MonitorOrgKeys
+}
+
+// MiddlewareTimingsEnabled replaces analytics_config.enable_middleware_timings
+func (o *OrgConfig) MiddlewareTimingsEnabled() bool {
+	if o == nil || o.Analytics.EnableMiddlewareTimings == nil {
+		return config.AnalyticsConfig.EnableMiddlewareTimings
+	}
+
+	return *o.Analytics.EnableMiddlewareTimings
+}
+
+// OrgQuotasEnforced replaces enforce_org_quotas
+func (o *OrgConfig) OrgQuotasEnforced() bool {
+	if o == nil || o.RateLimit.EnforceOrgQuotas == nil {
+		return config.EnforceOrgQuotas
+	}
+
+	return *o.RateLimit.EnforceOrgQuotas
+}
+
+// RateLimitDisabled is true if the rate limits of the keys of the org are not applied
+func (o *OrgConfig) RateLimitDisabled() bool {
+	return o != nil && o.RateLimit.DisableRateLimit
+}
+
+// QuotaDisabled is true if the quotas of the keys of the org are not applied
+func (o *OrgConfig) QuotaDisabled() bool {
+	return o != nil && o.RateLimit.DisableQuota
+}
+
+// loadOrgConfig reads the configuration record of an org, it is nil if the org has none
+func loadOrgConfig(orgID string, store StorageHandler) *OrgConfig {
+	rawConfig, err := store.GetKey(ORG_CONFIG_KEY_PREFIX + orgID)
+	if err != nil {
+		return nil
+	}
+
+	thisOrgConfig := &OrgConfig{}
+	if err := json.Unmarshal([]byte(rawConfig), thisOrgConfig); err != nil {
+		log.Error("Couldn't decode configuration of org ", orgID, ": ", err)
+		return nil
+	}
+
+	return thisOrgConfig
+}
+
+// GetOrgConfig returns the configuration record of the org that owns an API, nil means the global
+// configuration applies
+func GetOrgConfig(spec *APISpec) *OrgConfig {
+	if spec.OrgID == "" || spec.OrgSessionManager == nil || spec.OrgSessionManager.GetStore() == nil {
+		return nil
+	}
+
+	orgConfigCacheLock.RLock()
+	entry, found := orgConfigCache[spec.OrgID]
+	orgConfigCacheLock.RUnlock()
+	if found && entry.expires > time.Now().Unix() {
+		return entry.orgConfig
+	}
+
+	thisOrgConfig := loadOrgConfig(spec.OrgID, spec.OrgSessionManager.GetStore())
+
+	orgConfigCacheLock.Lock()
+	orgConfigCache[spec.OrgID] = orgConfigCacheEntry{thisOrgConfig, time.Now().Unix() + ORG_CONFIG_CACHE_TTL}
+	orgConfigCacheLock.Unlock()
+
+	return thisOrgConfig
+}
+
+// invalidateOrgConfig drops an org from the cache of this node, other nodes pick the change up
+// when their cache entry expires
+func invalidateOrgConfig(orgID string) {
+	orgConfigCacheLock.Lock()
+	delete(orgConfigCache, orgID)
+	orgConfigCacheLock.Unlock()
+}
+
+// getOrgSessionManager returns the org store used for an org, this is nil if the org has no API
+// and the default org store is suppressed
+func getOrgSessionManager(orgID string) SessionHandler {
+	if spec := GetSpecForOrg(orgID); spec != nil {
+		return spec.OrgSessionManager
+	}
+
+	if config.SupressDefaultOrgStore {
+		return nil
+	}
+
+	return &DefaultOrgStore
+}
+
+// orgConfigHandler manages the configuration record of an org, PUT (or POST) replaces it, DELETE
+// removes it so the global settings apply again and GET returns it
+func orgConfigHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.URL.Path[len("/tyk/org/config/"):]
+	if orgID == "" {
+		DoJSONWrite(w, 400, createError("Org ID is required"))
+		return
+	}
+
+	thisSessionManager := getOrgSessionManager(orgID)
+	if thisSessionManager == nil {
+		DoJSONWrite(w, 400, createError("No such organisation found in Active API list"))
+		return
+	}
+	store := thisSessionManager.GetStore()
+
+	var responseMessage []byte
+	var code int
+
+	switch r.Method {
+	case "GET":
+		thisOrgConfig := loadOrgConfig(orgID, store)
+		if thisOrgConfig == nil {
+			DoJSONWrite(w, 404, createError("Org configuration not found"))
+			return
+		}
+		responseMessage, _ = json.Marshal(thisOrgConfig)
+		DoJSONWrite(w, 200, responseMessage)
+		return
+	case "POST", "PUT":
+		responseMessage, code = handleUpdateOrgConfig(orgID, store, r)
+	case "DELETE":
+		store.DeleteKey(ORG_CONFIG_KEY_PREFIX + orgID)
+		responseMessage, _ = json.Marshal(&APIModifyKeySuccess{orgID, "ok", "deleted"})
+		code = 200
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	if code == 200 {
+		invalidateOrgConfig(orgID)
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
+
+func handleUpdateOrgConfig(orgID string, store StorageHandler, r *http.Request) ([]byte, int) {
+	thisOrgConfig := OrgConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&thisOrgConfig); err != nil {
+		log.Error("Couldn't decode org configuration: ", err)
+		return createError("Request malformed"), 400
+	}
+	thisOrgConfig.OrgID = orgID
+
+	rawConfig, _ := json.Marshal(&thisOrgConfig)
+	if err := store.SetKey(ORG_CONFIG_KEY_PREFIX+orgID, string(rawConfig), 0); err != nil {
+		log.Error("Could not write org configuration: ", err)
+		return createError("Error writing to org store " + err.Error()), 500
+	}
+
+	log.WithFields(logrus.Fields{
+		"org": orgID,
+	}).Info("Org configuration updated.")
+
+	responseMessage, _ := json.Marshal(&APIModifyKeySuccess{orgID, "ok", "modified"})
+	return responseMessage, 200
+}
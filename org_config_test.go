@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOrgConfigOverrides(t *testing.T) {
+	oldMonitor := config.Monitor
+	defer func() { config.Monitor = oldMonitor }()
+	config.Monitor.GlobalTriggerLimit = 80.0
+	config.Monitor.MonitorUserKeys = true
+
+	var noOrgConfig *OrgConfig
+	if noOrgConfig.GlobalTriggerLimit() != 80.0 || !noOrgConfig.MonitorUserKeys() || noOrgConfig.RateLimitDisabled() {
+		t.Error("A nil org config should use the global settings")
+	}
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	store.SetKey(ORG_CONFIG_KEY_PREFIX+"org-a", `{"monitor": {"global_trigger_limit": 50, "monitor_user_keys": false}, "rate_limit": {"disable_quota": true}}`, 0)
+
+	spec := &APISpec{OrgSessionManager: &DefaultSessionManager{}}
+	spec.OrgID = "org-a"
+	spec.OrgSessionManager.Init(store)
+	defer invalidateOrgConfig("org-a")
+
+	thisOrgConfig := GetOrgConfig(spec)
+	if thisOrgConfig == nil {
+		t.Fatal("Org config was not loaded")
+	}
+	if thisOrgConfig.GlobalTriggerLimit() != 50.0 || thisOrgConfig.MonitorUserKeys() {
+		t.Error("Monitor settings were not overridden")
+	}
+	if !thisOrgConfig.QuotaDisabled() || thisOrgConfig.RateLimitDisabled() {
+		t.Error("Rate limit settings were not overridden")
+	}
+	if thisOrgConfig.TriggerMonitorsEnabled() != config.Monitor.EnableTriggerMonitors {
+		t.Error("Settings that aren't in the record should use the global value")
+	}
+
+	// Changes are picked up once the cache entry is dropped
+	store.DeleteKey(ORG_CONFIG_KEY_PREFIX + "org-a")
+	if GetOrgConfig(spec) == nil {
+		t.Error("Org config should be cached")
+	}
+	invalidateOrgConfig("org-a")
+	if GetOrgConfig(spec) != nil {
+		t.Error("Deleted org config should not be returned")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Disabled orgs are blocked with this error unless org_kill_switch sets another one
+const (
+	ORG_DISABLED_DEFAULT_CODE    = 403
+	ORG_DISABLED_DEFAULT_MESSAGE = "This organisation access has been disabled, please contact your API administrator."
+	ORG_STATE_CACHE_TTL          = 10
+)
+
+type OrgKillSwitchConfig struct {
+	ErrorCode    int    `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// APIOrgStateMessage is returned by /tyk/org/state/
+type APIOrgStateMessage struct {
+	OrgID  string `json:"org_id"`
+	Active bool   `json:"active"`
+}
+
+type orgStateCacheEntry struct {
+	inactive bool
+	expires  int64
+}
+
+// The state of each org is cached so the kill switch doesn't cost a store lookup per request,
+// changes made through the API drop the entry on all nodes straight away
+var orgStateCache = make(map[string]orgStateCacheEntry)
+var orgStateCacheLock sync.RWMutex
+
+// OrgDisabledError returns the error and status code for requests to a disabled org
+func OrgDisabledError() (string, int) {
+	code := config.OrgKillSwitch.ErrorCode
+	if code == 0 {
+		code = ORG_DISABLED_DEFAULT_CODE
+	}
+
+	message := config.OrgKillSwitch.ErrorMessage
+	if message == "" {
+		message = ORG_DISABLED_DEFAULT_MESSAGE
+	}
+
+	return message, code
+}
+
+// IsOrgDisabled checks the kill switch of the org that owns an API, orgs without a session are
+// active
+func IsOrgDisabled(spec *APISpec) bool {
+	if spec.OrgID == "" || spec.OrgSessionManager == nil || spec.OrgSessionManager.GetStore() == nil {
+		return false
+	}
+
+	orgStateCacheLock.RLock()
+	entry, found := orgStateCache[spec.OrgID]
+	orgStateCacheLock.RUnlock()
+	if found && entry.expires > time.Now().Unix() {
+		return entry.inactive
+	}
+
+	thisSession, _ := spec.OrgSessionManager.GetSessionDetail(spec.OrgID)
+
+	orgStateCacheLock.Lock()
+	orgStateCache[spec.OrgID] = orgStateCacheEntry{thisSession.IsInactive, time.Now().Unix() + ORG_STATE_CACHE_TTL}
+	orgStateCacheLock.Unlock()
+
+	return thisSession.IsInactive
+}
+
+// handleOrgChanged drops an org from the state cache of this node
+func handleOrgChanged(orgID string) {
+	orgStateCacheLock.Lock()
+	delete(orgStateCache, orgID)
+	orgStateCacheLock.Unlock()
+}
+
+// notifyOrgChanged drops an org from the state cache of this and all other nodes
+func notifyOrgChanged(orgID string) {
+	handleOrgChanged(orgID)
+	MainNotifier.Notify(Notification{
+		Command: NoticeOrgChanged,
+		Payload: orgID,
+	})
+}
+
+// orgStateHandler is the org kill switch, POST disables all traffic for the org, DELETE enables it
+// again and GET reports the state
+func orgStateHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.URL.Path[len("/tyk/org/state/"):]
+	if orgID == "" {
+		DoJSONWrite(w, 400, createError("Org ID is required"))
+		return
+	}
+
+	thisSessionManager := getOrgSessionManager(orgID)
+	if thisSessionManager == nil {
+		DoJSONWrite(w, 400, createError("No such organisation found in Active API list"))
+		return
+	}
+
+	var responseMessage []byte
+	var code int
+
+	switch r.Method {
+	case "POST":
+		responseMessage, code = handleOrgStateChange(orgID, thisSessionManager, false)
+	case "DELETE":
+		responseMessage, code = handleOrgStateChange(orgID, thisSessionManager, true)
+	case "GET":
+		thisSession, _ := thisSessionManager.GetSessionDetail(orgID)
+		responseMessage, _ = json.Marshal(&APIOrgStateMessage{orgID, !thisSession.IsInactive})
+		code = 200
+	default:
+		DoJSONWrite(w, 405, createError("Method not supported"))
+		return
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
+
+// handleOrgStateChange sets the kill switch flag of the org session, an org without a session gets
+// one without limits so only the flag applies
+func handleOrgStateChange(orgID string, thisSessionManager SessionHandler, active bool) ([]byte, int) {
+	thisSession, found := thisSessionManager.GetSessionDetail(orgID)
+	if !found {
+		if active {
+			responseMessage, _ := json.Marshal(&APIOrgStateMessage{orgID, true})
+			return responseMessage, 200
+		}
+
+		thisSession = SessionState{OrgID: orgID, QuotaMax: -1}
+	}
+
+	thisSession.IsInactive = !active
+	if err := thisSessionManager.UpdateSession(orgID, thisSession, 0); err != nil {
+		log.Error("Could not update org state: ", err)
+		return createError("Error writing to org store " + err.Error()), 500
+	}
+
+	notifyOrgChanged(orgID)
+
+	log.WithFields(logrus.Fields{
+		"org":    orgID,
+		"active": active,
+	}).Warning("Org state changed.")
+
+	responseMessage, _ := json.Marshal(&APIOrgStateMessage{orgID, active})
+	return responseMessage, 200
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOrgKillSwitch(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	spec := &APISpec{OrgSessionManager: &DefaultSessionManager{}}
+	spec.OrgID = "org-b"
+	spec.OrgSessionManager.Init(store)
+	defer handleOrgChanged("org-b")
+
+	if IsOrgDisabled(spec) {
+		t.Error("Orgs without a session should be active")
+	}
+
+	spec.OrgSessionManager.UpdateSession("org-b", SessionState{OrgID: "org-b", QuotaMax: -1, IsInactive: true}, 0)
+	if IsOrgDisabled(spec) {
+		t.Error("The org state should be cached until it is dropped")
+	}
+
+	handleOrgChanged("org-b")
+	if !IsOrgDisabled(spec) {
+		t.Error("Org should be disabled")
+	}
+}
+
+func TestOrgDisabledError(t *testing.T) {
+	oldKillSwitch := config.OrgKillSwitch
+	defer func() { config.OrgKillSwitch = oldKillSwitch }()
+
+	config.OrgKillSwitch = OrgKillSwitchConfig{}
+	if message, code := OrgDisabledError(); code != 403 || message != ORG_DISABLED_DEFAULT_MESSAGE {
+		t.Error("Wrong default error: ", code, message)
+	}
+
+	config.OrgKillSwitch = OrgKillSwitchConfig{ErrorCode: 402, ErrorMessage: "Payment required"}
+	if message, code := OrgDisabledError(); code != 402 || message != "Payment required" {
+		t.Error("Configured error not used: ", code, message)
+	}
+}
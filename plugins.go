@@ -3,7 +3,9 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
 	"github.com/mitchellh/mapstructure"
 	"github.com/robertkrimen/otto"
@@ -12,6 +14,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"time"
 )
 
@@ -26,9 +29,19 @@ type MiniRequestObject struct {
 	DeleteParams  []string
 }
 
+// ReturnOverrides lets middleware stop the request with an error response
+type ReturnOverrides struct {
+	ResponseCode  int
+	ResponseError string
+}
+
+// VMReturnObject is what middleware return, Session and AuthKey are only used by auth_check middleware
 type VMReturnObject struct {
-	Request     MiniRequestObject
-	SessionMeta map[string]string
+	Request         MiniRequestObject
+	SessionMeta     map[string]string
+	Session         *SessionState
+	AuthKey         string
+	ReturnOverrides ReturnOverrides
 }
 
 type nopCloser struct {
@@ -45,12 +58,51 @@ type DynamicMiddleware struct {
 	MiddlewareClassName string
 	Pre                 bool
 	UseSession          bool
+	Hook                string
 }
 
 type DynamicMiddlewareConfig struct {
 	ConfigData map[string]string `mapstructure:"config_data" bson:"config_data" json:"config_data"`
 }
 
+// JSVMSpecData is the subset of the API definition exposed to scripts, it is set as the TykSpec global
+// in each API's VM and passed to middleware with the version of the current request
+type JSVMSpecData struct {
+	APIID      string            `json:"APIID"`
+	OrgID      string            `json:"OrgID"`
+	Name       string            `json:"Name"`
+	Versions   []string          `json:"Versions"`
+	ConfigData map[string]string `json:"config_data"`
+	Version    string            `json:"Version,omitempty"`
+}
+
+// GetJSVMSpecData builds the spec data object for an API
+func GetJSVMSpecData(spec *APISpec) JSVMSpecData {
+	var thisModuleConfig DynamicMiddlewareConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode config_data for JSVM: ", err)
+	}
+
+	if thisModuleConfig.ConfigData == nil {
+		thisModuleConfig.ConfigData = make(map[string]string)
+	}
+
+	versions := []string{}
+	for versionName, _ := range spec.VersionData.Versions {
+		versions = append(versions, versionName)
+	}
+	sort.Strings(versions)
+
+	return JSVMSpecData{
+		APIID:      spec.APIID,
+		OrgID:      spec.OrgID,
+		Name:       spec.Name,
+		Versions:   versions,
+		ConfigData: thisModuleConfig.ConfigData,
+	}
+}
+
 // New lets you do any initialisations for the object can be done here
 func (d *DynamicMiddleware) New() {}
 
@@ -72,12 +124,18 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 
 	t1 := time.Now().UnixNano()
 
-	// Createthe proxy object
-	defer r.Body.Close()
-	originalBody, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Error("Failed to read request body! ", err)
-		return nil, 200
+	// Streamed bodies are passed through untouched, the middleware sees an empty body
+	streaming := isStreamingRequest(r)
+	var originalBody []byte
+	if !streaming {
+		// Createthe proxy object
+		defer r.Body.Close()
+		var err error
+		originalBody, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Error("Failed to read request body! ", err)
+			return d.failed()
+		}
 	}
 
 	thisRequestData := MiniRequestObject{
@@ -93,7 +151,7 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 	asJsonRequestObj, encErr := json.Marshal(thisRequestData)
 	if encErr != nil {
 		log.Error("Failed to encode request object for dynamic middleware: ", encErr)
-		return nil, 200
+		return d.failed()
 	}
 
 	var thisSessionState = SessionState{}
@@ -102,8 +160,13 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 	// Encode the session object (if not a pre-process)
 	if !d.Pre {
 		if d.UseSession {
-			thisSessionState = context.Get(r, SessionData).(SessionState)
-			authHeaderValue = context.Get(r, AuthHeaderValue).(string)
+			// Keyless APIs have no session, the middleware gets an empty one
+			if sessVal, ok := context.Get(r, SessionData).(SessionState); ok {
+				thisSessionState = sessVal
+			}
+			if authVal, ok := context.Get(r, AuthHeaderValue).(string); ok {
+				authHeaderValue = authVal
+			}
 		}
 	}
 
@@ -111,12 +174,26 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 
 	if sessEncErr != nil {
 		log.Error("Failed to encode session for VM: ", sessEncErr)
-		return nil, 200
+		return d.failed()
+	}
+
+	// Expose the spec and config data along with the version for this request
+	thisSpecData := d.Spec.JSVM.SpecData
+	thisSpecData.Version = d.Spec.getVersionFromRequest(r)
+	specAsJsonObj, specEncErr := json.Marshal(thisSpecData)
+
+	if specEncErr != nil {
+		log.Error("Failed to encode spec data for VM: ", specEncErr)
+		return d.failed()
 	}
 
 	// Run the middleware
 	middlewareClassname := d.MiddlewareClassName
-	returnRaw, _ := d.Spec.JSVM.VM.Run(middlewareClassname + `.DoProcessRequest(` + string(asJsonRequestObj) + `, ` + string(sessionAsJsonObj) + `);`)
+	returnRaw, runErr := d.Spec.JSVM.VM.Run(middlewareClassname + `.DoProcessRequest(` + string(asJsonRequestObj) + `, ` + string(sessionAsJsonObj) + `, ` + string(specAsJsonObj) + `);`)
+	if runErr != nil {
+		log.Error("Failed to run JSVM middleware ", middlewareClassname, ": ", runErr)
+		return d.failed()
+	}
 	returnDataStr, _ := returnRaw.ToString()
 
 	// Decode the return object
@@ -126,12 +203,14 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 	if decErr != nil {
 		log.Error("Failed to decode middleware request data on return from VM: ", decErr)
 		log.Debug(returnDataStr)
-		return nil, 200
+		return d.failed()
 	}
 
 	// Reconstruct the request parts
-	r.ContentLength = int64(len(newRequestData.Request.Body))
-	r.Body = nopCloser{bytes.NewBufferString(newRequestData.Request.Body)}
+	if !streaming {
+		r.ContentLength = int64(len(newRequestData.Request.Body))
+		r.Body = nopCloser{bytes.NewBufferString(newRequestData.Request.Body)}
+	}
 	r.URL.Path = newRequestData.Request.URL
 
 	// Delete and set headers
@@ -155,9 +234,21 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 
 	r.URL.RawQuery = values.Encode()
 
+	if newRequestData.ReturnOverrides.ResponseCode >= 400 {
+		errorMessage := newRequestData.ReturnOverrides.ResponseError
+		if errorMessage == "" {
+			errorMessage = http.StatusText(newRequestData.ReturnOverrides.ResponseCode)
+		}
+		return errors.New(errorMessage), newRequestData.ReturnOverrides.ResponseCode
+	}
+
+	if d.Hook == MW_HOOK_AUTH_CHECK {
+		return d.setAuthCheckSession(r, newRequestData)
+	}
+
 	// Save the sesison data (if modified)
 	if !d.Pre {
-		if d.UseSession {
+		if d.UseSession && authHeaderValue != "" {
 			thisSessionState.MetaData = newRequestData.SessionMeta
 			d.Spec.SessionManager.UpdateSession(authHeaderValue, thisSessionState, 0)
 		}
@@ -168,10 +259,72 @@ func (d *DynamicMiddleware) ProcessRequest(w http.ResponseWriter, r *http.Reques
 	return nil, 200
 }
 
+// failed is the result of a middleware that couldn't run, the request carries on unless the
+// middleware is an auth check, which must never let a request through without a session
+func (d *DynamicMiddleware) failed() (error, int) {
+	if d.Hook == MW_HOOK_AUTH_CHECK {
+		return errors.New("Access to this API has been disallowed"), 403
+	}
+
+	return nil, 200
+}
+
+// setAuthCheckSession sets the session returned by auth_check middleware on the request like the
+// builtin auth methods do, no session means the request is not authorised
+func (d *DynamicMiddleware) setAuthCheckSession(r *http.Request, newRequestData VMReturnObject) (error, int) {
+	if newRequestData.Session == nil || newRequestData.AuthKey == "" {
+		log.WithFields(logrus.Fields{
+			"path":   r.URL.Path,
+			"origin": GetIPFromRequest(r),
+		}).Info("Attempted access rejected by auth check middleware.")
+
+		AuthFailed(d.TykMiddleware, r, newRequestData.AuthKey)
+		ReportHealthCheckValue(d.Spec.Health, KeyFailure, "1")
+
+		return errors.New("Key not authorised"), 403
+	}
+
+	context.Set(r, SessionData, *newRequestData.Session)
+	context.Set(r, AuthHeaderValue, newRequestData.AuthKey)
+
+	return nil, 200
+}
+
 // --- Utility functions during startup to ensure a sane VM is present for each API Def ----
 
 type JSVM struct {
-	VM *otto.Otto
+	VM       *otto.Otto
+	Storage  *JSVMStorage
+	Spec     *APISpec
+	SpecData JSVMSpecData
+}
+
+// JSVMStorage is a namespaced key/value store for scripts, each API gets its own namespace so
+// scripts can't read or overwrite each others data (or any of the gateway keys)
+type JSVMStorage struct {
+	Store     StorageHandler
+	Namespace string
+}
+
+const JSVM_STORAGE_PREFIX string = "jsvm-storage."
+
+// NewJSVMStorage creates a storage namespace for a JSVM, use an API ID or "global"
+func NewJSVMStorage(namespace string) *JSVMStorage {
+	// The store connects lazily on first use
+	return &JSVMStorage{Store: GetGlobalStorageHandler("", false), Namespace: JSVM_STORAGE_PREFIX + namespace + "."}
+}
+
+func (s *JSVMStorage) Get(keyName string) (string, error) {
+	return s.Store.GetRawKey(s.Namespace + keyName)
+}
+
+func (s *JSVMStorage) Set(keyName string, value string, ttl int64) error {
+	return s.Store.SetRawKey(s.Namespace+keyName, value, ttl)
+}
+
+// Incr increments a counter, the ttl is only set when the counter is created and a ttl of 0 never expires
+func (s *JSVMStorage) Incr(keyName string, ttl int64) int64 {
+	return s.Store.IncrememntWithExpire(s.Namespace+keyName, ttl)
 }
 
 // Init creates the JSVM with the core library (tyk.js)
@@ -188,6 +341,24 @@ func (j *JSVM) Init(coreJS string) {
 	j.LoadTykJSApi()
 }
 
+// LoadSpecData sets the TykSpec global in the VM so scripts can read the API's config_data and details, the
+// spec data is kept so middleware don't need to decode config_data again for each request
+func (j *JSVM) LoadSpecData(spec *APISpec) {
+	j.Spec = spec
+	j.SpecData = GetJSVMSpecData(spec)
+
+	specAsJson, err := json.Marshal(j.SpecData)
+	if err != nil {
+		log.Error("Failed to encode spec data for VM: ", err)
+		return
+	}
+
+	_, runErr := j.VM.Run(`var TykSpec = ` + string(specAsJson) + `;`)
+	if runErr != nil {
+		log.Error("Failed to load spec data into VM: ", runErr)
+	}
+}
+
 // LoadJSPaths will load JS classes and functionality in to the VM by file
 func (j *JSVM) LoadJSPaths(paths []string) {
 	for _, mwPath := range paths {
@@ -340,12 +511,66 @@ func (j *JSVM) LoadTykJSApi() {
 		return otto.Value{}
 	})
 
-	// Batch request method
-	unsafeBatchHandler := BatchRequestHandler{}
+	// Namespaced storage, lets scripts persist counters and flags
+	j.VM.Set("TykStorageGet", func(call otto.FunctionCall) otto.Value {
+		if j.Storage == nil {
+			j.Storage = NewJSVMStorage("global")
+		}
+
+		val, getErr := j.Storage.Get(call.Argument(0).String())
+		if getErr != nil {
+			return otto.UndefinedValue()
+		}
+
+		returnVal, retErr := j.VM.ToValue(val)
+		if retErr != nil {
+			log.Error("[JSVM]: Failed to encode return value: ", retErr)
+			return otto.Value{}
+		}
+
+		return returnVal
+	})
+
+	j.VM.Set("TykStorageSet", func(call otto.FunctionCall) otto.Value {
+		if j.Storage == nil {
+			j.Storage = NewJSVMStorage("global")
+		}
+
+		ttl, _ := call.Argument(2).ToInteger()
+		setErr := j.Storage.Set(call.Argument(0).String(), call.Argument(1).String(), ttl)
+		if setErr != nil {
+			log.Error("[JSVM]: Failed to store value: ", setErr)
+			returnVal, _ := j.VM.ToValue(false)
+			return returnVal
+		}
+
+		returnVal, _ := j.VM.ToValue(true)
+		return returnVal
+	})
+
+	j.VM.Set("TykStorageIncr", func(call otto.FunctionCall) otto.Value {
+		if j.Storage == nil {
+			j.Storage = NewJSVMStorage("global")
+		}
+
+		ttl, _ := call.Argument(1).ToInteger()
+		val := j.Storage.Incr(call.Argument(0).String(), ttl)
+
+		returnVal, retErr := j.VM.ToValue(val)
+		if retErr != nil {
+			log.Error("[JSVM]: Failed to encode return value: ", retErr)
+			return otto.Value{}
+		}
+
+		return returnVal
+	})
+
+	// Batch request method, requests can only target the API of the VM and its upstream
 	j.VM.Set("TykBatchRequest", func(call otto.FunctionCall) otto.Value {
 		requestSet := call.Argument(0).String()
 		log.Debug("Batch input is: ", requestSet)
 
+		unsafeBatchHandler := BatchRequestHandler{API: j.Spec}
 		byteArray := unsafeBatchHandler.ManualBatchRequest([]byte(requestSet))
 
 		returnVal, retErr := j.VM.ToValue(string(byteArray))
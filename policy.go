@@ -9,18 +9,23 @@ import (
 )
 
 type Policy struct {
-	MID              bson.ObjectId               `bson:"_id,omitempty" json:"_id"`
-	ID               string                      `bson:"id,omitempty" json:"id"`
-	OrgID            string                      `bson:"org_id" json:"org_id"`
-	Rate             float64                     `bson:"rate" json:"rate"`
-	Per              float64                     `bson:"per" json:"per"`
-	QuotaMax         int64                       `bson:"quota_max" json:"quota_max"`
-	QuotaRenewalRate int64                       `bson:"quota_renewal_rate" json:"quota_renewal_rate"`
-	AccessRights     map[string]AccessDefinition `bson:"access_rights" json:"access_rights"`
-	HMACEnabled      bool                        `bson:"hmac_enabled" json:"hmac_enabled"`
-	Active           bool                        `bson:"active" json:"active"`
-	IsInactive       bool                        `bson:"is_inactive" json:"is_inactive"`
-	Tags             []string                    `bson:"tags" json:"tags"`
+	MID               bson.ObjectId               `bson:"_id,omitempty" json:"_id"`
+	ID                string                      `bson:"id,omitempty" json:"id"`
+	OrgID             string                      `bson:"org_id" json:"org_id"`
+	Rate              float64                     `bson:"rate" json:"rate"`
+	Per               float64                     `bson:"per" json:"per"`
+	QuotaMax          int64                       `bson:"quota_max" json:"quota_max"`
+	QuotaRenewalRate  int64                       `bson:"quota_renewal_rate" json:"quota_renewal_rate"`
+	QuotaAlgorithm    string                      `bson:"quota_algorithm" json:"quota_algorithm"`
+	AccessRights      map[string]AccessDefinition `bson:"access_rights" json:"access_rights"`
+	HMACEnabled       bool                        `bson:"hmac_enabled" json:"hmac_enabled"`
+	Active            bool                        `bson:"active" json:"active"`
+	IsInactive        bool                        `bson:"is_inactive" json:"is_inactive"`
+	Tags              []string                    `bson:"tags" json:"tags"`
+	AccessWindows     []AccessWindow              `bson:"access_windows" json:"access_windows"`
+	MaxConcurrent     int64                       `bson:"max_concurrent" json:"max_concurrent"`
+	SpikeArrest       SpikeArrest                 `bson:"spike_arrest" json:"spike_arrest"`
+	MonitorOnlyLimits bool                        `bson:"monitor_only_limits" json:"monitor_only_limits"`
 }
 
 func LoadPoliciesFromFile(filePath string) map[string]Policy {
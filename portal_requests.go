@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/lonelycode/tykcommon"
+	"github.com/nu7hatch/gouuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const PORTAL_REQUEST_KEY_PREFIX string = "portal-request."
+
+// Key request states, only pending requests can be approved or rejected
+const (
+	KeyRequestPending  string = "pending"
+	KeyRequestApproved string = "approved"
+	KeyRequestRejected string = "rejected"
+)
+
+// Requests are locked while they are decided so two admins can't decide the same request at once
+const PORTAL_REQUEST_LOCK_TIMEOUT int64 = 30
+
+// KeyRequest is a developer's request for a key bound to a policy, the key is created in the pending
+// state straight away and is activated when the request is approved. Only the public hash of the key
+// (see publicHash) is stored, the key itself is only returned when the request is created
+type KeyRequest struct {
+	ID        string            `json:"id"`
+	PolicyID  string            `json:"policy_id"`
+	Developer string            `json:"developer"`
+	Fields    map[string]string `json:"fields"`
+	Status    string            `json:"status"`
+	Key       string            `json:"key,omitempty"`
+	KeyHash   string            `json:"key_hash"`
+	Reason    string            `json:"reason"`
+	Created   int64             `json:"created"`
+	Updated   int64             `json:"updated"`
+}
+
+// KeyRequestDecision is the optional body of an approval or rejection
+type KeyRequestDecision struct {
+	Reason string `json:"reason"`
+}
+
+// PortalRequestStore holds key requests, it is connected in setupGlobals
+var PortalRequestStore = &RedisClusterStorageManager{KeyPrefix: PORTAL_REQUEST_KEY_PREFIX, HashKeys: false}
+
+// lockKeyRequest claims a request for this node, it is false if the request is being decided elsewhere
+func lockKeyRequest(requestID string) bool {
+	skipped, err := PortalRequestStore.SetKeys(map[string]string{"lock." + requestID: healthCheckNodeID()}, PORTAL_REQUEST_LOCK_TIMEOUT, false)
+	if err != nil {
+		log.Error("Couldn't lock key request: ", err)
+		return false
+	}
+
+	return len(skipped) == 0
+}
+
+func unlockKeyRequest(requestID string) {
+	PortalRequestStore.DeleteKey("lock." + requestID)
+}
+
+// newPortalKeySession creates the pending session for a key request from its policy
+func newPortalKeySession(policy Policy) SessionState {
+	thisSession := SessionState{
+		Allowance:        policy.Rate,
+		Rate:             policy.Rate,
+		Per:              policy.Per,
+		QuotaMax:         policy.QuotaMax,
+		QuotaRenewalRate: policy.QuotaRenewalRate,
+		QuotaAlgorithm:   policy.QuotaAlgorithm,
+		AccessRights:     policy.AccessRights,
+		OrgID:            policy.OrgID,
+		HMACEnabled:      policy.HMACEnabled,
+		ApplyPolicyID:    policy.ID,
+		Tags:             policy.Tags,
+		State:            KeyStatePending,
+	}
+	thisSession.QuotaRemaining = policy.QuotaMax
+	thisSession.QuotaRenews = time.Now().Unix() + policy.QuotaRenewalRate
+
+	if policy.HMACEnabled {
+		thisSession.HmacSecret = keyGen.GenerateHMACSecret()
+	}
+
+	return thisSession
+}
+
+// forEachPolicyAPI runs fn for every loaded API a policy grants access to
+func forEachPolicyAPI(policy Policy, fn func(*APISpec) error) error {
+	for APIID, _ := range policy.AccessRights {
+		thisAPISpec := GetSpecForApi(APIID)
+		if thisAPISpec == nil {
+			return errors.New("API in policy is not loaded: " + APIID)
+		}
+
+		if err := fn(thisAPISpec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveKeyRequest stores a request without its key
+func saveKeyRequest(thisRequest *KeyRequest) error {
+	thisRequest.Updated = time.Now().Unix()
+	storedRequest := *thisRequest
+	storedRequest.Key = ""
+	asJSON, err := json.Marshal(&storedRequest)
+	if err != nil {
+		return err
+	}
+
+	return PortalRequestStore.SetKey(thisRequest.ID, string(asJSON), 0)
+}
+
+// decodeKeyRequest reads a stored request, requests stored with their key are moved to its hash
+func decodeKeyRequest(asJSON string, thisRequest *KeyRequest) error {
+	if err := json.Unmarshal([]byte(asJSON), thisRequest); err != nil {
+		return err
+	}
+
+	if thisRequest.KeyHash == "" && thisRequest.Key != "" {
+		thisRequest.KeyHash = publicHash(thisRequest.Key)
+	}
+	thisRequest.Key = ""
+
+	return nil
+}
+
+func getKeyRequest(requestID string) (*KeyRequest, error) {
+	asJSON, err := PortalRequestStore.GetKey(requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	thisRequest := &KeyRequest{}
+	if err := decodeKeyRequest(asJSON, thisRequest); err != nil {
+		return nil, err
+	}
+
+	return thisRequest, nil
+}
+
+func getKeyRequests(status string) []KeyRequest {
+	requests := []KeyRequest{}
+	for _, asJSON := range PortalRequestStore.GetKeysAndValues() {
+		thisRequest := KeyRequest{}
+		if err := decodeKeyRequest(asJSON, &thisRequest); err != nil {
+			// Decision locks live in the same namespace
+			log.Debug("Skipping entry that isn't a key request: ", err)
+			continue
+		}
+
+		if status == "" || thisRequest.Status == status {
+			requests = append(requests, thisRequest)
+		}
+	}
+
+	return requests
+}
+
+// newKeyRequestEvent is the event metadata of a request, it only carries the hash of the key
+func newKeyRequestEvent(message string, thisRequest *KeyRequest) EVENT_KeyRequestMeta {
+	return EVENT_KeyRequestMeta{
+		EventMetaDefault: EventMetaDefault{Message: message},
+		RequestID:        thisRequest.ID,
+		PolicyID:         thisRequest.PolicyID,
+		Developer:        thisRequest.Developer,
+		KeyHash:          thisRequest.KeyHash,
+		Status:           thisRequest.Status,
+		Reason:           thisRequest.Reason,
+	}
+}
+
+// fireKeyRequestEvent fires the event on every API the requested policy grants access to
+func fireKeyRequestEvent(eventName tykcommon.TykEvent, message string, policy Policy, thisRequest *KeyRequest) {
+	eventMeta := newKeyRequestEvent(message, thisRequest)
+	forEachPolicyAPI(policy, func(thisAPISpec *APISpec) error {
+		go thisAPISpec.FireEvent(eventName, eventMeta)
+		return nil
+	})
+}
+
+// setHashedKeyState moves a key known only by its hash to a new state on one API
+func setHashedKeyState(thisAPISpec *APISpec, keyHash string, newState string) error {
+	hashedStore, ok := thisAPISpec.SessionManager.GetStore().(HashedKeyStorage)
+	if !ok {
+		return errors.New("Key store can't look up hashed keys")
+	}
+
+	rawKeyName := hashedStore.HashedKeyName(keyHash)
+	sessionJSON, err := thisAPISpec.SessionManager.GetStore().GetRawKey(rawKeyName)
+	if err != nil {
+		return errors.New("Key not found")
+	}
+
+	thisSession := SessionState{}
+	if err := decodeSession(sessionJSON, &thisSession); err != nil {
+		return err
+	}
+
+	thisSession.State = newState
+	sessionJSON, err = encodeSession(thisSession)
+	if err != nil {
+		return err
+	}
+
+	return thisAPISpec.SessionManager.GetStore().SetRawKey(rawKeyName, sessionJSON, thisAPISpec.SessionLifetime)
+}
+
+func handleCreateKeyRequest(r *http.Request) ([]byte, int) {
+	thisRequest := &KeyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(thisRequest); err != nil {
+		return createError("Couldn't decode key request"), 400
+	}
+
+	policy, ok := Policies[thisRequest.PolicyID]
+	if !ok {
+		return createError("Policy not found"), 400
+	}
+
+	if len(policy.AccessRights) == 0 {
+		return createError("Policy does not grant access to any APIs"), 400
+	}
+
+	u5, _ := uuid.NewV4()
+	thisRequest.ID = strings.Replace(u5.String(), "-", "", -1)
+	thisRequest.Status = KeyRequestPending
+	thisRequest.Reason = ""
+	thisRequest.Created = time.Now().Unix()
+	thisSession := newPortalKeySession(policy)
+	newKey, err := generateUniqueKey(thisSession)
+	if err != nil {
+		log.Error("Failed to generate key: ", err)
+		return createError("Failed to create key - " + err.Error()), 500
+	}
+	thisRequest.Key = newKey
+	thisRequest.KeyHash = publicHash(newKey)
+
+	err = forEachPolicyAPI(policy, func(thisAPISpec *APISpec) error {
+		return thisAPISpec.SessionManager.UpdateSession(thisRequest.Key, thisSession, thisAPISpec.SessionLifetime)
+	})
+	if err != nil {
+		log.Error("Failed to create pending key: ", err)
+		return createError("Failed to create key - " + err.Error()), 400
+	}
+
+	if err := saveKeyRequest(thisRequest); err != nil {
+		log.Error("Failed to store key request: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	log.WithFields(logrus.Fields{
+		"request": thisRequest.ID,
+		"policy":  thisRequest.PolicyID,
+	}).Info("Key requested.")
+
+	fireKeyRequestEvent(EVENT_KeyRequested, "Key requested.", policy, thisRequest)
+
+	responseMessage, _ := json.Marshal(thisRequest)
+	return responseMessage, 200
+}
+
+// handleKeyRequestDecision approves or rejects a pending request, the key is moved to active or revoked
+func handleKeyRequestDecision(requestID string, approve bool, r *http.Request) ([]byte, int) {
+	if !lockKeyRequest(requestID) {
+		return createError("Key request is being decided"), 409
+	}
+	defer unlockKeyRequest(requestID)
+
+	thisRequest, err := getKeyRequest(requestID)
+	if err != nil {
+		return createError("Key request not found"), 404
+	}
+
+	if thisRequest.Status != KeyRequestPending {
+		return createError("Key request has already been " + thisRequest.Status), 409
+	}
+
+	decision := KeyRequestDecision{}
+	if r.ContentLength > 0 {
+		json.NewDecoder(r.Body).Decode(&decision)
+	}
+
+	policy, ok := Policies[thisRequest.PolicyID]
+	if !ok {
+		return createError("Policy not found"), 400
+	}
+
+	newStatus, newKeyState, eventName := KeyRequestRejected, KeyStateRevoked, EVENT_KeyRequestRejected
+	if approve {
+		newStatus, newKeyState, eventName = KeyRequestApproved, KeyStateActive, EVENT_KeyRequestApproved
+	}
+
+	err = forEachPolicyAPI(policy, func(thisAPISpec *APISpec) error {
+		return setHashedKeyState(thisAPISpec, thisRequest.KeyHash, newKeyState)
+	})
+	if err != nil {
+		log.Error("Failed to update requested key: ", err)
+		return createError("Failed to update key - " + err.Error()), 500
+	}
+
+	thisRequest.Status = newStatus
+	thisRequest.Reason = decision.Reason
+	if err := saveKeyRequest(thisRequest); err != nil {
+		log.Error("Failed to store key request: ", err)
+		return []byte(E_SYSTEM_ERROR), 500
+	}
+
+	log.WithFields(logrus.Fields{
+		"request": thisRequest.ID,
+		"status":  newStatus,
+	}).Info("Key request decided.")
+
+	notifyKeySpaceChanged(thisRequest.KeyHash)
+	fireKeyRequestEvent(eventName, "Key request "+newStatus+".", policy, thisRequest)
+
+	responseMessage, _ := json.Marshal(thisRequest)
+	return responseMessage, 200
+}
+
+// portalRequestHandler handles the self-service key request flow:
+// POST /tyk/portal/requests creates a request, GET lists them (optionally ?status=pending),
+// GET /tyk/portal/requests/{id} returns one and POST /tyk/portal/requests/{id}/approve (or /reject) decides it
+func portalRequestHandler(w http.ResponseWriter, r *http.Request) {
+	requestPath := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tyk/portal/requests"), "/")
+	parts := strings.Split(requestPath, "/")
+	var responseMessage []byte
+	var code int
+
+	switch {
+	case requestPath == "" && r.Method == "POST":
+		responseMessage, code = handleCreateKeyRequest(r)
+	case requestPath == "" && r.Method == "GET":
+		responseMessage, _ = json.Marshal(getKeyRequests(r.FormValue("status")))
+		code = 200
+	case len(parts) == 1 && r.Method == "GET":
+		thisRequest, err := getKeyRequest(parts[0])
+		if err != nil {
+			responseMessage, code = createError("Key request not found"), 404
+			break
+		}
+		responseMessage, _ = json.Marshal(thisRequest)
+		code = 200
+	case len(parts) == 2 && r.Method == "POST" && parts[1] == "approve":
+		responseMessage, code = handleKeyRequestDecision(parts[0], true, r)
+	case len(parts) == 2 && r.Method == "POST" && parts[1] == "reject":
+		responseMessage, code = handleKeyRequestDecision(parts[0], false, r)
+	default:
+		// Return Not supported message (and code)
+		code = 405
+		responseMessage = createError("Method not supported")
+	}
+
+	DoJSONWrite(w, code, responseMessage)
+}
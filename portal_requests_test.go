@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewPortalKeySession(t *testing.T) {
+	thisPolicy := Policy{
+		ID:               "gold",
+		OrgID:            "org-1",
+		Rate:             100,
+		Per:              60,
+		QuotaMax:         1000,
+		QuotaRenewalRate: 3600,
+		AccessRights: map[string]AccessDefinition{
+			"api-a": {APIID: "api-a", Versions: []string{"Default"}},
+		},
+	}
+
+	thisSession := newPortalKeySession(thisPolicy)
+
+	if thisSession.GetKeyState() != KeyStatePending {
+		t.Error("Requested keys should start pending, got: ", thisSession.GetKeyState())
+	}
+
+	if thisSession.ApplyPolicyID != "gold" || thisSession.OrgID != "org-1" {
+		t.Error("Key should be bound to the policy and its organisation")
+	}
+
+	if thisSession.Rate != 100 || thisSession.QuotaRemaining != 1000 {
+		t.Error("Policy limits were not applied: ", thisSession.Rate, thisSession.QuotaRemaining)
+	}
+
+	if _, ok := thisSession.AccessRights["api-a"]; !ok {
+		t.Error("Policy access rights were not applied")
+	}
+
+	if thisSession.HmacSecret != "" {
+		t.Error("HMAC secret should only be generated for HMAC policies")
+	}
+}
+
+func TestKeyRequestKeyIsHashed(t *testing.T) {
+	oldHashKeys := config.HashKeys
+	config.HashKeys = true
+	defer func() { config.HashKeys = oldHashKeys }()
+
+	// Requests stored before keys were hashed still carry the key
+	thisRequest := KeyRequest{}
+	if err := decodeKeyRequest(`{"id": "req-1", "status": "pending", "key": "plain-key"}`, &thisRequest); err != nil {
+		t.Fatal(err)
+	}
+	if thisRequest.Key != "" || thisRequest.KeyHash != publicHash("plain-key") {
+		t.Error("Stored key should be replaced by its hash: ", thisRequest.Key, thisRequest.KeyHash)
+	}
+
+	thisRequest.Key = "plain-key"
+	eventMeta := newKeyRequestEvent("Key requested.", &thisRequest)
+	if eventMeta.KeyHash != publicHash("plain-key") {
+		t.Error("Event should carry the hash of the key: ", eventMeta.KeyHash)
+	}
+	if encoded, _ := json.Marshal(eventMeta); strings.Contains(string(encoded), "plain-key") {
+		t.Error("Event shouldn't carry the key: ", string(encoded))
+	}
+}
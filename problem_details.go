@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const PROBLEM_DETAILS_CONTENT_TYPE = "application/problem+json"
+
+// ProblemDetailsConfig switches an API to RFC 7807 error bodies, type_base is prefixed to the status
+// code to generate the problem type URI, if it is empty the type is "about:blank"
+type ProblemDetailsConfig struct {
+	Enabled  bool   `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	TypeBase string `mapstructure:"type_base" bson:"type_base" json:"type_base"`
+}
+
+type ProblemDetailsModuleConfig struct {
+	ProblemDetails ProblemDetailsConfig `mapstructure:"problem_details" bson:"problem_details" json:"problem_details"`
+}
+
+// ProblemDetails is the RFC 7807 error object
+type ProblemDetails struct {
+	Type       string `json:"type"`
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Detail     string `json:"detail"`
+	Instance   string `json:"instance"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+}
+
+// GetProblemDetailsConfig reads the problem details settings from the API definition
+func GetProblemDetailsConfig(spec *APISpec) ProblemDetailsConfig {
+	var thisModuleConfig ProblemDetailsModuleConfig
+	if spec == nil {
+		return thisModuleConfig.ProblemDetails
+	}
+
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode problem details configuration: ", err)
+		return ProblemDetailsConfig{}
+	}
+
+	return thisModuleConfig.ProblemDetails
+}
+
+// NewProblemDetails generates the problem object for a gateway error
+func NewProblemDetails(conf ProblemDetailsConfig, instance string, err string, errCode int, retryAfter int64) ProblemDetails {
+	thisProblem := ProblemDetails{
+		Type:       "about:blank",
+		Title:      http.StatusText(errCode),
+		Status:     errCode,
+		Detail:     err,
+		Instance:   instance,
+		RetryAfter: retryAfter,
+	}
+
+	if conf.TypeBase != "" {
+		thisProblem.Type = singleJoiningSlash(conf.TypeBase, strconv.Itoa(errCode))
+	}
+
+	return thisProblem
+}
+
+// getRetryAfter works out how many seconds a client should wait before retrying from the error the
+// middleware rejected the request with, rate limited keys can retry after the rate window and keys
+// that are out of quota after the quota renews
+func getRetryAfter(r *http.Request) int64 {
+	thisSessionState, ok := context.Get(r, SessionData).(SessionState)
+	if !ok {
+		return 0
+	}
+
+	switch context.Get(r, MiddlewareError) {
+	case ErrRateLimitExceeded:
+		if thisSessionState.Per > 0 {
+			return int64(thisSessionState.Per)
+		}
+	case ErrQuotaExceeded:
+		renewsIn := thisSessionState.QuotaRenews - time.Now().Unix()
+		if renewsIn > 0 {
+			return renewsIn
+		}
+	}
+
+	return 0
+}
+
+// writeProblemDetails writes the problem object to the client, the headers must not have been sent yet
+func writeProblemDetails(w http.ResponseWriter, thisProblem ProblemDetails) {
+	w.Header().Set("Content-Type", PROBLEM_DETAILS_CONTENT_TYPE)
+	if thisProblem.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(thisProblem.RetryAfter, 10))
+	}
+
+	asJson, err := json.Marshal(thisProblem)
+	if err != nil {
+		log.Error("Failed to encode problem details: ", err)
+		w.WriteHeader(thisProblem.Status)
+		return
+	}
+
+	w.WriteHeader(thisProblem.Status)
+	w.Write(asJson)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProblemDetailsType(t *testing.T) {
+	thisProblem := NewProblemDetails(ProblemDetailsConfig{Enabled: true}, "/v1/widgets", "Access denied", 403, 0)
+	if thisProblem.Type != "about:blank" {
+		t.Error("Type should default to about:blank, got: ", thisProblem.Type)
+	}
+	if thisProblem.Title != "Forbidden" {
+		t.Error("Title should be the status text, got: ", thisProblem.Title)
+	}
+
+	thisProblem = NewProblemDetails(ProblemDetailsConfig{Enabled: true, TypeBase: "https://example.com/problems/"}, "/v1/widgets", "Rate limit exceeded", 429, 10)
+	if thisProblem.Type != "https://example.com/problems/429" {
+		t.Error("Type not generated from base, got: ", thisProblem.Type)
+	}
+}
+
+func TestProblemDetailsRetryAfter(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/v1/widgets", nil)
+	defer context.Clear(r)
+
+	context.Set(r, MiddlewareError, ErrRateLimitExceeded)
+	if getRetryAfter(r) != 0 {
+		t.Error("Retry should be 0 without a session")
+	}
+
+	context.Set(r, SessionData, SessionState{Per: 60, QuotaRenews: time.Now().Unix() + 120})
+
+	if getRetryAfter(r) != 60 {
+		t.Error("Rate limited keys should retry after the rate window")
+	}
+
+	context.Set(r, MiddlewareError, ErrQuotaExceeded)
+	renewsIn := getRetryAfter(r)
+	if renewsIn < 119 || renewsIn > 120 {
+		t.Error("Keys out of quota should retry after renewal, got: ", renewsIn)
+	}
+
+	// Only the errors of the rate limiter carry retry info, not errors that happen to read the same
+	context.Set(r, MiddlewareError, errors.New("Quota exceeded"))
+	if getRetryAfter(r) != 0 {
+		t.Error("Other errors should not have retry info")
+	}
+}
+
+func TestWriteProblemDetails(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeProblemDetails(recorder, NewProblemDetails(ProblemDetailsConfig{}, "/v1/widgets", "Rate limit exceeded", 429, 30))
+
+	if recorder.Code != 429 {
+		t.Error("Wrong status code: ", recorder.Code)
+	}
+	if recorder.HeaderMap.Get("Content-Type") != PROBLEM_DETAILS_CONTENT_TYPE {
+		t.Error("Wrong content type: ", recorder.HeaderMap.Get("Content-Type"))
+	}
+	if recorder.HeaderMap.Get("Retry-After") != "30" {
+		t.Error("Retry-After not set: ", recorder.HeaderMap.Get("Retry-After"))
+	}
+
+	var thisProblem ProblemDetails
+	if err := json.Unmarshal(recorder.Body.Bytes(), &thisProblem); err != nil {
+		t.Fatal("Body is not valid JSON: ", err)
+	}
+	if thisProblem.Detail != "Rate limit exceeded" || thisProblem.Instance != "/v1/widgets" {
+		t.Error("Body does not match: ", thisProblem)
+	}
+}
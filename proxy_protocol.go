@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PROXY_PROTOCOL_DEFAULT_TIMEOUT = 5
+
+var (
+	proxyProtocolV1Prefix  = []byte("PROXY ")
+	proxyProtocolV2Sig     = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	errProxyProtocolHeader = errors.New("Invalid PROXY protocol header")
+)
+
+// proxyProtocolListener reads the PROXY protocol header that an L4 load balancer sends at the start
+// of each connection, so RemoteAddr is the client's address rather than the load balancer's. Every
+// connection from a trusted source (any peer if there are none) must start with a header, other
+// connections are passed through as they are
+type proxyProtocolListener struct {
+	net.Listener
+	Timeout        time.Duration
+	TrustedSources []*net.IPNet
+}
+
+func (p *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.isTrustedSource(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = PROXY_PROTOCOL_DEFAULT_TIMEOUT * time.Second
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// isTrustedSource checks if a peer can send PROXY headers, peers without an IP (e.g. over a unix
+// socket) are only trusted if there is no list
+func (p *proxyProtocolListener) isTrustedSource(addr net.Addr) bool {
+	if len(p.TrustedSources) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range p.TrustedSources {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// proxyProtocolConn reads the header on first use instead of in Accept, so a slow client can't
+// hold up the accept loop
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			log.Warning("Closing connection from ", c.Conn.RemoteAddr(), ": ", c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader parses a v1 or v2 header, the address is nil for health checks sent by
+// the load balancer itself (UNKNOWN in v1, LOCAL in v2) and for address families other than TCP
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyProtocolV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1(r)
+	}
+
+	start, err = r.Peek(len(proxyProtocolV2Sig))
+	if err == nil && bytes.Equal(start, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(r)
+	}
+
+	return nil, errProxyProtocolHeader
+}
+
+// readProxyProtocolV1 parses the text header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProtocolHeader
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtocolHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyProtocolHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2 parses the binary header, any TLVs after the addresses are skipped
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand := header[12]
+	family := header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	if versionCommand>>4 != 2 {
+		return nil, errProxyProtocolHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch versionCommand & 0x0F {
+	case 0x0:
+		// LOCAL
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, errProxyProtocolHeader
+	}
+
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if length < 12 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		// TCP over IPv6
+		if length < 36 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyProtocolV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Sig...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	v2IPv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x01, 0xBB}
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string
+		fails  bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 not-an-ip 198.51.100.1 56324 443\r\n"), "", true},
+		{"v1 no CRLF", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", true},
+		{"v2 TCP4", proxyProtocolV2Header(0x1, 0x11, v2IPv4), "192.0.2.1:56324", false},
+		{"v2 TCP4 with TLVs", proxyProtocolV2Header(0x1, 0x11, append(v2IPv4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:56324", false},
+		{"v2 LOCAL", proxyProtocolV2Header(0x0, 0x00, nil), "", false},
+		{"v2 short addresses", proxyProtocolV2Header(0x1, 0x11, v2IPv4[:6]), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", true},
+	}
+
+	for _, test := range tests {
+		reader := bufio.NewReader(bytes.NewReader(append(test.header, []byte("GET /")...)))
+		addr, err := readProxyProtocolHeader(reader)
+
+		if test.fails {
+			if err == nil {
+				t.Error(test.name, ": header should be rejected")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Error(test.name, ": header should be accepted, got: ", err)
+			continue
+		}
+
+		gotAddr := ""
+		if addr != nil {
+			gotAddr = addr.String()
+		}
+		if gotAddr != test.addr {
+			t.Error(test.name, ": address should be ", test.addr, ", got: ", gotAddr)
+		}
+
+		rest, _ := ioutil.ReadAll(reader)
+		if string(rest) != "GET /" {
+			t.Error(test.name, ": the request after the header should be untouched, got: ", string(rest))
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &proxyProtocolListener{Listener: base}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", base.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 40000 80\r\nhello"))
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.RemoteAddr().String() != "203.0.113.7:40000" {
+		t.Error("RemoteAddr should be the client from the header, got: ", conn.RemoteAddr())
+	}
+
+	data, _ := ioutil.ReadAll(conn)
+	if string(data) != "hello" {
+		t.Error("Data after the header should be read as normal, got: ", string(data))
+	}
+}
+
+func TestProxyProtocolTrustedSources(t *testing.T) {
+	base, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &proxyProtocolListener{Listener: base, TrustedSources: parseCIDRList([]string{"10.0.0.0/8"}, "PROXY protocol source")}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", base.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 203.0.113.7 198.51.100.1 40000 80\r\nhello"))
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if strings.HasPrefix(conn.RemoteAddr().String(), "203.0.113.7") {
+		t.Error("Headers from untrusted peers should be ignored")
+	}
+
+	data, _ := ioutil.ReadAll(conn)
+	if !strings.HasPrefix(string(data), "PROXY TCP4") {
+		t.Error("Connections from untrusted peers should be passed through, got: ", string(data))
+	}
+}
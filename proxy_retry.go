@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The wait between upstream retries doubles with each attempt up to this many milliseconds
+const PROXY_RETRY_MAX_BACKOFF_MS = 5000
+
+// ProxyRetryConfig sets up automatic retries to the upstream, only idempotent
+// methods are retried unless others are explicitly listed in retry_methods
+type ProxyRetryConfig struct {
+	Enabled       bool     `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	MaxAttempts   int      `mapstructure:"max_attempts" bson:"max_attempts" json:"max_attempts"`
+	BackoffMS     int      `mapstructure:"backoff_ms" bson:"backoff_ms" json:"backoff_ms"`
+	RetryMethods  []string `mapstructure:"retry_methods" bson:"retry_methods" json:"retry_methods"`
+	RetryOnStatus []int    `mapstructure:"retry_on_status" bson:"retry_on_status" json:"retry_on_status"`
+}
+
+// ProxyRetryModuleConfig is the API definition section for retries
+type ProxyRetryModuleConfig struct {
+	ProxyRetries ProxyRetryConfig `mapstructure:"proxy_retries" bson:"proxy_retries" json:"proxy_retries"`
+}
+
+// GetProxyRetryConfig reads the retry settings from the API definition and sets defaults
+func GetProxyRetryConfig(spec *APISpec) ProxyRetryConfig {
+	var thisModuleConfig ProxyRetryModuleConfig
+	if spec == nil {
+		return thisModuleConfig.ProxyRetries
+	}
+
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode proxy retry configuration: ", err)
+		return ProxyRetryConfig{}
+	}
+
+	thisConf := thisModuleConfig.ProxyRetries
+	if thisConf.MaxAttempts < 1 {
+		thisConf.MaxAttempts = 3
+	}
+	if thisConf.BackoffMS < 0 {
+		thisConf.BackoffMS = 0
+	}
+	if len(thisConf.RetryMethods) == 0 {
+		thisConf.RetryMethods = []string{"GET", "HEAD"}
+	}
+	if len(thisConf.RetryOnStatus) == 0 {
+		thisConf.RetryOnStatus = []int{502, 503, 504}
+	}
+
+	return thisConf
+}
+
+// AppliesTo checks if requests with this method can be retried
+func (c ProxyRetryConfig) AppliesTo(method string) bool {
+	if !c.Enabled || c.MaxAttempts < 2 {
+		return false
+	}
+
+	for _, thisMethod := range c.RetryMethods {
+		if strings.ToUpper(thisMethod) == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ShouldRetry checks if the outcome of a round trip warrants another attempt
+func (c ProxyRetryConfig) ShouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	for _, code := range c.RetryOnStatus {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Backoff is the wait before the given retry, it starts at backoff_ms and doubles for each attempt
+// up to PROXY_RETRY_MAX_BACKOFF_MS
+func (c ProxyRetryConfig) Backoff(attempt int) time.Duration {
+	backoff := c.BackoffMS
+	for i := 1; i < attempt && backoff < PROXY_RETRY_MAX_BACKOFF_MS; i++ {
+		backoff *= 2
+	}
+
+	if backoff > PROXY_RETRY_MAX_BACKOFF_MS {
+		backoff = PROXY_RETRY_MAX_BACKOFF_MS
+	}
+
+	return time.Duration(backoff) * time.Millisecond
+}
+
+// roundTripWithRetries performs the upstream round trip, retrying with an exponential
+// backoff if the API has retries enabled for the request method. Streaming requests are never
+// retried as their body can't be replayed, and retries stop if the client goes away
+func (p *ReverseProxy) roundTripWithRetries(transport http.RoundTripper, outreq *http.Request, streaming bool) (*http.Response, error) {
+	if streaming || !p.RetryConfig.AppliesTo(outreq.Method) {
+		return transport.RoundTrip(outreq)
+	}
+
+	// The body needs to be replayable
+	var bodyBytes []byte
+	if outreq.Body != nil {
+		var readErr error
+		bodyBytes, readErr = ioutil.ReadAll(outreq.Body)
+		outreq.Body.Close()
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+
+	var res *http.Response
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		if bodyBytes != nil {
+			outreq.Body = ioutil.NopCloser(bytes.NewReader(bodyBytes))
+		}
+
+		res, err = transport.RoundTrip(outreq)
+		if attempt >= p.RetryConfig.MaxAttempts || !p.RetryConfig.ShouldRetry(res, err) {
+			return res, err
+		}
+
+		if err != nil {
+			log.Warning("Upstream request failed, retrying (attempt ", attempt, "): ", err)
+		} else {
+			log.Warning("Upstream returned ", res.StatusCode, ", retrying (attempt ", attempt, ")")
+			// Drain the body so the connection can be re-used
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(p.RetryConfig.Backoff(attempt)):
+		case <-outreq.Context().Done():
+			return nil, outreq.Context().Err()
+		}
+	}
+}
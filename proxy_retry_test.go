@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTripperFunc lets a test stand in for the upstream transport
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestProxyRetryBackoff(t *testing.T) {
+	thisConfig := ProxyRetryConfig{BackoffMS: 1000}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range expected {
+		if thisConfig.Backoff(i+1) != backoff {
+			t.Error("Unexpected backoff for attempt ", i+1, ": ", thisConfig.Backoff(i+1))
+		}
+	}
+
+	// A large backoff_ms is capped as well
+	if (ProxyRetryConfig{BackoffMS: 60000}).Backoff(1) != 5*time.Second {
+		t.Error("backoff_ms should be capped")
+	}
+}
+
+func TestRetriesStopWhenClientGoesAway(t *testing.T) {
+	attempts := 0
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: 503, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	thisProxy := &ReverseProxy{RetryConfig: ProxyRetryConfig{Enabled: true, MaxAttempts: 3, BackoffMS: 5000, RetryMethods: []string{"GET"}, RetryOnStatus: []int{503}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "http://upstream/", nil)
+	req = req.WithContext(ctx)
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := thisProxy.roundTripWithRetries(upstream, req, false)
+
+	if err == nil {
+		t.Error("A cancelled request should return an error")
+	}
+	if attempts != 1 {
+		t.Error("No retry should be made after the client went away, attempts: ", attempts)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("The backoff was not interrupted: ", time.Since(start))
+	}
+}
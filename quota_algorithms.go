@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Quota algorithms, set per key (or policy) with quota_algorithm. The fixed window starts with the
+// first request of a period, this is the default and the original behaviour
+const (
+	QuotaAlgorithmFixed           = "fixed"
+	QuotaAlgorithmCalendarMonthly = "calendar_monthly"
+	QuotaAlgorithmSliding         = "sliding"
+)
+
+// IsValidQuotaAlgorithm checks a quota algorithm name, an empty name means fixed
+func IsValidQuotaAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "", QuotaAlgorithmFixed, QuotaAlgorithmCalendarMonthly, QuotaAlgorithmSliding:
+		return true
+	}
+
+	return false
+}
+
+// validatePolicyQuotaAlgorithms drops policies with an unknown quota algorithm, rather than silently
+// enforcing them with a fixed window
+func validatePolicyQuotaAlgorithms(policies map[string]Policy) map[string]Policy {
+	for policyID, policy := range policies {
+		if !IsValidQuotaAlgorithm(policy.QuotaAlgorithm) {
+			log.Error("Policy ", policyID, " has an unknown quota_algorithm: ", policy.QuotaAlgorithm, ", skipping")
+			delete(policies, policyID)
+		}
+	}
+
+	return policies
+}
+
+// monthBounds returns the start of the (UTC) calendar month of now and the start of the next one
+func monthBounds(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0)
+}
+
+// calendarQuotaKey is the counter for the current month
+func calendarQuotaKey(rawKey string, now time.Time) string {
+	return rawKey + "-" + now.UTC().Format("2006-01")
+}
+
+// slidingQuotaKeys returns the counters of the current and previous windows and how far through
+// the current window we are (0 - 1)
+func slidingQuotaKeys(rawKey string, window int64, now time.Time) (string, string, float64, int64) {
+	windowIndex := now.Unix() / window
+	elapsed := float64(now.Unix()-windowIndex*window) / float64(window)
+
+	return rawKey + "-" + strconv.FormatInt(windowIndex, 10),
+		rawKey + "-" + strconv.FormatInt(windowIndex-1, 10),
+		elapsed,
+		(windowIndex + 1) * window
+}
+
+// setQuotaRemaining updates the session values reported to the client
+func setQuotaRemaining(currentSession *SessionState, used int64) {
+	remaining := currentSession.QuotaMax - used
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	currentSession.QuotaRemaining = remaining
+}
+
+// isCalendarQuotaExceeded counts requests per calendar month, the counter expires when the month ends
+func (l SessionLimiter) isCalendarQuotaExceeded(currentSession *SessionState, rawKey string, store StorageHandler) bool {
+	now := time.Now()
+	_, nextMonth := monthBounds(now)
+
+	// Keep the counter for an hour after the month ends to allow for clock drift between nodes
+	qInt := store.IncrememntWithExpire(calendarQuotaKey(rawKey, now), nextMonth.Unix()-now.Unix()+3600)
+	currentSession.QuotaRenews = nextMonth.Unix()
+
+	if (qInt - 1) >= currentSession.QuotaMax {
+		return true
+	}
+
+	setQuotaRemaining(currentSession, qInt)
+	return false
+}
+
+// isSlidingQuotaExceeded approximates a sliding window with two fixed windows of QuotaRenewalRate
+// seconds, the previous window's count is weighted by how much of it still overlaps the sliding window.
+// Only a single INCR and GET are needed per request regardless of the size of the quota
+func (l SessionLimiter) isSlidingQuotaExceeded(currentSession *SessionState, rawKey string, store StorageHandler) bool {
+	window := currentSession.QuotaRenewalRate
+	currKey, prevKey, elapsed, windowEnds := slidingQuotaKeys(rawKey, window, time.Now())
+
+	qInt := store.IncrememntWithExpire(currKey, window*2)
+
+	var prevCount int64
+	if prevVal, err := store.GetRawKey(prevKey); err == nil {
+		prevCount, _ = strconv.ParseInt(prevVal, 10, 64)
+	}
+
+	used := int64(float64(prevCount)*(1-elapsed)) + qInt
+	currentSession.QuotaRenews = windowEnds
+
+	if (used - 1) >= currentSession.QuotaMax {
+		// Rejected requests aren't counted, otherwise a client retrying while blocked would carry the
+		// block over into the next window
+		store.Decrement(currKey)
+		return true
+	}
+
+	setQuotaRemaining(currentSession, used)
+	return false
+}
+
+// resetQuotaWindows removes the windowed counters of a key so a quota reset applies to all algorithms
+func resetQuotaWindows(store StorageHandler, rawKey string, currentSession SessionState) {
+	now := time.Now()
+	switch currentSession.QuotaAlgorithm {
+	case QuotaAlgorithmCalendarMonthly:
+		store.DeleteRawKey(calendarQuotaKey(rawKey, now))
+	case QuotaAlgorithmSliding:
+		if currentSession.QuotaRenewalRate > 0 {
+			currKey, prevKey, _, _ := slidingQuotaKeys(rawKey, currentSession.QuotaRenewalRate, now)
+			store.DeleteRawKey(currKey)
+			store.DeleteRawKey(prevKey)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMonthBounds(t *testing.T) {
+	now := time.Date(2015, time.December, 17, 13, 4, 5, 0, time.UTC)
+	start, next := monthBounds(now)
+
+	if !start.Equal(time.Date(2015, time.December, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Month start is wrong: ", start)
+	}
+
+	if !next.Equal(time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("Next month is wrong: ", next)
+	}
+
+	if key := calendarQuotaKey("quota-abc", now); key != "quota-abc-2015-12" {
+		t.Error("Calendar quota key is wrong: ", key)
+	}
+}
+
+func TestCalendarQuota(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	thisSession := SessionState{QuotaMax: 2, QuotaAlgorithm: QuotaAlgorithmCalendarMonthly}
+	limiter := SessionLimiter{}
+
+	for i := 0; i < 2; i++ {
+		if limiter.isCalendarQuotaExceeded(&thisSession, "quota-abc", store) {
+			t.Fatal("Quota exceeded early on request ", i+1)
+		}
+	}
+
+	if thisSession.QuotaRemaining != 0 {
+		t.Error("Quota remaining should be 0, got: ", thisSession.QuotaRemaining)
+	}
+
+	_, next := monthBounds(time.Now())
+	if thisSession.QuotaRenews != next.Unix() {
+		t.Error("Quota should renew at the start of next month")
+	}
+
+	if !limiter.isCalendarQuotaExceeded(&thisSession, "quota-abc", store) {
+		t.Error("Third request should exceed the quota")
+	}
+
+	resetQuotaWindows(store, "quota-abc", thisSession)
+	if limiter.isCalendarQuotaExceeded(&thisSession, "quota-abc", store) {
+		t.Error("Quota should be available after a reset")
+	}
+}
+
+func TestSlidingQuota(t *testing.T) {
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	thisSession := SessionState{QuotaMax: 10, QuotaRenewalRate: 3600, QuotaAlgorithm: QuotaAlgorithmSliding}
+	limiter := SessionLimiter{}
+
+	// A full previous window should still count against the quota early in the new window
+	_, prevKey, elapsed, _ := slidingQuotaKeys("quota-abc", 3600, time.Now())
+	store.Sessions[prevKey] = strconv.Itoa(100)
+
+	if elapsed < 0.9 && !limiter.isSlidingQuotaExceeded(&thisSession, "quota-abc", store) {
+		t.Error("Previous window should be carried over")
+	}
+
+	resetQuotaWindows(store, "quota-abc", thisSession)
+	if limiter.isSlidingQuotaExceeded(&thisSession, "quota-abc", store) {
+		t.Error("Quota should be available after a reset")
+	}
+
+	if thisSession.QuotaRemaining != 9 {
+		t.Error("Quota remaining should be 9, got: ", thisSession.QuotaRemaining)
+	}
+
+	// Rejected requests don't count against the window
+	thisSession.QuotaMax = 1
+	currKey, _, _, _ := slidingQuotaKeys("quota-abc", 3600, time.Now())
+	for i := 0; i < 3; i++ {
+		if !limiter.isSlidingQuotaExceeded(&thisSession, "quota-abc", store) {
+			t.Error("Quota should be exceeded")
+		}
+	}
+
+	if store.Sessions[currKey] != "1" {
+		t.Error("Rejected requests should not be counted, got: ", store.Sessions[currKey])
+	}
+}
+
+func TestValidatePolicyQuotaAlgorithms(t *testing.T) {
+	policies := map[string]Policy{
+		"fixed":   {QuotaAlgorithm: QuotaAlgorithmFixed},
+		"default": {},
+		"typo":    {QuotaAlgorithm: "sliding_window"},
+	}
+
+	policies = validatePolicyQuotaAlgorithms(policies)
+	if len(policies) != 2 {
+		t.Error("Policy with an unknown quota algorithm should be dropped, got: ", policies)
+	}
+
+	if _, found := policies["typo"]; found {
+		t.Error("Policy with an unknown quota algorithm should be dropped")
+	}
+}
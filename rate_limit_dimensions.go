@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gorilla/context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Sources a rate limit dimension can be read from
+const (
+	RateLimitDimensionHeader   = "header"
+	RateLimitDimensionJWTClaim = "jwt_claim"
+	RateLimitDimensionBody     = "body"
+)
+
+// Request bodies larger than this are not read for a dimension
+const RATE_LIMIT_DIMENSION_MAX_BODY = 1 << 20
+
+// Keys list the header and body values they may be rate limited by in this meta data field
+const RATE_LIMIT_DIMENSIONS_META = "rate_limit_dimensions"
+
+// RateLimitDimensionConfig splits a key's rate limit by a request attribute, so that each device
+// sharing a key gets its own rate limit. Name is the header name, the claim name or a JSONPath
+// into the request body (e.g. "$.device.id"). Only authenticated attributes are used: claims of a
+// verified OpenID token or of a key that is a JWT, and header or body values listed in the key's
+// rate_limit_dimensions meta data. Requests without such an attribute share the key's limit,
+// quotas are always counted per key
+type RateLimitDimensionConfig struct {
+	Source string `mapstructure:"source" bson:"source" json:"source"`
+	Name   string `mapstructure:"name" bson:"name" json:"name"`
+}
+
+// GetDimension extracts the dimension value of a request, it is empty if the attribute is missing
+// or can't be trusted
+func (c RateLimitDimensionConfig) GetDimension(r *http.Request, authHeaderValue string, thisSession *SessionState) string {
+	if c.Name == "" {
+		return ""
+	}
+
+	switch c.Source {
+	case RateLimitDimensionJWTClaim:
+		if claims, ok := context.Get(r, VerifiedClaims).(map[string]interface{}); ok {
+			return dimensionString(claims[c.Name])
+		}
+		return getJWTClaim(authHeaderValue, c.Name)
+	case RateLimitDimensionHeader:
+		return allowedDimension(thisSession, r.Header.Get(c.Name))
+	case RateLimitDimensionBody:
+		return allowedDimension(thisSession, getBodyField(r, c.Name))
+	}
+
+	return ""
+}
+
+// allowedDimension only keeps a value the client controls if the key lists it, otherwise a client
+// could multiply its rate limit by sending a new value with each request
+func allowedDimension(thisSession *SessionState, value string) string {
+	if value == "" || thisSession == nil {
+		return ""
+	}
+
+	metaData, ok := thisSession.MetaData.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	allowed, _ := metaData[RATE_LIMIT_DIMENSIONS_META].([]interface{})
+	for _, allowedValue := range allowed {
+		if dimensionString(allowedValue) == value {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// getJWTClaim reads a claim from a JWT that is itself the key, the token was authenticated by
+// matching it to its session so the signature isn't checked again
+func getJWTClaim(token string, claim string) string {
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.URLEncoding.DecodeString(padBase64(parts[1]))
+	if err != nil {
+		log.Debug("Couldn't decode JWT payload: ", err)
+		return ""
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		log.Debug("Couldn't decode JWT claims: ", err)
+		return ""
+	}
+
+	return dimensionString(claims[claim])
+}
+
+func padBase64(data string) string {
+	if missing := len(data) % 4; missing > 0 {
+		data += strings.Repeat("=", 4-missing)
+	}
+
+	return data
+}
+
+// getBodyField reads a field from a JSON request body, the body is put back for the rest of the chain.
+// Bodies over RATE_LIMIT_DIMENSION_MAX_BODY are not parsed or held in memory
+func getBodyField(r *http.Request, path string) string {
+	if r.Body == nil || r.ContentLength > RATE_LIMIT_DIMENSION_MAX_BODY {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, RATE_LIMIT_DIMENSION_MAX_BODY+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	if err != nil {
+		log.Error("Failed to read request body! ", err)
+		return ""
+	}
+
+	if len(body) > RATE_LIMIT_DIMENSION_MAX_BODY {
+		return ""
+	}
+
+	var bodyData interface{}
+	if err := json.Unmarshal(body, &bodyData); err != nil {
+		return ""
+	}
+
+	return dimensionString(lookupJSONPath(bodyData, path))
+}
+
+// lookupJSONPath supports the simple dotted form of JSONPath with array indexes, e.g. "$.devices[0].id"
+func lookupJSONPath(data interface{}, path string) interface{} {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return data
+	}
+
+	for _, segment := range strings.Split(strings.Replace(path, "[", ".[", -1), ".") {
+		if segment == "" {
+			continue
+		}
+
+		if strings.HasPrefix(segment, "[") && strings.HasSuffix(segment, "]") {
+			index, err := strconv.Atoi(segment[1 : len(segment)-1])
+			list, ok := data.([]interface{})
+			if err != nil || !ok || index < 0 || index >= len(list) {
+				return nil
+			}
+			data = list[index]
+			continue
+		}
+
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		data = object[segment]
+	}
+
+	return data
+}
+
+// dimensionString converts scalar values, objects and lists can't be used as a dimension
+func dimensionString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+
+	return ""
+}
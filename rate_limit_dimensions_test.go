@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/gorilla/context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRateLimitDimensionHeader(t *testing.T) {
+	thisConfig := RateLimitDimensionConfig{Source: RateLimitDimensionHeader, Name: "X-Device-Id"}
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Device-Id", "device-1")
+	thisSession := SessionState{MetaData: map[string]interface{}{RATE_LIMIT_DIMENSIONS_META: []interface{}{"device-1"}}}
+
+	if dimension := thisConfig.GetDimension(req, "key", &thisSession); dimension != "device-1" {
+		t.Error("Wrong dimension: ", dimension)
+	}
+
+	// Values the key doesn't list would let a client pick a fresh rate limit with every request
+	req.Header.Set("X-Device-Id", "device-2")
+	if dimension := thisConfig.GetDimension(req, "key", &thisSession); dimension != "" {
+		t.Error("Unlisted value should have no dimension, got: ", dimension)
+	}
+
+	if dimension := thisConfig.GetDimension(req, "key", &SessionState{}); dimension != "" {
+		t.Error("Key without dimensions should have no dimension, got: ", dimension)
+	}
+
+	limiter := SessionLimiter{Dimension: "device-1"}
+	if limiter.rateKey("key") == "key" {
+		t.Error("Dimension should change the rate limit key")
+	}
+
+	if (SessionLimiter{}).rateKey("key") != "key" {
+		t.Error("Rate limit key should not change without a dimension")
+	}
+}
+
+func TestRateLimitDimensionJWTClaim(t *testing.T) {
+	payload := base64.URLEncoding.EncodeToString([]byte(`{"sub": "user", "device": 42}`))
+	token := "Bearer header." + strings.TrimRight(payload, "=") + ".signature"
+
+	thisConfig := RateLimitDimensionConfig{Source: RateLimitDimensionJWTClaim, Name: "device"}
+	req, _ := http.NewRequest("GET", "/", nil)
+	if dimension := thisConfig.GetDimension(req, token, &SessionState{}); dimension != "42" {
+		t.Error("Wrong dimension: ", dimension)
+	}
+
+	if dimension := thisConfig.GetDimension(req, "not-a-jwt", &SessionState{}); dimension != "" {
+		t.Error("Opaque keys should have no dimension, got: ", dimension)
+	}
+}
+
+func TestRateLimitDimensionBody(t *testing.T) {
+	body := `{"devices": [{"id": "first"}, {"id": "second"}]}`
+	thisConfig := RateLimitDimensionConfig{Source: RateLimitDimensionBody, Name: "$.devices[1].id"}
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	thisSession := SessionState{MetaData: map[string]interface{}{RATE_LIMIT_DIMENSIONS_META: []interface{}{"first", "second"}}}
+
+	if dimension := thisConfig.GetDimension(req, "key", &thisSession); dimension != "second" {
+		t.Error("Wrong dimension: ", dimension)
+	}
+
+	// The body must still be readable by the rest of the chain
+	remaining, _ := ioutil.ReadAll(req.Body)
+	if string(remaining) != body {
+		t.Error("Request body was not restored")
+	}
+
+	thisConfig.Name = "$.devices[5].id"
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+	if dimension := thisConfig.GetDimension(req, "key", &thisSession); dimension != "" {
+		t.Error("Missing field should have no dimension, got: ", dimension)
+	}
+}
+
+func TestRateLimitDimensionVerifiedClaims(t *testing.T) {
+	thisConfig := RateLimitDimensionConfig{Source: RateLimitDimensionJWTClaim, Name: "device"}
+	req, _ := http.NewRequest("GET", "/", nil)
+	context.Set(req, VerifiedClaims, map[string]interface{}{"device": "verified-device"})
+	defer context.Clear(req)
+
+	if dimension := thisConfig.GetDimension(req, "oidc-session-key", &SessionState{}); dimension != "verified-device" {
+		t.Error("Verified claims should be used, got: ", dimension)
+	}
+}
+
+func TestRateLimitDimensionLargeBody(t *testing.T) {
+	body := `{"id": "first", "padding": "` + strings.Repeat("a", RATE_LIMIT_DIMENSION_MAX_BODY) + `"}`
+	thisConfig := RateLimitDimensionConfig{Source: RateLimitDimensionBody, Name: "$.id"}
+	thisSession := SessionState{MetaData: map[string]interface{}{RATE_LIMIT_DIMENSIONS_META: []interface{}{"first"}}}
+
+	// Without a content length the body is read up to the limit
+	req, _ := http.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader(body)))
+	if dimension := thisConfig.GetDimension(req, "key", &thisSession); dimension != "" {
+		t.Error("Large body should not be parsed, got: ", dimension)
+	}
+
+	remaining, _ := ioutil.ReadAll(req.Body)
+	if string(remaining) != body {
+		t.Error("Large request body was not restored")
+	}
+}
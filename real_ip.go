@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GetIPFromRequest returns the client IP address of a request without the port. X-Forwarded-For
+// is only used when the request comes from a trusted proxy, the list is read from the right and the
+// first address that isn't a trusted proxy is the client, so entries added by the client are ignored
+func GetIPFromRequest(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(remoteIP) {
+		return remoteIP
+	}
+
+	// Each proxy can add its own header line instead of appending to the first one
+	forwarded := strings.Join(r.Header["X-Forwarded-For"], ",")
+	if forwarded == "" {
+		return remoteIP
+	}
+
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// Anything to the left of an invalid entry can't be trusted
+			return remoteIP
+		}
+
+		remoteIP = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return remoteIP
+}
+
+func isTrustedProxy(ip string) bool {
+	if len(config.trustedProxiesCompiled) == 0 {
+		return false
+	}
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+
+	for _, ipNet := range config.trustedProxiesCompiled {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	return false
+}
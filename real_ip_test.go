@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetIPFromRequest(t *testing.T) {
+	oldProxies := config.TrustedProxies
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.10"}
+	config.loadTrustedProxies()
+	defer func() {
+		config.TrustedProxies = oldProxies
+		config.loadTrustedProxies()
+	}()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		ip         string
+	}{
+		{"direct client", "203.0.113.5:1234", "", "203.0.113.5"},
+		{"untrusted proxy", "203.0.113.5:1234", "198.51.100.1", "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"single trusted IP", "192.0.2.10:1234", "198.51.100.1", "198.51.100.1"},
+		{"spoofed entry", "10.0.0.1:1234", "1.2.3.4, 198.51.100.1", "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"invalid entry", "10.0.0.1:1234", "not-an-ip", "10.0.0.1"},
+		{"IPv6 client", "[2001:db8::1]:1234", "", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+
+		if ip := GetIPFromRequest(req); ip != test.ip {
+			t.Error(test.name, ": IP should be ", test.ip, ", got: ", ip)
+		}
+	}
+	// The last proxy's own header line is read first
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Add("X-Forwarded-For", "1.2.3.4")
+	req.Header.Add("X-Forwarded-For", "198.51.100.1")
+	if ip := GetIPFromRequest(req); ip != "198.51.100.1" {
+		t.Error("Every X-Forwarded-For line should be read, got: ", ip)
+	}
+}
+
+func TestStoreAnalyticsIgnoresForwardedFromUntrustedProxy(t *testing.T) {
+	testConfig := Config{EnableAnalytics: true}
+	testConfig.AnalyticsConfig.IgnoredIPs = []string{"198.51.100.1"}
+	testConfig.loadIgnoredIPs()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+
+	if !testConfig.StoreAnalytics(req) {
+		t.Error("X-Forwarded-For should only be used from trusted proxies")
+	}
+}
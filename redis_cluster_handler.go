@@ -13,11 +13,13 @@ import (
 
 var redisClusterSingleton *rediscluster.RedisCluster
 
-// RedisClusterStorageManager is a storage manager that uses the redis database.
+// RedisClusterStorageManager is a storage manager that uses the redis database. If Isolation is set
+// the manager uses the dedicated connection of an isolated API instead of the shared pool
 type RedisClusterStorageManager struct {
 	db        *rediscluster.RedisCluster
 	KeyPrefix string
 	HashKeys  bool
+	Isolation *StorageIsolationConfig
 }
 
 func NewRedisClusterPool() *rediscluster.RedisCluster {
@@ -28,6 +30,23 @@ func NewRedisClusterPool() *rediscluster.RedisCluster {
 
 	log.Info("Creating new Redis connection pool")
 
+	seed_redii := []map[string]string{}
+
+	if len(config.Storage.Hosts) > 0 {
+		for h, p := range config.Storage.Hosts {
+			seed_redii = append(seed_redii, map[string]string{h: p})
+		}
+	} else {
+		seed_redii = append(seed_redii, map[string]string{config.Storage.Host: strconv.Itoa(config.Storage.Port)})
+	}
+
+	redisClusterSingleton = createRedisClusterPool(seed_redii, config.Storage.Database, config.Storage.Password)
+
+	return redisClusterSingleton
+}
+
+// createRedisClusterPool creates a pool with the optimisation settings of tyk.conf
+func createRedisClusterPool(seed_redii []map[string]string, database int, password string) *rediscluster.RedisCluster {
 	maxIdle := 100
 	if config.Storage.MaxIdle > 0 {
 		maxIdle = config.Storage.MaxIdle
@@ -46,32 +65,23 @@ func NewRedisClusterPool() *rediscluster.RedisCluster {
 		MaxIdle:     maxIdle,
 		MaxActive:   maxActive,
 		IdleTimeout: 240 * time.Second,
-		Database:    config.Storage.Database,
-		Password:    config.Storage.Password,
+		Database:    database,
+		Password:    password,
 		IsCluster:   config.Storage.EnableCluster,
 	}
 
-	seed_redii := []map[string]string{}
-
-	if len(config.Storage.Hosts) > 0 {
-		for h, p := range config.Storage.Hosts {
-			seed_redii = append(seed_redii, map[string]string{h: p})
-		}
-	} else {
-		seed_redii = append(seed_redii, map[string]string{config.Storage.Host: strconv.Itoa(config.Storage.Port)})
-	}
-
 	thisInstance := rediscluster.NewRedisCluster(seed_redii, thisPoolConf, false)
 
-	redisClusterSingleton = &thisInstance
-
 	return &thisInstance
 }
 
 // Connect will establish a connection to the r.db
 func (r *RedisClusterStorageManager) Connect() bool {
 
-	if r.db == nil {
+	if r.db == nil && r.Isolation != nil {
+		log.Debug("Connecting to isolated redis")
+		r.db = NewIsolatedRedisClusterPool(*r.Isolation)
+	} else if r.db == nil {
 		log.Debug("Connecting to redis cluster")
 		r.db = NewRedisClusterPool()
 	} else {
@@ -89,6 +99,20 @@ func (r *RedisClusterStorageManager) hashKey(in string) string {
 	return doHash(in)
 }
 
+// KeyNamespace is the key prefix, isolated connections are told apart by their pool name
+func (r *RedisClusterStorageManager) KeyNamespace() string {
+	if r.Isolation != nil {
+		return r.Isolation.poolName() + "/" + r.KeyPrefix
+	}
+
+	return r.KeyPrefix
+}
+
+// HashedKeyName is the raw name of a key known by its public hash
+func (r *RedisClusterStorageManager) HashedKeyName(keyHash string) string {
+	return r.KeyPrefix + keyHash
+}
+
 func (r *RedisClusterStorageManager) fixKey(keyName string) string {
 	setKeyName := r.KeyPrefix + r.hashKey(keyName)
 
@@ -235,7 +259,8 @@ func (r *RedisClusterStorageManager) IncrememntWithExpire(keyName string, expire
 		fixedKey := keyName
 		val, err := redis.Int64(r.db.Do("INCR", fixedKey))
 		log.Debug("Incremented key: ", fixedKey, ", val is: ", val)
-		if val == 1 {
+		// EXPIRE with a zero or negative value deletes the key, those counters never expire
+		if val == 1 && expire > 0 {
 			log.Debug("--> Setting Expire")
 			r.db.Send("EXPIRE", fixedKey, expire)
 		}
@@ -572,3 +597,111 @@ func (r *RedisClusterStorageManager) SetRollingWindow(keyName string, per int64,
 	}
 	return 0
 }
+
+// AppendToCappedList appends to a list and trims it to its last maxLen entries in one transaction
+func (r *RedisClusterStorageManager) AppendToCappedList(keyName string, value string, maxLen int64) error {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.AppendToCappedList(keyName, value, maxLen)
+	}
+
+	fixedKey := r.fixKey(keyName)
+	RPUSH := rediscluster.ClusterTransaction{}
+	RPUSH.Cmd = "RPUSH"
+	RPUSH.Args = []interface{}{fixedKey, value}
+
+	LTRIM := rediscluster.ClusterTransaction{}
+	LTRIM.Cmd = "LTRIM"
+	LTRIM.Args = []interface{}{fixedKey, -maxLen, -1}
+
+	_, err := r.db.DoTransaction([]rediscluster.ClusterTransaction{RPUSH, LTRIM})
+	return err
+}
+
+// IncrementHashFields increments several fields of a hash in one transaction and sets its expiry
+func (r *RedisClusterStorageManager) IncrementHashFields(keyName string, fields map[string]int64, expire int64) error {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.IncrementHashFields(keyName, fields, expire)
+	}
+
+	fixedKey := r.fixKey(keyName)
+	commands := []rediscluster.ClusterTransaction{}
+	for field, by := range fields {
+		HINCRBY := rediscluster.ClusterTransaction{}
+		HINCRBY.Cmd = "HINCRBY"
+		HINCRBY.Args = []interface{}{fixedKey, field, by}
+		commands = append(commands, HINCRBY)
+	}
+
+	if expire > 0 {
+		EXPIRE := rediscluster.ClusterTransaction{}
+		EXPIRE.Cmd = "EXPIRE"
+		EXPIRE.Args = []interface{}{fixedKey, expire}
+		commands = append(commands, EXPIRE)
+	}
+
+	_, err := r.db.DoTransaction(commands)
+	return err
+}
+
+// GetHash returns all the fields of a hash
+func (r *RedisClusterStorageManager) GetHash(keyName string) map[string]string {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.GetHash(keyName)
+	}
+
+	values, err := redis.StringMap(r.db.Do("HGETALL", r.fixKey(keyName)))
+	if err != nil {
+		log.Error("Error trying to get hash: ", err)
+		return map[string]string{}
+	}
+
+	return values
+}
+
+// SetKeys writes several keys in one transaction, existing keys are only replaced if overwrite is set.
+// It returns the keys that were skipped because they already exist
+func (r *RedisClusterStorageManager) SetKeys(keys map[string]string, timeout int64, overwrite bool) ([]string, error) {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.SetKeys(keys, timeout, overwrite)
+	}
+
+	keyNames := []string{}
+	commands := []rediscluster.ClusterTransaction{}
+	for keyName, value := range keys {
+		SET := rediscluster.ClusterTransaction{}
+		SET.Cmd = "SET"
+		SET.Args = []interface{}{r.fixKey(keyName), value}
+		if timeout > 0 {
+			SET.Args = append(SET.Args, "EX", timeout)
+		}
+		if !overwrite {
+			SET.Args = append(SET.Args, "NX")
+		}
+
+		keyNames = append(keyNames, keyName)
+		commands = append(commands, SET)
+	}
+
+	results, err := redis.Values(r.db.DoTransaction(commands))
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := []string{}
+	for i, result := range results {
+		// SET NX returns nil if the key exists
+		if result == nil && i < len(keyNames) {
+			skipped = append(skipped, keyNames[i])
+		}
+	}
+
+	return skipped, nil
+}
@@ -35,6 +35,44 @@ func HandleRedisReloadMsg(message redis.Message) {
 		return
 	}
 
+	// Key changes only affect the session cache, they don't need a reload
+	if thisMessage.Command == NoticeKeySpaceChanged {
+		handleKeySpaceChanged(thisMessage.Payload)
+		return
+	}
+
+	// Revoked tokens are dropped from the caches of this node
+	if thisMessage.Command == NoticeTokenRevoked {
+		handleTokenRevoked(thisMessage.Payload)
+		return
+	}
+
+	// Org changes only affect the org state cache
+	if thisMessage.Command == NoticeOrgChanged {
+		handleOrgChanged(thisMessage.Payload)
+		return
+	}
+
+	// API state changes are applied to the loaded API
+	if thisMessage.Command == NoticeAPIStateChanged {
+		handleAPIStateChanged(thisMessage.Payload)
+		return
+	}
+
+	// Node reloads are only for the node named in the payload
+	if thisMessage.Command == NoticeNodeReload && !isNotificationForThisNode(thisMessage.Payload) {
+		return
+	}
+
+	// Drain requests never reload, they only drain the node named in the payload
+	if thisMessage.Command == NoticeNodeDrain {
+		if isNotificationForThisNode(thisMessage.Payload) {
+			NodeDrain.StartDraining()
+			go Nodes.Heartbeat()
+		}
+		return
+	}
+
 	log.Info("Reload signal received, reloading endpoints")
 	ReloadURLStructure()
 }
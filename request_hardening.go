@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// HeaderHardeningConfig cleans up request headers before they are proxied. Limits include headers
+// added by the middleware chain, StripHeaders are header names to remove and may end with a * to
+// match a prefix, e.g. "X-Internal-*"
+type HeaderHardeningConfig struct {
+	Enabled        bool     `json:"enabled"`
+	MaxHeaderCount int      `json:"max_header_count"`
+	MaxHeaderSize  int      `json:"max_header_size"`
+	StripHeaders   []string `json:"strip_headers"`
+}
+
+var (
+	errTooManyHeaders  = errors.New("Request has too many headers")
+	errHeadersTooLarge = errors.New("Request headers are too large")
+)
+
+// checkHeaderLimits counts each header value and measures the headers as they are sent on the wire
+func checkHeaderLimits(headers http.Header, hardening HeaderHardeningConfig) error {
+	count := 0
+	size := 0
+	for name, values := range headers {
+		for _, value := range values {
+			count++
+			size += len(name) + len(value) + 4 // ": " and CRLF
+		}
+	}
+
+	if hardening.MaxHeaderCount > 0 && count > hardening.MaxHeaderCount {
+		return errTooManyHeaders
+	}
+
+	if hardening.MaxHeaderSize > 0 && size > hardening.MaxHeaderSize {
+		return errHeadersTooLarge
+	}
+
+	return nil
+}
+
+// connectionHeaders returns the headers the client listed in Connection, these are hop-by-hop too
+func connectionHeaders(headers http.Header) []string {
+	listed := []string{}
+	for _, value := range headers["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				listed = append(listed, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return listed
+}
+
+func isStrippedHeader(name string, stripHeaders []string) bool {
+	for _, pattern := range stripHeaders {
+		if strings.HasSuffix(pattern, "*") {
+			prefix := strings.TrimSuffix(pattern, "*")
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+			continue
+		}
+
+		if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hardenRequestHeaders removes the headers named in Connection, any Host entries (the upstream host
+// is always taken from the request), extra X-Forwarded-Host values and the blocklisted headers.
+// connectionListed must be read before the Connection header itself is removed
+func hardenRequestHeaders(headers http.Header, connectionListed []string, hardening HeaderHardeningConfig) {
+	for _, name := range connectionListed {
+		headers.Del(name)
+	}
+
+	headers.Del("Host")
+
+	if forwardedHosts := headers["X-Forwarded-Host"]; len(forwardedHosts) > 1 {
+		headers.Set("X-Forwarded-Host", forwardedHosts[0])
+	}
+
+	for name := range headers {
+		if isStrippedHeader(name, hardening.StripHeaders) {
+			headers.Del(name)
+		}
+	}
+}
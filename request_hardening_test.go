@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckHeaderLimits(t *testing.T) {
+	hardening := HeaderHardeningConfig{Enabled: true, MaxHeaderCount: 3, MaxHeaderSize: 100}
+
+	headers := http.Header{}
+	headers.Add("Accept", "*/*")
+	headers.Add("X-Test", "a")
+	headers.Add("X-Test", "b")
+	if err := checkHeaderLimits(headers, hardening); err != nil {
+		t.Error("Headers within the limits should pass, got: ", err)
+	}
+
+	headers.Add("X-Test", "c")
+	if err := checkHeaderLimits(headers, hardening); err != errTooManyHeaders {
+		t.Error("Repeated header values should count towards the limit, got: ", err)
+	}
+
+	headers = http.Header{}
+	headers.Set("Cookie", strings.Repeat("a", 100))
+	if err := checkHeaderLimits(headers, hardening); err != errHeadersTooLarge {
+		t.Error("Large headers should be rejected, got: ", err)
+	}
+
+	if err := checkHeaderLimits(headers, HeaderHardeningConfig{Enabled: true}); err != nil {
+		t.Error("Unset limits shouldn't be enforced, got: ", err)
+	}
+}
+
+func TestHardenRequestHeaders(t *testing.T) {
+	hardening := HeaderHardeningConfig{Enabled: true, StripHeaders: []string{"X-Internal-*", "x-debug"}}
+
+	headers := http.Header{}
+	headers.Set("Connection", "close, X-Hop")
+	headers.Set("X-Hop", "1")
+	headers.Set("Host", "evil.example.com")
+	headers.Add("X-Forwarded-Host", "first.example.com")
+	headers.Add("X-Forwarded-Host", "second.example.com")
+	headers.Set("X-Internal-User", "admin")
+	headers.Set("X-Debug", "true")
+	headers.Set("X-Keep", "yes")
+
+	hardenRequestHeaders(headers, connectionHeaders(headers), hardening)
+
+	for _, name := range []string{"X-Hop", "Host", "X-Internal-User", "X-Debug"} {
+		if _, found := headers[name]; found {
+			t.Error(name, " should have been removed")
+		}
+	}
+
+	if forwardedHosts := headers["X-Forwarded-Host"]; len(forwardedHosts) != 1 || forwardedHosts[0] != "first.example.com" {
+		t.Error("X-Forwarded-Host should only keep the first value, got: ", forwardedHosts)
+	}
+
+	if headers.Get("X-Keep") != "yes" {
+		t.Error("Other headers should be kept")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses smaller than this aren't worth compressing, the headers would outweigh the savings
+const RESPONSE_COMPRESSION_DEFAULT_MIN_SIZE = 1024
+
+var responseCompressionDefaultTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// ResponseCompressionConfig compresses upstream responses with gzip or deflate for clients that
+// accept it, responses the upstream already encoded are left alone
+type ResponseCompressionConfig struct {
+	Enabled      bool     `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	MinSize      int      `mapstructure:"min_size" bson:"min_size" json:"min_size"`
+	ContentTypes []string `mapstructure:"content_types" bson:"content_types" json:"content_types"`
+	Level        int      `mapstructure:"level" bson:"level" json:"level"`
+}
+
+type ResponseCompressionModuleConfig struct {
+	ResponseCompression ResponseCompressionConfig `mapstructure:"response_compression" bson:"response_compression" json:"response_compression"`
+}
+
+func GetResponseCompressionConfig(spec *APISpec) ResponseCompressionConfig {
+	var thisModuleConfig ResponseCompressionModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode response compression configuration: ", err)
+	}
+
+	thisConfig := thisModuleConfig.ResponseCompression
+	if thisConfig.MinSize == 0 {
+		thisConfig.MinSize = RESPONSE_COMPRESSION_DEFAULT_MIN_SIZE
+	}
+	if len(thisConfig.ContentTypes) == 0 {
+		thisConfig.ContentTypes = responseCompressionDefaultTypes
+	}
+	if thisConfig.Level < gzip.BestSpeed || thisConfig.Level > gzip.BestCompression {
+		thisConfig.Level = gzip.DefaultCompression
+	}
+
+	return thisConfig
+}
+
+// ResponseCompressionHandler is added to the end of the response chain so that transforms and
+// hooks still see the plain body
+type ResponseCompressionHandler struct {
+	Spec   *APISpec
+	config ResponseCompressionConfig
+}
+
+func (h ResponseCompressionHandler) New(c interface{}, spec *APISpec) (TykResponseHandler, error) {
+	return ResponseCompressionHandler{Spec: spec, config: GetResponseCompressionConfig(spec)}, nil
+}
+
+// isCompressibleType checks the media type against the allowlist, entries like text/* match a
+// whole group
+func (h ResponseCompressionHandler) isCompressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, allowedType := range h.config.ContentTypes {
+		allowedType = strings.ToLower(allowedType)
+		if strings.HasSuffix(allowedType, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(allowedType, "*")) {
+				return true
+			}
+		} else if mediaType == allowedType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptedEncoding picks gzip over deflate from Accept-Encoding, encodings with q=0 are refused
+func acceptedEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		refused := false
+		for _, param := range fields[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					refused = true
+				}
+			}
+		}
+		accepted[encoding] = !refused
+	}
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if isAccepted, found := accepted[encoding]; found {
+			if isAccepted {
+				return encoding
+			}
+			continue
+		}
+		if accepted["*"] {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+func (h ResponseCompressionHandler) HandleResponse(rw http.ResponseWriter, res *http.Response, req *http.Request, ses *SessionState) error {
+	if req.Method == "HEAD" || res.StatusCode == 204 || res.StatusCode == 304 {
+		return nil
+	}
+	// Byte ranges are offsets into the uncompressed body
+	if res.StatusCode == http.StatusPartialContent || res.Header.Get("Content-Range") != "" {
+		return nil
+	}
+	if res.Header.Get("Content-Encoding") != "" || strings.Contains(res.Header.Get("Cache-Control"), "no-transform") {
+		return nil
+	}
+	if !h.isCompressibleType(res.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	// The response depends on Accept-Encoding even if this client didn't ask for compression
+	res.Header.Add("Vary", "Accept-Encoding")
+
+	encoding := acceptedEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil
+	}
+
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if len(body) < h.config.MinSize {
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	var compressor io.WriteCloser
+	if encoding == "gzip" {
+		compressor, _ = gzip.NewWriterLevel(&compressed, h.config.Level)
+	} else {
+		compressor, _ = zlib.NewWriterLevel(&compressed, h.config.Level)
+	}
+	compressor.Write(body)
+	compressor.Close()
+
+	res.Header.Set("Content-Encoding", encoding)
+	res.Header.Set("Content-Length", strconv.Itoa(compressed.Len()))
+	res.ContentLength = int64(compressed.Len())
+	res.Body = ioutil.NopCloser(&compressed)
+
+	// The compressed body is a different representation, so a strong validator no longer holds
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func createCompressionTestResponse(contentType string, body string) *http.Response {
+	res := &http.Response{StatusCode: 200, Header: make(http.Header)}
+	res.Header.Set("Content-Type", contentType)
+	res.Header.Set("ETag", `"v1"`)
+	res.Body = ioutil.NopCloser(strings.NewReader(body))
+	return res
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	for acceptEncoding, expected := range map[string]string{
+		"gzip, deflate":        "gzip",
+		"deflate":              "deflate",
+		"gzip;q=0, deflate":    "deflate",
+		"br, *":                "gzip",
+		"*, gzip; q=0":         "deflate",
+		"identity":             "",
+		"":                     "",
+		"GZIP;q=0.5, identity": "gzip",
+	} {
+		if encoding := acceptedEncoding(acceptEncoding); encoding != expected {
+			t.Error("Wrong encoding for ", acceptEncoding, ": ", encoding)
+		}
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	h := ResponseCompressionHandler{config: ResponseCompressionConfig{
+		Enabled:      true,
+		MinSize:      10,
+		ContentTypes: []string{"application/json", "text/*"},
+		Level:        gzip.DefaultCompression,
+	}}
+
+	body := `{"widgets": ["blue", "blue", "blue", "blue", "blue"]}`
+	req, _ := http.NewRequest("GET", "/widgets", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	res := createCompressionTestResponse("application/json; charset=utf-8", body)
+	h.HandleResponse(nil, res, req, nil)
+	if res.Header.Get("Content-Encoding") != "gzip" || res.Header.Get("ETag") != `W/"v1"` {
+		t.Fatal("Response wasn't compressed: ", res.Header)
+	}
+	if res.Header.Get("Vary") != "Accept-Encoding" {
+		t.Error("Vary header not set")
+	}
+
+	reader, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, _ := ioutil.ReadAll(reader)
+	if string(uncompressed) != body {
+		t.Error("Body changed: ", string(uncompressed))
+	}
+
+	// Small bodies, other content types, encoded responses and byte ranges are left alone
+	encodedRes := createCompressionTestResponse("text/html", body)
+	encodedRes.Header.Set("Content-Encoding", "br")
+	partialRes := createCompressionTestResponse("application/json", body)
+	partialRes.StatusCode = http.StatusPartialContent
+	rangeRes := createCompressionTestResponse("application/json", body)
+	rangeRes.Header.Set("Content-Range", "bytes 0-52/53")
+	for _, res := range []*http.Response{
+		createCompressionTestResponse("text/plain", "tiny"),
+		createCompressionTestResponse("image/png", body),
+		encodedRes,
+		partialRes,
+		rangeRes,
+	} {
+		encoding := res.Header.Get("Content-Encoding")
+		h.HandleResponse(nil, res, req, nil)
+		if res.Header.Get("Content-Encoding") != encoding {
+			t.Error("Response shouldn't be compressed: ", res.Header)
+		}
+	}
+
+	req.Header.Del("Accept-Encoding")
+	res = createCompressionTestResponse("text/plain", body)
+	h.HandleResponse(nil, res, req, nil)
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Vary") != "Accept-Encoding" {
+		t.Error("Clients that don't accept compression should get the plain body: ", res.Header)
+	}
+}
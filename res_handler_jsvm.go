@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// MiniResponseObject is marshalled to JSON string and passed into JSVM response middleware
+type MiniResponseObject struct {
+	Status        int
+	Headers       map[string][]string
+	SetHeaders    map[string]string
+	DeleteHeaders []string
+	Body          string
+}
+
+type VMResponseReturnObject struct {
+	Response MiniResponseObject
+}
+
+// JSVMResponseHook runs a JSVM middleware from the response hook of custom_middleware on the
+// upstream response
+type JSVMResponseHook struct {
+	Spec                *APISpec
+	MiddlewareClassName string
+}
+
+// New takes the middleware class name as its configuration
+func (h JSVMResponseHook) New(c interface{}, spec *APISpec) (TykResponseHandler, error) {
+	className, ok := c.(string)
+	if !ok || className == "" {
+		return nil, errors.New("JSVM response middleware needs a class name")
+	}
+
+	return JSVMResponseHook{Spec: spec, MiddlewareClassName: className}, nil
+}
+
+func (h JSVMResponseHook) HandleResponse(rw http.ResponseWriter, res *http.Response, req *http.Request, ses *SessionState) error {
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		log.Error("Failed to read response body for JSVM middleware: ", err)
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	thisResponseData := MiniResponseObject{
+		Status:        res.StatusCode,
+		Headers:       res.Header,
+		SetHeaders:    make(map[string]string),
+		DeleteHeaders: make([]string, 0),
+		Body:          string(body),
+	}
+
+	asJsonResponseObj, encErr := json.Marshal(thisResponseData)
+	if encErr != nil {
+		log.Error("Failed to encode response object for JSVM middleware: ", encErr)
+		return nil
+	}
+
+	thisSessionState := SessionState{}
+	if ses != nil {
+		thisSessionState = *ses
+	}
+	sessionAsJsonObj, sessEncErr := json.Marshal(thisSessionState)
+	if sessEncErr != nil {
+		log.Error("Failed to encode session for VM: ", sessEncErr)
+		return nil
+	}
+
+	thisSpecData := h.Spec.JSVM.SpecData
+	thisSpecData.Version = h.Spec.getVersionFromRequest(req)
+	specAsJsonObj, specEncErr := json.Marshal(thisSpecData)
+	if specEncErr != nil {
+		log.Error("Failed to encode spec data for VM: ", specEncErr)
+		return nil
+	}
+
+	returnRaw, _ := h.Spec.JSVM.VM.Run(h.MiddlewareClassName + `.DoProcessResponse(` + string(asJsonResponseObj) + `, ` + string(sessionAsJsonObj) + `, ` + string(specAsJsonObj) + `);`)
+	returnDataStr, _ := returnRaw.ToString()
+
+	newResponseData := VMResponseReturnObject{}
+	decErr := json.Unmarshal([]byte(returnDataStr), &newResponseData)
+	if decErr != nil {
+		log.Error("Failed to decode middleware response data on return from VM: ", decErr)
+		log.Debug(returnDataStr)
+		return nil
+	}
+
+	if newResponseData.Response.Status > 0 {
+		res.StatusCode = newResponseData.Response.Status
+		res.Status = strconv.Itoa(res.StatusCode) + " " + http.StatusText(res.StatusCode)
+	}
+
+	for _, dh := range newResponseData.Response.DeleteHeaders {
+		res.Header.Del(dh)
+	}
+
+	for h, v := range newResponseData.Response.SetHeaders {
+		res.Header.Set(h, v)
+	}
+
+	res.ContentLength = int64(len(newResponseData.Response.Body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(newResponseData.Response.Body)))
+	res.Body = ioutil.NopCloser(bytes.NewBufferString(newResponseData.Response.Body))
+
+	return nil
+}
@@ -33,7 +33,13 @@ func (r ResponseChain) Go(chain *[]TykResponseHandler, rw http.ResponseWriter, r
 		return nil
 	}
 
+	// Event streams never end, so processors that read the whole body can't run on them
+	streaming := isStreamingRequest(req) || isEventStream(res)
 	for _, rh := range *chain {
+		if streaming && responseSkipsWhenStreaming(rh) {
+			continue
+		}
+
 		mwErr := rh.HandleResponse(rw, res, req, ses)
 		if mwErr != nil {
 			return mwErr
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Revocations that take longer than this to reach a node are logged as warnings
+const REVOCATION_SLOW_PROPAGATION = time.Second
+
+// TokenRevokedNotice is the payload of a TokenRevoked notification, it never carries the token itself.
+// KeyHash is the public hash of the token (see publicHash) and Namespace the namespace of the store it
+// was removed from (see KeyNamespaceStorage), an empty namespace covers every store. RevocationHash is
+// set if the token was added to the revocation list rather than deleted. SentAt (in nanoseconds) is
+// used to measure how long the notice took to reach the other nodes
+type TokenRevokedNotice struct {
+	KeyHash        string `json:"key_hash"`
+	Namespace      string `json:"namespace"`
+	RevocationHash string `json:"revocation_hash,omitempty"`
+	Origin         string `json:"origin"`
+	SentAt         int64  `json:"sent_at"`
+}
+
+// RevocationLatency tracks how long revocations from other nodes took to arrive
+type RevocationLatency struct {
+	sync.Mutex
+	Count int64
+	Last  time.Duration
+	Max   time.Duration
+	total time.Duration
+}
+
+// RevocationPropagation holds the latency of the revocations received by this node
+var RevocationPropagation = &RevocationLatency{}
+
+// Record adds the latency of a received revocation
+func (l *RevocationLatency) Record(latency time.Duration) {
+	l.Lock()
+	l.Count++
+	l.Last = latency
+	l.total += latency
+	if latency > l.Max {
+		l.Max = latency
+	}
+	l.Unlock()
+}
+
+// Average is the mean latency of the revocations received so far
+func (l *RevocationLatency) Average() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.Count == 0 {
+		return 0
+	}
+
+	return l.total / time.Duration(l.Count)
+}
+
+// revokeCachedToken drops a token from every cache of this node: the session cache (which also holds
+// OAuth access tokens), the RPC cache and the revocation list filter
+func revokeCachedToken(notice TokenRevokedNotice) {
+	if LocalSessionCache != nil {
+		LocalSessionCache.Invalidate(notice.Namespace, notice.KeyHash)
+	}
+
+	invalidateRPCCache(notice.Namespace, notice.KeyHash)
+
+	if notice.RevocationHash != "" && TokenRevocations != nil {
+		TokenRevocations.addToFilter(notice.RevocationHash)
+	}
+}
+
+// broadcastTokenRevoked revokes a token on this node straight away and tells the other nodes to drop
+// their cached copies, unlike key space notifications it is sent even if the session cache is disabled.
+// keyHash is the public hash of the token, revocationHash is only set for revoked tokens (see
+// tokenRevocationHash)
+func broadcastTokenRevoked(namespace string, keyHash string, revocationHash string) {
+	notice := TokenRevokedNotice{
+		KeyHash:        keyHash,
+		Namespace:      namespace,
+		RevocationHash: revocationHash,
+		Origin:         healthCheckNodeID(),
+		SentAt:         time.Now().UnixNano(),
+	}
+	revokeCachedToken(notice)
+
+	if MainNotifier.store == nil {
+		return
+	}
+
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		log.Error("Couldn't encode token revocation: ", err)
+		return
+	}
+
+	MainNotifier.Notify(Notification{
+		Command: NoticeTokenRevoked,
+		Payload: string(payload),
+	})
+}
+
+// handleTokenRevoked applies a revocation sent by another node
+func handleTokenRevoked(payload string) {
+	var notice TokenRevokedNotice
+	if err := json.Unmarshal([]byte(payload), &notice); err != nil {
+		log.Error("Token revocation is malformed: ", err)
+		return
+	}
+
+	// Our own revocations were applied when they were sent
+	if notice.Origin == healthCheckNodeID() {
+		return
+	}
+
+	revokeCachedToken(notice)
+
+	if notice.SentAt > 0 {
+		latency := time.Duration(time.Now().UnixNano() - notice.SentAt)
+		RevocationPropagation.Record(latency)
+		if latency > REVOCATION_SLOW_PROPAGATION {
+			log.Warning("Token revocation took ", latency, " to reach this node")
+		} else {
+			log.Debug("Token revocation received after ", latency)
+		}
+	}
+}
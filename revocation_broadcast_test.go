@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/pmylund/go-cache"
+	"testing"
+	"time"
+)
+
+func sendTestRevocation(notice TokenRevokedNotice) time.Duration {
+	payload, _ := json.Marshal(notice)
+	message, _ := json.Marshal(Notification{Command: NoticeTokenRevoked, Payload: string(payload)})
+
+	start := time.Now()
+	HandleRedisReloadMsg(redis.Message{Channel: RedisPubSubChannel, Data: message})
+	return time.Since(start)
+}
+
+func TestTokenRevocationPropagation(t *testing.T) {
+	LocalSessionCache = NewSessionCache(60, 10)
+	defer func() { LocalSessionCache = nil }()
+
+	revocationStore := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	TokenRevocations = NewTokenRevocationList(revocationStore, 100)
+	defer func() { TokenRevocations = nil }()
+
+	RevocationPropagation = &RevocationLatency{}
+
+	LocalSessionCache.Set("apikey-", publicHash("revoked-key"), "{}")
+	LocalSessionCache.Set("apikey-", publicHash("other-key"), "{}")
+	rpcKeyCache.Set("apikey-"+publicHash("revoked-key"), "{}", cache.DefaultExpiration)
+
+	// The origin node has written the list entry, our filter hasn't been refreshed yet
+	revocationStore.SetKey(tokenRevocationHash("revoked-key"), "1", 0)
+	if IsTokenRevoked("revoked-key") {
+		t.Fatal("Token shouldn't be in the filter before the notice arrives")
+	}
+
+	sentAt := time.Now().Add(-20 * time.Millisecond)
+	handled := sendTestRevocation(TokenRevokedNotice{KeyHash: publicHash("revoked-key"), RevocationHash: tokenRevocationHash("revoked-key"), Origin: "other-node", SentAt: sentAt.UnixNano()})
+
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("revoked-key")); found {
+		t.Error("Revoked key should be dropped from the session cache")
+	}
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("other-key")); !found {
+		t.Error("Other keys should stay cached")
+	}
+	if _, found := rpcKeyCache.Get("apikey-" + publicHash("revoked-key")); found {
+		t.Error("Revoked key should be dropped from the RPC cache")
+	}
+	if !IsTokenRevoked("revoked-key") {
+		t.Error("Revoked token should be added to the filter straight away")
+	}
+
+	if handled > 100*time.Millisecond {
+		t.Error("Handling a revocation took too long: ", handled)
+	}
+	if RevocationPropagation.Count != 1 {
+		t.Fatal("Latency of the revocation wasn't recorded")
+	}
+	if RevocationPropagation.Last < 20*time.Millisecond || RevocationPropagation.Last > time.Since(sentAt) {
+		t.Error("Latency should be measured from the time the notice was sent: ", RevocationPropagation.Last)
+	}
+}
+
+func TestTokenRevocationNamespacesAndOwnNotices(t *testing.T) {
+	LocalSessionCache = NewSessionCache(60, 10)
+	defer func() { LocalSessionCache = nil }()
+
+	RevocationPropagation = &RevocationLatency{}
+
+	// Notices sent by this node were applied when they were sent
+	LocalSessionCache.Set("apikey-", publicHash("own-key"), "{}")
+	sendTestRevocation(TokenRevokedNotice{KeyHash: publicHash("own-key"), Origin: healthCheckNodeID(), SentAt: time.Now().UnixNano()})
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("own-key")); !found || RevocationPropagation.Count != 0 {
+		t.Error("Own notices should be ignored")
+	}
+
+	// Only the namespace the key was deleted from is dropped
+	LocalSessionCache.Set("tenant-a.apikey-", publicHash("own-key"), "{}")
+	sendTestRevocation(TokenRevokedNotice{KeyHash: publicHash("own-key"), Namespace: "tenant-a.apikey-", Origin: "other-node", SentAt: time.Now().UnixNano()})
+	if _, found := LocalSessionCache.Get("tenant-a.apikey-", publicHash("own-key")); found {
+		t.Error("Key should be dropped from its namespace")
+	}
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("own-key")); !found {
+		t.Error("Other namespaces should stay cached")
+	}
+
+	sendTestRevocation(TokenRevokedNotice{KeyHash: publicHash("own-key"), Origin: "other-node", SentAt: time.Now().UnixNano()})
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("own-key")); found {
+		t.Error("Notices without a namespace should drop the key from every namespace")
+	}
+}
+
+func TestBroadcastTokenRevokedWithoutSessionCache(t *testing.T) {
+	oldHashKeys := config.HashKeys
+	config.HashKeys = true
+	defer func() { config.HashKeys = oldHashKeys }()
+
+	accessKey := OAUTH_PREFIX + "test-api." + ACCESS_PREFIX + "deleted-key"
+	rpcKeyCache.Set("apikey-"+publicHash("deleted-key"), "{}", cache.DefaultExpiration)
+	rpcKeyCache.Set(accessKey, "{}", cache.DefaultExpiration)
+	rpcKeyCache.Set("apikey-"+publicHash("other-key"), "{}", cache.DefaultExpiration)
+
+	broadcastTokenRevoked("apikey-", publicHash("deleted-key"), "")
+	if _, found := rpcKeyCache.Get("apikey-" + publicHash("deleted-key")); found {
+		t.Error("Deleted key should be dropped from the RPC cache of this node")
+	}
+	if _, found := rpcKeyCache.Get(accessKey); found {
+		t.Error("Cached OAuth access data of the token should be dropped by its hash")
+	}
+	if _, found := rpcKeyCache.Get("apikey-" + publicHash("other-key")); !found {
+		t.Error("Other keys should stay cached")
+	}
+}
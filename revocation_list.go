@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+const REVOCATION_KEY_PREFIX string = "revoked-token."
+
+// BloomFilter is a fixed size bloom filter, it can return false positives but never false negatives
+type BloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes uint64
+}
+
+// NewBloomFilter sizes a filter for the expected number of items at the given false positive rate
+func NewBloomFilter(expected int, fpRate float64) *BloomFilter {
+	if expected < 1 {
+		expected = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+
+	size := uint64(math.Ceil(-float64(expected) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	hashes := uint64(math.Ceil(math.Ln2 * float64(size) / float64(expected)))
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	return &BloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+// locations uses double hashing to generate the bit positions for an item
+func (b *BloomFilter) locations(item string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	h1 := h.Sum64()
+	h2 := (h1 >> 33) | (h1 << 31) | 1
+
+	locations := make([]uint64, b.hashes)
+	for i := uint64(0); i < b.hashes; i++ {
+		locations[i] = (h1 + i*h2) % b.size
+	}
+
+	return locations
+}
+
+// Add adds an item to the filter
+func (b *BloomFilter) Add(item string) {
+	for _, loc := range b.locations(item) {
+		b.bits[loc/64] |= 1 << (loc % 64)
+	}
+}
+
+// MayContain returns false if the item is definitely not in the filter
+func (b *BloomFilter) MayContain(item string) bool {
+	for _, loc := range b.locations(item) {
+		if b.bits[loc/64]&(1<<(loc%64)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TokenRevocationList holds revoked tokens in Redis, the bloom filter is refreshed from Redis
+// periodically so that the common (not revoked) case never needs a round trip
+type TokenRevocationList struct {
+	sync.RWMutex
+	Store    StorageHandler
+	filter   *BloomFilter
+	expected int
+}
+
+// TokenRevocations is only set if token revocation is enabled
+var TokenRevocations *TokenRevocationList
+
+func NewTokenRevocationList(store StorageHandler, expected int) *TokenRevocationList {
+	if expected < 1 {
+		expected = 10000
+	}
+
+	return &TokenRevocationList{
+		Store:    store,
+		filter:   NewBloomFilter(expected, 0.001),
+		expected: expected,
+	}
+}
+
+// tokenRevocationHash is used as the storage key so raw tokens are never written to Redis
+func tokenRevocationHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// Revoke stores the revoked token, ttl is in seconds, 0 never expires
+func (t *TokenRevocationList) Revoke(token string, ttl int64) error {
+	tokenHash := tokenRevocationHash(token)
+	if err := t.Store.SetKey(tokenHash, "1", ttl); err != nil {
+		return err
+	}
+
+	t.Lock()
+	t.filter.Add(tokenHash)
+	t.Unlock()
+
+	return nil
+}
+
+// addToFilter marks a token revoked on another node without waiting for the next refresh, it takes
+// the hash of the token (see tokenRevocationHash)
+func (t *TokenRevocationList) addToFilter(tokenHash string) {
+	t.Lock()
+	t.filter.Add(tokenHash)
+	t.Unlock()
+}
+
+// Unrevoke removes a token from the list, it will be dropped from the filter on the next refresh
+func (t *TokenRevocationList) Unrevoke(token string) bool {
+	return t.Store.DeleteKey(tokenRevocationHash(token))
+}
+
+// IsRevoked checks the filter first and only confirms possible matches against Redis
+func (t *TokenRevocationList) IsRevoked(token string) bool {
+	tokenHash := tokenRevocationHash(token)
+
+	t.RLock()
+	mayContain := t.filter.MayContain(tokenHash)
+	t.RUnlock()
+
+	if !mayContain {
+		return false
+	}
+
+	_, err := t.Store.GetKey(tokenHash)
+	return err == nil
+}
+
+// Refresh rebuilds the filter from the revoked tokens in Redis
+func (t *TokenRevocationList) Refresh() {
+	tokenHashes := t.Store.GetKeys("")
+
+	expected := t.expected
+	if len(tokenHashes) > expected {
+		// Grow the filter rather than let the false positive rate climb
+		expected = len(tokenHashes) * 2
+	}
+
+	newFilter := NewBloomFilter(expected, 0.001)
+	for _, tokenHash := range tokenHashes {
+		newFilter.Add(tokenHash)
+	}
+
+	t.Lock()
+	t.filter = newFilter
+	t.expected = expected
+	t.Unlock()
+
+	log.Debug("Token revocation list refreshed, revoked tokens: ", len(tokenHashes))
+}
+
+// StartRefreshLoop refreshes the filter every interval seconds
+func (t *TokenRevocationList) StartRefreshLoop(interval int) {
+	if interval < 1 {
+		interval = 10
+	}
+
+	for {
+		t.Refresh()
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// IsTokenRevoked is safe to call if revocation is disabled
+func IsTokenRevoked(token string) bool {
+	if TokenRevocations == nil {
+		return false
+	}
+
+	return TokenRevocations.IsRevoked(token)
+}
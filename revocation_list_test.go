@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	thisFilter := NewBloomFilter(1000, 0.001)
+	for i := 0; i < 1000; i++ {
+		thisFilter.Add(fmt.Sprintf("token-%v", i))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !thisFilter.MayContain(fmt.Sprintf("token-%v", i)) {
+			t.Fatal("Bloom filter returned a false negative for token-", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if thisFilter.MayContain(fmt.Sprintf("other-%v", i)) {
+			falsePositives++
+		}
+	}
+
+	if falsePositives > 100 {
+		t.Error("False positive rate is too high: ", falsePositives, " in 10000")
+	}
+}
+
+func TestTokenRevocationList(t *testing.T) {
+	thisList := NewTokenRevocationList(&InMemoryStorageManager{map[string]string{}}, 100)
+
+	if thisList.IsRevoked("abc123") {
+		t.Error("Token should not be revoked")
+	}
+
+	thisList.Revoke("abc123", 0)
+	if !thisList.IsRevoked("abc123") {
+		t.Error("Token should be revoked")
+	}
+
+	thisList.Unrevoke("abc123")
+	if thisList.IsRevoked("abc123") {
+		t.Error("Token should no longer be revoked")
+	}
+}
@@ -2,11 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/lonelycode/gorpc"
 	"gopkg.in/vmihailenco/msgpack.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
+// Spooled analytics are dropped (oldest first) beyond this many files unless analytics_spool_max_files is set
+const RPC_ANALYTICS_SPOOL_MAX_FILES = 1000
+
+var ErrRPCUnavailable = errors.New("RPC master unavailable")
+
 // MongoPurger will purge analytics data into a Mongo database, requires that the Mongo DB string is specified
 // in the Config object
 type RPCPurger struct {
@@ -14,19 +26,39 @@ type RPCPurger struct {
 	RPCClient *gorpc.Client
 	Client    *gorpc.DispatcherClient
 	Address   string
+	SpoolDir  string
 }
 
 // Connect Connects to Mongo
 func (r *RPCPurger) Connect() {
 	log.Info("Connecting to RPC Analytics service")
 	r.RPCClient = gorpc.NewTCPClient(r.Address)
+	configureRPCCompression(r.RPCClient, nil)
 	r.RPCClient.Start()
 	d := GetDispatcher()
 	r.Client = d.NewFuncClient(r.RPCClient)
+	r.Login()
+
+	if r.SpoolDir != "" {
+		if err := os.MkdirAll(r.SpoolDir, 0700); err != nil {
+			log.Error("Couldn't create analytics spool directory: ", err)
+		}
+	}
 
 	return
 }
 
+// Login authenticates the purger with the master, failures are retried on the next purge
+func (r *RPCPurger) Login() bool {
+	ok, err := r.Client.Call("Login", config.SlaveOptions.APIKey)
+	if err != nil || !ok.(bool) {
+		log.Warning("RPC analytics login failed: ", err)
+		return false
+	}
+
+	return true
+}
+
 // StartPurgeLoop starts the loop that will be started as a goroutine and pull data out of the in-memory
 // store and into MongoDB
 func (r RPCPurger) StartPurgeLoop(nextCount int) {
@@ -35,12 +67,16 @@ func (r RPCPurger) StartPurgeLoop(nextCount int) {
 	r.StartPurgeLoop(nextCount)
 }
 
-// PurgeCache will pull the data from the in-memory store and drop it into the specified MongoDB collection
+// PurgeCache will pull the data from the in-memory store and send it to the master, records that
+// can't be sent are spooled to disk and sent with a later purge
 func (r *RPCPurger) PurgeCache() {
 	//var AnalyticsValues []interface{}
 
 	AnalyticsValues := r.Store.GetAndDeleteSet(ANALYTICS_KEYNAME)
 
+	// Catch up on anything that couldn't be sent before
+	r.sendSpooled()
+
 	if len(AnalyticsValues) > 0 {
 		keys := make([]AnalyticsRecord, len(AnalyticsValues), len(AnalyticsValues))
 
@@ -56,14 +92,171 @@ func (r *RPCPurger) PurgeCache() {
 			}
 		}
 
-		data, dErr := json.Marshal(keys)
-		if dErr != nil {
-			log.Error("Failed to marshal analytics data")
-			return
+		// Large purges are split into chunks that go in a single batch
+		chunks := []string{}
+		for start := 0; start < len(keys); start += RPC_ANALYTICS_CHUNK_SIZE {
+			end := start + RPC_ANALYTICS_CHUNK_SIZE
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			data, dErr := json.Marshal(keys[start:end])
+			if dErr != nil {
+				log.Error("Failed to marshal analytics data")
+				return
+			}
+			chunks = append(chunks, string(data))
+		}
+
+		if failed, err := r.sendChunks(chunks); err != nil {
+			log.Error("Failed to send ", len(failed), " of ", len(chunks), " analytics chunk(s): ", err)
+			failedChunks := []string{}
+			for _, i := range failed {
+				failedChunks = append(failedChunks, chunks[i])
+			}
+			r.spool(failedChunks)
+		}
+	}
+
+}
+
+// sendChunks sends analytics chunks to the master in one batch, the indexes of the chunks that
+// weren't accepted are returned with the first error
+func (r *RPCPurger) sendChunks(chunks []string) ([]int, error) {
+	all := make([]int, len(chunks))
+	for i := range chunks {
+		all[i] = i
+	}
+
+	if IsRPCEmergencyMode() {
+		return all, ErrRPCUnavailable
+	}
+
+	batch := r.Client.NewBatch()
+	results := make([]*gorpc.BatchResult, len(chunks))
+	for i, chunk := range chunks {
+		results[i] = batch.Add("PurgeAnalyticsData", chunk)
+	}
+
+	failed := []int{}
+	err := batch.Call()
+	if err != nil {
+		failed = all
+	} else {
+		for i, result := range results {
+			if result.Error != nil {
+				if err == nil {
+					err = result.Error
+				}
+				failed = append(failed, i)
+			}
+		}
+	}
+
+	if err != nil && err.Error() == ErrorDenied.Error() {
+		r.Login()
+	}
+
+	return failed, err
+}
+
+// spool writes chunks that couldn't be sent to the spool directory, if no directory is set they are lost
+func (r *RPCPurger) spool(chunks []string) {
+	if r.SpoolDir == "" {
+		log.Warning("No analytics spool directory set, dropped ", len(chunks), " analytics chunk(s)")
+		return
+	}
+
+	now := time.Now().UnixNano()
+	for i, chunk := range chunks {
+		fileName := filepath.Join(r.SpoolDir, fmt.Sprintf("analytics-%020d-%04d.json", now, i))
+		if err := ioutil.WriteFile(fileName, []byte(chunk), 0600); err != nil {
+			log.Error("Failed to spool analytics data: ", err)
+		}
+	}
+
+	r.trimSpool()
+}
+
+// spooledFiles lists the spool files, oldest first
+func (r *RPCPurger) spooledFiles() []string {
+	files, err := ioutil.ReadDir(r.SpoolDir)
+	if err != nil {
+		return []string{}
+	}
+
+	fileNames := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), "analytics-") {
+			fileNames = append(fileNames, filepath.Join(r.SpoolDir, file.Name()))
 		}
+	}
+	sort.Strings(fileNames)
 
-		// Send keys to RPC
-		r.Client.Call("PurgeAnalyticsData", string(data))
+	return fileNames
+}
+
+// trimSpool drops the oldest files so a long outage can't fill the disk
+func (r *RPCPurger) trimSpool() {
+	maxFiles := config.SlaveOptions.AnalyticsSpoolMaxFiles
+	if maxFiles < 1 {
+		maxFiles = RPC_ANALYTICS_SPOOL_MAX_FILES
 	}
 
+	fileNames := r.spooledFiles()
+	if len(fileNames) <= maxFiles {
+		return
+	}
+
+	log.Warning("Analytics spool is full, dropping ", len(fileNames)-maxFiles, " oldest chunk(s)")
+	for _, fileName := range fileNames[:len(fileNames)-maxFiles] {
+		os.Remove(fileName)
+	}
+}
+
+// sendSpooled sends spooled chunks, oldest first, and removes them once they are accepted
+func (r *RPCPurger) sendSpooled() {
+	if r.SpoolDir == "" {
+		return
+	}
+
+	fileNames := r.spooledFiles()
+	for start := 0; start < len(fileNames); start += 10 {
+		end := start + 10
+		if end > len(fileNames) {
+			end = len(fileNames)
+		}
+
+		chunks := []string{}
+		sent := []string{}
+		for _, fileName := range fileNames[start:end] {
+			data, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				log.Error("Failed to read spooled analytics: ", err)
+				continue
+			}
+			chunks = append(chunks, string(data))
+			sent = append(sent, fileName)
+		}
+
+		failed, err := r.sendChunks(chunks)
+		kept := make(map[int]bool)
+		for _, i := range failed {
+			kept[i] = true
+		}
+
+		for i, fileName := range sent {
+			if !kept[i] {
+				os.Remove(fileName)
+			}
+		}
+		if len(sent) > len(failed) {
+			log.Info("Sent ", len(sent)-len(failed), " spooled analytics chunk(s)")
+		}
+
+		if err != nil {
+			log.Debug("Master still unavailable, keeping ", len(failed), " spooled analytics chunk(s): ", err)
+			return
+		}
+	}
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRPCPurgerSpool(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "tyk-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	config.SlaveOptions.AnalyticsSpoolMaxFiles = 3
+	defer func() { config.SlaveOptions.AnalyticsSpoolMaxFiles = 0 }()
+
+	thisPurger := RPCPurger{SpoolDir: spoolDir}
+	thisPurger.spool([]string{"[1]", "[2]"})
+	thisPurger.spool([]string{"[3]", "[4]"})
+
+	fileNames := thisPurger.spooledFiles()
+	if len(fileNames) != 3 {
+		t.Fatal("Expected the spool to be trimmed to 3 files, got: ", len(fileNames))
+	}
+
+	oldest, _ := ioutil.ReadFile(fileNames[0])
+	if string(oldest) != "[2]" {
+		t.Error("Oldest chunk should have been dropped, first file is: ", string(oldest))
+	}
+}
+
+func TestRPCPurgerKeepsOnlyFailedChunks(t *testing.T) {
+	spoolDir, err := ioutil.TempDir("", "tyk-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(spoolDir)
+
+	received := []string{}
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"PurgeAnalyticsData": func(data string) error {
+			if data == "[2]" {
+				return errors.New("Chunk rejected")
+			}
+			received = append(received, data)
+			return nil
+		},
+	})
+	defer stop()
+
+	thisPurger := RPCPurger{Client: store.Client, SpoolDir: spoolDir}
+	failed, err := thisPurger.sendChunks([]string{"[1]", "[2]", "[3]"})
+	if err == nil {
+		t.Error("Rejected chunk should return an error")
+	}
+	if len(failed) != 1 || failed[0] != 1 {
+		t.Error("Only the rejected chunk should have failed, got: ", failed)
+	}
+
+	// Spooled chunks that were accepted are removed, the rejected one is kept for the next purge
+	received = []string{}
+	thisPurger.spool([]string{"[1]", "[2]", "[3]"})
+	thisPurger.sendSpooled()
+
+	if len(received) != 2 {
+		t.Error("Expected the accepted chunks to be sent once, got: ", received)
+	}
+
+	fileNames := thisPurger.spooledFiles()
+	if len(fileNames) != 1 {
+		t.Fatal("Expected only the rejected chunk to stay spooled, got: ", len(fileNames))
+	}
+	if kept, _ := ioutil.ReadFile(fileNames[0]); string(kept) != "[2]" {
+		t.Error("Wrong chunk kept: ", string(kept))
+	}
+}
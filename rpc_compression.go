@@ -0,0 +1,151 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/golang/snappy"
+	"github.com/lonelycode/gorpc"
+	"io"
+	"sync"
+)
+
+// RPC compression modes, set with rpc_compression in slave_options. The default is gorpc's own
+// flate compression, gzip and snappy must also be enabled on the master
+const (
+	RPCCompressionDefault = ""
+	RPCCompressionNone    = "none"
+	RPCCompressionGzip    = "gzip"
+	RPCCompressionSnappy  = "snappy"
+)
+
+// Analytics records are sent to the master in chunks of this size, all chunks of a purge go in one batch
+const RPC_ANALYTICS_CHUNK_SIZE = 1000
+
+// flushWriter is implemented by the compressing writers, each write is flushed so that gorpc's
+// own buffering decides when data goes out
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// compressedConn compresses a connection to the master, the reader is created on the first read
+// because a gzip reader blocks until the stream header arrives
+type compressedConn struct {
+	io.ReadWriteCloser
+	mode       string
+	writer     flushWriter
+	reader     io.Reader
+	readerLock sync.Mutex
+}
+
+func newCompressedConn(rwc io.ReadWriteCloser, mode string) *compressedConn {
+	c := &compressedConn{ReadWriteCloser: rwc, mode: mode}
+	if mode == RPCCompressionSnappy {
+		c.writer = snappy.NewBufferedWriter(rwc)
+	} else {
+		c.writer = gzip.NewWriter(rwc)
+	}
+
+	return c
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	c.readerLock.Lock()
+	if c.reader == nil {
+		if c.mode == RPCCompressionSnappy {
+			c.reader = snappy.NewReader(c.ReadWriteCloser)
+		} else {
+			gzipReader, err := gzip.NewReader(c.ReadWriteCloser)
+			if err != nil {
+				c.readerLock.Unlock()
+				return 0, err
+			}
+			c.reader = gzipReader
+		}
+	}
+	c.readerLock.Unlock()
+
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.writer.Flush()
+}
+
+// IsValidRPCCompression checks the rpc_compression setting
+func IsValidRPCCompression(mode string) bool {
+	switch mode {
+	case RPCCompressionDefault, RPCCompressionNone, RPCCompressionGzip, RPCCompressionSnappy:
+		return true
+	}
+
+	return false
+}
+
+// configureRPCCompression applies the compression setting to a client, onConnect is wrapped so any
+// existing connect handler still runs
+func configureRPCCompression(client *gorpc.Client, onConnect gorpc.OnConnectFunc) {
+	mode := config.SlaveOptions.RPCCompression
+	client.OnConnect = onConnect
+
+	switch mode {
+	case RPCCompressionDefault:
+		return
+	case RPCCompressionNone:
+		client.DisableCompression = true
+		return
+	}
+
+	// Don't compress twice
+	client.DisableCompression = true
+	client.OnConnect = func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+		if onConnect != nil {
+			var err error
+			if rwc, err = onConnect(remoteAddr, rwc); err != nil {
+				return rwc, err
+			}
+		}
+
+		return newCompressedConn(rwc, mode), nil
+	}
+}
+
+// GetMultiKey fetches several keys in a single batch, missing keys are returned as empty strings
+func (r *RPCStorageHandler) GetMultiKey(keyNames []string) ([]string, error) {
+	values := make([]string, len(keyNames))
+	if IsRPCEmergencyMode() {
+		for i, keyName := range keyNames {
+			values[i], _ = getRPCBackupKey(r.fixKey(keyName))
+		}
+		return values, nil
+	}
+
+	batch := r.Client.NewBatch()
+	results := make([]*gorpc.BatchResult, len(keyNames))
+	for i, keyName := range keyNames {
+		results[i] = batch.Add("GetKey", r.fixKey(keyName))
+	}
+
+	if err := batch.Call(); err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.GetMultiKey(keyNames)
+		}
+
+		log.Error("Batched key fetch failed: ", err)
+		return nil, err
+	}
+
+	for i, result := range results {
+		if result.Error != nil || result.Response == nil {
+			continue
+		}
+		values[i] = result.Response.(string)
+		setRPCBackupKey(r.fixKey(keyNames[i]), values[i])
+	}
+
+	return values, nil
+}
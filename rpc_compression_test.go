@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// bufferConn loops written data back to the reader
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (b *bufferConn) Close() error {
+	return nil
+}
+
+func TestCompressedConnRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("analytics-record "), 500)
+
+	for _, mode := range []string{RPCCompressionGzip, RPCCompressionSnappy} {
+		rwc := &bufferConn{}
+		conn := newCompressedConn(rwc, mode)
+
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatal(mode, " write failed: ", err)
+		}
+
+		if rwc.Len() >= len(payload) {
+			t.Error(mode, " data was not compressed")
+		}
+
+		received, err := ioutil.ReadAll(io.LimitReader(conn, int64(len(payload))))
+		if err != nil {
+			t.Fatal(mode, " read failed: ", err)
+		}
+
+		if !bytes.Equal(received, payload) {
+			t.Error(mode, " payload was changed")
+		}
+	}
+}
+
+func TestIsValidRPCCompression(t *testing.T) {
+	for _, mode := range []string{"", "none", "gzip", "snappy"} {
+		if !IsValidRPCCompression(mode) {
+			t.Error("Mode should be valid: ", mode)
+		}
+	}
+
+	if IsValidRPCCompression("lz4") {
+		t.Error("Unknown mode should not be valid")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"github.com/lonelycode/gorpc"
+	"sync"
+	"time"
+)
+
+const (
+	RPC_DEFAULT_MAX_RETRIES = 5
+	RPC_DEFAULT_BACKOFF_MAX = 30
+)
+
+// RPCLinkState tracks the health of the link to the master, it is shared by all RPC storage handlers.
+// After too many failed logins (or calls) in a row the node enters emergency mode: keys are served
+// from the last copies received, writes are dropped, rate limits and quotas are not enforced and
+// reloads use the last API definitions and policies received. A background loop keeps trying to log
+// in, with a backoff, and reloads the node when the master is back
+type RPCLinkState struct {
+	sync.RWMutex
+	emergency      bool
+	failures       int
+	apiDefinitions string
+	policies       string
+}
+
+var RPCLink = &RPCLinkState{}
+
+// rpcKeyBackup holds the last copy of each key fetched from the master, it never expires entries
+var rpcKeyBackup = newLRUCache(LRU_DEFAULT_SIZE)
+
+// IsRPCEmergencyMode is true while the master can't be reached
+func IsRPCEmergencyMode() bool {
+	RPCLink.RLock()
+	defer RPCLink.RUnlock()
+
+	return RPCLink.emergency
+}
+
+func rpcMaxRetries() int {
+	if config.SlaveOptions.RPCMaxRetries > 0 {
+		return config.SlaveOptions.RPCMaxRetries
+	}
+
+	return RPC_DEFAULT_MAX_RETRIES
+}
+
+// rpcBackoff doubles the wait for each attempt, starting at a second and capped at rpc_backoff_max seconds
+func rpcBackoff(attempt int) time.Duration {
+	backoffMax := time.Duration(RPC_DEFAULT_BACKOFF_MAX) * time.Second
+	if config.SlaveOptions.RPCBackoffMax > 0 {
+		backoffMax = time.Duration(config.SlaveOptions.RPCBackoffMax) * time.Second
+	}
+
+	backoff := time.Second
+	for i := 1; i < attempt && backoff < backoffMax; i++ {
+		backoff *= 2
+	}
+
+	if backoff > backoffMax {
+		return backoffMax
+	}
+
+	return backoff
+}
+
+// StartRPCEmergencyMode switches the node to emergency mode and starts the recovery loop, it does
+// nothing if the node is already in emergency mode
+func StartRPCEmergencyMode(userKey string, address string) {
+	RPCLink.Lock()
+	if RPCLink.emergency {
+		RPCLink.Unlock()
+		return
+	}
+	RPCLink.emergency = true
+	RPCLink.failures = 0
+	RPCLink.Unlock()
+
+	log.Error("Lost connection to the RPC master, entering emergency mode")
+	go rpcRecoveryLoop(userKey, address)
+}
+
+// CallFailed counts a failed call, the node enters emergency mode after rpc_max_retries failures in a row
+func (l *RPCLinkState) CallFailed(userKey string, address string) {
+	l.Lock()
+	l.failures++
+	tripped := l.failures >= rpcMaxRetries()
+	l.Unlock()
+
+	if tripped {
+		StartRPCEmergencyMode(userKey, address)
+	}
+}
+
+// CallSucceeded resets the failure count
+func (l *RPCLinkState) CallSucceeded() {
+	l.Lock()
+	l.failures = 0
+	l.Unlock()
+}
+
+func (l *RPCLinkState) APIDefinitions() string {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.apiDefinitions
+}
+
+func (l *RPCLinkState) SetAPIDefinitions(apiDefinitions string) {
+	l.Lock()
+	l.apiDefinitions = apiDefinitions
+	l.Unlock()
+}
+
+func (l *RPCLinkState) Policies() string {
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.policies
+}
+
+func (l *RPCLinkState) SetPolicies(policies string) {
+	l.Lock()
+	l.policies = policies
+	l.Unlock()
+}
+
+// rpcRecoveryLoop tries to log in with its own client until it succeeds, then leaves emergency mode
+// and reloads so that the RPC handlers reconnect and fresh definitions are loaded
+func rpcRecoveryLoop(userKey string, address string) {
+	rpcClient := gorpc.NewTCPClient(address)
+	configureRPCCompression(rpcClient, nil)
+	rpcClient.Start()
+	defer rpcClient.Stop()
+	client := GetDispatcher().NewFuncClient(rpcClient)
+
+	for attempt := 1; ; attempt++ {
+		time.Sleep(rpcBackoff(attempt))
+
+		ok, err := client.Call("Login", userKey)
+		if err != nil {
+			log.Debug("RPC master still unavailable: ", err)
+			continue
+		}
+
+		// The master is back but rejects the key, waiting won't fix the configuration
+		if !ok.(bool) {
+			log.Fatal("RPC Login incorrect")
+		}
+
+		break
+	}
+
+	RPCLink.Lock()
+	RPCLink.emergency = false
+	RPCLink.failures = 0
+	RPCLink.Unlock()
+
+	log.Warning("Connection to the RPC master restored, leaving emergency mode")
+	ReloadURLStructure()
+}
+
+func getRPCBackupKey(keyName string) (string, error) {
+	rpcKeyBackup.Lock()
+	defer rpcKeyBackup.Unlock()
+
+	entry, ok := rpcKeyBackup.get(keyName)
+	if !ok {
+		return "", KeyError{}
+	}
+
+	return entry.value, nil
+}
+
+func setRPCBackupKey(keyName string, value string) {
+	rpcKeyBackup.Lock()
+	rpcKeyBackup.set(keyName, value, 0)
+	rpcKeyBackup.Unlock()
+}
+
+func deleteRPCBackupKey(keyName string) {
+	rpcKeyBackup.Lock()
+	rpcKeyBackup.remove(keyName)
+	rpcKeyBackup.Unlock()
+}
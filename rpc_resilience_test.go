@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRPCBackoff(t *testing.T) {
+	config.SlaveOptions.RPCBackoffMax = 10
+	defer func() { config.SlaveOptions.RPCBackoffMax = 0 }()
+
+	expected := []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for attempt, backoff := range expected {
+		if rpcBackoff(attempt) != backoff {
+			t.Error("Unexpected backoff for attempt ", attempt, ": ", rpcBackoff(attempt))
+		}
+	}
+}
+
+func TestRPCEmergencyModeServesBackup(t *testing.T) {
+	RPCLink.Lock()
+	RPCLink.emergency = true
+	RPCLink.Unlock()
+	defer func() {
+		RPCLink.Lock()
+		RPCLink.emergency = false
+		RPCLink.Unlock()
+	}()
+
+	store := &RPCStorageHandler{KeyPrefix: "apikey-"}
+	setRPCBackupKey("apikey-known", "{}")
+
+	if value, err := store.GetKey("known"); err != nil || value != "{}" {
+		t.Error("Key should be served from the backup in emergency mode")
+	}
+
+	if _, err := store.GetKey("unknown"); err == nil {
+		t.Error("Unknown key should not be found")
+	}
+
+	// Writes are kept locally so the node sees its own changes
+	store.SetKey("new", "{\"rate\": 1}", 0)
+	if value, _ := store.GetKey("new"); value != "{\"rate\": 1}" {
+		t.Error("Emergency write was not kept locally")
+	}
+
+	if store.SetRollingWindow("rate-limit-key", 60, 60) != 0 {
+		t.Error("Rate limits should not be enforced in emergency mode")
+	}
+}
@@ -30,6 +30,33 @@ type KeysValuesPair struct {
 	Values []string
 }
 
+// KeySpaceUpdateRequest asks for the keys changed since a token returned by a previous poll, an
+// empty token asks for the changes since the node last polled
+type KeySpaceUpdateRequest struct {
+	OrgId string
+	Since string
+}
+
+type KeySpaceUpdate struct {
+	Keys  []string
+	Token string
+}
+
+// Defaults for the RPC settings in slave_options, intervals are in seconds
+const (
+	RPC_DEFAULT_POOL_SIZE         = 10
+	RPC_DEFAULT_KEYSPACE_INTERVAL = 30
+	RPC_DEFAULT_RELOAD_TIMEOUT    = 60
+)
+
+func getRPCSetting(value int, defaultValue int) int {
+	if value > 0 {
+		return value
+	}
+
+	return defaultValue
+}
+
 var ErrorDenied error = errors.New("Access Denied")
 
 // ------------------- CLOUD STORAGE MANAGER -------------------------------
@@ -42,19 +69,49 @@ func ClearRPCClients() {
 	}
 }
 
+// rpcKeyCache is shared by all RPC storage handlers so that revoked keys can be dropped from one place,
+// cached keys include the handler's prefix
+var rpcKeyCache = cache.New(30*time.Second, 15*time.Second)
+
+// invalidateRPCCache drops a revoked key by its public hash and, for OAuth tokens, the cached access
+// data of every API. An empty namespace drops the hash from every namespace
+func invalidateRPCCache(namespace string, keyHash string) {
+	if namespace != "" {
+		rpcKeyCache.Delete(namespace + keyHash)
+	}
+
+	accessMarker := "." + ACCESS_PREFIX
+	for cacheKey, _ := range rpcKeyCache.Items() {
+		if namespace == "" && strings.HasSuffix(cacheKey, keyHash) {
+			rpcKeyCache.Delete(cacheKey)
+			continue
+		}
+
+		// OAuth access data is cached under the raw token
+		if !strings.HasPrefix(cacheKey, OAUTH_PREFIX) {
+			continue
+		}
+		if i := strings.Index(cacheKey, accessMarker); i != -1 && publicHash(cacheKey[i+len(accessMarker):]) == keyHash {
+			rpcKeyCache.Delete(cacheKey)
+		}
+	}
+}
+
 // RPCStorageHandler is a storage manager that uses the redis database.
 type RPCStorageHandler struct {
-	RPCClient        *gorpc.Client
-	Client           *gorpc.DispatcherClient
-	KeyPrefix        string
-	HashKeys         bool
-	UserKey          string
-	Address          string
-	cache            *cache.Cache
-	killChan         chan int
-	Connected        bool
-	ID               string
-	SuppressRegister bool
+	RPCClient         *gorpc.Client
+	Client            *gorpc.DispatcherClient
+	KeyPrefix         string
+	HashKeys          bool
+	UserKey           string
+	Address           string
+	cache             *cache.Cache
+	killChan          chan int
+	Connected         bool
+	ID                string
+	SuppressRegister  bool
+	keySpaceToken     string
+	deltasUnsupported bool
 }
 
 func (r *RPCStorageHandler) Register() {
@@ -76,10 +133,10 @@ func (r *RPCStorageHandler) checkDisconnect() {
 // Connect will establish a connection to the DB
 func (r *RPCStorageHandler) Connect() bool {
 	// Set up the cache
-	r.cache = cache.New(30*time.Second, 15*time.Second)
+	r.cache = rpcKeyCache
 	r.RPCClient = gorpc.NewTCPClient(r.Address)
-	r.RPCClient.OnConnect = r.OnConnectFunc
-	r.RPCClient.Conns = 10
+	configureRPCCompression(r.RPCClient, r.OnConnectFunc)
+	r.RPCClient.Conns = getRPCSetting(config.SlaveOptions.RPCPoolSize, RPC_DEFAULT_POOL_SIZE)
 	r.RPCClient.Start()
 	d := GetDispatcher()
 	r.Client = d.NewFuncClient(r.RPCClient)
@@ -115,6 +172,16 @@ func (r *RPCStorageHandler) hashKey(in string) string {
 	return doHash(in)
 }
 
+// KeyNamespace is the key prefix, cached keys are stored under it
+func (r *RPCStorageHandler) KeyNamespace() string {
+	return r.KeyPrefix
+}
+
+// HashedKeyName is the raw name of a key known by its public hash
+func (r *RPCStorageHandler) HashedKeyName(keyHash string) string {
+	return r.KeyPrefix + keyHash
+}
+
 func (r *RPCStorageHandler) fixKey(keyName string) string {
 	setKeyName := r.KeyPrefix + r.hashKey(keyName)
 
@@ -128,22 +195,36 @@ func (r *RPCStorageHandler) cleanKey(keyName string) string {
 	return setKeyName
 }
 
-func (r *RPCStorageHandler) Login() {
+// Login authenticates with the master. It makes a single attempt so request paths never wait on a
+// backoff: a master that can't be reached counts as a failed call, and after rpc_max_retries of those
+// the node enters emergency mode and a background loop retries with a backoff. Incorrect credentials
+// are a configuration error and stop the node. The result is false if not logged in
+func (r *RPCStorageHandler) Login() bool {
 	log.Debug("[RPC Store] Login initiated")
 
 	if len(r.UserKey) == 0 {
 		log.Fatal("No API Key set!")
 	}
 
+	// The recovery loop restores the link, don't pile more retries on a master that is down
+	if IsRPCEmergencyMode() {
+		return false
+	}
+
 	ok, err := r.Client.Call("Login", r.UserKey)
 	if err != nil {
-		log.Fatal("RPC Login failed: ", err)
+		log.Warning("RPC Login failed: ", err)
+		RPCLink.CallFailed(r.UserKey, r.Address)
+		return false
 	}
 
 	if !ok.(bool) {
 		log.Fatal("RPC Login incorrect")
 	}
+
+	RPCLink.CallSucceeded()
 	log.Debug("[RPC Store] Login complete")
+	return true
 }
 
 // GetKey will retreive a key from the database
@@ -152,6 +233,10 @@ func (r *RPCStorageHandler) GetKey(keyName string) (string, error) {
 	log.Debug("[STORE] Getting WAS: ", keyName)
 	log.Debug("[STORE] Getting: ", r.fixKey(keyName))
 
+	if IsRPCEmergencyMode() {
+		return getRPCBackupKey(r.fixKey(keyName))
+	}
+
 	// Check the cache first
 	if config.SlaveOptions.EnableRPCCache {
 		cachedVal, found := r.cache.Get(r.fixKey(keyName))
@@ -168,13 +253,18 @@ func (r *RPCStorageHandler) GetKey(keyName string) (string, error) {
 
 	if err != nil {
 		if r.IsAccessError(err) {
-			r.Login()
-			return r.GetKey(keyName)
+			if r.Login() {
+				return r.GetKey(keyName)
+			}
+			return "", KeyError{}
 		}
 
+		// The master may be unreachable, serve the last copy we saw
 		log.Debug("Error trying to get value:", err)
-		return "", KeyError{}
+		RPCLink.CallFailed(r.UserKey, r.Address)
+		return getRPCBackupKey(r.fixKey(keyName))
 	}
+	RPCLink.CallSucceeded()
 	elapsed := time.Since(start)
 	log.Debug("GetKey took ", elapsed)
 
@@ -182,23 +272,41 @@ func (r *RPCStorageHandler) GetKey(keyName string) (string, error) {
 		// Cache it
 		r.cache.Set(r.fixKey(keyName), value, cache.DefaultExpiration)
 	}
+	setRPCBackupKey(r.fixKey(keyName), value.(string))
 
 	return value.(string), nil
 }
 
 func (r *RPCStorageHandler) GetRawKey(keyName string) (string, error) {
-	log.Error("Not Implemented!")
+	if IsRPCEmergencyMode() {
+		return getRPCBackupKey(keyName)
+	}
 
-	return "", nil
+	value, err := r.Client.Call("GetRawKey", keyName)
+
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.GetRawKey(keyName)
+		}
+
+		log.Debug("Error trying to get value:", err)
+		return "", KeyError{}
+	}
+	setRPCBackupKey(keyName, value.(string))
+
+	return value.(string), nil
 }
 
 func (r *RPCStorageHandler) GetExp(keyName string) (int64, error) {
 	log.Debug("GetExp called")
+	if IsRPCEmergencyMode() {
+		return 0, KeyError{}
+	}
+
 	value, err := r.Client.Call("GetExp", r.fixKey(keyName))
 
 	if err != nil {
-		if r.IsAccessError(err) {
-			r.Login()
+		if r.IsAccessError(err) && r.Login() {
 			return r.GetExp(keyName)
 		}
 		log.Error("Error trying to get TTL: ", err)
@@ -212,6 +320,12 @@ func (r *RPCStorageHandler) GetExp(keyName string) (int64, error) {
 // SetKey will create (or update) a key value in the store
 func (r *RPCStorageHandler) SetKey(keyName string, sessionState string, timeout int64) error {
 	start := time.Now() // get current time
+	if IsRPCEmergencyMode() {
+		// Keep the local copy current so the node sees its own changes until the link is back
+		setRPCBackupKey(r.fixKey(keyName), sessionState)
+		return nil
+	}
+
 	ibd := InboundData{
 		KeyName:      r.fixKey(keyName),
 		SessionState: sessionState,
@@ -220,8 +334,7 @@ func (r *RPCStorageHandler) SetKey(keyName string, sessionState string, timeout
 
 	_, err := r.Client.Call("SetKey", ibd)
 
-	if r.IsAccessError(err) {
-		r.Login()
+	if r.IsAccessError(err) && r.Login() {
 		return r.SetKey(keyName, sessionState, timeout)
 	}
 
@@ -232,22 +345,45 @@ func (r *RPCStorageHandler) SetKey(keyName string, sessionState string, timeout
 }
 
 func (r *RPCStorageHandler) SetRawKey(keyName string, sessionState string, timeout int64) error {
-	return nil
+	if IsRPCEmergencyMode() {
+		setRPCBackupKey(keyName, sessionState)
+		return nil
+	}
+
+	ibd := InboundData{
+		KeyName:      keyName,
+		SessionState: sessionState,
+		Timeout:      timeout,
+	}
+
+	_, err := r.Client.Call("SetRawKey", ibd)
+
+	if r.IsAccessError(err) && r.Login() {
+		return r.SetRawKey(keyName, sessionState, timeout)
+	}
+
+	return err
 }
 
 // Decrement will decrement a key in redis
 func (r *RPCStorageHandler) Decrement(keyName string) {
 	log.Warning("Decrement called")
+	if IsRPCEmergencyMode() {
+		return
+	}
+
 	_, err := r.Client.Call("Decrement", keyName)
-	if r.IsAccessError(err) {
-		r.Login()
+	if r.IsAccessError(err) && r.Login() {
 		r.Decrement(keyName)
 		return
 	}
 }
 
-// IncrementWithExpire will increment a key in redis
+// IncrementWithExpire will increment a key in redis, in emergency mode quotas are not enforced
 func (r *RPCStorageHandler) IncrememntWithExpire(keyName string, expire int64) int64 {
+	if IsRPCEmergencyMode() {
+		return 0
+	}
 
 	ibd := InboundData{
 		KeyName: keyName,
@@ -256,9 +392,13 @@ func (r *RPCStorageHandler) IncrememntWithExpire(keyName string, expire int64) i
 
 	val, err := r.Client.Call("IncrememntWithExpire", ibd)
 
-	if r.IsAccessError(err) {
-		r.Login()
-		return r.IncrememntWithExpire(keyName, expire)
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.IncrememntWithExpire(keyName, expire)
+		}
+
+		log.Error("Error trying to increment value: ", err)
+		return 0
 	}
 
 	return val.(int64)
@@ -267,26 +407,56 @@ func (r *RPCStorageHandler) IncrememntWithExpire(keyName string, expire int64) i
 
 // GetKeys will return all keys according to the filter (filter is a prefix - e.g. tyk.keys.*)
 func (r *RPCStorageHandler) GetKeys(filter string) []string {
+	if IsRPCEmergencyMode() {
+		return []string{}
+	}
+
+	searchStr := r.KeyPrefix + r.hashKey(filter) + "*"
+	log.Debug("[STORE] Getting list by: ", searchStr)
+
+	keys, err := r.Client.Call("GetKeys", searchStr)
 
-	log.Error("GetKeys Not Implemented")
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.GetKeys(filter)
+		}
+
+		log.Error("Error trying to get all keys: ", err)
+		return []string{}
+	}
+
+	if keys == nil {
+		return []string{}
+	}
 
-	return []string{}
+	sessions := keys.([]string)
+	for i, v := range sessions {
+		sessions[i] = r.cleanKey(v)
+	}
+
+	return sessions
 }
 
 // GetKeysAndValuesWithFilter will return all keys and their values with a filter
 func (r *RPCStorageHandler) GetKeysAndValuesWithFilter(filter string) map[string]string {
+	returnValues := make(map[string]string)
+	if IsRPCEmergencyMode() {
+		return returnValues
+	}
 
 	searchStr := r.KeyPrefix + r.hashKey(filter) + "*"
 	log.Debug("[STORE] Getting list by: ", searchStr)
 
 	kvPair, err := r.Client.Call("GetKeysAndValuesWithFilter", searchStr)
 
-	if r.IsAccessError(err) {
-		r.Login()
-		return r.GetKeysAndValuesWithFilter(filter)
-	}
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.GetKeysAndValuesWithFilter(filter)
+		}
 
-	returnValues := make(map[string]string)
+		log.Error("Error trying to get filtered keys: ", err)
+		return returnValues
+	}
 
 	for i, v := range kvPair.(*KeysValuesPair).Keys {
 		returnValues[r.cleanKey(v)] = kvPair.(*KeysValuesPair).Values[i]
@@ -297,16 +467,23 @@ func (r *RPCStorageHandler) GetKeysAndValuesWithFilter(filter string) map[string
 
 // GetKeysAndValues will return all keys and their values - not to be used lightly
 func (r *RPCStorageHandler) GetKeysAndValues() map[string]string {
+	returnValues := make(map[string]string)
+	if IsRPCEmergencyMode() {
+		return returnValues
+	}
 
 	searchStr := r.KeyPrefix + "*"
 	kvPair, err := r.Client.Call("GetKeysAndValues", searchStr)
 
-	if r.IsAccessError(err) {
-		r.Login()
-		return r.GetKeysAndValues()
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.GetKeysAndValues()
+		}
+
+		log.Error("Error trying to get keys: ", err)
+		return returnValues
 	}
 
-	returnValues := make(map[string]string)
 	for i, v := range kvPair.(*KeysValuesPair).Keys {
 		returnValues[r.cleanKey(v)] = kvPair.(*KeysValuesPair).Values[i]
 	}
@@ -320,11 +497,21 @@ func (r *RPCStorageHandler) DeleteKey(keyName string) bool {
 
 	log.Debug("DEL Key was: ", keyName)
 	log.Debug("DEL Key became: ", r.fixKey(keyName))
+	deleteRPCBackupKey(r.fixKey(keyName))
+	rpcKeyCache.Delete(r.fixKey(keyName))
+	if IsRPCEmergencyMode() {
+		return false
+	}
+
 	ok, err := r.Client.Call("DeleteKey", r.fixKey(keyName))
 
-	if r.IsAccessError(err) {
-		r.Login()
-		return r.DeleteKey(keyName)
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.DeleteKey(keyName)
+		}
+
+		log.Error("Error trying to delete key: ", err)
+		return false
 	}
 
 	return ok.(bool)
@@ -332,11 +519,21 @@ func (r *RPCStorageHandler) DeleteKey(keyName string) bool {
 
 // DeleteKey will remove a key from the database without prefixing, assumes user knows what they are doing
 func (r *RPCStorageHandler) DeleteRawKey(keyName string) bool {
+	deleteRPCBackupKey(keyName)
+	rpcKeyCache.Delete(keyName)
+	if IsRPCEmergencyMode() {
+		return false
+	}
+
 	ok, err := r.Client.Call("DeleteRawKey", keyName)
 
-	if r.IsAccessError(err) {
-		r.Login()
-		return r.DeleteRawKey(keyName)
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.DeleteRawKey(keyName)
+		}
+
+		log.Error("Error trying to delete key: ", err)
+		return false
 	}
 
 	return ok.(bool)
@@ -348,14 +545,24 @@ func (r *RPCStorageHandler) DeleteKeys(keys []string) bool {
 		asInterface := make([]string, len(keys))
 		for i, v := range keys {
 			asInterface[i] = r.fixKey(v)
+			deleteRPCBackupKey(asInterface[i])
+			rpcKeyCache.Delete(asInterface[i])
+		}
+
+		if IsRPCEmergencyMode() {
+			return false
 		}
 
 		log.Debug("Deleting: ", asInterface)
 		ok, err := r.Client.Call("DeleteKeys", asInterface)
 
-		if r.IsAccessError(err) {
-			r.Login()
-			return r.DeleteKeys(keys)
+		if err != nil {
+			if r.IsAccessError(err) && r.Login() {
+				return r.DeleteKeys(keys)
+			}
+
+			log.Error("Error trying to delete keys: ", err)
+			return false
 		}
 
 		return ok.(bool)
@@ -369,8 +576,35 @@ func (r *RPCStorageHandler) DeleteKeys(keys []string) bool {
 
 // DeleteKeys will remove a group of keys in bulk without a prefix handler
 func (r *RPCStorageHandler) DeleteRawKeys(keys []string, prefix string) bool {
-	log.Error("DeleteRawKeys Not Implemented")
-	return false
+	if len(keys) == 0 {
+		log.Debug("RPCStorageHandler called DEL - Nothing to delete")
+		return true
+	}
+
+	// DeleteKeys on the master expects complete key names, so the prefix is applied here
+	asInterface := make([]string, len(keys))
+	for i, v := range keys {
+		asInterface[i] = prefix + v
+		deleteRPCBackupKey(asInterface[i])
+	}
+
+	if IsRPCEmergencyMode() {
+		return false
+	}
+
+	log.Debug("Deleting: ", asInterface)
+	ok, err := r.Client.Call("DeleteKeys", asInterface)
+
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.DeleteRawKeys(keys, prefix)
+		}
+
+		log.Error("Error trying to delete keys: ", err)
+		return false
+	}
+
+	return ok.(bool)
 }
 
 // StartPubSubHandler will listen for a signal and run the callback with the message
@@ -385,12 +619,32 @@ func (r *RPCStorageHandler) Publish(channel string, message string) error {
 }
 
 func (r *RPCStorageHandler) GetAndDeleteSet(keyName string) []interface{} {
-	log.Error("GetAndDeleteSet Not implemented, please disable your purger")
+	if IsRPCEmergencyMode() {
+		return []interface{}{}
+	}
 
-	return []interface{}{}
+	vals, err := r.Client.Call("GetAndDeleteSet", r.fixKey(keyName))
+
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.GetAndDeleteSet(keyName)
+		}
+
+		log.Error("Error trying to get and delete set: ", err)
+		return []interface{}{}
+	}
+
+	if vals == nil {
+		return []interface{}{}
+	}
+
+	return vals.([]interface{})
 }
 
 func (r *RPCStorageHandler) AppendToSet(keyName string, value string) {
+	if IsRPCEmergencyMode() {
+		return
+	}
 
 	ibd := InboundData{
 		KeyName: keyName,
@@ -398,16 +652,20 @@ func (r *RPCStorageHandler) AppendToSet(keyName string, value string) {
 	}
 
 	_, err := r.Client.Call("AppendToSet", ibd)
-	if r.IsAccessError(err) {
-		r.Login()
+	if r.IsAccessError(err) && r.Login() {
 		r.AppendToSet(keyName, value)
 		return
 	}
 
 }
 
-// SetScrollingWindow is used in the rate limiter to handle rate limits fairly.
+// SetScrollingWindow is used in the rate limiter to handle rate limits fairly, in emergency mode
+// rate limits are not enforced
 func (r *RPCStorageHandler) SetRollingWindow(keyName string, per int64, expire int64) int {
+	if IsRPCEmergencyMode() {
+		return 0
+	}
+
 	start := time.Now() // get current time
 	ibd := InboundData{
 		KeyName: keyName,
@@ -416,9 +674,13 @@ func (r *RPCStorageHandler) SetRollingWindow(keyName string, per int64, expire i
 	}
 
 	intVal, err := r.Client.Call("SetRollingWindow", ibd)
-	if r.IsAccessError(err) {
-		r.Login()
-		return r.SetRollingWindow(keyName, per, expire)
+	if err != nil {
+		if r.IsAccessError(err) && r.Login() {
+			return r.SetRollingWindow(keyName, per, expire)
+		}
+
+		log.Error("Error trying to set rolling window: ", err)
+		return 0
 	}
 
 	elapsed := time.Since(start)
@@ -438,8 +700,23 @@ func (r RPCStorageHandler) IsAccessError(err error) bool {
 	return false
 }
 
-// GetAPIDefinitions will pull API definitions from the RPC server
+// isUnknownRPCFunc is true if the master rejected a call because it doesn't provide the function
+func isUnknownRPCFunc(err error, funcName string) bool {
+	if err == nil {
+		return false
+	}
+
+	return strings.Contains(err.Error(), "unknown method") && strings.Contains(err.Error(), funcName)
+}
+
+// GetAPIDefinitions will pull API definitions from the RPC server, the last definitions that were
+// retrieved are returned if the master can't be reached
 func (r *RPCStorageHandler) GetApiDefinitions(orgId string, tags []string) string {
+	if IsRPCEmergencyMode() {
+		log.Warning("RPC emergency mode, using the last API definitions received")
+		return RPCLink.APIDefinitions()
+	}
+
 	dr := DefRequest{
 		OrgId: orgId,
 		Tags:  tags,
@@ -448,26 +725,38 @@ func (r *RPCStorageHandler) GetApiDefinitions(orgId string, tags []string) strin
 	defString, err := r.Client.Call("GetApiDefinitions", dr)
 
 	if err != nil {
-		if r.IsAccessError(err) {
-			r.Login()
+		if r.IsAccessError(err) && r.Login() {
 			return r.GetApiDefinitions(orgId, tags)
 		}
+
+		log.Error("Failed to get API definitions, using the last definitions received: ", err)
+		return RPCLink.APIDefinitions()
 	}
 	log.Debug("API Definitions retrieved")
+	RPCLink.SetAPIDefinitions(defString.(string))
 	return defString.(string)
 
 }
 
-// GetPolicies will pull Policies from the RPC server
+// GetPolicies will pull Policies from the RPC server, the last policies that were retrieved are
+// returned if the master can't be reached
 func (r *RPCStorageHandler) GetPolicies(orgId string) string {
+	if IsRPCEmergencyMode() {
+		log.Warning("RPC emergency mode, using the last policies received")
+		return RPCLink.Policies()
+	}
+
 	defString, err := r.Client.Call("GetPolicies", orgId)
 	if err != nil {
-		if r.IsAccessError(err) {
-			r.Login()
+		if r.IsAccessError(err) && r.Login() {
 			return r.GetPolicies(orgId)
 		}
+
+		log.Error("Failed to get policies, using the last policies received: ", err)
+		return RPCLink.Policies()
 	}
 
+	RPCLink.SetPolicies(defString.(string))
 	return defString.(string)
 
 }
@@ -475,7 +764,14 @@ func (r *RPCStorageHandler) GetPolicies(orgId string) string {
 // CheckForReload will start a long poll
 func (r *RPCStorageHandler) CheckForReload(orgId string) {
 	log.Debug("[RPC STORE] Check Reload called...")
-	reload, err := r.Client.CallTimeout("CheckReload", orgId, time.Second*60)
+	if IsRPCEmergencyMode() {
+		// Nothing to poll, the recovery loop reloads once the link is back
+		time.Sleep(rpcBackoff(rpcMaxRetries()))
+		return
+	}
+
+	reloadTimeout := getRPCSetting(config.SlaveOptions.ReloadTimeout, RPC_DEFAULT_RELOAD_TIMEOUT)
+	reload, err := r.Client.CallTimeout("CheckReload", orgId, time.Duration(reloadTimeout)*time.Second)
 	if err != nil {
 		if r.IsAccessError(err) {
 			log.Warning("[RPC STORE] CheckReload: Not logged in")
@@ -493,22 +789,72 @@ func (r *RPCStorageHandler) CheckForReload(orgId string) {
 }
 
 func (r *RPCStorageHandler) StartRPCLoopCheck(orgId string) {
-	log.Info("Starting keyspace poller")
+	interval := getRPCSetting(config.SlaveOptions.KeySpaceSyncInterval, RPC_DEFAULT_KEYSPACE_INTERVAL)
+	log.Info("Starting keyspace poller, interval: ", interval, "s")
 
 	for {
 		r.CheckForKeyspaceChanges(orgId)
-		time.Sleep(30 * time.Second)
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
+
+// getKeySpaceDelta asks the master for the keys changed since the last token it gave us, so that
+// changes aren't lost or sent twice if a poll fails. The error is set if the master doesn't support it
+func (r *RPCStorageHandler) getKeySpaceDelta(orgId string) ([]string, error) {
+	update, err := r.Client.Call("GetKeySpaceUpdateSince", &KeySpaceUpdateRequest{OrgId: orgId, Since: r.keySpaceToken})
+	if err != nil {
+		return nil, err
+	}
+
+	if update == nil {
+		return []string{}, nil
 	}
+
+	thisUpdate := update.(*KeySpaceUpdate)
+	r.keySpaceToken = thisUpdate.Token
+
+	return thisUpdate.Keys, nil
 }
 
 // CheckForKeyspaceChanges will poll for keysace changes
 func (r *RPCStorageHandler) CheckForKeyspaceChanges(orgId string) {
+	if IsRPCEmergencyMode() {
+		return
+	}
+
+	if !r.deltasUnsupported {
+		keys, err := r.getKeySpaceDelta(orgId)
+		if err == nil {
+			if len(keys) > 0 {
+				log.Info("Keyspace changes detected, updating local cache")
+				go r.ProcessKeySpaceChanges(keys)
+			}
+			return
+		}
+
+		if r.IsAccessError(err) {
+			if r.Login() {
+				r.CheckForKeyspaceChanges(orgId)
+			}
+			return
+		}
+
+		// Only a master that doesn't know the call is an older version, any other failure may be
+		// transient so deltas are tried again on the next poll
+		if isUnknownRPCFunc(err, "GetKeySpaceUpdateSince") {
+			log.Warning("RPC master doesn't support keyspace deltas, using full updates")
+			r.deltasUnsupported = true
+		} else {
+			log.Debug("Keyspace delta poll failed, trying a full update: ", err)
+		}
+	}
+
 	keys, err := r.Client.Call("GetKeySpaceUpdate", orgId)
 
 	if err != nil {
-		if r.IsAccessError(err) {
-			r.Login()
+		if r.IsAccessError(err) && r.Login() {
 			r.CheckForKeyspaceChanges(orgId)
+			return
 		}
 	}
 
@@ -526,6 +872,7 @@ func (r *RPCStorageHandler) CheckForKeyspaceChanges(orgId string) {
 func (r *RPCStorageHandler) ProcessKeySpaceChanges(keys []string) {
 	for _, key := range keys {
 		log.Info("--> removing cached key: ", key)
+		revokeCachedToken(TokenRevokedNotice{KeyHash: publicHash(key)})
 		handleDeleteKey(key, "-1")
 	}
 }
@@ -545,6 +892,14 @@ func GetDispatcher() *gorpc.Dispatcher {
 		return nil
 	})
 
+	Dispatch.AddFunc("GetRawKey", func(keyName string) (string, error) {
+		return "", nil
+	})
+
+	Dispatch.AddFunc("SetRawKey", func(ibd *InboundData) error {
+		return nil
+	})
+
 	Dispatch.AddFunc("GetExp", func(keyName string) (int64, error) {
 		return 0, nil
 	})
@@ -581,6 +936,10 @@ func GetDispatcher() *gorpc.Dispatcher {
 		return 0, nil
 	})
 
+	Dispatch.AddFunc("GetAndDeleteSet", func(keyName string) ([]interface{}, error) {
+		return []interface{}{}, nil
+	})
+
 	Dispatch.AddFunc("AppendToSet", func(ibd *InboundData) error {
 		return nil
 	})
@@ -609,6 +968,10 @@ func GetDispatcher() *gorpc.Dispatcher {
 		return []string{}, nil
 	})
 
+	Dispatch.AddFunc("GetKeySpaceUpdateSince", func(clientAddr string, req *KeySpaceUpdateRequest) (*KeySpaceUpdate, error) {
+		return &KeySpaceUpdate{}, nil
+	})
+
 	return Dispatch
 
 }
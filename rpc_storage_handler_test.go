@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"github.com/lonelycode/gorpc"
+	"net"
+	"reflect"
+	"testing"
+)
+
+const testRPCUserKey = "test-rpc-key"
+
+// startTestRPCMaster serves funcs (and a Login that accepts testRPCUserKey) on a free local port, the
+// handler returned is connected to it
+func startTestRPCMaster(t *testing.T, funcs map[string]interface{}) (*RPCStorageHandler, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	d := gorpc.NewDispatcher()
+	d.AddFunc("Login", func(clientAddr string, userKey string) bool {
+		return userKey == testRPCUserKey
+	})
+	for name, f := range funcs {
+		d.AddFunc(name, f)
+	}
+
+	server := gorpc.NewTCPServer(address, d.NewHandlerFunc())
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := gorpc.NewTCPClient(address)
+	client.Start()
+
+	store := &RPCStorageHandler{
+		RPCClient: client,
+		Client:    d.NewFuncClient(client),
+		KeyPrefix: "apikey-",
+		UserKey:   testRPCUserKey,
+		Address:   address,
+		cache:     rpcKeyCache,
+	}
+
+	return store, func() {
+		client.Stop()
+		server.Stop()
+	}
+}
+
+func TestKeyspaceDeltasUnsupported(t *testing.T) {
+	fullPolls := 0
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"GetKeySpaceUpdate": func(clientAddr string, orgId string) ([]string, error) {
+			fullPolls++
+			return []string{}, nil
+		},
+	})
+	defer stop()
+
+	store.CheckForKeyspaceChanges("org")
+	if !store.deltasUnsupported {
+		t.Error("A master without GetKeySpaceUpdateSince should switch the node to full updates")
+	}
+	if fullPolls != 1 {
+		t.Error("Expected a full update, got: ", fullPolls)
+	}
+}
+
+func TestKeyspaceDeltaTransientError(t *testing.T) {
+	deltaPolls := 0
+	fullPolls := 0
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"GetKeySpaceUpdateSince": func(clientAddr string, req *KeySpaceUpdateRequest) (*KeySpaceUpdate, error) {
+			deltaPolls++
+			if deltaPolls == 1 {
+				return nil, errors.New("Keyspace log unavailable")
+			}
+			return &KeySpaceUpdate{Keys: []string{}, Token: "token-2"}, nil
+		},
+		"GetKeySpaceUpdate": func(clientAddr string, orgId string) ([]string, error) {
+			fullPolls++
+			return []string{}, nil
+		},
+	})
+	defer stop()
+
+	store.CheckForKeyspaceChanges("org")
+	if store.deltasUnsupported {
+		t.Fatal("A transient delta error should not disable deltas")
+	}
+	if fullPolls != 1 {
+		t.Error("The failed delta poll should fall back to a full update, got: ", fullPolls)
+	}
+
+	store.CheckForKeyspaceChanges("org")
+	if deltaPolls != 2 || fullPolls != 1 {
+		t.Error("The next poll should use deltas again, delta polls: ", deltaPolls, " full polls: ", fullPolls)
+	}
+	if store.keySpaceToken != "token-2" {
+		t.Error("Delta token was not kept: ", store.keySpaceToken)
+	}
+}
+
+func TestIsUnknownRPCFunc(t *testing.T) {
+	if !isUnknownRPCFunc(errors.New("gorpc.Dispatcher: unknown method [GetKeySpaceUpdateSince]"), "GetKeySpaceUpdateSince") {
+		t.Error("Unknown method error not detected")
+	}
+
+	if isUnknownRPCFunc(errors.New("Keyspace log unavailable"), "GetKeySpaceUpdateSince") {
+		t.Error("Application error treated as an unknown method")
+	}
+
+	if isUnknownRPCFunc(nil, "GetKeySpaceUpdateSince") {
+		t.Error("No error treated as an unknown method")
+	}
+}
+
+func TestRPCRawKeys(t *testing.T) {
+	var written *InboundData
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"GetRawKey": func(clientAddr string, keyName string) (string, error) {
+			if keyName != "raw-key" {
+				return "", errors.New("Not found")
+			}
+			return "raw-value", nil
+		},
+		"SetRawKey": func(clientAddr string, ibd *InboundData) error {
+			written = ibd
+			return nil
+		},
+	})
+	defer stop()
+
+	if value, err := store.GetRawKey("raw-key"); err != nil || value != "raw-value" {
+		t.Error("Raw key should be read without the key prefix, got: ", value, " ", err)
+	}
+
+	if _, err := store.GetRawKey("missing"); err == nil {
+		t.Error("A missing raw key should be an error")
+	}
+
+	if err := store.SetRawKey("raw-key", "new-value", 60); err != nil {
+		t.Fatal(err)
+	}
+	if written == nil || written.KeyName != "raw-key" || written.SessionState != "new-value" || written.Timeout != 60 {
+		t.Error("Raw key was not written as is: ", written)
+	}
+}
+
+func TestRPCGetKeys(t *testing.T) {
+	var searched string
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"GetKeys": func(clientAddr string, filter string) ([]string, error) {
+			searched = filter
+			return []string{"apikey-abc", "apikey-def"}, nil
+		},
+	})
+	defer stop()
+
+	keys := store.GetKeys("")
+	if searched != "apikey-*" {
+		t.Error("Keys should be searched under the key prefix, got: ", searched)
+	}
+	if !reflect.DeepEqual(keys, []string{"abc", "def"}) {
+		t.Error("Key prefix should be removed from the results, got: ", keys)
+	}
+}
+
+func TestRPCDeleteRawKeys(t *testing.T) {
+	calls := 0
+	var deleted []string
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"DeleteKeys": func(clientAddr string, keys []string) (bool, error) {
+			calls++
+			deleted = keys
+			return true, nil
+		},
+	})
+	defer stop()
+
+	if !store.DeleteRawKeys([]string{}, "cache-") || calls != 0 {
+		t.Error("Deleting no keys should not call the master")
+	}
+
+	if !store.DeleteRawKeys([]string{"a", "b"}, "cache-") {
+		t.Error("Keys should have been deleted")
+	}
+	if !reflect.DeepEqual(deleted, []string{"cache-a", "cache-b"}) {
+		t.Error("Keys should be deleted with the given prefix, got: ", deleted)
+	}
+}
+
+func TestRPCGetAndDeleteSetLogsInAgain(t *testing.T) {
+	calls := 0
+	var setName string
+	store, stop := startTestRPCMaster(t, map[string]interface{}{
+		"GetAndDeleteSet": func(clientAddr string, keyName string) ([]interface{}, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("Access Denied")
+			}
+			setName = keyName
+			return []interface{}{"record-1", "record-2"}, nil
+		},
+	})
+	defer stop()
+
+	values := store.GetAndDeleteSet("analytics")
+	if calls != 2 {
+		t.Error("The call should be retried once after logging in again, calls: ", calls)
+	}
+	if setName != "apikey-analytics" {
+		t.Error("Set should be read under the key prefix, got: ", setName)
+	}
+	if !reflect.DeepEqual(values, []interface{}{"record-1", "record-2"}) {
+		t.Error("Wrong set values: ", values)
+	}
+}
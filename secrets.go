@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/lonelycode/tykcommon"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// String values in tyk.conf and API definitions can reference secrets instead of holding them:
+// env://NAME reads an environment variable, vault://path#field reads a field of a Vault secret (the
+// field defaults to "value") and consul://path reads a Consul KV entry
+const (
+	SECRET_ENV_PREFIX    = "env://"
+	SECRET_VAULT_PREFIX  = "vault://"
+	SECRET_CONSUL_PREFIX = "consul://"
+
+	SECRET_VAULT_DEFAULT_FIELD = "value"
+	SECRET_STORE_TIMEOUT       = 10
+)
+
+// SecretStoreConfig is the address and token of a Vault or Consul server, the standard VAULT_ADDR,
+// VAULT_TOKEN, CONSUL_HTTP_ADDR and CONSUL_HTTP_TOKEN variables are used if they aren't set
+type SecretStoreConfig struct {
+	Address string `json:"address"`
+	Token   string `json:"token"`
+}
+
+type SecretsConfig struct {
+	Vault        SecretStoreConfig `json:"vault"`
+	Consul       SecretStoreConfig `json:"consul"`
+	APIAllowList SecretAllowList   `json:"api_definition_allow_list"`
+}
+
+// SecretAllowList holds the prefixes of the environment variables, Vault paths and Consul paths that
+// API definitions may reference. Definitions are written by more people than tyk.conf, so nothing can
+// be referenced from them unless it is listed here
+type SecretAllowList struct {
+	Env    []string `json:"env"`
+	Vault  []string `json:"vault"`
+	Consul []string `json:"consul"`
+}
+
+func hasAllowedPrefix(name string, prefixes []string) bool {
+	if strings.Contains(name, "..") {
+		return false
+	}
+
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allows checks a reference against the allow list, the field of a Vault reference is not part of the path
+func (a SecretAllowList) Allows(reference string) bool {
+	switch {
+	case strings.HasPrefix(reference, SECRET_ENV_PREFIX):
+		return hasAllowedPrefix(strings.TrimPrefix(reference, SECRET_ENV_PREFIX), a.Env)
+	case strings.HasPrefix(reference, SECRET_VAULT_PREFIX):
+		secretPath := strings.SplitN(strings.TrimPrefix(reference, SECRET_VAULT_PREFIX), "#", 2)[0]
+		return hasAllowedPrefix(secretPath, a.Vault)
+	case strings.HasPrefix(reference, SECRET_CONSUL_PREFIX):
+		return hasAllowedPrefix(strings.TrimPrefix(reference, SECRET_CONSUL_PREFIX), a.Consul)
+	}
+
+	return true
+}
+
+func isSecretReference(value string) bool {
+	return strings.HasPrefix(value, SECRET_ENV_PREFIX) ||
+		strings.HasPrefix(value, SECRET_VAULT_PREFIX) ||
+		strings.HasPrefix(value, SECRET_CONSUL_PREFIX)
+}
+
+func getSecretStore(thisStore SecretStoreConfig, addressVar string, tokenVar string) SecretStoreConfig {
+	if thisStore.Address == "" {
+		thisStore.Address = os.Getenv(addressVar)
+	}
+	if thisStore.Token == "" {
+		thisStore.Token = os.Getenv(tokenVar)
+	}
+	thisStore.Address = strings.TrimSuffix(thisStore.Address, "/")
+
+	return thisStore
+}
+
+func fetchSecret(url string, tokenHeader string, token string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(tokenHeader, token)
+	}
+
+	client := &http.Client{Timeout: SECRET_STORE_TIMEOUT * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New("Secret store returned " + resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// resolveVaultSecret reads a field of a KV secret, both the v1 and v2 (data/) engines are supported
+func resolveVaultSecret(reference string, stores SecretsConfig) (string, error) {
+	thisStore := getSecretStore(stores.Vault, "VAULT_ADDR", "VAULT_TOKEN")
+	if thisStore.Address == "" {
+		return "", errors.New("No Vault address is set")
+	}
+
+	secretPath, field := reference, SECRET_VAULT_DEFAULT_FIELD
+	if parts := strings.SplitN(reference, "#", 2); len(parts) == 2 {
+		secretPath, field = parts[0], parts[1]
+	}
+
+	body, err := fetchSecret(thisStore.Address+"/v1/"+secretPath, "X-Vault-Token", thisStore.Token)
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", err
+	}
+
+	data := secret.Data
+	if innerData, ok := data["data"].(map[string]interface{}); ok {
+		if _, isV2 := data["metadata"]; isV2 {
+			data = innerData
+		}
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", errors.New("Vault secret has no field: " + field)
+	}
+
+	return value, nil
+}
+
+func resolveConsulSecret(reference string, stores SecretsConfig) (string, error) {
+	thisStore := getSecretStore(stores.Consul, "CONSUL_HTTP_ADDR", "CONSUL_HTTP_TOKEN")
+	if thisStore.Address == "" {
+		return "", errors.New("No Consul address is set")
+	}
+
+	body, err := fetchSecret(thisStore.Address+"/v1/kv/"+reference+"?raw", "X-Consul-Token", thisStore.Token)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// ResolveSecret returns the value of a secret reference, values that aren't references are returned
+// as they are
+func ResolveSecret(value string, stores SecretsConfig) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SECRET_ENV_PREFIX):
+		name := strings.TrimPrefix(value, SECRET_ENV_PREFIX)
+		secret, found := os.LookupEnv(name)
+		if !found {
+			return "", errors.New("Environment variable is not set: " + name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, SECRET_VAULT_PREFIX):
+		return resolveVaultSecret(strings.TrimPrefix(value, SECRET_VAULT_PREFIX), stores)
+	case strings.HasPrefix(value, SECRET_CONSUL_PREFIX):
+		return resolveConsulSecret(strings.TrimPrefix(value, SECRET_CONSUL_PREFIX), stores)
+	}
+
+	return value, nil
+}
+
+// resolveSecretsInValue returns a copy of v with the secret references in all its exported strings
+// replaced by resolve, v itself isn't changed so maps and slices it shares with the caller keep their
+// references. The references that couldn't be resolved are added to failed
+func resolveSecretsInValue(v reflect.Value, resolve func(string) (string, error), failed *[]string) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		elem := reflect.New(v.Type().Elem())
+		elem.Elem().Set(resolveSecretsInValue(v.Elem(), resolve, failed))
+		return elem
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < copied.NumField(); i++ {
+			if field := copied.Field(i); field.CanSet() {
+				field.Set(resolveSecretsInValue(field, resolve, failed))
+			}
+		}
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(resolveSecretsInValue(v.Index(i), resolve, failed))
+		}
+		return copied
+	case reflect.Array:
+		copied := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(resolveSecretsInValue(v.Index(i), resolve, failed))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(key, resolveSecretsInValue(v.MapIndex(key), resolve, failed))
+		}
+		return copied
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(resolveSecretsInValue(v.Elem(), resolve, failed))
+		return copied
+	case reflect.String:
+		if !isSecretReference(v.String()) {
+			return v
+		}
+		secret, err := resolve(v.String())
+		if err != nil {
+			log.Error("Couldn't resolve secret ", v.String(), ": ", err)
+			*failed = append(*failed, v.String())
+			return v
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.SetString(secret)
+		return copied
+	}
+
+	return v
+}
+
+// resolveConfigSecrets resolves the secret references in the configuration, the secret store
+// settings themselves can only reference environment variables. References that can't be resolved
+// are logged and left as they are
+func resolveConfigSecrets(configStruct *Config) {
+	failed := []string{}
+	fromEnv := func(reference string) (string, error) {
+		if !strings.HasPrefix(reference, SECRET_ENV_PREFIX) {
+			return "", errors.New("The secrets section can only reference environment variables")
+		}
+		return ResolveSecret(reference, SecretsConfig{})
+	}
+	stores := resolveSecretsInValue(reflect.ValueOf(configStruct.Secrets), fromEnv, &failed).Interface().(SecretsConfig)
+	configStruct.Secrets = stores
+
+	fromStores := func(reference string) (string, error) {
+		return ResolveSecret(reference, stores)
+	}
+	*configStruct = resolveSecretsInValue(reflect.ValueOf(*configStruct), fromStores, &failed).Interface().(Config)
+	configStruct.Secrets = stores
+}
+
+// resolveAPIDefinitionSecrets returns a copy of an API definition (and its raw data) with its secret
+// references resolved, the definition that was passed in keeps the references. Only references on
+// the allow list are resolved, the API shouldn't be loaded if any of them fail
+func resolveAPIDefinitionSecrets(thisAppConfig tykcommon.APIDefinition) (tykcommon.APIDefinition, error) {
+	failed := []string{}
+	resolve := func(reference string) (string, error) {
+		if !config.Secrets.APIAllowList.Allows(reference) {
+			return "", errors.New("Reference is not on the api_definition_allow_list")
+		}
+		return ResolveSecret(reference, config.Secrets)
+	}
+
+	resolved := resolveSecretsInValue(reflect.ValueOf(thisAppConfig), resolve, &failed).Interface().(tykcommon.APIDefinition)
+	if len(failed) > 0 {
+		return resolved, errors.New("Unresolved secret references: " + strings.Join(failed, ", "))
+	}
+
+	return resolved, nil
+}
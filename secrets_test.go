@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type secretsTestStruct struct {
+	Password string
+	Plain    string
+	Targets  []string
+	Options  map[string]string
+	RawData  map[string]interface{}
+	hidden   string
+}
+
+func resolveFromEnv(reference string) (string, error) {
+	return ResolveSecret(reference, SecretsConfig{})
+}
+
+func TestResolveSecretsFromEnv(t *testing.T) {
+	os.Setenv("TYK_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("TYK_TEST_SECRET")
+
+	thisStruct := secretsTestStruct{
+		Password: "env://TYK_TEST_SECRET",
+		Plain:    "not-a-secret",
+		Targets:  []string{"env://TYK_TEST_SECRET"},
+		Options:  map[string]string{"secret": "env://TYK_TEST_SECRET"},
+		RawData: map[string]interface{}{
+			"nested": map[string]interface{}{"secret": "env://TYK_TEST_SECRET"},
+			"list":   []interface{}{"env://TYK_TEST_SECRET", 1},
+		},
+		hidden: "env://TYK_TEST_SECRET",
+	}
+
+	failed := []string{}
+	resolved := resolveSecretsInValue(reflect.ValueOf(thisStruct), resolveFromEnv, &failed).Interface().(secretsTestStruct)
+
+	if resolved.Password != "s3cret" || resolved.Targets[0] != "s3cret" || resolved.Options["secret"] != "s3cret" {
+		t.Error("Secrets were not resolved: ", resolved)
+	}
+	if resolved.Plain != "not-a-secret" {
+		t.Error("Plain values should not change")
+	}
+	if resolved.RawData["nested"].(map[string]interface{})["secret"] != "s3cret" || resolved.RawData["list"].([]interface{})[0] != "s3cret" {
+		t.Error("Secrets in raw data were not resolved: ", resolved.RawData)
+	}
+	if resolved.hidden != "env://TYK_TEST_SECRET" {
+		t.Error("Unexported fields should not be touched")
+	}
+	if len(failed) != 0 {
+		t.Error("No reference should have failed: ", failed)
+	}
+
+	// The original keeps its references, including in the maps and slices it shared
+	if thisStruct.Password != "env://TYK_TEST_SECRET" || thisStruct.Targets[0] != "env://TYK_TEST_SECRET" || thisStruct.Options["secret"] != "env://TYK_TEST_SECRET" {
+		t.Error("Original was changed: ", thisStruct)
+	}
+	if thisStruct.RawData["nested"].(map[string]interface{})["secret"] != "env://TYK_TEST_SECRET" {
+		t.Error("Original raw data was changed: ", thisStruct.RawData)
+	}
+
+	// Missing variables are reported
+	thisStruct.Password = "env://TYK_TEST_MISSING_SECRET"
+	resolveSecretsInValue(reflect.ValueOf(thisStruct), resolveFromEnv, &failed)
+	if len(failed) != 1 || failed[0] != "env://TYK_TEST_MISSING_SECRET" {
+		t.Error("Unresolved references should be reported: ", failed)
+	}
+}
+
+func TestResolveSecretsFromStores(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/secret/data/tyk":
+			if r.Header.Get("X-Vault-Token") != "vault-token" {
+				w.WriteHeader(403)
+				return
+			}
+			w.Write([]byte(`{"data": {"data": {"password": "from-vault"}, "metadata": {"version": 1}}}`))
+		case "/v1/kv/tyk/password":
+			w.Write([]byte("from-consul"))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	stores := SecretsConfig{
+		Vault:  SecretStoreConfig{Address: server.URL, Token: "vault-token"},
+		Consul: SecretStoreConfig{Address: server.URL},
+	}
+
+	if secret, err := ResolveSecret("vault://secret/data/tyk#password", stores); err != nil || secret != "from-vault" {
+		t.Error("Vault secret not resolved: ", secret, err)
+	}
+	if secret, err := ResolveSecret("consul://tyk/password", stores); err != nil || secret != "from-consul" {
+		t.Error("Consul secret not resolved: ", secret, err)
+	}
+	if _, err := ResolveSecret("vault://secret/data/tyk#missing", stores); err == nil {
+		t.Error("Missing Vault fields should fail")
+	}
+}
+
+func TestSecretAllowList(t *testing.T) {
+	allowList := SecretAllowList{Env: []string{"TYK_API_"}, Vault: []string{"secret/data/apis/"}}
+
+	allowed := []string{"env://TYK_API_TOKEN", "vault://secret/data/apis/payments#key", "plain value"}
+	for _, reference := range allowed {
+		if !allowList.Allows(reference) {
+			t.Error("Reference should be allowed: ", reference)
+		}
+	}
+
+	denied := []string{"env://TYK_SECRET", "vault://secret/data/tyk#password", "vault://secret/data/apis/../tyk", "consul://tyk/password"}
+	for _, reference := range denied {
+		if allowList.Allows(reference) {
+			t.Error("Reference should be denied: ", reference)
+		}
+	}
+}
+
+func makeSecretsTestSpec(targetURL string) APISpec {
+	loader := APIDefinitionLoader{}
+	thisDef, thisRawDef := loader.ParseDefinition([]byte(strings.Replace(nonExpiringDef, `"target_url": "http://lonelycode.com"`, `"target_url": "`+targetURL+`"`, 1)))
+	thisDef.RawData = thisRawDef
+
+	return loader.MakeSpec(thisDef)
+}
+
+func TestAPIDefinitionSecrets(t *testing.T) {
+	os.Setenv("TYK_API_TARGET", "http://upstream.internal")
+	os.Setenv("TYK_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("TYK_API_TARGET")
+	defer os.Unsetenv("TYK_TEST_SECRET")
+
+	config.Secrets.APIAllowList = SecretAllowList{Env: []string{"TYK_API_"}}
+	defer func() { config.Secrets.APIAllowList = SecretAllowList{} }()
+
+	spec := makeSecretsTestSpec("env://TYK_API_TARGET")
+	if spec.SecretsErr != nil || spec.Proxy.TargetURL != "http://upstream.internal" {
+		t.Fatal("Allowed reference wasn't resolved: ", spec.Proxy.TargetURL, spec.SecretsErr)
+	}
+	if spec.RawData["proxy"].(map[string]interface{})["target_url"] != "http://upstream.internal" {
+		t.Error("Raw data wasn't resolved: ", spec.RawData["proxy"])
+	}
+	if spec.UnresolvedDefinition.Proxy.TargetURL != "env://TYK_API_TARGET" {
+		t.Error("The definition returned by the API should keep its references: ", spec.UnresolvedDefinition.Proxy.TargetURL)
+	}
+
+	oldSpecs := getApiSpecs()
+	setApiSpecs(map[string]*APISpec{spec.APIID: &spec})
+	defer setApiSpecs(oldSpecs)
+	responseMessage, _ := HandleGetAPI(spec.APIID)
+	if strings.Contains(string(responseMessage), "upstream.internal") {
+		t.Error("Resolved secrets shouldn't be returned: ", string(responseMessage))
+	}
+
+	spec = makeSecretsTestSpec("env://TYK_TEST_SECRET")
+	if spec.SecretsErr == nil || spec.Proxy.TargetURL == "s3cret" {
+		t.Error("References that aren't on the allow list shouldn't be resolved: ", spec.Proxy.TargetURL)
+	}
+
+	spec = makeSecretsTestSpec("env://TYK_API_MISSING")
+	if spec.SecretsErr == nil {
+		t.Error("APIs with references that don't resolve shouldn't load")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// Sessions are cached for this many seconds unless cached_session_timeout is set
+const SESSION_CACHE_DEFAULT_TTL = 10
+
+// SessionCache keeps recently used sessions in memory so key lookups don't need a Redis round trip
+// on every request. Entries expire after a short TTL and are dropped on all nodes when a key is
+// changed through the API (see notifyKeySpaceChanged). Sessions are cached by the namespace of their
+// store (see KeyNamespaceStorage) and the public hash of the key, so notifications never carry the
+// key itself. Sessions are kept as JSON so that cached copies never share access rights maps with the
+// sessions handed out to middleware
+type SessionCache struct {
+	cache      *lruCache
+	ttl        int64
+	namespaces map[string]bool
+}
+
+// LocalSessionCache is only set if local_session_cache is enabled
+var LocalSessionCache *SessionCache
+
+func NewSessionCache(ttl int64, maxEntries int) *SessionCache {
+	if ttl < 1 {
+		ttl = SESSION_CACHE_DEFAULT_TTL
+	}
+
+	return &SessionCache{cache: newLRUCache(maxEntries), ttl: ttl, namespaces: make(map[string]bool)}
+}
+
+// Get returns the cached session JSON of a key
+func (s *SessionCache) Get(namespace string, keyHash string) (string, bool) {
+	s.cache.Lock()
+	defer s.cache.Unlock()
+
+	entry, ok := s.cache.get(namespace + keyHash)
+	if !ok {
+		return "", false
+	}
+
+	return entry.value, true
+}
+
+// Set caches the session JSON of a key
+func (s *SessionCache) Set(namespace string, keyHash string, sessionJSON string) {
+	s.cache.Lock()
+	s.namespaces[namespace] = true
+	s.cache.set(namespace+keyHash, sessionJSON, lruExpiry(s.ttl))
+	s.cache.Unlock()
+}
+
+// Invalidate drops a key from the cache, an empty namespace drops it from every namespace
+func (s *SessionCache) Invalidate(namespace string, keyHash string) {
+	s.cache.Lock()
+	if namespace != "" {
+		s.cache.remove(namespace + keyHash)
+	} else {
+		for cachedNamespace, _ := range s.namespaces {
+			s.cache.remove(cachedNamespace + keyHash)
+		}
+	}
+	s.cache.Unlock()
+}
+
+// Flush drops all cached sessions
+func (s *SessionCache) Flush() {
+	s.cache.Lock()
+	for keyName, _ := range s.cache.entries {
+		s.cache.remove(keyName)
+	}
+	s.cache.Unlock()
+}
+
+// handleKeySpaceChanged invalidates a key changed on another node in every namespace, an empty hash
+// flushes the whole cache
+func handleKeySpaceChanged(keyHash string) {
+	if LocalSessionCache == nil {
+		return
+	}
+
+	if keyHash == "" {
+		log.Debug("Key space changed, flushing session cache")
+		LocalSessionCache.Flush()
+		return
+	}
+
+	LocalSessionCache.Invalidate("", keyHash)
+}
+
+// notifyKeySpaceChanged drops a key from the session caches of this and all other nodes, keyHash is
+// the public hash of the key (see publicHash). The cache must be enabled on all nodes for the
+// notification to be sent
+func notifyKeySpaceChanged(keyHash string) {
+	if LocalSessionCache == nil {
+		return
+	}
+
+	handleKeySpaceChanged(keyHash)
+	MainNotifier.Notify(Notification{
+		Command: NoticeKeySpaceChanged,
+		Payload: keyHash,
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSessionCacheReadThrough(t *testing.T) {
+	LocalSessionCache = NewSessionCache(60, 10)
+	defer func() { LocalSessionCache = nil }()
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	sessionManager := DefaultSessionManager{Store: store, CacheSessions: true}
+
+	thisSession := createSampleSession()
+	sessionManager.UpdateSession("cached-key", thisSession, 0)
+
+	// Change the stored copy behind the manager's back, the cached session should still be returned
+	store.DeleteKey("cached-key")
+	if _, found := sessionManager.GetSessionDetail("cached-key"); !found {
+		t.Fatal("Session should have been served from the cache")
+	}
+
+	handleKeySpaceChanged(publicHash("cached-key"))
+	if _, found := sessionManager.GetSessionDetail("cached-key"); found {
+		t.Error("Invalidated session should be read from the store")
+	}
+
+	sessionManager.UpdateSession("cached-key", thisSession, 0)
+	sessionManager.RemoveSession("cached-key")
+	if _, found := sessionManager.GetSessionDetail("cached-key"); found {
+		t.Error("Removed session should not be cached")
+	}
+}
+
+func TestSessionCacheNamespaces(t *testing.T) {
+	LocalSessionCache = NewSessionCache(60, 10)
+	defer func() { LocalSessionCache = nil }()
+
+	// The same key in two namespaces, e.g. an isolated API and the shared store
+	sharedManager := DefaultSessionManager{Store: &LRUStorageManager{KeyPrefix: "apikey-"}, CacheSessions: true}
+	isolatedManager := DefaultSessionManager{Store: &LRUStorageManager{KeyPrefix: "tenant-a.apikey-"}, CacheSessions: true}
+
+	sharedSession := createSampleSession()
+	isolatedSession := createSampleSession()
+	isolatedSession.Rate = sharedSession.Rate + 1
+	sharedManager.UpdateSession("same-key", sharedSession, 0)
+	isolatedManager.UpdateSession("same-key", isolatedSession, 0)
+
+	if thisSession, _ := sharedManager.GetSessionDetail("same-key"); thisSession.Rate != sharedSession.Rate {
+		t.Error("Namespaces should be cached separately: ", thisSession.Rate)
+	}
+
+	LocalSessionCache.Invalidate("tenant-a.apikey-", publicHash("same-key"))
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("same-key")); !found {
+		t.Error("Other namespaces should stay cached")
+	}
+
+	handleKeySpaceChanged(publicHash("same-key"))
+	if _, found := LocalSessionCache.Get("apikey-", publicHash("same-key")); found {
+		t.Error("Notifications should drop the key from every namespace")
+	}
+}
+
+func TestSessionCacheFlush(t *testing.T) {
+	thisCache := NewSessionCache(60, 2)
+	thisCache.Set("", "a", "{}")
+	thisCache.Set("", "b", "{}")
+	thisCache.Set("", "c", "{}")
+
+	if _, found := thisCache.Get("", "a"); found {
+		t.Error("Oldest entry should have been evicted")
+	}
+
+	thisCache.Flush()
+	if _, found := thisCache.Get("", "c"); found {
+		t.Error("Cache should be empty after a flush")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"reflect"
+)
+
+const (
+	SessionCodecJSON    = "json"
+	SessionCodecMsgpack = "msgpack"
+
+	// sessionMsgpackMarker starts every msgpack encoded session, 0xc1 is never used by msgpack and can't
+	// start a JSON document so the two encodings can't be mistaken for each other
+	sessionMsgpackMarker = "\xc1"
+)
+
+// sessionMsgpackFields are the msgpack names of the fields of SessionState, msgpack uses the Go names
+var sessionMsgpackFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(SessionState{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields[t.Field(i).Name] = true
+		}
+	}
+
+	return fields
+}()
+
+// IsValidSessionCodec checks the session codec set in tyk.conf, empty means json
+func IsValidSessionCodec(codec string) bool {
+	switch codec {
+	case "", SessionCodecJSON, SessionCodecMsgpack:
+		return true
+	}
+
+	return false
+}
+
+// encodeSession encodes a session for the key store with the codec set in tyk.conf
+func encodeSession(session SessionState) (string, error) {
+	if config.SessionCodec != SessionCodecMsgpack {
+		asJSON, err := json.Marshal(session)
+		return string(asJSON), err
+	}
+
+	if session.SchemaVersion < SessionSchemaVersion {
+		session.SchemaVersion = SessionSchemaVersion
+	}
+
+	encoded, err := msgpack.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	if len(session.unknownFields) > 0 {
+		if encoded, err = addMsgpackUnknownFields(encoded, session.unknownFields); err != nil {
+			return "", err
+		}
+	}
+
+	return sessionMsgpackMarker + string(encoded), nil
+}
+
+// addMsgpackUnknownFields writes the fields a session was read with but this node doesn't know back
+// into its msgpack encoding
+func addMsgpackUnknownFields(encoded []byte, unknownFields map[string]json.RawMessage) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := msgpack.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+
+	for name, value := range unknownFields {
+		var decoded interface{}
+		if err := json.Unmarshal(value, &decoded); err != nil {
+			return nil, err
+		}
+		fields[name] = decoded
+	}
+
+	return msgpack.Marshal(fields)
+}
+
+// msgpackUnknownFields returns the fields of a msgpack session this node doesn't know, every field is
+// encoded so only a session with more fields than SessionState (written by a newer node) is decoded
+// a second time
+func msgpackUnknownFields(encoded []byte) (map[string]json.RawMessage, error) {
+	fieldCount, err := msgpack.NewDecoder(bytes.NewReader(encoded)).DecodeMapLen()
+	if err != nil || fieldCount <= len(sessionMsgpackFields) {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := msgpack.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+
+	unknownFields := make(map[string]json.RawMessage)
+	for name, value := range fields {
+		if sessionMsgpackFields[name] {
+			continue
+		}
+
+		asJSON, err := json.Marshal(normaliseMsgpackValue(value))
+		if err != nil {
+			return nil, err
+		}
+		unknownFields[name] = asJSON
+	}
+
+	return unknownFields, nil
+}
+
+// decodeSession decodes a stored session whichever codec it was written with, so the codec can be
+// switched without rewriting the key store
+func decodeSession(encoded string, session *SessionState) error {
+	if len(encoded) == 0 || encoded[:1] != sessionMsgpackMarker {
+		if err := json.Unmarshal([]byte(encoded), session); err != nil {
+			return err
+		}
+		session.markMetadataStored()
+		return nil
+	}
+
+	var decoded SessionState
+	if err := msgpack.Unmarshal([]byte(encoded[1:]), &decoded); err != nil {
+		return err
+	}
+
+	// Fields written by a newer node are kept so they are written back unchanged
+	unknownFields, err := msgpackUnknownFields([]byte(encoded[1:]))
+	if err != nil {
+		return err
+	}
+	if len(unknownFields) > 0 {
+		decoded.unknownFields = unknownFields
+	}
+
+	decoded.MetaData = normaliseMsgpackValue(decoded.MetaData)
+	decoded.migrate(nil)
+	decoded.markMetadataStored()
+	*session = decoded
+
+	return nil
+}
+
+// normaliseMsgpackValue turns the maps msgpack decodes free-form data into back into the JSON style
+// maps the rest of the gateway (and the JSVM) expects
+func normaliseMsgpackValue(value interface{}) interface{} {
+	switch thisValue := value.(type) {
+	case map[interface{}]interface{}:
+		normalised := make(map[string]interface{}, len(thisValue))
+		for k, v := range thisValue {
+			normalised[fmt.Sprint(k)] = normaliseMsgpackValue(v)
+		}
+		return normalised
+	case map[string]interface{}:
+		for k, v := range thisValue {
+			thisValue[k] = normaliseMsgpackValue(v)
+		}
+		return thisValue
+	case []interface{}:
+		for i, v := range thisValue {
+			thisValue[i] = normaliseMsgpackValue(v)
+		}
+		return thisValue
+	}
+
+	return value
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"gopkg.in/vmihailenco/msgpack.v2"
+	"testing"
+)
+
+func TestSessionCodecMsgpack(t *testing.T) {
+	config.SessionCodec = SessionCodecMsgpack
+	defer func() { config.SessionCodec = "" }()
+
+	thisSession := createSampleSession()
+	thisSession.MetaData = map[string]interface{}{"plan": "gold", "limits": map[string]interface{}{"seats": 5}}
+	thisSession.SpikeArrest = SpikeArrest{Rate: 10, Per: 1}
+
+	encoded, err := encodeSession(thisSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asJSON, _ := json.Marshal(thisSession)
+	if len(encoded) >= len(asJSON) {
+		t.Error("msgpack session should be smaller than JSON: ", len(encoded), len(asJSON))
+	}
+
+	var decoded SessionState
+	if err := decodeSession(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Rate != thisSession.Rate || decoded.SpikeArrest.Rate != 10 || decoded.SchemaVersion != SessionSchemaVersion {
+		t.Error("Session didn't survive the round trip: ", decoded)
+	}
+
+	// Free-form metadata must still encode as JSON for the API and the JSVM
+	if _, err := json.Marshal(decoded.MetaData); err != nil {
+		t.Error("Metadata wasn't normalised: ", err)
+	}
+	limits, _ := decoded.MetaData.(map[string]interface{})["limits"].(map[string]interface{})
+	if limits == nil {
+		t.Error("Nested metadata wasn't normalised: ", decoded.MetaData)
+	}
+}
+
+func TestSessionCodecJSONFallback(t *testing.T) {
+	config.SessionCodec = SessionCodecMsgpack
+	defer func() { config.SessionCodec = "" }()
+
+	var decoded SessionState
+	if err := decodeSession(`{"rate": 7, "per": 1}`, &decoded); err != nil || decoded.Rate != 7 {
+		t.Error("JSON sessions should still be read: ", err)
+	}
+
+	config.SessionCodec = ""
+	encoded, _ := encodeSession(createSampleSession())
+	if encoded[:1] != "{" {
+		t.Error("Sessions should be written as JSON by default")
+	}
+}
+
+func TestSessionCodecMsgpackUnknownFields(t *testing.T) {
+	config.SessionCodec = SessionCodecMsgpack
+	defer func() { config.SessionCodec = "" }()
+
+	// A newer node wrote a field this node doesn't know
+	encoded, _ := encodeSession(createSampleSession())
+	var fields map[string]interface{}
+	msgpack.Unmarshal([]byte(encoded[1:]), &fields)
+	fields["NewerField"] = map[string]interface{}{"enabled": true}
+	newer, _ := msgpack.Marshal(fields)
+
+	var decoded SessionState
+	if err := decodeSession(sessionMsgpackMarker+string(newer), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded.Rate = 99
+
+	reencoded, err := encodeSession(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields = nil
+	msgpack.Unmarshal([]byte(reencoded[1:]), &fields)
+	newerField, _ := normaliseMsgpackValue(fields["NewerField"]).(map[string]interface{})
+	if newerField["enabled"] != true || fields["Rate"] != float64(99) {
+		t.Error("Unknown field should be written back unchanged: ", fields["NewerField"], fields["Rate"])
+	}
+
+	// Unknown fields read from JSON sessions are kept when they are converted
+	if err := decodeSession(`{"rate": 7, "newer_field": [1, 2]}`, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	reencoded, _ = encodeSession(decoded)
+	fields = nil
+	msgpack.Unmarshal([]byte(reencoded[1:]), &fields)
+	if list, _ := fields["newer_field"].([]interface{}); len(list) != 2 {
+		t.Error("Unknown JSON field should be kept: ", fields["newer_field"])
+	}
+}
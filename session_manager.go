@@ -1,21 +1,35 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 
-// AccessSpecs define what URLS a user has access to an what methods are enabled
+// AccessSpecs define what URLS a user has access to an what methods are enabled, enforced by AccessRightsCheck
 type AccessSpec struct {
 	URL     string   `json:"url"`
 	Methods []string `json:"methods"`
 }
 
+// APILimit overrides the rate limit and / or quota of a key for a single API or version, a zero
+// rate or quota_max means the key's own value is used
+type APILimit struct {
+	Rate             float64 `bson:"rate" json:"rate"`
+	Per              float64 `bson:"per" json:"per"`
+	QuotaMax         int64   `bson:"quota_max" json:"quota_max"`
+	QuotaRenews      int64   `bson:"quota_renews" json:"quota_renews"`
+	QuotaRemaining   int64   `bson:"quota_remaining" json:"quota_remaining"`
+	QuotaRenewalRate int64   `bson:"quota_renewal_rate" json:"quota_renewal_rate"`
+}
+
 // AccessDefinition defines which versions of an API a key has access to
 type AccessDefinition struct {
-	APIName     string       `json:"api_name"`
-	APIID       string       `json:"api_id"`
-	Versions    []string     `json:"versions"`
-	AllowedURLs []AccessSpec `bson:"allowed_urls"  json:"allowed_urls"` // mapped string MUST be a valid regex
+	APIName       string              `json:"api_name"`
+	APIID         string              `json:"api_id"`
+	Versions      []string            `json:"versions"`
+	AllowedURLs   []AccessSpec        `bson:"allowed_urls"  json:"allowed_urls"` // mapped string MUST be a valid regex
+	Limit         *APILimit           `bson:"limit" json:"limit,omitempty"`
+	VersionLimits map[string]APILimit `bson:"version_limits" json:"version_limits,omitempty"`
 }
 
 // SessionState objects represent a current API session, mainly used for rate limiting.
@@ -29,6 +43,7 @@ type SessionState struct {
 	QuotaRenews      int64                       `json:"quota_renews"`
 	QuotaRemaining   int64                       `json:"quota_remaining"`
 	QuotaRenewalRate int64                       `json:"quota_renewal_rate"`
+	QuotaAlgorithm   string                      `json:"quota_algorithm"`
 	AccessRights     map[string]AccessDefinition `json:"access_rights"`
 	OrgID            string                      `json:"org_id"`
 	OauthClientID    string                      `json:"oauth_client_id"`
@@ -43,8 +58,38 @@ type SessionState struct {
 	Monitor       struct {
 		TriggerLimits []float64 `json:"trigger_limits"`
 	} `json:"monitor"`
-	MetaData interface{} `json:"meta_data"`
-	Tags     []string    `json:"tags"`
+	MetaData          interface{}    `json:"meta_data"`
+	Tags              []string       `json:"tags"`
+	State             string         `json:"state"`
+	AllowedIPs        []string       `json:"allowed_ips"`
+	AccessWindows     []AccessWindow `json:"access_windows"`
+	LastUsed          int64          `json:"last_used,omitempty"`
+	MaxConcurrent     int64          `json:"max_concurrent"`
+	SpikeArrest       SpikeArrest    `json:"spike_arrest"`
+	MonitorOnlyLimits bool           `json:"monitor_only_limits"`
+	SchemaVersion     int            `json:"schema_version"`
+
+	// Fields written by a newer node, see UnmarshalJSON
+	unknownFields map[string]json.RawMessage
+	// Indexed metadata of a session read from the store, see KeyMetadataIndexer
+	storedMetadataIndex *string
+}
+
+// SpikeArrest smooths out bursts with a second, short rolling window on top of the sustained rate,
+// e.g. at most 10 requests per second on a key allowed 600 per minute. A zero rate disables it,
+// per defaults to one second
+type SpikeArrest struct {
+	Rate int64 `bson:"rate" json:"rate"`
+	Per  int64 `bson:"per" json:"per"`
+}
+
+// window is the length of the spike arrest window in seconds
+func (s SpikeArrest) window() int64 {
+	if s.Per <= 0 {
+		return 1
+	}
+
+	return s.Per
 }
 
 type PublicSessionState struct {
@@ -60,27 +105,157 @@ type PublicSessionState struct {
 }
 
 const (
-	QuotaKeyPrefix     string = "quota-"
-	RateLimitKeyPrefix string = "rate-limit-"
+	QuotaKeyPrefix       string = "quota-"
+	RateLimitKeyPrefix   string = "rate-limit-"
+	SpikeArrestKeyPrefix string = "spike-arrest-"
 )
 
 // SessionLimiter is the rate limiter for the API, use ForwardMessage() to
-// check if a message should pass through or not
-type SessionLimiter struct{}
+// check if a message should pass through or not. If Dimension is set the rate
+// limit is counted separately for each dimension value, quotas are not affected.
+// DisableRateLimit and DisableQuota skip either check (see OrgConfig), UseDRL
+// keeps the rate limit in memory (see DRLConfig)
+type SessionLimiter struct {
+	Dimension        string
+	DisableRateLimit bool
+	DisableQuota     bool
+	UseDRL           bool
+}
 
-// ForwardMessage will enforce rate limiting, returning false if session limits have been exceeded.
-// Key values to manage rate are Rate and Per, e.g. Rate of 10 messages Per 10 seconds
-func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key string, store StorageHandler) (bool, int) {
+// rateKey is the key rate limits are counted under
+func (l SessionLimiter) rateKey(key string) string {
+	if l.Dimension == "" {
+		return key
+	}
+
+	return key + "-dim-" + l.Dimension
+}
 
+// isRedisRateLimited checks the rolling window rate limit of a key
+func (l SessionLimiter) isRedisRateLimited(currentSession *SessionState, key string, store StorageHandler) bool {
 	log.Debug("[RATELIMIT] Inbound raw key is: ", key)
 	rateLimiterKey := RateLimitKeyPrefix + publicHash(key)
 	log.Debug("[RATELIMIT] Rate limiter key is: ", rateLimiterKey)
+
+	if currentSession.SpikeArrest.Rate > 0 {
+		spikeWindow := currentSession.SpikeArrest.window()
+		spikePerPeriodNow := store.SetRollingWindow(SpikeArrestKeyPrefix+publicHash(key), spikeWindow, spikeWindow)
+		if spikePerPeriodNow > int(currentSession.SpikeArrest.Rate)-1 {
+			log.Debug("Spike arrest, num requests: ", spikePerPeriodNow)
+			return true
+		}
+	}
+
 	ratePerPeriodNow := store.SetRollingWindow(rateLimiterKey, int64(currentSession.Per), int64(currentSession.Per))
 
 	log.Debug("Num Requests: ", ratePerPeriodNow)
 
 	// Subtract by 1 because of the delayed add in the window
-	if ratePerPeriodNow > (int(currentSession.Rate) - 1) {
+	return ratePerPeriodNow > (int(currentSession.Rate) - 1)
+}
+
+// isDRLRateLimited checks this node's share of the rate limit and spike arrest of a key
+func (l SessionLimiter) isDRLRateLimited(currentSession *SessionState, key string) bool {
+	if currentSession.SpikeArrest.Rate > 0 {
+		if !DRLManager.Allow(SpikeArrestKeyPrefix+key, float64(currentSession.SpikeArrest.Rate), float64(currentSession.SpikeArrest.window())) {
+			log.Debug("Spike arrest (DRL)")
+			return true
+		}
+	}
+
+	return !DRLManager.Allow(RateLimitKeyPrefix+key, currentSession.Rate, currentSession.Per)
+}
+
+// isRateLimited checks the rate limit of a key with the DRL or Redis
+func (l SessionLimiter) isRateLimited(currentSession *SessionState, key string, store StorageHandler) bool {
+	if l.UseDRL {
+		return l.isDRLRateLimited(currentSession, key)
+	}
+
+	return l.isRedisRateLimited(currentSession, key, store)
+}
+
+// usesFixedQuota is true if the quota of a session is unlimited or uses the default fixed window
+func usesFixedQuota(currentSession *SessionState) bool {
+	if currentSession.QuotaMax == -1 {
+		return true
+	}
+
+	return currentSession.QuotaAlgorithm == "" || currentSession.QuotaAlgorithm == QuotaAlgorithmFixed
+}
+
+// forwardAtomic checks the rate limit and spike arrest of rateSession and the quota of quotaSession with a
+// single call to the store, the error is set if the store can't do this and the separate checks should be used
+func (l SessionLimiter) forwardAtomic(currentSession *SessionState, rateSession *SessionState, rateKey string, quotaSession *SessionState, quotaKey string, store StorageHandler) (bool, int, error) {
+	atomicStore, ok := store.(RateLimitQuotaStorage)
+	if !ok || !usesFixedQuota(quotaSession) {
+		return false, 0, ErrAtomicLimitUnsupported
+	}
+
+	checkQuota := quotaSession.QuotaMax != -1
+	spike := SpikeArrestWindow{
+		Key:   SpikeArrestKeyPrefix + publicHash(rateKey),
+		Per:   rateSession.SpikeArrest.window(),
+		Limit: rateSession.SpikeArrest.Rate,
+	}
+	ratePerPeriodNow, spikePerPeriodNow, qInt, err := atomicStore.RateLimitAndQuota(
+		RateLimitKeyPrefix+publicHash(rateKey), int64(rateSession.Per), int64(rateSession.Rate), spike,
+		QuotaKeyPrefix+publicHash(quotaKey), quotaSession.QuotaRenewalRate, checkQuota)
+	if err != nil {
+		return false, 0, err
+	}
+
+	log.Debug("Num Requests: ", ratePerPeriodNow)
+
+	if spike.Limit > 0 && spikePerPeriodNow > int(spike.Limit)-1 {
+		log.Debug("Spike arrest, num requests: ", spikePerPeriodNow)
+		return false, 1, nil
+	}
+
+	// Subtract by 1 because of the delayed add in the window
+	if ratePerPeriodNow > (int(rateSession.Rate) - 1) {
+		return false, 1, nil
+	}
+
+	currentSession.Allowance--
+	if checkQuota && l.applyFixedQuota(quotaSession, qInt) {
+		return false, 2, nil
+	}
+
+	return true, 0, nil
+}
+
+// forwardPartial applies the checks that aren't disabled one at a time, the atomic check of the store
+// can't be used as it always counts both in Redis
+func (l SessionLimiter) forwardPartial(currentSession *SessionState, rateSession *SessionState, rateKey string, quotaSession *SessionState, quotaKey string, store StorageHandler) (bool, int) {
+	if !l.DisableRateLimit {
+		if l.isRateLimited(rateSession, rateKey, store) {
+			return false, 1
+		}
+		currentSession.Allowance--
+	}
+
+	if !l.DisableQuota && l.IsRedisQuotaExceeded(quotaSession, quotaKey, store) {
+		return false, 2
+	}
+
+	return true, 0
+}
+
+// ForwardMessage will enforce rate limiting, returning false if session limits have been exceeded.
+// Key values to manage rate are Rate and Per, e.g. Rate of 10 messages Per 10 seconds
+func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key string, store StorageHandler) (bool, int) {
+
+	rateKey := l.rateKey(key)
+	if l.DisableRateLimit || l.DisableQuota || l.UseDRL {
+		return l.forwardPartial(currentSession, currentSession, rateKey, currentSession, key, store)
+	}
+
+	if forward, reason, err := l.forwardAtomic(currentSession, currentSession, rateKey, currentSession, key, store); err == nil {
+		return forward, reason
+	}
+
+	if l.isRedisRateLimited(currentSession, rateKey, store) {
 		return false, 1
 	}
 
@@ -93,6 +268,130 @@ func (l SessionLimiter) ForwardMessage(currentSession *SessionState, key string,
 
 }
 
+// GetAPILimit returns the limit override for an API version and the scope its counters are kept under,
+// a version limit takes precedence over the API limit
+func (s *SessionState) GetAPILimit(APIID string, version string) (APILimit, string, bool) {
+	accessDef, ok := s.AccessRights[APIID]
+	if !ok {
+		return APILimit{}, "", false
+	}
+
+	if limit, ok := accessDef.VersionLimits[version]; ok {
+		return limit, APIID + "-" + version, true
+	}
+
+	if accessDef.Limit != nil {
+		return *accessDef.Limit, APIID, true
+	}
+
+	return APILimit{}, "", false
+}
+
+// SetAPILimit stores the updated quota values of a limit override, the access rights are copied
+// because they may be shared with a policy
+func (s *SessionState) SetAPILimit(APIID string, version string, limit APILimit) {
+	newRights := make(map[string]AccessDefinition, len(s.AccessRights))
+	for k, v := range s.AccessRights {
+		newRights[k] = v
+	}
+
+	accessDef := newRights[APIID]
+	if _, ok := accessDef.VersionLimits[version]; ok {
+		newVersionLimits := make(map[string]APILimit, len(accessDef.VersionLimits))
+		for k, v := range accessDef.VersionLimits {
+			newVersionLimits[k] = v
+		}
+		newVersionLimits[version] = limit
+		accessDef.VersionLimits = newVersionLimits
+	} else {
+		accessDef.Limit = &limit
+	}
+
+	newRights[APIID] = accessDef
+	s.AccessRights = newRights
+}
+
+// APILimitScopes lists the counter scopes of all the limit overrides in a session
+func (s *SessionState) APILimitScopes() []string {
+	scopes := []string{}
+	for APIID, accessDef := range s.AccessRights {
+		if accessDef.Limit != nil {
+			scopes = append(scopes, APIID)
+		}
+		for version, _ := range accessDef.VersionLimits {
+			scopes = append(scopes, APIID+"-"+version)
+		}
+	}
+
+	return scopes
+}
+
+// ForwardMessageWithLimit works like ForwardMessage but applies an API limit override, overridden
+// values are counted under limitKey so they are tracked separately from the key's global limits
+func (l SessionLimiter) ForwardMessageWithLimit(currentSession *SessionState, limit *APILimit, key string, limitKey string, store StorageHandler) (bool, int) {
+	rateSession := *currentSession
+	rateKey := key
+	if limit.Rate > 0 {
+		rateSession.Rate = limit.Rate
+		rateSession.Per = limit.Per
+		rateKey = limitKey
+	}
+	rateKey = l.rateKey(rateKey)
+
+	if limit.QuotaMax == 0 {
+		if l.DisableRateLimit || l.DisableQuota || l.UseDRL {
+			return l.forwardPartial(currentSession, &rateSession, rateKey, currentSession, key, store)
+		}
+
+		if forward, reason, err := l.forwardAtomic(currentSession, &rateSession, rateKey, currentSession, key, store); err == nil {
+			return forward, reason
+		}
+
+		if l.isRedisRateLimited(&rateSession, rateKey, store) {
+			return false, 1
+		}
+
+		currentSession.Allowance--
+		if !l.IsRedisQuotaExceeded(currentSession, key, store) {
+			return true, 0
+		}
+		return false, 2
+	}
+
+	quotaSession := *currentSession
+	quotaSession.QuotaMax = limit.QuotaMax
+	quotaSession.QuotaRenews = limit.QuotaRenews
+	quotaSession.QuotaRemaining = limit.QuotaRemaining
+	if limit.QuotaRenewalRate > 0 {
+		quotaSession.QuotaRenewalRate = limit.QuotaRenewalRate
+	}
+
+	if l.DisableRateLimit || l.DisableQuota || l.UseDRL {
+		forward, reason := l.forwardPartial(currentSession, &rateSession, rateKey, &quotaSession, limitKey, store)
+		limit.QuotaRenews = quotaSession.QuotaRenews
+		limit.QuotaRemaining = quotaSession.QuotaRemaining
+		return forward, reason
+	}
+
+	forward, reason, err := l.forwardAtomic(currentSession, &rateSession, rateKey, &quotaSession, limitKey, store)
+	if err != nil {
+		if l.isRedisRateLimited(&rateSession, rateKey, store) {
+			return false, 1
+		}
+
+		currentSession.Allowance--
+		forward, reason = true, 0
+		if l.IsRedisQuotaExceeded(&quotaSession, limitKey, store) {
+			forward, reason = false, 2
+		}
+	}
+
+	limit.QuotaRenews = quotaSession.QuotaRenews
+	limit.QuotaRemaining = quotaSession.QuotaRemaining
+
+	return forward, reason
+}
+
 // ForwardMessageNaiveKey is the old redis-key ttl-based Rate limit, it could be gamed.
 func (l SessionLimiter) ForwardMessageNaiveKey(currentSession *SessionState, key string, store StorageHandler) (bool, int) {
 
@@ -155,9 +454,25 @@ func (l SessionLimiter) IsRedisQuotaExceeded(currentSession *SessionState, key s
 	log.Debug("[QUOTA] Inbound raw key is: ", key)
 	rawKey := QuotaKeyPrefix + publicHash(key)
 	log.Debug("[QUOTA] Quota limiter key is: ", rawKey)
+
+	switch currentSession.QuotaAlgorithm {
+	case QuotaAlgorithmCalendarMonthly:
+		return l.isCalendarQuotaExceeded(currentSession, rawKey, store)
+	case QuotaAlgorithmSliding:
+		if currentSession.QuotaRenewalRate > 0 {
+			return l.isSlidingQuotaExceeded(currentSession, rawKey, store)
+		}
+		log.Warning("Sliding quota needs a quota_renewal_rate, using a fixed window")
+	}
+
 	// INCR the key (If it equals 1 - set EXPIRE)
 	qInt := store.IncrememntWithExpire(rawKey, currentSession.QuotaRenewalRate)
 
+	return l.applyFixedQuota(currentSession, qInt)
+}
+
+// applyFixedQuota checks the counter of a fixed window quota and updates the session values
+func (l SessionLimiter) applyFixedQuota(currentSession *SessionState, qInt int64) bool {
 	// if the returned val is >= quota: block
 	if (int64(qInt) - 1) >= currentSession.QuotaMax {
 		return true
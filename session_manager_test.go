@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAPILimitOverrides(t *testing.T) {
+	policyRights := map[string]AccessDefinition{
+		"api-a": {APIID: "api-a", Versions: []string{"Default", "v2"}, Limit: &APILimit{QuotaMax: 2}, VersionLimits: map[string]APILimit{"v2": {QuotaMax: 1}}},
+		"api-b": {APIID: "api-b", Versions: []string{"Default"}},
+	}
+
+	thisSession := createSampleSession()
+	thisSession.QuotaMax = 100
+	thisSession.AccessRights = policyRights
+
+	if _, _, found := thisSession.GetAPILimit("api-b", "Default"); found {
+		t.Error("API without a limit should use the key's limits")
+	}
+
+	thisLimit, limitScope, found := thisSession.GetAPILimit("api-a", "v2")
+	if !found || limitScope != "api-a-v2" || thisLimit.QuotaMax != 1 {
+		t.Fatal("Version limit should take precedence: ", limitScope, thisLimit)
+	}
+
+	store := &InMemoryStorageManager{Sessions: make(map[string]string)}
+	limiter := SessionLimiter{}
+
+	thisLimit, limitScope, _ = thisSession.GetAPILimit("api-a", "Default")
+	for i := 0; i < 2; i++ {
+		if forward, _ := limiter.ForwardMessageWithLimit(&thisSession, &thisLimit, "key", "key-"+limitScope, store); !forward {
+			t.Fatal("Request should be within the API quota: ", i+1)
+		}
+	}
+
+	if forward, reason := limiter.ForwardMessageWithLimit(&thisSession, &thisLimit, "key", "key-"+limitScope, store); forward || reason != 2 {
+		t.Error("API quota should be exceeded")
+	}
+
+	thisSession.SetAPILimit("api-a", "Default", thisLimit)
+	if thisSession.AccessRights["api-a"].Limit.QuotaRemaining != 0 {
+		t.Error("Quota remaining was not stored on the API limit")
+	}
+
+	if policyRights["api-a"].Limit.QuotaRemaining != 0 || policyRights["api-a"].Limit == thisSession.AccessRights["api-a"].Limit {
+		t.Error("Shared policy access rights were modified")
+	}
+
+	if len(thisSession.APILimitScopes()) != 2 {
+		t.Error("Expected two limit scopes, got: ", thisSession.APILimitScopes())
+	}
+}
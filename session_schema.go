@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SessionSchemaVersion is the version of the SessionState layout written by this node, bump it and add
+// a migration when the meaning of a stored field changes
+const SessionSchemaVersion = 1
+
+// sessionMigrations upgrade a session from the version they are keyed by to the next one, raw holds
+// every field of the stored session so renamed fields can still be read
+var sessionMigrations = map[int]func(session *SessionState, raw map[string]json.RawMessage){
+	// Sessions written before versioning have the same layout, they only need the version
+	0: func(session *SessionState, raw map[string]json.RawMessage) {},
+}
+
+// sessionStateFields are the lower cased JSON names of the fields of SessionState, encoding/json
+// matches names case insensitively
+var sessionStateFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(SessionState{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := configFieldName(field)
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		fields[strings.ToLower(name)] = true
+	}
+
+	return fields
+}()
+
+// sessionStateJSON has the fields of SessionState without its JSON methods
+type sessionStateJSON SessionState
+
+// UnmarshalJSON decodes a stored session, fields this node doesn't know (written by a newer node) are
+// kept so they are written back unchanged, sessions of an older schema are migrated
+func (s *SessionState) UnmarshalJSON(data []byte) error {
+	var decoded sessionStateJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*s = SessionState(decoded)
+	for name, value := range raw {
+		if !sessionStateFields[strings.ToLower(name)] {
+			if s.unknownFields == nil {
+				s.unknownFields = make(map[string]json.RawMessage)
+			}
+			s.unknownFields[name] = value
+		}
+	}
+
+	s.migrate(raw)
+	return nil
+}
+
+// migrate runs the migrations from the session's schema version to this node's, a session written by a
+// newer node keeps its version
+func (s *SessionState) migrate(raw map[string]json.RawMessage) {
+	for s.SchemaVersion < SessionSchemaVersion {
+		if migration, found := sessionMigrations[s.SchemaVersion]; found {
+			migration(s, raw)
+		}
+		s.SchemaVersion++
+	}
+}
+
+// MarshalJSON encodes a session with the current schema version, the unknown fields it was read with
+// are added back
+func (s SessionState) MarshalJSON() ([]byte, error) {
+	if s.SchemaVersion < SessionSchemaVersion {
+		s.SchemaVersion = SessionSchemaVersion
+	}
+
+	encoded, err := json.Marshal(sessionStateJSON(s))
+	if err != nil || len(s.unknownFields) == 0 {
+		return encoded, err
+	}
+
+	names := []string{}
+	for name, _ := range s.unknownFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	buffer.Write(encoded[:len(encoded)-1])
+	for _, name := range names {
+		encodedName, _ := json.Marshal(name)
+		buffer.WriteByte(',')
+		buffer.Write(encodedName)
+		buffer.WriteByte(':')
+		buffer.Write(s.unknownFields[name])
+	}
+	buffer.WriteByte('}')
+
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSessionUnknownFieldsPreserved(t *testing.T) {
+	stored := `{"rate": 10, "per": 60, "Quota_Max": 5, "schema_version": 3, "loyalty_tier": {"level": "gold"}}`
+
+	var thisSession SessionState
+	if err := json.Unmarshal([]byte(stored), &thisSession); err != nil {
+		t.Fatal(err)
+	}
+	if thisSession.Rate != 10 || thisSession.QuotaMax != 5 {
+		t.Error("Known fields weren't decoded: ", thisSession)
+	}
+	if len(thisSession.unknownFields) != 1 {
+		t.Error("Only the field from the newer node should be kept: ", thisSession.unknownFields)
+	}
+
+	thisSession.Rate = 20
+	asJSON, _ := json.Marshal(thisSession)
+	if !strings.Contains(string(asJSON), `"loyalty_tier":{"level":"gold"}`) {
+		t.Error("Unknown field wasn't written back: ", string(asJSON))
+	}
+
+	var reread SessionState
+	json.Unmarshal(asJSON, &reread)
+	if reread.Rate != 20 || reread.SchemaVersion != 3 {
+		t.Error("Newer schema version should be kept: ", reread.SchemaVersion)
+	}
+}
+
+func TestSessionSchemaMigration(t *testing.T) {
+	originalMigration := sessionMigrations[0]
+	sessionMigrations[0] = func(session *SessionState, raw map[string]json.RawMessage) {
+		json.Unmarshal(raw["old_rate"], &session.Rate)
+	}
+	defer func() { sessionMigrations[0] = originalMigration }()
+
+	var thisSession SessionState
+	if err := json.Unmarshal([]byte(`{"old_rate": 15}`), &thisSession); err != nil {
+		t.Fatal(err)
+	}
+	if thisSession.Rate != 15 || thisSession.SchemaVersion != SessionSchemaVersion {
+		t.Error("Session should be migrated to the current version: ", thisSession.Rate, thisSession.SchemaVersion)
+	}
+
+	var current SessionState
+	json.Unmarshal([]byte(`{"old_rate": 15, "schema_version": 1}`), &current)
+	if current.Rate != 0 {
+		t.Error("Session of the current version shouldn't be migrated")
+	}
+
+	created := createSampleSession()
+	asJSON, _ := json.Marshal(created)
+	if !strings.Contains(string(asJSON), `"schema_version":1`) {
+		t.Error("New sessions should be written with the current version: ", string(asJSON))
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	textTemplate "text/template"
+)
+
+const (
+	SOAP_11_NAMESPACE    = "http://schemas.xmlsoap.org/soap/envelope/"
+	SOAP_12_NAMESPACE    = "http://www.w3.org/2003/05/soap-envelope"
+	SOAP_11_CONTENT_TYPE = "text/xml; charset=utf-8"
+	SOAP_12_CONTENT_TYPE = "application/soap+xml; charset=utf-8"
+)
+
+// SOAPMeta is a soap entry in a version's extended_paths. The template renders the contents of the
+// SOAP body from the JSON request, the gateway adds the envelope and unwraps the response to JSON
+type SOAPMeta struct {
+	Path           string `mapstructure:"path" bson:"path" json:"path"`
+	Method         string `mapstructure:"method" bson:"method" json:"method"`
+	SOAPAction     string `mapstructure:"soap_action" bson:"soap_action" json:"soap_action"`
+	SOAPVersion    string `mapstructure:"soap_version" bson:"soap_version" json:"soap_version"`
+	TemplateMode   string `mapstructure:"template_mode" bson:"template_mode" json:"template_mode"`
+	TemplateSource string `mapstructure:"template_source" bson:"template_source" json:"template_source"`
+	ExposeContext  bool   `mapstructure:"expose_context" bson:"expose_context" json:"expose_context"`
+}
+
+// SOAPModuleConfig reads the soap entries of each version from the raw definition
+type SOAPModuleConfig struct {
+	VersionData struct {
+		Versions map[string]struct {
+			ExtendedPaths struct {
+				SOAP []SOAPMeta `mapstructure:"soap"`
+			} `mapstructure:"extended_paths"`
+		} `mapstructure:"versions"`
+	} `mapstructure:"version_data"`
+}
+
+type compiledSOAPPath struct {
+	path     *regexp.Regexp
+	method   string
+	action   string
+	version  string
+	template *textTemplate.Template
+	context  bool
+}
+
+// HasSOAPPaths is used to add the response unwrapping processor to APIs that use SOAP
+func HasSOAPPaths(spec *APISpec) bool {
+	var thisModuleConfig SOAPModuleConfig
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig); err != nil {
+		return false
+	}
+
+	for _, version := range thisModuleConfig.VersionData.Versions {
+		if len(version.ExtendedPaths.SOAP) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CompileSOAPPaths loads the templates of each version once at load time, entries with templates
+// that fail to load are logged and skipped
+func CompileSOAPPaths(thisModuleConfig SOAPModuleConfig) map[string][]compiledSOAPPath {
+	apiLangIDsRegex := regexp.MustCompile("{(.*?)}")
+	loader := APIDefinitionLoader{}
+
+	compiled := make(map[string][]compiledSOAPPath)
+	for versionName, version := range thisModuleConfig.VersionData.Versions {
+		for _, entry := range version.ExtendedPaths.SOAP {
+			pathRegex, err := regexp.Compile(apiLangIDsRegex.ReplaceAllString(entry.Path, "(.*?)"))
+			if err != nil {
+				log.Error("Invalid soap path ", entry.Path, ", skipping: ", err)
+				continue
+			}
+
+			var template *textTemplate.Template
+			switch entry.TemplateMode {
+			case "file":
+				template, err = loader.loadFileTemplate(entry.TemplateSource)
+			case "blob":
+				template, err = loader.loadBlobTemplate(entry.TemplateSource)
+			default:
+				err = errors.New("No valid template mode defined, must be either 'file' or 'blob'.")
+			}
+			if err != nil {
+				log.Error("SOAP template load failure for ", entry.Path, ", skipping: ", err)
+				continue
+			}
+
+			compiled[versionName] = append(compiled[versionName], compiledSOAPPath{
+				path:     pathRegex,
+				method:   entry.Method,
+				action:   entry.SOAPAction,
+				version:  entry.SOAPVersion,
+				template: template,
+				context:  entry.ExposeContext,
+			})
+		}
+	}
+
+	return compiled
+}
+
+// soapEnvelope wraps the rendered body in a SOAP envelope and returns it with its content type
+func soapEnvelope(body []byte, version string, action string) ([]byte, string) {
+	namespace := SOAP_11_NAMESPACE
+	contentType := SOAP_11_CONTENT_TYPE
+	if version == "1.2" {
+		namespace = SOAP_12_NAMESPACE
+		contentType = SOAP_12_CONTENT_TYPE
+		if action != "" {
+			contentType += "; action=" + strconv.Quote(action)
+		}
+	}
+
+	var envelope bytes.Buffer
+	envelope.WriteString(xml.Header)
+	envelope.WriteString(`<soap:Envelope xmlns:soap="` + namespace + `"><soap:Body>`)
+	envelope.Write(body)
+	envelope.WriteString(`</soap:Body></soap:Envelope>`)
+
+	return envelope.Bytes(), contentType
+}
+
+// xmlEscapeValues escapes the strings in the template data, the templates build XML from values
+// sent by the client
+func xmlEscapeValues(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case string:
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(typedValue))
+		return escaped.String()
+	case []string:
+		escaped := make([]interface{}, len(typedValue))
+		for i, item := range typedValue {
+			escaped[i] = xmlEscapeValues(item)
+		}
+		return escaped
+	case []interface{}:
+		escaped := make([]interface{}, len(typedValue))
+		for i, item := range typedValue {
+			escaped[i] = xmlEscapeValues(item)
+		}
+		return escaped
+	case map[string]string:
+		escaped := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			escaped[xmlEscapeValues(key).(string)] = xmlEscapeValues(item)
+		}
+		return escaped
+	case map[string]interface{}:
+		escaped := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			escaped[xmlEscapeValues(key).(string)] = xmlEscapeValues(item)
+		}
+		return escaped
+	}
+
+	return value
+}
+
+// SOAPTransform turns JSON requests into SOAP calls for endpoints with a soap entry
+type SOAPTransform struct {
+	*TykMiddleware
+}
+
+// New lets you do any initialisations for the object can be done here
+func (s *SOAPTransform) New() {}
+
+// GetConfig retrieves the configuration from the API config - we user mapstructure for this for simplicity
+func (s *SOAPTransform) GetConfig() (interface{}, error) {
+	var thisModuleConfig SOAPModuleConfig
+
+	err := mapstructure.Decode(s.TykMiddleware.Spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	return CompileSOAPPaths(thisModuleConfig), nil
+}
+
+// ProcessRequest will run any checks on the request on the way through the system, return an error to have the chain fail
+func (s *SOAPTransform) ProcessRequest(w http.ResponseWriter, r *http.Request, configuration interface{}) (error, int) {
+	soapPaths := configuration.(map[string][]compiledSOAPPath)
+	if len(soapPaths) == 0 {
+		return nil, 200
+	}
+
+	_, _, _, stat := s.Spec.GetVersionData(r)
+	if stat != StatusOk {
+		return nil, 200
+	}
+
+	versionKey, _ := context.Get(r, VersionKeyContext).(string)
+	for _, soapPath := range soapPaths[versionKey] {
+		if !strings.EqualFold(soapPath.method, r.Method) || !soapPath.path.MatchString(r.URL.Path) {
+			continue
+		}
+
+		var bodyData map[string]interface{}
+		if r.Body != nil {
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			json.Unmarshal(body, &bodyData)
+		}
+		if bodyData == nil {
+			bodyData = make(map[string]interface{})
+		}
+		if soapPath.context {
+			bodyData["_tyk_context"] = GetContextVars(r)
+		}
+
+		var soapBody bytes.Buffer
+		if err := soapPath.template.Execute(&soapBody, xmlEscapeValues(bodyData)); err != nil {
+			log.Error("Failed to apply SOAP template to request: ", err)
+			return errors.New("Failed to create SOAP request"), 500
+		}
+
+		envelope, contentType := soapEnvelope(soapBody.Bytes(), soapPath.version, soapPath.action)
+
+		// SOAP calls are always POSTs
+		r.Method = "POST"
+		r.Body = ioutil.NopCloser(bytes.NewReader(envelope))
+		r.ContentLength = int64(len(envelope))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Accept", contentType)
+		if soapPath.version != "1.2" {
+			r.Header.Set("SOAPAction", strconv.Quote(soapPath.action))
+		}
+
+		context.Set(r, SOAPRequest, true)
+		return nil, 200
+	}
+
+	return nil, 200
+}
+
+// SOAPResponseHandler unwraps the SOAP responses of requests made by SOAPTransform into JSON, the
+// contents of the SOAP body become the response and a fault becomes {"fault": {...}}
+type SOAPResponseHandler struct {
+	Spec *APISpec
+}
+
+func (h SOAPResponseHandler) New(c interface{}, spec *APISpec) (TykResponseHandler, error) {
+	return SOAPResponseHandler{Spec: spec}, nil
+}
+
+func (h SOAPResponseHandler) HandleResponse(rw http.ResponseWriter, res *http.Response, req *http.Request, ses *SessionState) error {
+	if isSOAP, _ := context.Get(req, SOAPRequest).(bool); !isSOAP {
+		return nil
+	}
+
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	bodyData, err := unwrapSOAPBody(body)
+	if err != nil {
+		// Leave responses that aren't SOAP as they are
+		log.Warning("Couldn't unwrap SOAP response: ", err)
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+
+	asJSON, _ := json.Marshal(bodyData)
+	res.ContentLength = int64(len(asJSON))
+	res.Header.Set("Content-Length", strconv.Itoa(len(asJSON)))
+	res.Header.Set("Content-Type", "application/json")
+	res.Body = ioutil.NopCloser(bytes.NewReader(asJSON))
+
+	return nil
+}
+
+// xmlNode is a generic XML element used to convert SOAP bodies to JSON
+type xmlNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Content  string     `xml:",chardata"`
+	Children []xmlNode  `xml:",any"`
+}
+
+// unwrapSOAPBody returns the first element of the SOAP body converted to JSON
+func unwrapSOAPBody(body []byte) (interface{}, error) {
+	var envelope xmlNode
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		// Upstreams that declare a charset other than UTF-8 are read as is
+		return input, nil
+	}
+	if err := decoder.Decode(&envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.XMLName.Local != "Envelope" {
+		return nil, errors.New("Response is not a SOAP envelope")
+	}
+
+	for _, child := range envelope.Children {
+		if child.XMLName.Local != "Body" {
+			continue
+		}
+
+		if len(child.Children) == 0 {
+			return map[string]interface{}{}, nil
+		}
+
+		content := child.Children[0]
+		if content.XMLName.Local == "Fault" {
+			return map[string]interface{}{"fault": content.toJSON()}, nil
+		}
+
+		return map[string]interface{}{content.XMLName.Local: content.toJSON()}, nil
+	}
+
+	return nil, errors.New("SOAP envelope has no body")
+}
+
+// toJSON converts an element, attributes are prefixed with "@", repeated elements become lists and
+// elements with only text become strings
+func (n xmlNode) toJSON() interface{} {
+	attrs := []xml.Attr{}
+	for _, attr := range n.Attrs {
+		// Namespace declarations aren't data
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+
+	text := strings.TrimSpace(n.Content)
+	if len(n.Children) == 0 && len(attrs) == 0 {
+		return text
+	}
+
+	object := make(map[string]interface{})
+	for _, attr := range attrs {
+		object["@"+attr.Name.Local] = attr.Value
+	}
+
+	for _, child := range n.Children {
+		name := child.XMLName.Local
+		value := child.toJSON()
+
+		existing, found := object[name]
+		if !found {
+			object[name] = value
+			continue
+		}
+
+		if list, isList := existing.([]interface{}); isList {
+			object[name] = append(list, value)
+		} else {
+			object[name] = []interface{}{existing, value}
+		}
+	}
+
+	if text != "" {
+		object["#text"] = text
+	}
+
+	return object
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	textTemplate "text/template"
+)
+
+func TestSOAPEnvelope(t *testing.T) {
+	envelope, contentType := soapEnvelope([]byte("<GetUser><id>1</id></GetUser>"), "1.1", "urn:GetUser")
+	if contentType != SOAP_11_CONTENT_TYPE {
+		t.Error("SOAP 1.1 should use text/xml, got: ", contentType)
+	}
+	if !strings.Contains(string(envelope), `<soap:Envelope xmlns:soap="`+SOAP_11_NAMESPACE+`"><soap:Body><GetUser><id>1</id></GetUser></soap:Body>`) {
+		t.Error("Body should be wrapped in the envelope, got: ", string(envelope))
+	}
+
+	_, contentType = soapEnvelope([]byte(""), "1.2", "urn:GetUser")
+	if contentType != SOAP_12_CONTENT_TYPE+`; action="urn:GetUser"` {
+		t.Error("SOAP 1.2 should send the action in the content type, got: ", contentType)
+	}
+}
+
+func TestUnwrapSOAPBody(t *testing.T) {
+	response := `<?xml version="1.0" encoding="utf-8"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+	<soap:Body>
+		<GetUserResponse xmlns="urn:users">
+			<name>Jane</name>
+			<role>admin</role>
+			<role>editor</role>
+			<address type="home"><city>London</city></address>
+		</GetUserResponse>
+	</soap:Body>
+</soap:Envelope>`
+
+	bodyData, err := unwrapSOAPBody([]byte(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asJSON, _ := json.Marshal(bodyData)
+	expected := `{"GetUserResponse":{"address":{"@type":"home","city":"London"},"name":"Jane","role":["admin","editor"]}}`
+	if string(asJSON) != expected {
+		t.Error("Response should be converted to JSON, got: ", string(asJSON))
+	}
+
+	fault := `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>
+		<soap:Fault><faultcode>soap:Client</faultcode><faultstring>Unknown user</faultstring></soap:Fault>
+	</soap:Body></soap:Envelope>`
+
+	bodyData, err = unwrapSOAPBody([]byte(fault))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asJSON, _ = json.Marshal(bodyData)
+	expected = `{"fault":{"faultcode":"soap:Client","faultstring":"Unknown user"}}`
+	if string(asJSON) != expected {
+		t.Error("Faults should be converted, got: ", string(asJSON))
+	}
+
+	if _, err := unwrapSOAPBody([]byte(`{"not": "xml"}`)); err == nil {
+		t.Error("Responses that aren't SOAP should fail")
+	}
+}
+
+func TestSOAPTemplateEscaping(t *testing.T) {
+	template, _ := textTemplate.New("soap").Parse(`<GetUser><id>{{.id}}</id><tag>{{index .tags 0}}</tag></GetUser>`)
+	bodyData := map[string]interface{}{
+		"id":   `1</id><admin>true</admin><id>`,
+		"tags": []interface{}{"a&b"},
+	}
+
+	var soapBody bytes.Buffer
+	template.Execute(&soapBody, xmlEscapeValues(bodyData))
+	if soapBody.String() != `<GetUser><id>1&lt;/id&gt;&lt;admin&gt;true&lt;/admin&gt;&lt;id&gt;</id><tag>a&amp;b</tag></GetUser>` {
+		t.Error("Values should be escaped, got: ", soapBody.String())
+	}
+}
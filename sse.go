@@ -0,0 +1,164 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const SSE_ANALYTICS_TAG = "sse"
+
+// SSEConfig flags Server-Sent Events endpoints, these are proxied like streaming endpoints and
+// the connection is exempt from the server read and write timeouts. Event stream responses are
+// always flushed as they arrive, flagging the endpoint also stops middleware and response
+// processors from buffering the stream. If paths is empty the whole API is treated as SSE
+type SSEConfig struct {
+	Enabled bool     `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	Paths   []string `mapstructure:"paths" bson:"paths" json:"paths"`
+}
+
+type SSEModuleConfig struct {
+	SSE SSEConfig `mapstructure:"sse" bson:"sse" json:"sse"`
+}
+
+func NewSSESpec(spec *APISpec) *StreamingSpec {
+	var thisModuleConfig SSEModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode SSE configuration: ", err)
+		return nil
+	}
+
+	if !thisModuleConfig.SSE.Enabled {
+		return nil
+	}
+
+	return compileStreamingPaths(thisModuleConfig.SSE.Paths)
+}
+
+func isEventStream(res *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// startEventStream marks the time the stream opened for analytics, the connection deadlines are
+// only lifted for endpoints flagged as SSE
+func startEventStream(r *http.Request) {
+	context.Set(r, SSEStreamStart, time.Now())
+}
+
+// upstreamLatency is the time the upstream took to respond, for event streams this is the time
+// to the response headers rather than how long the client stayed connected
+func upstreamLatency(r *http.Request, t1 time.Time, t2 time.Time) float64 {
+	if streamStart, ok := context.Get(r, SSEStreamStart).(time.Time); ok {
+		t2 = streamStart
+	}
+
+	return float64(t2.UnixNano()-t1.UnixNano()) * 0.000001
+}
+
+// openConns tracks the accepted connections so that a handler can change the deadlines of its own
+// connection, the http package doesn't expose the connection otherwise. Connections are indexed
+// by remote address once the first request is read from them, a request whose address is shared
+// by several connections (e.g. over a unix socket) can't be matched to its connection
+var openConns = struct {
+	sync.RWMutex
+	byAddr map[string]map[net.Conn]bool
+}{byAddr: make(map[string]map[net.Conn]bool)}
+
+type trackedConn struct {
+	net.Conn
+	addr      string
+	indexOnce sync.Once
+	closeOnce sync.Once
+}
+
+// Read indexes the connection on the first read, the remote address isn't looked up in Accept as
+// it can block (e.g. until the PROXY protocol header is read)
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.indexOnce.Do(func() {
+		c.addr = c.Conn.RemoteAddr().String()
+		openConns.Lock()
+		if openConns.byAddr[c.addr] == nil {
+			openConns.byAddr[c.addr] = make(map[net.Conn]bool)
+		}
+		openConns.byAddr[c.addr][c] = true
+		openConns.Unlock()
+	})
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		// Waits for the index if a read is setting it up
+		c.indexOnce.Do(func() {})
+		if c.addr == "" {
+			return
+		}
+
+		openConns.Lock()
+		delete(openConns.byAddr[c.addr], c)
+		if len(openConns.byAddr[c.addr]) == 0 {
+			delete(openConns.byAddr, c.addr)
+		}
+		openConns.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+type trackedListener struct {
+	net.Listener
+}
+
+// newTrackedListener wraps the gateway listener, it is only needed when the server enforces
+// timeouts
+func newTrackedListener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l}
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	return &trackedConn{Conn: conn}, nil
+}
+
+func getRequestConn(r *http.Request) net.Conn {
+	openConns.RLock()
+	defer openConns.RUnlock()
+
+	conns := openConns.byAddr[r.RemoteAddr]
+	if len(conns) != 1 {
+		return nil
+	}
+	for conn := range conns {
+		return conn
+	}
+
+	return nil
+}
+
+// WriteTimeoutHandler applies the server write timeout per request, unlike http.Server's
+// WriteTimeout it can be lifted for long-lived responses with clearConnDeadlines
+func WriteTimeoutHandler(timeout time.Duration, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn := getRequestConn(r); conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func clearConnDeadlines(r *http.Request) {
+	if conn := getRequestConn(r); conn != nil {
+		conn.SetDeadline(time.Time{})
+	}
+}
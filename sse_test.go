@@ -0,0 +1,150 @@
+package main
+
+import (
+	"github.com/gorilla/context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSESpec(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"sse": {"enabled": true, "paths": ["events"]},`, 1))
+
+	var streaming bool
+	handler := StreamingHandler(&spec, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streaming = isStreamingRequest(r)
+	}))
+
+	req, _ := http.NewRequest("GET", "/maintenance/events", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !streaming {
+		t.Error("SSE endpoints should be streamed")
+	}
+
+	streaming = false
+	req, _ = http.NewRequest("GET", "/maintenance/widgets", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if streaming {
+		t.Error("Only SSE endpoints should be streamed")
+	}
+}
+
+func TestEventStreamResponse(t *testing.T) {
+	res := &http.Response{StatusCode: 200, Header: make(http.Header)}
+	res.Header.Set("Content-Type", "text/event-stream; charset=utf-8")
+	res.Body = ioutil.NopCloser(strings.NewReader("data: hello\n\n"))
+
+	req, _ := http.NewRequest("GET", "/events", nil)
+	defer context.Clear(req)
+
+	t1 := time.Now()
+	recorder := httptest.NewRecorder()
+	p := &ReverseProxy{FlushInterval: time.Hour}
+	p.HandleResponse(recorder, res, req, nil)
+	if recorder.Body.String() != "data: hello\n\n" || !recorder.Flushed {
+		t.Error("Events should be flushed as they arrive")
+	}
+
+	// The time the client stayed connected isn't upstream latency
+	if latency := upstreamLatency(req, t1, t1.Add(time.Hour)); latency > 1000 {
+		t.Error("Latency should be measured to the response headers: ", latency)
+	}
+}
+
+func TestWriteTimeoutHandler(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		clearConnDeadlines(r)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("data: hello\n\n"))
+	})
+	mux.HandleFunc("/widgets", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("widgets"))
+	})
+	go (&http.Server{Handler: WriteTimeoutHandler(50*time.Millisecond, mux)}).Serve(newTrackedListener(l))
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	res, err := client.Get("http://" + l.Addr().String() + "/events")
+	if err != nil {
+		t.Fatal("SSE request shouldn't time out: ", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "data: hello\n\n" {
+		t.Error("Wrong body: ", string(body))
+	}
+
+	if res, err := client.Get("http://" + l.Addr().String() + "/widgets"); err == nil {
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err == nil && string(body) == "widgets" {
+			t.Error("Other requests should still time out")
+		}
+	}
+}
+
+type addrCountingConn struct {
+	net.Conn
+	addrCalls int
+}
+
+func (c *addrCountingConn) RemoteAddr() net.Addr {
+	c.addrCalls++
+	return c.Conn.RemoteAddr()
+}
+
+type singleConnListener struct {
+	net.Listener
+	conn net.Conn
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	return l.conn, nil
+}
+
+func TestTrackedConnsByAddress(t *testing.T) {
+	first, firstPeer := net.Pipe()
+	second, secondPeer := net.Pipe()
+	defer firstPeer.Close()
+	defer secondPeer.Close()
+
+	countingConn := &addrCountingConn{Conn: first}
+	firstConn, _ := newTrackedListener(&singleConnListener{conn: countingConn}).Accept()
+	if countingConn.addrCalls != 0 {
+		t.Error("Accept shouldn't look up the remote address")
+	}
+	secondConn, _ := newTrackedListener(&singleConnListener{conn: second}).Accept()
+
+	for _, pair := range [][2]net.Conn{{firstConn, firstPeer}, {secondConn, secondPeer}} {
+		go pair[1].Write([]byte("x"))
+		pair[0].Read(make([]byte, 1))
+	}
+
+	// Pipes share their address, the request can't be matched to a connection
+	req, _ := http.NewRequest("GET", "/events", nil)
+	req.RemoteAddr = first.RemoteAddr().String()
+	if getRequestConn(req) != nil {
+		t.Error("Connections sharing an address shouldn't be matched")
+	}
+
+	firstConn.Close()
+	if getRequestConn(req) != secondConn {
+		t.Error("The remaining connection should be matched")
+	}
+
+	secondConn.Close()
+	if getRequestConn(req) != nil {
+		t.Error("Closed connections should be removed")
+	}
+}
@@ -21,9 +21,34 @@ func (e KeyError) Error() string {
 type StorageHandlerName string
 
 const (
-	RedisHandler StorageHandlerName = "redis"
+	RedisHandler     StorageHandlerName = "redis"
+	MemcachedHandler StorageHandlerName = "memcached"
+	LRUHandler       StorageHandlerName = "lru"
 )
 
+// IsValidStorageType checks the storage type set in tyk.conf
+func IsValidStorageType(storageType string) bool {
+	switch StorageHandlerName(storageType) {
+	case RedisHandler, MemcachedHandler, LRUHandler:
+		return true
+	}
+
+	return false
+}
+
+// NewKeyStorageHandler returns the backend for keys and sessions selected by the storage type, other
+// data (analytics, notifications, health checks and caching) is always kept in Redis
+func NewKeyStorageHandler(KeyPrefix string, hashKeys bool) StorageHandler {
+	switch StorageHandlerName(config.Storage.Type) {
+	case MemcachedHandler:
+		return &MemcachedStorageManager{KeyPrefix: KeyPrefix, HashKeys: hashKeys}
+	case LRUHandler:
+		return &LRUStorageManager{KeyPrefix: KeyPrefix, HashKeys: hashKeys}
+	}
+
+	return &RedisClusterStorageManager{KeyPrefix: KeyPrefix, HashKeys: hashKeys}
+}
+
 // StorageHandler is a standard interface to a storage backend,
 // used by AuthorisationManager to read and write key values to the backend
 type StorageHandler interface {
@@ -51,9 +76,10 @@ type InMemoryStorageManager struct {
 	Sessions map[string]string
 }
 
-// Decrement is a dummy function
+// Decrement decrements the counter
 func (s *InMemoryStorageManager) Decrement(n string) {
-	log.Warning("Not implemented!")
+	val, _ := strconv.ParseInt(s.Sessions[n], 10, 64)
+	s.Sessions[n] = strconv.FormatInt(val-1, 10)
 }
 
 func (s *InMemoryStorageManager) SetRollingWindow(keyName string, per int64, expire int64) int {
@@ -61,9 +87,12 @@ func (s *InMemoryStorageManager) SetRollingWindow(keyName string, per int64, exp
 	return 0
 }
 
+// IncrememntWithExpire increments the counter, the expiry is ignored
 func (s *InMemoryStorageManager) IncrememntWithExpire(n string, i int64) int64 {
-	log.Warning("Not implemented!")
-	return 0
+	val, _ := strconv.ParseInt(s.Sessions[n], 10, 64)
+	val++
+	s.Sessions[n] = strconv.FormatInt(val, 10)
+	return val
 }
 
 func (s *InMemoryStorageManager) Connect() bool {
@@ -412,7 +441,8 @@ func (r *RedisStorageManager) IncrememntWithExpire(keyName string, expire int64)
 		fixedKey := keyName
 		val, err := redis.Int64(db.Do("INCR", fixedKey))
 		log.Debug("Incremented key: ", fixedKey, ", val is: ", val)
-		if val == 1 {
+		// EXPIRE with a zero or negative value deletes the key, those counters never expire
+		if val == 1 && expire > 0 {
 			log.Debug("--> Setting Expire")
 			db.Send("EXPIRE", fixedKey, expire)
 		}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/lonelycode/redigocluster/rediscluster"
+	"github.com/mitchellh/mapstructure"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StorageIsolationConfig gives an API its own storage namespace, set it in the API definition or for
+// all the APIs of an org with org_storage in tyk.conf (the API's own section wins). KeyPrefix is put in
+// front of the key, health check, cache and analytics keys of the API. If Host (or Hosts), Database or
+// Password are set that data is kept on a dedicated Redis connection, missing connection settings are
+// taken from the storage section of tyk.conf. Rate limit and quota counters keep their names, they are
+// only isolated by a dedicated connection
+type StorageIsolationConfig struct {
+	KeyPrefix string            `mapstructure:"key_prefix" bson:"key_prefix" json:"key_prefix"`
+	Host      string            `mapstructure:"host" bson:"host" json:"host"`
+	Port      int               `mapstructure:"port" bson:"port" json:"port"`
+	Hosts     map[string]string `mapstructure:"hosts" bson:"hosts" json:"hosts"`
+	Password  string            `mapstructure:"password" bson:"password" json:"password"`
+	Database  int               `mapstructure:"database" bson:"database" json:"database"`
+}
+
+type StorageIsolationModuleConfig struct {
+	StorageIsolation StorageIsolationConfig `mapstructure:"storage_isolation" bson:"storage_isolation" json:"storage_isolation"`
+}
+
+func GetStorageIsolationConfig(spec *APISpec) StorageIsolationConfig {
+	var thisModuleConfig StorageIsolationModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode storage isolation configuration: ", err)
+	}
+
+	if thisModuleConfig.StorageIsolation.IsIsolated() {
+		return thisModuleConfig.StorageIsolation
+	}
+
+	return config.OrgStorage[spec.OrgID]
+}
+
+// IsIsolated is false if the API uses the shared storage
+func (c StorageIsolationConfig) IsIsolated() bool {
+	return c.KeyPrefix != "" || c.hasConnection()
+}
+
+func (c StorageIsolationConfig) hasConnection() bool {
+	return c.Host != "" || len(c.Hosts) > 0 || c.Database > 0 || c.Password != ""
+}
+
+// seeds are the Redis servers of the connection
+func (c StorageIsolationConfig) seeds() []map[string]string {
+	seed_redii := []map[string]string{}
+
+	switch {
+	case len(c.Hosts) > 0:
+		for h, p := range c.Hosts {
+			seed_redii = append(seed_redii, map[string]string{h: p})
+		}
+	case c.Host != "":
+		port := c.Port
+		if port == 0 {
+			port = config.Storage.Port
+		}
+		seed_redii = append(seed_redii, map[string]string{c.Host: strconv.Itoa(port)})
+	case len(config.Storage.Hosts) > 0:
+		for h, p := range config.Storage.Hosts {
+			seed_redii = append(seed_redii, map[string]string{h: p})
+		}
+	default:
+		seed_redii = append(seed_redii, map[string]string{config.Storage.Host: strconv.Itoa(config.Storage.Port)})
+	}
+
+	return seed_redii
+}
+
+// poolName identifies a connection, isolated APIs that share the same settings share a pool
+func (c StorageIsolationConfig) poolName() string {
+	servers := []string{}
+	for _, seed := range c.seeds() {
+		for h, p := range seed {
+			servers = append(servers, h+":"+p)
+		}
+	}
+	sort.Strings(servers)
+
+	return strings.Join(servers, ",") + "/" + strconv.Itoa(c.Database)
+}
+
+func (c StorageIsolationConfig) password() string {
+	if c.Password != "" {
+		return c.Password
+	}
+
+	return config.Storage.Password
+}
+
+// redisStore creates a Redis storage manager in the namespace of the API
+func (c StorageIsolationConfig) redisStore(KeyPrefix string, hashKeys bool) *RedisClusterStorageManager {
+	store := &RedisClusterStorageManager{KeyPrefix: c.KeyPrefix + KeyPrefix, HashKeys: hashKeys}
+	if c.hasConnection() {
+		connection := c
+		store.Isolation = &connection
+	}
+
+	return store
+}
+
+// keyStore creates the key store of the API, memcached and LRU stores only use the prefix
+func (c StorageIsolationConfig) keyStore(KeyPrefix string, hashKeys bool) StorageHandler {
+	switch StorageHandlerName(config.Storage.Type) {
+	case MemcachedHandler, LRUHandler:
+		return NewKeyStorageHandler(c.KeyPrefix+KeyPrefix, hashKeys)
+	}
+
+	return c.redisStore(KeyPrefix, hashKeys)
+}
+
+// Pools are kept by connection and password, the password is left out of the logs
+var isolatedRedisPools = make(map[string]*rediscluster.RedisCluster)
+var isolatedRedisPoolsLock sync.Mutex
+
+// NewIsolatedRedisClusterPool returns the pool of a dedicated connection, pools are kept across reloads
+func NewIsolatedRedisClusterPool(c StorageIsolationConfig) *rediscluster.RedisCluster {
+	isolatedRedisPoolsLock.Lock()
+	defer isolatedRedisPoolsLock.Unlock()
+
+	name := c.poolName()
+	if pool, found := isolatedRedisPools[name+"|"+c.password()]; found {
+		return pool
+	}
+
+	log.Info("Creating isolated Redis connection pool: ", name)
+	pool := createRedisClusterPool(c.seeds(), c.Database, c.password())
+	isolatedRedisPools[name+"|"+c.password()] = pool
+
+	return pool
+}
+
+var isolatedAnalytics = make(map[string]*RedisAnalyticsHandler)
+var isolatedAnalyticsLock sync.Mutex
+
+// getIsolatedAnalytics returns the analytics handler of an isolated namespace, records are buffered in
+// the namespace and purged by a purger of its own
+func getIsolatedAnalytics(c StorageIsolationConfig) *RedisAnalyticsHandler {
+	isolatedAnalyticsLock.Lock()
+	defer isolatedAnalyticsLock.Unlock()
+
+	store := c.redisStore("analytics-", false)
+	name := store.KeyPrefix
+	if c.hasConnection() {
+		name = c.poolName() + "/" + name
+	}
+
+	if handler, found := isolatedAnalytics[name]; found {
+		return handler
+	}
+
+	store.Connect()
+	handler := &RedisAnalyticsHandler{Store: store, Clean: newAnalyticsPurger(store)}
+	isolatedAnalytics[name] = handler
+	if handler.Clean != nil && config.AnalyticsConfig.PurgeDelay >= 0 {
+		go handler.Clean.StartPurgeLoop(config.AnalyticsConfig.PurgeDelay)
+	}
+
+	return handler
+}
+
+// recordAnalytics sends a record to the analytics store of the API
+func recordAnalytics(spec *APISpec, thisRecord AnalyticsRecord) error {
+	if spec.Analytics != nil {
+		return spec.Analytics.RecordHit(thisRecord)
+	}
+
+	return analytics.RecordHit(thisRecord)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetStorageIsolationConfig(t *testing.T) {
+	spec := createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"storage_isolation": {"key_prefix": "tenant-a-"},`, 1))
+	if thisConfig := GetStorageIsolationConfig(&spec); thisConfig.KeyPrefix != "tenant-a-" || thisConfig.hasConnection() {
+		t.Error("API storage isolation wasn't read: ", thisConfig)
+	}
+
+	config.OrgStorage = map[string]StorageIsolationConfig{spec.OrgID: {Database: 3}}
+	defer func() { config.OrgStorage = nil }()
+
+	if thisConfig := GetStorageIsolationConfig(&spec); thisConfig.KeyPrefix != "tenant-a-" {
+		t.Error("API settings should win over the org's: ", thisConfig)
+	}
+
+	spec.APIDefinition.RawData = map[string]interface{}{}
+	if thisConfig := GetStorageIsolationConfig(&spec); !thisConfig.IsIsolated() || thisConfig.Database != 3 {
+		t.Error("Org storage isolation should apply: ", thisConfig)
+	}
+}
+
+func TestStorageIsolationStores(t *testing.T) {
+	shared := StorageIsolationConfig{}
+	if store := shared.redisStore("apihealth.", false); store.KeyPrefix != "apihealth." || store.Isolation != nil {
+		t.Error("API without isolation should use the shared storage: ", store)
+	}
+
+	prefixed := StorageIsolationConfig{KeyPrefix: "tenant-a-"}
+	if store := prefixed.redisStore("apihealth.", false); store.KeyPrefix != "tenant-a-apihealth." || store.Isolation != nil {
+		t.Error("Prefix shouldn't need a dedicated connection: ", store)
+	}
+
+	dedicated := StorageIsolationConfig{Host: "redis-a", Port: 6380, Database: 2}
+	store := dedicated.redisStore("cache-", false)
+	if store.Isolation == nil || store.Isolation.poolName() != "redis-a:6380/2" {
+		t.Error("Store should use the dedicated connection: ", store.Isolation)
+	}
+
+	sameServer := StorageIsolationConfig{Hosts: map[string]string{"redis-a": "6380"}, Database: 2, KeyPrefix: "tenant-b-"}
+	if sameServer.poolName() != dedicated.poolName() {
+		t.Error("Same connection settings should share a pool")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LRU storage is bounded to this many entries unless lru_size is set
+const LRU_DEFAULT_SIZE = 10000
+
+type lruEntry struct {
+	key     string
+	value   string
+	window  []int64
+	expires int64
+}
+
+// lruCache is a bounded, thread safe map with per entry expiry, the least recently used entry is
+// evicted when it is full
+type lruCache struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newLRUCache(size int) *lruCache {
+	if size < 1 {
+		size = LRU_DEFAULT_SIZE
+	}
+
+	return &lruCache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func lruExpiry(timeout int64) int64 {
+	if timeout > 0 {
+		return time.Now().Unix() + timeout
+	}
+
+	return 0
+}
+
+// get must be called with the lock held, expired entries are removed
+func (c *lruCache) get(key string) (*lruEntry, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if entry.expires > 0 && entry.expires < time.Now().Unix() {
+		c.remove(key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry, true
+}
+
+// set must be called with the lock held
+func (c *lruCache) set(key string, value string, expires int64) *lruEntry {
+	if entry, ok := c.get(key); ok {
+		entry.value = value
+		entry.expires = expires
+		return entry
+	}
+
+	entry := &lruEntry{key: key, value: value, expires: expires}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.remove(oldest.Value.(*lruEntry).key)
+	}
+
+	return entry
+}
+
+// remove must be called with the lock held
+func (c *lruCache) remove(key string) bool {
+	element, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+
+	c.order.Remove(element)
+	delete(c.entries, key)
+	return true
+}
+
+var lruSingleton *lruCache
+var lruSingletonLock sync.Mutex
+
+// LRUStorageManager implements the StorageHandler interface with a bounded in-memory store, all
+// managers share one cache. Data is not shared between nodes so it is for single node and dev use
+type LRUStorageManager struct {
+	KeyPrefix string
+	HashKeys  bool
+	cache     *lruCache
+}
+
+func (l *LRUStorageManager) Connect() bool {
+	lruSingletonLock.Lock()
+	defer lruSingletonLock.Unlock()
+
+	if lruSingleton == nil {
+		log.Info("Creating in-memory LRU session store")
+		lruSingleton = newLRUCache(config.Storage.LRUSize)
+	}
+	l.cache = lruSingleton
+
+	return true
+}
+
+func (l *LRUStorageManager) getCache() *lruCache {
+	if l.cache == nil {
+		l.Connect()
+	}
+
+	return l.cache
+}
+
+// KeyNamespace is the key prefix
+func (l *LRUStorageManager) KeyNamespace() string {
+	return l.KeyPrefix
+}
+
+// HashedKeyName is the raw name of a key known by its public hash
+func (l *LRUStorageManager) HashedKeyName(keyHash string) string {
+	return l.KeyPrefix + keyHash
+}
+
+func (l *LRUStorageManager) fixKey(keyName string) string {
+	if l.HashKeys {
+		return l.KeyPrefix + doHash(keyName)
+	}
+
+	return l.KeyPrefix + keyName
+}
+
+func (l *LRUStorageManager) filterPrefix(filter string) string {
+	if filter == "" {
+		return l.KeyPrefix
+	}
+
+	return l.fixKey(filter)
+}
+
+func (l *LRUStorageManager) GetKey(keyName string) (string, error) {
+	return l.GetRawKey(l.fixKey(keyName))
+}
+
+func (l *LRUStorageManager) GetRawKey(keyName string) (string, error) {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	entry, ok := cache.get(keyName)
+	if !ok {
+		return "", KeyError{}
+	}
+
+	return entry.value, nil
+}
+
+func (l *LRUStorageManager) SetKey(keyName string, sessionState string, timeout int64) error {
+	return l.SetRawKey(l.fixKey(keyName), sessionState, timeout)
+}
+
+func (l *LRUStorageManager) SetRawKey(keyName string, sessionState string, timeout int64) error {
+	cache := l.getCache()
+	cache.Lock()
+	cache.set(keyName, sessionState, lruExpiry(timeout))
+	cache.Unlock()
+
+	return nil
+}
+
+// GetExp returns the seconds until the key expires, -1 if it doesn't expire
+func (l *LRUStorageManager) GetExp(keyName string) (int64, error) {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	entry, ok := cache.get(l.fixKey(keyName))
+	if !ok {
+		return 0, KeyError{}
+	}
+
+	if entry.expires == 0 {
+		return -1, nil
+	}
+
+	return entry.expires - time.Now().Unix(), nil
+}
+
+func (l *LRUStorageManager) GetKeys(filter string) []string {
+	return l.getKeysWithPrefix(l.filterPrefix(filter))
+}
+
+// getKeysWithPrefix lists keys without changing their position in the cache
+func (l *LRUStorageManager) getKeysWithPrefix(prefix string) []string {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now().Unix()
+	keys := []string{}
+	for key, element := range cache.entries {
+		entry := element.Value.(*lruEntry)
+		if strings.HasPrefix(key, prefix) && (entry.expires == 0 || entry.expires >= now) {
+			keys = append(keys, strings.Replace(key, l.KeyPrefix, "", 1))
+		}
+	}
+
+	return keys
+}
+
+func (l *LRUStorageManager) GetKeysAndValues() map[string]string {
+	return l.GetKeysAndValuesWithFilter("")
+}
+
+func (l *LRUStorageManager) GetKeysAndValuesWithFilter(filter string) map[string]string {
+	values := make(map[string]string)
+	for _, keyName := range l.getKeysWithPrefix(l.filterPrefix(filter)) {
+		if value, err := l.GetRawKey(l.KeyPrefix + keyName); err == nil {
+			values[keyName] = value
+		}
+	}
+
+	return values
+}
+
+func (l *LRUStorageManager) DeleteKey(keyName string) bool {
+	return l.DeleteRawKey(l.fixKey(keyName))
+}
+
+func (l *LRUStorageManager) DeleteRawKey(keyName string) bool {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.remove(keyName)
+}
+
+func (l *LRUStorageManager) DeleteKeys(keys []string) bool {
+	for _, keyName := range keys {
+		l.DeleteKey(keyName)
+	}
+
+	return true
+}
+
+func (l *LRUStorageManager) Decrement(keyName string) {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	fixedKey := l.fixKey(keyName)
+	entry, ok := cache.get(fixedKey)
+	if !ok {
+		return
+	}
+
+	val, _ := strconv.ParseInt(entry.value, 10, 64)
+	entry.value = strconv.FormatInt(val-1, 10)
+}
+
+// IncrememntWithExpire uses a raw key, the expiry is only set when the counter is created
+func (l *LRUStorageManager) IncrememntWithExpire(keyName string, expire int64) int64 {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	entry, ok := cache.get(keyName)
+	if !ok {
+		cache.set(keyName, "1", lruExpiry(expire))
+		return 1
+	}
+
+	val, _ := strconv.ParseInt(entry.value, 10, 64)
+	val++
+	entry.value = strconv.FormatInt(val, 10)
+
+	return val
+}
+
+// SetRollingWindow returns the number of requests in the window before this one, like the Redis implementation
+func (l *LRUStorageManager) SetRollingWindow(keyName string, per int64, expire int64) int {
+	cache := l.getCache()
+	cache.Lock()
+	defer cache.Unlock()
+
+	now := time.Now()
+	onePeriodAgo := now.Add(time.Duration(-1*per) * time.Second).UnixNano()
+
+	entry, ok := cache.get(keyName)
+	if !ok {
+		entry = cache.set(keyName, "", 0)
+	}
+
+	window := entry.window[:0]
+	for _, t := range entry.window {
+		if t > onePeriodAgo {
+			window = append(window, t)
+		}
+	}
+
+	inWindow := len(window)
+	entry.window = append(window, now.UnixNano())
+	entry.expires = lruExpiry(per)
+
+	return inWindow
+}
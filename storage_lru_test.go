@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLRUStorageEviction(t *testing.T) {
+	store := &LRUStorageManager{KeyPrefix: "apikey-", cache: newLRUCache(2)}
+
+	store.SetKey("one", "1", 0)
+	store.SetKey("two", "2", 0)
+
+	// Reading one makes two the least recently used
+	if val, err := store.GetKey("one"); err != nil || val != "1" {
+		t.Fatal("Key not stored: ", val, err)
+	}
+
+	store.SetKey("three", "3", 0)
+
+	if _, err := store.GetKey("two"); err == nil {
+		t.Error("Least recently used key should have been evicted")
+	}
+
+	if _, err := store.GetKey("one"); err != nil {
+		t.Error("Recently used key should not have been evicted")
+	}
+
+	if len(store.GetKeys("")) != 2 {
+		t.Error("Expected 2 keys, got: ", store.GetKeys(""))
+	}
+}
+
+func TestLRUStorageCounters(t *testing.T) {
+	store := &LRUStorageManager{KeyPrefix: "apikey-", cache: newLRUCache(10)}
+
+	for i := int64(1); i <= 3; i++ {
+		if val := store.IncrememntWithExpire("quota-abc", 60); val != i {
+			t.Error("Counter should be ", i, ", got: ", val)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if inWindow := store.SetRollingWindow("rate-limit-abc", 60, 60); inWindow != i {
+			t.Error("Rolling window should have ", i, " requests, got: ", inWindow)
+		}
+	}
+
+	if exp, err := store.GetExp("missing"); err == nil {
+		t.Error("Missing key should return an error, got expiry: ", exp)
+	}
+
+	store.SetKey("expiring", "1", 100)
+	if exp, _ := store.GetExp("expiring"); exp < 99 || exp > 100 {
+		t.Error("Expiry is wrong: ", exp)
+	}
+}
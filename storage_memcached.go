@@ -0,0 +1,207 @@
+package main
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+	"strconv"
+	"time"
+)
+
+// Memcached treats expiry values over 30 days as a unix timestamp
+const memcachedMaxRelativeExpiry = 60 * 60 * 24 * 30
+
+var memcachedSingleton *memcache.Client
+
+// MemcachedStorageManager implements the StorageHandler interface with memcached. Memcached can't list
+// keys, so the key listing endpoints return nothing, and rate limits use a fixed window instead of a
+// rolling one
+type MemcachedStorageManager struct {
+	db        *memcache.Client
+	KeyPrefix string
+	HashKeys  bool
+}
+
+func NewMemcachedClient() *memcache.Client {
+	if memcachedSingleton != nil {
+		return memcachedSingleton
+	}
+
+	// The storage section holds the Redis connection, which analytics, notifications, health checks
+	// and caching still use, memcached has its own section
+	log.Info("Creating new memcached client for: ", config.Memcached.Hosts)
+	memcachedSingleton = memcache.New(config.Memcached.Hosts...)
+	if config.Memcached.MaxIdle > 0 {
+		memcachedSingleton.MaxIdleConns = config.Memcached.MaxIdle
+	}
+
+	return memcachedSingleton
+}
+
+func (m *MemcachedStorageManager) Connect() bool {
+	if m.db == nil {
+		m.db = NewMemcachedClient()
+	}
+
+	return true
+}
+
+func (m *MemcachedStorageManager) getClient() *memcache.Client {
+	if m.db == nil {
+		m.Connect()
+	}
+
+	return m.db
+}
+
+// KeyNamespace is the key prefix
+func (m *MemcachedStorageManager) KeyNamespace() string {
+	return m.KeyPrefix
+}
+
+// HashedKeyName is the raw name of a key known by its public hash
+func (m *MemcachedStorageManager) HashedKeyName(keyHash string) string {
+	return m.KeyPrefix + keyHash
+}
+
+func (m *MemcachedStorageManager) fixKey(keyName string) string {
+	if m.HashKeys {
+		return m.KeyPrefix + doHash(keyName)
+	}
+
+	return m.KeyPrefix + keyName
+}
+
+func memcachedExpiry(timeout int64) int32 {
+	if timeout <= 0 {
+		return 0
+	}
+
+	if timeout > memcachedMaxRelativeExpiry {
+		return int32(time.Now().Unix() + timeout)
+	}
+
+	return int32(timeout)
+}
+
+func (m *MemcachedStorageManager) GetKey(keyName string) (string, error) {
+	return m.GetRawKey(m.fixKey(keyName))
+}
+
+func (m *MemcachedStorageManager) GetRawKey(keyName string) (string, error) {
+	item, err := m.getClient().Get(keyName)
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Error("Error trying to get value: ", err)
+		}
+		return "", KeyError{}
+	}
+
+	return string(item.Value), nil
+}
+
+func (m *MemcachedStorageManager) SetKey(keyName string, sessionState string, timeout int64) error {
+	return m.SetRawKey(m.fixKey(keyName), sessionState, timeout)
+}
+
+func (m *MemcachedStorageManager) SetRawKey(keyName string, sessionState string, timeout int64) error {
+	err := m.getClient().Set(&memcache.Item{Key: keyName, Value: []byte(sessionState), Expiration: memcachedExpiry(timeout)})
+	if err != nil {
+		log.Error("Error trying to set value: ", err)
+	}
+
+	return err
+}
+
+// GetExp isn't supported by memcached, keys are reported as not expiring
+func (m *MemcachedStorageManager) GetExp(keyName string) (int64, error) {
+	if _, err := m.GetKey(keyName); err != nil {
+		return 0, err
+	}
+
+	return -1, nil
+}
+
+func (m *MemcachedStorageManager) GetKeys(filter string) []string {
+	log.Warning("Listing keys is not supported by the memcached storage backend")
+	return []string{}
+}
+
+func (m *MemcachedStorageManager) GetKeysAndValues() map[string]string {
+	log.Warning("Listing keys is not supported by the memcached storage backend")
+	return map[string]string{}
+}
+
+func (m *MemcachedStorageManager) GetKeysAndValuesWithFilter(filter string) map[string]string {
+	log.Warning("Listing keys is not supported by the memcached storage backend")
+	return map[string]string{}
+}
+
+func (m *MemcachedStorageManager) DeleteKey(keyName string) bool {
+	return m.DeleteRawKey(m.fixKey(keyName))
+}
+
+func (m *MemcachedStorageManager) DeleteRawKey(keyName string) bool {
+	err := m.getClient().Delete(keyName)
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Error("Error trying to delete key: ", err)
+		return false
+	}
+
+	return err == nil
+}
+
+func (m *MemcachedStorageManager) DeleteKeys(keys []string) bool {
+	for _, keyName := range keys {
+		m.DeleteKey(keyName)
+	}
+
+	return true
+}
+
+func (m *MemcachedStorageManager) Decrement(keyName string) {
+	_, err := m.getClient().Decrement(m.fixKey(keyName), 1)
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Error("Error trying to decrement value: ", err)
+	}
+}
+
+// IncrememntWithExpire uses a raw key, the counter is created with ADD so concurrent nodes can't reset it
+func (m *MemcachedStorageManager) IncrememntWithExpire(keyName string, expire int64) int64 {
+	client := m.getClient()
+
+	val, err := client.Increment(keyName, 1)
+	if err == nil {
+		return int64(val)
+	}
+
+	if err != memcache.ErrCacheMiss {
+		log.Error("Error trying to increment value: ", err)
+		return 0
+	}
+
+	err = client.Add(&memcache.Item{Key: keyName, Value: []byte("1"), Expiration: memcachedExpiry(expire)})
+	if err == nil {
+		return 1
+	}
+
+	// Another request created the counter first
+	if err == memcache.ErrNotStored {
+		val, err = client.Increment(keyName, 1)
+		if err == nil {
+			return int64(val)
+		}
+	}
+
+	log.Error("Error trying to increment value: ", err)
+	return 0
+}
+
+// SetRollingWindow is approximated with a counter per fixed window of per seconds, it returns the number
+// of requests in the window before this one like the Redis implementation
+func (m *MemcachedStorageManager) SetRollingWindow(keyName string, per int64, expire int64) int {
+	if per < 1 {
+		per = 1
+	}
+
+	windowKey := keyName + "-" + strconv.FormatInt(time.Now().Unix()/per, 10)
+	return int(m.IncrememntWithExpire(windowKey, per)) - 1
+}
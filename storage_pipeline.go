@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/lonelycode/redigocluster/rediscluster"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MultiKeyStorage is implemented by stores that can fetch several keys in one round trip
+type MultiKeyStorage interface {
+	GetMultiKey(keyNames []string) ([]string, error)
+}
+
+// RateLimitQuotaStorage is implemented by stores that can check the rolling window rate limit and
+// increment the quota counter of a request in a single atomic call. rateLimit is the number of requests
+// allowed per window, the quota is only incremented if the request is not rate limited and checkQuota is set.
+// The spike arrest window is checked first, a request it stops isn't counted in the rate limit window.
+// It returns the number of requests already in the rate limit and spike arrest windows and the new quota
+// counter (0 if not incremented)
+type RateLimitQuotaStorage interface {
+	RateLimitAndQuota(rateKey string, per int64, rateLimit int64, spike SpikeArrestWindow, quotaKey string, quotaRenewalRate int64, checkQuota bool) (int, int, int64, error)
+}
+
+// SpikeArrestWindow is the short rolling window checked along with the rate limit, a zero Limit skips it
+type SpikeArrestWindow struct {
+	Key   string
+	Per   int64
+	Limit int64
+}
+
+// SetStorage is implemented by stores that can keep unordered sets of unique members
+type SetStorage interface {
+	AddSetMember(keyName string, member string) error
+	RemoveSetMember(keyName string, member string) error
+	GetSetMembers(keyName string) ([]string, error)
+}
+
+// ConcurrencySlotStorage is implemented by stores that can count the requests in flight for a key,
+// a slot is only taken if the count stays within limit. ttl is a safety net so that slots held by a
+// node that died are eventually freed
+type ConcurrencySlotStorage interface {
+	AcquireSlot(keyName string, limit int64, ttl int64) (bool, error)
+	ReleaseSlot(keyName string) error
+}
+
+// KeyNamespaceStorage is implemented by stores that keep their keys under a prefix or on a dedicated
+// connection, caches use the namespace so the same key held by two stores is cached separately
+type KeyNamespaceStorage interface {
+	KeyNamespace() string
+}
+
+// storageKeyNamespace is the namespace of a store, stores that don't report one share ""
+func storageKeyNamespace(store StorageHandler) string {
+	if namespaced, ok := store.(KeyNamespaceStorage); ok {
+		return namespaced.KeyNamespace()
+	}
+
+	return ""
+}
+
+// ScanKeyStorage is implemented by stores that can walk their keys in batches (SCAN) rather than
+// listing them all at once, fn is called with the key names (without the prefix) and values of each batch
+type ScanKeyStorage interface {
+	ScanKeysAndValues(batchSize int, fn func(map[string]string)) error
+}
+
+// HashedKeyStorage is implemented by stores that can address a key known only by its public hash
+// (see publicHash), HashedKeyName returns the raw key name to use with GetRawKey and SetRawKey
+type HashedKeyStorage interface {
+	HashedKeyName(keyHash string) string
+}
+
+// ErrBatchKeysUnsupported is returned when the store can't write keys in batches (see BatchKeyStorage)
+var ErrBatchKeysUnsupported = errors.New("session store can't write keys in batches")
+
+// ErrAtomicLimitUnsupported is returned when the store can't run the rate limit and quota check as one call,
+// callers should fall back to the separate checks
+var ErrAtomicLimitUnsupported = errors.New("atomic rate limit and quota check not supported")
+
+// rateLimitQuotaScript performs the same steps as SetRollingWindow followed by IncrememntWithExpire,
+// preceded by the spike arrest window if it has a limit. The timestamps are passed as strings so Lua
+// never has to hold them as (lossy) doubles
+const rateLimitQuotaScript = `
+local spike = 0
+if tonumber(ARGV[9]) > 0 then
+	redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", ARGV[7])
+	spike = redis.call("ZCARD", KEYS[3])
+	if spike > tonumber(ARGV[9]) - 1 then
+		return {0, spike, 0}
+	end
+	redis.call("ZADD", KEYS[3], ARGV[1], ARGV[1])
+	redis.call("EXPIRE", KEYS[3], ARGV[8])
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[2])
+local count = redis.call("ZCARD", KEYS[1])
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[1])
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+if count > tonumber(ARGV[4]) - 1 or ARGV[6] ~= "1" then
+	return {count, spike, 0}
+end
+local used = redis.call("INCR", KEYS[2])
+if used == 1 then
+	redis.call("EXPIRE", KEYS[2], ARGV[5])
+end
+return {count, spike, used}
+`
+
+var rateLimitQuotaScriptSHA = scriptSHA(rateLimitQuotaScript)
+
+const acquireSlotScript = `
+local inFlight = redis.call("INCR", KEYS[1])
+redis.call("EXPIRE", KEYS[1], ARGV[2])
+if inFlight > tonumber(ARGV[1]) then
+	redis.call("DECR", KEYS[1])
+	return 0
+end
+return 1
+`
+
+var acquireSlotScriptSHA = scriptSHA(acquireSlotScript)
+
+// releaseSlotScript removes the counter once it is back to 0 so that an expired counter can't go negative
+const releaseSlotScript = `
+local inFlight = redis.call("DECR", KEYS[1])
+if inFlight <= 0 then
+	redis.call("DEL", KEYS[1])
+end
+return inFlight
+`
+
+var releaseSlotScriptSHA = scriptSHA(releaseSlotScript)
+
+func scriptSHA(script string) string {
+	h := sha1.Sum([]byte(script))
+	return hex.EncodeToString(h[:])
+}
+
+// GetMultiKey fetches several keys at once, missing keys are returned as empty strings.
+// MGET can't span hash slots so a cluster uses a pipeline of GETs instead
+func (r *RedisClusterStorageManager) GetMultiKey(keyNames []string) ([]string, error) {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.GetMultiKey(keyNames)
+	}
+
+	rawKeyNames := make([]string, len(keyNames))
+	for i, keyName := range keyNames {
+		rawKeyNames[i] = r.fixKey(keyName)
+	}
+
+	return r.getRawMultiKey(rawKeyNames)
+}
+
+// getRawMultiKey reads several raw keys in one round trip, missing keys are returned as ""
+func (r *RedisClusterStorageManager) getRawMultiKey(rawKeyNames []string) ([]string, error) {
+	if len(rawKeyNames) == 0 {
+		return []string{}, nil
+	}
+
+	var values []interface{}
+	var err error
+	if config.Storage.EnableCluster {
+		commands := make([]rediscluster.ClusterTransaction, len(rawKeyNames))
+		for i, rawKeyName := range rawKeyNames {
+			commands[i] = rediscluster.ClusterTransaction{Cmd: "GET", Args: []interface{}{rawKeyName}}
+		}
+		values, err = redis.Values(r.db.DoTransaction(commands))
+	} else {
+		args := make([]interface{}, len(rawKeyNames))
+		for i, rawKeyName := range rawKeyNames {
+			args[i] = rawKeyName
+		}
+		values, err = redis.Values(r.db.Do("MGET", args...))
+	}
+
+	if err != nil {
+		log.Error("Error trying to get multiple keys: ", err)
+		return nil, err
+	}
+
+	results := make([]string, len(rawKeyNames))
+	for i, value := range values {
+		if i >= len(results) || value == nil {
+			continue
+		}
+		results[i], _ = redis.String(value, nil)
+	}
+
+	return results, nil
+}
+
+// ScanKeysAndValues walks the keys of the store with SCAN, so Redis isn't blocked the way KEYS
+// blocks it on a large key space. Keys that are deleted while they are read are left out
+func (r *RedisClusterStorageManager) ScanKeysAndValues(batchSize int, fn func(map[string]string)) error {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.ScanKeysAndValues(batchSize, fn)
+	}
+
+	cursor := "0"
+	for {
+		reply, err := redis.Values(r.db.Do("SCAN", cursor, "MATCH", r.KeyPrefix+"*", "COUNT", batchSize))
+		if err != nil {
+			return err
+		}
+
+		if len(reply) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return err
+		}
+
+		rawKeyNames, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+
+		values, err := r.getRawMultiKey(rawKeyNames)
+		if err != nil {
+			return err
+		}
+
+		batch := make(map[string]string, len(rawKeyNames))
+		for i, rawKeyName := range rawKeyNames {
+			if values[i] != "" {
+				batch[r.cleanKey(rawKeyName)] = values[i]
+			}
+		}
+		fn(batch)
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// RateLimitAndQuota runs the spike arrest, rate limit and quota check as one Lua script, the keys are raw keys.
+// The keys of a session hash to different slots, so this is not available in cluster mode
+func (r *RedisClusterStorageManager) RateLimitAndQuota(rateKey string, per int64, rateLimit int64, spike SpikeArrestWindow, quotaKey string, quotaRenewalRate int64, checkQuota bool) (int, int, int64, error) {
+	if config.Storage.EnableCluster {
+		return 0, 0, 0, ErrAtomicLimitUnsupported
+	}
+
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.RateLimitAndQuota(rateKey, per, rateLimit, spike, quotaKey, quotaRenewalRate, checkQuota)
+	}
+
+	now := time.Now()
+	onePeriodAgo := now.Add(time.Duration(-1*per) * time.Second)
+	oneSpikePeriodAgo := now.Add(time.Duration(-1*spike.Per) * time.Second)
+	quotaFlag := "0"
+	if checkQuota {
+		quotaFlag = "1"
+	}
+
+	args := []interface{}{
+		3, rateKey, quotaKey, spike.Key,
+		strconv.FormatInt(now.UnixNano(), 10),
+		strconv.FormatInt(onePeriodAgo.UnixNano(), 10),
+		per,
+		rateLimit,
+		quotaRenewalRate,
+		quotaFlag,
+		strconv.FormatInt(oneSpikePeriodAgo.UnixNano(), 10),
+		spike.Per,
+		spike.Limit,
+	}
+
+	values, err := redis.Int64s(r.evalScript(rateLimitQuotaScript, rateLimitQuotaScriptSHA, args...))
+	if err != nil {
+		log.Error("Rate limit and quota script failed: ", err)
+		return 0, 0, 0, err
+	}
+
+	if len(values) != 3 {
+		return 0, 0, 0, errors.New("unexpected rate limit and quota script result")
+	}
+
+	return int(values[0]), int(values[1]), values[2], nil
+}
+
+// evalScript runs a Lua script, the script is only sent in full the first time each Redis server sees it
+func (r *RedisClusterStorageManager) evalScript(script string, sha string, args ...interface{}) (interface{}, error) {
+	reply, err := r.db.Do("EVALSHA", append([]interface{}{sha}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = r.db.Do("EVAL", append([]interface{}{script}, args...)...)
+	}
+
+	return reply, err
+}
+
+// AcquireSlot takes a concurrency slot for a raw key, like the rate limiter this needs Lua so it is not
+// available in cluster mode
+func (r *RedisClusterStorageManager) AcquireSlot(keyName string, limit int64, ttl int64) (bool, error) {
+	if config.Storage.EnableCluster {
+		return false, ErrAtomicLimitUnsupported
+	}
+
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.AcquireSlot(keyName, limit, ttl)
+	}
+
+	acquired, err := redis.Int64(r.evalScript(acquireSlotScript, acquireSlotScriptSHA, 1, keyName, limit, ttl))
+	if err != nil {
+		log.Error("Concurrency slot script failed: ", err)
+		return false, err
+	}
+
+	return acquired == 1, nil
+}
+
+// ReleaseSlot gives back a slot taken with AcquireSlot
+func (r *RedisClusterStorageManager) ReleaseSlot(keyName string) error {
+	if config.Storage.EnableCluster {
+		return ErrAtomicLimitUnsupported
+	}
+
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.ReleaseSlot(keyName)
+	}
+
+	_, err := r.evalScript(releaseSlotScript, releaseSlotScriptSHA, 1, keyName)
+	if err != nil {
+		log.Error("Concurrency slot script failed: ", err)
+	}
+
+	return err
+}
+
+// AddSetMember adds a member to a set
+func (r *RedisClusterStorageManager) AddSetMember(keyName string, member string) error {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.AddSetMember(keyName, member)
+	}
+
+	_, err := r.db.Do("SADD", r.fixKey(keyName), member)
+	return err
+}
+
+// RemoveSetMember removes a member from a set, Redis deletes the set with its last member
+func (r *RedisClusterStorageManager) RemoveSetMember(keyName string, member string) error {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.RemoveSetMember(keyName, member)
+	}
+
+	_, err := r.db.Do("SREM", r.fixKey(keyName), member)
+	return err
+}
+
+// GetSetMembers returns the members of a set, a missing set is empty
+func (r *RedisClusterStorageManager) GetSetMembers(keyName string) ([]string, error) {
+	if r.db == nil {
+		log.Info("Connection dropped, connecting..")
+		r.Connect()
+		return r.GetSetMembers(keyName)
+	}
+
+	return redis.Strings(r.db.Do("SMEMBERS", r.fixKey(keyName)))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+)
+
+// atomicTestStore counts the calls made to the store so the single round trip can be checked
+type atomicTestStore struct {
+	InMemoryStorageManager
+	calls       int
+	window      int
+	spikeWindow int
+	quotaMax    int64
+	used        int64
+}
+
+func (a *atomicTestStore) RateLimitAndQuota(rateKey string, per int64, rateLimit int64, spike SpikeArrestWindow, quotaKey string, quotaRenewalRate int64, checkQuota bool) (int, int, int64, error) {
+	a.calls++
+	spikeCount := 0
+	if spike.Limit > 0 {
+		spikeCount = a.spikeWindow
+		if int64(spikeCount) > spike.Limit-1 {
+			return 0, spikeCount, 0, nil
+		}
+		a.spikeWindow++
+	}
+
+	count := a.window
+	a.window++
+	if int64(count) > rateLimit-1 || !checkQuota {
+		return count, spikeCount, 0, nil
+	}
+
+	a.used++
+	return count, spikeCount, a.used, nil
+}
+
+func TestForwardMessageAtomic(t *testing.T) {
+	store := &atomicTestStore{InMemoryStorageManager: InMemoryStorageManager{Sessions: make(map[string]string)}}
+	limiter := SessionLimiter{}
+
+	thisSession := createSampleSession()
+	thisSession.Rate = 3
+	thisSession.QuotaMax = 2
+
+	for i := 0; i < 2; i++ {
+		if forward, _ := limiter.ForwardMessage(&thisSession, "key", store); !forward {
+			t.Fatal("Request should be allowed: ", i+1)
+		}
+	}
+
+	if forward, reason := limiter.ForwardMessage(&thisSession, "key", store); forward || reason != 2 {
+		t.Error("Quota should be exceeded, got reason: ", reason)
+	}
+
+	if forward, reason := limiter.ForwardMessage(&thisSession, "key", store); forward || reason != 1 {
+		t.Error("Rate limit should be exceeded, got reason: ", reason)
+	}
+
+	if store.calls != 4 {
+		t.Error("Expected one store call per request, got: ", store.calls)
+	}
+
+	if thisSession.QuotaRemaining != 0 {
+		t.Error("Quota remaining was not updated: ", thisSession.QuotaRemaining)
+	}
+
+	// Other quota algorithms need more than one counter so they use the separate checks
+	thisSession.QuotaAlgorithm = QuotaAlgorithmCalendarMonthly
+	limiter.ForwardMessage(&thisSession, "other-key", store)
+	if store.calls != 4 {
+		t.Error("Calendar quota should not use the atomic check")
+	}
+}
+
+func TestForwardMessageSpikeArrest(t *testing.T) {
+	store := &atomicTestStore{InMemoryStorageManager: InMemoryStorageManager{Sessions: make(map[string]string)}}
+	limiter := SessionLimiter{}
+
+	thisSession := createSampleSession()
+	thisSession.Rate = 10
+	thisSession.QuotaMax = -1
+	thisSession.SpikeArrest = SpikeArrest{Rate: 2}
+
+	for i := 0; i < 2; i++ {
+		if forward, _ := limiter.ForwardMessage(&thisSession, "key", store); !forward {
+			t.Fatal("Request should be within the spike arrest limit: ", i+1)
+		}
+	}
+
+	if forward, reason := limiter.ForwardMessage(&thisSession, "key", store); forward || reason != 1 {
+		t.Error("Burst should be stopped by the spike arrest, got reason: ", reason)
+	}
+	if store.calls != 3 || store.window != 2 {
+		t.Error("Spike arrest should be checked in the same store call without counting the request: ", store.calls, store.window)
+	}
+
+	// Once the short window has passed the sustained rate applies again
+	store.spikeWindow = 0
+	if forward, _ := limiter.ForwardMessage(&thisSession, "key", store); !forward {
+		t.Error("Request should be allowed after the spike window")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// StreamingConfig passes request and response bodies straight through for large uploads and
+// downloads, middleware and response processors that need the whole body are skipped. If paths is
+// empty the whole API streams, otherwise only the matching endpoints do
+type StreamingConfig struct {
+	Enabled bool     `mapstructure:"enabled" bson:"enabled" json:"enabled"`
+	Paths   []string `mapstructure:"paths" bson:"paths" json:"paths"`
+}
+
+type StreamingModuleConfig struct {
+	Streaming StreamingConfig `mapstructure:"streaming" bson:"streaming" json:"streaming"`
+}
+
+// StreamingSpec is the compiled streaming configuration of an API, a nil StreamingSpec never streams
+type StreamingSpec struct {
+	paths []*regexp.Regexp
+}
+
+func NewStreamingSpec(spec *APISpec) *StreamingSpec {
+	var thisModuleConfig StreamingModuleConfig
+	err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+	if err != nil {
+		log.Error("Failed to decode streaming configuration: ", err)
+		return nil
+	}
+
+	if !thisModuleConfig.Streaming.Enabled {
+		return nil
+	}
+
+	return compileStreamingPaths(thisModuleConfig.Streaming.Paths)
+}
+
+func compileStreamingPaths(paths []string) *StreamingSpec {
+	thisSpec := &StreamingSpec{}
+	for _, path := range paths {
+		pathRegex, err := compileRawPath(path)
+		if err != nil {
+			log.Error("Invalid streaming path ", path, ", skipping")
+			continue
+		}
+		thisSpec.paths = append(thisSpec.paths, pathRegex)
+	}
+
+	return thisSpec
+}
+
+func (s *StreamingSpec) Matches(r *http.Request) bool {
+	return s.matchesPath(r.URL.Path)
+}
+
+func (s *StreamingSpec) matchesPath(path string) bool {
+	if s == nil {
+		return false
+	}
+	if len(s.paths) == 0 {
+		return true
+	}
+
+	for _, pathRegex := range s.paths {
+		if pathRegex.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkStreamingConfig refuses APIs that validate the body of endpoints they stream, the body
+// can't be validated without reading it and skipping the validation would let anything through
+func checkStreamingConfig(spec *APISpec) error {
+	if spec.Streaming == nil && spec.SSE == nil {
+		return nil
+	}
+
+	var thisModuleConfig ValidateJSONModuleConfig
+	if err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig); err != nil {
+		return err
+	}
+
+	for _, version := range thisModuleConfig.VersionData.Versions {
+		for _, entry := range version.ExtendedPaths.ValidateJSON {
+			if spec.Streaming.matchesPath(entry.Path) || spec.SSE.matchesPath(entry.Path) {
+				return errors.New("validate_json is set for streamed path " + entry.Path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StreamingHandler flags requests to streaming endpoints before the chain runs
+func StreamingHandler(spec *APISpec, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if spec.Streaming.Matches(r) {
+			context.Set(r, StreamingRequest, true)
+		}
+		if spec.SSE.Matches(r) {
+			context.Set(r, StreamingRequest, true)
+			clearConnDeadlines(r)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isStreamingRequest(r *http.Request) bool {
+	streaming, _ := context.Get(r, StreamingRequest).(bool)
+	return streaming
+}
+
+// skipsWhenStreaming lists the middleware that read or replace the request body. JSVM middleware
+// always run as they can be auth checks, they get an empty body instead
+func skipsWhenStreaming(mw TykMiddlewareImplementation) bool {
+	switch mw.(type) {
+	case *ValidateJSON, *TransformMiddleware, *SOAPTransform, *RedisCacheMiddleware, *VirtualEndpoint, *TrafficMirror:
+		return true
+	}
+
+	return false
+}
+
+// responseSkipsWhenStreaming lists the response processors that buffer the response body
+func responseSkipsWhenStreaming(rh TykResponseHandler) bool {
+	switch rh.(type) {
+	case ResponseTransformMiddleware, SOAPResponseHandler, JSVMResponseHook, ResponseCompressionHandler:
+		return true
+	}
+
+	return false
+}
+
+// copyStreamingResponse flushes every chunk to the client as soon as it arrives from the upstream
+func (p *ReverseProxy) copyStreamingResponse(dst io.Writer, src io.Reader) {
+	flusher, canFlush := dst.(http.Flusher)
+	if !canFlush {
+		io.Copy(dst, src)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
+				return
+			}
+			flusher.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
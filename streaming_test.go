@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func createStreamingTestSpec(streaming string) APISpec {
+	return createDefinitionFromString(strings.Replace(maintenanceDefinition, `"active": false,`, `"streaming": `+streaming+`,`, 1))
+}
+
+func TestStreamingSpec(t *testing.T) {
+	uploadReq, _ := http.NewRequest("POST", "/maintenance/files/upload", nil)
+	otherReq, _ := http.NewRequest("GET", "/maintenance/widgets", nil)
+
+	spec := createStreamingTestSpec(`{"enabled": true, "paths": ["files/{id}"]}`)
+	if !spec.Streaming.Matches(uploadReq) || spec.Streaming.Matches(otherReq) {
+		t.Error("Only the streaming endpoints should stream")
+	}
+
+	spec = createStreamingTestSpec(`{"enabled": true}`)
+	if !spec.Streaming.Matches(otherReq) {
+		t.Error("The whole API should stream without paths")
+	}
+
+	spec = createStreamingTestSpec(`{"enabled": false, "paths": ["files/{id}"]}`)
+	if spec.Streaming != nil || spec.Streaming.Matches(uploadReq) {
+		t.Error("Streaming should be off")
+	}
+}
+
+func TestStreamingSkipsBodyProcessing(t *testing.T) {
+	spec := createStreamingTestSpec(`{"enabled": true}`)
+
+	var streaming bool
+	handler := StreamingHandler(&spec, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streaming = isStreamingRequest(r)
+	}))
+	req, _ := http.NewRequest("GET", "/maintenance/files/1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !streaming {
+		t.Fatal("Request should be flagged as streaming")
+	}
+
+	if !skipsWhenStreaming(&TransformMiddleware{}) || skipsWhenStreaming(&AccessRightsCheck{}) {
+		t.Error("Only middleware that touch the body should be skipped")
+	}
+	if skipsWhenStreaming(&DynamicMiddleware{Hook: MW_HOOK_AUTH_CHECK}) || skipsWhenStreaming(&DynamicMiddleware{Hook: MW_HOOK_PRE}) {
+		t.Error("JSVM middleware should never be skipped")
+	}
+
+	compression := ResponseCompressionHandler{config: ResponseCompressionConfig{Enabled: true, MinSize: 1, ContentTypes: []string{"text/*"}}}
+	chain := []TykResponseHandler{compression}
+	res := createCompressionTestResponse("text/plain", "a large file")
+	ResponseChain{}.Go(&chain, nil, res, req, nil)
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Error("Streaming responses shouldn't be buffered by response processors")
+	}
+}
+
+func TestStreamingRejectsValidatedPaths(t *testing.T) {
+	validated := strings.Replace(maintenanceDefinition, `"versions": {"Default": {"name": "Default"}}`, `"versions": {"Default": {
+		"name": "Default",
+		"extended_paths": {"validate_json": [{"path": "files/upload", "method": "POST", "schema": {"type": "object"}}]}
+	}}`, 1)
+
+	spec := createDefinitionFromString(strings.Replace(validated, `"active": false,`, `"streaming": {"enabled": true, "paths": ["files/{id}"]},`, 1))
+	if spec.StreamingErr == nil {
+		t.Error("Streaming a validated path should be refused")
+	}
+
+	spec = createDefinitionFromString(strings.Replace(validated, `"active": false,`, `"streaming": {"enabled": true, "paths": ["downloads/{id}"]},`, 1))
+	if spec.StreamingErr != nil {
+		t.Error("Streaming other paths should be allowed: ", spec.StreamingErr)
+	}
+}
+
+func TestCopyStreamingResponse(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	p := &ReverseProxy{}
+	p.copyStreamingResponse(recorder, ioutil.NopCloser(strings.NewReader("chunk")))
+
+	if recorder.Body.String() != "chunk" || !recorder.Flushed {
+		t.Error("Response should be written and flushed: ", recorder.Body.String(), recorder.Flushed)
+	}
+}
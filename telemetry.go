@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TELEMETRY_API_ID   string = "tyk-self-telemetry"
+	TELEMETRY_API_NAME string = "Tyk Self Telemetry"
+)
+
+// GatewayTelemetry counts the requests handled by this node between telemetry records. Each API
+// has its own counter that is incremented atomically, the lock is only taken to add an API's
+// counter and to flush, so requests to different APIs don't contend with each other
+type GatewayTelemetry struct {
+	sync.Mutex
+	apiCounts  map[string]*int64
+	lastRecord time.Time
+	lastNumGC  uint32
+	lastPause  uint64
+}
+
+var Telemetry = &GatewayTelemetry{apiCounts: make(map[string]*int64), lastRecord: time.Now()}
+
+// TelemetryCountHandler wraps an API's chain so its requests are included in the telemetry counts
+func TelemetryCountHandler(APIID string, h http.Handler) http.Handler {
+	counter := Telemetry.Counter(APIID)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(counter, 1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Counter returns the request counter of an API, the same counter is kept across reloads
+func (g *GatewayTelemetry) Counter(APIID string) *int64 {
+	g.Lock()
+	defer g.Unlock()
+
+	counter, found := g.apiCounts[APIID]
+	if !found {
+		counter = new(int64)
+		g.apiCounts[APIID] = counter
+	}
+
+	return counter
+}
+
+// Inc counts a request for an API
+func (g *GatewayTelemetry) Inc(APIID string) {
+	atomic.AddInt64(g.Counter(APIID), 1)
+}
+
+// Flush returns the counts of the APIs that received traffic since the last flush and the time
+// they cover, then resets them
+func (g *GatewayTelemetry) Flush() (map[string]int64, time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+
+	thisCounts := make(map[string]int64)
+	for APIID, counter := range g.apiCounts {
+		if count := atomic.SwapInt64(counter, 0); count > 0 {
+			thisCounts[APIID] = count
+		}
+	}
+
+	since := time.Since(g.lastRecord)
+	g.lastRecord = time.Now()
+
+	return thisCounts, since
+}
+
+// GenerateRecord builds the telemetry analytics record, the measurements are stored as tags
+// in a "name-value" format so they can be queried with the same tooling as traffic tags
+func (g *GatewayTelemetry) GenerateRecord(redisLatency time.Duration) AnalyticsRecord {
+	apiCounts, since := g.Flush()
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	var total int64
+	for _, count := range apiCounts {
+		total += count
+	}
+
+	reqPerSec := 0.0
+	if since.Seconds() > 0 {
+		reqPerSec = float64(total) / since.Seconds()
+	}
+
+	hostname, _ := os.Hostname()
+	tags := []string{
+		"node-" + hostname,
+		fmt.Sprintf("requests-%v", total),
+		fmt.Sprintf("req_per_sec-%.2f", reqPerSec),
+		fmt.Sprintf("goroutines-%v", runtime.NumGoroutine()),
+		fmt.Sprintf("heap_alloc_bytes-%v", memStats.HeapAlloc),
+		fmt.Sprintf("gc_runs-%v", memStats.NumGC-g.lastNumGC),
+		fmt.Sprintf("gc_pause_ns-%v", memStats.PauseTotalNs-g.lastPause),
+		fmt.Sprintf("redis_latency_us-%v", int64(redisLatency/time.Microsecond)),
+	}
+
+	g.lastNumGC = memStats.NumGC
+	g.lastPause = memStats.PauseTotalNs
+
+	APIIDs := []string{}
+	for APIID, _ := range apiCounts {
+		APIIDs = append(APIIDs, APIID)
+	}
+	sort.Strings(APIIDs)
+
+	for _, APIID := range APIIDs {
+		tags = append(tags, fmt.Sprintf("api_requests-%v-%v", APIID, apiCounts[APIID]))
+	}
+
+	t := time.Now()
+	thisRecord := AnalyticsRecord{
+		Method:       "TELEMETRY",
+		Path:         "/",
+		UserAgent:    hostname,
+		Day:          t.Day(),
+		Month:        t.Month(),
+		Year:         t.Year(),
+		Hour:         t.Hour(),
+		ResponseCode: 200,
+		TimeStamp:    t,
+		APIVersion:   VERSION,
+		APIName:      TELEMETRY_API_NAME,
+		APIID:        TELEMETRY_API_ID,
+		Tags:         tags,
+	}
+	thisRecord.SetExpiry(config.SelfTelemetry.ExpireAfter)
+
+	return thisRecord
+}
+
+// measureRedisLatency times a round trip to the analytics store
+func measureRedisLatency(store *RedisClusterStorageManager) time.Duration {
+	t1 := time.Now()
+	store.GetKey("telemetry-ping")
+	return time.Since(t1)
+}
+
+// StartTelemetryLoop writes a telemetry record to the analytics store every interval seconds
+func StartTelemetryLoop(interval int) {
+	if interval < 1 {
+		interval = 60
+	}
+
+	log.Info("Self telemetry enabled, recording every ", interval, " seconds")
+	for {
+		time.Sleep(time.Duration(interval) * time.Second)
+		thisRecord := Telemetry.GenerateRecord(measureRedisLatency(analytics.Store))
+		analytics.RecordHit(thisRecord)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTelemetryRecord(t *testing.T) {
+	thisTelemetry := &GatewayTelemetry{apiCounts: make(map[string]*int64), lastRecord: time.Now()}
+	thisTelemetry.Inc("api-1")
+	thisTelemetry.Inc("api-1")
+	thisTelemetry.Inc("api-2")
+
+	thisRecord := thisTelemetry.GenerateRecord(1500 * time.Microsecond)
+	if thisRecord.APIID != TELEMETRY_API_ID {
+		t.Error("Record should use the reserved API ID, got: ", thisRecord.APIID)
+	}
+
+	expectedTags := []string{"requests-3", "redis_latency_us-1500", "api_requests-api-1-2", "api_requests-api-2-1"}
+	for _, expected := range expectedTags {
+		found := false
+		for _, tag := range thisRecord.Tags {
+			if tag == expected {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Error("Tag not found: ", expected, " in ", thisRecord.Tags)
+		}
+	}
+
+	// Counts are reset after each record
+	thisRecord = thisTelemetry.GenerateRecord(0)
+	for _, tag := range thisRecord.Tags {
+		if tag == "requests-0" {
+			return
+		}
+	}
+	t.Error("Counts were not reset: ", thisRecord.Tags)
+}
@@ -8,7 +8,9 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"github.com/gorilla/context"
+	"github.com/mitchellh/mapstructure"
 	"github.com/pmylund/go-cache"
 	"io"
 	"io/ioutil"
@@ -23,6 +25,9 @@ import (
 
 var ServiceCache *cache.Cache
 
+// ErrUpstreamConnLimit is returned when an API already has max_upstream_connections open to its upstream
+var ErrUpstreamConnLimit = errors.New("Upstream connection limit reached")
+
 func GetURLFromService(spec *APISpec) (interface{}, error) {
 	sd := ServiceDiscovery{}
 	sd.New(spec)
@@ -143,7 +148,20 @@ func TykNewSingleHostReverseProxy(target *url.URL, spec *APISpec) *ReverseProxy
 		}
 	}
 
-	return &ReverseProxy{Director: director, TykAPISpec: spec, FlushInterval: time.Duration(config.HttpServerOptions.FlushInterval) * time.Second}
+	thisProxy := &ReverseProxy{
+		Director:        director,
+		TykAPISpec:      spec,
+		FlushInterval:   time.Duration(config.HttpServerOptions.FlushInterval) * time.Second,
+		TransportConfig: GetProxyTransportConfig(spec),
+		RetryConfig:     GetProxyRetryConfig(spec),
+	}
+
+	if thisProxy.TransportConfig.MaxConnections > 0 {
+		log.Info("Limiting upstream connections to: ", thisProxy.TransportConfig.MaxConnections)
+		thisProxy.connSlots = make(chan bool, thisProxy.TransportConfig.MaxConnections)
+	}
+
+	return thisProxy
 }
 
 // onExitFlushLoop is a callback set by tests to detect the state of the
@@ -170,38 +188,211 @@ type ReverseProxy struct {
 	// If zero, no periodic flushing is done.
 	FlushInterval time.Duration
 
+	// TransportConfig holds the connection pool and timeout settings
+	// used when Transport is not set.
+	TransportConfig ProxyTransportConfig
+
+	// RetryConfig sets up retries of failed upstream requests
+	RetryConfig ProxyRetryConfig
+
 	TykAPISpec      *APISpec
 	ErrorHandler    ErrorHandler
 	ResponseHandler ResponseChain
+
+	transports    map[int]http.RoundTripper
+	transportLock sync.Mutex
+	connSlots     chan bool
+}
+
+// ProxyTransportModuleConfig lets an API definition override the global proxy_transport settings
+type ProxyTransportModuleConfig struct {
+	ProxyTransport ProxyTransportConfig `mapstructure:"proxy_transport" bson:"proxy_transport" json:"proxy_transport"`
 }
 
-var TykDefaultTransport http.RoundTripper = &http.Transport{
-	Proxy: http.ProxyFromEnvironment,
-	Dial: (&net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).Dial,
-	TLSHandshakeTimeout: 10 * time.Second,
+// GetProxyTransportConfig merges the per-API transport settings over the global ones, unset values
+// fall back to the gateway config and then to sane defaults
+func GetProxyTransportConfig(spec *APISpec) ProxyTransportConfig {
+	thisConf := config.ProxyTransport
+
+	if spec != nil {
+		var thisModuleConfig ProxyTransportModuleConfig
+		err := mapstructure.Decode(spec.APIDefinition.RawData, &thisModuleConfig)
+		if err != nil {
+			log.Error("Failed to decode proxy transport configuration: ", err)
+		} else {
+			apiConf := thisModuleConfig.ProxyTransport
+			if apiConf.MaxIdleConnsPerHost > 0 {
+				thisConf.MaxIdleConnsPerHost = apiConf.MaxIdleConnsPerHost
+			}
+			if apiConf.IdleConnTimeout > 0 {
+				thisConf.IdleConnTimeout = apiConf.IdleConnTimeout
+			}
+			if apiConf.DialTimeout > 0 {
+				thisConf.DialTimeout = apiConf.DialTimeout
+			}
+			if apiConf.ResponseHeaderTimeout > 0 {
+				thisConf.ResponseHeaderTimeout = apiConf.ResponseHeaderTimeout
+			}
+			if apiConf.TLSHandshakeTimeout > 0 {
+				thisConf.TLSHandshakeTimeout = apiConf.TLSHandshakeTimeout
+			}
+			if apiConf.MaxConnections > 0 {
+				thisConf.MaxConnections = apiConf.MaxConnections
+				thisConf.MaxConnectionsWait = apiConf.MaxConnectionsWait
+			}
+		}
+	}
+
+	if thisConf.MaxIdleConnsPerHost == 0 {
+		thisConf.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	if thisConf.DialTimeout == 0 {
+		thisConf.DialTimeout = 30
+	}
+	if thisConf.TLSHandshakeTimeout == 0 {
+		thisConf.TLSHandshakeTimeout = 10
+	}
+	if thisConf.MaxConnections > 0 && thisConf.MaxIdleConnsPerHost > thisConf.MaxConnections {
+		// No point keeping more idle connections around than we are allowed to open
+		thisConf.MaxIdleConnsPerHost = thisConf.MaxConnections
+	}
+	if thisConf.MaxConnections > 0 && thisConf.IdleConnTimeout == 0 {
+		// Idle connections hold their slot, they must not be kept forever
+		thisConf.IdleConnTimeout = 90
+	}
+
+	return thisConf
 }
 
-func GetTransport(timeOut int) http.RoundTripper {
+// GetTransport builds an upstream transport from the transport config, if a hard timeout is
+// set for the endpoint it takes precedence over the dial and response header timeouts
+func GetTransport(timeOut int, thisConf ProxyTransportConfig) http.RoundTripper {
+	dialTimeout := thisConf.DialTimeout
+	responseHeaderTimeout := thisConf.ResponseHeaderTimeout
+
 	if timeOut > 0 {
 		log.Debug("Setting timeout for outbound request to: ", timeOut)
-		var ModifiedTransport http.RoundTripper = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   time.Duration(timeOut) * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			ResponseHeaderTimeout: time.Duration(timeOut) * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
+		dialTimeout = timeOut
+		responseHeaderTimeout = timeOut
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   time.Duration(dialTimeout) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		MaxIdleConnsPerHost:   thisConf.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(thisConf.IdleConnTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(responseHeaderTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(thisConf.TLSHandshakeTimeout) * time.Second,
+	}
+}
+
+// getTransport returns a pooled transport for the given timeout, transports are created once and
+// re-used so that upstream connections are kept alive between requests
+func (p *ReverseProxy) getTransport(timeOut int) http.RoundTripper {
+	p.transportLock.Lock()
+	defer p.transportLock.Unlock()
+
+	if p.transports == nil {
+		p.transports = make(map[int]http.RoundTripper)
+	}
+
+	thisTransport, found := p.transports[timeOut]
+	if !found {
+		thisTransport = GetTransport(timeOut, p.TransportConfig)
+		if p.connSlots != nil {
+			// All the transports of the API share its connection slots
+			httpTransport := thisTransport.(*http.Transport)
+			httpTransport.Dial = p.limitDial(httpTransport.Dial)
+		}
+		p.transports[timeOut] = thisTransport
+	}
+
+	return thisTransport
+}
+
+// acquireConnSlot blocks until an upstream connection slot is free, if none frees up within
+// max_upstream_connections_wait seconds the request is shed
+func (p *ReverseProxy) acquireConnSlot() bool {
+	if p.connSlots == nil {
+		return true
+	}
+
+	select {
+	case p.connSlots <- true:
+		return true
+	default:
+	}
+
+	// Kept alive connections that aren't in use give up their slots first
+	p.closeIdleConns()
+	select {
+	case p.connSlots <- true:
+		return true
+	default:
+	}
+
+	if p.TransportConfig.MaxConnectionsWait <= 0 {
+		return false
+	}
+
+	select {
+	case p.connSlots <- true:
+		return true
+	case <-time.After(time.Duration(p.TransportConfig.MaxConnectionsWait) * time.Second):
+		return false
+	}
+}
+
+// closeIdleConns closes the idle connections of all the transports of the API, which frees their slots
+func (p *ReverseProxy) closeIdleConns() {
+	p.transportLock.Lock()
+	defer p.transportLock.Unlock()
+
+	for _, thisTransport := range p.transports {
+		if httpTransport, ok := thisTransport.(*http.Transport); ok {
+			httpTransport.CloseIdleConnections()
+		}
+	}
+}
+
+func (p *ReverseProxy) releaseConnSlot() {
+	if p.connSlots != nil {
+		<-p.connSlots
+	}
+}
+
+// limitDial caps the connections open to the upstream, a connection holds its slot until it is
+// closed so requests re-using a kept alive connection don't need a slot
+func (p *ReverseProxy) limitDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		if !p.acquireConnSlot() {
+			return nil, ErrUpstreamConnLimit
 		}
 
-		return ModifiedTransport
+		conn, err := dial(network, addr)
+		if err != nil {
+			p.releaseConnSlot()
+			return nil, err
+		}
 
+		return &slotConn{Conn: conn, release: p.releaseConnSlot}, nil
 	}
+}
+
+// slotConn frees its connection slot once, when it is closed
+type slotConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
 
-	return TykDefaultTransport
+func (c *slotConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
 }
 
 func singleJoiningSlash(a, b string) string {
@@ -238,7 +429,7 @@ func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
 			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 		}
 	}
-	return &ReverseProxy{Director: director, FlushInterval: 1 * time.Second}
+	return &ReverseProxy{Director: director, FlushInterval: 1 * time.Second, TransportConfig: GetProxyTransportConfig(nil)}
 }
 
 func copyHeader(dst, src http.Header) {
@@ -304,6 +495,12 @@ func (p *ReverseProxy) CheckHardTimeoutEnforced(spec *APISpec, req *http.Request
 	return false, 0
 }
 
+// isUpstreamTimeout checks if a round trip failed because the upstream connected but didn't respond in
+// time. Dial and TLS handshake timeouts are connection failures, not a timeout of the upstream service
+func isUpstreamTimeout(err error) bool {
+	return strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
 func (p *ReverseProxy) CheckCircuitBreakerEnforced(spec *APISpec, req *http.Request) (bool, *ExtendedCircuitBreakerMeta) {
 	var stat RequestStatus
 	var meta interface{}
@@ -326,10 +523,20 @@ func (p *ReverseProxy) CheckCircuitBreakerEnforced(spec *APISpec, req *http.Requ
 
 func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Request, withCache bool) *http.Response {
 	transport := p.Transport
+	var timeoutEnforced bool
+	var timeout int
 	if transport == nil {
 		// 1. Check if timeouts are set for this endpoint
-		_, timeout := p.CheckHardTimeoutEnforced(p.TykAPISpec, req)
-		transport = GetTransport(timeout)
+		timeoutEnforced, timeout = p.CheckHardTimeoutEnforced(p.TykAPISpec, req)
+		transport = p.getTransport(timeout)
+	}
+
+	if config.HeaderHardening.Enabled {
+		if err := checkHeaderLimits(req.Header, config.HeaderHardening); err != nil {
+			log.Warning(err, ", rejecting request for: ", req.URL.Path)
+			p.ErrorHandler.HandleError(rw, req, err.Error(), 431)
+			return nil
+		}
 	}
 
 	// Do this before we make a shallow copy
@@ -342,6 +549,30 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	*logreq = *req
 
 	p.Director(outreq)
+
+	// URL rewrites can send the request to another API on this gateway
+	if rewriteTarget, ok := context.Get(req, URLRewriteTarget).(*url.URL); ok {
+		outreq.URL.Scheme = rewriteTarget.Scheme
+		outreq.URL.Host = rewriteTarget.Host
+		outreq.URL.Path = rewriteTarget.Path
+		if rewriteTarget.RawQuery != "" {
+			if outreq.URL.RawQuery == "" {
+				outreq.URL.RawQuery = rewriteTarget.RawQuery
+			} else {
+				outreq.URL.RawQuery = rewriteTarget.RawQuery + "&" + outreq.URL.RawQuery
+			}
+		}
+	}
+
+	if isInternalURL(outreq.URL) {
+		if p.Transport == nil {
+			transport = InternalTransport{}
+		}
+		outreq.Host = req.Host
+	} else if outreq.Header.Get(INTERNAL_HOPS_HEADER) != "" {
+		outreq.Header.Del(INTERNAL_HOPS_HEADER)
+	}
+
 	outreq.Proto = "HTTP/1.1"
 	outreq.ProtoMajor = 1
 	outreq.ProtoMinor = 1
@@ -367,6 +598,18 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 		}
 	}
 
+	if config.HeaderHardening.Enabled {
+		if !copiedHeaders {
+			outreq.Header = make(http.Header)
+			logreq.Header = make(http.Header)
+			copyHeader(outreq.Header, req.Header)
+			copyHeader(logreq.Header, req.Header)
+		}
+		connectionListed := connectionHeaders(req.Header)
+		hardenRequestHeaders(outreq.Header, connectionListed, config.HeaderHardening)
+		hardenRequestHeaders(logreq.Header, connectionListed, config.HeaderHardening)
+	}
+
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		// If we aren't the first proxy retain prior
 		// X-Forwarded-For information as a comma+space
@@ -389,7 +632,7 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	if breakerEnforced {
 		log.Debug("ON REQUEST: Breaker status: ", breakerConf.CB.Ready())
 		if breakerConf.CB.Ready() {
-			res, err = transport.RoundTrip(outreq)
+			res, err = p.roundTripWithRetries(transport, outreq, isStreamingRequest(req))
 			if err != nil {
 				breakerConf.CB.Fail()
 			} else if res.StatusCode == 500 {
@@ -402,13 +645,34 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 			return nil
 		}
 	} else {
-		res, err = transport.RoundTrip(outreq)
+		res, err = p.roundTripWithRetries(transport, outreq, isStreamingRequest(req))
+	}
+
+	// Failures of the upstream itself, rejections by the gateway are counted as blocked requests
+	if err != nil || res.StatusCode >= 500 {
+		ReportHealthCheckValue(p.TykAPISpec.Health, UpstreamError, "1")
+	}
+
+	// 5xx responses made by the gateway are counted by the error handler
+	if err == nil && res.StatusCode >= 500 {
+		ReportHealthCheckValue(p.TykAPISpec.Health, ServerError, "1")
 	}
 
 	if err != nil {
 		log.Error("http: proxy error: ", err)
-		if strings.Contains(err.Error(), "timeout awaiting response headers") {
-			p.ErrorHandler.HandleError(rw, logreq, "Upstream service reached hard timeout.", 408)
+		if isUpstreamTimeout(err) {
+			if timeoutEnforced {
+				go p.TykAPISpec.FireEvent(EVENT_HardTimeout,
+					EVENT_HardTimeoutMeta{
+						EventMetaDefault: EventMetaDefault{Message: "Upstream service reached hard timeout.", OriginatingRequest: EncodeRequestToEvent(p.TykAPISpec.LogMasking.MaskRequest(logreq)), TykContext: eventContextVars(logreq, p.TykAPISpec)},
+						Path:             req.URL.Path,
+						Origin:           GetIPFromRequest(req),
+						APIID:            p.TykAPISpec.APIID,
+						Timeout:          timeout,
+					})
+			}
+
+			p.ErrorHandler.HandleError(rw, logreq, "Upstream service reached hard timeout.", 504)
 
 			if p.TykAPISpec.Proxy.ServiceDiscovery.UseDiscoveryService {
 				if ServiceCache != nil {
@@ -418,6 +682,19 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 			}
 			return nil
 		}
+		if err == ErrUpstreamConnLimit {
+			log.Warning("Upstream connection limit reached, shedding request for: ", req.URL.Path)
+			p.ErrorHandler.HandleError(rw, logreq, "Upstream connection limit reached.", 503)
+			return nil
+		}
+		if err == ErrInternalAPILoop {
+			p.ErrorHandler.HandleError(rw, logreq, err.Error(), 508)
+			return nil
+		}
+		if err == ErrInternalAPINotFound {
+			p.ErrorHandler.HandleError(rw, logreq, err.Error(), 502)
+			return nil
+		}
 		if strings.Contains(err.Error(), "no such host") {
 			p.ErrorHandler.HandleError(rw, logreq, "Upstream host lookup failed", 500)
 			return nil
@@ -429,8 +706,13 @@ func (p *ReverseProxy) WrappedServeHTTP(rw http.ResponseWriter, req *http.Reques
 	}
 
 	inres := new(http.Response)
-	if withCache {
-		*inres = *res // includes shallow copies of maps, but okay
+	if withCache && isEventStream(res) {
+		inres = nil
+	} else if withCache {
+		*inres = *res
+		// The response chain can rewrite the headers (e.g. compression), the cached copy keeps its own
+		inres.Header = make(http.Header)
+		copyHeader(inres.Header, res.Header)
 
 		defer res.Body.Close()
 
@@ -484,7 +766,15 @@ func (p *ReverseProxy) HandleResponse(rw http.ResponseWriter, res *http.Response
 	copyHeader(rw.Header(), res.Header)
 
 	rw.WriteHeader(res.StatusCode)
-	p.copyResponse(rw, res.Body)
+	if isEventStream(res) {
+		// Events are flushed as they arrive rather than on the flush interval
+		startEventStream(req)
+		p.copyStreamingResponse(rw, res.Body)
+	} else if isStreamingRequest(req) {
+		p.copyStreamingResponse(rw, res.Body)
+	} else {
+		p.copyResponse(rw, res.Body)
+	}
 	return nil
 }
 
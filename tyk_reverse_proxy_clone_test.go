@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dialTimeoutError is a connection timeout, as returned when the upstream can't be reached
+type dialTimeoutError struct{}
+
+func (dialTimeoutError) Error() string   { return "dial tcp 10.0.0.1:80: i/o timeout" }
+func (dialTimeoutError) Timeout() bool   { return true }
+func (dialTimeoutError) Temporary() bool { return true }
+
+func TestIsUpstreamTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(1500 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	req, _ := http.NewRequest("GET", upstream.URL, nil)
+	_, err := GetTransport(1, ProxyTransportConfig{}).RoundTrip(req)
+	if err == nil {
+		t.Fatal("Expected the hard timeout to be hit")
+	}
+	if !isUpstreamTimeout(err) {
+		t.Error("A slow upstream should be reported as a timeout: ", err)
+	}
+
+	if isUpstreamTimeout(dialTimeoutError{}) {
+		t.Error("A dial timeout is a connection failure, not an upstream timeout")
+	}
+}
+
+func TestUpstreamConnectionLimit(t *testing.T) {
+	release := make(chan bool)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer upstream.Close()
+
+	thisProxy := &ReverseProxy{
+		TransportConfig: ProxyTransportConfig{MaxIdleConnsPerHost: 1, MaxConnections: 1},
+		connSlots:       make(chan bool, 1),
+	}
+	transport := thisProxy.getTransport(0)
+	roundTrip := func(path string) error {
+		req, _ := http.NewRequest("GET", upstream.URL+path, nil)
+		res, err := transport.RoundTrip(req)
+		if err == nil {
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// Requests in sequence re-use the kept alive connection, they don't need a slot each
+	for i := 0; i < 3; i++ {
+		if err := roundTrip("/fast"); err != nil {
+			t.Fatal("Request over the kept alive connection failed: ", err)
+		}
+	}
+
+	// While the only connection is busy no other connection can be opened
+	done := make(chan error)
+	go func() {
+		done <- roundTrip("/slow")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := roundTrip("/fast"); err != ErrUpstreamConnLimit {
+		t.Error("Expected the connection limit to be hit, got: ", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Error("Request holding the connection failed: ", err)
+	}
+}
+
+func TestUpstreamConnectionLimitClosesIdleConnections(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	thisProxy := &ReverseProxy{
+		TransportConfig: GetProxyTransportConfig(nil),
+		connSlots:       make(chan bool, 1),
+	}
+	thisProxy.TransportConfig.MaxConnections = 1
+
+	roundTrip := func(timeOut int) error {
+		req, _ := http.NewRequest("GET", upstream.URL, nil)
+		res, err := thisProxy.getTransport(timeOut).RoundTrip(req)
+		if err == nil {
+			ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// The idle connection of the first transport holds the only slot until it is closed
+	if err := roundTrip(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(5); err != nil {
+		t.Error("Idle connections should be closed before the request is shed: ", err)
+	}
+}
+
+func TestConnectionLimitSetsAnIdleTimeout(t *testing.T) {
+	spec := createDefinitionFromString(nonExpiringDef)
+	spec.APIDefinition.RawData = map[string]interface{}{
+		"proxy_transport": map[string]interface{}{"max_upstream_connections": 10},
+	}
+
+	oldConf := config.ProxyTransport
+	config.ProxyTransport = ProxyTransportConfig{}
+	defer func() { config.ProxyTransport = oldConf }()
+
+	if thisConf := GetProxyTransportConfig(&spec); thisConf.IdleConnTimeout == 0 {
+		t.Error("Idle connections should time out when the connections are capped")
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	USAGE_KEY_PREFIX  string = "usage-rollup."
+	USAGE_HOUR_FORMAT string = "2006010215"
+
+	UsageMetricRequests = "requests"
+	UsageMetricBytesIn  = "bytes_in"
+	UsageMetricBytesOut = "bytes_out"
+)
+
+// UsageExporterConfig configures a single usage exporter in tyk.conf
+type UsageExporterConfig struct {
+	Type   string `json:"type"`
+	CSVDir string `json:"csv_dir"`
+	URL    string `json:"url"`
+}
+
+// UsageRecord is the hourly rollup of a single key's usage of an API
+type UsageRecord struct {
+	Hour     string `json:"hour"`
+	APIID    string `json:"api_id"`
+	Key      string `json:"key"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// OrgUsageRecord is the hourly rollup of all the usage of an organisation
+type OrgUsageRecord struct {
+	Hour     string `json:"hour"`
+	OrgID    string `json:"org_id"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+// UsageStore is the storage a usage meter needs, rollups are kept in one Redis hash per hour
+type UsageStore interface {
+	IncrementHashFields(string, map[string]int64, int64) error
+	GetHash(string) map[string]string
+}
+
+// UsageMeter aggregates request and byte counts into hourly rollups
+type UsageMeter struct {
+	Store     UsageStore
+	Retention int64
+}
+
+// Metering is only set if usage metering is enabled
+var Metering *UsageMeter
+
+func usageHour(t time.Time) string {
+	return t.UTC().Format(USAGE_HOUR_FORMAT)
+}
+
+func usageField(APIID string, keyName string, metric string) string {
+	return APIID + "|" + keyName + "|" + metric
+}
+
+// usageOrgField names the org totals, they only have two parts so key rollups never include them
+func usageOrgField(OrgID string, metric string) string {
+	return "org:" + OrgID + "|" + metric
+}
+
+// Record adds a request to the rollups of the current hour, key names are stored as public hashes.
+// The totals of the organisation are only kept if OrgID is set
+func (u *UsageMeter) Record(OrgID string, APIID string, keyName string, bytesIn int64, bytesOut int64) {
+	if bytesIn < 0 {
+		bytesIn = 0
+	}
+
+	keyName = publicHash(keyName)
+	fields := map[string]int64{
+		usageField(APIID, keyName, UsageMetricRequests): 1,
+		usageField(APIID, keyName, UsageMetricBytesIn):  bytesIn,
+		usageField(APIID, keyName, UsageMetricBytesOut): bytesOut,
+	}
+
+	if OrgID != "" {
+		fields[usageOrgField(OrgID, UsageMetricRequests)] = 1
+		fields[usageOrgField(OrgID, UsageMetricBytesIn)] = bytesIn
+		fields[usageOrgField(OrgID, UsageMetricBytesOut)] = bytesOut
+	}
+
+	if err := u.Store.IncrementHashFields(usageHour(time.Now()), fields, u.Retention); err != nil {
+		log.Error("Failed to record usage: ", err)
+	}
+}
+
+// GetUsage returns the rollups for an hour, APIID and keyName are optional filters
+func (u *UsageMeter) GetUsage(hour time.Time, APIID string, keyName string) []UsageRecord {
+	thisHour := usageHour(hour)
+	if keyName != "" {
+		keyName = publicHash(keyName)
+	}
+
+	records := make(map[string]*UsageRecord)
+	for field, value := range u.Store.GetHash(thisHour) {
+		parts := strings.Split(field, "|")
+		if len(parts) != 3 {
+			continue
+		}
+
+		if (APIID != "" && parts[0] != APIID) || (keyName != "" && parts[1] != keyName) {
+			continue
+		}
+
+		thisRecord, ok := records[parts[0]+"|"+parts[1]]
+		if !ok {
+			thisRecord = &UsageRecord{Hour: thisHour, APIID: parts[0], Key: parts[1]}
+			records[parts[0]+"|"+parts[1]] = thisRecord
+		}
+
+		count, _ := strconv.ParseInt(value, 10, 64)
+		switch parts[2] {
+		case UsageMetricRequests:
+			thisRecord.Requests = count
+		case UsageMetricBytesIn:
+			thisRecord.BytesIn = count
+		case UsageMetricBytesOut:
+			thisRecord.BytesOut = count
+		}
+	}
+
+	recordIDs := []string{}
+	for recordID, _ := range records {
+		recordIDs = append(recordIDs, recordID)
+	}
+	sort.Strings(recordIDs)
+
+	usage := make([]UsageRecord, 0, len(recordIDs))
+	for _, recordID := range recordIDs {
+		usage = append(usage, *records[recordID])
+	}
+
+	return usage
+}
+
+// GetUsageRange returns the rollups of every hour between from and to (inclusive)
+func (u *UsageMeter) GetUsageRange(from time.Time, to time.Time, APIID string, keyName string) []UsageRecord {
+	usage := []UsageRecord{}
+	for thisHour := from.UTC().Truncate(time.Hour); !thisHour.After(to); thisHour = thisHour.Add(time.Hour) {
+		usage = append(usage, u.GetUsage(thisHour, APIID, keyName)...)
+	}
+
+	return usage
+}
+
+// GetOrgUsage returns the organisation totals for an hour, OrgID is an optional filter
+func (u *UsageMeter) GetOrgUsage(hour time.Time, OrgID string) []OrgUsageRecord {
+	thisHour := usageHour(hour)
+
+	records := make(map[string]*OrgUsageRecord)
+	for field, value := range u.Store.GetHash(thisHour) {
+		if !strings.HasPrefix(field, "org:") {
+			continue
+		}
+
+		parts := strings.Split(field[len("org:"):], "|")
+		if len(parts) != 2 || (OrgID != "" && parts[0] != OrgID) {
+			continue
+		}
+
+		thisRecord, ok := records[parts[0]]
+		if !ok {
+			thisRecord = &OrgUsageRecord{Hour: thisHour, OrgID: parts[0]}
+			records[parts[0]] = thisRecord
+		}
+
+		count, _ := strconv.ParseInt(value, 10, 64)
+		switch parts[1] {
+		case UsageMetricRequests:
+			thisRecord.Requests = count
+		case UsageMetricBytesIn:
+			thisRecord.BytesIn = count
+		case UsageMetricBytesOut:
+			thisRecord.BytesOut = count
+		}
+	}
+
+	orgIDs := []string{}
+	for thisOrgID, _ := range records {
+		orgIDs = append(orgIDs, thisOrgID)
+	}
+	sort.Strings(orgIDs)
+
+	usage := make([]OrgUsageRecord, 0, len(orgIDs))
+	for _, thisOrgID := range orgIDs {
+		usage = append(usage, *records[thisOrgID])
+	}
+
+	return usage
+}
+
+// GetOrgUsageRange returns the organisation totals of every hour between from and to (inclusive)
+func (u *UsageMeter) GetOrgUsageRange(from time.Time, to time.Time, OrgID string) []OrgUsageRecord {
+	usage := []OrgUsageRecord{}
+	for thisHour := from.UTC().Truncate(time.Hour); !thisHour.After(to); thisHour = thisHour.Add(time.Hour) {
+		usage = append(usage, u.GetOrgUsage(thisHour, OrgID)...)
+	}
+
+	return usage
+}
+
+// WriteOrgUsageCSV writes organisation totals with a header row
+func WriteOrgUsageCSV(w *csv.Writer, usage []OrgUsageRecord) error {
+	if err := w.Write([]string{"HOUR", "ORGID", "REQUESTS", "BYTES_IN", "BYTES_OUT"}); err != nil {
+		return err
+	}
+
+	for _, thisRecord := range usage {
+		err := w.Write([]string{
+			thisRecord.Hour,
+			thisRecord.OrgID,
+			strconv.FormatInt(thisRecord.Requests, 10),
+			strconv.FormatInt(thisRecord.BytesIn, 10),
+			strconv.FormatInt(thisRecord.BytesOut, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// UsageExporter sends completed hourly rollups to a billing system
+type UsageExporter interface {
+	Export([]UsageRecord) error
+}
+
+// UsageExporterTypes maps exporter types to their constructors, add to this to support other billing systems
+var UsageExporterTypes = map[string]func(UsageExporterConfig) (UsageExporter, error){
+	"csv":     NewCSVUsageExporter,
+	"webhook": NewWebhookUsageExporter,
+}
+
+// CSVUsageExporter writes each hour to its own file in CSVDir
+type CSVUsageExporter struct {
+	Dir string
+}
+
+func NewCSVUsageExporter(thisConf UsageExporterConfig) (UsageExporter, error) {
+	if thisConf.CSVDir == "" {
+		return nil, errors.New("CSV usage exporter needs a csv_dir")
+	}
+
+	return &CSVUsageExporter{Dir: thisConf.CSVDir}, nil
+}
+
+// WriteUsageCSV writes usage records with a header row
+func WriteUsageCSV(w *csv.Writer, usage []UsageRecord) error {
+	if err := w.Write([]string{"HOUR", "APIID", "KEY", "REQUESTS", "BYTES_IN", "BYTES_OUT"}); err != nil {
+		return err
+	}
+
+	for _, thisRecord := range usage {
+		err := w.Write([]string{
+			thisRecord.Hour,
+			thisRecord.APIID,
+			thisRecord.Key,
+			strconv.FormatInt(thisRecord.Requests, 10),
+			strconv.FormatInt(thisRecord.BytesIn, 10),
+			strconv.FormatInt(thisRecord.BytesOut, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func (c *CSVUsageExporter) Export(usage []UsageRecord) error {
+	if len(usage) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		return err
+	}
+
+	outfile, err := os.Create(filepath.Join(c.Dir, "usage-"+usage[0].Hour+".csv"))
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	return WriteUsageCSV(csv.NewWriter(outfile), usage)
+}
+
+// WebhookUsageExporter POSTs each hour to a URL as a JSON array
+type WebhookUsageExporter struct {
+	URL    string
+	client *http.Client
+}
+
+func NewWebhookUsageExporter(thisConf UsageExporterConfig) (UsageExporter, error) {
+	if thisConf.URL == "" {
+		return nil, errors.New("Webhook usage exporter needs a url")
+	}
+
+	return &WebhookUsageExporter{URL: thisConf.URL, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (wh *WebhookUsageExporter) Export(usage []UsageRecord) error {
+	if len(usage) == 0 {
+		return nil
+	}
+
+	asJSON, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wh.client.Post(wh.URL, "application/json", bytes.NewReader(asJSON))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return fmt.Errorf("Usage webhook returned status: %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// StartUsageExportLoop exports the previous hour once it is complete, exporters run on every node that
+// has them configured so they should only be enabled on one node
+func StartUsageExportLoop(exporterConfs []UsageExporterConfig) {
+	exporters := []UsageExporter{}
+	for _, thisConf := range exporterConfs {
+		constructor, ok := UsageExporterTypes[thisConf.Type]
+		if !ok {
+			log.Error("Unknown usage exporter type: ", thisConf.Type)
+			continue
+		}
+
+		thisExporter, err := constructor(thisConf)
+		if err != nil {
+			log.Error("Failed to create usage exporter: ", err)
+			continue
+		}
+		exporters = append(exporters, thisExporter)
+	}
+
+	if len(exporters) == 0 {
+		return
+	}
+
+	for {
+		// Wait for the hour to end, with a margin for requests that are still being recorded
+		now := time.Now().UTC()
+		nextHour := now.Truncate(time.Hour).Add(time.Hour)
+		time.Sleep(nextHour.Sub(now) + time.Minute)
+
+		exportUsage(exporters, nextHour.Add(-time.Hour))
+	}
+}
+
+func exportUsage(exporters []UsageExporter, hour time.Time) {
+	usage := Metering.GetUsage(hour, "", "")
+	log.Info("Exporting usage for ", usageHour(hour), ", records: ", len(usage))
+
+	var wg sync.WaitGroup
+	for _, thisExporter := range exporters {
+		wg.Add(1)
+		go func(thisExporter UsageExporter) {
+			defer wg.Done()
+			if err := thisExporter.Export(usage); err != nil {
+				log.Error("Usage export failed: ", err)
+			}
+		}(thisExporter)
+	}
+	wg.Wait()
+}
+
+// meteringResponseWriter counts the bytes written to the client
+type meteringResponseWriter struct {
+	http.ResponseWriter
+	bytesOut int64
+}
+
+func (m *meteringResponseWriter) Write(b []byte) (int, error) {
+	n, err := m.ResponseWriter.Write(b)
+	m.bytesOut += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses working when metering is on
+func (m *meteringResponseWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// meteringRequestBody counts the bytes of the request body read by the proxy
+type meteringRequestBody struct {
+	io.ReadCloser
+	bytesIn int64
+}
+
+func (m *meteringRequestBody) Read(b []byte) (int, error) {
+	n, err := m.ReadCloser.Read(b)
+	m.bytesIn += int64(n)
+	return n, err
+}
+
+// meterRequestBody wraps the body of a request, it returns nil if the request has no body
+func meterRequestBody(r *http.Request) *meteringRequestBody {
+	if r.Body == nil {
+		return nil
+	}
+
+	body := &meteringRequestBody{ReadCloser: r.Body}
+	r.Body = body
+	return body
+}
+
+// requestSize is the number of body bytes that were read, the declared length is used if the body
+// wasn't read (e.g. cached responses)
+func requestSize(r *http.Request, body *meteringRequestBody) int64 {
+	if body != nil && body.bytesIn > 0 {
+		return body.bytesIn
+	}
+
+	if r.ContentLength > 0 {
+		return r.ContentLength
+	}
+
+	return 0
+}
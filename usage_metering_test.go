@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockUsageStore struct {
+	hashes map[string]map[string]int64
+}
+
+func (m *mockUsageStore) IncrementHashFields(keyName string, fields map[string]int64, expire int64) error {
+	if m.hashes[keyName] == nil {
+		m.hashes[keyName] = make(map[string]int64)
+	}
+	for field, by := range fields {
+		m.hashes[keyName][field] += by
+	}
+	return nil
+}
+
+func (m *mockUsageStore) GetHash(keyName string) map[string]string {
+	values := make(map[string]string)
+	for field, value := range m.hashes[keyName] {
+		values[field] = strconv.FormatInt(value, 10)
+	}
+	return values
+}
+
+func TestUsageRollups(t *testing.T) {
+	thisMeter := &UsageMeter{Store: &mockUsageStore{hashes: make(map[string]map[string]int64)}}
+
+	thisMeter.Record("", "api-a", "key-1", 100, 1000)
+	thisMeter.Record("", "api-a", "key-1", -1, 500)
+	thisMeter.Record("", "api-b", "key-1", 10, 20)
+	thisMeter.Record("", "api-a", "key-2", 0, 5)
+
+	usage := thisMeter.GetUsage(time.Now(), "", "")
+	if len(usage) != 3 {
+		t.Fatal("Expected 3 rollups, got: ", len(usage))
+	}
+
+	keyOneUsage := thisMeter.GetUsage(time.Now(), "api-a", "key-1")
+	if len(keyOneUsage) != 1 {
+		t.Fatal("Filter by API and key failed: ", keyOneUsage)
+	}
+
+	if keyOneUsage[0].Requests != 2 || keyOneUsage[0].BytesIn != 100 || keyOneUsage[0].BytesOut != 1500 {
+		t.Error("Rollup counts are wrong: ", keyOneUsage[0])
+	}
+
+	if len(thisMeter.GetUsage(time.Now().Add(-time.Hour), "", "")) != 0 {
+		t.Error("Previous hour should have no usage")
+	}
+
+	if len(thisMeter.GetUsageRange(time.Now().Add(-2*time.Hour), time.Now(), "api-b", "")) != 1 {
+		t.Error("Range query should include the current hour")
+	}
+}
+
+func TestOrgUsageRollups(t *testing.T) {
+	thisMeter := &UsageMeter{Store: &mockUsageStore{hashes: make(map[string]map[string]int64)}}
+
+	thisMeter.Record("org-1", "api-a", "key-1", 100, 1000)
+	thisMeter.Record("org-1", "api-b", "key-2", 50, 500)
+	thisMeter.Record("org-2", "api-c", "key-3", 10, 20)
+
+	if len(thisMeter.GetUsage(time.Now(), "", "")) != 3 {
+		t.Error("Org totals shouldn't show up as key rollups")
+	}
+
+	usage := thisMeter.GetOrgUsage(time.Now(), "")
+	if len(usage) != 2 || usage[0].OrgID != "org-1" {
+		t.Fatal("Expected a rollup per org: ", usage)
+	}
+	if usage[0].Requests != 2 || usage[0].BytesIn != 150 || usage[0].BytesOut != 1500 {
+		t.Error("Org totals are wrong: ", usage[0])
+	}
+
+	if orgTwo := thisMeter.GetOrgUsageRange(time.Now().Add(-time.Hour), time.Now(), "org-2"); len(orgTwo) != 1 || orgTwo[0].BytesOut != 20 {
+		t.Error("Filter by org failed: ", orgTwo)
+	}
+}
+
+func TestWriteUsageCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteUsageCSV(csv.NewWriter(&buf), []UsageRecord{{"2015121713", "api-a", "abc", 2, 100, 1500}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[1] != "2015121713,api-a,abc,2,100,1500" {
+		t.Error("CSV output is wrong: ", buf.String())
+	}
+}
+
+func TestRequestSize(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("0123456789")))
+	req.ContentLength = -1
+
+	body := meterRequestBody(req)
+	if requestSize(req, body) != 0 {
+		t.Error("Chunked body that wasn't read has no known size")
+	}
+
+	ioutil.ReadAll(req.Body)
+	if requestSize(req, body) != 10 {
+		t.Error("Read bytes should be counted: ", requestSize(req, body))
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader("01234"))
+	if requestSize(req, nil) != 5 {
+		t.Error("Declared length should be used if the body wasn't read")
+	}
+}